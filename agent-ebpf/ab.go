@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// abConfig describes a comparison of two commits run against a time budget
+// rather than a fixed number of runs.
+type abConfig struct {
+	Agent    string
+	Scenario string
+	Impl     string
+	Variant  string
+	Dataset  string
+	Params   map[string]string
+
+	Baseline  string
+	Optimized string
+
+	// Order is the run order strategy of each pair: abba, abab or blocked,
+	// drawn from Seed.
+	Order string
+	Seed  int64
+
+	Budget time.Duration
+	// MinRuns is how many runs each side has before the first look; MaxRuns,
+	// when set, stops the comparison after that many pairs even with budget
+	// left.
+	MinRuns int
+	MaxRuns int
+
+	// Metric is an evidence measurement to compare; empty compares the run
+	// duration.
+	Metric       string
+	HigherBetter bool
+	ThresholdPct float64
+	Alpha        float64
+	// Record posts the runs to /report, recording the gain on the agent.
+	Record bool
+}
+
+// abSide is one side's runs so far.
+type abSide struct {
+	Commit string
+	RunIDs []string
+	Values []float64
+	Runs   []*Run
+}
+
+// abResult is how a comparison ended.
+type abResult struct {
+	Verdict string
+	Reason  string
+	// ChangePct is the optimized median's change from the baseline's; P is
+	// the last look's two-sided p-value and Spent the significance level
+	// spent up to it. CILowPct and CIHighPct bound the change at 1-alpha.
+	ChangePct float64
+	P         float64
+	Spent     float64
+	CILowPct  float64
+	CIHighPct float64
+	Looks     int
+	Elapsed   time.Duration
+}
+
+// abMaxFailures is how many jobs in a row may fail before the comparison
+// gives up.
+const abMaxFailures = 3
+
+type abTester struct {
+	cfg       abConfig
+	out       io.Writer
+	tag       string
+	baseline  abSide
+	optimized abSide
+}
+
+// run submits one job for the side and adds its value. The run is tagged
+// with the comparison, its order and, for a blocked order, the seed that
+// drew it, so the order can be made again from the runs alone.
+func (t *abTester) run(side *abSide) error {
+	tags := map[string]string{"ab": t.tag, "order": t.cfg.Order}
+	if t.cfg.Order == orderBlocked {
+		tags["seed"] = strconv.FormatInt(t.cfg.Seed, 10)
+	}
+	run, value, err := runScenarioJob(context.Background(), t.cfg.Agent, RunRequest{
+		Scenario: t.cfg.Scenario,
+		Impl:     t.cfg.Impl,
+		Variant:  t.cfg.Variant,
+		Commit:   side.Commit,
+		Dataset:  t.cfg.Dataset,
+		Params:   t.cfg.Params,
+		Tags:     tags,
+	}, t.cfg.Metric)
+	if err != nil {
+		return err
+	}
+	side.RunIDs = append(side.RunIDs, run.ID)
+	side.Values = append(side.Values, value)
+	side.Runs = append(side.Runs, run)
+	fmt.Fprintf(t.out, "%s: run %d: %g\n", short(side.Commit), len(side.Values), value)
+	return nil
+}
+
+// look tests the runs so far at significance level alpha. It reports a
+// verdict once the sides differ significantly by at least the threshold,
+// or once the interval of the change lies within the threshold either way,
+// so that no difference worth finding is left to find (futility).
+func (t *abTester) look(alpha float64) (r abResult, done bool) {
+	b, o := t.baseline.Values, t.optimized.Values
+	if base := median(b); base != 0 {
+		r.ChangePct = (median(o) - base) / base * 100
+	}
+	r.P = math.Min(1, 2*math.Min(mannWhitneyGreater(b, o), mannWhitneyGreater(o, b)))
+	// bootstrapGain gives the interval of the fall from baseline, the
+	// change's negation.
+	low, high := bootstrapGain(b, o, 1-t.cfg.Alpha)
+	r.CILowPct, r.CIHighPct = -high, -low
+
+	better := -r.ChangePct
+	if t.cfg.HigherBetter {
+		better = r.ChangePct
+	}
+	switch {
+	case r.P < alpha && math.Abs(r.ChangePct) >= t.cfg.ThresholdPct:
+		r.Verdict, r.Reason = comparisonImproved, reasonSignificant
+		if better < 0 {
+			r.Verdict = comparisonRegressed
+		}
+		return r, true
+	case r.CILowPct > -t.cfg.ThresholdPct && r.CIHighPct < t.cfg.ThresholdPct:
+		r.Verdict, r.Reason = comparisonNeutral, reasonBelowNoiseFloor
+		return r, true
+	}
+	return r, false
+}
+
+// runAB alternates baseline and optimized runs, in pairs ordered by the
+// configured strategy so drift falls on both sides alike, and looks at the
+// results after every pair from MinRuns a side on. Repeated looks would
+// inflate the false positive rate of a fixed-level test, so each look may
+// only spend the share of alpha that the budget time since the last look is
+// of the whole; the levels spent sum to at most alpha however many looks
+// there are. The comparison stops at the first verdict, or with an
+// inconclusive one when the next pair would not finish within the budget.
+func runAB(cfg abConfig, out io.Writer) (*abTester, *abResult, error) {
+	if err := requireFeature(context.Background(), cfg.Agent, "jobs"); err != nil {
+		return nil, nil, err
+	}
+	t := &abTester{
+		cfg:       cfg,
+		out:       out,
+		tag:       short(cfg.Baseline) + ".." + short(cfg.Optimized),
+		baseline:  abSide{Commit: cfg.Baseline},
+		optimized: abSide{Commit: cfg.Optimized},
+	}
+	fmt.Fprintf(out, "comparing %s with %s within %s, %s order", short(cfg.Baseline), short(cfg.Optimized), cfg.Budget, cfg.Order)
+	if cfg.Order == orderBlocked {
+		fmt.Fprintf(out, " (seed %d)", cfg.Seed)
+	}
+	fmt.Fprintln(out)
+	rng := rand.New(rand.NewSource(cfg.Seed))
+
+	began := time.Now()
+	var longest, lastLook time.Duration
+	var result abResult
+	failures := 0
+	for pair := 0; cfg.MaxRuns == 0 || pair < cfg.MaxRuns; pair++ {
+		if elapsed := time.Since(began); elapsed+longest > cfg.Budget {
+			break
+		}
+		pairBegan := time.Now()
+		for _, i := range roundOrder(cfg.Order, pair, 2, rng) {
+			side := []*abSide{&t.baseline, &t.optimized}[i]
+			if err := t.run(side); err != nil {
+				failures++
+				fmt.Fprintf(out, "%s: run failed: %v\n", short(side.Commit), err)
+				if failures >= abMaxFailures {
+					return t, nil, fmt.Errorf("%d runs in a row failed", failures)
+				}
+				continue
+			}
+			failures = 0
+		}
+		if took := time.Since(pairBegan); took > longest {
+			longest = took
+		}
+		if len(t.baseline.Values) < cfg.MinRuns || len(t.optimized.Values) < cfg.MinRuns {
+			continue
+		}
+
+		elapsed := time.Since(began)
+		spend := cfg.Alpha * math.Min(1, float64(elapsed-lastLook)/float64(cfg.Budget))
+		lastLook = elapsed
+		spent := result.Spent + spend
+		r, done := t.look(spend)
+		r.Spent, r.Looks = spent, result.Looks+1
+		result = r
+		fmt.Fprintf(out, "look %d: %+.1f%% (p=%.4f at level %.4f, %.0f%% interval %+.1f%% to %+.1f%%)\n",
+			result.Looks, r.ChangePct, r.P, spend, (1-cfg.Alpha)*100, r.CILowPct, r.CIHighPct)
+		if done {
+			result.Elapsed = time.Since(began)
+			return t, &result, nil
+		}
+	}
+	if result.Looks == 0 {
+		return t, nil, fmt.Errorf("the budget ran out before %d runs a side", cfg.MinRuns)
+	}
+	result.Verdict, result.Reason = comparisonNeutral, reasonInsufficientSamples
+	result.Elapsed = time.Since(began)
+	return t, &result, nil
+}
+
+func newABCmd() *cobra.Command {
+	cfg := abConfig{}
+
+	cmd := &cobra.Command{
+		Use:   "ab <baseline> <optimized>",
+		Short: "Compare two commits within a time budget, stopping once the answer is clear",
+		Long: "Runs the scenario as jobs on --agent for the baseline and optimized commits in\n" +
+			"pairs ordered by --order, and after every pair from --min-runs a side on\n" +
+			"tests the runs so far: a two-sided Mann-Whitney test significant at its share\n" +
+			"of --alpha with a change of at least --threshold percent ends it improved or\n" +
+			"regressed, and a confidence interval of the change within --threshold either\n" +
+			"way ends it neutral. Each look spends the part of --alpha that the time since\n" +
+			"the last look is of --time-budget, so looking often does not inflate false\n" +
+			"positives. When the next pair would not fit in the budget, the comparison\n" +
+			"ends inconclusive. Every run is tagged with the order. The scenario's\n" +
+			"adapter for --impl must run the commit given, e.g. through a build section\n" +
+			"or a path with {{.Commit}} in it.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Baseline, cfg.Optimized = args[0], args[1]
+			if cfg.Scenario == "" {
+				return fmt.Errorf("--scenario is required")
+			}
+			if cfg.Budget <= 0 {
+				return fmt.Errorf("--time-budget is required")
+			}
+			if cfg.MinRuns < 3 {
+				return fmt.Errorf("--min-runs must be at least 3 for the test to mean anything")
+			}
+			if cfg.MaxRuns != 0 && cfg.MaxRuns < cfg.MinRuns {
+				return fmt.Errorf("--max-runs must be at least --min-runs")
+			}
+			if cfg.Alpha <= 0 || cfg.Alpha >= 1 {
+				return fmt.Errorf("--alpha must be between 0 and 1")
+			}
+			if err := validateOrder(cfg.Order, orderABBA, orderABAB, orderBlocked); err != nil {
+				return fmt.Errorf("--%w", err)
+			}
+			cfg.Seed = orderSeed(cfg.Seed)
+			out := cmd.OutOrStdout()
+			t, r, err := runAB(cfg, out)
+			if err != nil {
+				return err
+			}
+
+			verdict := r.Verdict + " (" + r.Reason + ")"
+			if r.Reason == reasonInsufficientSamples {
+				verdict = "inconclusive: the budget ran out"
+			}
+			fmt.Fprintf(out, "\n%s after %d+%d runs in %s\n", verdict,
+				len(t.baseline.Values), len(t.optimized.Values), r.Elapsed.Round(time.Second))
+			fmt.Fprintf(out, "median %g vs %g (%+.1f%%, p=%.4f, alpha spent %.4f)\n",
+				median(t.baseline.Values), median(t.optimized.Values), r.ChangePct, r.P, r.Spent)
+			b, o := t.baseline.Values, t.optimized.Values
+			delta := cliffsDelta(o, b)
+			fmt.Fprintf(out, "effect of optimized: Cliff's delta %+.2f (%s), Hedges' g %+.2f; smallest detectable change %.1f%% at %.0f%% power\n",
+				delta, cliffsMagnitude(delta), hedgesG(o, b), minDetectablePct(b, o, cfg.Alpha, gainPower), gainPower*100)
+			for _, side := range []*abSide{&t.baseline, &t.optimized} {
+				if drift, err := runSetDrift(side.Runs, driftDefaultThreshold); err == nil && drift.Drifting {
+					fmt.Fprintf(out, "warning: %s drifted: %s\n", short(side.Commit), strings.Join(drift.summary(), "; "))
+				}
+			}
+
+			if cfg.Record {
+				var gain GainReport
+				err := agentCall(context.Background(), http.MethodPost, strings.TrimSuffix(cfg.Agent, "/")+"/report", map[string]interface{}{
+					"impl":           cfg.Impl,
+					"variant":        cfg.Variant,
+					"commit":         cfg.Optimized,
+					"dataset":        cfg.Dataset,
+					"baseline_runs":  t.baseline.RunIDs,
+					"optimized_runs": t.optimized.RunIDs,
+				}, &gain)
+				if err != nil {
+					return fmt.Errorf("recording the gain: %w", err)
+				}
+				fmt.Fprintf(out, "recorded gain %s: %+.1f%% (%s)\n", gain.ID, gain.GainPct, gain.Verdict)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&cfg.Agent, "agent", "http://localhost:9090", "Agent that runs the scenario jobs")
+	cmd.Flags().StringVar(&cfg.Scenario, "scenario", "", "Scenario to run")
+	cmd.Flags().StringVar(&cfg.Impl, "impl", "", "Impl whose adapter runs the commits")
+	cmd.Flags().StringVar(&cfg.Variant, "variant", "", "Variant label for the runs")
+	cmd.Flags().StringVar(&cfg.Dataset, "dataset", "", "Dataset label for the runs")
+	cmd.Flags().StringToStringVar(&cfg.Params, "param", nil, "Scenario param for the runs, as name=value (repeatable)")
+	cmd.Flags().StringVar(&cfg.Order, "order", orderABBA, "Run order of each pair: abba (swap who goes first each pair), abab or blocked (random each pair)")
+	cmd.Flags().Int64Var(&cfg.Seed, "seed", 0, "Seed of the blocked order (0: a new one, printed)")
+	cmd.Flags().DurationVar(&cfg.Budget, "time-budget", 0, "Most time the comparison may take, e.g. 2h")
+	cmd.Flags().IntVar(&cfg.MinRuns, "min-runs", 5, "Runs per side before the first look")
+	cmd.Flags().IntVar(&cfg.MaxRuns, "max-runs", 0, "Most runs per side (0: as many as the budget allows)")
+	cmd.Flags().StringVar(&cfg.Metric, "metric", "", "Measurement to compare instead of the run duration")
+	cmd.Flags().BoolVar(&cfg.HigherBetter, "higher-is-better", false, "The metric is a rate, so a rise is an improvement")
+	cmd.Flags().Float64Var(&cfg.ThresholdPct, "threshold", 2, "Smallest change in percent worth finding")
+	cmd.Flags().Float64Var(&cfg.Alpha, "alpha", 0.05, "Significance level of the whole comparison")
+	cmd.Flags().BoolVar(&cfg.Record, "record", false, "Record the gain of the runs' durations on the agent")
+
+	return cmd
+}
@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+func TestABLook(t *testing.T) {
+	steady := []float64{100, 100.2, 99.8, 100.1, 99.9, 100, 100.3, 99.7}
+	tests := []struct {
+		name                string
+		baseline, optimized []float64
+		higherBetter        bool
+		level               float64
+		done                bool
+		verdict, reason     string
+	}{
+		{
+			name:      "faster",
+			baseline:  []float64{6, 7, 8, 9, 10},
+			optimized: []float64{1, 2, 3, 4, 5},
+			level:     0.05,
+			done:      true,
+			verdict:   comparisonImproved,
+			reason:    reasonSignificant,
+		},
+		{
+			name:         "lower throughput",
+			baseline:     []float64{6, 7, 8, 9, 10},
+			optimized:    []float64{1, 2, 3, 4, 5},
+			higherBetter: true,
+			level:        0.05,
+			done:         true,
+			verdict:      comparisonRegressed,
+			reason:       reasonSignificant,
+		},
+		{
+			// The same runs at the small share of alpha an early look
+			// may spend: p = 0.0122 is not enough yet.
+			name:      "early look",
+			baseline:  []float64{6, 7, 8, 9, 10},
+			optimized: []float64{1, 2, 3, 4, 5},
+			level:     0.01,
+		},
+		{
+			name:      "no change",
+			baseline:  steady,
+			optimized: steady,
+			level:     0.05,
+			done:      true,
+			verdict:   comparisonNeutral,
+			reason:    reasonBelowNoiseFloor,
+		},
+		{
+			// Significant, but a fraction of the threshold.
+			name:      "below threshold",
+			baseline:  steady,
+			optimized: []float64{99.5, 99.7, 99.3, 99.6, 99.4, 99.5, 99.8, 99.2},
+			level:     0.05,
+			done:      true,
+			verdict:   comparisonNeutral,
+			reason:    reasonBelowNoiseFloor,
+		},
+		{
+			name:      "too noisy",
+			baseline:  []float64{100, 130, 80},
+			optimized: []float64{95, 125, 70},
+			level:     0.05,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tester := &abTester{
+				cfg:       abConfig{Alpha: 0.05, ThresholdPct: 2, HigherBetter: tt.higherBetter},
+				baseline:  abSide{Values: tt.baseline},
+				optimized: abSide{Values: tt.optimized},
+			}
+			r, done := tester.look(tt.level)
+			if done != tt.done || r.Verdict != tt.verdict || r.Reason != tt.reason {
+				t.Errorf("look = %q/%q (done %v), want %q/%q (done %v); p=%g change %+.2f%% interval %+.2f%% to %+.2f%%",
+					r.Verdict, r.Reason, done, tt.verdict, tt.reason, tt.done, r.P, r.ChangePct, r.CILowPct, r.CIHighPct)
+			}
+			if r.CILowPct > r.ChangePct || r.ChangePct > r.CIHighPct {
+				t.Errorf("interval %+.2f%% to %+.2f%% does not hold the change %+.2f%%", r.CILowPct, r.CIHighPct, r.ChangePct)
+			}
+		})
+	}
+}
+
+func TestABLookValues(t *testing.T) {
+	tester := &abTester{
+		cfg:       abConfig{Alpha: 0.05, ThresholdPct: 2},
+		baseline:  abSide{Values: []float64{6, 7, 8, 9, 10}},
+		optimized: abSide{Values: []float64{1, 2, 3, 4, 5}},
+	}
+	r, _ := tester.look(0.05)
+	// Twice the one-sided Mann-Whitney p of the separated samples.
+	if !near(r.P, 0.012185780, 1e-8) {
+		t.Errorf("p = %.9f, want 0.012185780", r.P)
+	}
+	if !near(r.ChangePct, -62.5, 1e-12) {
+		t.Errorf("change = %g%%, want -62.5%%", r.ChangePct)
+	}
+}
+
+func TestRoundOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		want  [][]int
+	}{
+		{orderABBA, [][]int{{0, 1}, {1, 0}, {0, 1}, {1, 0}}},
+		{orderABAB, [][]int{{0, 1}, {0, 1}, {0, 1}, {0, 1}}},
+	}
+	for _, tt := range tests {
+		for round, want := range tt.want {
+			got := roundOrder(tt.order, round, 2, nil)
+			if got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("%s round %d = %v, want %v", tt.order, round, got, want)
+			}
+		}
+	}
+}
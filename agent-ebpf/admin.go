@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Operators take an agent out of rotation before patching its kernel.
+// Draining refuses new sessions and jobs, leaves queued jobs queued, and
+// lets the current session or job finish. Maintenance does the same and is
+// saved to <dataDir>/maintenance.json, so the agent stays out of rotation
+// across the reboot until an operator ends it.
+const (
+	modeActive      = "active"
+	modeDraining    = "draining"
+	modeMaintenance = "maintenance"
+)
+
+// AdminStatus is the agent's mode, and whether it still has work in hand.
+type AdminStatus struct {
+	Mode   string    `json:"mode"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	// Busy is true while a session collects or a job builds or runs;
+	// Drained once a draining agent has none left.
+	Busy    bool `json:"busy"`
+	Drained bool `json:"drained"`
+	Queued  int  `json:"queued"`
+}
+
+type adminState struct {
+	mu     sync.Mutex
+	path   string
+	mode   string
+	reason string
+	since  time.Time
+	// resumed is closed when the agent returns to active.
+	resumed chan struct{}
+}
+
+var admin = &adminState{mode: modeActive}
+
+// drainPoll is how often a drain waiting for idle checks again.
+const drainPoll = 250 * time.Millisecond
+
+var errDraining = errors.New("agent is draining")
+
+// openAdminState restores maintenance mode saved before a restart.
+func openAdminState(dataDir string) (*adminState, error) {
+	a := &adminState{path: filepath.Join(dataDir, "maintenance.json"), mode: modeActive}
+	data, err := os.ReadFile(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved AdminStatus
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.mode, a.reason, a.since, a.resumed = modeMaintenance, saved.Reason, saved.Since, make(chan struct{})
+	return a, nil
+}
+
+// set changes the mode. Maintenance is saved; leaving it removes the file.
+func (a *adminState) set(mode, reason string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if mode == modeMaintenance {
+		data, err := json.MarshalIndent(AdminStatus{Mode: mode, Reason: reason, Since: time.Now().UTC()}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(a.path, data, 0o644); err != nil {
+			return err
+		}
+	} else if a.mode == modeMaintenance {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if mode == a.mode {
+		a.reason = reason
+		return nil
+	}
+	switch {
+	case mode == modeActive:
+		close(a.resumed)
+	case a.mode == modeActive:
+		a.resumed = make(chan struct{})
+	}
+	a.mode, a.reason, a.since = mode, reason, time.Now().UTC()
+	return nil
+}
+
+// admit refuses new work unless the agent is active.
+func (a *adminState) admit() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch a.mode {
+	case modeDraining:
+		return errDraining
+	case modeMaintenance:
+		if a.reason != "" {
+			return fmt.Errorf("agent is in maintenance: %s", a.reason)
+		}
+		return fmt.Errorf("agent is in maintenance")
+	}
+	return nil
+}
+
+// waitActive blocks while the agent is draining or in maintenance.
+func (a *adminState) waitActive() {
+	a.mu.Lock()
+	resumed := a.resumed
+	active := a.mode == modeActive
+	a.mu.Unlock()
+	if !active {
+		<-resumed
+	}
+}
+
+func (a *adminState) status() *AdminStatus {
+	a.mu.Lock()
+	s := &AdminStatus{Mode: a.mode, Reason: a.reason, Since: a.since}
+	a.mu.Unlock()
+	s.Busy = collector.Status().Running
+	if jobs != nil {
+		for _, job := range jobs.List() {
+			switch job.State {
+			case jobQueued:
+				s.Queued++
+			case jobBuilding, jobRunning, jobRetrying:
+				s.Busy = true
+			}
+		}
+	}
+	s.Drained = s.Mode != modeActive && !s.Busy
+	return s
+}
+
+// handleAdmin serves /admin/drain and /admin/maintenance: GET reports the
+// mode, POST enters it and DELETE returns the agent to active. POST takes
+// wait=<duration> to answer only once the agent drained, or the wait ran
+// out, and maintenance a JSON body with a reason.
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	var mode string
+	switch r.URL.Path {
+	case "/admin/drain":
+		mode = modeDraining
+	case "/admin/maintenance":
+		mode = modeMaintenance
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && !requireLabWide(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var wait time.Duration
+		if v := r.URL.Query().Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid wait %q", v), http.StatusBadRequest)
+				return
+			}
+			wait = d
+		}
+		if err := admin.set(mode, body.Reason); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deadline := time.Now().Add(wait)
+		for time.Now().Before(deadline) && admin.status().Busy {
+			select {
+			case <-time.After(drainPoll):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	case http.MethodDelete:
+		if err := admin.set(modeActive, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admin.status())
+}
+
+func newAdminCmd() *cobra.Command {
+	var agent string
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Drain an agent or put it in maintenance",
+	}
+	cmd.PersistentFlags().StringVar(&agent, "agent", "http://localhost:9090", "Agent to administer")
+
+	// call sends the request and prints the status the agent answers with.
+	// With drained set, an agent still busy is an error.
+	call := func(cmd *cobra.Command, method, path string, body interface{}, drained bool) error {
+		if err := requireFeature(cmd.Context(), agent, "admin"); err != nil {
+			return err
+		}
+		var in io.Reader
+		if body != nil {
+			data, err := json.Marshal(body)
+			if err != nil {
+				return err
+			}
+			in = bytes.NewReader(data)
+		}
+		url := strings.TrimSuffix(agent, "/") + path
+		req, err := http.NewRequestWithContext(cmd.Context(), method, url, in)
+		if err != nil {
+			return err
+		}
+		authorize(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			data, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(data)))
+		}
+		var s AdminStatus
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "mode: %s", s.Mode)
+		if s.Reason != "" {
+			fmt.Fprintf(out, " (%s)", s.Reason)
+		}
+		if s.Mode != modeActive {
+			fmt.Fprintf(out, " since %s", s.Since.Format(time.RFC3339))
+		}
+		fmt.Fprintf(out, "\nbusy: %t, queued jobs: %d\n", s.Busy, s.Queued)
+		if drained && !s.Drained {
+			return fmt.Errorf("agent still busy")
+		}
+		return nil
+	}
+
+	var wait time.Duration
+	drain := &cobra.Command{
+		Use:   "drain",
+		Short: "Refuse new sessions and jobs, letting the current one finish",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(cmd, http.MethodPost, fmt.Sprintf("/admin/drain?wait=%s", wait), nil, wait > 0)
+		},
+	}
+	drain.Flags().DurationVar(&wait, "wait", 0, "Wait this long for the current session or job to finish, failing if it does not")
+
+	var reason string
+	maintenance := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Drain and stay out of rotation, across restarts, until resumed",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(cmd, http.MethodPost, fmt.Sprintf("/admin/maintenance?wait=%s", wait),
+				map[string]string{"reason": reason}, wait > 0)
+		},
+	}
+	maintenance.Flags().DurationVar(&wait, "wait", 0, "Wait this long for the current session or job to finish, failing if it does not")
+	maintenance.Flags().StringVar(&reason, "reason", "", "Why, as shown to anyone whose work is refused")
+
+	resume := &cobra.Command{
+		Use:   "resume",
+		Short: "Leave drain or maintenance and take work again",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(cmd, http.MethodDelete, "/admin/drain", nil, false)
+		},
+	}
+	status := &cobra.Command{
+		Use:   "status",
+		Short: "Show the agent's mode and whether it is busy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(cmd, http.MethodGet, "/admin/drain", nil, false)
+		},
+	}
+
+	cmd.AddCommand(drain, maintenance, resume, status)
+	return cmd
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapProbe is a native collector's BPF program counting into a per-CPU
+// map: syscalls by number in an array, execs by the new program's name in
+// a hash. Each CPU increments its own slot without atomics; the agent sums
+// them at Stop.
+type mapProbe struct {
+	name                string
+	counts, pids, drops int
+	prog, link          int
+	cpus                int
+}
+
+// execMapEntries bounds the distinct program names the exec map holds;
+// execs of names beyond it are counted as dropped.
+const execMapEntries = 10240
+
+func startMapProbe(collector string, pids []int) (*mapProbe, error) {
+	var tracepoint string
+	p := &mapProbe{name: collector, counts: -1, pids: -1, drops: -1, prog: -1, link: -1}
+	var err error
+	if p.cpus, err = possibleCPUs(); err != nil {
+		return nil, err
+	}
+	raiseMemlock()
+	switch collector {
+	case "exec":
+		tracepoint = "sched_process_exec"
+		p.counts, err = bpfMapCreate(unix.BPF_MAP_TYPE_PERCPU_HASH, execRecordSize, 8, execMapEntries)
+	case "syscalls":
+		tracepoint = "sys_enter"
+		p.counts, err = bpfMapCreate(unix.BPF_MAP_TYPE_PERCPU_ARRAY, 4, 8, maxSyscallNr)
+	default:
+		return nil, fmt.Errorf("no native probe for %s", collector)
+	}
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("counts: %w", err)
+	}
+	if p.pids, err = bpfMapCreate(unix.BPF_MAP_TYPE_HASH, 4, 1, pidFilterEntries); err != nil {
+		p.close()
+		return nil, fmt.Errorf("pid filter: %w", err)
+	}
+	if p.drops, err = bpfMapCreate(unix.BPF_MAP_TYPE_PERCPU_ARRAY, 4, 8, 1); err != nil {
+		p.close()
+		return nil, fmt.Errorf("drop counter: %w", err)
+	}
+	if err := p.setPIDs(pids); err != nil {
+		p.close()
+		return nil, fmt.Errorf("pid filter: %w", err)
+	}
+	if p.prog, err = bpfProgLoad(collector, p.program()); err != nil {
+		p.close()
+		return nil, err
+	}
+	if p.link, err = bpfRawTracepointOpen(tracepoint, p.prog); err != nil {
+		p.close()
+		return nil, fmt.Errorf("attach %s: %w", tracepoint, err)
+	}
+	return p, nil
+}
+
+// program assembles the collector's BPF program, which counts each event
+// the pid filter lets through (syscalls only, as with the ring buffer).
+func (p *mapProbe) program() []bpfInsn {
+	var a bpfAsm
+	switch p.name {
+	case "syscalls":
+		a.mov(6, 1)
+		a.filterPIDs(p.pids)
+		a.emit(unix.BPF_LDX|unix.BPF_MEM|unix.BPF_DW, 7, 6, 8, 0)
+		a.emit(unix.BPF_STX|unix.BPF_MEM|unix.BPF_W, 10, 7, -4, 0)
+		a.lookup(p.counts)
+		a.jump(unix.BPF_JEQ, 0, "out")
+		a.increment()
+	case "exec":
+		// The key is the program's name at r10-16, NUL-padded.
+		a.emit(unix.BPF_ST|unix.BPF_MEM|unix.BPF_DW, 10, 0, -16, 0)
+		a.emit(unix.BPF_ST|unix.BPF_MEM|unix.BPF_DW, 10, 0, -8, 0)
+		a.mov(1, 10)
+		a.emit(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 1, 0, 0, -16)
+		a.movImm(2, execRecordSize)
+		a.call(bpfGetCurrentComm)
+		a.loadMap(1, p.counts)
+		a.mov(2, 10)
+		a.emit(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 2, 0, 0, -16)
+		a.call(bpfMapLookupElem)
+		a.jump(unix.BPF_JNE, 0, "count")
+		// A new name starts at 1; when the map is full the exec is dropped.
+		a.emit(unix.BPF_ST|unix.BPF_MEM|unix.BPF_DW, 10, 0, -24, 1)
+		a.loadMap(1, p.counts)
+		a.mov(2, 10)
+		a.emit(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 2, 0, 0, -16)
+		a.mov(3, 10)
+		a.emit(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 3, 0, 0, -24)
+		a.movImm(4, unix.BPF_NOEXIST)
+		a.call(bpfMapUpdateElem)
+		a.jump(unix.BPF_JEQ, 0, "out")
+		a.emit(unix.BPF_ST|unix.BPF_MEM|unix.BPF_W, 10, 0, -4, 0)
+		a.lookup(p.drops)
+		a.jump(unix.BPF_JEQ, 0, "out")
+		a.increment()
+		a.jump(unix.BPF_JA, 0, "out")
+		a.label("count")
+		a.increment()
+	}
+	a.label("out")
+	a.movImm(0, 0)
+	a.emit(unix.BPF_JMP|unix.BPF_EXIT, 0, 0, 0, 0)
+	return a.assemble()
+}
+
+func (p *mapProbe) setPIDs(pids []int) error {
+	return setPIDFilter(p.pids, pids)
+}
+
+// Stop detaches the program and sums the map's per-CPU counts.
+func (p *mapProbe) Stop() (*bpftraceOutput, *PipelineStats) {
+	p.detach()
+	defer p.close()
+	stats := &PipelineStats{}
+	values := make([]uint64, p.cpus)
+	sum := func(fd int, key unsafe.Pointer) (uint64, bool) {
+		if bpfMapElem(unix.BPF_MAP_LOOKUP_ELEM, fd, key, unsafe.Pointer(&values[0]), 0) != nil {
+			return 0, false
+		}
+		var n uint64
+		for _, v := range values {
+			n += v
+		}
+		return n, true
+	}
+
+	var shard eventShard
+	switch p.name {
+	case "exec":
+		execs := execShard{}
+		var key, next [execRecordSize]byte
+		keyPtr := unsafe.Pointer(nil)
+		for bpfMapElem(unix.BPF_MAP_GET_NEXT_KEY, p.counts, keyPtr, unsafe.Pointer(&next), 0) == nil {
+			key, keyPtr = next, unsafe.Pointer(&key)
+			if n, ok := sum(p.counts, keyPtr); ok {
+				execs.addN(key[:], float64(n))
+				stats.Events += n
+			}
+		}
+		shard = execs
+	case "syscalls":
+		syscalls := make(syscallShard, maxSyscallNr)
+		for nr := uint32(0); nr < maxSyscallNr; nr++ {
+			if n, ok := sum(p.counts, unsafe.Pointer(&nr)); ok {
+				syscalls[nr] = float64(n)
+				stats.Events += n
+			}
+		}
+		shard = syscalls
+	}
+	var zero uint32
+	stats.Dropped, _ = sum(p.drops, unsafe.Pointer(&zero))
+	stats.setDropPct()
+	return nativeOutput(p.name, []eventShard{shard}), stats
+}
+
+func (p *mapProbe) detach() {
+	for _, fd := range []*int{&p.link, &p.prog} {
+		if *fd >= 0 {
+			unix.Close(*fd)
+			*fd = -1
+		}
+	}
+}
+
+func (p *mapProbe) close() {
+	p.detach()
+	for _, fd := range []*int{&p.counts, &p.pids, &p.drops} {
+		if *fd >= 0 {
+			unix.Close(*fd)
+			*fd = -1
+		}
+	}
+}
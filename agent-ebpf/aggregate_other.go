@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+type mapProbe struct{}
+
+func startMapProbe(collector string, pids []int) (*mapProbe, error) {
+	return nil, fmt.Errorf("native eBPF collectors need Linux, not %s", runtime.GOOS)
+}
+
+func (p *mapProbe) setPIDs(pids []int) error { return nil }
+
+func (p *mapProbe) Stop() (*bpftraceOutput, *PipelineStats) { return nil, nil }
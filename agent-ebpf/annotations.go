@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// grafanaAnnotator posts a region annotation to Grafana for every collection
+// window: created at Start, closed with its end time at Stop.
+type grafanaAnnotator struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type runAnnotation struct {
+	done chan struct{}
+	id   int64
+	body map[string]interface{}
+}
+
+var annotator *grafanaAnnotator
+
+func newGrafanaAnnotator(url, token string) *grafanaAnnotator {
+	return &grafanaAnnotator{
+		url:    strings.TrimRight(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (g *grafanaAnnotator) do(method, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, g.url+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("grafana %s %s: %s", method, path, resp.Status)
+	}
+	return resp, nil
+}
+
+// RunStarted posts the opening annotation in the background and returns a
+// handle that RunStopped uses to close the region.
+func (g *grafanaAnnotator) RunStarted(start time.Time, scenario, impl, variant, commit string) *runAnnotation {
+	a := &runAnnotation{
+		done: make(chan struct{}),
+		body: map[string]interface{}{
+			"time": start.UnixMilli(),
+			"tags": []string{"chainbench", "scenario:" + scenario, "impl:" + impl, "variant:" + variant, "commit:" + commit},
+			"text": fmt.Sprintf("chainbench %s: impl=%s variant=%s commit=%s", scenario, impl, variant, commit),
+		},
+	}
+
+	go func() {
+		defer close(a.done)
+
+		resp, err := g.do(http.MethodPost, "/api/annotations", a.body)
+		if err != nil {
+			log.Printf("Grafana annotation failed: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+			log.Printf("Grafana annotation response: %v", err)
+			return
+		}
+		a.id = created.ID
+	}()
+
+	return a
+}
+
+func (g *grafanaAnnotator) RunStopped(a *runAnnotation, end time.Time) {
+	go func() {
+		<-a.done
+
+		var (
+			resp *http.Response
+			err  error
+		)
+		if a.id != 0 {
+			resp, err = g.do(http.MethodPatch, fmt.Sprintf("/api/annotations/%d", a.id), map[string]interface{}{
+				"timeEnd": end.UnixMilli(),
+			})
+		} else {
+			// The opening annotation never made it; post the whole region.
+			a.body["timeEnd"] = end.UnixMilli()
+			resp, err = g.do(http.MethodPost, "/api/annotations", a.body)
+		}
+		if err != nil {
+			log.Printf("Grafana annotation failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// Mark posts a point annotation in the background.
+func (g *grafanaAnnotator) Mark(at time.Time, text string, tags []string) {
+	go func() {
+		resp, err := g.do(http.MethodPost, "/api/annotations", map[string]interface{}{
+			"time": at.UnixMilli(),
+			"tags": tags,
+			"text": text,
+		})
+		if err != nil {
+			log.Printf("Grafana annotation failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
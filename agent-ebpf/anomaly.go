@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// AnomalyData lists the evidence figures of a run that lie far outside
+// what earlier runs of the same scenario, impl and dataset recorded. A
+// broken environment, a node fsyncing every write or a stray cron job
+// forking away, shows up there even when the run's duration looks
+// plausible.
+type AnomalyData struct {
+	// History is how many earlier runs the figures were held against.
+	History int             `json:"history"`
+	Metrics []AnomalyMetric `json:"metrics"`
+}
+
+// AnomalyMetric is one figure out of line: its value, the history's median
+// and median absolute deviation, and the robust z-score between them.
+type AnomalyMetric struct {
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	Median float64 `json:"median"`
+	MAD    float64 `json:"mad"`
+	Score  float64 `json:"score"`
+}
+
+// anomalyMetrics are the figures watched: what the workload asked of the
+// kernel, which should hardly change from run to run of one scenario.
+var anomalyMetrics = []string{
+	"syscall.fsync", "syscall.futex", "syscall.openat", "syscall.read", "syscall.write",
+	"exec.count", "offcpu.total_ms", "runqlat.p95_us", "biolatency.p95_us",
+}
+
+// A figure is anomalous when its robust z-score exceeds anomalyScore,
+// against at least anomalyMinHistory of the series' latest
+// anomalyHistory successful runs. Machines are left out of the series on
+// purpose: one machine unlike the rest is what it is meant to catch.
+var (
+	anomalyScore      = 5.0
+	anomalyMinHistory = 10
+	anomalyHistory    = 30
+)
+
+// robustScore is how many standard deviations value is from median,
+// estimated from the median absolute deviation. The deviation is floored at
+// 1% of the median and at 1, so a history of identical counts does not make
+// every small change infinitely unlikely.
+func robustScore(value, median, mad float64) float64 {
+	mad = math.Max(mad, math.Max(math.Abs(median)*0.01, 1))
+	return 0.6745 * (value - median) / mad
+}
+
+// medianAbsoluteDeviation is the median of the values' distances from
+// their median.
+func medianAbsoluteDeviation(values []float64, m float64) float64 {
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	return median(deviations)
+}
+
+// detectAnomalies holds a run's evidence against the series' history
+// before the run is stored. It returns nil when the history is too short
+// or nothing is out of line.
+func detectAnomalies(run *Run) *AnomalyData {
+	if store == nil || run.Evidence == nil || runResult(run.Evidence) != resultSuccess {
+		return nil
+	}
+	valid := true
+	summaries, _, err := store.Query(&RunQuery{
+		Labels: map[string][]string{
+			"scenario": {run.Scenario},
+			"impl":     {run.Impl},
+			"dataset":  {run.Dataset},
+			"project":  {projectOf(run.Project)},
+		},
+		Valid:   &valid,
+		Results: []string{resultSuccess},
+		Sort:    "created",
+		Desc:    true,
+		Limit:   anomalyHistory,
+	})
+	if err != nil {
+		log.Printf("Anomaly check of run %s: %v", run.ID, err)
+		return nil
+	}
+	if len(summaries) < anomalyMinHistory {
+		return nil
+	}
+
+	history := map[string][]float64{}
+	for _, s := range summaries {
+		earlier, err := store.Get(s.ID)
+		if err != nil || earlier.Evidence == nil {
+			continue
+		}
+		values := evidenceValues(earlier.Evidence)
+		for _, name := range anomalyMetrics {
+			if v, ok := values[name]; ok {
+				history[name] = append(history[name], v)
+			}
+		}
+	}
+
+	data := &AnomalyData{History: len(summaries)}
+	values := evidenceValues(run.Evidence)
+	for _, name := range anomalyMetrics {
+		value, ok := values[name]
+		past := history[name]
+		if !ok || len(past) < anomalyMinHistory {
+			continue
+		}
+		m := median(past)
+		mad := medianAbsoluteDeviation(past, m)
+		if score := robustScore(value, m, mad); math.Abs(score) > anomalyScore {
+			data.Metrics = append(data.Metrics, AnomalyMetric{Metric: name, Value: value, Median: m, MAD: mad, Score: score})
+		}
+	}
+	if len(data.Metrics) == 0 {
+		return nil
+	}
+	sort.Slice(data.Metrics, func(i, j int) bool { return math.Abs(data.Metrics[i].Score) > math.Abs(data.Metrics[j].Score) })
+	log.Printf("Run %s is anomalous: %s", run.ID, data.summary())
+	return data
+}
+
+// summary lists the anomalous figures against their medians.
+func (a *AnomalyData) summary() string {
+	parts := make([]string, len(a.Metrics))
+	for i, m := range a.Metrics {
+		parts[i] = fmt.Sprintf("%s %g (median %g)", m.Metric, m.Value, m.Median)
+	}
+	return strings.Join(parts, "; ")
+}
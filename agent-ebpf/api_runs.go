@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func handleRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := parseRunQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scopeQuery(q, requestScope(r))
+
+	runs, next, err := store.Query(q)
+	if errors.Is(err, errBadCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The body stays a plain array; the next page's cursor, if any, is in
+	// a header.
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/runs/"), "/")
+	method := http.MethodGet
+	if rest == "replay" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	run, err := store.Get(id)
+	if err == nil && !inScope(requestScope(r), run.Project) {
+		err = errRunNotFound
+	}
+	if errors.Is(err, errRunNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch rest {
+	case "":
+		writeDocument(w, r, run)
+	case "report.html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Query().Get("inline") == "" {
+			w.Header().Set("Content-Disposition", `attachment; filename="`+run.ID+`.html"`)
+		}
+		if err := writeHTMLReport(w, run); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "replay":
+		replayRunMetrics(run)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "replayed", "run_id": run.ID})
+	case "artifacts":
+		artifacts, err := store.Artifacts(run.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(artifacts)
+	default:
+		name, ok := strings.CutPrefix(rest, "artifacts/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		path, err := store.ArtifactPath(run.ID, name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(name, ".log") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		http.ServeFile(w, r, path)
+	}
+}
+
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	threshold := 10.0
+	if t := q.Get("threshold"); t != "" {
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			http.Error(w, "invalid threshold", http.StatusBadRequest)
+			return
+		}
+		threshold = v
+	}
+
+	runs := make([]*Run, 0, 2)
+	for _, key := range []string{"a", "b"} {
+		run, err := store.Get(q.Get(key))
+		if err == nil && !inScope(requestScope(r), run.Project) {
+			err = errRunNotFound
+		}
+		if errors.Is(err, errRunNotFound) {
+			http.Error(w, "run "+key+" not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, run)
+	}
+
+	if q.Get("format") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := writeHTMLReport(w, runs...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	diff := compareRuns(runs[0], runs[1], threshold)
+	b := runs[1]
+	recordVerdict(b.Scenario, b.Impl, b.Variant, b.Commit, b.Machine, b.Dataset, projectOf(b.Project), diff.Verdict, diff.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
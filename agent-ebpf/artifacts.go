@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	artifactBuild = "build"
+	artifactImage = "image"
+)
+
+// CachedArtifact is a built workload or a pulled container image kept for
+// later jobs. Key addresses its content: for a build, a digest of the impl,
+// repo, commit and rendered build command, env and cache_key; for an image,
+// a digest of its reference.
+type CachedArtifact struct {
+	Key    string `json:"key"`
+	Kind   string `json:"kind"`
+	Impl   string `json:"impl,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Ref and ImageID identify a pulled image.
+	Ref     string `json:"ref,omitempty"`
+	ImageID string `json:"image_id,omitempty"`
+	// Path is a build's directory.
+	Path string `json:"path,omitempty"`
+	Size int64  `json:"size"`
+	// DurationMs is how long the build or pull took.
+	DurationMs float64   `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsed   time.Time `json:"last_used"`
+	Uses       int       `json:"uses"`
+}
+
+// CachePolicy bounds the artifact cache. Zero fields are not enforced;
+// least recently used artifacts go first.
+type CachePolicy struct {
+	MaxBytes   int64
+	MaxAge     time.Duration
+	MaxEntries int
+}
+
+func (p CachePolicy) MarshalJSON() ([]byte, error) {
+	out := struct {
+		MaxBytes   int64  `json:"max_bytes,omitempty"`
+		MaxAge     string `json:"max_age,omitempty"`
+		MaxEntries int    `json:"max_entries,omitempty"`
+	}{MaxBytes: p.MaxBytes, MaxEntries: p.MaxEntries}
+	if p.MaxAge > 0 {
+		out.MaxAge = p.MaxAge.String()
+	}
+	return json.Marshal(out)
+}
+
+// ArtifactCache keeps builds under <dir>/builds/<key> and remembers pulled
+// images, with what it holds listed in <dir>/index.json. Source mirrors
+// under <dir>/repos are shared by all builds of an impl and not counted.
+type ArtifactCache struct {
+	mu      sync.Mutex
+	dir     string
+	policy  CachePolicy
+	entries map[string]*CachedArtifact
+	// held counts the jobs using each artifact; those are never evicted.
+	held map[string]int
+}
+
+var artifactCache *ArtifactCache
+
+func NewArtifactCache(dir string, policy CachePolicy) (*ArtifactCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "builds"), 0o755); err != nil {
+		return nil, fmt.Errorf("create artifact cache: %w", err)
+	}
+	c := &ArtifactCache{dir: dir, policy: policy, entries: map[string]*CachedArtifact{}, held: map[string]int{}}
+	if data, err := os.ReadFile(c.indexPath()); err == nil {
+		if err := json.Unmarshal(data, &c.entries); err != nil {
+			log.Printf("Artifact cache: ignoring %s: %v", c.indexPath(), err)
+			c.entries = map[string]*CachedArtifact{}
+		}
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// contentKey digests the JSON encoding of parts.
+func contentKey(parts ...interface{}) string {
+	data, _ := json.Marshal(parts)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *ArtifactCache) indexPath() string {
+	return filepath.Join(c.dir, "index.json")
+}
+
+func (c *ArtifactCache) buildPath(key string) string {
+	return filepath.Join(c.dir, "builds", key)
+}
+
+// save writes the index. Callers hold c.mu.
+func (c *ArtifactCache) save() {
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := c.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err == nil {
+		err = os.Rename(tmp, c.indexPath())
+	}
+	if err != nil {
+		log.Printf("Artifact cache: %v", err)
+	}
+}
+
+// use returns the artifact under key, counting the use and holding it
+// until released, or nil.
+func (c *ArtifactCache) use(key string) *CachedArtifact {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.entries[key]
+	if a == nil {
+		return nil
+	}
+	a.LastUsed = time.Now().UTC()
+	a.Uses++
+	c.held[key]++
+	c.save()
+	copied := *a
+	return &copied
+}
+
+// put records a new artifact, held until released, then evicts others as
+// the policy requires.
+func (c *ArtifactCache) put(a *CachedArtifact) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a.CreatedAt = time.Now().UTC()
+	a.LastUsed = a.CreatedAt
+	a.Uses = 1
+	c.entries[a.Key] = a
+	c.held[a.Key]++
+	c.evict()
+}
+
+// release ends a job's hold on the artifacts it used.
+func (c *ArtifactCache) release(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if c.held[key]--; c.held[key] <= 0 {
+			delete(c.held, key)
+		}
+	}
+}
+
+// forget drops an artifact found to be gone, e.g. an image removed by hand.
+func (c *ArtifactCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	delete(c.held, key)
+	c.save()
+}
+
+// evict removes artifacts past the policy, least recently used first,
+// sparing held ones. Callers hold c.mu.
+func (c *ArtifactCache) evict() {
+	lru := make([]*CachedArtifact, 0, len(c.entries))
+	var total int64
+	for _, a := range c.entries {
+		lru = append(lru, a)
+		total += a.Size
+	}
+	sort.Slice(lru, func(i, j int) bool { return lru[i].LastUsed.Before(lru[j].LastUsed) })
+
+	now := time.Now()
+	count := len(lru)
+	for _, a := range lru {
+		if c.held[a.Key] > 0 {
+			continue
+		}
+		expired := c.policy.MaxAge > 0 && now.Sub(a.LastUsed) > c.policy.MaxAge
+		tooMany := c.policy.MaxEntries > 0 && count > c.policy.MaxEntries
+		tooBig := c.policy.MaxBytes > 0 && total > c.policy.MaxBytes
+		if !expired && !tooMany && !tooBig {
+			continue
+		}
+		if err := c.remove(a); err != nil {
+			log.Printf("Artifact cache: evicting %s %s: %v", a.Kind, a.Key, err)
+			continue
+		}
+		log.Printf("Artifact cache: evicted %s %s (%d bytes, last used %s)", a.Kind, a.Key, a.Size, a.LastUsed.Format(time.RFC3339))
+		delete(c.entries, a.Key)
+		count--
+		total -= a.Size
+	}
+	c.save()
+}
+
+func (c *ArtifactCache) remove(a *CachedArtifact) error {
+	switch a.Kind {
+	case artifactBuild:
+		return os.RemoveAll(c.buildPath(a.Key))
+	case artifactImage:
+		return dockerRemoveImage(a.ImageID)
+	}
+	return nil
+}
+
+// List returns the cached artifacts, most recently used first.
+func (c *ArtifactCache) List() []*CachedArtifact {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]*CachedArtifact, 0, len(c.entries))
+	for _, a := range c.entries {
+		copied := *a
+		out = append(out, &copied)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastUsed.After(out[j].LastUsed) })
+	return out
+}
+
+// ImageData records an image the job made sure was present before it ran.
+type ImageData struct {
+	Ref     string `json:"ref"`
+	ImageID string `json:"image_id"`
+	Cached  bool   `json:"cached"`
+}
+
+// dockerPullClient shares dockerClient's socket but has no timeout, since
+// pulls can take minutes.
+var dockerPullClient = &http.Client{Transport: dockerClient.Transport}
+
+func dockerImageID(ref string) (id string, size int64, err error) {
+	var image struct {
+		ID   string `json:"Id"`
+		Size int64  `json:"Size"`
+	}
+	if err := dockerGet("/images/"+url.PathEscape(ref)+"/json", &image); err != nil {
+		return "", 0, err
+	}
+	return image.ID, image.Size, nil
+}
+
+func dockerPullImage(ctx context.Context, ref string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://docker/images/create?fromImage="+url.QueryEscape(ref), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dockerPullClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker pull %s: %s", ref, resp.Status)
+	}
+	// Progress is streamed as JSON lines; a failure midway is one with an
+	// error.
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &msg) == nil && msg.Error != "" {
+			return fmt.Errorf("docker pull %s: %s", ref, msg.Error)
+		}
+	}
+	return scanner.Err()
+}
+
+func dockerRemoveImage(id string) error {
+	req, err := http.NewRequest(http.MethodDelete, "http://docker/images/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dockerClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker: %w", err)
+	}
+	resp.Body.Close()
+	// Already gone is as good as removed; in use by a container is not.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("docker remove image %s: %s", id, resp.Status)
+	}
+	return nil
+}
+
+// image makes sure ref is present locally, pulling it unless the cache
+// already did and it is still there.
+func (c *ArtifactCache) image(ctx context.Context, ref string) (*ImageData, error) {
+	key := contentKey(artifactImage, ref)
+	if a := c.use(key); a != nil {
+		if id, _, err := dockerImageID(ref); err == nil && id == a.ImageID {
+			return &ImageData{Ref: ref, ImageID: id, Cached: true}, nil
+		}
+		c.forget(key)
+	}
+
+	start := time.Now()
+	if err := dockerPullImage(ctx, ref); err != nil {
+		return nil, err
+	}
+	id, size, err := dockerImageID(ref)
+	if err != nil {
+		return nil, err
+	}
+	c.put(&CachedArtifact{
+		Key:        key,
+		Kind:       artifactImage,
+		Ref:        ref,
+		ImageID:    id,
+		Size:       size,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	})
+	return &ImageData{Ref: ref, ImageID: id}, nil
+}
+
+func handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := artifactCache.List()
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filtered := list[:0]
+		for _, a := range list {
+			if a.Kind == kind {
+				filtered = append(filtered, a)
+			}
+		}
+		list = filtered
+	}
+	var total int64
+	for _, a := range list {
+		total += a.Size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"artifacts":   list,
+		"total_bytes": total,
+		"policy":      artifactCache.policy,
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// bisectConfig describes a regression hunt: the scenario job to run on an
+// agent, the commit range, and how a commit is built and judged.
+type bisectConfig struct {
+	Agent    string
+	Scenario string
+	Impl     string
+	Variant  string
+	Dataset  string
+	Params   map[string]string
+
+	Repo  string
+	Good  string
+	Bad   string
+	Build string
+
+	Repetitions int
+	// Metric is an evidence measurement to compare; empty compares the run
+	// duration.
+	Metric       string
+	HigherBetter bool
+	ThresholdPct float64
+	Alpha        float64
+}
+
+// bisectCommit is what was learned about one commit.
+type bisectCommit struct {
+	Commit string
+	Values []float64
+	// Skipped holds why the commit could not be measured.
+	Skipped string
+	// ChangePct is the median's change from good's, whose median is
+	// GoodMedian; P is the test's p-value.
+	ChangePct  float64
+	GoodMedian float64
+	P          float64
+	Regressed  bool
+}
+
+type bisector struct {
+	cfg      bisectConfig
+	out      io.Writer
+	worktree string
+	tag      string
+	good     *bisectCommit
+	tested   map[string]*bisectCommit
+}
+
+// bisectPollInterval is how often job state is checked.
+const bisectPollInterval = 2 * time.Second
+
+func git(dir string, args ...string) (string, error) {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// measure builds the commit and runs the scenario on it Repetitions times.
+// A commit that fails to build or run is skipped, as git bisect skip would.
+func (b *bisector) measure(commit string) *bisectCommit {
+	if c := b.tested[commit]; c != nil {
+		return c
+	}
+	c := &bisectCommit{Commit: commit}
+	b.tested[commit] = c
+	fmt.Fprintf(b.out, "%s: measuring\n", short(commit))
+
+	if b.cfg.Build != "" {
+		if _, err := git(b.worktree, "checkout", "--quiet", "--detach", commit); err != nil {
+			c.Skipped = err.Error()
+			return c
+		}
+		cmd := exec.Command("sh", "-c", b.cfg.Build)
+		cmd.Dir = b.worktree
+		cmd.Env = append(os.Environ(), "CHAINBENCH_COMMIT="+commit)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			c.Skipped = "build: " + err.Error()
+			fmt.Fprintf(b.out, "%s: skipped, %s\n", short(commit), c.Skipped)
+			return c
+		}
+	}
+
+	for i := 0; i < b.cfg.Repetitions; i++ {
+		value, err := b.runOnce(commit)
+		if err != nil {
+			c.Skipped = err.Error()
+			fmt.Fprintf(b.out, "%s: skipped, %s\n", short(commit), c.Skipped)
+			return c
+		}
+		c.Values = append(c.Values, value)
+		fmt.Fprintf(b.out, "%s: run %d/%d: %g\n", short(commit), i+1, b.cfg.Repetitions, value)
+	}
+	return c
+}
+
+// runOnce submits one scenario job for the commit and waits for its run.
+func (b *bisector) runOnce(commit string) (float64, error) {
+	_, value, err := runScenarioJob(context.Background(), b.cfg.Agent, RunRequest{
+		Scenario: b.cfg.Scenario,
+		Impl:     b.cfg.Impl,
+		Variant:  b.cfg.Variant,
+		Commit:   commit,
+		Dataset:  b.cfg.Dataset,
+		Params:   b.cfg.Params,
+		Tags:     map[string]string{"bisect": b.tag},
+	}, b.cfg.Metric)
+	return value, err
+}
+
+// runScenarioJob submits a job to the agent, waits for it, and returns its
+// run and the run's metric: the measurement named, or the run duration when
+// metric is empty.
+func runScenarioJob(ctx context.Context, agent string, req RunRequest, metric string) (*Run, float64, error) {
+	agent = strings.TrimSuffix(agent, "/")
+	var job Job
+	if err := agentCall(ctx, http.MethodPost, agent+"/run", req, &job); err != nil {
+		return nil, 0, err
+	}
+	for job.State == jobQueued || job.State == jobBuilding || job.State == jobRunning || job.State == jobRetrying {
+		time.Sleep(bisectPollInterval)
+		if err := agentCall(ctx, http.MethodGet, agent+"/jobs/"+job.ID, nil, &job); err != nil {
+			return nil, 0, err
+		}
+	}
+	if job.State != jobSucceeded {
+		return nil, 0, fmt.Errorf("job %s %s: %s", job.ID, job.State, job.Error)
+	}
+
+	var run Run
+	if err := agentCall(ctx, http.MethodGet, agent+"/runs/"+job.RunID, nil, &run); err != nil {
+		return nil, 0, err
+	}
+	if metric == "" {
+		return &run, run.DurationMs, nil
+	}
+	if run.Evidence != nil {
+		if value, ok := run.Evidence.Measurements[metric]; ok {
+			return &run, value, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("run %s has no measurement %q", run.ID, metric)
+}
+
+// judge compares a measured commit with the good one. Values are turned so
+// that larger is worse before testing.
+func (b *bisector) judge(c *bisectCommit) {
+	worse := func(values []float64) []float64 {
+		if !b.cfg.HigherBetter {
+			return values
+		}
+		negated := make([]float64, len(values))
+		for i, v := range values {
+			negated[i] = -v
+		}
+		return negated
+	}
+	c.GoodMedian = median(b.good.Values)
+	if c.GoodMedian != 0 {
+		c.ChangePct = (median(c.Values) - c.GoodMedian) / c.GoodMedian * 100
+	}
+	c.P = mannWhitneyGreater(worse(b.good.Values), worse(c.Values))
+	slower := c.ChangePct
+	if b.cfg.HigherBetter {
+		slower = -slower
+	}
+	c.Regressed = c.P < b.cfg.Alpha && slower >= b.cfg.ThresholdPct
+}
+
+func short(commit string) string {
+	if len(commit) > 10 {
+		return commit[:10]
+	}
+	return commit
+}
+
+// runBisect finds the first commit in (good, bad] whose runs are worse than
+// good's by at least the threshold with significance alpha. It bisects the
+// ancestry path, assuming one regression; skipped commits are dropped from
+// the search, so the result may be the first measurable one after it.
+func runBisect(cfg bisectConfig, out io.Writer) (*bisectCommit, error) {
+	good, err := git(cfg.Repo, "rev-parse", "--verify", cfg.Good+"^{commit}")
+	if err != nil {
+		return nil, err
+	}
+	bad, err := git(cfg.Repo, "rev-parse", "--verify", cfg.Bad+"^{commit}")
+	if err != nil {
+		return nil, err
+	}
+	list, err := git(cfg.Repo, "rev-list", "--reverse", "--ancestry-path", good+".."+bad)
+	if err != nil {
+		return nil, err
+	}
+	if list == "" {
+		return nil, fmt.Errorf("%s is not an ancestor of %s", cfg.Good, cfg.Bad)
+	}
+	commits := strings.Fields(list)
+	if err := requireFeature(context.Background(), cfg.Agent, "jobs"); err != nil {
+		return nil, err
+	}
+
+	b := &bisector{
+		cfg:    cfg,
+		out:    out,
+		tag:    short(good) + ".." + short(bad),
+		tested: map[string]*bisectCommit{},
+	}
+	if cfg.Build != "" {
+		b.worktree, err = os.MkdirTemp("", "chainbench-bisect-")
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(b.worktree)
+		if _, err := git(cfg.Repo, "worktree", "add", "--quiet", "--detach", b.worktree, good); err != nil {
+			return nil, err
+		}
+		defer git(cfg.Repo, "worktree", "remove", "--force", b.worktree)
+	}
+	fmt.Fprintf(out, "bisecting %d commits, %d runs each\n", len(commits), cfg.Repetitions)
+
+	b.good = b.measure(good)
+	if b.good.Skipped != "" {
+		return nil, fmt.Errorf("good commit %s: %s", short(good), b.good.Skipped)
+	}
+	last := b.measure(bad)
+	if last.Skipped != "" {
+		return nil, fmt.Errorf("bad commit %s: %s", short(bad), last.Skipped)
+	}
+	b.judge(last)
+	if !last.Regressed {
+		return nil, fmt.Errorf("%s is not measurably worse than %s (%+.1f%%, p=%.3f); nothing to bisect",
+			short(bad), short(good), last.ChangePct, last.P)
+	}
+
+	// commits[lo] is good (-1 for the good commit itself), commits[hi]
+	// regressed.
+	lo, hi := -1, len(commits)-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		c := b.measure(commits[mid])
+		if c.Skipped != "" {
+			commits = append(commits[:mid], commits[mid+1:]...)
+			hi--
+			continue
+		}
+		b.judge(c)
+		if c.Regressed {
+			fmt.Fprintf(out, "%s: %+.1f%% (p=%.3f), regressed\n", short(c.Commit), c.ChangePct, c.P)
+			hi = mid
+		} else {
+			fmt.Fprintf(out, "%s: %+.1f%% (p=%.3f), good\n", short(c.Commit), c.ChangePct, c.P)
+			lo = mid
+		}
+	}
+	return b.tested[commits[hi]], nil
+}
+
+func newBisectCmd() *cobra.Command {
+	cfg := bisectConfig{Repo: "."}
+
+	cmd := &cobra.Command{
+		Use:   "bisect <good> <bad>",
+		Short: "Find the commit that introduced a performance regression",
+		Long: "Bisects the commits between good and bad. Each tested commit is checked out\n" +
+			"in a temporary worktree of --repo and built with --build (run by sh, with\n" +
+			"CHAINBENCH_COMMIT set), which must leave the binary where the scenario's\n" +
+			"adapter for --impl runs it, e.g. a path with {{.Commit}} in it. Leave --build\n" +
+			"out when that adapter has a build section: the agent then builds each commit\n" +
+			"itself. The scenario runs --repetitions times as jobs on --agent, and a commit\n" +
+			"counts as regressed when a one-sided Mann-Whitney test against good's runs is\n" +
+			"significant at --alpha and the median is worse by --threshold percent.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Good, cfg.Bad = args[0], args[1]
+			if cfg.Scenario == "" {
+				return fmt.Errorf("--scenario is required")
+			}
+			if cfg.Repetitions < 3 {
+				return fmt.Errorf("--repetitions must be at least 3 for the test to mean anything")
+			}
+			out := cmd.OutOrStdout()
+			c, err := runBisect(cfg, out)
+			if err != nil {
+				return err
+			}
+			subject, _ := git(cfg.Repo, "log", "-1", "--format=%s", c.Commit)
+			fmt.Fprintf(out, "\nfirst regressing commit: %s %s\n", c.Commit, subject)
+			fmt.Fprintf(out, "median %g vs %g at %s (%+.1f%%, p=%.3f)\n",
+				median(c.Values), c.GoodMedian, short(cfg.Good), c.ChangePct, c.P)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&cfg.Agent, "agent", "http://localhost:9090", "Agent that runs the scenario jobs")
+	cmd.Flags().StringVar(&cfg.Scenario, "scenario", "", "Scenario to run")
+	cmd.Flags().StringVar(&cfg.Impl, "impl", "", "Impl whose adapter runs the built binary")
+	cmd.Flags().StringVar(&cfg.Variant, "variant", "", "Variant label for the runs")
+	cmd.Flags().StringVar(&cfg.Dataset, "dataset", "", "Dataset label for the runs")
+	cmd.Flags().StringToStringVar(&cfg.Params, "param", nil, "Scenario param for the runs, as name=value (repeatable)")
+	cmd.Flags().StringVar(&cfg.Repo, "repo", cfg.Repo, "Git repository of the workload")
+	cmd.Flags().StringVar(&cfg.Build, "build", "", "Shell command that builds the checked-out commit")
+	cmd.Flags().IntVarP(&cfg.Repetitions, "repetitions", "n", 5, "Runs per commit")
+	cmd.Flags().StringVar(&cfg.Metric, "metric", "", "Measurement to compare instead of the run duration")
+	cmd.Flags().BoolVar(&cfg.HigherBetter, "higher-is-better", false, "The metric is a rate, so a drop is a regression")
+	cmd.Flags().Float64Var(&cfg.ThresholdPct, "threshold", 5, "Smallest change in percent that counts as a regression")
+	cmd.Flags().Float64Var(&cfg.Alpha, "alpha", 0.05, "Significance level of the test")
+
+	return cmd
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BlockQueueSpec declares the I/O scheduler and request queue settings a
+// scenario measures under, applied through sysfs for the duration of the job
+// and restored afterwards. Without Devices the disk under the job's work
+// directory is tuned.
+type BlockQueueSpec struct {
+	Devices     []string `yaml:"devices,omitempty" json:"devices,omitempty"`
+	Scheduler   string   `yaml:"scheduler,omitempty" json:"scheduler,omitempty"`
+	NrRequests  int      `yaml:"nr_requests,omitempty" json:"nr_requests,omitempty"`
+	ReadAheadKB int      `yaml:"read_ahead_kb,omitempty" json:"read_ahead_kb,omitempty"`
+}
+
+func (b *BlockQueueSpec) validate() error {
+	if b.Scheduler == "" && b.NrRequests == 0 && b.ReadAheadKB == 0 {
+		return fmt.Errorf("block_queue: set scheduler, nr_requests or read_ahead_kb")
+	}
+	if b.NrRequests < 0 || b.ReadAheadKB < 0 {
+		return fmt.Errorf("block_queue: nr_requests and read_ahead_kb must not be negative")
+	}
+	for _, dev := range b.Devices {
+		if dev == "" || strings.Contains(dev, "/") {
+			return fmt.Errorf("block_queue: %q is not a block device name", dev)
+		}
+	}
+	return nil
+}
+
+// BlockQueueSetting is a disk's queue settings as they stood while the run
+// measured, read back after they were applied.
+type BlockQueueSetting struct {
+	Device      string `json:"device"`
+	Scheduler   string `json:"scheduler"`
+	NrRequests  int    `json:"nr_requests"`
+	ReadAheadKB int    `json:"read_ahead_kb"`
+}
+
+func (s *BlockQueueSetting) String() string {
+	return fmt.Sprintf("%s: scheduler %s, nr_requests %d, read_ahead_kb %d", s.Device, s.Scheduler, s.NrRequests, s.ReadAheadKB)
+}
+
+// blockQueueAttr is a disk's queue attribute and the value it had before
+// the job changed it.
+type blockQueueAttr struct {
+	path, was string
+}
+
+// readBlockQueue reads a disk's current settings from its sysfs queue.
+func readBlockQueue(dev string) BlockQueueSetting {
+	queue := filepath.Join("/sys/block", dev, "queue")
+	s := BlockQueueSetting{Device: dev, Scheduler: bracketed(readTrimmed(filepath.Join(queue, "scheduler")))}
+	s.NrRequests, _ = strconv.Atoi(readTrimmed(filepath.Join(queue, "nr_requests")))
+	s.ReadAheadKB, _ = strconv.Atoi(readTrimmed(filepath.Join(queue, "read_ahead_kb")))
+	return s
+}
+
+// applyBlockQueue applies the settings to the named disks, or to the disk
+// under dir, and returns the settings in force and a function that restores
+// the previous ones. The scheduler goes first: switching it resets
+// nr_requests to the new scheduler's default.
+func applyBlockQueue(b *BlockQueueSpec, dir string) ([]BlockQueueSetting, func(), error) {
+	devices := b.Devices
+	if len(devices) == 0 {
+		disk := diskOf(dir)
+		if disk == "" {
+			return nil, nil, fmt.Errorf("block_queue: %s is not on a block device", dir)
+		}
+		devices = []string{filepath.Base(disk)}
+	}
+
+	var changed []blockQueueAttr
+	restore := func() {
+		for _, attr := range changed {
+			if err := os.WriteFile(attr.path, []byte(attr.was), 0); err != nil {
+				log.Printf("Restoring %s: %v", attr.path, err)
+			}
+		}
+	}
+	recorded := map[string]bool{}
+	record := func(path, was string) {
+		if !recorded[path] {
+			recorded[path] = true
+			changed = append(changed, blockQueueAttr{path: path, was: was})
+		}
+	}
+	var settings []BlockQueueSetting
+	for _, dev := range devices {
+		queue := filepath.Join("/sys/block", dev, "queue")
+		if _, err := os.Stat(queue); err != nil {
+			restore()
+			return nil, nil, fmt.Errorf("block_queue: no block device %s", dev)
+		}
+		nrRequests := readTrimmed(filepath.Join(queue, "nr_requests"))
+		for _, attr := range []struct{ name, value string }{
+			{"scheduler", b.Scheduler},
+			{"nr_requests", positive(b.NrRequests)},
+			{"read_ahead_kb", positive(b.ReadAheadKB)},
+		} {
+			path := filepath.Join(queue, attr.name)
+			was := bracketed(readTrimmed(path))
+			if attr.value == "" || attr.value == was {
+				continue
+			}
+			if err := os.WriteFile(path, []byte(attr.value), 0); err != nil {
+				restore()
+				if attr.name == "scheduler" {
+					return nil, nil, fmt.Errorf("block_queue: %s: scheduler %s (available: %s): %w", dev, attr.value, readTrimmed(path), err)
+				}
+				return nil, nil, fmt.Errorf("block_queue: %s: %s %s: %w", dev, attr.name, attr.value, err)
+			}
+			record(path, was)
+			if attr.name == "scheduler" {
+				// Restored after the scheduler, which resets it.
+				record(filepath.Join(queue, "nr_requests"), nrRequests)
+			}
+		}
+		settings = append(settings, readBlockQueue(dev))
+	}
+	if len(changed) > 0 {
+		log.Printf("Block queue settings applied: %d changed on %s", len(changed), strings.Join(devices, ", "))
+	}
+	return settings, restore, nil
+}
+
+// positive formats n, or returns "" for an unset 0.
+func positive(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
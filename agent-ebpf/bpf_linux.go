@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The native probes' programs are small enough to assemble here, so they
+// need neither a compiler nor BTF; they attach to raw tracepoints, which
+// need no tracefs either.
+
+// BPF helpers the programs call.
+const (
+	bpfMapLookupElem     = 1
+	bpfMapUpdateElem     = 2
+	bpfGetCurrentPidTgid = 14
+	bpfGetCurrentComm    = 16
+	bpfRingbufReserve    = 131
+	bpfRingbufSubmit     = 132
+)
+
+// anyPID is the pid filter's key for "every process", set when the session
+// has no target.
+const anyPID = 0
+
+// raiseMemlock lifts RLIMIT_MEMLOCK, which kernels before 5.11 charge BPF
+// maps to.
+func raiseMemlock() {
+	unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+}
+
+// pidFilterEntries bounds the processes a pid filter holds.
+const pidFilterEntries = 8192
+
+// setPIDFilter replaces a pid filter map's contents: the given processes,
+// or every process when there are none. The new processes go in before the
+// old ones come out, so the filter is never empty while it is retargeted,
+// unless both do not fit in it at once.
+func setPIDFilter(fd int, pids []int) error {
+	if len(pids) == 0 {
+		pids = []int{anyPID}
+	}
+	wanted := make(map[uint32]bool, len(pids))
+	for _, pid := range pids {
+		wanted[uint32(pid)] = true
+	}
+	insert := func() error {
+		value := uint8(1)
+		for key := range wanted {
+			if err := bpfMapElem(unix.BPF_MAP_UPDATE_ELEM, fd, unsafe.Pointer(&key), unsafe.Pointer(&value), 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := insert()
+	if err != nil && !errors.Is(err, unix.E2BIG) {
+		return err
+	}
+
+	// Without a key, GET_NEXT_KEY returns the first one; the kernel reads
+	// the key before writing the next one over it.
+	var stale []uint32
+	var key uint32
+	var after unsafe.Pointer
+	for bpfMapElem(unix.BPF_MAP_GET_NEXT_KEY, fd, after, unsafe.Pointer(&key), 0) == nil {
+		if !wanted[key] {
+			stale = append(stale, key)
+		}
+		after = unsafe.Pointer(&key)
+	}
+	for _, key := range stale {
+		if err := bpfMapElem(unix.BPF_MAP_DELETE_ELEM, fd, unsafe.Pointer(&key), nil, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+	if err != nil {
+		// The map was full: the rest go in now there is room.
+		return insert()
+	}
+	return nil
+}
+
+// possibleCPUs is how many values a per-CPU map holds for each key.
+func possibleCPUs() (int, error) {
+	data, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		lo, hi, found := strings.Cut(r, "-")
+		if !found {
+			hi = lo
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil {
+			return 0, fmt.Errorf("possible CPUs %q: %w", data, err)
+		}
+		first, _ := strconv.Atoi(lo)
+		n += last - first + 1
+	}
+	return n, nil
+}
+
+// bpfInsn is one eBPF instruction.
+type bpfInsn struct {
+	Code uint8
+	Regs uint8 // dst in the low nibble, src in the high one
+	Off  int16
+	Imm  int32
+}
+
+// bpfAsm assembles a program, resolving jumps to labels.
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *bpfAsm) emit(code uint8, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{Code: code, Regs: dst | src<<4, Off: off, Imm: imm})
+}
+
+func (a *bpfAsm) mov(dst, src uint8) {
+	a.emit(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X, dst, src, 0, 0)
+}
+
+func (a *bpfAsm) movImm(dst uint8, imm int32) {
+	a.emit(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_K, dst, 0, 0, imm)
+}
+
+func (a *bpfAsm) call(helper int32) {
+	a.emit(unix.BPF_JMP|unix.BPF_CALL, 0, 0, 0, helper)
+}
+
+// loadMap loads a map's fd into dst; the kernel replaces it with the map.
+func (a *bpfAsm) loadMap(dst uint8, fd int) {
+	a.emit(unix.BPF_LD|unix.BPF_DW|unix.BPF_IMM, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+// filterPIDs jumps to "out" unless the calling process, or any process, is
+// in the pid filter map.
+func (a *bpfAsm) filterPIDs(fd int) {
+	a.call(bpfGetCurrentPidTgid)
+	a.emit(unix.BPF_ALU64|unix.BPF_RSH|unix.BPF_K, 0, 0, 0, 32)
+	a.emit(unix.BPF_STX|unix.BPF_MEM|unix.BPF_W, 10, 0, -4, 0)
+	a.lookup(fd)
+	a.jump(unix.BPF_JNE, 0, "filtered")
+	a.emit(unix.BPF_ST|unix.BPF_MEM|unix.BPF_W, 10, 0, -4, anyPID)
+	a.lookup(fd)
+	a.jump(unix.BPF_JEQ, 0, "out")
+	a.label("filtered")
+}
+
+// increment adds one to the u64 r0 points to. It is not atomic, so only
+// for per-CPU map values.
+func (a *bpfAsm) increment() {
+	a.emit(unix.BPF_LDX|unix.BPF_MEM|unix.BPF_DW, 1, 0, 0, 0)
+	a.emit(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 1, 0, 0, 1)
+	a.emit(unix.BPF_STX|unix.BPF_MEM|unix.BPF_DW, 0, 1, 0, 0)
+}
+
+// lookup looks up the u32 key at r10-4, leaving the value or nil in r0.
+func (a *bpfAsm) lookup(fd int) {
+	a.loadMap(1, fd)
+	a.mov(2, 10)
+	a.emit(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 2, 0, 0, -4)
+	a.call(bpfMapLookupElem)
+}
+
+// reserve reserves a record in the ring buffer into r0, jumping to "drop"
+// when it is full.
+func (a *bpfAsm) reserve(fd int, size int32) {
+	a.loadMap(1, fd)
+	a.movImm(2, size)
+	a.movImm(3, 0)
+	a.call(bpfRingbufReserve)
+	a.jump(unix.BPF_JEQ, 0, "drop")
+}
+
+// jump jumps to label if r0 compares to imm; BPF_JA always does.
+func (a *bpfAsm) jump(op uint8, imm int32, label string) {
+	if a.jumps == nil {
+		a.jumps = map[int]string{}
+	}
+	a.jumps[len(a.insns)] = label
+	a.emit(unix.BPF_JMP|op|unix.BPF_K, 0, 0, 0, imm)
+}
+
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = map[string]int{}
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) assemble() []bpfInsn {
+	for at, label := range a.jumps {
+		a.insns[at].Off = int16(a.labels[label] - at - 1)
+	}
+	return a.insns
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func bpfMapCreate(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := struct {
+		MapType    uint32
+		KeySize    uint32
+		ValueSize  uint32
+		MaxEntries uint32
+		MapFlags   uint32
+	}{mapType, keySize, valueSize, maxEntries, 0}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapElem(cmd int, fd int, key, value unsafe.Pointer, flags uint64) error {
+	attr := struct {
+		MapFD uint32
+		_     uint32
+		Key   uint64
+		Value uint64
+		Flags uint64
+	}{MapFD: uint32(fd), Key: uint64(uintptr(key)), Value: uint64(uintptr(value)), Flags: flags}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// bpfProgLoad loads a raw tracepoint program. When the verifier rejects it
+// the error carries the verifier's log.
+func bpfProgLoad(name string, insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 64*1024)
+	attr := struct {
+		ProgType    uint32
+		InsnCnt     uint32
+		Insns       uint64
+		License     uint64
+		LogLevel    uint32
+		LogSize     uint32
+		LogBuf      uint64
+		KernVersion uint32
+		ProgFlags   uint32
+		ProgName    [16]byte
+	}{
+		ProgType: unix.BPF_PROG_TYPE_RAW_TRACEPOINT,
+		InsnCnt:  uint32(len(insns)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	copy(attr.ProgName[:15], "chainbench_"+name)
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		runtime.KeepAlive(insns)
+		runtime.KeepAlive(license)
+		return fd, nil
+	}
+	// Load again with the verifier's log to say why.
+	attr.LogLevel, attr.LogSize = 1, uint32(len(logBuf))
+	attr.LogBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+	_, retry := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if retry != nil && logBuf[0] != 0 {
+		return -1, fmt.Errorf("load %s program: %w: %s", name, err, cString(logBuf))
+	}
+	if errors.Is(err, unix.EPERM) {
+		return -1, fmt.Errorf("load %s program: %w (needs CAP_BPF and CAP_PERFMON, or root)", name, err)
+	}
+	return -1, fmt.Errorf("load %s program: %w", name, err)
+}
+
+func bpfRawTracepointOpen(name string, prog int) (int, error) {
+	tp := append([]byte(name), 0)
+	attr := struct {
+		Name   uint64
+		ProgFD uint32
+		_      uint32
+	}{Name: uint64(uintptr(unsafe.Pointer(&tp[0]))), ProgFD: uint32(prog)}
+	fd, err := bpf(unix.BPF_RAW_TRACEPOINT_OPEN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(tp)
+	return fd, err
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
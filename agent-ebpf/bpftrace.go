@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// The eBPF collectors run bpftrace scripts, one per collector and variant,
+// named <collector>-<variant>.bt. The agent ships them embedded; a file of
+// the same name in scriptsDir replaces the embedded one.
+//
+//go:embed scripts/*.bt
+var embeddedScripts embed.FS
+
+// scriptsDir is the --scripts-dir override directory.
+var scriptsDir = "/etc/chainbench/scripts"
+
+// ScriptInfo records which script an eBPF collector ran, so a run can be
+// traced back to the exact probe source even when it was overridden.
+type ScriptInfo struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+	Version string `json:"version,omitempty"`
+	SHA256  string `json:"sha256"`
+}
+
+// shortHash abbreviates a script's hash for display. Imported runs may carry
+// a short or empty one, which is shown whole.
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// bpftraceStopTimeout bounds how long bpftrace may take to print its maps
+// after SIGINT.
+const bpftraceStopTimeout = 10 * time.Second
+
+func scriptName(collector, variant string) string {
+	return collector + "-" + variant + ".bt"
+}
+
+// loadScript returns a script's source, from scriptsDir if it overrides
+// the embedded one.
+func loadScript(name string) ([]byte, *ScriptInfo, error) {
+	info := &ScriptInfo{Name: name, Source: "embedded"}
+	src, err := os.ReadFile(filepath.Join(scriptsDir, name))
+	if err == nil {
+		info.Source = filepath.Join(scriptsDir, name)
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	} else if src, err = embeddedScripts.ReadFile("scripts/" + name); err != nil {
+		return nil, nil, fmt.Errorf("no script %s", name)
+	}
+	sum := sha256.Sum256(src)
+	info.SHA256 = hex.EncodeToString(sum[:])
+	// Scripts may declare "// version: N" on a line of their own.
+	for _, line := range strings.Split(string(src), "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "// version:"); ok {
+			info.Version = strings.TrimSpace(v)
+			break
+		}
+	}
+	return src, info, nil
+}
+
+// syscallNumbers are the numbers of the syscalls the evidence counts. arm64
+// and riscv64 share the generic table.
+var syscallNumbers = map[string]map[string]int{
+	"amd64":   {"read": 0, "write": 1, "fsync": 74, "futex": 202, "openat": 257},
+	"arm64":   {"read": 63, "write": 64, "fsync": 82, "futex": 98, "openat": 56},
+	"riscv64": {"read": 63, "write": 64, "fsync": 82, "futex": 98, "openat": 56},
+}
+
+// renderScript fills in a script's template actions:
+//
+//	{{match "expr"}}    true when expr is one of the target's pids (always
+//	                    true without a target)
+//	{{syscall "name"}}  the kernel function behind a syscall
+//	{{nr "name"}}       a syscall's number on this architecture
+//	{{kfunc "a" "b"}}   the first of the kernel functions the kernel has,
+//	                    for functions renamed between versions
+//	{{bycomm "expr"}}   the map key [expr] when --thread-group is set,
+//	                    for histograms split by thread name; nothing
+//	                    otherwise
+//	{{if grouped}}      whether --thread-group is set
+//	{{range libcs}}     the libc files the target's processes map, or the
+//	                    host's without a target, for uprobes
+//	{{range handshakes}} the handshake functions in the target's files,
+//	                    with .Binary, .Address, .Key and .Timed
+func renderScript(name string, src []byte, pids []int) (string, error) {
+	funcs := template.FuncMap{
+		"match": func(expr string) string {
+			if len(pids) == 0 {
+				return "1"
+			}
+			terms := make([]string, len(pids))
+			for i, pid := range pids {
+				terms[i] = fmt.Sprintf("%s == %d", expr, pid)
+			}
+			return "(" + strings.Join(terms, " || ") + ")"
+		},
+		"syscall": syscallSymbol,
+		"bycomm": func(expr string) string {
+			if len(threadGroups) == 0 {
+				return ""
+			}
+			return "[" + expr + "]"
+		},
+		"grouped": func() bool { return len(threadGroups) > 0 },
+		"libcs":   func() []string { return targetLibcs(pids) },
+		// Reading the target's symbols takes a while; do it once.
+		"handshakes": sync.OnceValues(func() ([]handshakeProbe, error) { return handshakeProbes(pids) }),
+		"kfunc": func(names ...string) (string, error) {
+			for _, name := range names {
+				if kernelFunctions()[name] {
+					return name, nil
+				}
+			}
+			return "", fmt.Errorf("no kernel function %s", strings.Join(names, " or "))
+		},
+		"nr": func(name string) (int, error) {
+			nr, ok := syscallNumbers[runtime.GOARCH][name]
+			if !ok {
+				return 0, fmt.Errorf("no syscall number for %s on %s", name, runtime.GOARCH)
+			}
+			return nr, nil
+		},
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Parse(string(src))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, nil); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// bpftraceAttachTimeout bounds how long bpftrace may take to compile a
+// script and attach its probes.
+const bpftraceAttachTimeout = 30 * time.Second
+
+// bpftraceRun is one collector's bpftrace process, running for the session.
+type bpftraceRun struct {
+	name   string
+	cmd    *exec.Cmd
+	out    bytes.Buffer
+	stderr stderrTail
+	// attached is closed once bpftrace reports its probes attached.
+	attached chan struct{}
+	done     chan error
+}
+
+// Write keeps bpftrace's output for Stop and watches it for the record
+// bpftrace prints once its probes are attached.
+func (r *bpftraceRun) Write(p []byte) (int, error) {
+	r.out.Write(p)
+	select {
+	case <-r.attached:
+	default:
+		if bytes.Contains(r.out.Bytes(), []byte(`"attached_probes"`)) {
+			close(r.attached)
+		}
+	}
+	return len(p), nil
+}
+
+// stderrTail passes bpftrace's stderr on to the agent's and keeps its end,
+// which says why bpftrace failed when it does.
+type stderrTail struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+const stderrTailBytes = 4096
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	os.Stderr.Write(p)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > stderrTailBytes {
+		t.buf = t.buf[len(t.buf)-stderrTailBytes:]
+	}
+	return len(p), nil
+}
+
+// lastLine returns the last line bpftrace wrote to stderr, or "".
+func (t *stderrTail) lastLine() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := strings.Split(strings.TrimSpace(string(t.buf)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// bpftraceOutput holds the maps bpftrace printed on exit: histograms by map
+// name, and keyed or single-value maps with their values as numbers. A
+// keyed histogram is also kept per key in keyedHists; hists holds the sum.
+type bpftraceOutput struct {
+	hists      map[string][]HistogramBucket
+	keyedHists map[string]map[string][]HistogramBucket
+	maps       map[string]map[string]float64
+}
+
+// bpftraceRunning holds the pids of the bpftrace processes the agent
+// started that have not exited yet.
+var (
+	bpftraceMu      sync.Mutex
+	bpftraceRunning = map[int]bool{}
+)
+
+func bpftracePIDs() []int {
+	bpftraceMu.Lock()
+	defer bpftraceMu.Unlock()
+	pids := make([]int, 0, len(bpftraceRunning))
+	for pid := range bpftraceRunning {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func startBPFTrace(collector, variant string, pids []int) (*bpftraceRun, *ScriptInfo, error) {
+	name := scriptName(collector, variant)
+	src, info, err := loadScript(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	script, err := renderScript(name, src, pids)
+	if err != nil {
+		return nil, info, fmt.Errorf("%s: %w", info.Source, err)
+	}
+	r := &bpftraceRun{name: name, attached: make(chan struct{}), done: make(chan error, 1)}
+	r.cmd = exec.Command("bpftrace", "-f", "json", "-e", script)
+	r.cmd.Stdout = r
+	r.cmd.Stderr = &r.stderr
+	if err := r.cmd.Start(); err != nil {
+		return nil, info, err
+	}
+	pid := r.cmd.Process.Pid
+	bpftraceMu.Lock()
+	bpftraceRunning[pid] = true
+	bpftraceMu.Unlock()
+	go func() {
+		err := r.cmd.Wait()
+		bpftraceMu.Lock()
+		delete(bpftraceRunning, pid)
+		bpftraceMu.Unlock()
+		r.done <- err
+	}()
+	return r, info, nil
+}
+
+// waitAttached waits until bpftrace has attached its probes. When it exits
+// or times out first the run is over and need not be stopped.
+func (r *bpftraceRun) waitAttached(timeout time.Duration) error {
+	select {
+	case <-r.attached:
+		return nil
+	case err := <-r.done:
+		if line := r.stderr.lastLine(); line != "" {
+			return fmt.Errorf("bpftrace %s: %s", r.name, line)
+		}
+		return fmt.Errorf("bpftrace %s exited before attaching: %v", r.name, err)
+	case <-time.After(timeout):
+		r.cmd.Process.Kill()
+		<-r.done
+		return fmt.Errorf("bpftrace %s did not attach within %s", r.name, timeout)
+	}
+}
+
+// interrupt asks bpftrace to print its maps and exit.
+func (r *bpftraceRun) interrupt() {
+	r.cmd.Process.Signal(os.Interrupt)
+}
+
+// Stop interrupts bpftrace and parses what it printed.
+func (r *bpftraceRun) Stop() (*bpftraceOutput, error) {
+	r.interrupt()
+	select {
+	case err := <-r.done:
+		if err != nil {
+			if line := r.stderr.lastLine(); line != "" {
+				return nil, fmt.Errorf("bpftrace %s: %w: %s", r.name, err, line)
+			}
+			return nil, fmt.Errorf("bpftrace %s: %w", r.name, err)
+		}
+	case <-time.After(bpftraceStopTimeout):
+		r.cmd.Process.Kill()
+		<-r.done
+		return nil, fmt.Errorf("bpftrace %s did not exit after SIGINT", r.name)
+	}
+	return parseBPFTraceOutput(&r.out)
+}
+
+// parseBPFTraceOutput reads bpftrace's -f json records.
+func parseBPFTraceOutput(r *bytes.Buffer) (*bpftraceOutput, error) {
+	out := &bpftraceOutput{
+		hists:      map[string][]HistogramBucket{},
+		keyedHists: map[string]map[string][]HistogramBucket{},
+		maps:       map[string]map[string]float64{},
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record struct {
+			Type string                     `json:"type"`
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		for name, raw := range record.Data {
+			name = strings.TrimPrefix(name, "@")
+			switch record.Type {
+			case "hist":
+				type bucket struct {
+					Min   *int `json:"min"`
+					Count int  `json:"count"`
+				}
+				latencies := func(buckets []bucket) []HistogramBucket {
+					var hist []HistogramBucket
+					for _, b := range buckets {
+						// The bucket without a min holds negative values,
+						// which no latency has.
+						if b.Min != nil {
+							hist = append(hist, HistogramBucket{BucketUs: *b.Min, Count: b.Count})
+						}
+					}
+					return hist
+				}
+				var buckets []bucket
+				if json.Unmarshal(raw, &buckets) == nil {
+					out.hists[name] = append(out.hists[name], latencies(buckets)...)
+					continue
+				}
+				var keyed map[string][]bucket
+				if err := json.Unmarshal(raw, &keyed); err != nil {
+					return nil, fmt.Errorf("@%s: %w", name, err)
+				}
+				out.keyedHists[name] = map[string][]HistogramBucket{}
+				for key, buckets := range keyed {
+					hist := latencies(buckets)
+					out.keyedHists[name][key] = hist
+					out.hists[name] = mergeHistograms(out.hists[name], hist)
+				}
+			case "map":
+				values := map[string]float64{}
+				var scalar float64
+				if json.Unmarshal(raw, &scalar) == nil {
+					values[""] = scalar
+				} else if err := json.Unmarshal(raw, &values); err != nil {
+					return nil, fmt.Errorf("@%s: %w", name, err)
+				}
+				out.maps[name] = values
+			}
+		}
+	}
+	return out, scanner.Err()
+}
+
+// offcpuReason names where an off-CPU stack blocked: its first frame past
+// the scheduler itself, without the offset.
+func offcpuReason(stack string) string {
+	for _, frame := range strings.Fields(stack) {
+		fn, _, _ := strings.Cut(frame, "+")
+		switch {
+		case fn == "", strings.Contains(fn, "schedule"), strings.HasPrefix(fn, "finish_task_switch"),
+			strings.HasPrefix(fn, "bpf_"), strings.HasPrefix(fn, "__traceiter"):
+			continue
+		}
+		return fn
+	}
+	return "other"
+}
+
+func newScriptsCmd() *cobra.Command {
+	var export string
+
+	cmd := &cobra.Command{
+		Use:   "scripts",
+		Short: "List the bpftrace scripts the eBPF collectors run",
+		Long: "Lists each script with the file it comes from, its version and SHA-256.\n" +
+			"--export writes the embedded scripts to a directory as a starting point\n" +
+			"for overrides in --scripts-dir.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := fs.ReadDir(embeddedScripts, "scripts")
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			sort.Strings(names)
+
+			if export != "" {
+				if err := os.MkdirAll(export, 0o755); err != nil {
+					return err
+				}
+				for _, name := range names {
+					src, _ := embeddedScripts.ReadFile("scripts/" + name)
+					if err := os.WriteFile(filepath.Join(export, name), src, 0o644); err != nil {
+						return err
+					}
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "wrote %d scripts to %s\n", len(names), export)
+				return nil
+			}
+
+			out := cmd.OutOrStdout()
+			for _, name := range names {
+				_, info, err := loadScript(name)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%-26s %-4s %s  %s\n", name, info.Version, shortHash(info.SHA256), info.Source)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&export, "export", "", "Write the embedded scripts to this directory")
+	return cmd
+}
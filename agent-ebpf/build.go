@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// BuildSpec builds an impl from source before its runs. Command arguments,
+// env values and cache_key are templates over scenarioVars, with SourceDir
+// and BuildDir set. The build happens before the session opens, so its time
+// is never part of a run.
+type BuildSpec struct {
+	// Repo is a git URL or path. When set, the job's commit is checked out
+	// into SourceDir, where the command runs; otherwise it runs in BuildDir.
+	Repo    string            `yaml:"repo,omitempty" json:"repo,omitempty"`
+	Command []string          `yaml:"command" json:"command"`
+	Env     map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// CacheKey adds to what addresses the build in the artifact cache, for
+	// inputs the command does not show, such as the toolchain version.
+	CacheKey string `yaml:"cache_key,omitempty" json:"cache_key,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// BuildData is the evidence section of a run whose impl was built by the
+// agent.
+type BuildData struct {
+	Impl   string `json:"impl"`
+	Commit string `json:"commit,omitempty"`
+	// CacheKey is the build's key in the artifact cache.
+	CacheKey string `json:"cache_key"`
+	// Cached is set when an earlier job's build was reused; BuiltAt and
+	// DurationMs describe that build.
+	Cached     bool      `json:"cached"`
+	BuiltAt    time.Time `json:"built_at"`
+	DurationMs float64   `json:"duration_ms"`
+	// Log is the name of the run artifact holding the build output.
+	Log string `json:"log,omitempty"`
+}
+
+const buildLogFile = "build.log"
+
+var unsafeBuildKey = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (b *BuildSpec) validate() error {
+	if len(b.Command) == 0 {
+		return fmt.Errorf("build has no command")
+	}
+	if b.Timeout != "" {
+		if _, err := time.ParseDuration(b.Timeout); err != nil {
+			return fmt.Errorf("build timeout: %w", err)
+		}
+	}
+	return nil
+}
+
+// render renders the build's command and env over vars.
+func (b *BuildSpec) render(vars scenarioVars) ([]string, []string, error) {
+	argv := make([]string, len(b.Command))
+	for i, arg := range b.Command {
+		rendered, err := renderTemplate(arg, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("build command argument %d: %w", i, err)
+		}
+		argv[i] = rendered
+	}
+	env := make([]string, 0, len(b.Env))
+	for key, value := range b.Env {
+		rendered, err := renderTemplate(value, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("build env %s: %w", key, err)
+		}
+		env = append(env, key+"="+rendered)
+	}
+	sort.Strings(env)
+	return argv, env, nil
+}
+
+// buildKey addresses a build by its inputs: the impl, repo and commit and
+// the command, env and cache_key as rendered for this job, with the
+// directories left as placeholders since they derive from the key.
+func (b *BuildSpec) buildKey(vars scenarioVars) (string, error) {
+	vars.SourceDir, vars.BuildDir = "$SOURCE_DIR", "$BUILD_DIR"
+	argv, env, err := b.render(vars)
+	if err != nil {
+		return "", err
+	}
+	extra, err := renderTemplate(b.CacheKey, vars)
+	if err != nil {
+		return "", fmt.Errorf("cache_key: %w", err)
+	}
+	return contentKey(artifactBuild, vars.Impl, b.Repo, vars.Commit, argv, env, extra), nil
+}
+
+// build makes sure the adapter's impl is built for the job, building it
+// unless the artifact cache has a build with the same key. Jobs without a
+// commit always build, since their source is whatever the repo's HEAD is,
+// and their builds are not cached. It sets vars.BuildDir and
+// vars.SourceDir for the adapter's templates.
+func (m *JobManager) build(spec *BuildSpec, vars *scenarioVars) (*BuildData, error) {
+	key, err := spec.buildKey(*vars)
+	if err != nil {
+		return nil, err
+	}
+	dir := m.cache.buildPath(key)
+	vars.BuildDir = dir
+	if spec.Repo != "" {
+		vars.SourceDir = filepath.Join(dir, "src")
+	}
+
+	if vars.Commit != "" {
+		if a := m.cache.use(key); a != nil {
+			if _, err := os.Stat(dir); err == nil {
+				return &BuildData{
+					Impl:       vars.Impl,
+					Commit:     vars.Commit,
+					CacheKey:   key,
+					Cached:     true,
+					BuiltAt:    a.CreatedAt,
+					DurationMs: a.DurationMs,
+				}, nil
+			}
+			m.cache.forget(key)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if spec.Repo != "" {
+		if err := m.checkoutSource(spec.Repo, vars.Impl, vars.Commit, vars.SourceDir); err != nil {
+			return nil, err
+		}
+	}
+	argv, env, err := spec.render(*vars)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if spec.Timeout != "" {
+		timeout, _ := time.ParseDuration(spec.Timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	logPath := filepath.Join(dir, buildLogFile)
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	out := secrets.writer(logFile)
+	defer out.Close()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	if vars.SourceDir != "" {
+		cmd.Dir = vars.SourceDir
+	}
+	cmd.Stdout, cmd.Stderr = out, out
+	cmd.Env = append(os.Environ(), "CHAINBENCH_COMMIT="+vars.Commit, "CHAINBENCH_BUILD_DIR="+dir)
+	cmd.Env = append(cmd.Env, env...)
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", spec.Timeout)
+		}
+		return nil, fmt.Errorf("%s: %w (log in %s)", argv[0], err, logPath)
+	}
+
+	build := &BuildData{
+		Impl:       vars.Impl,
+		Commit:     vars.Commit,
+		CacheKey:   key,
+		BuiltAt:    start.UTC(),
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if vars.Commit != "" {
+		m.cache.put(&CachedArtifact{
+			Key:        key,
+			Kind:       artifactBuild,
+			Impl:       vars.Impl,
+			Commit:     vars.Commit,
+			Path:       dir,
+			Size:       dirSize(dir),
+			DurationMs: build.DurationMs,
+		})
+	}
+	return build, nil
+}
+
+// preparedAdapter is what a job readied for an impl before its session
+// opened. The artifacts it used stay held in the cache until release.
+type preparedAdapter struct {
+	build  *BuildData
+	images []ImageData
+	held   []string
+}
+
+// prepare builds the adapter's impl and pulls its images, as set up.
+func (m *JobManager) prepare(adapter AdapterSpec, vars *scenarioVars) (*preparedAdapter, error) {
+	p := &preparedAdapter{}
+	if adapter.Build != nil {
+		build, err := m.build(adapter.Build, vars)
+		if err != nil {
+			m.release(p)
+			return nil, fmt.Errorf("build: %w", err)
+		}
+		p.build = build
+		p.held = append(p.held, build.CacheKey)
+	}
+	for _, image := range adapter.Images {
+		ref, err := renderTemplate(image, *vars)
+		if err != nil {
+			m.release(p)
+			return nil, fmt.Errorf("image: %w", err)
+		}
+		pulled, err := m.cache.image(context.Background(), ref)
+		if err != nil {
+			m.release(p)
+			return nil, fmt.Errorf("image %s: %w", ref, err)
+		}
+		p.images = append(p.images, *pulled)
+		p.held = append(p.held, contentKey(artifactImage, ref))
+	}
+	return p, nil
+}
+
+func (m *JobManager) release(p *preparedAdapter) {
+	m.cache.release(p.held...)
+}
+
+// attach records the build and images in the run's evidence. The build log
+// is stored as an artifact once the run is.
+func (p *preparedAdapter) attach(run *scenarioRun) {
+	if p.build != nil {
+		section := *p.build
+		if store != nil {
+			section.Log = buildLogFile
+		}
+		run.attach(func(e *Evidence) { e.Build = &section })
+	}
+	if len(p.images) > 0 {
+		images := p.images
+		run.attach(func(e *Evidence) { e.Images = images })
+	}
+}
+
+// saveBuildLog keeps the build's output with the run as an artifact.
+func (p *preparedAdapter) saveBuildLog(runID, buildDir string) {
+	if p.build == nil || store == nil || runID == "" {
+		return
+	}
+	f, err := os.Open(filepath.Join(buildDir, buildLogFile))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err := store.SaveArtifact(runID, buildLogFile, f); err != nil {
+		log.Printf("Run %s: storing build log: %v", runID, err)
+	}
+}
+
+// checkoutSource checks commit (or the remote's HEAD) out into dir, as a
+// worktree of a mirror clone of repo shared by all of the impl's builds.
+func (m *JobManager) checkoutSource(repo, impl, commit, dir string) error {
+	mirror := filepath.Join(m.cache.dir, "repos", unsafeBuildKey.ReplaceAllString(impl, "_"))
+	if _, err := os.Stat(repo); err == nil {
+		// A local path, which git would resolve against the mirror's parent.
+		repo, _ = filepath.Abs(repo)
+	}
+	if _, err := os.Stat(mirror); err != nil {
+		if err := os.MkdirAll(filepath.Dir(mirror), 0o755); err != nil {
+			return err
+		}
+		if _, err := git(filepath.Dir(mirror), "clone", "--quiet", "--mirror", repo, mirror); err != nil {
+			return err
+		}
+	} else if commit == "" {
+		if _, err := git(mirror, "fetch", "--quiet", "--prune", "origin"); err != nil {
+			return err
+		}
+	} else if _, err := git(mirror, "cat-file", "-e", commit+"^{commit}"); err != nil {
+		if _, err := git(mirror, "fetch", "--quiet", "--prune", "origin"); err != nil {
+			return err
+		}
+	}
+
+	rev := commit
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if _, err := os.Stat(dir); err == nil {
+		_, err := git(dir, "checkout", "--quiet", "--detach", "--force", rev)
+		return err
+	}
+	git(mirror, "worktree", "prune")
+	_, err := git(mirror, "worktree", "add", "--quiet", "--detach", "--force", dir, rev)
+	return err
+}
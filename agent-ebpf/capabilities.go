@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// During a fleet upgrade agents and the aggregator or CLI driving them run
+// different versions. Each agent says what it is at GET /capabilities and
+// in /status: its version, the API version it speaks and the features it
+// has. Clients check a feature before relying on it, and agents predating
+// /capabilities answer it with a 404, so they are told apart and still
+// used for what they had.
+
+// apiVersion is the version of the HTTP API. It goes up only when an
+// existing endpoint changes in a way older clients would misread; new
+// endpoints and fields are announced as features instead. minAPIVersion is
+// the oldest a client may ask for.
+const (
+	apiVersion    = 1
+	minAPIVersion = 1
+)
+
+// Every response carries the agent's version and API version in these
+// headers; a client sends the API version it speaks in the latter.
+const (
+	agentVersionHeader = "X-ChainBench-Agent-Version"
+	apiVersionHeader   = "X-ChainBench-API-Version"
+)
+
+// agentFeatures are what this agent supports, by name.
+var agentFeatures = []string{
+	"sessions",     // POST /start, /stop, /report, GET /status
+	"dry-run",      // POST /start?dry_run=true
+	"idempotency",  // Idempotency-Key on /start, /run and /report
+	"compression",  // gzip and zstd bodies on /stop, /runs, /compare and /ingest
+	"progress",     // /sessions/{id}/progress, with the ETA in /status
+	"phases",       // /sessions/{id}/mark and /sessions/{id}/measure
+	"propagation",  // /propagation
+	"jobs",         // POST /run, /jobs
+	"matrix",       // /matrix
+	"runs",         // /runs, /compare, /trends
+	"machines",     // /machines and class filters
+	"artifacts",    // /artifacts, /storage/usage, /storage/prune
+	"ingest",       // POST /ingest
+	"events",       // /events
+	"fleet",        // /fleet, /fleet/heartbeat
+	"reservations", // /reservations
+	"admin",        // /admin/drain, /admin/maintenance and their fleet states
+	"upgrade",      // /upgrade and upgrade offers in heartbeat replies
+	"replay",       // POST /replay
+	"projects",     // --tokens, X-ChainBench-Project and the project label
+	"roles",        // viewer, runner and admin tokens
+	"secrets",      // {{ secret "name" }} in scenario templates
+	"params",       // scenario params given to /run and /matrix
+	"steady",       // steady-state iterations in /matrix
+	"drift",        // /drift and drift in /matrix tables
+	"plan",         // /plan
+	"anomalies",    // the anomalies evidence section and anomalous verdict
+	"correlations", // /correlations
+}
+
+// Capabilities is the answer to GET /capabilities.
+type Capabilities struct {
+	Version       string   `json:"version"`
+	APIVersion    int      `json:"api_version"`
+	MinAPIVersion int      `json:"min_api_version"`
+	OS            string   `json:"os"`
+	Arch          string   `json:"arch"`
+	Features      []string `json:"features"`
+}
+
+func localCapabilities() *Capabilities {
+	return &Capabilities{
+		Version:       agentVersion,
+		APIVersion:    apiVersion,
+		MinAPIVersion: minAPIVersion,
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Features:      agentFeatures,
+	}
+}
+
+// legacy reports whether the agent predates /capabilities.
+func (c *Capabilities) legacy() bool {
+	return c.APIVersion == 0
+}
+
+// has reports whether the agent has a feature. Legacy agents have none as
+// far as negotiation goes.
+func (c *Capabilities) has(feature string) bool {
+	return slices.Contains(c.Features, feature)
+}
+
+// require fails if the agent at url lacks a feature. Legacy agents are
+// given the benefit of the doubt: their answer to the request itself tells.
+func (c *Capabilities) require(url, feature string) error {
+	if c.legacy() || c.has(feature) {
+		return nil
+	}
+	return fmt.Errorf("agent at %s (version %s) does not support %s; upgrade it first", url, c.Version, feature)
+}
+
+// fetchCapabilities asks the agent at base what it is. An agent answering
+// 404 predates /capabilities and is returned as a legacy one.
+func fetchCapabilities(ctx context.Context, client *http.Client, base string) (*Capabilities, error) {
+	url := strings.TrimSuffix(base, "/") + "/capabilities"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion))
+	authorize(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &Capabilities{Version: "unknown"}, nil
+	default:
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var c Capabilities
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	return &c, nil
+}
+
+// requireFeature fails if the agent at base lacks a feature.
+func requireFeature(ctx context.Context, base, feature string) error {
+	caps, err := fetchCapabilities(ctx, http.DefaultClient, base)
+	if err != nil {
+		return err
+	}
+	return caps.require(base, feature)
+}
+
+// versioned stamps every response with the agent's version and API
+// version, and refuses clients asking for an API version older than the
+// agent still serves. Clients asking for a newer one are answered in the
+// agent's own and read its headers to adapt.
+func versioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(agentVersionHeader, agentVersion)
+		w.Header().Set(apiVersionHeader, strconv.Itoa(apiVersion))
+		if v := r.Header.Get(apiVersionHeader); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %q", apiVersionHeader, v), http.StatusBadRequest)
+				return
+			}
+			if n < minAPIVersion {
+				http.Error(w, fmt.Sprintf("client speaks API version %d; this agent (%s) serves %d to %d", n, agentVersion, minAPIVersion, apiVersion), http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(localCapabilities())
+}
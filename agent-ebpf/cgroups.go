@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CgroupData is the kernel's own accounting for one of the target's cgroups
+// over the session: deltas of cpu.stat, memory.events, memory.pressure and
+// io.stat, plus its memory use at the end and peak (memory.peak covers the
+// cgroup's lifetime).
+type CgroupData struct {
+	Path             string  `json:"path"`
+	CPUMs            float64 `json:"cpu_ms"`
+	UserMs           float64 `json:"user_ms"`
+	SystemMs         float64 `json:"system_ms"`
+	Periods          uint64  `json:"periods"`
+	ThrottledPeriods uint64  `json:"throttled_periods"`
+	ThrottledMs      float64 `json:"throttled_ms"`
+	MemoryBytes      uint64  `json:"memory_bytes"`
+	MemoryPeakBytes  uint64  `json:"memory_peak_bytes,omitempty"`
+	MemoryHighEvents uint64  `json:"memory_high_events"`
+	MemoryMaxEvents  uint64  `json:"memory_max_events"`
+	OOMKills         uint64  `json:"oom_kills"`
+	// MemorySomeStallUs is the time at least one of the cgroup's tasks
+	// stalled on memory (reclaim, refaults, swap-in), MemoryFullStallUs the
+	// time all of them did at once, from pressure stall information (PSI).
+	MemorySomeStallUs uint64 `json:"memory_some_stall_us"`
+	MemoryFullStallUs uint64 `json:"memory_full_stall_us"`
+	MajorFaults       uint64 `json:"major_faults"`
+	IOReadBytes       uint64 `json:"io_read_bytes"`
+	IOWriteBytes      uint64 `json:"io_write_bytes"`
+	IOReadOps         uint64 `json:"io_read_ops"`
+	IOWriteOps        uint64 `json:"io_write_ops"`
+}
+
+// cgroupCounters are the cumulative values a delta is taken over.
+type cgroupCounters map[string]uint64
+
+func readKeyValues(path string, into cgroupCounters, prefix string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			into[prefix+fields[0]] = v
+		}
+	}
+}
+
+// exportCgroupMetrics adds the memory stalls summed over the target's
+// cgroups to the run's series; labels are the run's. Cgroup paths are not a
+// label, since every run's scope has a new one.
+func exportCgroupMetrics(labels []string, cgroups []CgroupData) {
+	if len(cgroups) == 0 {
+		return
+	}
+	var some, full uint64
+	for _, cg := range cgroups {
+		some += cg.MemorySomeStallUs
+		full += cg.MemoryFullStallUs
+	}
+	memoryPSISome.WithLabelValues(labels...).Add(float64(some))
+	memoryPSIFull.WithLabelValues(labels...).Add(float64(full))
+}
+
+// readPressure reads the stall totals of a PSI file, "some avg10=.. avg60=..
+// avg300=.. total=<us>" and the same for "full", as <prefix>some and
+// <prefix>full.
+func readPressure(path string, into cgroupCounters, prefix string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if total, ok := strings.CutPrefix(field, "total="); ok {
+				if v, err := strconv.ParseUint(total, 10, 64); err == nil {
+					into[prefix+fields[0]] = v
+				}
+			}
+		}
+	}
+}
+
+// readIOStat sums io.stat over devices: "MAJ:MIN rbytes=.. wbytes=.. ...".
+func readIOStat(path string, into cgroupCounters) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+				into["io."+key] += v
+			}
+		}
+	}
+}
+
+func readCgroupCounters(cgroup string) (cgroupCounters, bool) {
+	dir := filepath.Join(cgroupRoot, strings.TrimPrefix(cgroup, "/"))
+	if _, err := os.Stat(dir); err != nil {
+		return nil, false
+	}
+	c := cgroupCounters{}
+	readKeyValues(filepath.Join(dir, "cpu.stat"), c, "cpu.")
+	readKeyValues(filepath.Join(dir, "memory.events"), c, "events.")
+	readKeyValues(filepath.Join(dir, "memory.stat"), c, "memory.")
+	readPressure(filepath.Join(dir, "memory.pressure"), c, "psi.memory.")
+	readIOStat(filepath.Join(dir, "io.stat"), c)
+	for _, file := range []string{"memory.current", "memory.peak"} {
+		if v, err := strconv.ParseUint(readTrimmed(filepath.Join(dir, file)), 10, 64); err == nil {
+			c[file] = v
+		}
+	}
+	return c, true
+}
+
+// cgroupAccounting follows the cgroups the target's processes live in. Each
+// cgroup's baseline is read when it is first seen, and its counters are
+// re-read every second so a cgroup removed before Stop still reports.
+type cgroupAccounting struct {
+	tracker *targetTracker
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu    sync.Mutex
+	first map[string]cgroupCounters
+	last  map[string]cgroupCounters
+}
+
+func startCgroupAccounting(tracker *targetTracker) *cgroupAccounting {
+	a := &cgroupAccounting{
+		tracker: tracker,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		first:   map[string]cgroupCounters{},
+		last:    map[string]cgroupCounters{},
+	}
+	a.sample()
+	go a.loop()
+	return a
+}
+
+func (a *cgroupAccounting) loop() {
+	defer close(a.done)
+	ticker := newPacedTicker(time.Second)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.sample()
+		}
+	}
+}
+
+// cgroups lists the target's cgroups. Processes in the root cgroup are
+// skipped: its counters describe the whole machine.
+func (a *cgroupAccounting) cgroups() map[string]bool {
+	paths := map[string]bool{}
+	if cgroup := a.tracker.target.Cgroup; cgroup != "" {
+		paths["/"+strings.TrimPrefix(cgroup, "/")] = true
+	}
+	for _, pid := range a.tracker.PIDs() {
+		if cgroup := processCgroup(pid); cgroup != "" && cgroup != "/" {
+			paths[cgroup] = true
+		}
+	}
+	return paths
+}
+
+func (a *cgroupAccounting) sample() {
+	paths := a.cgroups()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for path := range a.last {
+		paths[path] = true
+	}
+	for path := range paths {
+		counters, ok := readCgroupCounters(path)
+		if !ok {
+			continue
+		}
+		if _, seen := a.first[path]; !seen {
+			a.first[path] = counters
+		}
+		a.last[path] = counters
+	}
+}
+
+func (a *cgroupAccounting) Stop() []CgroupData {
+	close(a.stop)
+	<-a.done
+	a.sample()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out []CgroupData
+	for path, first := range a.first {
+		last := a.last[path]
+		delta := func(key string) uint64 {
+			if last[key] < first[key] {
+				return 0
+			}
+			return last[key] - first[key]
+		}
+		out = append(out, CgroupData{
+			Path:              path,
+			CPUMs:             float64(delta("cpu.usage_usec")) / 1000,
+			UserMs:            float64(delta("cpu.user_usec")) / 1000,
+			SystemMs:          float64(delta("cpu.system_usec")) / 1000,
+			Periods:           delta("cpu.nr_periods"),
+			ThrottledPeriods:  delta("cpu.nr_throttled"),
+			ThrottledMs:       float64(delta("cpu.throttled_usec")) / 1000,
+			MemoryBytes:       last["memory.current"],
+			MemoryPeakBytes:   last["memory.peak"],
+			MemoryHighEvents:  delta("events.high"),
+			MemoryMaxEvents:   delta("events.max"),
+			OOMKills:          delta("events.oom_kill"),
+			MemorySomeStallUs: delta("psi.memory.some"),
+			MemoryFullStallUs: delta("psi.memory.full"),
+			MajorFaults:       delta("memory.pgmajfault"),
+			IOReadBytes:       delta("io.rbytes"),
+			IOWriteBytes:      delta("io.wbytes"),
+			IOReadOps:         delta("io.rios"),
+			IOWriteOps:        delta("io.wios"),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ClockData records the state of timekeeping over the window. Durations the
+// agent measures use the monotonic clock, but workloads often time
+// themselves with the wall clock, which a step or fast slew corrupts.
+type ClockData struct {
+	Clocksource   string   `json:"clocksource"`
+	SyncDaemon    string   `json:"sync_daemon,omitempty"`
+	Synchronized  bool     `json:"synchronized"`
+	StartOffsetMs float64  `json:"start_offset_ms"`
+	EndOffsetMs   float64  `json:"end_offset_ms"`
+	MaxOffsetMs   float64  `json:"max_offset_ms"`
+	DriftPPM      float64  `json:"drift_ppm"`
+	MaxErrorMs    float64  `json:"max_error_ms"`
+	Steps         int      `json:"steps"`
+	MaxStepMs     float64  `json:"max_step_ms,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+	Invalid       bool     `json:"invalid,omitempty"`
+}
+
+// invalidateOnClockStep makes a stepped clock invalidate the run rather than
+// only warn about it.
+var invalidateOnClockStep bool
+
+type clockSample struct {
+	offsetMs float64
+	freqPPM  float64
+	maxErrMs float64
+	synced   bool
+}
+
+func timeSyncDaemon() string {
+	for _, info := range procTable() {
+		switch info.comm {
+		case "chronyd", "ntpd", "systemd-timesyn", "timesyncd", "ptp4l", "phc2sys":
+			return info.comm
+		}
+	}
+	return ""
+}
+
+const clockInterval = time.Second
+
+type clockMonitor struct {
+	stop     chan struct{}
+	done     chan struct{}
+	interval time.Duration
+
+	mu        sync.Mutex
+	data      ClockData
+	available bool
+	startFreq float64
+	lastFreq  float64
+}
+
+func startClockMonitor(interval time.Duration) *clockMonitor {
+	m := &clockMonitor{
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		interval: interval,
+	}
+	m.data.Clocksource = readTrimmed("/sys/devices/system/clocksource/clocksource0/current_clocksource")
+	m.data.SyncDaemon = timeSyncDaemon()
+	if s, ok := readKernelClock(); ok {
+		m.available = true
+		m.data.Synchronized = s.synced
+		m.data.StartOffsetMs = s.offsetMs
+		m.startFreq, m.lastFreq = s.freqPPM, s.freqPPM
+	}
+	m.sample()
+	go m.loop()
+	return m
+}
+
+func (m *clockMonitor) loop() {
+	defer close(m.done)
+	ticker := newPacedTicker(m.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+func (m *clockMonitor) sample() {
+	s, ok := readKernelClock()
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data.MaxOffsetMs < s.offsetMs || m.data.MaxOffsetMs < -s.offsetMs {
+		m.data.MaxOffsetMs = max(s.offsetMs, -s.offsetMs)
+	}
+	m.data.MaxErrorMs = max(m.data.MaxErrorMs, s.maxErrMs)
+	m.data.EndOffsetMs = s.offsetMs
+	m.data.Synchronized = m.data.Synchronized && s.synced
+	m.lastFreq = s.freqPPM
+}
+
+// Stop returns the clock summary. Steps are the wall-clock jumps the noise
+// monitor saw against the monotonic clock.
+func (m *clockMonitor) Stop(noise *NoiseData) *ClockData {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	m.sample()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := m.data
+	data.DriftPPM = m.lastFreq
+	if noise != nil {
+		data.Steps, data.MaxStepMs = noise.ClockJumps, noise.MaxJumpMs
+	}
+
+	if !m.available {
+		data.Warnings = append(data.Warnings, "kernel clock state unavailable (adjtimex failed)")
+	} else if !data.Synchronized {
+		data.Warnings = append(data.Warnings, "clock not synchronized to a time source")
+	}
+	switch data.Clocksource {
+	case "hpet", "acpi_pm", "jiffies", "refined-jiffies":
+		data.Warnings = append(data.Warnings, fmt.Sprintf("slow clocksource %s (timer reads are expensive)", data.Clocksource))
+	}
+	if freqChange := m.lastFreq - m.startFreq; freqChange > 50 || freqChange < -50 {
+		data.Warnings = append(data.Warnings, fmt.Sprintf("clock frequency corrected by %.0f ppm during the run", freqChange))
+	}
+	if data.Steps > 0 {
+		data.Warnings = append(data.Warnings, fmt.Sprintf("clock stepped %d times mid-run (largest %.0f ms)", data.Steps, data.MaxStepMs))
+		data.Invalid = invalidateOnClockStep
+	}
+	return &data
+}
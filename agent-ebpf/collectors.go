@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Collector is one source of evidence for a session. Its output lands in the
+// evidence `collectors` section under its name.
+type Collector interface {
+	Name() string
+	// Supported returns why the collector cannot run on this host, or nil.
+	Supported() error
+	Start(ctx context.Context, target *Target) error
+	Stop() (json.RawMessage, error)
+}
+
+// CollectorOptions tunes one collector for a session, e.g.
+// {"interval": "500ms"}. Plugins receive them as given.
+type CollectorOptions map[string]any
+
+// coreCollectors are built into every session; each lists the options it
+// takes. "interval" is a duration, the others are numbers.
+var coreCollectors = map[string][]string{
+	"runqlat":    nil,
+	"biolatency": nil,
+	"offcpu":     {"top"},
+	"exec":       {"top", "stream", "ring_kb", "workers"},
+	"syscalls":   {"stream", "ring_kb", "workers"},
+	"connect":    nil,
+	"handshakes": nil,
+	"fderrors":   nil,
+	"readahead":  nil,
+	"writeback":  nil,
+	"noise":      {"interval", "steal_pct"},
+	"thermal":    {"interval"},
+	"gpu":        {"interval"},
+	"pmu":        nil,
+	"clock":      {"interval"},
+	"swap":       {"interval"},
+	"pressure":   {"interval", "some_pct"},
+	"compaction": {"interval"},
+	"cgroups":    nil,
+	"threads":    {"interval", "top"},
+	"sockets":    {"interval"},
+	"files":      {"interval"},
+}
+
+func (o CollectorOptions) parseNumber(key string) (float64, bool, error) {
+	switch v := o[key].(type) {
+	case nil:
+		return 0, false, nil
+	case float64:
+		return v, true, nil
+	case int:
+		return float64(v), true, nil
+	default:
+		return 0, false, fmt.Errorf("option %s: expected a number, got %v", key, v)
+	}
+}
+
+func (o CollectorOptions) parseDuration(key string) (time.Duration, bool, error) {
+	v, ok := o[key]
+	if !ok {
+		return 0, false, nil
+	}
+	str, _ := v.(string)
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, false, fmt.Errorf("option %s: %q is not a duration", key, v)
+	}
+	if d < time.Millisecond {
+		return 0, false, fmt.Errorf("option %s: must be at least 1ms", key)
+	}
+	return d, true, nil
+}
+
+// number and duration return the option, or def when it is unset. Options
+// are checked by validateCollectors before a session starts.
+func (o CollectorOptions) number(key string, def float64) float64 {
+	if v, ok, err := o.parseNumber(key); ok && err == nil {
+		return v
+	}
+	return def
+}
+
+func (o CollectorOptions) count(key string, def int) int {
+	return int(o.number(key, float64(def)))
+}
+
+func (o CollectorOptions) duration(key string, def time.Duration) time.Duration {
+	if d, ok, err := o.parseDuration(key); ok && err == nil {
+		return d
+	}
+	return def
+}
+
+// collectorEnabled reports whether a selection runs the named collector: a
+// nil selection runs everything with defaults.
+func collectorEnabled(selection map[string]CollectorOptions, name string) (CollectorOptions, bool) {
+	if selection == nil {
+		return nil, true
+	}
+	opts, ok := selection[name]
+	return opts, ok
+}
+
+// validateCollectors checks that every selected collector exists and
+// accepts its options.
+func validateCollectors(selection map[string]CollectorOptions) error {
+	for name, opts := range selection {
+		if keys, ok := coreCollectors[name]; ok {
+			for key := range opts {
+				var err error
+				switch {
+				case !slices.Contains(keys, key):
+					err = fmt.Errorf("unknown option %q", key)
+				case key == "interval":
+					_, _, err = opts.parseDuration(key)
+				default:
+					_, _, err = opts.parseNumber(key)
+				}
+				if err != nil {
+					return fmt.Errorf("collector %s: %w", name, err)
+				}
+			}
+			continue
+		}
+
+		t, ok := getCollectorType(name)
+		if !ok {
+			return fmt.Errorf("unknown collector %q", name)
+		}
+		if len(opts) == 0 {
+			continue
+		}
+		c, ok := t.New().(configurable)
+		if !ok {
+			return fmt.Errorf("collector %s takes no options", name)
+		}
+		if err := c.Configure(opts); err != nil {
+			return fmt.Errorf("collector %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// configurable is implemented by registered collectors that take options.
+// Configure is called before Start.
+type configurable interface {
+	Configure(opts CollectorOptions) error
+}
+
+// collectorType creates a fresh Collector for each session. Source is the
+// plugin's path.
+type collectorType struct {
+	New    func() Collector
+	Source string
+}
+
+var (
+	collectorsMu   sync.RWMutex
+	collectorTypes = map[string]collectorType{}
+)
+
+func collectorNames() []string {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	names := make([]string, 0, len(collectorTypes))
+	for name := range collectorTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getCollectorType(name string) (collectorType, bool) {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	t, ok := collectorTypes[name]
+	return t, ok
+}
+
+// collectorSet is the collectors running for one session.
+type collectorSet struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	running []Collector
+	// early holds sections of collectors the overhead governor stopped.
+	early map[string]json.RawMessage
+}
+
+// processCollector runs as its own process, so its CPU use can be measured.
+type processCollector interface {
+	PID() int
+}
+
+type sessionIDKey struct{}
+
+// sessionIDFrom returns the ID of the session a collector was started for.
+func sessionIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey{}).(string)
+	return id
+}
+
+func startCollectors(sessionID string, target *Target, selection map[string]CollectorOptions) *collectorSet {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), sessionIDKey{}, sessionID))
+	set := &collectorSet{cancel: cancel}
+	for _, name := range collectorNames() {
+		opts, enabled := collectorEnabled(selection, name)
+		t, ok := getCollectorType(name)
+		if !enabled || !ok {
+			continue
+		}
+		c := t.New()
+		if err := c.Supported(); err != nil {
+			if selection != nil {
+				log.Printf("Collector %s: not supported: %v", name, err)
+			}
+			continue
+		}
+		if cfg, ok := c.(configurable); ok && len(opts) > 0 {
+			if err := cfg.Configure(opts); err != nil {
+				log.Printf("Collector %s: %v", name, err)
+				continue
+			}
+		}
+		if err := c.Start(ctx, target); err != nil {
+			log.Printf("Collector %s: start: %v", name, err)
+			continue
+		}
+		set.running = append(set.running, c)
+	}
+	return set
+}
+
+// Stop ends every running collector and returns their sections by name.
+// A collector that fails is logged and left out.
+func (s *collectorSet) Stop() map[string]json.RawMessage {
+	if s == nil {
+		return nil
+	}
+	defer s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sections := s.early
+	for _, c := range s.running {
+		data, err := c.Stop()
+		if err != nil {
+			log.Printf("Collector %s: stop: %v", c.Name(), err)
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if sections == nil {
+			sections = map[string]json.RawMessage{}
+		}
+		sections[c.Name()] = data
+	}
+	s.running = nil
+	return sections
+}
+
+// processes returns the PIDs of running collectors that are processes.
+func (s *collectorSet) processes() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pids := map[string]int{}
+	for _, c := range s.running {
+		if p, ok := c.(processCollector); ok && p.PID() > 0 {
+			pids[c.Name()] = p.PID()
+		}
+	}
+	return pids
+}
+
+// stopEarly stops one collector mid-session, keeping what it collected.
+func (s *collectorSet) stopEarly(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.running {
+		if c.Name() != name {
+			continue
+		}
+		s.running = append(s.running[:i], s.running[i+1:]...)
+		data, err := c.Stop()
+		if err != nil {
+			log.Printf("Collector %s: stop: %v", name, err)
+			return true
+		}
+		if len(data) > 0 {
+			if s.early == nil {
+				s.early = map[string]json.RawMessage{}
+			}
+			s.early[name] = data
+		}
+		return true
+	}
+	return false
+}
+
+// Exec plugins are executables in --plugin-dir that speak newline-delimited
+// JSON on stdin/stdout:
+//
+//	-> {"op":"describe"}                       <- {"name":"zfs-arc","supported":true}
+//	-> {"op":"start","session_id":..,"target":..,"options":..}
+//	-> {"op":"stop"}                           <- {"evidence":{...}} or {"error":"..."}
+//
+// describe runs in its own process at discovery; a session keeps one process
+// from start to stop. Stderr is passed through to the agent's log.
+type pluginRequest struct {
+	Op        string  `json:"op"`
+	SessionID string  `json:"session_id,omitempty"`
+	Target    *Target `json:"target,omitempty"`
+
+	Options CollectorOptions `json:"options,omitempty"`
+}
+
+type pluginResponse struct {
+	Name      string          `json:"name,omitempty"`
+	Supported bool            `json:"supported,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Evidence  json.RawMessage `json:"evidence,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+const (
+	pluginDescribeTimeout = 5 * time.Second
+	pluginStopTimeout     = 30 * time.Second
+)
+
+type execPlugin struct {
+	path        string
+	name        string
+	unsupported string
+	options     CollectorOptions
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func (p *execPlugin) Name() string { return p.name }
+
+func (p *execPlugin) PID() int {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
+func (p *execPlugin) Supported() error {
+	if p.unsupported != "" {
+		return errors.New(p.unsupported)
+	}
+	return nil
+}
+
+// spawn starts the plugin process and sends it its first request.
+func (p *execPlugin) spawn(ctx context.Context, req pluginRequest) error {
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd, p.stdin, p.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return p.send(req)
+}
+
+func (p *execPlugin) send(req pluginRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = p.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// receive reads one response line, killing the process if none arrives in
+// time.
+func (p *execPlugin) receive(timeout time.Duration) (*pluginResponse, error) {
+	type result struct {
+		line []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		line, err := p.stdout.ReadBytes('\n')
+		ch <- result{line, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil && len(r.line) == 0 {
+			return nil, fmt.Errorf("no response: %w", r.err)
+		}
+		var resp pluginResponse
+		if err := json.Unmarshal(r.line, &resp); err != nil {
+			return nil, fmt.Errorf("bad response: %w", err)
+		}
+		return &resp, nil
+	case <-time.After(timeout):
+		p.cmd.Process.Kill()
+		return nil, fmt.Errorf("no response within %s", timeout)
+	}
+}
+
+func (p *execPlugin) finish() {
+	p.stdin.Close()
+	p.cmd.Wait()
+}
+
+func (p *execPlugin) describe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDescribeTimeout)
+	defer cancel()
+
+	if err := p.spawn(ctx, pluginRequest{Op: "describe"}); err != nil {
+		return err
+	}
+	defer p.finish()
+	resp, err := p.receive(pluginDescribeTimeout)
+	if err != nil {
+		return err
+	}
+	if resp.Name != "" {
+		p.name = resp.Name
+	}
+	if !resp.Supported {
+		p.unsupported = resp.Reason
+		if p.unsupported == "" {
+			p.unsupported = "plugin reports unsupported"
+		}
+	}
+	return nil
+}
+
+// Configure keeps the options for the start request; plugins check them
+// themselves.
+func (p *execPlugin) Configure(opts CollectorOptions) error {
+	p.options = opts
+	return nil
+}
+
+func (p *execPlugin) Start(ctx context.Context, target *Target) error {
+	return p.spawn(ctx, pluginRequest{Op: "start", SessionID: sessionIDFrom(ctx), Target: target, Options: p.options})
+}
+
+func (p *execPlugin) Stop() (json.RawMessage, error) {
+	defer p.finish()
+	if err := p.send(pluginRequest{Op: "stop"}); err != nil {
+		return nil, err
+	}
+	resp, err := p.receive(pluginStopTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Evidence, nil
+}
+
+// loadPlugins discovers exec plugins in dir, replacing those found by an
+// earlier call. A missing dir means no plugins.
+func loadPlugins(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	loaded := map[string]collectorType{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+
+		plugin := &execPlugin{path: path, name: entry.Name()}
+		if err := plugin.describe(); err != nil {
+			log.Printf("Plugin %s: describe: %v", path, err)
+			continue
+		}
+		if _, ok := coreCollectors[plugin.name]; ok {
+			log.Printf("Plugin %s: collector %q is built in", path, plugin.name)
+			continue
+		}
+		if existing, ok := loaded[plugin.name]; ok {
+			log.Printf("Plugin %s: collector %q already provided by %s", path, plugin.name, existing.Source)
+			continue
+		}
+		name, unsupported := plugin.name, plugin.unsupported
+		loaded[name] = collectorType{
+			New: func() Collector {
+				return &execPlugin{path: path, name: name, unsupported: unsupported}
+			},
+			Source: path,
+		}
+	}
+
+	collectorsMu.Lock()
+	collectorTypes = loaded
+	collectorsMu.Unlock()
+	return nil
+}
+
+type collectorInfo struct {
+	Name      string   `json:"name"`
+	Source    string   `json:"source"`
+	Supported bool     `json:"supported"`
+	Reason    string   `json:"reason,omitempty"`
+	Variant   string   `json:"variant,omitempty"`
+	Options   []string `json:"options,omitempty"`
+}
+
+func handleCollectors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := make([]collectorInfo, 0)
+	core := make([]string, 0, len(coreCollectors))
+	for name := range coreCollectors {
+		core = append(core, name)
+	}
+	sort.Strings(core)
+	for _, name := range core {
+		info := collectorInfo{Name: name, Source: "core", Supported: true, Options: coreCollectors[name]}
+		if ebpfMatrix[name] != nil {
+			variant, err := selectVariant(name, nil)
+			info.Variant = variant
+			if err != nil {
+				info.Supported = false
+				info.Reason = err.Error()
+			}
+		}
+		infos = append(infos, info)
+	}
+	for _, name := range collectorNames() {
+		t, ok := getCollectorType(name)
+		if !ok {
+			continue
+		}
+		info := collectorInfo{Name: name, Source: t.Source, Supported: true}
+		if err := t.New().Supported(); err != nil {
+			info.Supported = false
+			info.Reason = err.Error()
+		}
+		infos = append(infos, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
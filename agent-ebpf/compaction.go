@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CompactionData attributes background LSM compaction in the target
+// processes. CPU and I/O come from threads whose names match the storage
+// engine's compaction pools (RocksDB names them rocksdb:low/high/bottom);
+// stalls are counted from the engine's own log lines.
+type CompactionData struct {
+	Threads      int      `json:"threads"`
+	CPUMs        float64  `json:"cpu_ms"`
+	PeakCPUPct   float64  `json:"peak_cpu_pct"`
+	ActiveShare  float64  `json:"active_share"`
+	ReadBytes    uint64   `json:"read_bytes"`
+	WriteBytes   uint64   `json:"write_bytes"`
+	Stalls       int      `json:"stalls"`
+	StallSamples []string `json:"stall_samples,omitempty"`
+}
+
+var (
+	compactionThread = regexp.MustCompile(`^(rocksdb:(low|high|bottom)|leveldb|compact)`)
+	compactionStall  = regexp.MustCompile(`(?i)(stalling writes|stopping writes|write stall|compacting, degraded)`)
+)
+
+const compactionInterval = time.Second
+
+// clockTicks is USER_HZ, which is 100 on every Linux platform we run on.
+const clockTicks = 100
+
+type threadCounters struct {
+	cpuTicks uint64
+	read     uint64
+	write    uint64
+}
+
+type compactionSampler struct {
+	tracker  *targetTracker
+	logFile  string
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	last    map[string]threadCounters
+	threads map[string]bool
+	data    CompactionData
+	samples int
+	active  int
+	logPos  int64
+	// lastAt is when the previous sample was taken; the overhead governor
+	// may stretch the interval.
+	lastAt time.Time
+}
+
+func startCompactionSampler(tracker *targetTracker, interval time.Duration) *compactionSampler {
+	s := &compactionSampler{
+		tracker:  tracker,
+		logFile:  tracker.target.LogFile,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		last:     map[string]threadCounters{},
+		threads:  map[string]bool{},
+	}
+	if s.logFile != "" {
+		// Only stalls logged during the window count.
+		if info, err := os.Stat(s.logFile); err == nil {
+			s.logPos = info.Size()
+		}
+	}
+	s.sample(true)
+	go s.loop()
+	return s
+}
+
+func (s *compactionSampler) loop() {
+	defer close(s.done)
+	ticker := newPacedTicker(s.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sample(false)
+		}
+	}
+}
+
+func readThreadCounters(taskDir string) (threadCounters, bool) {
+	var c threadCounters
+	stat, err := os.ReadFile(filepath.Join(taskDir, "stat"))
+	if err != nil {
+		return c, false
+	}
+	// comm may contain spaces; fields are counted from after its ')'.
+	rest := string(stat)
+	if i := strings.LastIndexByte(rest, ')'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 13 {
+		return c, false
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	c.cpuTicks = utime + stime
+
+	if v := procField(filepath.Join(taskDir, "io"), "read_bytes"); v != "" {
+		c.read, _ = strconv.ParseUint(v, 10, 64)
+	}
+	if v := procField(filepath.Join(taskDir, "io"), "write_bytes"); v != "" {
+		c.write, _ = strconv.ParseUint(v, 10, 64)
+	}
+	return c, true
+}
+
+func (s *compactionSampler) sample(baseline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cpuTicks uint64
+	for _, pid := range s.tracker.PIDs() {
+		taskRoot := filepath.Join("/proc", strconv.Itoa(pid), "task")
+		tasks, err := os.ReadDir(taskRoot)
+		if err != nil {
+			continue
+		}
+		for _, task := range tasks {
+			taskDir := filepath.Join(taskRoot, task.Name())
+			if !compactionThread.MatchString(readTrimmed(filepath.Join(taskDir, "comm"))) {
+				continue
+			}
+			counters, ok := readThreadCounters(taskDir)
+			if !ok {
+				continue
+			}
+
+			key := strconv.Itoa(pid) + "/" + task.Name()
+			prev, seen := s.last[key]
+			s.last[key] = counters
+			s.threads[key] = true
+			if !seen {
+				if baseline {
+					continue
+				}
+				// A thread spawned during the window starts from zero.
+				prev = threadCounters{}
+			}
+			if counters.cpuTicks >= prev.cpuTicks {
+				cpuTicks += counters.cpuTicks - prev.cpuTicks
+			}
+			if counters.read >= prev.read {
+				s.data.ReadBytes += counters.read - prev.read
+			}
+			if counters.write >= prev.write {
+				s.data.WriteBytes += counters.write - prev.write
+			}
+		}
+	}
+	now := time.Now()
+	elapsed := now.Sub(s.lastAt)
+	s.lastAt = now
+	if baseline {
+		return
+	}
+
+	cpuMs := float64(cpuTicks) * 1000 / clockTicks
+	s.data.CPUMs += cpuMs
+	// CPU time comes in clock ticks, so an interval shorter than one, such
+	// as the last sample taken at Stop, says nothing about the rate.
+	if elapsed >= time.Second/clockTicks {
+		if pct := cpuMs / (elapsed.Seconds() * 1000) * 100; pct > s.data.PeakCPUPct {
+			s.data.PeakCPUPct = pct
+		}
+	}
+	s.samples++
+	if cpuTicks > 0 {
+		s.active++
+	}
+	s.scanLog()
+}
+
+func (s *compactionSampler) scanLog() {
+	if s.logFile == "" {
+		return
+	}
+	f, err := os.Open(s.logFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() < s.logPos {
+		// Rotated or truncated.
+		s.logPos = 0
+	}
+	if _, err := f.Seek(s.logPos, io.SeekStart); err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Leave a partial last line for the next scan.
+			return
+		}
+		s.logPos += int64(len(line))
+		if compactionStall.MatchString(line) {
+			s.data.Stalls++
+			if len(s.data.StallSamples) < 5 {
+				s.data.StallSamples = append(s.data.StallSamples, strings.TrimSpace(line))
+			}
+		}
+	}
+}
+
+func (s *compactionSampler) Stop() *CompactionData {
+	close(s.stop)
+	<-s.done
+	s.sample(false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.data
+	data.Threads = len(s.threads)
+	if s.samples > 0 {
+		data.ActiveShare = float64(s.active) / float64(s.samples)
+	}
+	return &data
+}
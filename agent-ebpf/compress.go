@@ -0,0 +1,237 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Evidence and folded stacks compress many times over, and labs often pull
+// results over slow management networks, so the evidence endpoints
+// compress their responses with zstd or gzip when the client accepts it,
+// and take request bodies compressed with either.
+
+// contentEncodings are the encodings offered, preferred first when the
+// client rates several alike.
+var contentEncodings = []string{"zstd", "gzip"}
+
+// A compressed body is decoded to at most maxDecodedBodyBytes, and a zstd
+// frame may not ask for a window over zstdMaxWindow, which zstd -19 and
+// --long=25 stay within.
+const (
+	maxDecodedBodyBytes = 1 << 30
+	zstdMaxWindow       = 32 << 20
+)
+
+// newZstdReader decodes a zstd stream from a client, within the limits
+// above.
+func newZstdReader(r io.Reader) (*zstd.Decoder, error) {
+	return zstd.NewReader(r,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(maxDecodedBodyBytes),
+		zstd.WithDecoderMaxWindow(zstdMaxWindow))
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zstdWriters = sync.Pool{New: func() any {
+		enc, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+		return enc
+	}}
+)
+
+// compressed serves h with compressed responses and request bodies.
+func compressed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := decodeRequestBody(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		// A byte range is of the uncompressed body.
+		encoding := acceptedEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			h(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		h(cw, r)
+	}
+}
+
+// acceptedEncoding picks the encoding the request's Accept-Encoding rates
+// highest, or "" for none.
+func acceptedEncoding(r *http.Request) string {
+	rated := map[string]float64{}
+	for _, accept := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(accept, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+			rated[strings.ToLower(name)] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range contentEncodings {
+		q, ok := rated[encoding]
+		if !ok {
+			q, ok = rated["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// decodeRequestBody replaces a compressed request body with its content,
+// cut off with a *http.MaxBytesError past maxDecodedBodyBytes.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request) error {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = http.MaxBytesReader(w, readCloser{gz, r.Body}, maxDecodedBodyBytes)
+	case "zstd":
+		dec, err := newZstdReader(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = http.MaxBytesReader(w, readCloser{dec.IOReadCloser(), r.Body}, maxDecodedBodyBytes)
+	default:
+		return &unsupportedEncodingError{encoding}
+	}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return nil
+}
+
+type unsupportedEncodingError struct{ encoding string }
+
+func (e *unsupportedEncodingError) Error() string {
+	return "unsupported Content-Encoding " + strconv.Quote(e.encoding) + " (gzip or zstd)"
+}
+
+// readCloser reads a decoder and closes it along with the body it reads.
+type readCloser struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (rc readCloser) Close() error {
+	rc.ReadCloser.Close()
+	return rc.body.Close()
+}
+
+// compressWriter compresses what the handler writes, once it is known to
+// be worth it: responses that are already compressed or carry no body are
+// passed through.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         io.WriteCloser
+	wroteHeader bool
+	passthrough bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	h := cw.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if h.Get("Content-Encoding") != "" || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified || alreadyCompressed(mediaType) {
+		cw.passthrough = true
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	cw.ResponseWriter.WriteHeader(status)
+	switch cw.encoding {
+	case "gzip":
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(cw.ResponseWriter)
+		cw.enc = gz
+	case "zstd":
+		enc := zstdWriters.Get().(*zstd.Encoder)
+		enc.Reset(cw.ResponseWriter)
+		cw.enc = enc
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.passthrough {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.enc.Write(p)
+}
+
+// Flush sends what has been compressed so far, for streamed responses.
+func (cw *compressWriter) Flush() {
+	if cw.enc != nil {
+		switch enc := cw.enc.(type) {
+		case *gzip.Writer:
+			enc.Flush()
+		case *zstd.Encoder:
+			enc.Flush()
+		}
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close finishes the compressed stream and returns the encoder to its pool.
+func (cw *compressWriter) Close() {
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Reset(io.Discard)
+		gzipWriters.Put(enc)
+	case *zstd.Encoder:
+		enc.Reset(io.Discard)
+		zstdWriters.Put(enc)
+	}
+	cw.enc = nil
+}
+
+// alreadyCompressed reports whether a media type gains nothing from being
+// compressed again.
+func alreadyCompressed(mediaType string) bool {
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zstd", "application/zip", "application/x-tar+zstd":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml"
+}
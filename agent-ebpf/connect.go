@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConnectData is how long the target waited to reach its peers: TCP
+// connection establishment, from SYN sent to established, and name lookups
+// through libc's getaddrinfo. Slow peer discovery shows up here long before
+// it shows up as a slower sync.
+type ConnectData struct {
+	Histogram []HistogramBucket `json:"histogram"`
+	P95Us     float64           `json:"p95_us"`
+	Connects  int               `json:"connects"`
+	// Failed counts connects that never got established: refused, reset or
+	// timed out.
+	Failed int `json:"failed"`
+	// The lookups are only those through libc; Go's own resolver, which
+	// most Go nodes use, does not call it.
+	DNSHistogram  []HistogramBucket `json:"dns_histogram,omitempty"`
+	DNSP95Us      float64           `json:"dns_p95_us,omitempty"`
+	Lookups       int               `json:"lookups"`
+	LookupsFailed int               `json:"lookups_failed"`
+}
+
+// libcName matches the file names of glibc and musl.
+var libcName = regexp.MustCompile(`^(libc\.so\.\d+|libc-[\d.]+\.so|ld-musl-[^/]+\.so\.1|libc\.musl-[^/]+\.so\.1)$`)
+
+// targetLibcs returns the libc files the target's processes have mapped,
+// or the host's libc without a target.
+func targetLibcs(pids []int) []string {
+	if len(pids) == 0 {
+		return hostFiles("/lib*/libc.so.6", "/lib/*/libc.so.6", "/usr/lib*/libc.so.6", "/usr/lib/*/libc.so.6", "/lib/ld-musl-*.so.1")
+	}
+	return mappedFiles(pids, libcName.MatchString)
+}
+
+// mappedFiles returns the files the processes have mapped whose base name
+// matches, through /proc/<pid>/root so that a container's own copy is
+// found. Each file is listed once.
+func mappedFiles(pids []int, match func(base string) bool) []string {
+	var paths []string
+	for _, pid := range pids {
+		file, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "maps"))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 6 || !match(filepath.Base(fields[5])) {
+				continue
+			}
+			paths = append(paths, filepath.Join("/proc", strconv.Itoa(pid), "root", fields[5]))
+		}
+		file.Close()
+	}
+	return uniqueFiles(paths)
+}
+
+// hostFiles returns the files matching the glob patterns, each once.
+func hostFiles(patterns ...string) []string {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	return uniqueFiles(paths)
+}
+
+// uniqueFiles drops the paths that do not exist or name a file listed
+// before, so that a uprobe is not attached twice.
+func uniqueFiles(paths []string) []string {
+	var unique []string
+	var seen []os.FileInfo
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		same := false
+		for _, s := range seen {
+			same = same || os.SameFile(s, info)
+		}
+		if !same {
+			seen = append(seen, info)
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
+
+func (c *EvidenceCollector) collectConnect(out *bpftraceOutput) *ConnectData {
+	hist, dns := out.hists["connect_usecs"], out.hists["dns_usecs"]
+	data := &ConnectData{
+		Histogram:     hist,
+		P95Us:         histogramPercentile(hist, 0.95),
+		Failed:        int(out.maps["connect_failed"][""]),
+		DNSHistogram:  dns,
+		DNSP95Us:      histogramPercentile(dns, 0.95),
+		LookupsFailed: int(out.maps["dns_failed"][""]),
+	}
+	for _, bucket := range hist {
+		data.Connects += bucket.Count
+	}
+	for _, bucket := range dns {
+		data.Lookups += bucket.Count
+	}
+	for h, hist := range map[*prometheus.HistogramVec][]HistogramBucket{connectHistogram: hist, dnsHistogram: dns} {
+		observer := h.WithLabelValues(c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project)
+		for _, bucket := range hist {
+			for i := 0; i < bucket.Count; i++ {
+				observer.Observe(float64(bucket.BucketUs))
+			}
+		}
+	}
+	return data
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContainerInfo is what the session recorded about a container target.
+type ContainerInfo struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	Image            string  `json:"image"`
+	ImageDigest      string  `json:"image_digest,omitempty"`
+	PID              int     `json:"pid"`
+	Cgroup           string  `json:"cgroup,omitempty"`
+	PIDNamespace     string  `json:"pid_namespace,omitempty"`
+	CPULimit         float64 `json:"cpu_limit,omitempty"`
+	CPUSet           string  `json:"cpuset,omitempty"`
+	MemoryLimitBytes int64   `json:"memory_limit_bytes,omitempty"`
+	PidsLimit        int64   `json:"pids_limit,omitempty"`
+}
+
+// dockerSocket honours DOCKER_HOST when it names a unix socket.
+func dockerSocket() string {
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	return "/var/run/docker.sock"
+}
+
+var dockerClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", dockerSocket())
+		},
+	},
+}
+
+func dockerGet(path string, out interface{}) error {
+	resp, err := dockerClient.Get("http://docker" + path)
+	if err != nil {
+		return fmt.Errorf("docker: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// processCgroup returns the unified (v2) cgroup path of pid.
+func processCgroup(pid int) string {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+func inspectContainer(ref string) (*ContainerInfo, error) {
+	var c struct {
+		ID     string `json:"Id"`
+		Name   string `json:"Name"`
+		Image  string `json:"Image"`
+		Config struct {
+			Image string `json:"Image"`
+		} `json:"Config"`
+		State struct {
+			Running bool `json:"Running"`
+			Pid     int  `json:"Pid"`
+		} `json:"State"`
+		HostConfig struct {
+			NanoCpus   int64  `json:"NanoCpus"`
+			CpuQuota   int64  `json:"CpuQuota"`
+			CpuPeriod  int64  `json:"CpuPeriod"`
+			CpusetCpus string `json:"CpusetCpus"`
+			Memory     int64  `json:"Memory"`
+			PidsLimit  *int64 `json:"PidsLimit"`
+		} `json:"HostConfig"`
+	}
+	if err := dockerGet("/containers/"+url.PathEscape(ref)+"/json", &c); err != nil {
+		return nil, err
+	}
+	if !c.State.Running || c.State.Pid == 0 {
+		return nil, fmt.Errorf("container %s is not running", ref)
+	}
+
+	info := &ContainerInfo{
+		ID:               c.ID,
+		Name:             strings.TrimPrefix(c.Name, "/"),
+		Image:            c.Config.Image,
+		ImageDigest:      c.Image,
+		PID:              c.State.Pid,
+		Cgroup:           processCgroup(c.State.Pid),
+		CPUSet:           c.HostConfig.CpusetCpus,
+		MemoryLimitBytes: c.HostConfig.Memory,
+	}
+	info.PIDNamespace, _ = os.Readlink(filepath.Join("/proc", strconv.Itoa(c.State.Pid), "ns", "pid"))
+	switch {
+	case c.HostConfig.NanoCpus > 0:
+		info.CPULimit = float64(c.HostConfig.NanoCpus) / 1e9
+	case c.HostConfig.CpuQuota > 0 && c.HostConfig.CpuPeriod > 0:
+		info.CPULimit = float64(c.HostConfig.CpuQuota) / float64(c.HostConfig.CpuPeriod)
+	}
+	if c.HostConfig.PidsLimit != nil && *c.HostConfig.PidsLimit > 0 {
+		info.PidsLimit = *c.HostConfig.PidsLimit
+	}
+
+	// Prefer the registry digest, which identifies the image across hosts;
+	// locally built images only have their ID.
+	var image struct {
+		RepoDigests []string `json:"RepoDigests"`
+	}
+	if dockerGet("/images/"+url.PathEscape(c.Image)+"/json", &image) == nil && len(image.RepoDigests) > 0 {
+		info.ImageDigest = image.RepoDigests[0]
+	}
+	return info, nil
+}
+
+var (
+	containerCacheMu sync.Mutex
+	containerCache   = map[string]*ContainerInfo{}
+)
+
+// containerProcs returns every process in the container's cgroup, which
+// also covers processes started with docker exec. The inspect result is
+// cached until the container's cgroup disappears.
+func containerProcs(ref string) ([]int, *ContainerInfo) {
+	containerCacheMu.Lock()
+	info := containerCache[ref]
+	containerCacheMu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if info == nil {
+			var err error
+			if info, err = inspectContainer(ref); err != nil {
+				return nil, nil
+			}
+			containerCacheMu.Lock()
+			containerCache[ref] = info
+			containerCacheMu.Unlock()
+		}
+
+		if info.Cgroup == "" {
+			return []int{info.PID}, info
+		}
+		if pids, ok := cgroupProcs(info.Cgroup); ok {
+			return pids, info
+		}
+		// Restarted or removed; inspect again.
+		info = nil
+	}
+	return nil, nil
+}
+
+func cgroupProcs(cgroup string) ([]int, bool) {
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, strings.TrimPrefix(cgroup, "/"), "cgroup.procs"))
+	if err != nil {
+		return nil, false
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, true
+}
+
+func (c *ContainerInfo) String() string {
+	parts := []string{c.Name, c.Image}
+	if c.ImageDigest != "" {
+		parts = append(parts, c.ImageDigest)
+	}
+	if c.CPULimit > 0 {
+		parts = append(parts, fmt.Sprintf("cpus=%g", c.CPULimit))
+	}
+	if c.CPUSet != "" {
+		parts = append(parts, "cpuset="+c.CPUSet)
+	}
+	if c.MemoryLimitBytes > 0 {
+		parts = append(parts, fmt.Sprintf("memory=%dMiB", c.MemoryLimitBytes>>20))
+	}
+	if c.PidsLimit > 0 {
+		parts = append(parts, fmt.Sprintf("pids=%d", c.PidsLimit))
+	}
+	return strings.Join(parts, " ")
+}
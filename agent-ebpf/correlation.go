@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CorrelationReport ranks the evidence figures of a scenario's runs by how
+// closely they follow its benchmark duration, or another figure named as
+// Target, across the run history. A kernel signal that rises and falls with
+// the duration is the one worth watching, and the one to look at first when
+// the duration moves.
+type CorrelationReport struct {
+	Scenario     string        `json:"scenario"`
+	Target       string        `json:"target"`
+	Runs         int           `json:"runs"`
+	Correlations []Correlation `json:"correlations"`
+}
+
+// Correlation is one figure's rank (Spearman) and linear (Pearson)
+// correlation with the target over the runs that recorded both. With many
+// figures tested some correlate by chance, so Significant holds P against
+// correlationAlpha divided by the number of figures (Bonferroni).
+type Correlation struct {
+	Metric      string  `json:"metric"`
+	Runs        int     `json:"runs"`
+	Spearman    float64 `json:"spearman"`
+	Pearson     float64 `json:"pearson"`
+	P           float64 `json:"p"`
+	Significant bool    `json:"significant"`
+}
+
+// A figure needs correlationMinRuns runs, and a spread, to be ranked.
+const (
+	correlationMinRuns = 10
+	correlationAlpha   = 0.05
+)
+
+// correlationTarget is the target name of the benchmark duration.
+const correlationTarget = "duration_ms"
+
+// runCorrelations correlates every evidence figure of the runs with target,
+// the benchmark duration or an evidence figure.
+func runCorrelations(scenario, target string, runs []*Run) (*CorrelationReport, error) {
+	type pairs struct{ x, y []float64 }
+	series := map[string]*pairs{}
+	counted := 0
+	for _, run := range runs {
+		values := evidenceValues(run.Evidence)
+		y, ok := benchmarkMs(run), benchmarkMs(run) > 0
+		if target != correlationTarget {
+			y, ok = values[target]
+		}
+		if !ok {
+			continue
+		}
+		counted++
+		for name, x := range values {
+			// Per-command exec counts come and go with the workload's own
+			// scheduling; they predict nothing.
+			if name == target || strings.HasPrefix(name, "exec.cmd.") {
+				continue
+			}
+			if series[name] == nil {
+				series[name] = &pairs{}
+			}
+			series[name].x = append(series[name].x, x)
+			series[name].y = append(series[name].y, y)
+		}
+	}
+	if counted < correlationMinRuns {
+		return nil, fmt.Errorf("correlations need at least %d runs of scenario %s with %s, got %d", correlationMinRuns, scenario, target, counted)
+	}
+
+	report := &CorrelationReport{Scenario: scenario, Target: target, Runs: counted, Correlations: []Correlation{}}
+	for name, s := range series {
+		if len(s.x) < correlationMinRuns || variance(s.x) == 0 || variance(s.y) == 0 {
+			continue
+		}
+		rho := spearman(s.x, s.y)
+		report.Correlations = append(report.Correlations, Correlation{
+			Metric: name, Runs: len(s.x), Spearman: rho, Pearson: pearson(s.x, s.y), P: spearmanP(rho, len(s.x)),
+		})
+	}
+	for i := range report.Correlations {
+		report.Correlations[i].Significant = report.Correlations[i].P < correlationAlpha/float64(len(report.Correlations))
+	}
+	sort.Slice(report.Correlations, func(i, j int) bool {
+		a, b := report.Correlations[i], report.Correlations[j]
+		if math.Abs(a.Spearman) != math.Abs(b.Spearman) {
+			return math.Abs(a.Spearman) > math.Abs(b.Spearman)
+		}
+		return a.Metric < b.Metric
+	})
+	return report, nil
+}
+
+// handleCorrelations answers GET /correlations?scenario=X. The runs looked
+// at may be narrowed like a GET /runs query, by default to the latest
+// planDefaultRuns successful ones; target names an evidence figure
+// to correlate with instead of the benchmark duration.
+func handleCorrelations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	if values.Get("scenario") == "" {
+		http.Error(w, "scenario is required", http.StatusBadRequest)
+		return
+	}
+	target := correlationTarget
+	if t := values.Get("target"); t != "" {
+		target = t
+	}
+	values.Del("target")
+
+	q, err := parseRunQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !values.Has("limit") {
+		q.Limit = planDefaultRuns
+	}
+	if !values.Has("result") {
+		q.Results = []string{resultSuccess}
+	}
+	scopeQuery(q, requestScope(r))
+	summaries, _, err := store.Query(q)
+	if errors.Is(err, errBadCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	runs := make([]*Run, 0, len(summaries))
+	for _, s := range summaries {
+		run, err := store.Get(s.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if usableRun(run) {
+			runs = append(runs, run)
+		}
+	}
+	report, err := runCorrelations(values.Get("scenario"), target, runs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
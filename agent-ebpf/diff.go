@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type DiffEntry struct {
+	Metric      string   `json:"metric"`
+	A           float64  `json:"a"`
+	B           float64  `json:"b"`
+	DeltaPct    *float64 `json:"delta_pct"`
+	Significant bool     `json:"significant"`
+}
+
+type EvidenceDiff struct {
+	A            string      `json:"a"`
+	B            string      `json:"b"`
+	ThresholdPct float64     `json:"threshold_pct"`
+	Entries      []DiffEntry `json:"entries"`
+
+	// TuningDifferences lists kernel settings and hardware the two runs'
+	// hosts did not share, disks included; any entry means the comparison is not like for like.
+	TuningDifferences []TuningDifference `json:"tuning_differences,omitempty"`
+
+	// Verdict and Reason judge B's benchmark duration against A's; see
+	// judgeRuns.
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+func loadEvidence(path string) (*Evidence, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var evidence Evidence
+	if err := json.Unmarshal(data, &evidence); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &evidence, nil
+}
+
+func histogramPercentile(hist []HistogramBucket, q float64) float64 {
+	total := 0
+	for _, bucket := range hist {
+		total += bucket.Count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := q * float64(total)
+	cumulative := 0
+	for _, bucket := range hist {
+		cumulative += bucket.Count
+		if float64(cumulative) >= target {
+			return float64(bucket.BucketUs)
+		}
+	}
+	return float64(hist[len(hist)-1].BucketUs)
+}
+
+// evidenceValues flattens the comparable parts of an evidence document into
+// metric-name/value pairs. Missing sections simply contribute no values.
+func evidenceValues(e *Evidence) map[string]float64 {
+	values := map[string]float64{}
+
+	if e.Runqlat != nil {
+		values["runqlat.p50_us"] = histogramPercentile(e.Runqlat.Histogram, 0.50)
+		values["runqlat.p95_us"] = e.Runqlat.P95Us
+		values["runqlat.p99_us"] = histogramPercentile(e.Runqlat.Histogram, 0.99)
+	}
+	if e.Biolatency != nil {
+		values["biolatency.p50_us"] = histogramPercentile(e.Biolatency.Histogram, 0.50)
+		values["biolatency.p95_us"] = e.Biolatency.P95Us
+		values["biolatency.p99_us"] = histogramPercentile(e.Biolatency.Histogram, 0.99)
+		if b := e.Biolatency; b.SequentialIOs+b.RandomIOs > 0 {
+			values["biolatency.sequential_pct"] = b.SequentialPct
+			values["biolatency.median_bytes"] = float64(b.MedianBytes)
+		}
+	}
+	if e.Offcpu != nil {
+		values["offcpu.total_ms"] = e.Offcpu.TotalMs
+		for _, reason := range e.Offcpu.TopReasons {
+			values["offcpu."+reason.Reason+"_ms"] = reason.Ms
+		}
+	}
+	if e.Exec != nil {
+		values["exec.count"] = float64(e.Exec.ExecCount)
+		for _, cmd := range e.Exec.TopCommands {
+			values["exec.cmd."+cmd.Command] = float64(cmd.Count)
+		}
+	}
+	if e.SyscallCounts != nil {
+		values["syscall.futex"] = float64(e.SyscallCounts.Futex)
+		values["syscall.fsync"] = float64(e.SyscallCounts.Fsync)
+		values["syscall.openat"] = float64(e.SyscallCounts.Openat)
+		values["syscall.read"] = float64(e.SyscallCounts.Read)
+		values["syscall.write"] = float64(e.SyscallCounts.Write)
+	}
+	if c := e.Connect; c != nil {
+		values["connect.p95_us"] = c.P95Us
+		values["connect.count"] = float64(c.Connects)
+		values["connect.failed"] = float64(c.Failed)
+		if c.Lookups > 0 {
+			values["dns.p95_us"] = c.DNSP95Us
+		}
+		values["dns.lookups"] = float64(c.Lookups)
+		values["dns.failed"] = float64(c.LookupsFailed)
+	}
+	if r := e.Readahead; r != nil {
+		values["readahead.pages"] = float64(r.Pages)
+		if r.Pages > 0 {
+			values["readahead.efficiency_pct"] = r.EfficiencyPct
+		}
+	}
+	if w := e.Writeback; w != nil {
+		values["writeback.throttled_ms"] = w.ThrottledMs
+		for _, d := range w.Devices {
+			values["writeback."+d.Device+".p95_us"] = d.P95Us
+			values["writeback."+d.Device+".pages"] = float64(d.Pages)
+		}
+	}
+	if e.Handshakes != nil {
+		values["handshakes.count"] = float64(e.Handshakes.Handshakes)
+		for _, h := range e.Handshakes.Stacks {
+			prefix := "handshakes." + h.Stack + "." + h.Library
+			values[prefix+".count"] = float64(h.Handshakes)
+			if h.Ms > 0 {
+				values[prefix+".ms"] = h.Ms
+			}
+		}
+	}
+	if e.RPC != nil {
+		values["rpc.p95_us"] = e.RPC.P95Us
+		values["rpc.error_rate"] = e.RPC.ErrorRate
+		for _, m := range e.RPC.Methods {
+			values["rpc."+m.Method+".p95_us"] = m.P95Us
+		}
+	}
+	if e.Sync != nil {
+		values["sync.stall_ms"] = e.Sync.StallMs
+		values["sync.stalls"] = float64(len(e.Sync.Stalls))
+	}
+	if e.Beacon != nil {
+		values["beacon.head_p95_ms"] = e.Beacon.HeadP95Ms
+		values["beacon.missed_slots"] = float64(e.Beacon.MissedSlots)
+	}
+	if e.Compaction != nil {
+		values["compaction.cpu_ms"] = e.Compaction.CPUMs
+		values["compaction.write_bytes"] = float64(e.Compaction.WriteBytes)
+		values["compaction.stalls"] = float64(e.Compaction.Stalls)
+	}
+	if e.Noise != nil {
+		values["noise.steal_pct"] = e.Noise.StealPct
+		values["noise.clock_jumps"] = float64(e.Noise.ClockJumps)
+	}
+	if e.Clock != nil {
+		values["clock.max_offset_ms"] = e.Clock.MaxOffsetMs
+		values["clock.steps"] = float64(e.Clock.Steps)
+	}
+	if e.GPU != nil {
+		for _, d := range e.GPU.Devices {
+			values["gpu."+d.Device+".util_pct"] = d.MeanUtilPct
+			values["gpu."+d.Device+".peak_memory_mb"] = d.PeakMemoryMB
+			if d.MeanPowerW > 0 {
+				values["gpu."+d.Device+".power_w"] = d.MeanPowerW
+			}
+		}
+	}
+	if e.Thermal != nil {
+		values["thermal.mean_freq_mhz"] = e.Thermal.MeanFreqMHz
+		values["thermal.peak_temp_c"] = e.Thermal.PeakTempC
+		values["thermal.throttle_events"] = float64(e.Thermal.ThrottleEvents)
+	}
+	if e.PMU != nil {
+		counters := map[string]float64{}
+		for _, c := range e.PMU.Counters {
+			counters[c.Event] = float64(c.Value)
+			values["pmu."+c.Event] = float64(c.Value)
+		}
+		if e.PMU.IPC > 0 {
+			values["pmu.ipc"] = e.PMU.IPC
+		}
+		if e.PMU.FrontendStallPct > 0 || e.PMU.BackendStallPct > 0 {
+			values["pmu.frontend_stall_pct"] = e.PMU.FrontendStallPct
+			values["pmu.backend_stall_pct"] = e.PMU.BackendStallPct
+		}
+		if misses, ok := counters["cache_misses"]; ok && counters["instructions"] > 0 {
+			values["pmu.cache_misses_per_kinst"] = misses / counters["instructions"] * 1000
+		}
+	}
+	for _, cg := range e.Cgroups {
+		values["cgroup.cpu_ms"] += cg.CPUMs
+		values["cgroup.throttled_ms"] += cg.ThrottledMs
+		values["cgroup.memory_high_events"] += float64(cg.MemoryHighEvents)
+		values["cgroup.memory_some_stall_ms"] += float64(cg.MemorySomeStallUs) / 1000
+		values["cgroup.memory_full_stall_ms"] += float64(cg.MemoryFullStallUs) / 1000
+		values["cgroup.io_read_bytes"] += float64(cg.IOReadBytes)
+		values["cgroup.io_write_bytes"] += float64(cg.IOWriteBytes)
+	}
+	if e.Threads != nil {
+		for _, r := range e.Threads.Roles {
+			values["thread."+r.Role+".cpu_ms"] = r.CPUMs
+			values["thread."+r.Role+".offcpu_ms"] = r.OffCPUMs
+			values["thread."+r.Role+".runq_mean_us"] = r.RunqMeanUs
+		}
+	}
+	if p := e.Pressure; p != nil {
+		for _, r := range p.Resources {
+			values["pressure."+r.Resource+".some_pct"] = r.SomePct
+			values["pressure."+r.Resource+".full_pct"] = r.FullPct
+		}
+	}
+	if s := e.Swap; s != nil {
+		values["swap.in_pages"] = float64(s.SwapInPages + s.ZswapInPages)
+		values["swap.out_pages"] = float64(s.SwapOutPages + s.ZswapOutPages)
+	}
+	if s := e.Sockets; s != nil {
+		values["sockets.listen_overflows"] = float64(s.ListenOverflows)
+		values["sockets.listen_drops"] = float64(s.ListenDrops)
+		values["sockets.tcp_rcvq_drops"] = float64(s.TCPBacklogDrops + s.TCPRcvQDrops + s.TCPPruned + s.TCPOFODrops)
+		values["sockets.udp_rcvbuf_errors"] = float64(s.UDPRcvbufErrors)
+		for _, p := range s.Ports {
+			prefix := "sockets." + p.Proto + "." + strconv.Itoa(p.Port)
+			values[prefix+".peak_recv_queue_bytes"] = float64(p.PeakRecvBytes)
+			if p.Proto == "udp" {
+				values[prefix+".drops"] = float64(p.Drops)
+			} else {
+				values[prefix+".peak_accept_queue"] = float64(p.PeakAccept)
+			}
+		}
+	}
+	if f := e.Files; f != nil {
+		values["files.peak_fds"] = float64(f.PeakFDs)
+		values["files.dentries_reclaimed"] = float64(f.DentriesReclaimed)
+		values["files.inodes_reclaimed"] = float64(f.InodesReclaimed)
+	}
+	if f := e.FDErrors; f != nil {
+		values["files.emfile"] = float64(f.TooManyOpen)
+		values["files.enfile"] = float64(f.FileTableFull)
+	}
+	if e.Propagation != nil {
+		for _, p := range e.Propagation.Peers {
+			values["propagation."+p.Peer+".p95_ms"] = p.ArrivalP95Ms
+		}
+	}
+	for name, value := range e.Measurements {
+		values["custom."+name] = value
+	}
+
+	return values
+}
+
+func diffEvidence(a, b *Evidence, thresholdPct float64) []DiffEntry {
+	valuesA := evidenceValues(a)
+	valuesB := evidenceValues(b)
+
+	names := make([]string, 0, len(valuesA))
+	for name := range valuesA {
+		names = append(names, name)
+	}
+	for name := range valuesB {
+		if _, ok := valuesA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	entries := make([]DiffEntry, 0, len(names))
+	for _, name := range names {
+		entry := DiffEntry{Metric: name, A: valuesA[name], B: valuesB[name]}
+		if entry.A != 0 {
+			delta := (entry.B - entry.A) / entry.A * 100
+			entry.DeltaPct = &delta
+			entry.Significant = math.Abs(delta) >= thresholdPct
+		} else if entry.B != 0 {
+			// No baseline to take a percentage of; appearing from zero is
+			// always worth pointing out.
+			entry.Significant = true
+		} else {
+			zero := 0.0
+			entry.DeltaPct = &zero
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// compareRuns diffs two runs' evidence, checks that they executed under
+// the same kernel tuning and gives the verdict.
+func compareRuns(a, b *Run, thresholdPct float64) *EvidenceDiff {
+	diff := &EvidenceDiff{
+		A:                 a.ID,
+		B:                 b.ID,
+		ThresholdPct:      thresholdPct,
+		Entries:           diffEvidence(a.Evidence, b.Evidence, thresholdPct),
+		TuningDifferences: tuningDifferences(a.Environment, b.Environment),
+	}
+	diff.Verdict, diff.Reason = judgeRuns(a, b, thresholdPct)
+	return diff
+}
+
+const (
+	ansiReset = "\033[0m"
+	ansiRed   = "\033[31m"
+	ansiGreen = "\033[32m"
+	ansiBold  = "\033[1m"
+)
+
+func printEvidenceDiff(w io.Writer, diff *EvidenceDiff, color bool) {
+	fmt.Fprintf(w, "Evidence diff: %s -> %s (significant: |delta| >= %.1f%%)\n\n", diff.A, diff.B, diff.ThresholdPct)
+	fmt.Fprintf(w, "%-32s %14s %14s %10s\n", "METRIC", "A", "B", "DELTA")
+
+	significant := 0
+	for _, entry := range diff.Entries {
+		delta := "new"
+		if entry.DeltaPct != nil {
+			delta = fmt.Sprintf("%+.1f%%", *entry.DeltaPct)
+		}
+
+		line := fmt.Sprintf("%-32s %14.2f %14.2f %10s", entry.Metric, entry.A, entry.B, delta)
+		if entry.Significant {
+			significant++
+			line += "  !"
+			if color {
+				// Kernel signals are latencies or counts, so growth is the bad
+				// direction. Custom measurements have no known direction.
+				tint := ansiRed
+				if strings.HasPrefix(entry.Metric, "custom.") {
+					tint = ansiBold
+				} else if entry.B < entry.A {
+					tint = ansiGreen
+				}
+				line = tint + line + ansiReset
+			}
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	summary := fmt.Sprintf("\n%d of %d metrics changed significantly", significant, len(diff.Entries))
+	if color {
+		summary = ansiBold + summary + ansiReset
+	}
+	fmt.Fprintln(w, summary)
+	verdict := fmt.Sprintf("verdict: %s (%s)", diff.Verdict, diff.Reason)
+	if color {
+		switch diff.Verdict {
+		case comparisonImproved:
+			verdict = ansiGreen + verdict + ansiReset
+		case comparisonRegressed, comparisonInvalid:
+			verdict = ansiRed + verdict + ansiReset
+		}
+	}
+	fmt.Fprintln(w, verdict)
+
+	if len(diff.TuningDifferences) > 0 {
+		warning := fmt.Sprintf("\nWarning: runs executed under different kernel tuning or hardware (%d settings differ)", len(diff.TuningDifferences))
+		if color {
+			warning = ansiRed + warning + ansiReset
+		}
+		fmt.Fprintln(w, warning)
+		for _, d := range diff.TuningDifferences {
+			fmt.Fprintf(w, "  %-40s %s -> %s\n", d.Setting, orUnset(d.A), orUnset(d.B))
+		}
+	}
+}
+
+func orUnset(s string) string {
+	if s == "" {
+		return "(unset)"
+	}
+	return s
+}
+
+func newDiffCmd(dataDir *string) *cobra.Command {
+	var (
+		asJSON    bool
+		noColor   bool
+		threshold float64
+	)
+
+	cmd := &cobra.Command{
+		Use:   "diff <a> <b>",
+		Short: "Compare two runs (evidence files, run files or stored run IDs)",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := loadRunArg(args[0], *dataDir)
+			if err != nil {
+				return err
+			}
+			b, err := loadRunArg(args[1], *dataDir)
+			if err != nil {
+				return err
+			}
+
+			diff := compareRuns(a, b, threshold)
+			diff.A, diff.B = args[0], args[1]
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(diff)
+			}
+			printEvidenceDiff(cmd.OutOrStdout(), diff, !noColor)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Output the comparison as JSON")
+	cmd.Flags().BoolVar(&noColor, "no-color", false, "Disable ANSI highlighting")
+	cmd.Flags().Float64Var(&threshold, "threshold", 10, "Percentage change considered significant")
+
+	return cmd
+}
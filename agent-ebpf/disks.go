@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DiskHealth is one disk's identity and SMART health when the run was
+// recorded. A long campaign can outlive an NVMe drive's best days, and a
+// baseline and an optimized run on different drives compare the drives as
+// much as the change. Health figures are set when smartctl reports them.
+type DiskHealth struct {
+	Device   string `json:"device"`
+	Model    string `json:"model,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	// SMARTPassed is the drive's own overall health assessment.
+	SMARTPassed *bool `json:"smart_passed,omitempty"`
+	// WearPct is the share of the rated endurance used: NVMe "percentage
+	// used", or on SATA SSDs the device statistics or wear attributes.
+	WearPct            *float64 `json:"wear_pct,omitempty"`
+	PendingSectors     *uint64  `json:"pending_sectors,omitempty"`
+	ReallocatedSectors *uint64  `json:"reallocated_sectors,omitempty"`
+	MediaErrors        *uint64  `json:"media_errors,omitempty"`
+	WrittenBytes       uint64   `json:"written_bytes,omitempty"`
+	PowerOnHours       uint64   `json:"power_on_hours,omitempty"`
+	TemperatureC       float64  `json:"temperature_c,omitempty"`
+}
+
+// diskWearChangePct is how many points of wear two runs' disks may differ
+// by before their comparison is flagged.
+var diskWearChangePct = 2.0
+
+// smartctlTimeout bounds one smartctl call; a drive in trouble can hang it.
+const smartctlTimeout = 5 * time.Second
+
+// smartctlReport is the part of `smartctl --json -a` the health reads.
+type smartctlReport struct {
+	Model       string `json:"model_name"`
+	Serial      string `json:"serial_number"`
+	Firmware    string `json:"firmware_version"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	PowerOnTime struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+	Temperature struct {
+		Current float64 `json:"current"`
+	} `json:"temperature"`
+	NVMe *struct {
+		PercentageUsed   float64 `json:"percentage_used"`
+		MediaErrors      uint64  `json:"media_errors"`
+		DataUnitsWritten uint64  `json:"data_units_written"`
+	} `json:"nvme_smart_health_information_log"`
+	EnduranceUsed *struct {
+		CurrentPercent float64 `json:"current_percent"`
+	} `json:"endurance_used"`
+	ATA *struct {
+		Table []struct {
+			ID    int `json:"id"`
+			Value int `json:"value"`
+			Raw   struct {
+				Value uint64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+}
+
+// ataWearAttributes are SATA SSD attributes whose normalized value counts
+// down from 100 as the flash wears: Wear_Leveling_Count,
+// Media_Wearout_Indicator, SSD_Life_Left and Percent_Lifetime_Remain.
+var ataWearAttributes = []int{177, 233, 231, 202}
+
+// captureDisks records the host's physical disks, with SMART health where
+// smartctl is installed and allowed to read the drives (it needs root).
+func captureDisks() []DiskHealth {
+	devices, _ := filepath.Glob("/sys/block/*")
+	_, smartErr := exec.LookPath("smartctl")
+	var disks []DiskHealth
+	for _, dev := range devices {
+		name := filepath.Base(dev)
+		if virtualBlockDevice(name) {
+			continue
+		}
+		d := DiskHealth{
+			Device:   name,
+			Model:    readTrimmed(filepath.Join(dev, "device", "model")),
+			Serial:   readTrimmed(filepath.Join(dev, "device", "serial")),
+			Firmware: readTrimmed(filepath.Join(dev, "device", "firmware_rev")),
+		}
+		if d.Firmware == "" {
+			d.Firmware = readTrimmed(filepath.Join(dev, "device", "rev"))
+		}
+		if d.Serial == "" {
+			d.Serial = readTrimmed(filepath.Join(dev, "serial"))
+		}
+		if smartErr == nil {
+			readSMART(&d)
+		}
+		disks = append(disks, d)
+	}
+	return disks
+}
+
+// virtualBlockDevice reports whether a /sys/block entry is backed by
+// memory, a file or other disks rather than being a drive of its own.
+func virtualBlockDevice(name string) bool {
+	for _, prefix := range []string{"loop", "ram", "zram", "dm-", "md", "sr", "nbd", "fd"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSMART fills in d from smartctl. smartctl's exit status is a bit mask
+// that flags failing drives too, so its output is read whatever it is.
+func readSMART(d *DiskHealth) {
+	ctx, cancel := context.WithTimeout(context.Background(), smartctlTimeout)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, "smartctl", "--json", "-a", "/dev/"+d.Device).Output()
+	var r smartctlReport
+	if json.Unmarshal(out, &r) != nil {
+		return
+	}
+	if r.Model != "" {
+		d.Model, d.Serial, d.Firmware = r.Model, r.Serial, r.Firmware
+	}
+	if r.SmartStatus != nil {
+		passed := r.SmartStatus.Passed
+		d.SMARTPassed = &passed
+	}
+	d.PowerOnHours = r.PowerOnTime.Hours
+	d.TemperatureC = r.Temperature.Current
+	if r.NVMe != nil {
+		wear, errors := r.NVMe.PercentageUsed, r.NVMe.MediaErrors
+		d.WearPct, d.MediaErrors = &wear, &errors
+		// NVMe counts data units of 1000 512-byte blocks.
+		d.WrittenBytes = r.NVMe.DataUnitsWritten * 512000
+	}
+	if r.EnduranceUsed != nil {
+		wear := r.EnduranceUsed.CurrentPercent
+		d.WearPct = &wear
+	}
+	if r.ATA == nil {
+		return
+	}
+	attributes := map[int]int{}
+	for _, a := range r.ATA.Table {
+		raw := a.Raw.Value
+		switch a.ID {
+		case 5:
+			d.ReallocatedSectors = &raw
+		case 197:
+			d.PendingSectors = &raw
+		}
+		attributes[a.ID] = a.Value
+	}
+	for _, id := range ataWearAttributes {
+		if v, ok := attributes[id]; ok && d.WearPct == nil && v <= 100 {
+			wear := float64(100 - v)
+			d.WearPct = &wear
+		}
+	}
+}
+
+func (d *DiskHealth) String() string {
+	var parts []string
+	if d.Model != "" {
+		parts = append(parts, d.Model)
+	}
+	if d.Firmware != "" {
+		parts = append(parts, "firmware "+d.Firmware)
+	}
+	if d.WearPct != nil {
+		parts = append(parts, fmt.Sprintf("wear %.0f%%", *d.WearPct))
+	}
+	if d.PendingSectors != nil && *d.PendingSectors > 0 {
+		parts = append(parts, fmt.Sprintf("%d pending sectors", *d.PendingSectors))
+	}
+	if d.ReallocatedSectors != nil && *d.ReallocatedSectors > 0 {
+		parts = append(parts, fmt.Sprintf("%d reallocated sectors", *d.ReallocatedSectors))
+	}
+	if d.MediaErrors != nil && *d.MediaErrors > 0 {
+		parts = append(parts, fmt.Sprintf("%d media errors", *d.MediaErrors))
+	}
+	if d.PowerOnHours > 0 {
+		parts = append(parts, fmt.Sprintf("%d h powered on", d.PowerOnHours))
+	}
+	if d.SMARTPassed != nil && !*d.SMARTPassed {
+		parts = append(parts, "SMART failing")
+	}
+	if len(parts) == 0 {
+		return "unidentified"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// diskDifferences flags two runs' disks that are not the same drives, or
+// whose wear moved by diskWearChangePct points or more, or that gained
+// pending sectors in between.
+func diskDifferences(a, b []DiskHealth) []TuningDifference {
+	if a == nil || b == nil {
+		return nil
+	}
+	byDevice := func(disks []DiskHealth) map[string]DiskHealth {
+		m := map[string]DiskHealth{}
+		for _, d := range disks {
+			m[d.Device] = d
+		}
+		return m
+	}
+	da, db := byDevice(a), byDevice(b)
+	var diffs []TuningDifference
+	for name, x := range da {
+		y, ok := db[name]
+		if !ok {
+			diffs = append(diffs, TuningDifference{Setting: "disk." + name + ".model", A: x.Model})
+			continue
+		}
+		for _, f := range []TuningDifference{{"model", x.Model, y.Model}, {"serial", x.Serial, y.Serial}, {"firmware", x.Firmware, y.Firmware}} {
+			if f.A != f.B {
+				diffs = append(diffs, TuningDifference{Setting: "disk." + name + "." + f.Setting, A: f.A, B: f.B})
+			}
+		}
+		if x.WearPct != nil && y.WearPct != nil && math.Abs(*y.WearPct-*x.WearPct) >= diskWearChangePct {
+			diffs = append(diffs, TuningDifference{
+				Setting: "disk." + name + ".wear_pct", A: fmt.Sprintf("%.0f", *x.WearPct), B: fmt.Sprintf("%.0f", *y.WearPct),
+			})
+		}
+		if x.PendingSectors != nil && y.PendingSectors != nil && *y.PendingSectors > *x.PendingSectors {
+			diffs = append(diffs, TuningDifference{
+				Setting: "disk." + name + ".pending_sectors", A: fmt.Sprint(*x.PendingSectors), B: fmt.Sprint(*y.PendingSectors),
+			})
+		}
+	}
+	for name, y := range db {
+		if _, ok := da[name]; !ok {
+			diffs = append(diffs, TuningDifference{Setting: "disk." + name + ".model", B: y.Model})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Setting < diffs[j].Setting })
+	return diffs
+}
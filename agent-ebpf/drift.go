@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DriftReport compares the first half of a run set, in the order the runs
+// were made, with the second half. Runs of one set are meant to repeat the
+// same measurement; when a figure moves between the halves the set drifted
+// while it ran, from a cache still warming up, compaction debt piling up or
+// a host heating, and its median hides that.
+type DriftReport struct {
+	Runs         []string      `json:"runs"`
+	ThresholdPct float64       `json:"threshold_pct"`
+	Metrics      []DriftMetric `json:"metrics"`
+	// Drifting is set when any metric drifted, and Causes names what the
+	// drifting metrics suggest.
+	Drifting bool     `json:"drifting"`
+	Causes   []string `json:"causes,omitempty"`
+}
+
+// DriftMetric is one figure's medians in either half. It drifted when a
+// two-sided Mann-Whitney test of the halves is significant at driftAlpha
+// and the medians differ by at least the threshold.
+type DriftMetric struct {
+	Metric     string  `json:"metric"`
+	FirstHalf  float64 `json:"first_half"`
+	SecondHalf float64 `json:"second_half"`
+	ChangePct  float64 `json:"change_pct"`
+	P          float64 `json:"p"`
+	Drifting   bool    `json:"drifting"`
+}
+
+// A run set needs driftMinRuns runs, four a half, before the test can
+// tell anything at driftAlpha.
+const (
+	driftMinRuns          = 8
+	driftAlpha            = 0.05
+	driftDefaultThreshold = 5.0
+)
+
+// Drift causes, suggested by which metrics moved which way.
+const (
+	driftWarmUp     = "warm-up: the second half ran faster"
+	driftSlowdown   = "slowdown: the second half ran slower"
+	driftCache      = "cache warm-up: the hit ratio rose"
+	driftCompaction = "compaction debt: compaction work grew"
+	driftStorage    = "storage slowing: block I/O latency grew"
+	driftThermal    = "thermal creep: the CPU ran hotter or slower"
+)
+
+// driftCause names what a metric moving in the direction of change
+// suggests, if anything.
+func driftCause(metric string, change float64) string {
+	switch {
+	case metric == "duration_ms":
+		if change < 0 {
+			return driftWarmUp
+		}
+		return driftSlowdown
+	case strings.HasPrefix(metric, "custom.") && strings.Contains(metric, "hit_ratio"):
+		if change > 0 {
+			return driftCache
+		}
+	case strings.HasPrefix(metric, "compaction."):
+		if change > 0 {
+			return driftCompaction
+		}
+	case strings.HasPrefix(metric, "biolatency."):
+		if change > 0 {
+			return driftStorage
+		}
+	case metric == "thermal.mean_freq_mhz":
+		if change < 0 {
+			return driftThermal
+		}
+	case strings.HasPrefix(metric, "thermal."):
+		if change > 0 {
+			return driftThermal
+		}
+	}
+	return ""
+}
+
+// runSetDrift tests the runs for drift between their halves: their
+// benchmark duration and every evidence figure all of them recorded. With
+// an odd number of runs the middle one is left out.
+func runSetDrift(runs []*Run, thresholdPct float64) (*DriftReport, error) {
+	if len(runs) < driftMinRuns {
+		return nil, fmt.Errorf("drift needs at least %d runs, got %d", driftMinRuns, len(runs))
+	}
+	runs = append([]*Run(nil), runs...)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].CreatedAt.Before(runs[j].CreatedAt) })
+
+	series := map[string][]float64{}
+	for i, run := range runs {
+		values := map[string]float64{}
+		if run.Evidence != nil {
+			values = evidenceValues(run.Evidence)
+		}
+		values["duration_ms"] = benchmarkMs(run)
+		for name, value := range values {
+			// Per-command exec counts come and go with the workload's own
+			// scheduling; they say nothing about drift.
+			if strings.HasPrefix(name, "exec.cmd.") || len(series[name]) != i {
+				continue
+			}
+			series[name] = append(series[name], value)
+		}
+	}
+
+	report := &DriftReport{ThresholdPct: thresholdPct}
+	for _, run := range runs {
+		report.Runs = append(report.Runs, run.ID)
+	}
+	half := len(runs) / 2
+	causes := map[string]bool{}
+	for name, values := range series {
+		if len(values) != len(runs) {
+			continue
+		}
+		first, second := values[:half], values[len(values)-half:]
+		m := DriftMetric{Metric: name, FirstHalf: median(first), SecondHalf: median(second)}
+		if m.FirstHalf == 0 && m.SecondHalf == 0 {
+			continue
+		}
+		if m.FirstHalf != 0 {
+			m.ChangePct = (m.SecondHalf - m.FirstHalf) / math.Abs(m.FirstHalf) * 100
+		}
+		m.P = math.Min(1, 2*math.Min(mannWhitneyGreater(first, second), mannWhitneyGreater(second, first)))
+		m.Drifting = m.P < driftAlpha && (m.FirstHalf == 0 || math.Abs(m.ChangePct) >= thresholdPct)
+		if m.Drifting {
+			report.Drifting = true
+			if cause := driftCause(name, m.SecondHalf-m.FirstHalf); cause != "" {
+				causes[cause] = true
+			}
+		}
+		report.Metrics = append(report.Metrics, m)
+	}
+	sort.Slice(report.Metrics, func(i, j int) bool {
+		a, b := report.Metrics[i], report.Metrics[j]
+		if a.Drifting != b.Drifting {
+			return a.Drifting
+		}
+		return a.Metric < b.Metric
+	})
+	for cause := range causes {
+		report.Causes = append(report.Causes, cause)
+	}
+	sort.Strings(report.Causes)
+	return report, nil
+}
+
+// summary names what drifted: the causes, or the drifting metrics where
+// none suggests one. It is empty when nothing drifted.
+func (d *DriftReport) summary() []string {
+	if len(d.Causes) > 0 || !d.Drifting {
+		return d.Causes
+	}
+	var metrics []string
+	for _, m := range d.Metrics {
+		if m.Drifting {
+			metrics = append(metrics, fmt.Sprintf("%s %+.1f%%", m.Metric, m.ChangePct))
+		}
+	}
+	return metrics
+}
+
+// handleDrift tests the runs a GET /runs query selects for drift; the
+// query takes its latest gainDefaultRuns*2 successful runs unless it says
+// otherwise, and threshold sets the smallest change that counts.
+func handleDrift(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	threshold := driftDefaultThreshold
+	if t := values.Get("threshold"); t != "" {
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil || v < 0 {
+			http.Error(w, "invalid threshold", http.StatusBadRequest)
+			return
+		}
+		threshold = v
+	}
+	values.Del("threshold")
+	q, err := parseRunQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !values.Has("limit") {
+		q.Limit = gainDefaultRuns * 2
+	}
+	if !values.Has("result") {
+		q.Results = []string{resultSuccess}
+	}
+	scopeQuery(q, requestScope(r))
+	summaries, _, err := store.Query(q)
+	if errors.Is(err, errBadCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	runs := make([]*Run, 0, len(summaries))
+	for _, s := range summaries {
+		run, err := store.Get(s.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, run)
+	}
+	report, err := runSetDrift(runs, threshold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KernelFeatures are the kernel capabilities the eBPF collectors' variants
+// depend on, detected once at startup.
+type KernelFeatures struct {
+	Release     string `json:"release"`
+	Arch        string `json:"arch"`
+	BTF         bool   `json:"btf"`
+	Ringbuf     bool   `json:"ringbuf"`
+	Fentry      bool   `json:"fentry"`
+	Tracepoints bool   `json:"tracepoints"`
+	Kprobes     bool   `json:"kprobes"`
+	Uprobes     bool   `json:"uprobes"`
+	Tool        string `json:"tool,omitempty"`
+	// RawTracepoints (4.17+) are what the native variants attach to.
+	RawTracepoints bool `json:"raw_tracepoints"`
+}
+
+// EBPFData records which implementation each eBPF collector ran with, or
+// why none could.
+type EBPFData struct {
+	Kernel     KernelFeatures  `json:"kernel"`
+	Collectors []EBPFCollector `json:"collectors"`
+}
+
+// EBPFCollector is one collector's row of the matrix. Fallback names the
+// degraded non-eBPF source that filled in its section when no variant could
+// run; Script is the bpftrace script the variant ran, and Pipeline accounts
+// for a native variant's events.
+type EBPFCollector struct {
+	Collector string `json:"collector"`
+	Variant   string `json:"variant,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Fallback  string `json:"fallback,omitempty"`
+
+	Script   *ScriptInfo    `json:"script,omitempty"`
+	Pipeline *PipelineStats `json:"pipeline,omitempty"`
+}
+
+// ebpfVariant is one way to implement a collector. Requires names
+// KernelFeatures fields; Attach lists the kernel symbols or tracepoints it
+// attaches to, checked before the variant is chosen. Native variants are
+// built into the agent and need no bpftrace; see native.go. Aggregating
+// ones count in the kernel and are passed over when the collector's stream
+// option asks for every event.
+type ebpfVariant struct {
+	Name       string
+	Requires   []string
+	Attach     []string
+	Native     bool
+	Aggregates bool
+}
+
+// ebpfMatrix lists each eBPF collector's variants, best first: fentry and
+// BTF tracepoints with ring buffers on 5.8+ kernels with BTF, then stable
+// tracepoints, then kprobes, which work back to 4.x. The high-rate exec and
+// syscalls collectors prefer their native variants, counting in per-CPU
+// maps or, to stream, through a ring buffer.
+var ebpfMatrix = map[string][]ebpfVariant{
+	"runqlat": {
+		{Name: "tp_btf", Requires: []string{"btf", "ringbuf"}, Attach: []string{"tp_btf:sched_wakeup", "tp_btf:sched_wakeup_new", "tp_btf:sched_switch"}},
+		{Name: "tracepoint", Requires: []string{"tracepoints"}, Attach: []string{"tracepoint:sched:sched_wakeup", "tracepoint:sched:sched_wakeup_new", "tracepoint:sched:sched_switch"}},
+		{Name: "kprobe", Requires: []string{"kprobes"}, Attach: []string{"kprobe:ttwu_do_wakeup", "kprobe:finish_task_switch"}},
+	},
+	"biolatency": {
+		{Name: "tracepoint", Requires: []string{"tracepoints"}, Attach: []string{"tracepoint:block:block_rq_issue", "tracepoint:block:block_rq_complete"}},
+		{Name: "kprobe", Requires: []string{"kprobes"}, Attach: []string{"kprobe:blk_account_io_start", "kprobe:blk_account_io_done"}},
+	},
+	"offcpu": {
+		{Name: "fentry", Requires: []string{"btf", "fentry", "ringbuf"}, Attach: []string{"fentry:finish_task_switch"}},
+		{Name: "kprobe", Requires: []string{"kprobes"}, Attach: []string{"kprobe:finish_task_switch"}},
+	},
+	"exec": {
+		{Name: "maps", Requires: []string{"raw_tracepoints"}, Native: true, Aggregates: true},
+		{Name: "ringbuf", Requires: []string{"ringbuf"}, Native: true},
+		{Name: "tracepoint", Requires: []string{"tracepoints"}, Attach: []string{"tracepoint:sched:sched_process_exec"}},
+		{Name: "kprobe", Requires: []string{"kprobes"}, Attach: []string{"kprobe:" + syscallSymbol("execve")}},
+	},
+	"syscalls": {
+		{Name: "maps", Requires: []string{"raw_tracepoints"}, Native: true, Aggregates: true},
+		{Name: "ringbuf", Requires: []string{"ringbuf"}, Native: true},
+		{Name: "tracepoint", Requires: []string{"tracepoints"}, Attach: []string{"tracepoint:raw_syscalls:sys_enter"}},
+	},
+	"connect": {
+		{Name: "tracepoint", Requires: []string{"tracepoints"}, Attach: []string{"tracepoint:sock:inet_sock_set_state"}},
+	},
+	"handshakes": {
+		{Name: "uprobe", Requires: []string{"uprobes"}},
+	},
+	"fderrors": {
+		{Name: "tracepoint", Requires: []string{"tracepoints"}, Attach: []string{"tracepoint:raw_syscalls:sys_exit"}},
+	},
+	"readahead": {
+		{Name: "folio", Requires: []string{"kprobes"}, Attach: []string{"kprobe:page_cache_ra_unbounded", "kprobe:page_cache_ra_order", "kprobe:folio_mark_accessed"}},
+		{Name: "page", Requires: []string{"kprobes"}, Attach: []string{"kprobe:page_cache_ra_unbounded", "kprobe:__page_cache_alloc", "kprobe:mark_page_accessed", "kprobe:page_add_file_rmap"}},
+	},
+	"writeback": {
+		{Name: "tracepoint", Requires: []string{"tracepoints"}, Attach: []string{
+			"tracepoint:writeback:writeback_start", "tracepoint:writeback:writeback_written",
+			"tracepoint:writeback:writeback_single_inode", "tracepoint:writeback:balance_dirty_pages",
+		}},
+	},
+}
+
+// syscallSymbol is the kernel function behind a syscall, whose name carries
+// an architecture prefix since 4.17's syscall wrappers.
+func syscallSymbol(name string) string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "__x64_sys_" + name
+	case "arm64":
+		return "__arm64_sys_" + name
+	case "riscv64":
+		return "__riscv_sys_" + name
+	}
+	return "sys_" + name
+}
+
+// tracefsRoot is where tracefs is mounted, or "" if it is not.
+func tracefsRoot() string {
+	for _, dir := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		if _, err := os.Stat(filepath.Join(dir, "events")); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// kernelVersion returns the major and minor version of a release string
+// such as "5.15.0-91-generic".
+func kernelVersion(release string) (int, int) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0
+	}
+	major, _ := strconv.Atoi(parts[0])
+	minor, _ := strconv.Atoi(strings.TrimFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	return major, minor
+}
+
+func atLeast(release string, major, minor int) bool {
+	maj, min := kernelVersion(release)
+	return maj > major || maj == major && min >= minor
+}
+
+// trampolineRelease is the kernel that brought BPF trampolines, which fentry
+// needs, to each architecture.
+var trampolineRelease = map[string][2]int{
+	"amd64":   {5, 5},
+	"arm64":   {6, 0},
+	"riscv64": {6, 5},
+}
+
+func detectKernelFeatures() KernelFeatures {
+	f := KernelFeatures{Release: readTrimmed("/proc/sys/kernel/osrelease"), Arch: runtime.GOARCH}
+	_, err := os.Stat("/sys/kernel/btf/vmlinux")
+	f.BTF = err == nil
+	f.Ringbuf = atLeast(f.Release, 5, 8)
+	f.RawTracepoints = atLeast(f.Release, 4, 17)
+	release, ok := trampolineRelease[runtime.GOARCH]
+	f.Fentry = ok && f.BTF && atLeast(f.Release, release[0], release[1])
+	f.Tracepoints = tracefsRoot() != ""
+	if _, err := os.Stat("/sys/bus/event_source/devices/kprobe"); err == nil {
+		f.Kprobes = true
+	} else if root := tracefsRoot(); root != "" {
+		_, err := os.Stat(filepath.Join(root, "kprobe_events"))
+		f.Kprobes = err == nil
+	}
+	if _, err := os.Stat("/sys/bus/event_source/devices/uprobe"); err == nil {
+		f.Uprobes = true
+	} else if root := tracefsRoot(); root != "" {
+		_, err := os.Stat(filepath.Join(root, "uprobe_events"))
+		f.Uprobes = err == nil
+	}
+	if checkEBPFAvailable() {
+		f.Tool = "bpftrace"
+	}
+	return f
+}
+
+func (f KernelFeatures) has(feature string) bool {
+	switch feature {
+	case "btf":
+		return f.BTF
+	case "ringbuf":
+		return f.Ringbuf
+	case "fentry":
+		return f.Fentry
+	case "tracepoints":
+		return f.Tracepoints
+	case "raw_tracepoints":
+		return f.RawTracepoints
+	case "kprobes":
+		return f.Kprobes
+	case "uprobes":
+		return f.Uprobes
+	}
+	return false
+}
+
+// kernelFunctions are the functions kprobes and fentry can attach to, from
+// available_filter_functions or, without tracefs, kallsyms. Compiler
+// suffixes such as ".isra.0" are dropped.
+var kernelFunctions = sync.OnceValue(func() map[string]bool {
+	funcs := map[string]bool{}
+	path, field := "/proc/kallsyms", 2
+	if root := tracefsRoot(); root != "" {
+		if _, err := os.Stat(filepath.Join(root, "available_filter_functions")); err == nil {
+			path, field = filepath.Join(root, "available_filter_functions"), 0
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return funcs
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= field {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[field], ".")
+		funcs[name] = true
+	}
+	return funcs
+})
+
+// attachable reports whether the kernel has an attach point like
+// "tracepoint:sched:sched_switch", "tp_btf:sched_switch" or
+// "kprobe:finish_task_switch".
+func attachable(point string) bool {
+	kind, target, _ := strings.Cut(point, ":")
+	switch kind {
+	case "tracepoint":
+		category, name, _ := strings.Cut(target, ":")
+		root := tracefsRoot()
+		if root == "" {
+			return false
+		}
+		_, err := os.Stat(filepath.Join(root, "events", category, name))
+		return err == nil
+	case "kprobe", "fentry":
+		return kernelFunctions()[target]
+	case "tp_btf":
+		return bytes.Contains(vmlinuxBTF(), []byte("btf_trace_"+target+"\x00"))
+	}
+	return false
+}
+
+// vmlinuxBTF is the kernel's own BTF, in which every BTF-enabled tracepoint
+// has a btf_trace_<name> type.
+var vmlinuxBTF = sync.OnceValue(func() []byte {
+	data, _ := os.ReadFile("/sys/kernel/btf/vmlinux")
+	return data
+})
+
+var kernelFeatures = sync.OnceValue(detectKernelFeatures)
+
+// selectVariant picks the best variant of an eBPF collector this kernel can
+// run with the collector's options, or explains why none fits.
+func selectVariant(name string, opts CollectorOptions) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("eBPF needs Linux, not %s", runtime.GOOS)
+	}
+	features := kernelFeatures()
+	if features.Tool == "" && !slices.ContainsFunc(ebpfMatrix[name], func(v ebpfVariant) bool { return v.Native }) {
+		return "", fmt.Errorf("bpftrace/bcc-tools not found")
+	}
+	stream := opts.number("stream", 0) != 0
+	var reasons []string
+	for _, v := range ebpfMatrix[name] {
+		if v.Aggregates && stream {
+			reasons = append(reasons, v.Name+" does not stream")
+			continue
+		}
+		if !v.Native && features.Tool == "" {
+			reasons = append(reasons, v.Name+" needs bpftrace")
+			continue
+		}
+		var missing []string
+		for _, feature := range v.Requires {
+			if !features.has(feature) {
+				missing = append(missing, feature)
+			}
+		}
+		if len(missing) == 0 {
+			for _, point := range v.Attach {
+				if !attachable(point) {
+					missing = append(missing, point)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			return v.Name, nil
+		}
+		reasons = append(reasons, v.Name+" needs "+strings.Join(missing, ", "))
+	}
+	return "", fmt.Errorf("kernel %s: %s", features.Release, strings.Join(reasons, "; "))
+}
+
+// selectEBPF picks a variant for each eBPF collector the selection enables.
+func selectEBPF(selection map[string]CollectorOptions) *EBPFData {
+	data := &EBPFData{Kernel: kernelFeatures()}
+	names := make([]string, 0, len(ebpfMatrix))
+	for name := range ebpfMatrix {
+		if _, ok := collectorEnabled(selection, name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := EBPFCollector{Collector: name}
+		opts, _ := collectorEnabled(selection, name)
+		if variant, err := selectVariant(name, opts); err != nil {
+			entry.Reason = err.Error()
+		} else {
+			entry.Variant = variant
+		}
+		data.Collectors = append(data.Collectors, entry)
+	}
+	return data
+}
+
+// native reports whether the named collector's variant is a native one.
+func native(name, variant string) bool {
+	return slices.ContainsFunc(ebpfMatrix[name], func(v ebpfVariant) bool { return v.Name == variant && v.Native })
+}
+
+// variant returns the variant the named collector runs with, or "".
+func (d *EBPFData) variant(name string) string {
+	if d == nil {
+		return ""
+	}
+	for _, c := range d.Collectors {
+		if c.Collector == name {
+			return c.Variant
+		}
+	}
+	return ""
+}
+
+func (d *EBPFData) available() bool {
+	for _, c := range d.Collectors {
+		if c.Variant != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// setPipeline records how a native collector's events fared.
+func (d *EBPFData) setPipeline(name string, stats *PipelineStats) {
+	for i := range d.Collectors {
+		if d.Collectors[i].Collector == name {
+			d.Collectors[i].Pipeline = stats
+		}
+	}
+}
+
+// setReason records why the named collector produced nothing.
+func (d *EBPFData) setReason(name, reason string) {
+	for i := range d.Collectors {
+		if d.Collectors[i].Collector == name {
+			d.Collectors[i].Reason = reason
+		}
+	}
+}
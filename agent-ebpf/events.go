@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lifecycle event types.
+const (
+	eventSessionStarted     = "session.started"
+	eventSessionStopped     = "session.stopped"
+	eventJobFinished        = "job.finished"
+	eventRegressionDetected = "regression.detected"
+)
+
+var eventTypes = []string{eventSessionStarted, eventSessionStopped, eventJobFinished, eventRegressionDetected}
+
+// Event is one lifecycle notification. Cursor numbers events in the order
+// they happened and survives restarts, so a client can resume after the
+// last one it saw.
+type Event struct {
+	Cursor   uint64    `json:"cursor"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session_id,omitempty"`
+	Job      string    `json:"job_id,omitempty"`
+	Run      string    `json:"run_id,omitempty"`
+	Scenario string    `json:"scenario,omitempty"`
+	Impl     string    `json:"impl,omitempty"`
+	Variant  string    `json:"variant,omitempty"`
+	Commit   string    `json:"commit,omitempty"`
+	Dataset  string    `json:"dataset,omitempty"`
+	Project  string    `json:"project,omitempty"`
+	Machine  string    `json:"machine,omitempty"`
+	// State is how a job finished, or a stopped session's result.
+	State      string           `json:"state,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Regression *RegressionEvent `json:"regression,omitempty"`
+}
+
+// EventPage is what GET /events answers: the events after the requested
+// cursor and the cursor to ask from next. Missed is set when events after
+// the requested cursor were already dropped from the log.
+type EventPage struct {
+	Events []Event `json:"events"`
+	Cursor uint64  `json:"cursor"`
+	Missed bool    `json:"missed,omitempty"`
+}
+
+// eventLog keeps the most recent events in memory and appends every event
+// to events.jsonl in the data dir, which is rewritten with just the kept
+// ones once it has grown to twice as many.
+type eventLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	lines  int
+	events []Event
+	next   uint64
+	// changed is closed, and replaced, whenever an event is added.
+	changed chan struct{}
+}
+
+// eventRetain is how many events the log keeps.
+const eventRetain = 10000
+
+// Long polls wait this long for events unless asked otherwise, and never
+// longer than eventMaxWait.
+const (
+	eventDefaultWait = 30 * time.Second
+	eventMaxWait     = 2 * time.Minute
+	eventPageLimit   = 1000
+)
+
+var events *eventLog
+
+func openEventLog(dataDir string) (*eventLog, error) {
+	l := &eventLog{path: filepath.Join(dataDir, "events.jsonl"), next: 1, changed: make(chan struct{})}
+	if f, err := os.Open(l.path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e Event
+			if json.Unmarshal(scanner.Bytes(), &e) != nil || e.Cursor < l.next {
+				continue
+			}
+			l.lines++
+			l.events = append(l.events, e)
+			l.next = e.Cursor + 1
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read %s: %w", l.path, err)
+		}
+		if len(l.events) > eventRetain {
+			l.events = slices.Clone(l.events[len(l.events)-eventRetain:])
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+// publish numbers the event, records it and wakes the long polls waiting.
+// A nil log, outside the server, drops it.
+func (l *eventLog) publish(e Event) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Cursor = l.next
+	e.Time = time.Now().UTC()
+	l.next++
+	l.events = append(l.events, e)
+	if len(l.events) > eventRetain {
+		l.events = slices.Delete(l.events, 0, len(l.events)-eventRetain)
+	}
+	if err := l.append(e); err != nil {
+		log.Printf("Failed to record %s event: %v", e.Type, err)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *eventLog) append(e Event) error {
+	if l.lines >= 2*eventRetain {
+		if err := l.rewrite(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.lines++
+	return nil
+}
+
+// rewrite replaces the file with the events kept in memory, but for the
+// one being appended.
+func (l *eventLog) rewrite() error {
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range l.events[:len(l.events)-1] {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	l.file.Close()
+	if l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	l.lines = len(l.events) - 1
+	return nil
+}
+
+// after returns up to limit events after since whose type is in types (all
+// when empty) and whose project is in scope, with the cursor the next call
+// should start from and whether events after since were already dropped,
+// and a channel closed when more arrive.
+func (l *eventLog) after(since uint64, types []string, scope string, limit int) (EventPage, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	page := EventPage{Events: []Event{}, Cursor: since}
+	if since >= l.next {
+		// A cursor from before the log was lost starts over.
+		since, page.Cursor, page.Missed = 0, 0, true
+	}
+	if len(l.events) > 0 && l.events[0].Cursor > since+1 {
+		page.Missed = true
+	}
+	i, _ := slices.BinarySearchFunc(l.events, since+1, func(e Event, cursor uint64) int {
+		switch {
+		case e.Cursor < cursor:
+			return -1
+		case e.Cursor > cursor:
+			return 1
+		}
+		return 0
+	})
+	for ; i < len(l.events) && len(page.Events) < limit; i++ {
+		e := l.events[i]
+		page.Cursor = e.Cursor
+		if (len(types) == 0 || slices.Contains(types, e.Type)) && inScope(scope, e.Project) {
+			page.Events = append(page.Events, e)
+		}
+	}
+	return page, l.changed
+}
+
+// latest is the cursor of the last event.
+func (l *eventLog) latest() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next - 1
+}
+
+// find reports whether a kept event matches.
+func (l *eventLog) find(match func(*Event) bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.events {
+		if match(&l.events[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleEvents long-polls for lifecycle events: GET /events?since=<cursor>
+// answers at once with the events after the cursor, or waits up to timeout
+// for one to happen. Without since it waits for the next event. type
+// (repeated for several) limits the events returned, as does the caller's
+// project; the cursor still moves past those left out.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	since := events.latest()
+	if v := values.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	wait := eventDefaultWait
+	if v := values.Get("timeout"); v != "" {
+		var err error
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q", v), http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, eventMaxWait)
+	}
+	limit := eventPageLimit
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = min(n, eventPageLimit)
+	}
+	types := values["type"]
+	for _, t := range types {
+		if !slices.Contains(eventTypes, t) {
+			http.Error(w, fmt.Sprintf("unknown event type %q", t), http.StatusBadRequest)
+			return
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	page, changed := events.after(since, types, requestScope(r), limit)
+	missed := page.Missed
+poll:
+	for len(page.Events) == 0 {
+		select {
+		case <-changed:
+			page, changed = events.after(page.Cursor, types, requestScope(r), limit)
+		case <-timer.C:
+			break poll
+		case <-r.Context().Done():
+			return
+		}
+	}
+	page.Missed = missed
+	writeEventPage(w, page)
+}
+
+func writeEventPage(w http.ResponseWriter, page EventPage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+)
+
+// A run archive is a tar of runs/<id>.json or runs/<id>.msgpack documents,
+// zstd- or gzip-compressed or plain; readers detect which from the first
+// bytes.
+
+// maxArchivedRunBytes caps one run document in an archive, and
+// maxIngestBytes the body /ingest reads, as it arrives on the wire.
+const (
+	maxArchivedRunBytes = 64 << 20
+	maxIngestBytes      = 1 << 30
+)
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+func writeRunArchive(w io.Writer, runs []*Run, compression, format string) error {
+	if format != "json" && format != "msgpack" {
+		return fmt.Errorf("unknown format %q (json or msgpack)", format)
+	}
+	var out io.WriteCloser
+	switch compression {
+	case "zstd":
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		out = enc
+	case "gzip":
+		out = gzip.NewWriter(w)
+	case "none":
+		out = nopWriteCloser{w}
+	default:
+		return fmt.Errorf("unknown compression %q (zstd, gzip or none)", compression)
+	}
+
+	tw := tar.NewWriter(out)
+	for _, run := range runs {
+		// tar needs each entry's size up front, so entries are encoded whole.
+		var data []byte
+		var err error
+		if format == "msgpack" {
+			var buf bytes.Buffer
+			err = writeMsgpack(&buf, run)
+			data = buf.Bytes()
+		} else {
+			data, err = json.MarshalIndent(run, "", "  ")
+		}
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    "runs/" + run.ID + "." + format,
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: run.CreatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// readRunArchive calls fn for every run document in the archive. Entries
+// that are not runs/<id>.json or runs/<id>.msgpack are ignored.
+func readRunArchive(r io.Reader, fn func(*Run) error) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	var in io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		dec, err := newZstdReader(br)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		in = dec
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Dir(hdr.Name) != "runs" {
+			continue
+		}
+		if hdr.Size > maxArchivedRunBytes {
+			return fmt.Errorf("%s: %d bytes, over the %d byte limit for a run", hdr.Name, hdr.Size, maxArchivedRunBytes)
+		}
+		entry := io.LimitReader(tr, hdr.Size)
+
+		var run Run
+		switch path.Ext(hdr.Name) {
+		case ".json":
+			err = json.NewDecoder(entry).Decode(&run)
+		case ".msgpack":
+			err = newMsgpackDecoder(entry).Decode(&run)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if err := fn(&run); err != nil {
+			return err
+		}
+	}
+}
+
+type ImportResult struct {
+	Imported []string `json:"imported"`
+	Skipped  []string `json:"skipped,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// importRuns stores every run in the archive. Runs the store already holds
+// are skipped unless overwrite is set, so re-importing an archive is safe.
+// With a scope, runs go into that project, and runs of other projects are
+// refused, in the archive and in the store alike.
+func importRuns(s *RunStore, r io.Reader, overwrite bool, scope string) (*ImportResult, error) {
+	result := &ImportResult{Imported: []string{}}
+	err := readRunArchive(r, result.importer(s, overwrite, scope))
+	return result, err
+}
+
+// importRunStream stores every run in a stream of MessagePack run
+// documents, as importRuns does those of an archive.
+func importRunStream(s *RunStore, r io.Reader, overwrite bool, scope string) (*ImportResult, error) {
+	result := &ImportResult{Imported: []string{}}
+	save := result.importer(s, overwrite, scope)
+	dec := newMsgpackDecoder(r)
+	for n := 1; ; n++ {
+		var run Run
+		if err := dec.Decode(&run); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return result, fmt.Errorf("document %d: %w", n, err)
+		}
+		save(&run)
+	}
+}
+
+// importer returns the function storing each imported run into s and
+// recording the outcome.
+func (result *ImportResult) importer(s *RunStore, overwrite bool, scope string) func(*Run) error {
+	return func(run *Run) error {
+		if !validRunID(run.ID) || run.Evidence == nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("run %q: not a run document", run.ID))
+			return nil
+		}
+		if scope != "" && run.Project == "" {
+			run.Project = scope
+		}
+		if !inScope(scope, run.Project) {
+			result.Errors = append(result.Errors, fmt.Sprintf("run %s: in project %s", run.ID, run.Project))
+			return nil
+		}
+		if existing, err := s.Get(run.ID); err == nil {
+			if !inScope(scope, existing.Project) {
+				result.Errors = append(result.Errors, fmt.Sprintf("run %s: held by another project", run.ID))
+				return nil
+			}
+			if !overwrite {
+				result.Skipped = append(result.Skipped, run.ID)
+				return nil
+			}
+		}
+		if err := s.Save(run); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("run %s: %v", run.ID, err))
+			return nil
+		}
+		result.Imported = append(result.Imported, run.ID)
+		return nil
+	}
+}
+
+// handleIngest accepts a run archive from another machine's export, or,
+// sent as application/msgpack, a stream of MessagePack run documents.
+func handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	overwrite := r.URL.Query().Get("overwrite") != ""
+	body := http.MaxBytesReader(w, r.Body, maxIngestBytes)
+	var result *ImportResult
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); isMsgpack(mediaType) {
+		result, err = importRunStream(store, body, overwrite, requestScope(r))
+	} else {
+		result, err = importRuns(store, body, overwrite, requestScope(r))
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("body over %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func newExportCmd(dataDir *string) *cobra.Command {
+	var (
+		since       string
+		scenario    string
+		impl        string
+		compression string
+		format      string
+		output      string
+		redact      bool
+		redactCfg   string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write stored runs to a compressed tar archive",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cutoff time.Time
+			if since != "" {
+				age, err := parseAge(since)
+				if err != nil {
+					return err
+				}
+				cutoff = time.Now().Add(-age)
+			}
+
+			s, err := NewRunStore(*dataDir)
+			if err != nil {
+				return err
+			}
+			all, err := s.List()
+			if err != nil {
+				return err
+			}
+			var redaction *RedactionConfig
+			if redact || redactCfg != "" {
+				if redaction, err = loadRedactionConfig(redactCfg); err != nil {
+					return err
+				}
+			}
+
+			var runs []*Run
+			for _, run := range all {
+				if run.CreatedAt.Before(cutoff) || (scenario != "" && run.Scenario != scenario) || (impl != "" && run.Impl != impl) {
+					continue
+				}
+				if redaction != nil {
+					if run, err = redaction.Run(run); err != nil {
+						return err
+					}
+				}
+				runs = append(runs, run)
+			}
+
+			w := cmd.OutOrStdout()
+			if output != "" {
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			if err := writeRunArchive(w, runs, compression, format); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "exported %d runs\n", len(runs))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&since, "since", "", "Only runs recorded within this age (e.g. 30d, 12h)")
+	cmd.Flags().StringVar(&scenario, "scenario", "", "Only runs of this scenario")
+	cmd.Flags().StringVar(&impl, "impl", "", "Only runs of this impl")
+	cmd.Flags().StringVar(&compression, "compression", "zstd", "Archive compression: zstd, gzip or none")
+	cmd.Flags().StringVar(&format, "format", "json", "Run document encoding: json or msgpack")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Write to a file instead of stdout")
+	cmd.Flags().BoolVar(&redact, "redact", false, "Strip hostnames, paths, argv and IPs from the exported runs")
+	cmd.Flags().StringVar(&redactCfg, "redact-config", "", "YAML redaction config (implies --redact)")
+
+	return cmd
+}
+
+func newImportCmd(dataDir *string) *cobra.Command {
+	var (
+		overwrite bool
+		remote    string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "import [archive]",
+		Short: "Load runs from an export archive (stdin if omitted)",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var in io.Reader = cmd.InOrStdin()
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+
+			var result *ImportResult
+			if remote != "" {
+				if err := requireFeature(cmd.Context(), remote, "ingest"); err != nil {
+					return err
+				}
+				url := strings.TrimSuffix(remote, "/") + "/ingest"
+				if overwrite {
+					url += "?overwrite=1"
+				}
+				req, err := http.NewRequestWithContext(cmd.Context(), http.MethodPost, url, in)
+				if err != nil {
+					return err
+				}
+				req.Header.Set("Content-Type", "application/octet-stream")
+				authorize(req)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					body, _ := io.ReadAll(resp.Body)
+					return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+				}
+				result = &ImportResult{}
+				if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+					return err
+				}
+			} else {
+				s, err := NewRunStore(*dataDir)
+				if err != nil {
+					return err
+				}
+				result, err = importRuns(s, in, overwrite, "")
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, msg := range result.Errors {
+				fmt.Fprintln(cmd.ErrOrStderr(), msg)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "imported %d runs, skipped %d already stored\n", len(result.Imported), len(result.Skipped))
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace runs the store already holds")
+	cmd.Flags().StringVar(&remote, "remote", "", "Send the archive to another agent's /ingest instead of the local store")
+
+	return cmd
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Run results, the result label of chainbench_runs_total. Runs without a
+// FailureData succeeded.
+const (
+	resultSuccess = "success"
+	// resultExit is a workload that exited nonzero on its own.
+	resultExit = "exit"
+	// resultSignal is a workload killed by a signal other than the OOM
+	// killer's.
+	resultSignal  = "signal"
+	resultOOM     = "oom"
+	resultTimeout = "timeout"
+	// resultError is a failure of the scenario itself rather than of a
+	// workload process, e.g. an RPC endpoint that never answered.
+	resultError = "error"
+)
+
+var runResults = []string{resultSuccess, resultExit, resultSignal, resultOOM, resultTimeout, resultError}
+
+// FailureData classifies why a runner-launched workload failed.
+type FailureData struct {
+	Class    string `json:"class"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	// OOMKills counts the OOM kills seen during the run: in the target's
+	// cgroups, or host-wide when there are none.
+	OOMKills uint64 `json:"oom_kills,omitempty"`
+	Message  string `json:"message"`
+}
+
+// classifyFailure reads what it can from the error a scenario returned and
+// the context it ran under. Whether the OOM killer was behind it is only
+// known once the collectors stop; see checkOOM.
+func classifyFailure(ctx context.Context, err error) *FailureData {
+	f := &FailureData{Class: resultError, Message: err.Error()}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		f.Class = resultTimeout
+		return f
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return f
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		f.Class = resultSignal
+		f.Signal = status.Signal().String()
+		return f
+	}
+	code := exitErr.ExitCode()
+	f.Class = resultExit
+	f.ExitCode = &code
+	return f
+}
+
+// checkOOM turns a kill into an OOM kill when the kernel's OOM killer
+// fired during the run. Shells report a child's SIGKILL as exit 137.
+func (f *FailureData) checkOOM(e *Evidence, hostOOMKills uint64) {
+	if k := e.KubernetesJob; k != nil && k.Reason != "" {
+		code := k.ExitCode
+		f.ExitCode = &code
+		if k.Reason == "OOMKilled" {
+			f.Class = resultOOM
+		} else if f.Class == resultError {
+			f.Class = resultExit
+		}
+		return
+	}
+
+	var kills uint64
+	for _, cg := range e.Cgroups {
+		kills += cg.OOMKills
+	}
+	if len(e.Cgroups) == 0 {
+		kills = hostOOMKills
+	}
+	f.OOMKills = kills
+	killed := f.Class == resultSignal && f.Signal == syscall.SIGKILL.String() ||
+		f.Class == resultExit && f.ExitCode != nil && *f.ExitCode == 128+int(syscall.SIGKILL)
+	if killed && kills > 0 {
+		f.Class = resultOOM
+	}
+}
+
+// String names the failure class with its detail, e.g. "exit 2".
+func (f *FailureData) String() string {
+	switch {
+	case f.Class == resultOOM && f.OOMKills > 0:
+		return fmt.Sprintf("oom, %d kills", f.OOMKills)
+	case f.Signal != "":
+		return f.Class + ", " + f.Signal
+	case f.ExitCode != nil:
+		return fmt.Sprintf("%s %d", f.Class, *f.ExitCode)
+	}
+	return f.Class
+}
+
+// runResult is the run's result label.
+func runResult(e *Evidence) string {
+	if e.Failure == nil {
+		return resultSuccess
+	}
+	return e.Failure.Class
+}
+
+// readOOMKills returns the host's oom_kill counter from /proc/vmstat, or 0
+// where there is none.
+func readOOMKills() uint64 {
+	f, err := os.Open("/proc/vmstat")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "oom_kill "); ok {
+			n, _ := strconv.ParseUint(value, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
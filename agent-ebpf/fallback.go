@@ -0,0 +1,28 @@
+package main
+
+// fallbackCollector stands in for eBPF collectors that have no variant on
+// this host with what the platform offers instead: /proc on Linux,
+// performance counters on Windows and DTrace on macOS (fallback_<os>.go).
+// Its sections are degraded, and the ebpf section flags them.
+type fallbackCollector interface {
+	// retarget follows a session that was retargeted.
+	retarget(tracker *targetTracker)
+	// Stop ends sampling and fills in the sections it stands in for. top
+	// limits the offcpu and exec lists (0 keeps all).
+	Stop(e *Evidence, offcpuTop, execTop int)
+}
+
+// fallbacks marks the collectors without a variant that the platform's
+// fallback can stand in for and returns their names. Some need a target.
+func (d *EBPFData) fallbacks(hasTarget bool) map[string]bool {
+	names := map[string]bool{}
+	for i, c := range d.Collectors {
+		needsTarget, ok := fallbackCollectors[c.Collector]
+		if c.Variant != "" || !ok || needsTarget && !hasTarget {
+			continue
+		}
+		d.Collectors[i].Fallback = fallbackSource
+		names[c.Collector] = true
+	}
+	return names
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fallbackSource = "dtrace"
+
+// fallbackCollectors are the collectors dtraceFallback covers, and whether
+// each needs a target. macOS's sched provider has no wakeup probes to time
+// run queue latency or attribute off-CPU time with.
+var fallbackCollectors = map[string]bool{
+	"biolatency": false,
+	"exec":       false,
+	"syscalls":   false,
+}
+
+// dtraceStopTimeout bounds how long dtrace may take to print its
+// aggregations after SIGINT.
+const dtraceStopTimeout = 10 * time.Second
+
+// dtraceFallback is the macOS fallbackCollector: one dtrace process for the
+// session whose aggregations are read at Stop. It needs root and DTrace
+// allowed by System Integrity Protection. Syscalls are counted host-wide
+// unless the target's processes are known at start; futex counts
+// psynch_mutexwait, the closest macOS has.
+type dtraceFallback struct {
+	names map[string]bool
+	cmd   *exec.Cmd
+	out   bytes.Buffer
+	done  chan error
+}
+
+func startFallback(names map[string]bool, tracker *targetTracker) fallbackCollector {
+	var pids []int
+	if tracker != nil {
+		pids = tracker.PIDs()
+	}
+	f := &dtraceFallback{names: names, done: make(chan error, 1)}
+	f.cmd = exec.Command("dtrace", "-q", "-s", "/dev/stdin")
+	f.cmd.Stdin = strings.NewReader(dtraceScript(names, pids))
+	f.cmd.Stdout = &f.out
+	f.cmd.Stderr = os.Stderr
+	if err := f.cmd.Start(); err != nil {
+		log.Printf("DTrace fallback unavailable: %v", err)
+		f.cmd = nil
+		return f
+	}
+	go func() { f.done <- f.cmd.Wait() }()
+	return f
+}
+
+func dtraceScript(names map[string]bool, pids []int) string {
+	var b strings.Builder
+	if names["exec"] {
+		b.WriteString("proc:::exec-success { @exec[execname] = count(); }\n")
+	}
+	if names["syscalls"] {
+		predicate := ""
+		if len(pids) > 0 {
+			terms := make([]string, len(pids))
+			for i, pid := range pids {
+				terms[i] = fmt.Sprintf("pid == %d", pid)
+			}
+			predicate = "/" + strings.Join(terms, " || ") + "/ "
+		}
+		b.WriteString("syscall::read:entry, syscall::write:entry, syscall::fsync:entry, syscall::open*:entry, syscall::psynch_mutexwait:entry " +
+			predicate + "{ @sys[probefunc] = count(); }\n")
+	}
+	if names["biolatency"] {
+		b.WriteString("io:::start { bio[arg0] = timestamp; }\n")
+		b.WriteString("io:::done /bio[arg0]/ { this->us = (timestamp - bio[arg0]) / 1000; " +
+			"@bio = quantize(this->us); @bio_mean = avg(this->us); bio[arg0] = 0; }\n")
+	}
+	b.WriteString("dtrace:::END {")
+	if names["exec"] {
+		b.WriteString(` printa("exec %s %@d\n", @exec);`)
+	}
+	if names["syscalls"] {
+		b.WriteString(` printa("sys %s %@d\n", @sys);`)
+	}
+	if names["biolatency"] {
+		b.WriteString(` printa("bio_mean %@d\n", @bio_mean); printa(@bio);`)
+	}
+	b.WriteString(" }\n")
+	return b.String()
+}
+
+// retarget does nothing: the script's pid predicate is fixed when dtrace
+// starts.
+func (f *dtraceFallback) retarget(tracker *targetTracker) {}
+
+// quantizeRow is one bucket of a printed quantize() aggregation.
+var quantizeRow = regexp.MustCompile(`^\s*(\d+)\s+\|[@ ]*\s+(\d+)$`)
+
+func (f *dtraceFallback) Stop(e *Evidence, offcpuTop, execTop int) {
+	if f.cmd == nil {
+		return
+	}
+	f.cmd.Process.Signal(os.Interrupt)
+	select {
+	case err := <-f.done:
+		if err != nil {
+			log.Printf("dtrace: %v", err)
+		}
+	case <-time.After(dtraceStopTimeout):
+		f.cmd.Process.Kill()
+		<-f.done
+		log.Printf("dtrace did not exit after SIGINT; its aggregations are lost")
+		return
+	}
+
+	commands := map[string]int{}
+	syscalls := map[string]int{}
+	var bio *BiolatencyData
+	scanner := bufio.NewScanner(&f.out)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "exec":
+			commands[fields[1]], _ = strconv.Atoi(fields[2])
+		case len(fields) == 3 && fields[0] == "sys":
+			n, _ := strconv.Atoi(fields[2])
+			syscalls[fields[1]] += n
+		case len(fields) == 2 && fields[0] == "bio_mean":
+			bio = &BiolatencyData{}
+			bio.MeanUs, _ = strconv.ParseFloat(fields[1], 64)
+		case bio != nil && quantizeRow.MatchString(line):
+			m := quantizeRow.FindStringSubmatch(line)
+			bucket, _ := strconv.Atoi(m[1])
+			count, _ := strconv.Atoi(m[2])
+			bio.Histogram = append(bio.Histogram, HistogramBucket{BucketUs: bucket, Count: count})
+		}
+	}
+
+	if f.names["exec"] {
+		data := &ExecData{}
+		for comm, n := range commands {
+			data.ExecCount += n
+			data.TopCommands = append(data.TopCommands, CommandCount{Command: comm, Count: n})
+		}
+		sort.Slice(data.TopCommands, func(i, j int) bool {
+			a, b := data.TopCommands[i], data.TopCommands[j]
+			return a.Count > b.Count || a.Count == b.Count && a.Command < b.Command
+		})
+		if execTop > 0 && execTop < len(data.TopCommands) {
+			data.TopCommands = data.TopCommands[:execTop]
+		}
+		e.Exec = data
+	}
+	if f.names["syscalls"] {
+		data := &SyscallData{
+			Futex: syscalls["psynch_mutexwait"],
+			Fsync: syscalls["fsync"],
+			Read:  syscalls["read"],
+			Write: syscalls["write"],
+		}
+		for name, n := range syscalls {
+			if strings.HasPrefix(name, "open") {
+				data.Openat += n
+			}
+		}
+		e.SyscallCounts = data
+	}
+	if f.names["biolatency"] && bio != nil {
+		bio.P95Us = histogramPercentile(bio.Histogram, 0.95)
+		e.Biolatency = bio
+	}
+}
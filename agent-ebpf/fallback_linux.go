@@ -0,0 +1,322 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fallbackSource = "procfs"
+
+// fallbackCollectors are the collectors procfsFallback covers, and whether
+// each needs a target.
+var fallbackCollectors = map[string]bool{
+	"runqlat":    false,
+	"biolatency": false,
+	"offcpu":     true,
+	"exec":       false,
+	"syscalls":   true,
+}
+
+const fallbackInterval = time.Second
+
+// procfsFallback is the Linux fallbackCollector, sampling /proc every second. Its sections are coarser than the
+// probes': mean latencies instead of histograms, sampled wait channels
+// instead of off-CPU stacks, forks instead of execs, and only read/write
+// syscalls. Per-process ones (offcpu, syscalls) need a target.
+type procfsFallback struct {
+	names map[string]bool
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu      sync.Mutex
+	tracker *targetTracker
+	lastAt  time.Time
+
+	hostSched             bool
+	schedStart, schedLast schedCounters
+	diskStart             diskCounters
+
+	threads     map[string]schedCounters
+	threadSched schedCounters
+	offMs       float64
+	wchans      map[string]int
+	sleeping    int
+
+	forksStart uint64
+	seen       map[int]bool
+	commands   map[string]int
+
+	syscalls map[int][2]uint64
+	reads    uint64
+	writes   uint64
+}
+
+type diskCounters struct {
+	ios uint64
+	ms  uint64
+}
+
+// hostSchedstat sums run delay and timeslices over all CPUs in
+// /proc/schedstat; the kernel only has it with CONFIG_SCHEDSTATS.
+func hostSchedstat() (schedCounters, bool) {
+	data, err := os.ReadFile("/proc/schedstat")
+	if err != nil {
+		return schedCounters{}, false
+	}
+	var c schedCounters
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		delay, _ := strconv.ParseUint(fields[8], 10, 64)
+		slices, _ := strconv.ParseUint(fields[9], 10, 64)
+		c.delayNs += delay
+		c.slices += slices
+	}
+	return c, true
+}
+
+// readDiskstats sums completed I/Os and the milliseconds spent on them over
+// whole disks, skipping partitions and loop and ram devices.
+func readDiskstats() diskCounters {
+	var c diskCounters
+	data, err := os.ReadFile("/proc/diskstats")
+	if err != nil {
+		return c
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 11 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/block", name)); err != nil {
+			continue
+		}
+		for _, i := range []int{3, 7} {
+			n, _ := strconv.ParseUint(fields[i], 10, 64)
+			c.ios += n
+		}
+		for _, i := range []int{6, 10} {
+			n, _ := strconv.ParseUint(fields[i], 10, 64)
+			c.ms += n
+		}
+	}
+	return c
+}
+
+func readForks() uint64 {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "processes "); ok {
+			n, _ := strconv.ParseUint(value, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+func startFallback(names map[string]bool, tracker *targetTracker) fallbackCollector {
+	f := &procfsFallback{
+		names:    names,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		tracker:  tracker,
+		lastAt:   time.Now(),
+		threads:  map[string]schedCounters{},
+		wchans:   map[string]int{},
+		seen:     map[int]bool{},
+		commands: map[string]int{},
+		syscalls: map[int][2]uint64{},
+	}
+	f.schedStart, f.hostSched = hostSchedstat()
+	f.schedLast = f.schedStart
+	f.diskStart = readDiskstats()
+	f.forksStart = readForks()
+	for pid := range procTable() {
+		f.seen[pid] = true
+	}
+	f.sample(true)
+	go f.loop()
+	return f
+}
+
+// retarget starts per-process counts over from the new target's processes.
+func (f *procfsFallback) retarget(tracker *targetTracker) {
+	f.mu.Lock()
+	f.tracker = tracker
+	f.threads = map[string]schedCounters{}
+	f.syscalls = map[int][2]uint64{}
+	f.mu.Unlock()
+	f.sample(true)
+}
+
+func (f *procfsFallback) loop() {
+	defer close(f.done)
+	ticker := newPacedTicker(fallbackInterval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.sample(false)
+		}
+	}
+}
+
+func (f *procfsFallback) sample(baseline bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	elapsedNs := uint64(now.Sub(f.lastAt).Nanoseconds())
+	f.lastAt = now
+
+	if f.names["runqlat"] {
+		if c, ok := hostSchedstat(); ok {
+			f.schedLast = c
+		}
+	}
+	if f.names["exec"] {
+		for pid, info := range procTable() {
+			if !f.seen[pid] {
+				f.seen[pid] = true
+				f.commands[info.comm]++
+			}
+		}
+	}
+
+	var pids []int
+	if f.tracker != nil {
+		pids = f.tracker.PIDs()
+	}
+	for _, pid := range pids {
+		dir := filepath.Join("/proc", strconv.Itoa(pid))
+		if f.names["syscalls"] {
+			r, _ := strconv.ParseUint(procField(filepath.Join(dir, "io"), "syscr"), 10, 64)
+			w, _ := strconv.ParseUint(procField(filepath.Join(dir, "io"), "syscw"), 10, 64)
+			prev, seen := f.syscalls[pid]
+			f.syscalls[pid] = [2]uint64{r, w}
+			if !baseline && seen && r >= prev[0] && w >= prev[1] {
+				f.reads += r - prev[0]
+				f.writes += w - prev[1]
+			}
+		}
+		if f.names["offcpu"] || f.names["runqlat"] && !f.hostSched {
+			f.sampleThreads(dir, pid, elapsedNs, baseline)
+		}
+	}
+}
+
+// sampleThreads adds the process's threads' run delay, the time they spent
+// neither running nor waiting for a CPU, and what the sleeping ones are
+// waiting in.
+func (f *procfsFallback) sampleThreads(dir string, pid int, elapsedNs uint64, baseline bool) {
+	tasks, err := os.ReadDir(filepath.Join(dir, "task"))
+	if err != nil {
+		return
+	}
+	for _, task := range tasks {
+		taskDir := filepath.Join(dir, "task", task.Name())
+		c, ok := readSchedstat(filepath.Join(taskDir, "schedstat"))
+		if !ok {
+			continue
+		}
+		key := strconv.Itoa(pid) + "/" + task.Name()
+		prev, seen := f.threads[key]
+		f.threads[key] = c
+		if baseline || !seen {
+			continue
+		}
+		f.threadSched.delayNs += c.delayNs - prev.delayNs
+		f.threadSched.slices += c.slices - prev.slices
+		busy := (c.cpuNs - prev.cpuNs) + (c.delayNs - prev.delayNs)
+		if busy < elapsedNs {
+			f.offMs += float64(elapsedNs-busy) / 1e6
+		}
+
+		stat := readTrimmed(filepath.Join(taskDir, "stat"))
+		i := strings.LastIndexByte(stat, ')')
+		if i < 0 || i+2 >= len(stat) {
+			continue
+		}
+		state := stat[i+2]
+		if state != 'S' && state != 'D' {
+			continue
+		}
+		reason := readTrimmed(filepath.Join(taskDir, "wchan"))
+		if reason == "" || reason == "0" {
+			// Hidden without CAP_SYS_ADMIN or kallsyms access.
+			reason = map[byte]string{'S': "sleeping", 'D': "uninterruptible"}[state]
+		}
+		f.wchans[reason]++
+		f.sleeping++
+	}
+}
+
+func (f *procfsFallback) Stop(e *Evidence, offcpuTop, execTop int) {
+	close(f.stop)
+	<-f.done
+	f.sample(false)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.names["runqlat"] {
+		// Without CONFIG_SCHEDSTATS only the target's threads are counted.
+		sched := f.threadSched
+		if f.hostSched {
+			sched = schedCounters{delayNs: f.schedLast.delayNs - f.schedStart.delayNs, slices: f.schedLast.slices - f.schedStart.slices}
+		}
+		if sched.slices > 0 {
+			e.Runqlat = &RunqlatData{MeanUs: float64(sched.delayNs) / float64(sched.slices) / 1000}
+		}
+	}
+	if f.names["biolatency"] {
+		end := readDiskstats()
+		if ios := end.ios - f.diskStart.ios; ios > 0 {
+			e.Biolatency = &BiolatencyData{MeanUs: float64(end.ms-f.diskStart.ms) * 1000 / float64(ios)}
+		}
+	}
+	if f.names["offcpu"] && f.tracker != nil {
+		data := &OffcpuData{TotalMs: f.offMs}
+		for reason, n := range f.wchans {
+			data.TopReasons = append(data.TopReasons, ReasonData{Reason: reason, Ms: f.offMs * float64(n) / float64(f.sleeping)})
+		}
+		sort.Slice(data.TopReasons, func(i, j int) bool { return data.TopReasons[i].Ms > data.TopReasons[j].Ms })
+		if offcpuTop > 0 && offcpuTop < len(data.TopReasons) {
+			data.TopReasons = data.TopReasons[:offcpuTop]
+		}
+		e.Offcpu = data
+	}
+	if f.names["exec"] {
+		data := &ExecData{ExecCount: int(readForks() - f.forksStart)}
+		for comm, n := range f.commands {
+			data.TopCommands = append(data.TopCommands, CommandCount{Command: comm, Count: n})
+		}
+		sort.Slice(data.TopCommands, func(i, j int) bool {
+			a, b := data.TopCommands[i], data.TopCommands[j]
+			return a.Count > b.Count || a.Count == b.Count && a.Command < b.Command
+		})
+		if execTop > 0 && execTop < len(data.TopCommands) {
+			data.TopCommands = data.TopCommands[:execTop]
+		}
+		e.Exec = data
+	}
+	if f.names["syscalls"] && f.tracker != nil {
+		e.SyscallCounts = &SyscallData{Read: int(f.reads), Write: int(f.writes)}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fallbackSource = "perfcounters"
+
+// fallbackCollectors are the collectors perfCounterFallback covers, and
+// whether each needs a target. Windows performance counters have nothing
+// like run queue latency, per-process syscall counts or off-CPU reasons.
+var fallbackCollectors = map[string]bool{
+	"biolatency": false,
+	"exec":       false,
+}
+
+const fallbackInterval = time.Second
+
+// perfCounterFallback is the Windows fallbackCollector. Disk latency comes
+// from the PhysicalDisk counters, read with typeperf, and process starts from
+// polling tasklist every second, so processes shorter than that are missed.
+type perfCounterFallback struct {
+	names    map[string]bool
+	typeperf *exec.Cmd
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu        sync.Mutex
+	diskUs    float64
+	transfers float64
+	seen      map[int]bool
+	commands  map[string]int
+	starts    int
+}
+
+func startFallback(names map[string]bool, tracker *targetTracker) fallbackCollector {
+	f := &perfCounterFallback{
+		names:    names,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		seen:     map[int]bool{},
+		commands: map[string]int{},
+	}
+	if names["biolatency"] {
+		f.startTypeperf()
+	}
+	for pid := range tasklist() {
+		f.seen[pid] = true
+	}
+	go f.loop()
+	return f
+}
+
+// startTypeperf streams the disks' mean latency and transfer rate, one CSV
+// row per second.
+func (f *perfCounterFallback) startTypeperf() {
+	cmd := exec.Command("typeperf",
+		`\PhysicalDisk(_Total)\Avg. Disk sec/Transfer`,
+		`\PhysicalDisk(_Total)\Disk Transfers/sec`,
+		"-si", strconv.Itoa(int(fallbackInterval/time.Second)))
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("Disk latency fallback unavailable: typeperf: %v", err)
+		return
+	}
+	f.typeperf = cmd
+	go func() {
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			fields, err := csv.NewReader(strings.NewReader(scanner.Text())).Read()
+			if err != nil || len(fields) < 3 {
+				continue
+			}
+			// The header row and blank samples do not parse.
+			secs, err1 := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+			rate, err2 := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			f.mu.Lock()
+			f.diskUs += secs * 1e6 * rate
+			f.transfers += rate
+			f.mu.Unlock()
+		}
+	}()
+}
+
+// tasklist returns the image name of every running process.
+func tasklist() map[int]string {
+	procs := map[int]string{}
+	out, err := exec.Command("tasklist", "/FO", "CSV", "/NH").Output()
+	if err != nil {
+		return procs
+	}
+	r := csv.NewReader(strings.NewReader(string(out)))
+	for {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || len(fields) < 2 {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[1]); err == nil {
+			procs[pid] = strings.TrimSuffix(fields[0], ".exe")
+		}
+	}
+	return procs
+}
+
+func (f *perfCounterFallback) loop() {
+	defer close(f.done)
+	if !f.names["exec"] {
+		<-f.stop
+		return
+	}
+	ticker := newPacedTicker(fallbackInterval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.sample()
+		}
+	}
+}
+
+func (f *perfCounterFallback) sample() {
+	procs := tasklist()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for pid, name := range procs {
+		if !f.seen[pid] {
+			f.seen[pid] = true
+			f.commands[name]++
+			f.starts++
+		}
+	}
+}
+
+// retarget does nothing: no Windows fallback is per-process.
+func (f *perfCounterFallback) retarget(tracker *targetTracker) {}
+
+func (f *perfCounterFallback) Stop(e *Evidence, offcpuTop, execTop int) {
+	close(f.stop)
+	<-f.done
+	if f.typeperf != nil {
+		f.typeperf.Process.Kill()
+		f.typeperf.Wait()
+	}
+	if f.names["exec"] {
+		f.sample()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.names["biolatency"] && f.transfers > 0 {
+		e.Biolatency = &BiolatencyData{MeanUs: f.diskUs / f.transfers}
+	}
+	if f.names["exec"] {
+		data := &ExecData{ExecCount: f.starts}
+		for comm, n := range f.commands {
+			data.TopCommands = append(data.TopCommands, CommandCount{Command: comm, Count: n})
+		}
+		sort.Slice(data.TopCommands, func(i, j int) bool {
+			a, b := data.TopCommands[i], data.TopCommands[j]
+			return a.Count > b.Count || a.Count == b.Count && a.Command < b.Command
+		})
+		if execTop > 0 && execTop < len(data.TopCommands) {
+			data.TopCommands = data.TopCommands[:execTop]
+		}
+		e.Exec = data
+	}
+}
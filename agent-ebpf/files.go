@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileData is the target's open file descriptors over the window and the
+// host's dentry and inode caches. An implementation that opens and closes
+// the same files over and over, rather than caching the handles, shows as
+// openat churn with a flat fd count here, and as cache reclaim when the
+// caches are under pressure.
+type FileData struct {
+	StartFDs int `json:"start_fds"`
+	EndFDs   int `json:"end_fds"`
+	PeakFDs  int `json:"peak_fds"`
+	// Limit is the lowest soft RLIMIT_NOFILE among the target's processes,
+	// and PeakLimitPct the largest share of its own limit any of them
+	// reached.
+	Limit        uint64     `json:"limit,omitempty"`
+	PeakLimitPct float64    `json:"peak_limit_pct"`
+	Samples      []FDSample `json:"samples"`
+	// The caches' sizes are the host's, from /proc/sys/fs; Reclaimed sums
+	// the falls in their size between samples.
+	DentriesStart     uint64 `json:"dentries_start"`
+	DentriesEnd       uint64 `json:"dentries_end"`
+	DentriesReclaimed uint64 `json:"dentries_reclaimed"`
+	InodesStart       uint64 `json:"inodes_start"`
+	InodesEnd         uint64 `json:"inodes_end"`
+	InodesReclaimed   uint64 `json:"inodes_reclaimed"`
+	// InodeStealPages are page cache pages freed along with the inodes
+	// reclaimed, and SlabsScanned the slab objects reclaim scanned.
+	InodeStealPages uint64 `json:"inode_steal_pages"`
+	SlabsScanned    uint64 `json:"slabs_scanned"`
+}
+
+// FDSample is the target's open file descriptors at one point of the window.
+type FDSample struct {
+	OffsetMs float64 `json:"offset_ms"`
+	FDs      int     `json:"fds"`
+}
+
+// FDErrorData counts the target's syscalls that failed for want of a file
+// descriptor: EMFILE at its own limit, ENFILE at the host's.
+type FDErrorData struct {
+	TooManyOpen   int `json:"emfile"`
+	FileTableFull int `json:"enfile"`
+}
+
+const filesInterval = time.Second
+
+// openFileLimit returns a process's soft limit on open files, or 0 when it
+// is unlimited or unreadable.
+func openFileLimit(pid int) uint64 {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "limits"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rest, ok := strings.CutPrefix(scanner.Text(), "Max open files"); ok {
+			fields := strings.Fields(rest)
+			if len(fields) > 0 {
+				limit, _ := strconv.ParseUint(fields[0], 10, 64)
+				return limit
+			}
+		}
+	}
+	return 0
+}
+
+// readFirstNumber returns the first number of a /proc/sys/fs file such as
+// dentry-state or inode-nr.
+func readFirstNumber(path string) (uint64, bool) {
+	fields := strings.Fields(readTrimmed(path))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(fields[0], 10, 64)
+	return v, err == nil
+}
+
+// fileSampler counts the target's open fds every interval, and follows the
+// dentry and inode caches' size and reclaim.
+type fileSampler struct {
+	tracker  *targetTracker
+	interval time.Duration
+	started  time.Time
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu                  sync.Mutex
+	data                FileData
+	sampled             bool
+	dentries, inodes    uint64
+	firstVM, lastVM     cgroupCounters
+	haveDentry, haveIno bool
+}
+
+func startFileSampler(tracker *targetTracker, interval time.Duration) *fileSampler {
+	s := &fileSampler{
+		tracker:  tracker,
+		interval: interval,
+		started:  time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.sample()
+	go s.loop()
+	return s
+}
+
+func (s *fileSampler) loop() {
+	defer close(s.done)
+	ticker := newPacedTicker(s.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+func (s *fileSampler) sample() {
+	pids := s.tracker.PIDs()
+	fds, counted := 0, false
+	var limit uint64
+	limitPct := 0.0
+	for _, pid := range pids {
+		entries, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "fd"))
+		if err != nil {
+			continue
+		}
+		fds += len(entries)
+		counted = true
+		if l := openFileLimit(pid); l > 0 {
+			if limit == 0 || l < limit {
+				limit = l
+			}
+			limitPct = max(limitPct, float64(len(entries))/float64(l)*100)
+		}
+	}
+	dentries, haveDentry := readFirstNumber("/proc/sys/fs/dentry-state")
+	inodes, haveIno := readFirstNumber("/proc/sys/fs/inode-nr")
+	vm := cgroupCounters{}
+	readKeyValues("/proc/vmstat", vm, "")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counted {
+		if !s.sampled {
+			s.sampled = true
+			s.data.StartFDs = fds
+		}
+		s.data.EndFDs = fds
+		s.data.PeakFDs = max(s.data.PeakFDs, fds)
+		s.data.Samples = append(s.data.Samples, FDSample{OffsetMs: float64(time.Since(s.started).Milliseconds()), FDs: fds})
+		if limit > 0 && (s.data.Limit == 0 || limit < s.data.Limit) {
+			s.data.Limit = limit
+		}
+		s.data.PeakLimitPct = max(s.data.PeakLimitPct, limitPct)
+	}
+	if haveDentry {
+		if !s.haveDentry {
+			s.haveDentry, s.data.DentriesStart = true, dentries
+		} else if dentries < s.dentries {
+			s.data.DentriesReclaimed += s.dentries - dentries
+		}
+		s.dentries, s.data.DentriesEnd = dentries, dentries
+	}
+	if haveIno {
+		if !s.haveIno {
+			s.haveIno, s.data.InodesStart = true, inodes
+		} else if inodes < s.inodes {
+			s.data.InodesReclaimed += s.inodes - inodes
+		}
+		s.inodes, s.data.InodesEnd = inodes, inodes
+	}
+	if s.firstVM == nil {
+		s.firstVM = vm
+	}
+	s.lastVM = vm
+}
+
+// Stop returns the window's fds and caches, or nil when the target's fds
+// could not be read.
+func (s *fileSampler) Stop() *FileData {
+	close(s.stop)
+	<-s.done
+	s.sample()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sampled {
+		return nil
+	}
+	data := s.data
+	delta := func(name string) uint64 {
+		if s.lastVM[name] < s.firstVM[name] {
+			return 0
+		}
+		return s.lastVM[name] - s.firstVM[name]
+	}
+	data.InodeStealPages = delta("pginodesteal") + delta("kswapd_inodesteal")
+	data.SlabsScanned = delta("slabs_scanned")
+	return &data
+}
+
+func (c *EvidenceCollector) collectFDErrors(out *bpftraceOutput) *FDErrorData {
+	return &FDErrorData{
+		TooManyOpen:   int(out.maps["emfile"][""]),
+		FileTableFull: int(out.maps["enfile"][""]),
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FilesystemInfo is the filesystem the workload's data directory was on. A
+// node's disk-bound phases move with the mount as much as with the disk:
+// the same drive mounted with online discard, or with compression, or
+// without noatime, benchmarks differently.
+type FilesystemInfo struct {
+	Path       string `json:"path"`
+	MountPoint string `json:"mount_point"`
+	Type       string `json:"type"`
+	Source     string `json:"source,omitempty"`
+	// Options are the mount's and the filesystem's options together.
+	Options []string `json:"options,omitempty"`
+	// Discard reports online discard: TRIM issued as blocks are freed.
+	Discard bool `json:"discard"`
+	// Compression is the algorithm the mount compresses with, if any.
+	Compression string `json:"compression,omitempty"`
+}
+
+// mountIdentityOptions name where a mount comes from rather than how it
+// behaves, so two runs' mounts may differ in them.
+var mountIdentityOptions = map[string]bool{
+	"subvol": true, "subvolid": true, "lowerdir": true, "upperdir": true, "workdir": true,
+	"size": true, "nr_inodes": true, "uid": true, "gid": true,
+}
+
+// behaviorOptions returns the options that affect how the filesystem
+// behaves, for comparing two mounts.
+func (f *FilesystemInfo) behaviorOptions() string {
+	var options []string
+	for _, o := range f.Options {
+		key, _, _ := strings.Cut(o, "=")
+		if !mountIdentityOptions[key] {
+			options = append(options, o)
+		}
+	}
+	return strings.Join(options, ",")
+}
+
+// filesystemDifferences flags two runs' data directories that were on
+// differently mounted filesystems.
+func filesystemDifferences(a, b *FilesystemInfo) []TuningDifference {
+	if a == nil || b == nil {
+		return nil
+	}
+	var diffs []TuningDifference
+	for _, d := range []TuningDifference{
+		{"fs.type", a.Type, b.Type},
+		{"fs.options", a.behaviorOptions(), b.behaviorOptions()},
+		{"fs.discard", strconv.FormatBool(a.Discard), strconv.FormatBool(b.Discard)},
+		{"fs.compression", a.Compression, b.Compression},
+	} {
+		if d.A != d.B {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
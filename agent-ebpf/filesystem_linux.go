@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// captureFilesystem finds the mount path is on in /proc/self/mountinfo:
+// the deepest mount point above it, preferring one of its own device.
+func captureFilesystem(path string) *FilesystemInfo {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(abs, &st); err != nil {
+		return nil
+	}
+	dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var best *FilesystemInfo
+	bestOwn := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// id parent major:minor root mount-point options [optional...] - type source super-options
+		before, after, ok := strings.Cut(scanner.Text(), " - ")
+		fields, tail := strings.Fields(before), strings.Fields(after)
+		if !ok || len(fields) < 6 || len(tail) < 3 {
+			continue
+		}
+		mountPoint := unescapeMountinfo(fields[4])
+		if !within(abs, mountPoint) {
+			continue
+		}
+		own := fields[2] == dev
+		if best != nil && (bestOwn && !own || bestOwn == own && len(mountPoint) < len(best.MountPoint)) {
+			continue
+		}
+		best, bestOwn = &FilesystemInfo{
+			Path:       abs,
+			MountPoint: mountPoint,
+			Type:       tail[0],
+			Source:     unescapeMountinfo(tail[1]),
+			Options:    mountOptions(fields[5], tail[2]),
+		}, own
+	}
+	if best == nil {
+		return nil
+	}
+	for _, o := range best.Options {
+		key, value, _ := strings.Cut(o, "=")
+		switch key {
+		case "discard":
+			best.Discard = true
+		case "compress", "compress-force", "compress_algorithm":
+			best.Compression = value
+		}
+	}
+	if best.Type == "zfs" {
+		best.Compression = zfsProperty(best.Source, "compression")
+	}
+	if best.Compression == "off" || best.Compression == "no" {
+		best.Compression = ""
+	}
+	return best
+}
+
+// within reports whether path is mountPoint or below it.
+func within(path, mountPoint string) bool {
+	return mountPoint == "/" || path == mountPoint || strings.HasPrefix(path, mountPoint+"/")
+}
+
+// unescapeMountinfo undoes mountinfo's octal escapes of spaces, tabs,
+// newlines and backslashes.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountOptions merges the per-mount and superblock options, sorted.
+func mountOptions(lists ...string) []string {
+	seen := map[string]bool{}
+	var options []string
+	for _, list := range lists {
+		for _, o := range strings.Split(list, ",") {
+			if o != "" && !seen[o] {
+				seen[o] = true
+				options = append(options, o)
+			}
+		}
+	}
+	sort.Strings(options)
+	return options
+}
+
+// zfsProperty reads a dataset's property; ZFS keeps compression out of the
+// mount options.
+func zfsProperty(dataset, property string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "zfs", "get", "-H", "-o", "value", property, dataset).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
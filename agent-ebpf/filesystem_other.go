@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// captureFilesystem is only known on Linux, from mountinfo.
+func captureFilesystem(path string) *FilesystemInfo {
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type EnvironmentInfo struct {
+	Hostname    string `json:"hostname"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+	Kernel      string `json:"kernel,omitempty"`
+	CPUModel    string `json:"cpu_model,omitempty"`
+	CPUCount    int    `json:"cpu_count"`
+	MemoryBytes uint64 `json:"memory_bytes,omitempty"`
+	// StorageClass is the kind of disk under the data dir: nvme, ssd, hdd
+	// or virtual.
+	StorageClass string `json:"storage_class,omitempty"`
+	// Filesystem is the mount the workload's data directory was on.
+	Filesystem *FilesystemInfo `json:"filesystem,omitempty"`
+	// Disks are the host's drives and their health; nil when not recorded.
+	Disks []DiskHealth `json:"disks,omitempty"`
+
+	KernelTuning map[string]string `json:"kernel_tuning,omitempty"`
+}
+
+func readTrimmed(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// procField returns the value of the first "key: value" line in a /proc file
+// whose key matches.
+func procField(path, key string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(name) == key {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// machineInfo carries each machine's architecture and CPU, so other series
+// can be grouped by them through the machine label.
+var machineInfo = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_machine_info",
+		Help: "Architecture and CPU of each benchmark machine (always 1)",
+	},
+	[]string{"machine", "arch", "cpu_model"},
+)
+
+// armCores names Arm CPU parts by implementer and part number, for the
+// "CPU implementer" and "CPU part" fields arm64 has instead of a model name.
+var armCores = map[string]string{
+	"0x41/0xd03": "Cortex-A53",
+	"0x41/0xd08": "Cortex-A72",
+	"0x41/0xd0b": "Cortex-A76",
+	"0x41/0xd0c": "Neoverse-N1",
+	"0x41/0xd40": "Neoverse-V1",
+	"0x41/0xd49": "Neoverse-N2",
+	"0x41/0xd4f": "Neoverse-V2",
+	"0x41/0xd84": "Neoverse-V3",
+	"0x41/0xd8e": "Neoverse-N3",
+	"0xc0/0xac3": "AmpereOne",
+}
+
+// cpuModel names the CPU: the model name on x86, the core on arm64 and the
+// microarchitecture (or ISA string) on riscv64.
+func cpuModel() string {
+	if model := procField("/proc/cpuinfo", "model name"); model != "" {
+		return model
+	}
+	switch runtime.GOARCH {
+	case "arm64":
+		implementer := procField("/proc/cpuinfo", "CPU implementer")
+		part := procField("/proc/cpuinfo", "CPU part")
+		if name, ok := armCores[implementer+"/"+part]; ok {
+			return name
+		}
+		if part != "" {
+			return "arm64 implementer " + implementer + " part " + part
+		}
+	case "riscv64":
+		if uarch := procField("/proc/cpuinfo", "uarch"); uarch != "" {
+			return uarch
+		}
+		return procField("/proc/cpuinfo", "isa")
+	}
+	return ""
+}
+
+// captureEnvironment fingerprints the host, with the filesystem of
+// workloadDir, or of the agent's data dir when it is "".
+func captureEnvironment(workloadDir string) *EnvironmentInfo {
+	env := &EnvironmentInfo{
+		Hostname: getHostname(),
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Kernel:   readTrimmed("/proc/sys/kernel/osrelease"),
+		CPUModel: cpuModel(),
+		CPUCount: runtime.NumCPU(),
+	}
+
+	if mem := strings.TrimSuffix(procField("/proc/meminfo", "MemTotal"), " kB"); mem != "" {
+		if kb, err := strconv.ParseUint(mem, 10, 64); err == nil {
+			env.MemoryBytes = kb * 1024
+		}
+	}
+
+	dataDir := "."
+	if store != nil {
+		dataDir = store.dir
+	}
+	env.StorageClass = storageClass(dataDir)
+	if workloadDir == "" {
+		workloadDir = dataDir
+	}
+	env.Filesystem = captureFilesystem(workloadDir)
+	env.KernelTuning = captureKernelTuning(env.Kernel)
+	env.Disks = captureDisks()
+
+	return env
+}
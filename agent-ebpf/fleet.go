@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Agents given --aggregator-url heartbeat their state to that agent, which
+// keeps the latest from each and serves the whole fleet at GET /fleet: who
+// is idle, who is running what since when, and how much work is queued
+// behind it.
+
+// An agent is running while a session collects or a job builds or runs,
+// stopping while a session winds down, idle otherwise, and offline once it
+// missed fleetMissedHeartbeats heartbeats. An agent draining or in
+// maintenance is out of rotation and says so instead, whatever it runs.
+const (
+	agentIdle     = "idle"
+	agentRunning  = "running"
+	agentStopping = "stopping"
+	agentOffline  = "offline"
+)
+
+var agentStates = []string{agentIdle, agentRunning, agentStopping, modeDraining, modeMaintenance, agentOffline}
+
+const fleetMissedHeartbeats = 3
+
+// heartbeatInterval is how often an agent reports to its aggregator, and
+// fleetAdvertiseURL where it says it can be reached.
+var (
+	heartbeatInterval = 15 * time.Second
+	fleetAdvertiseURL string
+)
+
+// AgentState is what an agent reports in a heartbeat.
+type AgentState struct {
+	Agent   string `json:"agent"`
+	Version string `json:"version,omitempty"`
+	OS      string `json:"os,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	// APIVersion and Features are what the agent's API offers; agents
+	// predating them report neither.
+	APIVersion int      `json:"api_version,omitempty"`
+	Features   []string `json:"features,omitempty"`
+	// URL is where the agent can be reached, if it advertised one.
+	URL       string     `json:"url,omitempty"`
+	State     string     `json:"state"`
+	SessionID string     `json:"session_id,omitempty"`
+	Job       string     `json:"job_id,omitempty"`
+	Scenario  string     `json:"scenario,omitempty"`
+	Impl      string     `json:"impl,omitempty"`
+	Variant   string     `json:"variant,omitempty"`
+	Commit    string     `json:"commit,omitempty"`
+	Since     *time.Time `json:"since,omitempty"`
+	// ProgressPct is how far the running session got, if it reports
+	// progress.
+	ProgressPct *float64 `json:"progress_pct,omitempty"`
+	QueueDepth  int      `json:"queue_depth"`
+	// ReservedBy holds the agent until ReservedUntil; only its work runs.
+	ReservedBy    string     `json:"reserved_by,omitempty"`
+	ReservedUntil *time.Time `json:"reserved_until,omitempty"`
+	// HeartbeatIntervalS is how often the agent heartbeats, so the
+	// aggregator knows when it went quiet.
+	HeartbeatIntervalS float64 `json:"heartbeat_interval_s"`
+}
+
+// FleetAgent is an agent as the aggregator last heard from it.
+type FleetAgent struct {
+	AgentState
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+// Fleet is the answer to GET /fleet.
+type Fleet struct {
+	Agents []*FleetAgent `json:"agents"`
+	// States counts the agents in each state.
+	States map[string]int `json:"states"`
+	// Utilization is the share of agents in rotation that are busy.
+	Utilization float64 `json:"utilization"`
+	QueueDepth  int     `json:"queue_depth"`
+}
+
+var fleetAgents = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_fleet_agents",
+		Help: "Agents reporting to this aggregator, by state",
+	},
+	[]string{"state"},
+)
+
+// localAgentState is this agent's own state.
+func localAgentState() AgentState {
+	s := agentWorkState()
+	if mode := admin.status().Mode; mode != modeActive {
+		s.State = mode
+	}
+	return s
+}
+
+// agentWorkState is this agent's state from the work it has in hand alone,
+// whether it is in rotation or not.
+func agentWorkState() AgentState {
+	status := collector.Status()
+	s := AgentState{
+		Agent:              status.Machine,
+		Version:            agentVersion,
+		OS:                 runtime.GOOS,
+		Arch:               runtime.GOARCH,
+		APIVersion:         apiVersion,
+		Features:           agentFeatures,
+		URL:                fleetAdvertiseURL,
+		State:              agentIdle,
+		HeartbeatIntervalS: heartbeatInterval.Seconds(),
+	}
+	if jobs != nil {
+		for _, job := range jobs.List() {
+			switch job.State {
+			case jobQueued:
+				s.QueueDepth++
+			case jobBuilding, jobRunning, jobRetrying:
+				s.State = agentRunning
+				s.Job, s.Scenario, s.Impl, s.Variant, s.Commit = job.ID, job.Scenario, job.Impl, job.Variant, job.Commit
+				s.Since = job.StartedAt
+			}
+		}
+	}
+	if res := reservations.current(); res != nil {
+		s.ReservedBy, s.ReservedUntil = res.Principal, &res.End
+	}
+	if status.Running {
+		s.State = agentRunning
+		if status.Stopping {
+			s.State = agentStopping
+		}
+		s.SessionID, s.Scenario, s.Impl, s.Variant = status.SessionID, status.Scenario, status.Impl, status.Variant
+		since := status.StartedAt.UTC()
+		s.Since = &since
+		if status.Progress != nil {
+			s.ProgressPct = &status.Progress.Percent
+		}
+	}
+	return s
+}
+
+// fleetRegistry holds the latest heartbeat of every agent. It lives in
+// memory only: agents heartbeat again within an interval of the aggregator
+// restarting.
+type fleetRegistry struct {
+	mu     sync.Mutex
+	agents map[string]*FleetAgent
+}
+
+var fleet = &fleetRegistry{agents: map[string]*FleetAgent{}}
+
+func (f *fleetRegistry) record(s AgentState) {
+	f.mu.Lock()
+	f.agents[s.Agent] = &FleetAgent{AgentState: s, LastHeartbeat: time.Now().UTC()}
+	f.mu.Unlock()
+}
+
+// snapshot returns every agent, this one included as self reports it, with
+// agents that stopped heartbeating marked offline.
+func (f *fleetRegistry) snapshot(self AgentState) *Fleet {
+	now := time.Now().UTC()
+	f.mu.Lock()
+	agents := make([]*FleetAgent, 0, len(f.agents)+1)
+	for name, a := range f.agents {
+		if name == self.Agent {
+			continue
+		}
+		copied := *a
+		interval := time.Duration(a.HeartbeatIntervalS * float64(time.Second))
+		if interval <= 0 {
+			interval = heartbeatInterval
+		}
+		if now.Sub(a.LastHeartbeat) > fleetMissedHeartbeats*interval {
+			copied.State = agentOffline
+		}
+		agents = append(agents, &copied)
+	}
+	f.mu.Unlock()
+	agents = append(agents, &FleetAgent{AgentState: self, LastHeartbeat: now})
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Agent < agents[j].Agent })
+
+	fl := &Fleet{Agents: agents, States: map[string]int{}}
+	for _, state := range agentStates {
+		fl.States[state] = 0
+	}
+	for _, a := range agents {
+		fl.States[a.State]++
+		if a.State != agentOffline {
+			fl.QueueDepth += a.QueueDepth
+		}
+	}
+	busy := fl.States[agentRunning] + fl.States[agentStopping]
+	if available := busy + fl.States[agentIdle]; available > 0 {
+		fl.Utilization = float64(busy) / float64(available)
+	}
+	for state, n := range fl.States {
+		fleetAgents.WithLabelValues(state).Set(float64(n))
+	}
+	return fl
+}
+
+// heartbeat reports this agent's state to the aggregator every interval,
+// and hands any upgrade it offers to agentUpgrader. It asks the aggregator
+// for its capabilities first, and again after a failure or once it answers
+// as another version, and leaves out what an older aggregator would refuse.
+// Failures are logged when they start and when they end, not on every
+// attempt.
+func heartbeat(aggregatorURL string) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	url := strings.TrimRight(aggregatorURL, "/") + "/fleet/heartbeat"
+	var (
+		failing bool
+		caps    *Capabilities
+	)
+	for {
+		err := func() error {
+			if caps == nil {
+				c, err := fetchCapabilities(context.Background(), client, aggregatorURL)
+				if err != nil {
+					return err
+				}
+				if !c.has("admin") {
+					log.Printf("Fleet: aggregator %s (version %s) predates drain and maintenance; reporting those as idle or running", aggregatorURL, c.Version)
+				}
+				caps = c
+			}
+			s := localAgentState()
+			if !caps.has("admin") {
+				s = agentWorkState()
+			}
+			data, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion))
+			authorize(req)
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if v := resp.Header.Get(agentVersionHeader); v != "" && v != caps.Version {
+				caps = nil
+			}
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("%s: %s", url, resp.Status)
+			}
+			var reply HeartbeatReply
+			if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&reply) == nil && reply.Upgrade != nil {
+				agentUpgrader.offered(reply.Upgrade)
+			}
+			return nil
+		}()
+		if err != nil {
+			caps = nil
+		}
+		if err != nil && !failing {
+			log.Printf("Fleet heartbeat failed: %v", err)
+		} else if err == nil && failing {
+			log.Printf("Fleet heartbeat to %s restored", aggregatorURL)
+		}
+		failing = err != nil
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// handleFleet serves GET /fleet, optionally narrowed to the agents in one
+// or more states, and takes heartbeats at POST /fleet/heartbeat.
+func handleFleet(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/fleet/heartbeat" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var s AgentState
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.Agent == "" {
+			http.Error(w, "agent is required", http.StatusBadRequest)
+			return
+		}
+		if s.State == agentOffline || !slices.Contains(agentStates, s.State) {
+			http.Error(w, fmt.Sprintf("invalid state %q", s.State), http.StatusBadRequest)
+			return
+		}
+		fleet.record(s)
+		if rel := releases.offer(s); rel != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(HeartbeatReply{Upgrade: rel})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.URL.Path != "/fleet" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fl := fleet.snapshot(localAgentState())
+	if states := r.URL.Query()["state"]; len(states) > 0 {
+		for _, state := range states {
+			if !slices.Contains(agentStates, state) {
+				http.Error(w, fmt.Sprintf("unknown state %q (want one of %s)", state, strings.Join(agentStates, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+		filtered := fl.Agents[:0]
+		for _, a := range fl.Agents {
+			if slices.Contains(states, a.State) {
+				filtered = append(filtered, a)
+			}
+		}
+		fl.Agents = filtered
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fl)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GainReport is a gain the agent worked out from stored runs: the median of
+// each side's durations, the gain of the optimized median over the
+// baseline's, and a bootstrap confidence interval around it. Reports
+// submitted with figures computed by the caller have Source "client" and no
+// interval.
+type GainReport struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Impl      string    `json:"impl"`
+	Variant   string    `json:"variant"`
+	Commit    string    `json:"commit"`
+	Machine   string    `json:"machine"`
+	Dataset   string    `json:"dataset"`
+	Project   string    `json:"project,omitempty"`
+	Source    string    `json:"source"`
+
+	Baseline  GainSide `json:"baseline"`
+	Optimized GainSide `json:"optimized"`
+
+	GainPct float64 `json:"gain_pct"`
+	// CILowPct and CIHighPct bound the gain at Confidence.
+	CILowPct   *float64 `json:"ci_low_pct,omitempty"`
+	CIHighPct  *float64 `json:"ci_high_pct,omitempty"`
+	Confidence float64  `json:"confidence,omitempty"`
+	// Effect says how large the gain is against the runs' spread, and how
+	// large one they could have told apart from noise.
+	Effect *EffectSize `json:"effect,omitempty"`
+	// Verdict and Reason judge the gain; see judgeGain.
+	Verdict string `json:"verdict,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// EffectSize puts a difference between two run sets in terms of their
+// spread. CliffsDelta is how much more often a baseline run is slower than
+// an optimized one than the other way round, and HedgesG the difference of
+// the means in pooled standard deviations; both are positive when
+// optimized is faster. MinDetectablePct is the smallest gain, in percent
+// of the baseline mean, a two-sided test at 1-confidence would find with
+// Power, given the runs' spread and count: a gain below it is not one this
+// rig can vouch for, whatever its interval says.
+type EffectSize struct {
+	CliffsDelta      float64 `json:"cliffs_delta"`
+	Magnitude        string  `json:"magnitude"`
+	HedgesG          float64 `json:"hedges_g"`
+	MinDetectablePct float64 `json:"min_detectable_pct"`
+	Power            float64 `json:"power"`
+}
+
+// GainSide is one side of a gain: the runs it was taken from and how many
+// of them succeeded, and their median duration.
+type GainSide struct {
+	Runs     []string `json:"runs,omitempty"`
+	Success  int      `json:"success"`
+	MedianMs float64  `json:"median_ms"`
+}
+
+const (
+	gainSourceRuns   = "runs"
+	gainSourceClient = "client"
+)
+
+// A run set given as a query takes its latest gainDefaultRuns runs unless
+// the query says how many; the interval is drawn from gainResamples
+// bootstrap resamples, and the smallest detectable gain is the one found
+// with gainPower.
+const (
+	gainDefaultRuns       = 10
+	gainDefaultConfidence = 0.95
+	gainResamples         = 2000
+	gainPower             = 0.8
+)
+
+var benchmarkGainCI = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_gain_ci_percent",
+		Help: "Bounds of the confidence interval of the agent-computed performance gain",
+	},
+	[]string{"impl", "variant", "commit", "machine", "dataset", "project", "bound"},
+)
+
+var benchmarkGainMinDetectable = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_gain_min_detectable_percent",
+		Help: "Smallest gain the runs behind the agent-computed gain could have detected",
+	},
+	[]string{"impl", "variant", "commit", "machine", "dataset", "project"},
+)
+
+// gainRuns resolves one side's run set, given as run ids or as a GET /runs
+// query, to the ids and the runs among them that can be compared and
+// recorded a duration.
+func gainRuns(ids []string, query, scope string) ([]string, []*Run, error) {
+	if store == nil {
+		return nil, nil, fmt.Errorf("no run store")
+	}
+	if query != "" {
+		if len(ids) > 0 {
+			return nil, nil, fmt.Errorf("give runs or a query, not both")
+		}
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, nil, err
+		}
+		q, err := parseRunQuery(values)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !values.Has("limit") {
+			q.Limit = gainDefaultRuns
+		}
+		if !values.Has("result") {
+			q.Results = []string{resultSuccess}
+		}
+		scopeQuery(q, scope)
+		runs, _, err := store.Query(q)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, run := range runs {
+			ids = append(ids, run.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil, fmt.Errorf("no runs")
+	}
+	var usable []*Run
+	for _, id := range ids {
+		run, err := store.Get(id)
+		if err == nil && !inScope(scope, run.Project) {
+			err = errRunNotFound
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", id, err)
+		}
+		if usableRun(run) && benchmarkMs(run) > 0 {
+			usable = append(usable, run)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, nil, fmt.Errorf("none of the runs succeeded with a duration")
+	}
+	return ids, usable, nil
+}
+
+// gainPct is how much faster optimized is than baseline, in percent of
+// baseline.
+func gainPct(baselineMs, optimizedMs float64) float64 {
+	if baselineMs <= 0 {
+		return 0
+	}
+	return (baselineMs - optimizedMs) / baselineMs * 100
+}
+
+// bootstrapGain returns the percentile bootstrap interval of the gain of
+// the medians at confidence. The resampling is seeded, so the same runs
+// always give the same interval.
+func bootstrapGain(baseline, optimized []float64, confidence float64) (low, high float64) {
+	rng := rand.New(rand.NewSource(1))
+	resample := func(values, into []float64) []float64 {
+		into = into[:0]
+		for range values {
+			into = append(into, values[rng.Intn(len(values))])
+		}
+		return into
+	}
+	gains := make([]float64, gainResamples)
+	var b, o []float64
+	for i := range gains {
+		b, o = resample(baseline, b), resample(optimized, o)
+		gains[i] = gainPct(median(b), median(o))
+	}
+	sort.Float64s(gains)
+	tail := (1 - confidence) / 2
+	return sortedPercentile(gains, tail), sortedPercentile(gains, 1-tail)
+}
+
+// newEffectSize measures the effect between the two sides' values, which
+// are durations, so smaller is better.
+func newEffectSize(baseline, optimized []float64, confidence float64) *EffectSize {
+	delta := cliffsDelta(baseline, optimized)
+	return &EffectSize{
+		CliffsDelta:      delta,
+		Magnitude:        cliffsMagnitude(delta),
+		HedgesG:          hedgesG(baseline, optimized),
+		MinDetectablePct: minDetectablePct(baseline, optimized, 1-confidence, gainPower),
+		Power:            gainPower,
+	}
+}
+
+// newGainReport works out the gain between two run sets, and judges it.
+func newGainReport(baseline, optimized []string, baselineRuns, optimizedRuns []*Run, confidence float64) *GainReport {
+	durations := func(runs []*Run) []float64 {
+		values := make([]float64, len(runs))
+		for i, run := range runs {
+			values[i] = benchmarkMs(run)
+		}
+		return values
+	}
+	baselineMs, optimizedMs := durations(baselineRuns), durations(optimizedRuns)
+	g := &GainReport{
+		Source:     gainSourceRuns,
+		Baseline:   GainSide{Runs: baseline, Success: len(baselineMs), MedianMs: median(baselineMs)},
+		Optimized:  GainSide{Runs: optimized, Success: len(optimizedMs), MedianMs: median(optimizedMs)},
+		Confidence: confidence,
+	}
+	g.GainPct = gainPct(g.Baseline.MedianMs, g.Optimized.MedianMs)
+	low, high := bootstrapGain(baselineMs, optimizedMs, confidence)
+	g.CILowPct, g.CIHighPct = &low, &high
+	g.Effect = newEffectSize(baselineMs, optimizedMs, confidence)
+	g.Verdict, g.Reason = judgeGain(g, baselineRuns, optimizedRuns)
+	return g
+}
+
+func (s *RunStore) gainsDir() string {
+	return filepath.Join(s.dir, "gains")
+}
+
+// SaveGain records a gain report, giving it an id.
+func (s *RunStore) SaveGain(g *GainReport) error {
+	g.ID = newRunID()
+	g.CreatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.gainsDir(), 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(s.gainsDir(), g.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Gains returns the recorded gain reports, newest first.
+func (s *RunStore) Gains() ([]*GainReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, err := os.ReadDir(s.gainsDir())
+	if os.IsNotExist(err) {
+		return []*GainReport{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gains := make([]*GainReport, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.gainsDir(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var g GainReport
+		if err := json.Unmarshal(data, &g); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		gains = append(gains, &g)
+	}
+	sort.Slice(gains, func(i, j int) bool { return gains[i].CreatedAt.After(gains[j].CreatedAt) })
+	return gains, nil
+}
+
+// handleGains lists recorded gain reports, newest first, filtered by impl,
+// variant, commit, machine and dataset.
+func handleGains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gains, err := store.Gains()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	values := r.URL.Query()
+	scope := requestScope(r)
+	filtered := gains[:0]
+	for _, g := range gains {
+		labels := map[string]string{"impl": g.Impl, "variant": g.Variant, "commit": g.Commit, "machine": g.Machine, "dataset": g.Dataset, "project": projectOf(g.Project)}
+		keep := inScope(scope, g.Project)
+		for name, value := range labels {
+			if values.Has(name) && values.Get(name) != value {
+				keep = false
+			}
+		}
+		if keep {
+			filtered = append(filtered, g)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
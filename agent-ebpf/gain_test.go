@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestGainPct(t *testing.T) {
+	tests := []struct {
+		baseline, optimized, want float64
+	}{
+		{100, 80, 20},
+		{100, 120, -20},
+		{250, 250, 0},
+		{0, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := gainPct(tt.baseline, tt.optimized); !near(got, tt.want, 1e-12) {
+			t.Errorf("gainPct(%g, %g) = %g, want %g", tt.baseline, tt.optimized, got, tt.want)
+		}
+	}
+}
+
+func TestBootstrapGain(t *testing.T) {
+	tests := []struct {
+		name                string
+		baseline, optimized []float64
+		confidence          float64
+		low, high           float64
+	}{
+		// Without spread every resample has the same medians.
+		{"constant", []float64{100, 100, 100}, []float64{90, 90, 90}, 0.95, 10, 10},
+		{"slower", []float64{50, 50}, []float64{60, 60, 60}, 0.9, -20, -20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			low, high := bootstrapGain(tt.baseline, tt.optimized, tt.confidence)
+			if !near(low, tt.low, 1e-9) || !near(high, tt.high, 1e-9) {
+				t.Errorf("bootstrapGain = [%g, %g], want [%g, %g]", low, high, tt.low, tt.high)
+			}
+		})
+	}
+
+	baseline := []float64{100, 104, 97, 102, 99, 101, 103, 98}
+	optimized := []float64{91, 95, 89, 93, 90, 94, 92, 96}
+	low, high := bootstrapGain(baseline, optimized, 0.95)
+	point := gainPct(median(baseline), median(optimized))
+	if !(low <= point && point <= high) {
+		t.Errorf("interval [%g, %g] does not hold the gain of the medians %g", low, high, point)
+	}
+	if low <= 0 {
+		t.Errorf("interval [%g, %g] reaches no gain for sides that do not overlap in the middle", low, high)
+	}
+	narrowLow, narrowHigh := bootstrapGain(baseline, optimized, 0.5)
+	if narrowLow < low || narrowHigh > high {
+		t.Errorf("50%% interval [%g, %g] is not within the 95%% one [%g, %g]", narrowLow, narrowHigh, low, high)
+	}
+	if againLow, againHigh := bootstrapGain(baseline, optimized, 0.95); againLow != low || againHigh != high {
+		t.Errorf("the same runs gave [%g, %g], then [%g, %g]", low, high, againLow, againHigh)
+	}
+}
+
+func TestNewEffectSize(t *testing.T) {
+	baseline := []float64{100, 102, 98, 101, 99}
+	optimized := []float64{90, 93, 88, 91, 89}
+	e := newEffectSize(baseline, optimized, 0.95)
+	if e.CliffsDelta != 1 || e.Magnitude != "large" {
+		t.Errorf("Cliff's delta = %g (%s), want 1 (large)", e.CliffsDelta, e.Magnitude)
+	}
+	// Means 100 and 90.2, pooled sd sqrt(3.1), corrected by 1 - 3/31.
+	if !near(e.HedgesG, 5.0273783, 1e-6) {
+		t.Errorf("Hedges' g = %.7f, want 5.0273783", e.HedgesG)
+	}
+	if !near(e.MinDetectablePct, 3.1197132674, 1e-8) {
+		t.Errorf("minimum detectable effect = %.10f%%, want 3.1197132674%%", e.MinDetectablePct)
+	}
+	if e.Power != gainPower {
+		t.Errorf("power = %g, want %g", e.Power, gainPower)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"log"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GPUData is the host's GPUs over the window, for variants that offload
+// proving or hashing to them: a faster run that kept the GPU busier, or a
+// slower one whose GPU sat idle, shows here.
+type GPUData struct {
+	Devices []GPUDevice `json:"devices"`
+}
+
+// GPUDevice is one GPU's utilization (the share of time a kernel ran),
+// memory controller utilization, memory and power draw over the window.
+// Figures the driver does not report are left out.
+type GPUDevice struct {
+	Device         string  `json:"device"`
+	Vendor         string  `json:"vendor"`
+	Name           string  `json:"name,omitempty"`
+	Samples        int     `json:"samples"`
+	MeanUtilPct    float64 `json:"mean_util_pct"`
+	PeakUtilPct    float64 `json:"peak_util_pct"`
+	MeanMemBusyPct float64 `json:"mean_mem_busy_pct,omitempty"`
+	MemoryTotalMB  float64 `json:"memory_total_mb,omitempty"`
+	PeakMemoryMB   float64 `json:"peak_memory_used_mb,omitempty"`
+	MeanPowerW     float64 `json:"mean_power_w,omitempty"`
+	PeakPowerW     float64 `json:"peak_power_w,omitempty"`
+}
+
+const gpuInterval = time.Second
+
+// gpuQuery are the fields asked of nvidia-smi, in the order it prints them.
+var gpuQuery = []string{"index", "name", "utilization.gpu", "utilization.memory", "memory.used", "memory.total", "power.draw"}
+
+// gpuSample is one reading of one device; NaN marks what was not reported.
+type gpuSample struct {
+	device, vendor, name                     string
+	util, memBusy, memUsedMB, memTotalMB, pw float64
+}
+
+// gpuTotals accumulates a device's samples.
+type gpuTotals struct {
+	data                        GPUDevice
+	utilSum, memBusySum, powSum float64
+	utilN, memBusyN, powN       int
+}
+
+// gpuMonitor samples NVIDIA GPUs through nvidia-smi, which streams one CSV
+// row per device every interval, and AMD GPUs through the amdgpu driver's
+// sysfs files, which ROCm SMI reads too.
+type gpuMonitor struct {
+	interval time.Duration
+	amd      []string
+	smi      *exec.Cmd
+	smiDone  chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	devices map[string]*gpuTotals
+}
+
+// amdGPUs returns the device directories of the amdgpu cards.
+func amdGPUs() []string {
+	var dirs []string
+	cards, _ := filepath.Glob("/sys/class/drm/card[0-9]*/device")
+	for _, dir := range cards {
+		if _, ok := readUint(filepath.Join(dir, "gpu_busy_percent")); ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func startGPUMonitor(interval time.Duration) *gpuMonitor {
+	m := &gpuMonitor{
+		interval: interval,
+		amd:      amdGPUs(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		devices:  map[string]*gpuTotals{},
+	}
+	if _, err := exec.LookPath("nvidia-smi"); err == nil {
+		m.startSMI()
+	}
+	m.sampleAMD()
+	go m.loop()
+	return m
+}
+
+// startSMI streams the NVIDIA devices' readings.
+func (m *gpuMonitor) startSMI() {
+	cmd := exec.Command("nvidia-smi",
+		"--query-gpu="+strings.Join(gpuQuery, ","), "--format=csv,noheader,nounits",
+		"-lms", strconv.FormatInt(m.interval.Milliseconds(), 10))
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("GPU collector: nvidia-smi: %v", err)
+		return
+	}
+	m.smi, m.smiDone = cmd, make(chan struct{})
+	go func() {
+		defer close(m.smiDone)
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			fields, err := csv.NewReader(strings.NewReader(scanner.Text())).Read()
+			if err != nil || len(fields) != len(gpuQuery) {
+				continue
+			}
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+			// Unsupported fields read "[N/A]" or "[Not Supported]".
+			number := func(s string) float64 {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return math.NaN()
+				}
+				return v
+			}
+			m.add(gpuSample{
+				device: "nvidia" + fields[0], vendor: "nvidia", name: fields[1],
+				util: number(fields[2]), memBusy: number(fields[3]),
+				memUsedMB: number(fields[4]), memTotalMB: number(fields[5]), pw: number(fields[6]),
+			})
+		}
+	}()
+}
+
+func (m *gpuMonitor) loop() {
+	defer close(m.done)
+	if len(m.amd) == 0 {
+		<-m.stop
+		return
+	}
+	ticker := newPacedTicker(m.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.sampleAMD()
+		}
+	}
+}
+
+func (m *gpuMonitor) sampleAMD() {
+	for _, dir := range m.amd {
+		reading := func(name string, scale float64) float64 {
+			if v, ok := readUint(filepath.Join(dir, name)); ok {
+				return float64(v) * scale
+			}
+			return math.NaN()
+		}
+		s := gpuSample{
+			device: filepath.Base(filepath.Dir(dir)), vendor: "amd", name: readTrimmed(filepath.Join(dir, "product_name")),
+			util: reading("gpu_busy_percent", 1), memBusy: reading("mem_busy_percent", 1),
+			memUsedMB: reading("mem_info_vram_used", 1.0/(1<<20)), memTotalMB: reading("mem_info_vram_total", 1.0/(1<<20)),
+			pw: math.NaN(),
+		}
+		// hwmon reports power in microwatts, averaged on older kernels.
+		for _, name := range []string{"power1_average", "power1_input"} {
+			files, _ := filepath.Glob(filepath.Join(dir, "hwmon", "hwmon*", name))
+			if len(files) > 0 {
+				if uw, ok := readUint(files[0]); ok {
+					s.pw = float64(uw) / 1e6
+					break
+				}
+			}
+		}
+		m.add(s)
+	}
+}
+
+func (m *gpuMonitor) add(s gpuSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.devices[s.device]
+	if t == nil {
+		t = &gpuTotals{data: GPUDevice{Device: s.device, Vendor: s.vendor, Name: s.name}}
+		m.devices[s.device] = t
+	}
+	t.data.Samples++
+	if !math.IsNaN(s.util) {
+		t.utilSum += s.util
+		t.utilN++
+		t.data.PeakUtilPct = max(t.data.PeakUtilPct, s.util)
+	}
+	if !math.IsNaN(s.memBusy) {
+		t.memBusySum += s.memBusy
+		t.memBusyN++
+	}
+	if !math.IsNaN(s.memUsedMB) {
+		t.data.PeakMemoryMB = max(t.data.PeakMemoryMB, s.memUsedMB)
+	}
+	if !math.IsNaN(s.memTotalMB) {
+		t.data.MemoryTotalMB = s.memTotalMB
+	}
+	if !math.IsNaN(s.pw) {
+		t.powSum += s.pw
+		t.powN++
+		t.data.PeakPowerW = max(t.data.PeakPowerW, s.pw)
+	}
+}
+
+// Stop returns the devices' summaries, or nil on hosts without a GPU the
+// collector can read.
+func (m *gpuMonitor) Stop() *GPUData {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	if m.smi != nil {
+		m.smi.Process.Kill()
+		<-m.smiDone
+		m.smi.Wait()
+	}
+	m.sampleAMD()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.devices) == 0 {
+		return nil
+	}
+	data := &GPUData{}
+	for _, t := range m.devices {
+		d := t.data
+		if t.utilN > 0 {
+			d.MeanUtilPct = t.utilSum / float64(t.utilN)
+		}
+		if t.memBusyN > 0 {
+			d.MeanMemBusyPct = t.memBusySum / float64(t.memBusyN)
+		}
+		if t.powN > 0 {
+			d.MeanPowerW = t.powSum / float64(t.powN)
+		}
+		data.Devices = append(data.Devices, d)
+	}
+	sort.Slice(data.Devices, func(i, j int) bool { return data.Devices[i].Device < data.Devices[j].Device })
+	return data
+}
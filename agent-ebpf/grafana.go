@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// dashboardVariables are the labels exposed as dashboard template variables;
+// a panel filters on whichever of them its metric carries.
+var dashboardVariables = []string{"scenario", "impl", "variant", "dataset", "machine", "commit", "project"}
+
+func metricUnit(name string) string {
+	switch {
+	case strings.Contains(name, "_microseconds"):
+		return "µs"
+	case strings.Contains(name, "_milliseconds"):
+		return "ms"
+	case strings.Contains(name, "_percent"):
+		return "percent"
+	default:
+		return "short"
+	}
+}
+
+func hasLabel(labels []string, name string) bool {
+	for _, l := range labels {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+func metricPanelQuery(def metricDef) (expr, legend string) {
+	var filters, shown []string
+	for _, v := range dashboardVariables {
+		if hasLabel(def.Labels, v) {
+			filters = append(filters, fmt.Sprintf(`%s=~"$%s"`, v, v))
+		}
+	}
+	for _, l := range def.Labels {
+		if l != "commit" && l != "machine" && l != "dataset" && l != "project" {
+			shown = append(shown, l)
+		}
+	}
+
+	selector := "{" + strings.Join(filters, ",") + "}"
+	group := strings.Join(shown, ", ")
+	legend = strings.Join(wrapLabels(shown), " ")
+
+	switch def.Type {
+	case "histogram":
+		expr = fmt.Sprintf("histogram_quantile(0.95, sum by (le, %s) (rate(%s_bucket%s[5m])))", group, def.Name, selector)
+		legend = "p95 " + legend
+	case "counter":
+		expr = fmt.Sprintf("sum by (%s) (rate(%s%s[5m]))", group, def.Name, selector)
+	default:
+		expr = def.Name + selector
+	}
+	return expr, legend
+}
+
+func wrapLabels(labels []string) []string {
+	out := make([]string, len(labels))
+	for i, l := range labels {
+		out[i] = "{{" + l + "}}"
+	}
+	return out
+}
+
+func generateDashboard() map[string]interface{} {
+	defs := registeredMetrics()
+	panels := make([]map[string]interface{}, 0, len(defs))
+	for i, def := range defs {
+		expr, legend := metricPanelQuery(def)
+		title := def.Help
+		if def.Type == "counter" {
+			title += " (rate)"
+		}
+
+		panels = append(panels, map[string]interface{}{
+			"id":          i + 1,
+			"title":       title,
+			"description": def.Name,
+			"type":        "timeseries",
+			"datasource":  "Prometheus",
+			"gridPos":     map[string]int{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": metricUnit(def.Name)},
+				"overrides": []interface{}{},
+			},
+			"options": map[string]interface{}{
+				"legend": map[string]interface{}{"displayMode": "table", "calcs": []string{"last", "mean"}},
+			},
+			"targets": []map[string]string{
+				{"expr": expr, "legendFormat": legend, "refId": "A"},
+			},
+		})
+	}
+
+	variables := make([]map[string]interface{}, 0, len(dashboardVariables))
+	for _, v := range dashboardVariables {
+		variables = append(variables, map[string]interface{}{
+			"name":       v,
+			"label":      v,
+			"type":       "query",
+			"datasource": "Prometheus",
+			"query":      fmt.Sprintf("label_values(%s)", v),
+			"refresh":    2,
+			"includeAll": true,
+			"multi":      true,
+			"allValue":   ".*",
+			"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+		})
+	}
+
+	return map[string]interface{}{
+		"uid":           "chainbench-agent",
+		"title":         "ChainBench Agent Metrics",
+		"tags":          []string{"chainbench", "ebpf", "generated"},
+		"editable":      true,
+		"graphTooltip":  1,
+		"refresh":       "10s",
+		"schemaVersion": 27,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"timezone":      "browser",
+		"annotations": map[string]interface{}{
+			"list": []map[string]interface{}{
+				{
+					"builtIn":    1,
+					"datasource": "-- Grafana --",
+					"enable":     true,
+					"hide":       true,
+					"iconColor":  "rgba(0, 211, 255, 1)",
+					"name":       "Annotations & Alerts",
+					"type":       "dashboard",
+				},
+				{
+					"datasource": "-- Grafana --",
+					"enable":     true,
+					"iconColor":  "rgba(255, 96, 96, 1)",
+					"name":       "ChainBench runs",
+					"type":       "tags",
+					"tags":       []string{"chainbench"},
+				},
+			},
+		},
+		"templating": map[string]interface{}{"list": variables},
+		"panels":     panels,
+		"version":    1,
+	}
+}
+
+func handleGrafanaDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(generateDashboard())
+}
+
+func newGrafanaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "grafana",
+		Short: "Grafana integration helpers",
+	}
+
+	var output string
+	export := &cobra.Command{
+		Use:   "export",
+		Short: "Print a Grafana dashboard for the metrics this agent emits",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := json.MarshalIndent(generateDashboard(), "", "  ")
+			if err != nil {
+				return err
+			}
+			data = append(data, '\n')
+
+			if output == "" || output == "-" {
+				_, err = cmd.OutOrStdout().Write(data)
+				return err
+			}
+			return os.WriteFile(output, data, 0o644)
+		},
+	}
+	export.Flags().StringVarP(&output, "output", "o", "", "Write the dashboard to a file instead of stdout")
+
+	cmd.AddCommand(export)
+	return cmd
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HandshakeData counts the TLS, Noise and QUIC handshakes the target went
+// through, by the library that ran them. Two variants of a client that
+// differ only in how often they reconnect, or in their crypto library,
+// differ here.
+type HandshakeData struct {
+	Handshakes int              `json:"handshakes"`
+	Stacks     []HandshakeStack `json:"stacks"`
+}
+
+// HandshakeStack is one protocol and library's handshakes. A stack listed
+// with none had its functions traced but never called. Ms is the time
+// spent in the handshake calls, for libraries whose calls can be timed; on
+// non-blocking sockets, where each call only takes the handshake a step
+// further, it is CPU time.
+type HandshakeStack struct {
+	Stack      string  `json:"stack"`
+	Library    string  `json:"library"`
+	Handshakes int     `json:"handshakes"`
+	Ms         float64 `json:"ms,omitempty"`
+	MeanUs     float64 `json:"mean_us,omitempty"`
+}
+
+// handshakeFunc is a function called once per handshake. Timed functions
+// return 1 once the handshake is done, and are safe to put a uretprobe on;
+// a uretprobe on a Go function crashes the program when its goroutine's
+// stack moves. Prefix matches Rust's mangled names, whose hash varies by
+// build.
+type handshakeFunc struct {
+	stack, library string
+	symbol         string
+	prefix         bool
+	timed          bool
+}
+
+var handshakeFuncs = []handshakeFunc{
+	{stack: "tls", library: "openssl", symbol: "SSL_do_handshake", timed: true},
+	{stack: "tls", library: "go", symbol: "crypto/tls.(*Conn).clientHandshake"},
+	{stack: "tls", library: "go", symbol: "crypto/tls.(*Conn).serverHandshake"},
+	{stack: "quic", library: "go", symbol: "crypto/tls.(*QUICConn).Start"},
+	{stack: "noise", library: "go-libp2p", symbol: "github.com/libp2p/go-libp2p/p2p/security/noise.(*secureSession).runHandshake"},
+	{stack: "tls", library: "rustls", symbol: "_ZN6rustls6client2hs15start_handshake17h", prefix: true},
+	{stack: "noise", library: "snow", symbol: "_ZN4snow7builder7Builder15build_initiator17h", prefix: true},
+	{stack: "noise", library: "snow", symbol: "_ZN4snow7builder7Builder15build_responder17h", prefix: true},
+}
+
+// handshakeProbe is a handshake function found in one of the target's
+// files, for a script to put uprobes on. Key is "<stack>/<library>".
+type handshakeProbe struct {
+	Binary  string
+	Address string
+	Key     string
+	Timed   bool
+}
+
+// handshakeProbes finds the handshake functions in the target's
+// executables and the OpenSSL libraries they map, or in the host's OpenSSL
+// without a target. Stripped binaries have none to find.
+func handshakeProbes(pids []int) ([]handshakeProbe, error) {
+	isLibssl := func(base string) bool { return strings.HasPrefix(base, "libssl.so") }
+	var files []string
+	if len(pids) == 0 {
+		files = hostFiles("/lib*/libssl.so.*", "/lib/*/libssl.so.*", "/usr/lib*/libssl.so.*", "/usr/lib/*/libssl.so.*")
+	} else {
+		var exes []string
+		for _, pid := range pids {
+			root := filepath.Join("/proc", strconv.Itoa(pid), "root")
+			if exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe")); err == nil {
+				exes = append(exes, filepath.Join(root, strings.TrimSuffix(exe, " (deleted)")))
+			}
+		}
+		files = append(uniqueFiles(exes), mappedFiles(pids, isLibssl)...)
+	}
+
+	var probes []handshakeProbe
+	for _, path := range files {
+		f, err := elf.Open(path)
+		if err != nil {
+			continue
+		}
+		symbols, _ := f.Symbols()
+		dynamic, _ := f.DynamicSymbols()
+		f.Close()
+		seen := map[uint64]bool{}
+		for _, sym := range append(symbols, dynamic...) {
+			if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 || seen[sym.Value] {
+				continue
+			}
+			for _, fn := range handshakeFuncs {
+				if sym.Name == fn.symbol || fn.prefix && strings.HasPrefix(sym.Name, fn.symbol) {
+					seen[sym.Value] = true
+					probes = append(probes, handshakeProbe{
+						Binary:  path,
+						Address: fmt.Sprintf("0x%x", sym.Value),
+						Key:     fn.stack + "/" + fn.library,
+						Timed:   fn.timed,
+					})
+					break
+				}
+			}
+		}
+	}
+	if len(probes) == 0 {
+		return nil, fmt.Errorf("no TLS, Noise or QUIC handshake functions in the target's binaries or libssl")
+	}
+	return probes, nil
+}
+
+func (c *EvidenceCollector) collectHandshakes(out *bpftraceOutput) *HandshakeData {
+	data := &HandshakeData{Stacks: []HandshakeStack{}}
+	for key := range out.maps["traced"] {
+		stack, library, _ := strings.Cut(key, "/")
+		s := HandshakeStack{
+			Stack:      stack,
+			Library:    library,
+			Handshakes: int(out.maps["handshakes"][key]),
+			Ms:         out.maps["handshake_us"][key] / 1000,
+		}
+		if s.Handshakes > 0 {
+			s.MeanUs = s.Ms * 1000 / float64(s.Handshakes)
+		}
+		data.Handshakes += s.Handshakes
+		data.Stacks = append(data.Stacks, s)
+		handshakesTotal.WithLabelValues(
+			c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project, stack, library,
+		).Add(float64(s.Handshakes))
+	}
+	sort.Slice(data.Stacks, func(i, j int) bool {
+		a, b := data.Stacks[i], data.Stacks[j]
+		if a.Handshakes != b.Handshakes {
+			return a.Handshakes > b.Handshakes
+		}
+		return a.Stack+"/"+a.Library < b.Stack+"/"+b.Library
+	})
+	return data
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Hooks run around a job's workload: pre_run hooks before its session
+// opens, post_iteration hooks inside it after each of the workload's passes
+// (evm-bench makes one per iteration, other types one in all), and post_run
+// hooks once it has closed, whether or not the workload failed. They restore
+// snapshots, rotate logs or scrape the node, and are recorded in the run's
+// hooks evidence. Only post_iteration hooks fall in the measured window: they
+// are left out of the workload time, marked as the session's hook phase and
+// flagged in the evidence, whose kernel-side sections include them. A
+// scenario runs its own hooks, then those of the impl's adapter. Hooks are
+// steps, so they may use library steps, and they share the scenario's
+// timeout; a failing hook fails the run unless it ignores errors.
+const (
+	hookPreRun        = "pre_run"
+	hookPostIteration = "post_iteration"
+	hookPostRun       = "post_run"
+)
+
+// HooksSpec lists the hooks of a scenario or adapter.
+type HooksSpec struct {
+	PreRun        []HookSpec `yaml:"pre_run,omitempty" json:"pre_run,omitempty"`
+	PostIteration []HookSpec `yaml:"post_iteration,omitempty" json:"post_iteration,omitempty"`
+	PostRun       []HookSpec `yaml:"post_run,omitempty" json:"post_run,omitempty"`
+}
+
+// HookSpec is a step run as a hook.
+type HookSpec struct {
+	StepSpec `yaml:",inline"`
+	// Extract turns the hook's output into measurements of the run, as an
+	// adapter's rules do, without overriding the workload's own.
+	Extract map[string]ExtractRule `yaml:"extract,omitempty" json:"extract,omitempty"`
+}
+
+// HookData is one hook run in a run's evidence.
+type HookData struct {
+	Hook       string  `json:"hook"`
+	Name       string  `json:"name"`
+	Iteration  int     `json:"iteration,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (h *HooksSpec) list(hook string) []HookSpec {
+	if h == nil {
+		return nil
+	}
+	switch hook {
+	case hookPreRun:
+		return h.PreRun
+	case hookPostIteration:
+		return h.PostIteration
+	default:
+		return h.PostRun
+	}
+}
+
+func (h *HooksSpec) resolve(library map[string]StepSpec) error {
+	if h == nil {
+		return nil
+	}
+	for _, hooks := range [][]HookSpec{h.PreRun, h.PostIteration, h.PostRun} {
+		for i := range hooks {
+			steps, err := resolveSteps([]StepSpec{hooks[i].StepSpec}, library)
+			if err != nil {
+				return fmt.Errorf("hooks: %w", err)
+			}
+			hooks[i].StepSpec = steps[0]
+		}
+	}
+	return nil
+}
+
+func (h *HooksSpec) validate() error {
+	if h == nil {
+		return nil
+	}
+	for _, hook := range []string{hookPreRun, hookPostIteration, hookPostRun} {
+		hooks := h.list(hook)
+		for i := range hooks {
+			if hooks[i].Name == "" {
+				hooks[i].Name = fmt.Sprintf("%s-%d", hook, i+1)
+			}
+			if err := hooks[i].validate(); err != nil {
+				return fmt.Errorf("%s hook: %w", hook, err)
+			}
+			for name, rule := range hooks[i].Extract {
+				if !measurementName.MatchString(name) {
+					return fmt.Errorf("%s hook %s: extract %q is not a valid measurement name", hook, hooks[i].Name, name)
+				}
+				if _, err := regexp.Compile(rule.Regex); err != nil {
+					return fmt.Errorf("%s hook %s: extract %s: %w", hook, hooks[i].Name, name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hookPhase is the session phase post_iteration hooks are marked as.
+const hookPhase = "hook"
+
+// runHooks runs one kind of hook, recording each in the run's hooks
+// evidence. It returns the time they took.
+func (r *scenarioRun) runHooks(ctx context.Context, hook string, iteration int) (time.Duration, error) {
+	hooks := append(slices.Clip(r.Spec.Hooks.list(hook)), r.Adapter.Hooks.list(hook)...)
+	var total time.Duration
+	for _, h := range hooks {
+		if err := ctx.Err(); err != nil {
+			return total, fmt.Errorf("%s hooks: %w", hook, err)
+		}
+		ex := newExtractor(h.Extract)
+		r.logLine(fmt.Sprintf("--- %s hook %s", hook, h.Name))
+		began := time.Now()
+		err := runStep(ctx, h.StepSpec, r.Vars, func(line string) {
+			ex.line(line)
+			r.logLine(line)
+		})
+		took := time.Since(began)
+		total += took
+
+		data := HookData{Hook: hook, Name: h.Name, Iteration: iteration, DurationMs: float64(took.Microseconds()) / 1000}
+		if err != nil {
+			data.Error = err.Error()
+		}
+		r.hooks = append(r.hooks, data)
+		for name, value := range ex.Values() {
+			if r.hookValues == nil {
+				r.hookValues = map[string]float64{}
+			}
+			r.hookValues[name] = value
+		}
+		if err != nil {
+			if h.IgnoreErrors {
+				r.logLine(fmt.Sprintf("--- %s hook %s failed, ignored: %v", hook, h.Name, err))
+				continue
+			}
+			return total, fmt.Errorf("%s hook %s: %w", hook, h.Name, err)
+		}
+	}
+	return total, nil
+}
+
+// iterationDone runs the post_iteration hooks after a pass of the
+// workload. Scenario types that make several passes call it after each.
+// These hooks run inside the session, so they are marked as its hook
+// phase, except in side-by-side runs, whose sides share one session.
+func (r *scenarioRun) iterationDone(ctx context.Context) error {
+	r.iterations++
+	mark := r.cgroup == nil && len(r.Spec.Hooks.list(hookPostIteration))+len(r.Adapter.Hooks.list(hookPostIteration)) > 0
+	if mark {
+		collector.Mark(r.SessionID, hookPhase)
+	}
+	took, err := r.runHooks(ctx, hookPostIteration, r.iterations)
+	if mark {
+		collector.Mark(r.SessionID, "")
+	}
+	r.iterationHooks += took
+	return err
+}
+
+// runWorkload runs the scenario type's workload and its post_iteration
+// hooks. It returns the workload's measurements, with those the hooks so
+// far extracted added, and how long the workload ran, hooks left out.
+func runWorkload(ctx context.Context, run *scenarioRun) (map[string]float64, float64, error) {
+	began := time.Now()
+	measurements, err := scenarioTypes[run.Spec.Type](ctx, run)
+	if err == nil && run.iterations == 0 {
+		err = run.iterationDone(ctx)
+	}
+	workload := time.Since(began) - run.iterationHooks
+	if run.iterationHooks > 0 {
+		inWindow := float64(run.iterationHooks.Microseconds()) / 1000
+		run.attach(func(e *Evidence) { e.HookWindowMs = inWindow })
+	}
+	run.attach(run.recordHooks)
+	return run.addHookValues(measurements), float64(workload.Microseconds()) / 1000, err
+}
+
+// addHookValues adds what the hooks extracted to measurements, without
+// overriding the workload's own.
+func (r *scenarioRun) addHookValues(measurements map[string]float64) map[string]float64 {
+	for name, value := range r.hookValues {
+		if _, ok := measurements[name]; ok {
+			continue
+		}
+		if measurements == nil {
+			measurements = map[string]float64{}
+		}
+		measurements[name] = value
+	}
+	return measurements
+}
+
+// recordHooks puts the hooks run so far, and what they extracted, in the
+// run's evidence.
+func (r *scenarioRun) recordHooks(e *Evidence) {
+	if len(r.hooks) == 0 {
+		return
+	}
+	e.Hooks = r.hooks
+	e.Measurements = r.addHookValues(e.Measurements)
+}
+
+// amendRun applies section to a stopped session's evidence and to its stored
+// run, for what is only known once the session has closed.
+func amendRun(evidence *Evidence, section func(*Evidence)) {
+	section(evidence)
+	if store == nil || evidence.RunID == "" {
+		return
+	}
+	run, err := store.Get(evidence.RunID)
+	if err != nil {
+		log.Printf("Run %s: amending: %v", evidence.RunID, err)
+		return
+	}
+	section(run.Evidence)
+	if err := store.Save(run); err != nil {
+		log.Printf("Run %s: amending: %v", evidence.RunID, err)
+	}
+}
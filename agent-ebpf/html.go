@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var pieColors = []string{"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f", "#edc948", "#b07aa1", "#9c755f"}
+
+type htmlReport struct {
+	Title     string
+	Generated time.Time
+	Runs      []*Run
+	Diff      *EvidenceDiff
+}
+
+func histogramSVG(hist []HistogramBucket) template.HTML {
+	const width, height, pad = 480, 160, 20
+	if len(hist) == 0 {
+		return ""
+	}
+
+	max := 0
+	for _, bucket := range hist {
+		if bucket.Count > max {
+			max = bucket.Count
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg viewBox="0 0 %d %d" width="%d" height="%d">`, width, height+pad, width, height+pad)
+	barWidth := float64(width) / float64(len(hist))
+	for i, bucket := range hist {
+		h := 0.0
+		if max > 0 {
+			h = float64(bucket.Count) / float64(max) * float64(height-pad)
+		}
+		x := float64(i) * barWidth
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#4e79a7"><title>%dus: %d</title></rect>`,
+			x+2, float64(height)-h, barWidth-4, h, bucket.BucketUs, bucket.Count)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" font-size="10" text-anchor="middle">%d</text>`,
+			x+barWidth/2, height+14, bucket.BucketUs)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func offcpuPieSVG(reasons []ReasonData) template.HTML {
+	const r = 80.0
+	total := 0.0
+	for _, reason := range reasons {
+		total += reason.Ms
+	}
+	if total == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg viewBox="-100 -100 400 200" width="400" height="200">`)
+	angle := -math.Pi / 2
+	for i, reason := range reasons {
+		color := pieColors[i%len(pieColors)]
+		share := reason.Ms / total
+		if share >= 0.9999 {
+			fmt.Fprintf(&b, `<circle r="%.0f" fill="%s"/>`, r, color)
+		} else {
+			end := angle + share*2*math.Pi
+			large := 0
+			if share > 0.5 {
+				large = 1
+			}
+			fmt.Fprintf(&b, `<path d="M0,0 L%.2f,%.2f A%.0f,%.0f 0 %d 1 %.2f,%.2f Z" fill="%s"><title>%s: %.1f ms</title></path>`,
+				r*math.Cos(angle), r*math.Sin(angle), r, r, large, r*math.Cos(end), r*math.Sin(end), color,
+				template.HTMLEscapeString(reason.Reason), reason.Ms)
+			angle = end
+		}
+		fmt.Fprintf(&b, `<rect x="110" y="%d" width="10" height="10" fill="%s"/><text x="126" y="%d" font-size="11">%s (%.0f%%)</text>`,
+			-80+i*18, color, -71+i*18, template.HTMLEscapeString(reason.Reason), share*100)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"histogram": histogramSVG,
+	"pie":       offcpuPieSVG,
+	"tags":      formatTags,
+	"delta": func(d *float64) string {
+		if d == nil {
+			return "new"
+		}
+		return fmt.Sprintf("%+.1f%%", *d)
+	},
+	"ioSize":  ioSize,
+	"mib":     func(b uint64) string { return fmt.Sprintf("%.0f MiB", float64(b)/(1<<20)) },
+	"ms":      func(us uint64) float64 { return float64(us) / 1000 },
+	"mgas":    func(gas float64) float64 { return gas / 1e6 },
+	"percent": func(share float64) float64 { return share * 100 },
+	"join":    strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2rem; color: #222; }
+h1 { font-size: 1.5rem; } h2 { font-size: 1.2rem; margin-top: 2rem; } h3 { font-size: 1rem; }
+table { border-collapse: collapse; margin: .5rem 0; }
+th, td { border: 1px solid #ddd; padding: .25rem .6rem; text-align: left; font-size: .9rem; }
+th { background: #f4f4f4; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr.significant td { background: #fff4e5; font-weight: 600; }
+.runs { display: flex; gap: 2rem; flex-wrap: wrap; }
+.run { flex: 1; min-width: 480px; }
+.muted { color: #777; font-size: .85rem; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="muted">Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}} by chainbench-agent</p>
+{{with .Diff}}
+<h2>Comparison</h2>
+<table>
+<tr><th>Metric</th><th>A</th><th>B</th><th>Delta</th></tr>
+{{range .Entries}}<tr{{if .Significant}} class="significant"{{end}}><td>{{.Metric}}</td><td class="num">{{printf "%.2f" .A}}</td><td class="num">{{printf "%.2f" .B}}</td><td class="num">{{delta .DeltaPct}}</td></tr>
+{{end}}</table>
+<p class="muted">Highlighted rows changed by at least {{printf "%.1f" .ThresholdPct}}%.</p>
+<p>Verdict: <strong>{{.Verdict}}</strong> ({{.Reason}})</p>
+{{with .TuningDifferences}}
+<h3>Kernel tuning or hardware differs</h3>
+<p><strong>The runs executed under different kernel tuning or hardware; deltas may reflect the host rather than the change.</strong></p>
+<table>
+<tr><th>Setting</th><th>A</th><th>B</th></tr>
+{{range .}}<tr class="significant"><td>{{.Setting}}</td><td>{{.A}}</td><td>{{.B}}</td></tr>
+{{end}}</table>
+{{end}}
+{{end}}
+<div class="runs">
+{{range .Runs}}<div class="run">
+<h2>Run {{if .ID}}{{.ID}}{{else}}(unstored){{end}}</h2>
+<table>
+<tr><th>Scenario</th><td>{{.Scenario}}</td></tr>
+<tr><th>Impl / variant</th><td>{{.Impl}} / {{.Variant}}</td></tr>
+<tr><th>Commit</th><td>{{.Commit}}</td></tr>
+<tr><th>Dataset</th><td>{{.Dataset}}</td></tr>
+<tr><th>Machine</th><td>{{.Machine}}</td></tr>
+{{with .Params}}<tr><th>Params</th><td>{{tags .}}</td></tr>{{end}}
+{{with .Tags}}<tr><th>Tags</th><td>{{tags .}}</td></tr>{{end}}
+{{if not .CreatedAt.IsZero}}<tr><th>Recorded</th><td>{{.CreatedAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>{{end}}
+{{with .Evidence}}{{if and .StartedAt .StoppedAt}}<tr><th>Window</th><td>{{.StartedAt.Format "15:04:05.000"}} to {{.StoppedAt.Format "15:04:05.000 MST"}}, {{printf "%.0f" .DurationMs}} ms{{if .WorkloadMs}}, workload {{printf "%.0f" .WorkloadMs}} ms{{end}}{{with .HookWindowMs}}, hooks in window {{printf "%.0f" .}} ms{{end}}</td></tr>{{end}}{{end}}
+{{with .Evidence}}{{with .Target}}<tr><th>Target</th><td>{{.Selector}}: {{range .Processes}}{{.Comm}}[{{.PID}}] {{end}}</td></tr>
+{{with .Container}}<tr><th>Container</th><td>{{.String}}</td></tr>{{end}}
+{{range .Pods}}<tr><th>Pod</th><td>{{.String}}</td></tr>{{end}}{{end}}
+{{with .Noise}}<tr><th>Host noise</th><td>{{if .Virtualized}}virtualized ({{.Hypervisor}}){{else}}bare metal{{end}}, cpu steal {{printf "%.1f" .StealPct}}% (peak {{printf "%.1f" .PeakStealPct}}%){{if .Noisy}} <strong>cloud-noisy: {{range .Reasons}}{{.}}; {{end}}</strong>{{end}}</td></tr>{{end}}
+{{with .Anomalies}}<tr><th>Anomalies</th><td><strong>out of line with {{.History}} earlier runs:</strong>{{range .Metrics}}<br>{{.Metric}} {{printf "%g" .Value}}, median {{printf "%g" .Median}} (score {{printf "%+.1f" .Score}}){{end}}</td></tr>{{end}}
+{{with .Pressure}}<tr><th>Pressure</th><td>{{range $i, $r := .Resources}}{{if $i}}, {{end}}{{$r.Resource}} {{printf "%.1f" $r.SomePct}}% some / {{printf "%.1f" $r.FullPct}}% full (peak avg10 {{printf "%.1f" $r.PeakSomeAvg10}}%){{end}}{{if .Oversubscribed}} <strong>oversubscribed: {{join .Reasons "; "}}</strong>{{end}}</td></tr>{{end}}
+{{with .Swap}}{{if .Swapped}}<tr><th>Swap</th><td><strong>{{if .Invalid}}run invalid: {{else if not .TargetSwapped}}host {{end}}swapped during the run</strong>: {{.SwapInPages}} pages in, {{.SwapOutPages}} out (zswap {{.ZswapInPages}} in, {{.ZswapOutPages}} out); target {{.TargetSwapInPages}} in, {{.TargetSwapOutPages}} out, {{mib .TargetSwapPeakBytes}} swapped at peak</td></tr>{{end}}{{end}}
+{{with .Clock}}<tr><th>Clock</th><td>{{.Clocksource}}, {{if .Synchronized}}synchronized{{else}}unsynchronized{{end}}{{with .SyncDaemon}} ({{.}}){{end}}, offset {{printf "%.3f" .MaxOffsetMs}} ms max, drift {{printf "%.1f" .DriftPPM}} ppm{{if .Invalid}} <strong>run invalid: the clock stepped mid-run</strong>{{end}}{{range .Warnings}}<br>{{.}}{{end}}</td></tr>{{end}}
+{{with .EBPF}}<tr><th>eBPF</th><td>kernel {{.Kernel.Release}} ({{.Kernel.Arch}}){{range .Collectors}}<br>{{.Collector}}: {{if .Variant}}{{.Variant}}{{with .Script}} ({{.Name}}{{with .Version}} v{{.}}{{end}}{{if ne .Source "embedded"}} from {{.Source}}{{end}}){{end}}{{with .Pipeline}}{{if .Dropped}}, dropped {{.Dropped}} events ({{printf "%.2f" .DropPct}}%){{end}}{{end}}{{else if .Fallback}}{{.Fallback}} fallback, degraded ({{.Reason}}){{else}}unavailable ({{.Reason}}){{end}}{{end}}</td></tr>{{end}}
+{{with .Overhead}}<tr><th>Collection overhead</th><td>{{printf "%.1f" .MeanCPUPct}}% cpu mean, {{printf "%.1f" .PeakCPUPct}}% peak (budget {{printf "%.1f" .BudgetPct}}%){{range .Degraded}}<br>degraded at {{printf "%.0f" .OffsetMs}} ms: {{.Action}}{{end}}</td></tr>{{end}}
+{{with .SideBySide}}{{range .Runs}}<tr><th>Side by side</th><td>{{.Impl}}: run {{.RunID}} on cpus {{.Partition.CPUs}}</td></tr>{{end}}
+<tr><th>Host-wide run</th><td>{{.Combined}}</td></tr>{{end}}
+{{with .KubernetesJob}}<tr><th>Kubernetes job</th><td>{{.Namespace}}/{{.Job}}: pod {{.Pod}} on {{.Node}}, {{.Phase}} (exit {{.ExitCode}}) in {{printf "%.0f" .DurationMs}} ms</td></tr>{{end}}
+{{with .Network}}<tr><th>Network shaping</th><td>{{.String}}</td></tr>{{end}}
+{{range .BlockQueue}}<tr><th>Block queue</th><td>{{.String}}</td></tr>{{end}}
+{{if .Scheduling}}<tr><th>Scheduling</th><td>{{.Scheduling.String}}{{with .SchedulingMismatches}} <strong>{{.}} target threads ran otherwise</strong>{{end}}</td></tr>{{end}}
+{{with .Failure}}<tr><th>Failure</th><td><strong>{{.String}}</strong>: {{.Message}}</td></tr>{{end}}
+{{with .Attempt}}<tr><th>Attempt</th><td>{{.Attempt}} of {{.MaxAttempts}}{{range .Previous}}<br>attempt {{.Attempt}}: {{.Result}}{{with .RunID}}, run {{.}}{{end}}{{end}}</td></tr>{{end}}
+{{with .Readiness}}<tr><th>Readiness</th><td>ready after {{printf "%.0f" .WaitMs}} ms, {{.Attempts}} attempts ({{join .Probes ", "}})</td></tr>{{end}}
+{{range .Hooks}}<tr><th>Hook {{.Hook}}</th><td>{{.Name}}{{if .Iteration}} (iteration {{.Iteration}}){{end}}: {{printf "%.0f" .DurationMs}} ms{{with .Error}}, failed: {{.}}{{end}}</td></tr>{{end}}
+{{with .Build}}<tr><th>Build</th><td>{{.Impl}} in {{printf "%.0f" .DurationMs}} ms at {{.BuiltAt.Format "2006-01-02 15:04:05 MST"}}, key {{.CacheKey}}{{if .Cached}} (cached){{end}}{{with .Log}}, log in artifact {{.}}{{end}}</td></tr>{{end}}
+{{range .Images}}<tr><th>Image</th><td>{{.Ref}} ({{.ImageID}}){{if .Cached}} cached{{end}}</td></tr>{{end}}{{end}}
+</table>
+{{with .Environment}}
+<h3>Environment fingerprint</h3>
+<table>
+<tr><th>Host</th><td>{{.Hostname}}</td></tr>
+<tr><th>OS / arch</th><td>{{.OS}} / {{.Arch}}</td></tr>
+<tr><th>Kernel</th><td>{{.Kernel}}</td></tr>
+<tr><th>CPU</th><td>{{.CPUModel}} ({{.CPUCount}} cores)</td></tr>
+{{if .MemoryBytes}}<tr><th>Memory</th><td>{{mib .MemoryBytes}}</td></tr>{{end}}
+{{with index .KernelTuning "boot.cmdline"}}<tr><th>Boot params</th><td>{{.}}</td></tr>{{end}}
+{{with .KernelTuning}}<tr><th>Kernel tuning</th><td>{{len .}} settings recorded</td></tr>{{end}}
+{{with .Filesystem}}<tr><th>Filesystem</th><td>{{.Path}} on {{.MountPoint}}: {{.Type}} ({{join .Options ","}}){{if .Discard}}, online discard{{end}}{{with .Compression}}, compressed with {{.}}{{end}}</td></tr>{{end}}
+{{range .Disks}}<tr><th>Disk {{.Device}}</th><td>{{.String}}</td></tr>{{end}}
+</table>
+{{end}}
+{{with .Evidence}}{{with .Phases}}<h3>Phases</h3>
+<table><tr><th>Phase</th><th>Start</th><th>Duration</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td class="num">+{{printf "%.0f" .StartOffsetMs}} ms</td><td class="num">{{printf "%.1f" .DurationMs}} ms</td></tr>{{end}}
+</table>{{end}}
+{{with .Measurements}}<h3>Workload measurements</h3>
+<table><tr><th>Name</th><th>Value</th></tr>
+{{range $name, $value := .}}<tr><td>{{$name}}</td><td class="num">{{printf "%.2f" $value}}</td></tr>{{end}}
+</table>{{end}}
+{{with .RPC}}<h3>JSON-RPC load ({{.Requests}} requests, {{printf "%.1f" .RequestsPerSec}} req/s)</h3>
+<table><tr><th>Method</th><th>Requests</th><th>Error rate</th><th>p50</th><th>p95</th><th>p99</th></tr>
+{{range .Methods}}<tr><td>{{.Method}}</td><td class="num">{{.Requests}}</td><td class="num">{{printf "%.2f" .ErrorRate}}</td><td class="num">{{printf "%.0f" .P50Us}}us</td><td class="num">{{printf "%.0f" .P95Us}}us</td><td class="num">{{printf "%.0f" .P99Us}}us</td></tr>{{end}}
+</table>{{end}}
+{{with .Sync}}<h3>Sync ({{if .Completed}}completed{{else}}incomplete{{end}}, blocks {{.StartBlock}} → {{.EndBlock}}, {{printf "%.1f" .BlocksPerSec}} blocks/s)</h3>
+{{if .Stalls}}<p>{{len .Stalls}} stalls totalling {{printf "%.0f" .StallMs}} ms; iowait {{printf "%.1f" .IOWaitStalledPct}}% while stalled vs {{printf "%.1f" .IOWaitProgressingPct}}% while progressing.</p>
+<table><tr><th>Stalled at</th><th>Duration</th><th>Block</th><th>iowait</th></tr>
+{{range .Stalls}}<tr><td>{{.Start.Format "15:04:05"}}</td><td class="num">{{printf "%.0f" .DurationMs}} ms</td><td class="num">{{.Block}}</td><td class="num">{{printf "%.1f" .IOWaitPct}}%</td></tr>{{end}}
+</table>{{end}}{{end}}
+{{with .EVM}}<h3>EVM execution ({{printf "%.1f" (mgas .GasPerSec)}} Mgas/s)</h3>
+<table><tr><th>Category</th><th>Fixtures</th><th>Mgas/s</th></tr>
+{{range .Categories}}<tr><td>{{.Category}}</td><td class="num">{{.Fixtures}}</td><td class="num">{{printf "%.1f" (mgas .GasPerSec)}}</td></tr>{{end}}
+</table>{{end}}
+{{with .Propagation}}<h3>Transaction propagation ({{.Transactions}} sent, {{.Rejected}} rejected)</h3>
+<table><tr><th>Peer</th><th>Seen</th><th>Included</th><th>Arrival p50</th><th>Arrival p95</th><th>Arrival p99</th><th>Inclusion p95</th></tr>
+{{range .Peers}}<tr><td>{{.Peer}}</td><td class="num">{{.Seen}}</td><td class="num">{{.Included}}</td><td class="num">{{printf "%.1f" .ArrivalP50Ms}} ms</td><td class="num">{{printf "%.1f" .ArrivalP95Ms}} ms</td><td class="num">{{printf "%.1f" .ArrivalP99Ms}} ms</td><td class="num">{{printf "%.0f" .InclusionP95Ms}} ms</td></tr>{{end}}
+</table>{{end}}
+{{with .Beacon}}<h3>Beacon node ({{.Slots}} slots, {{.MissedSlots}} missed)</h3>
+<table><tr><th>Into slot</th><th>p50</th><th>p95</th></tr>
+<tr><td>Block received</td><td class="num">{{printf "%.0f" .BlockP50Ms}} ms</td><td class="num">{{printf "%.0f" .BlockP95Ms}} ms</td></tr>
+<tr><td>Head updated</td><td class="num">{{printf "%.0f" .HeadP50Ms}} ms</td><td class="num">{{printf "%.0f" .HeadP95Ms}} ms</td></tr>
+</table>{{end}}
+{{with .Compaction}}<h3>Background compaction</h3>
+<table><tr><th>Threads</th><th>CPU</th><th>Peak</th><th>Active</th><th>Read</th><th>Written</th><th>Stalls</th></tr>
+<tr><td class="num">{{.Threads}}</td><td class="num">{{printf "%.0f" .CPUMs}} ms</td><td class="num">{{printf "%.0f" .PeakCPUPct}}%</td><td class="num">{{printf "%.0f" (percent .ActiveShare)}}%</td><td class="num">{{mib .ReadBytes}}</td><td class="num">{{mib .WriteBytes}}</td><td class="num">{{.Stalls}}</td></tr>
+</table>{{range .StallSamples}}<p class="muted">{{.}}</p>{{end}}{{end}}
+{{with .PMU}}<h3>PMU counters ({{.Arch}} {{.CPU}})</h3>
+<table><tr><th>Event</th><th>Count</th></tr>
+{{range .Counters}}<tr><td>{{.Event}}</td><td class="num">{{.Value}}{{if .Scaled}} (scaled){{end}}</td></tr>{{end}}
+</table><p>IPC {{printf "%.2f" .IPC}}, frontend stalls {{printf "%.1f" .FrontendStallPct}}%, backend stalls {{printf "%.1f" .BackendStallPct}}%{{with .Unsupported}}; not counted by this PMU: {{join . ", "}}{{end}}</p>{{end}}
+{{with .Thermal}}<h3>CPU frequency and temperature</h3>
+<table><tr><th>Mean freq</th><th>Min</th><th>Max</th><th>Start temp</th><th>Mean temp</th><th>Peak temp</th><th>Throttling events</th></tr>
+<tr><td class="num">{{printf "%.0f" .MeanFreqMHz}} MHz</td><td class="num">{{printf "%.0f" .MinFreqMHz}} MHz</td><td class="num">{{printf "%.0f" .MaxFreqMHz}} MHz</td><td class="num">{{printf "%.0f" .StartTempC}}°C</td><td class="num">{{printf "%.0f" .MeanTempC}}°C</td><td class="num">{{printf "%.0f" .PeakTempC}}°C</td><td class="num">{{.ThrottleEvents}}</td></tr>
+</table>{{with .Residency}}
+<table><tr><th>Of max frequency</th><th>Residency</th></tr>
+{{range .}}<tr><td>{{.Band}}</td><td class="num">{{printf "%.1f" (percent .Share)}}%</td></tr>{{end}}
+</table>{{end}}{{end}}
+{{with .GPU}}<h3>GPUs</h3>
+<table><tr><th>Device</th><th>Name</th><th>Busy</th><th>Peak busy</th><th>Memory busy</th><th>Peak memory</th><th>Mean power</th><th>Peak power</th></tr>
+{{range .Devices}}<tr><td>{{.Device}}</td><td>{{.Name}}</td><td class="num">{{printf "%.0f" .MeanUtilPct}}%</td><td class="num">{{printf "%.0f" .PeakUtilPct}}%</td><td class="num">{{printf "%.0f" .MeanMemBusyPct}}%</td><td class="num">{{if .MemoryTotalMB}}{{printf "%.0f" .PeakMemoryMB}} / {{printf "%.0f" .MemoryTotalMB}} MB{{else}}-{{end}}</td><td class="num">{{if .PeakPowerW}}{{printf "%.0f" .MeanPowerW}} W{{else}}-{{end}}</td><td class="num">{{if .PeakPowerW}}{{printf "%.0f" .PeakPowerW}} W{{else}}-{{end}}</td></tr>{{end}}
+</table>{{end}}
+{{with .Cgroups}}<h3>cgroup accounting</h3>
+<table><tr><th>cgroup</th><th>CPU</th><th>Throttled</th><th>Memory</th><th>memory.high events</th><th>OOM kills</th><th>Memory stalls (some / full)</th><th>Read</th><th>Written</th></tr>
+{{range .}}<tr><td>{{.Path}}</td><td class="num">{{printf "%.0f" .CPUMs}} ms</td><td class="num">{{printf "%.0f" .ThrottledMs}} ms ({{.ThrottledPeriods}}/{{.Periods}})</td><td class="num">{{mib .MemoryBytes}}</td><td class="num">{{.MemoryHighEvents}}</td><td class="num">{{.OOMKills}}</td><td class="num">{{printf "%.0f" (ms .MemorySomeStallUs)}} / {{printf "%.0f" (ms .MemoryFullStallUs)}} ms</td><td class="num">{{mib .IOReadBytes}}</td><td class="num">{{mib .IOWriteBytes}}</td></tr>{{end}}
+</table>{{end}}
+{{with .Threads}}<h3>Threads by role ({{.Threads}} threads)</h3>
+<table><tr><th>Role</th><th>Threads</th><th>CPU</th><th>Off-CPU</th><th>Run queue</th><th>Mean wait</th></tr>
+{{range .Roles}}<tr><td>{{.Role}}</td><td class="num">{{.Threads}}</td><td class="num">{{printf "%.0f" .CPUMs}} ms</td><td class="num">{{printf "%.0f" .OffCPUMs}} ms</td><td class="num">{{printf "%.0f" .RunqMs}} ms</td><td class="num">{{printf "%.1f" .RunqMeanUs}}us</td></tr>{{end}}
+</table>{{with .Omitted}}<p class="muted">{{.}} more roles</p>{{end}}
+{{with .Scheduling}}<p>Scheduling:{{range $i, $s := .}}{{if $i}},{{end}} {{$s.Threads}} {{$s.Policy}} nice {{$s.Nice}}{{end}}</p>{{end}}{{end}}
+{{with .Sockets}}<h3>Socket drops</h3>
+<p>{{if .Dropped}}<strong>{{end}}listen overflows {{.ListenOverflows}}, listen drops {{.ListenDrops}}, tcp receive-buffer drops: backlog {{.TCPBacklogDrops}}, queue {{.TCPRcvQDrops}}, pruned {{.TCPPruned}}, out-of-order {{.TCPOFODrops}}; udp buffer errors {{.UDPRcvbufErrors}} receive / {{.UDPSndbufErrors}} send, udp input errors {{.UDPInErrors}}{{if .Dropped}}</strong>{{end}}</p>
+{{with .Ports}}<table><tr><th>Port</th><th>Sockets</th><th>Peak accept queue</th><th>Peak receive queue</th><th>Peak send queue</th><th>Drops</th></tr>
+{{range .}}<tr><td>{{.Proto}}/{{.Port}}</td><td class="num">{{.Sockets}}</td><td class="num">{{if eq .Proto "tcp"}}{{.PeakAccept}}{{else}}-{{end}}</td><td class="num">{{.PeakRecvBytes}} B</td><td class="num">{{.PeakSendBytes}} B</td><td class="num">{{if eq .Proto "udp"}}{{.Drops}}{{else}}-{{end}}</td></tr>{{end}}
+</table>{{end}}{{end}}
+{{if or .Files .FDErrors}}<h3>Open files</h3>{{end}}
+{{with .Files}}<p>fds {{.StartFDs}} → {{.EndFDs}}, peak {{.PeakFDs}}{{if .Limit}} (limit {{.Limit}}, {{printf "%.1f" .PeakLimitPct}}% at most){{end}}</p>
+<p>dentries {{.DentriesStart}} → {{.DentriesEnd}} ({{.DentriesReclaimed}} reclaimed), inodes {{.InodesStart}} → {{.InodesEnd}} ({{.InodesReclaimed}} reclaimed), {{.InodeStealPages}} pages freed with inodes, {{.SlabsScanned}} slab objects scanned</p>{{end}}
+{{with .FDErrors}}<p>{{if or .TooManyOpen .FileTableFull}}<strong>{{end}}too many open files: {{.TooManyOpen}} EMFILE (process limit), {{.FileTableFull}} ENFILE (host limit){{if or .TooManyOpen .FileTableFull}}</strong>{{end}}</p>{{end}}
+{{if not .Available}}<p><strong>eBPF evidence was not available for this run.</strong></p>{{end}}
+{{with .Runqlat}}{{if .Histogram}}<h3>Run queue latency (p95 {{printf "%.0f" .P95Us}}us)</h3>{{histogram .Histogram}}{{else}}<h3>Run queue latency (mean {{printf "%.1f" .MeanUs}}us, fallback)</h3>{{end}}{{end}}
+{{with .Biolatency}}{{if .Histogram}}<h3>Block I/O latency (p95 {{printf "%.0f" .P95Us}}us)</h3>{{histogram .Histogram}}
+{{if .SizeHistogram}}<h3>Block I/O sizes (median {{ioSize .MedianBytes}}, {{printf "%.0f" .SequentialPct}}% sequential)</h3>
+<table><tr><th>Size</th><th>Requests</th></tr>
+{{range .SizeHistogram}}<tr><td>{{ioSize .Bytes}}</td><td class="num">{{.Count}}</td></tr>{{end}}
+</table>{{end}}{{else}}<h3>Block I/O latency (mean {{printf "%.1f" .MeanUs}}us, fallback)</h3>{{end}}{{end}}
+{{with .Offcpu}}<h3>Off-CPU time ({{printf "%.1f" .TotalMs}} ms)</h3>{{pie .TopReasons}}{{end}}
+{{with .Exec}}<h3>Process execs ({{.ExecCount}})</h3>
+<table><tr><th>Command</th><th>Count</th></tr>
+{{range .TopCommands}}<tr><td>{{.Command}}</td><td class="num">{{.Count}}</td></tr>{{end}}
+</table>{{end}}
+{{with .SyscallCounts}}<h3>Syscalls</h3>
+<table><tr><th>Syscall</th><th>Count</th></tr>
+<tr><td>futex</td><td class="num">{{.Futex}}</td></tr>
+<tr><td>fsync</td><td class="num">{{.Fsync}}</td></tr>
+<tr><td>openat</td><td class="num">{{.Openat}}</td></tr>
+<tr><td>read</td><td class="num">{{.Read}}</td></tr>
+<tr><td>write</td><td class="num">{{.Write}}</td></tr>
+</table>{{end}}
+{{with .Connect}}<h3>TCP connect latency (p95 {{printf "%.0f" .P95Us}}us, {{.Connects}} established, {{.Failed}} failed)</h3>{{histogram .Histogram}}
+{{if .Lookups}}<h3>getaddrinfo latency (p95 {{printf "%.0f" .DNSP95Us}}us, {{.Lookups}} lookups, {{.LookupsFailed}} failed)</h3>{{histogram .DNSHistogram}}{{else}}<p class="muted">No getaddrinfo lookups</p>{{end}}{{end}}
+{{with .Readahead}}<h3>Readahead ({{printf "%.1f" .EfficiencyPct}}% efficiency)</h3>
+<p>{{.Pages}} pages read ahead, {{.UsedPages}} used, {{.UnusedPages}} unused</p>{{end}}
+{{with .Writeback}}<h3>Writeback (target throttled {{printf "%.0f" .ThrottledMs}} ms in {{.Throttles}} pauses)</h3>
+<table><tr><th>Device</th><th>Passes</th><th>Written</th><th>p95</th></tr>
+{{range .Devices}}<tr><td>{{.Device}}</td><td class="num">{{.Passes}}</td><td class="num">{{mib .WrittenBytes}}</td><td class="num">{{printf "%.0f" .P95Us}}us</td></tr>{{end}}
+</table>{{if .Reasons}}<p class="muted">Passes by reason:{{range $reason, $n := .Reasons}} {{$reason}} {{$n}}{{end}}</p>{{end}}{{end}}
+{{with .Handshakes}}<h3>Handshakes ({{.Handshakes}})</h3>
+<table><tr><th>Stack</th><th>Library</th><th>Handshakes</th><th>Time</th><th>Mean</th></tr>
+{{range .Stacks}}<tr><td>{{.Stack}}</td><td>{{.Library}}</td><td class="num">{{.Handshakes}}</td><td class="num">{{if .Ms}}{{printf "%.1f" .Ms}} ms{{else}}-{{end}}</td><td class="num">{{if .Ms}}{{printf "%.0f" .MeanUs}}us{{else}}-{{end}}</td></tr>{{end}}
+</table>{{end}}
+{{end}}
+</div>
+{{end}}</div>
+</body>
+</html>
+`))
+
+func writeHTMLReport(w io.Writer, runs ...*Run) error {
+	report := htmlReport{Generated: time.Now().UTC(), Runs: runs}
+
+	switch len(runs) {
+	case 1:
+		report.Title = "ChainBench run " + runs[0].ID
+	case 2:
+		report.Title = fmt.Sprintf("ChainBench comparison %s vs %s", runs[0].ID, runs[1].ID)
+		report.Diff = compareRuns(runs[0], runs[1], 10)
+	default:
+		return fmt.Errorf("html report needs one or two runs, got %d", len(runs))
+	}
+
+	return htmlReportTemplate.Execute(w, report)
+}
+
+func newHTMLCmd(dataDir *string) *cobra.Command {
+	var outputDir string
+
+	cmd := &cobra.Command{
+		Use:   "html <run-id|file> [<run-id|file>]",
+		Short: "Write a standalone HTML report for a run or a comparison of two runs",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			runs := make([]*Run, 0, len(args))
+			names := make([]string, 0, len(args))
+			for _, arg := range args {
+				run, err := loadRunArg(arg, *dataDir)
+				if err != nil {
+					return err
+				}
+				runs = append(runs, run)
+
+				name := run.ID
+				if name == "" {
+					name = strings.TrimSuffix(filepath.Base(arg), filepath.Ext(arg))
+				}
+				names = append(names, name)
+			}
+
+			if err := os.MkdirAll(outputDir, 0o755); err != nil {
+				return err
+			}
+			path := filepath.Join(outputDir, strings.Join(names, "-vs-")+".html")
+
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if err := writeHTMLReport(f, runs...); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), path)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputDir, "output-dir", "o", ".", "Directory to write the HTML report to")
+
+	return cmd
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Orchestrators retry control requests on network errors, which could start
+// a session or submit a job twice. A request carrying an Idempotency-Key
+// header is answered once; repeats of it within the window get the original
+// response back, marked with Idempotent-Replayed.
+
+// idempotencyWindow is how long a key's response is kept.
+var idempotencyWindow = 24 * time.Hour
+
+const (
+	maxIdempotencyKeys   = 10000
+	maxIdempotencyKeyLen = 255
+	// maxIdempotentBody caps the body read to bind a key to it.
+	maxIdempotentBody = 16 << 20
+)
+
+type idempotentResponse struct {
+	// done is closed once the first request has been answered; the fields
+	// below are set by then.
+	done    chan struct{}
+	digest  [sha256.Size]byte
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+var idempotency = &idempotencyCache{entries: map[string]*idempotentResponse{}}
+
+// claim returns the entry for key, and whether the caller is the first to
+// ask and must fill it in.
+func (c *idempotencyCache) claim(key string, digest [sha256.Size]byte) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if entry, ok := c.entries[key]; ok {
+		select {
+		case <-entry.done:
+			if now.Before(entry.expires) {
+				return entry, false
+			}
+		default:
+			return entry, false
+		}
+	}
+	if len(c.entries) >= maxIdempotencyKeys {
+		c.sweep(now)
+	}
+	entry := &idempotentResponse{done: make(chan struct{}), digest: digest}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// sweep drops expired entries, and the oldest ones if that is not enough.
+// The caller holds mu.
+func (c *idempotencyCache) sweep(now time.Time) {
+	var oldest string
+	for key, entry := range c.entries {
+		select {
+		case <-entry.done:
+		default:
+			continue
+		}
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		} else if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(c.entries) >= maxIdempotencyKeys && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// forget drops the entry, so the request can be retried.
+func (c *idempotencyCache) forget(key string, entry *idempotentResponse) {
+	c.mu.Lock()
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+}
+
+// idempotent answers h's requests once per Idempotency-Key. Keys are the
+// caller's own, and bound to the request body: reusing one with another
+// body is refused. Responses of 5xx are not kept, nor is anything when h
+// panics, so a failed request can be retried.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key longer than "+strconv.Itoa(maxIdempotencyKeyLen)+" bytes", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body over "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		digest := sha256.Sum256(body)
+		// Two callers choosing the same key do not see each other's
+		// responses.
+		c := requestCaller(r)
+		key = strconv.Quote(c.name) + " " + strconv.Quote(c.scope) + " " + r.Method + " " + r.URL.Path + " " + key
+
+		for {
+			entry, first := idempotency.claim(key, digest)
+			if first {
+				// Until h returns the entry reads as failed, so if it
+				// panics the key is forgotten and its waiters retry.
+				entry.status = http.StatusInternalServerError
+				defer func() {
+					if entry.status >= 500 {
+						idempotency.forget(key, entry)
+					}
+					entry.expires = time.Now().Add(idempotencyWindow)
+					close(entry.done)
+				}()
+				rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+				h(rec, r)
+				entry.status, entry.header, entry.body = rec.status, w.Header().Clone(), rec.body.Bytes()
+				return
+			}
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.status >= 500 {
+				// The first attempt failed; this one runs afresh.
+				continue
+			}
+			if entry.digest != digest {
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the response it passes on.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status, rw.wroteHeader = status, true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// resetIdempotency empties the cache, so tests do not see each other's keys.
+func resetIdempotency(t *testing.T) {
+	t.Helper()
+	idempotency.mu.Lock()
+	idempotency.entries = map[string]*idempotentResponse{}
+	idempotency.mu.Unlock()
+}
+
+// idempotentRequest sends body to h with the Idempotency-Key key, as name
+// when name is set.
+func idempotentRequest(h http.HandlerFunc, key, name, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	if name != "" {
+		r = r.WithContext(context.WithValue(r.Context(), callerKey{}, caller{name: name}))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIdempotentConcurrent(t *testing.T) {
+	resetIdempotency(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte{byte('0' + n)})
+	})
+
+	const requests = 16
+	responses := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = idempotentRequest(h, "k", "", "{}")
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times, want once", n)
+	}
+	replayed := 0
+	for _, w := range responses {
+		if w.Code != http.StatusCreated || w.Body.String() != "1" {
+			t.Errorf("got %d %q, want 201 %q", w.Code, w.Body.String(), "1")
+		}
+		if w.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if replayed != requests-1 {
+		t.Errorf("%d responses replayed, want %d", replayed, requests-1)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		name string
+		// status is what the handler answers the first request with.
+		status int
+		// caller and body are those of the request repeating the key.
+		caller, body string
+		wantStatus   int
+		wantCalls    int32
+	}{
+		{"replayed", http.StatusOK, "a", "{}", http.StatusOK, 1},
+		{"other body", http.StatusOK, "a", `{"x":1}`, http.StatusUnprocessableEntity, 1},
+		{"client error kept", http.StatusBadRequest, "a", "{}", http.StatusBadRequest, 1},
+		{"server error retried", http.StatusServiceUnavailable, "a", "{}", http.StatusServiceUnavailable, 2},
+		{"other caller", http.StatusOK, "b", "{}", http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetIdempotency(t)
+			var calls atomic.Int32
+			h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+			})
+			idempotentRequest(h, "k", "a", "{}")
+			w := idempotentRequest(h, "k", tt.caller, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("repeat answered %d, want %d", w.Code, tt.wantStatus)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotentPanic(t *testing.T) {
+	resetIdempotency(t)
+	var calls atomic.Int32
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the handler's panic was swallowed")
+			}
+		}()
+		idempotentRequest(h, "k", "", "{}")
+	}()
+	w := idempotentRequest(h, "k", "", "{}")
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry answered %d replayed=%q, want a fresh 201", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler ran %d times, want 2", n)
+	}
+}
+
+func TestIdempotentBodyLimit(t *testing.T) {
+	resetIdempotency(t)
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran for an oversized body")
+	})
+	w := idempotentRequest(h, "k", "", strings.Repeat("x", maxIdempotentBody+1))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("answered %d, want 413", w.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	workloadLogFile = "workload.log"
+	// maxJobLogBytes bounds a job's log; later output is dropped.
+	maxJobLogBytes = 256 << 20
+)
+
+// jobLog is the combined stdout and stderr of the workloads a job launched,
+// kept in the job's work directory while it runs and stored with its run
+// afterwards. Readers following it are woken on every write.
+type jobLog struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	dropped bool
+	closed  bool
+	// wake is closed and replaced whenever the log grows or is closed.
+	wake chan struct{}
+}
+
+func newJobLog(path string) *jobLog {
+	return &jobLog{path: path, wake: make(chan struct{})}
+}
+
+// line appends one line of output, prefixed when several workloads share
+// the log. The file is created on the first line.
+func (l *jobLog) line(prefix, text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.dropped {
+		return
+	}
+	if l.f == nil {
+		if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+			log.Printf("Job log: %v", err)
+			l.dropped = true
+			return
+		}
+		f, err := os.Create(l.path)
+		if err != nil {
+			log.Printf("Job log: %v", err)
+			l.dropped = true
+			return
+		}
+		l.f = f
+	}
+	if prefix != "" {
+		text = "[" + prefix + "] " + text
+	}
+	text = secrets.mask(text)
+	if l.size+int64(len(text))+1 > maxJobLogBytes {
+		text = fmt.Sprintf("... output beyond %d bytes dropped", maxJobLogBytes)
+		l.dropped = true
+	}
+	n, _ := l.f.WriteString(text + "\n")
+	l.size += int64(n)
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// close ends the log; followers drain what is left and return.
+func (l *jobLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.f != nil {
+		l.f.Close()
+	}
+	close(l.wake)
+}
+
+// state returns how much has been written, whether the log is closed, and
+// a channel closed on the next change.
+func (l *jobLog) state() (size int64, closed bool, wake <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size, l.closed, l.wake
+}
+
+// save stores the log with the run as an artifact.
+func (l *jobLog) save(runID string) {
+	if store == nil || runID == "" {
+		return
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err := store.SaveArtifact(runID, workloadLogFile, f); err != nil {
+		log.Printf("Run %s: storing workload log: %v", runID, err)
+	}
+}
+
+// follow copies the log to w from the start, then keeps copying as it
+// grows until it is closed or the client goes away.
+func (l *jobLog) follow(w http.ResponseWriter, r *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	var offset int64
+	for {
+		size, closed, wake := l.state()
+		if size > offset {
+			n, err := copyRange(w, l.path, offset, size-offset)
+			offset += n
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-wake:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func copyRange(w io.Writer, path string, offset, n int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, bufio.NewReader(io.NewSectionReader(f, offset, n)))
+}
+
+// handleJobLogs serves GET /jobs/{id}/logs: the workload output so far, or
+// with follow=true, streamed until the job finishes.
+func handleJobLogs(w http.ResponseWriter, r *http.Request, job *Job) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.URL.Query().Get("follow") == "true" {
+		job.log.follow(w, r)
+		return
+	}
+	size, closed, _ := job.log.state()
+	if _, err := os.Stat(job.log.path); err != nil && closed && store != nil && job.RunID != "" {
+		// Retention removed the work directory; the run kept a copy.
+		if path, err := store.ArtifactPath(job.RunID, workloadLogFile); err == nil {
+			http.ServeFile(w, r, path)
+			return
+		}
+	}
+	if size > 0 {
+		copyRange(w, job.log.path, 0, size)
+	}
+}
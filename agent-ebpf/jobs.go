@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued    = "queued"
+	jobBuilding  = "building"
+	jobRunning   = "running"
+	jobRetrying  = "retrying"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+type Job struct {
+	ID         string            `json:"id"`
+	Scenario   string            `json:"scenario"`
+	Impl       string            `json:"impl"`
+	Variant    string            `json:"variant"`
+	Commit     string            `json:"commit"`
+	Dataset    string            `json:"dataset"`
+	Project    string            `json:"project"`
+	Params     map[string]string `json:"params,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Principal  string            `json:"principal,omitempty"`
+	State      string            `json:"state"`
+	Error      string            `json:"error,omitempty"`
+	SessionID  string            `json:"session_id,omitempty"`
+	RunID      string            `json:"run_id,omitempty"`
+	RunIDs     []string          `json:"run_ids,omitempty"`
+	Attempts   []JobAttempt      `json:"attempts,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+
+	// done is closed when the job finishes.
+	done chan struct{}
+	// log holds the output of the workloads it launched.
+	log *jobLog
+}
+
+type RunRequest struct {
+	Scenario string `json:"scenario"`
+	Impl     string `json:"impl"`
+	Variant  string `json:"variant"`
+	Commit   string `json:"commit"`
+	Dataset  string `json:"dataset"`
+	// Params set the scenario's parameters; see ParamSpec.
+	Params map[string]string `json:"params,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	// Principal is who submitted the job, for reservations; POST /run takes
+	// it from the X-ChainBench-Principal header.
+	Principal string `json:"-"`
+	// Project is the project the job and its runs belong to; POST /run
+	// takes it from the caller.
+	Project string `json:"-"`
+}
+
+// JobManager executes runner-launched scenarios one at a time, since they all
+// share the single evidence collector.
+type JobManager struct {
+	mu      sync.RWMutex
+	jobs    map[string]*Job
+	queue   chan *Job
+	workDir string
+	// cache holds adapter builds and pulled images across jobs.
+	cache *ArtifactCache
+}
+
+var jobs *JobManager
+
+func NewJobManager(workDir string, cache *ArtifactCache) *JobManager {
+	m := &JobManager{
+		jobs:    map[string]*Job{},
+		queue:   make(chan *Job, 64),
+		workDir: workDir,
+		cache:   cache,
+	}
+	go m.loop()
+	return m
+}
+
+func (m *JobManager) Submit(req RunRequest) (*Job, error) {
+	spec, ok := getScenario(req.Scenario)
+	if !ok {
+		return nil, fmt.Errorf("unknown scenario %q", req.Scenario)
+	}
+	if err := validateTags(req.Tags); err != nil {
+		return nil, err
+	}
+	params, err := resolveParams(spec, req.Params)
+	if err != nil {
+		return nil, err
+	}
+	if err := admin.admit(); err != nil {
+		return nil, err
+	}
+	if err := reservations.admit(req.Principal); err != nil {
+		return nil, err
+	}
+	if spec.SideBySide != nil {
+		// The scenario names its impls; a requested one must be among them.
+		if req.Impl != "" && !slices.Contains(spec.SideBySide.Impls, req.Impl) {
+			return nil, fmt.Errorf("scenario %s runs %s side by side, not %q", spec.Name, strings.Join(spec.SideBySide.Impls, "+"), req.Impl)
+		}
+		req.Impl = strings.Join(spec.SideBySide.Impls, "+")
+	} else if _, ok := spec.Adapters[req.Impl]; !ok {
+		return nil, fmt.Errorf("scenario %s has no adapter for impl %q", spec.Name, req.Impl)
+	}
+
+	job := &Job{
+		ID:        newRunID(),
+		Scenario:  req.Scenario,
+		Impl:      req.Impl,
+		Variant:   req.Variant,
+		Commit:    req.Commit,
+		Dataset:   req.Dataset,
+		Project:   projectOf(req.Project),
+		Params:    params,
+		Tags:      req.Tags,
+		Principal: req.Principal,
+		State:     jobQueued,
+		CreatedAt: time.Now().UTC(),
+		done:      make(chan struct{}),
+	}
+	job.log = newJobLog(filepath.Join(m.workDir, job.ID, workloadLogFile))
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	select {
+	case m.queue <- job:
+	default:
+		m.finish(job, "", fmt.Errorf("job queue full"))
+		return nil, fmt.Errorf("job queue full")
+	}
+	return m.Get(job.ID), nil
+}
+
+// Get returns a copy of the job so callers never race with the worker.
+func (m *JobManager) Get(id string) *Job {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil
+	}
+	copied := *job
+	return &copied
+}
+
+// Wait blocks until the job finishes and returns it.
+func (m *JobManager) Wait(id string) *Job {
+	job := m.Get(id)
+	if job == nil {
+		return nil
+	}
+	<-job.done
+	return m.Get(id)
+}
+
+func (m *JobManager) List() []*Job {
+	m.mu.RLock()
+	out := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		copied := *job
+		out = append(out, &copied)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+func (m *JobManager) update(job *Job, fn func(*Job)) {
+	m.mu.Lock()
+	fn(job)
+	m.mu.Unlock()
+}
+
+func (m *JobManager) finish(job *Job, runID string, err error) {
+	m.update(job, func(j *Job) {
+		now := time.Now().UTC()
+		j.FinishedAt = &now
+		j.RunID = runID
+		if err != nil {
+			j.State = jobFailed
+			j.Error = secrets.mask(err.Error())
+		} else {
+			j.State = jobSucceeded
+		}
+	})
+	job.log.close()
+	close(job.done)
+	events.publish(Event{
+		Type: eventJobFinished, Job: job.ID, Session: job.SessionID, Run: runID,
+		Scenario: job.Scenario, Impl: job.Impl, Variant: job.Variant, Commit: job.Commit, Dataset: job.Dataset, Project: job.Project, Machine: collector.machine,
+		State: job.State, Error: job.Error,
+	})
+}
+
+func (m *JobManager) loop() {
+	for job := range m.queue {
+		// Queued jobs wait out a drain; a reservation may have begun while
+		// they did.
+		admin.waitActive()
+		if err := reservations.admit(job.Principal); err != nil {
+			log.Printf("Job %s (%s/%s) refused: %v", job.ID, job.Scenario, job.Impl, err)
+			m.finish(job, "", err)
+			continue
+		}
+		runID, err := m.run(job)
+		if err != nil {
+			log.Printf("Job %s (%s/%s) failed: %v", job.ID, job.Scenario, job.Impl, err)
+		}
+		m.finish(job, runID, err)
+	}
+}
+
+func (m *JobManager) execute(job *Job, attempt *AttemptData) (string, error) {
+	spec, ok := getScenario(job.Scenario)
+	if !ok {
+		return "", fmt.Errorf("scenario %q no longer loaded", job.Scenario)
+	}
+
+	workDir := filepath.Join(m.workDir, job.ID)
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return "", err
+	}
+
+	vars := scenarioVars{
+		Scenario: job.Scenario,
+		Impl:     job.Impl,
+		Variant:  job.Variant,
+		Commit:   job.Commit,
+		Dataset:  job.Dataset,
+		Project:  job.Project,
+		Params:   job.Params,
+		WorkDir:  workDir,
+	}
+	datasetPath, err := renderTemplate(spec.DatasetPath, vars)
+	if err != nil {
+		return "", fmt.Errorf("dataset_path: %w", err)
+	}
+	vars.DatasetPath = datasetPath
+	if vars.Blocks, err = spec.Blocks.render(vars); err != nil {
+		return "", fmt.Errorf("blocks: %w", err)
+	}
+	if spec.SideBySide != nil {
+		return m.executeSideBySide(job, spec, vars, attempt)
+	}
+	adapter := spec.Adapters[job.Impl]
+
+	if adapter.Build != nil || len(adapter.Images) > 0 {
+		m.update(job, func(j *Job) { j.State = jobBuilding })
+	}
+	prepared, err := m.prepare(adapter, &vars)
+	if err != nil {
+		return "", err
+	}
+	defer m.release(prepared)
+
+	prepare, reset := jobSteps(spec, adapter)
+	defer resetSteps(job.ID, reset, vars, job.log, "")
+	if err := runSteps("prepare", prepare, vars, job.log, ""); err != nil {
+		return "", err
+	}
+
+	target, err := renderTarget(adapter.Target, vars)
+	if err != nil {
+		return "", fmt.Errorf("adapter target: %w", err)
+	}
+	run := &scenarioRun{Spec: spec, Adapter: adapter, Vars: vars, Tags: job.Tags, log: job.log}
+	defer run.release()
+	prepared.attach(run)
+	if attempt != nil {
+		run.attach(func(e *Evidence) { e.Attempt = attempt })
+	}
+
+	// Shaping goes in before the session opens so its setup is not part of
+	// the measured window.
+	if spec.Network != nil {
+		remove, err := applyNetwork(context.Background(), spec.Network)
+		if err != nil {
+			return "", err
+		}
+		defer remove()
+		network := *spec.Network
+		run.attach(func(e *Evidence) { e.Network = &network })
+	}
+	if spec.BlockQueue != nil {
+		settings, restore, err := applyBlockQueue(spec.BlockQueue, vars.WorkDir)
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+		run.attach(func(e *Evidence) { e.BlockQueue = settings })
+	}
+	if spec.Scheduling != nil {
+		scheduling := *spec.Scheduling
+		run.attach(func(e *Evidence) { e.Scheduling = &scheduling })
+	}
+
+	// So is the node's start-up: the session opens once it serves.
+	stopServer, err := run.serve()
+	if err != nil {
+		return "", err
+	}
+	defer stopServer()
+
+	ctx := context.Background()
+	if timeout := spec.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// The pre_run hooks also run before the session opens, within the
+	// scenario's timeout like the rest of the run.
+	if _, err := run.runHooks(ctx, hookPreRun, 0); err != nil {
+		return "", err
+	}
+
+	sessionID, err := collector.Start(StartRequest{
+		Scenario:   job.Scenario,
+		Impl:       job.Impl,
+		Variant:    job.Variant,
+		Commit:     job.Commit,
+		Dataset:    job.Dataset,
+		Project:    job.Project,
+		Params:     job.Params,
+		Target:     target,
+		Tags:       job.Tags,
+		Collectors: spec.Collectors,
+		DataDir:    run.Vars.WorkDir,
+	})
+	if err != nil {
+		return "", err
+	}
+	run.SessionID = sessionID
+	m.update(job, func(j *Job) {
+		j.State = jobRunning
+		now := time.Now().UTC()
+		j.StartedAt = &now
+		j.SessionID = sessionID
+	})
+
+	measurements, workloadMs, runErr := runWorkload(ctx, run)
+	run.attach(func(e *Evidence) { e.WorkloadMs = workloadMs })
+	if runErr != nil {
+		failure := classifyFailure(ctx, runErr)
+		run.attach(func(e *Evidence) { e.Failure = failure })
+	}
+	if len(measurements) > 0 {
+		if err := collector.Measure(sessionID, measurements); err != nil {
+			log.Printf("Job %s: recording measurements: %v", job.ID, err)
+		}
+	}
+	for _, section := range run.sections {
+		if err := collector.AttachEvidence(sessionID, section); err != nil {
+			log.Printf("Job %s: attaching evidence: %v", job.ID, err)
+		}
+	}
+
+	evidence, err := collector.Stop("")
+	if err != nil {
+		return "", err
+	}
+	// The post_run hooks run once the session has closed; the run is
+	// amended with them.
+	ran := len(run.hooks)
+	_, postErr := run.runHooks(ctx, hookPostRun, 0)
+	if len(run.hooks) > ran {
+		amendRun(evidence, func(e *Evidence) {
+			run.recordHooks(e)
+			if postErr != nil && e.Failure == nil {
+				e.Failure = classifyFailure(ctx, postErr)
+			}
+		})
+	}
+	if runErr == nil {
+		runErr = postErr
+	}
+	prepared.saveBuildLog(evidence.RunID, vars.BuildDir)
+	job.log.save(evidence.RunID)
+	if runErr != nil && evidence.Failure != nil {
+		runErr = &classifiedError{class: evidence.Failure.Class, err: runErr}
+	}
+	if runErr == nil && evidence.Clock != nil && evidence.Clock.Invalid {
+		runErr = fmt.Errorf("run invalidated: clock stepped %d times mid-run", evidence.Clock.Steps)
+	}
+	if runErr == nil && evidence.Swap != nil && evidence.Swap.Invalid {
+		runErr = fmt.Errorf("run invalidated: the target swapped during the run")
+	}
+	return evidence.RunID, runErr
+}
+
+func handleRunScenario(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Principal = requestPrincipal(r)
+	req.Project = requestProject(r)
+	job, err := jobs.Submit(req)
+	var reserved *reservedError
+	if errors.As(err, &reserved) {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	if err != nil && admin.admit() != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scope := requestScope(r)
+	list := make([]*Job, 0)
+	for _, job := range jobs.List() {
+		if inScope(scope, job.Project) {
+			list = append(list, job)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	job := jobs.Get(id)
+	if job == nil || !inScope(requestScope(r), job.Project) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	switch rest {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	case "logs":
+		handleJobLogs(w, r, job)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleScenarios(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	specs := make([]*ScenarioSpec, 0)
+	for _, name := range scenarioNames() {
+		spec, _ := getScenario(name)
+		specs = append(specs, spec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(specs)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Files the kubelet mounts into every pod for its service account.
+const (
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// PodInfo attributes a traced cgroup to the pod and container running in it.
+type PodInfo struct {
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	UID       string            `json:"uid"`
+	Container string            `json:"container"`
+	Node      string            `json:"node,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+func (p *PodInfo) String() string {
+	return p.Namespace + "/" + p.Pod + "/" + p.Container
+}
+
+// kubeletPods looks pods up through the node's kubelet, which the agent
+// reaches as a DaemonSet with its service account token. Nil outside
+// Kubernetes mode.
+type kubeletPods struct {
+	url    string
+	node   string
+	client *http.Client
+
+	mu          sync.Mutex
+	byContainer map[string]*PodInfo
+	fetched     time.Time
+}
+
+var kubelet *kubeletPods
+
+// targetPodInfo carries the pod labels of a run's target so its other series,
+// which share the run labels, can be joined to them in PromQL.
+var targetPodInfo = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_target_pod_info",
+		Help: "Pods the benchmark target ran in (always 1)",
+	},
+	[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project", "namespace", "pod", "container"},
+)
+
+func newKubeletPods(url, node string, insecure bool) (*kubeletPods, error) {
+	if node == "" {
+		return nil, fmt.Errorf("kubernetes mode needs the node name (NODE_NAME from the downward API)")
+	}
+	if url == "" {
+		url = "https://" + node + ":10250"
+	}
+
+	// Kubelet serving certificates are often self-signed rather than issued
+	// by the cluster CA, hence the opt-out.
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if !insecure {
+		if pem, err := os.ReadFile(serviceAccountCA); err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(pem)
+			tlsConfig.RootCAs = pool
+		}
+	}
+	return &kubeletPods{
+		url:  strings.TrimRight(url, "/"),
+		node: node,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func (k *kubeletPods) fetch() (map[string]*PodInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, k.url+"/pods", nil)
+	if err != nil {
+		return nil, err
+	}
+	// Re-read every time: projected tokens are rotated by the kubelet.
+	if token, err := os.ReadFile(serviceAccountToken); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("kubelet: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubelet /pods: %s", resp.Status)
+	}
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string            `json:"name"`
+				Namespace string            `json:"namespace"`
+				UID       string            `json:"uid"`
+				Labels    map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Status struct {
+				ContainerStatuses     []kubeContainerStatus `json:"containerStatuses"`
+				InitContainerStatuses []kubeContainerStatus `json:"initContainerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("kubelet /pods: %w", err)
+	}
+
+	byContainer := map[string]*PodInfo{}
+	for _, item := range list.Items {
+		statuses := append(item.Status.ContainerStatuses, item.Status.InitContainerStatuses...)
+		for _, status := range statuses {
+			// containerID is "<runtime>://<id>".
+			_, id, ok := strings.Cut(status.ContainerID, "://")
+			if !ok || id == "" {
+				continue
+			}
+			byContainer[id] = &PodInfo{
+				Namespace: item.Metadata.Namespace,
+				Pod:       item.Metadata.Name,
+				UID:       item.Metadata.UID,
+				Container: status.Name,
+				Node:      k.node,
+				Labels:    item.Metadata.Labels,
+			}
+		}
+	}
+	return byContainer, nil
+}
+
+type kubeContainerStatus struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"containerID"`
+}
+
+// containerIDPattern finds the runtime's container ID in a cgroup path, for
+// both the cgroupfs (".../<id>") and systemd ("cri-containerd-<id>.scope")
+// drivers.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// podPIDs returns the processes in the containers of the pod named
+// "namespace/name". A pod not (yet) known to the kubelet matches nothing.
+func (k *kubeletPods) podPIDs(ref string, table map[int]procInfo) []int {
+	namespace, name, _ := strings.Cut(ref, "/")
+	ids := map[string]bool{}
+
+	k.mu.Lock()
+	for attempt := 0; attempt < 2 && len(ids) == 0; attempt++ {
+		for id, pod := range k.byContainer {
+			if pod.Namespace == namespace && pod.Pod == name {
+				ids[id] = true
+			}
+		}
+		if len(ids) > 0 || time.Since(k.fetched) < 5*time.Second {
+			break
+		}
+		k.fetched = time.Now()
+		if byContainer, err := k.fetch(); err == nil {
+			k.byContainer = byContainer
+		} else {
+			log.Printf("Kubernetes pod lookup failed: %v", err)
+		}
+	}
+	k.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var pids []int
+	for pid := range table {
+		for _, id := range containerIDPattern.FindAllString(processCgroup(pid), -1) {
+			if ids[id] {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
+
+// podForPID returns the pod the process runs in, or nil for processes
+// outside any pod. The kubelet is asked again, at most every few seconds,
+// when a container is not in the cached list, so pods started during the
+// session are attributed too.
+func (k *kubeletPods) podForPID(pid int) *PodInfo {
+	ids := containerIDPattern.FindAllString(processCgroup(pid), -1)
+	if len(ids) == 0 {
+		return nil
+	}
+	id := ids[len(ids)-1]
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if pod, ok := k.byContainer[id]; ok {
+		return pod
+	}
+	if time.Since(k.fetched) < 5*time.Second {
+		return nil
+	}
+	k.fetched = time.Now()
+	byContainer, err := k.fetch()
+	if err != nil {
+		log.Printf("Kubernetes pod lookup failed: %v", err)
+		return nil
+	}
+	k.byContainer = byContainer
+	return byContainer[id]
+}
+
+// kubeAPI talks to the API server with the pod's service account.
+type kubeAPI struct {
+	host   string
+	client *http.Client
+}
+
+func newInClusterAPI() (*kubeAPI, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST unset)")
+	}
+	pem, err := os.ReadFile(serviceAccountCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	return &kubeAPI{
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (k *kubeAPI) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.host+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token, err := os.ReadFile(serviceAccountToken); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kubernetes %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw, err = io.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MachineClasses places a machine in hardware classes, so results can be
+// grouped and compared across like machines. Each class is derived from
+// the machine's environment unless the catalog sets it.
+type MachineClasses struct {
+	// CPU is the normalized CPU model, e.g. amd-epyc-7763.
+	CPU string `json:"cpu_class,omitempty"`
+	// Storage is the kind of disk the data dir is on: nvme, ssd, hdd or
+	// virtual.
+	Storage string `json:"storage_class,omitempty"`
+	// Memory is the memory size rounded up to a power of two, e.g. 64GiB.
+	Memory string `json:"memory_class,omitempty"`
+	// Hardware names the three together, cpu/storage/memory unless set.
+	Hardware string `json:"hw_class,omitempty"`
+}
+
+// MachineInfo is a machine as the run store knows it: its latest
+// environment, its classes, and how many runs it recorded.
+type MachineInfo struct {
+	Name        string    `json:"name"`
+	Arch        string    `json:"arch,omitempty"`
+	CPUModel    string    `json:"cpu_model,omitempty"`
+	CPUCount    int       `json:"cpu_count,omitempty"`
+	MemoryBytes uint64    `json:"memory_bytes,omitempty"`
+	Runs        int       `json:"runs"`
+	LastSeen    time.Time `json:"last_seen"`
+	MachineClasses
+	// Catalog holds the classes set by hand, if any.
+	Catalog *MachineClasses `json:"catalog,omitempty"`
+}
+
+// MachineGroup is the machines sharing one class.
+type MachineGroup struct {
+	Class    string   `json:"class"`
+	Machines []string `json:"machines"`
+	Runs     int      `json:"runs"`
+}
+
+// machineClassNames are the class filters GET /runs takes and the groupings
+// trends and the leaderboard can use instead of machine.
+var machineClassNames = []string{"cpu_class", "storage_class", "memory_class", "hw_class"}
+
+var machineClassInfo = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_machine_class_info",
+		Help: "Hardware classes of each benchmark machine (always 1)",
+	},
+	[]string{"machine", "cpu_class", "storage_class", "memory_class", "hw_class"},
+)
+
+// class returns the named class.
+func (c MachineClasses) class(name string) string {
+	switch name {
+	case "cpu_class":
+		return c.CPU
+	case "storage_class":
+		return c.Storage
+	case "memory_class":
+		return c.Memory
+	case "hw_class":
+		return c.Hardware
+	}
+	return ""
+}
+
+// override replaces the classes the catalog sets.
+func (c MachineClasses) override(catalog MachineClasses) MachineClasses {
+	for _, f := range []struct {
+		into *string
+		from string
+	}{
+		{&c.CPU, catalog.CPU}, {&c.Storage, catalog.Storage}, {&c.Memory, catalog.Memory}, {&c.Hardware, catalog.Hardware},
+	} {
+		if f.from != "" {
+			*f.into = f.from
+		}
+	}
+	return c
+}
+
+var (
+	cpuModelNoise = regexp.MustCompile(`\((r|tm)\)|\bcpu\b|\bprocessor\b|\b\d+-core\b|@.*$`)
+	nonClassChars = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// deriveClasses works out a machine's classes from its environment.
+func deriveClasses(env *EnvironmentInfo) MachineClasses {
+	var c MachineClasses
+	if env == nil {
+		return c
+	}
+	model := cpuModelNoise.ReplaceAllString(strings.ToLower(env.CPUModel), " ")
+	c.CPU = strings.Trim(nonClassChars.ReplaceAllString(model, "-"), "-")
+	c.Storage = env.StorageClass
+	if env.MemoryBytes > 0 {
+		gib := float64(env.MemoryBytes) / (1 << 30)
+		c.Memory = fmt.Sprintf("%dGiB", int64(math.Pow(2, math.Ceil(math.Log2(gib)))))
+	}
+	return c
+}
+
+// hardwareClass joins the other classes into the default hw_class.
+func (c MachineClasses) hardwareClass() string {
+	return strings.Join([]string{orUnknown(c.CPU), orUnknown(c.Storage), orUnknown(c.Memory)}, "/")
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func (s *RunStore) catalogPath() string {
+	return filepath.Join(s.dir, "machines.json")
+}
+
+// catalog reads the classes set by hand, by machine.
+func (s *RunStore) catalog() (map[string]MachineClasses, error) {
+	catalog := map[string]MachineClasses{}
+	data, err := os.ReadFile(s.catalogPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.catalogPath(), err)
+	}
+	return catalog, nil
+}
+
+// SetMachineClasses records the classes set by hand for a machine; nil
+// removes them.
+func (s *RunStore) SetMachineClasses(name string, classes *MachineClasses) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	catalog, err := s.catalog()
+	if err != nil {
+		return err
+	}
+	if classes == nil {
+		delete(catalog, name)
+	} else {
+		catalog[name] = *classes
+	}
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.catalogPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.catalogPath())
+}
+
+// Machines returns every machine that recorded a run or has a catalog
+// entry, by name.
+func (s *RunStore) Machines() ([]*MachineInfo, error) {
+	s.mu.RLock()
+	catalog, err := s.catalog()
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]*MachineInfo{}
+	s.indexMu.Lock()
+	x, err := s.loadIndex()
+	if err != nil {
+		s.indexMu.Unlock()
+		return nil, err
+	}
+	envs := map[string]*EnvironmentInfo{}
+	for _, entry := range x.entries {
+		run := entry.Summary
+		m := byName[run.Machine]
+		if m == nil {
+			m = &MachineInfo{Name: run.Machine}
+			byName[run.Machine] = m
+		}
+		m.Runs++
+		if run.CreatedAt.After(m.LastSeen) {
+			m.LastSeen = run.CreatedAt
+			if run.Environment != nil {
+				envs[run.Machine] = run.Environment
+			}
+		}
+	}
+	s.indexMu.Unlock()
+
+	for name := range catalog {
+		if byName[name] == nil {
+			byName[name] = &MachineInfo{Name: name}
+		}
+	}
+	machines := make([]*MachineInfo, 0, len(byName))
+	for name, m := range byName {
+		if env := envs[name]; env != nil {
+			m.Arch, m.CPUModel, m.CPUCount, m.MemoryBytes = env.Arch, env.CPUModel, env.CPUCount, env.MemoryBytes
+		}
+		m.MachineClasses = deriveClasses(envs[name])
+		if set, ok := catalog[name]; ok {
+			m.MachineClasses = m.MachineClasses.override(set)
+			m.Catalog = &set
+		}
+		if m.Hardware == "" {
+			m.Hardware = m.hardwareClass()
+		}
+		machines = append(machines, m)
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].Name < machines[j].Name })
+	return machines, nil
+}
+
+// machineClassesByName maps each machine to its classes.
+func (s *RunStore) machineClassesByName() (map[string]MachineClasses, error) {
+	machines, err := s.Machines()
+	if err != nil {
+		return nil, err
+	}
+	classes := make(map[string]MachineClasses, len(machines))
+	for _, m := range machines {
+		classes[m.Name] = m.MachineClasses
+	}
+	return classes, nil
+}
+
+// exportMachineClasses sets the machine's chainbench_machine_class_info
+// series to its current classes.
+func exportMachineClasses(machine string) {
+	if store == nil {
+		return
+	}
+	classes, err := store.machineClassesByName()
+	if err != nil {
+		log.Printf("Machine classes of %s: %v", machine, err)
+		return
+	}
+	machineClassInfo.DeletePartialMatch(prometheus.Labels{"machine": machine})
+	if c, ok := classes[machine]; ok {
+		machineClassInfo.WithLabelValues(machine, c.CPU, c.Storage, c.Memory, c.Hardware).Set(1)
+	}
+}
+
+// groupMachines groups machines by the named class.
+func groupMachines(machines []*MachineInfo, by string) []MachineGroup {
+	index := map[string]int{}
+	var groups []MachineGroup
+	for _, m := range machines {
+		class := orUnknown(m.class(by))
+		i, ok := index[class]
+		if !ok {
+			i = len(groups)
+			index[class] = i
+			groups = append(groups, MachineGroup{Class: class})
+		}
+		groups[i].Machines = append(groups[i].Machines, m.Name)
+		groups[i].Runs += m.Runs
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Class < groups[j].Class })
+	return groups
+}
+
+// runClassOf returns what puts a run in the named class of machines, or
+// nil to keep machines apart.
+func runClassOf(by string) (func(*RunSummary) string, error) {
+	if by == "" || by == "machine" {
+		return nil, nil
+	}
+	classes, err := store.machineClassesByName()
+	if err != nil {
+		return nil, err
+	}
+	return func(run *RunSummary) string {
+		return orUnknown(classes[run.Machine].class(by))
+	}, nil
+}
+
+func validMachineClass(name string) error {
+	for _, known := range machineClassNames {
+		if name == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown class %q (want one of %s)", name, strings.Join(machineClassNames, ", "))
+}
+
+// handleMachines serves the machine catalog: GET /machines lists machines,
+// or with group=<class> the machines in each class; GET, PUT and DELETE
+// /machines/{name} read, set and clear a machine's classes.
+func handleMachines(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/machines"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		machines, err := store.Machines()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if by := r.URL.Query().Get("group"); by != "" {
+			if err := validMachineClass(by); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(groupMachines(machines, by))
+			return
+		}
+		json.NewEncoder(w).Encode(machines)
+		return
+	}
+	if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && !requireLabWide(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		machines, err := store.Machines()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, m := range machines {
+			if m.Name == name {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(m)
+				return
+			}
+		}
+		http.Error(w, "machine not found", http.StatusNotFound)
+	case http.MethodPut:
+		var classes MachineClasses
+		if err := json.NewDecoder(r.Body).Decode(&classes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.SetMachineClasses(name, &classes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		exportMachineClasses(name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := store.SetMachineClasses(name, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		exportMachineClasses(name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
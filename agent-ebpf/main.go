@@ -1,43 +1,108 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 )
 
 type EvidenceCollector struct {
-	mu              sync.RWMutex
-	running         bool
-	scenario        string
-	impl            string
-	variant         string
-	commit          string
-	machine         string
-	dataset         string
-	runqlatData     *RunqlatData
-	biolatencyData  *BiolatencyData
-	offcpuData      *OffcpuData
-	execData        *ExecData
-	syscallData     *SyscallData
+	mu             sync.RWMutex
+	running        bool
+	sessionID      string
+	scenario       string
+	impl           string
+	variant        string
+	commit         string
+	machine        string
+	dataset        string
+	project        string
+	params         map[string]string
+	tags           map[string]string
+	dataDir        string
+	startedAt      time.Time
+	annotation     *runAnnotation
+	phases         []PhaseData
+	openPhase      *phaseMark
+	measurements   map[string]float64
+	progress       *ProgressData
+	sections       []func(*Evidence)
+	target         *Target
+	scope          *targetScope
+	noise          *noiseMonitor
+	thermal        *thermalMonitor
+	gpu            *gpuMonitor
+	swap           *swapMonitor
+	pressure       *pressureMonitor
+	pmu            *pmuCounters
+	clock          *clockMonitor
+	collectors     *collectorSet
+	ebpf           *EBPFData
+	governor       *overheadGovernor
+	fallback       fallbackCollector
+	traces         map[string]*bpftraceRun
+	natives        map[string]nativeRun
+	selection      map[string]CollectorOptions
+	runqlatData    *RunqlatData
+	biolatencyData *BiolatencyData
+	offcpuData     *OffcpuData
+	execData       *ExecData
+	syscallData    *SyscallData
+	oomKills       uint64
+	stopping       bool
+	// status is the snapshot /status reads; see publish.
+	status atomic.Pointer[CollectorStatus]
 }
 
 type RunqlatData struct {
 	Histogram []HistogramBucket `json:"histogram"`
 	P95Us     float64           `json:"p95_us"`
+	// MeanUs is all the procfs fallback can measure.
+	MeanUs float64 `json:"mean_us,omitempty"`
+	// ThreadGroups splits the histogram by --thread-group, when set.
+	ThreadGroups map[string][]HistogramBucket `json:"thread_groups,omitempty"`
 }
 
 type BiolatencyData struct {
 	Histogram []HistogramBucket `json:"histogram"`
 	P95Us     float64           `json:"p95_us"`
+	// MeanUs is set by the fallbacks; only the DTrace one also fills in
+	// the histogram.
+	MeanUs float64 `json:"mean_us,omitempty"`
+	// ThreadGroups splits the histogram by --thread-group, by the thread
+	// that issued each request, when set.
+	ThreadGroups map[string][]HistogramBucket `json:"thread_groups,omitempty"`
+	// SizeHistogram is the requests' sizes, and SequentialPct the share of
+	// them that started where the previous request to the same device
+	// ended. Only the tracepoint script records them.
+	SizeHistogram []SizeBucket `json:"size_histogram,omitempty"`
+	MedianBytes   int          `json:"median_bytes,omitempty"`
+	SequentialIOs int          `json:"sequential_ios,omitempty"`
+	RandomIOs     int          `json:"random_ios,omitempty"`
+	SequentialPct float64      `json:"sequential_pct,omitempty"`
+}
+
+// SizeBucket is a power-of-two bucket of I/O sizes, from Bytes up to twice
+// that.
+type SizeBucket struct {
+	Bytes int `json:"bytes"`
+	Count int `json:"count"`
 }
 
 type OffcpuData struct {
@@ -74,12 +139,68 @@ type CommandCount struct {
 }
 
 type Evidence struct {
-	Available     bool            `json:"available"`
-	Runqlat       *RunqlatData    `json:"runqlat,omitempty"`
-	Biolatency    *BiolatencyData `json:"biolatency,omitempty"`
-	Offcpu        *OffcpuData     `json:"offcpu,omitempty"`
-	Exec          *ExecData       `json:"exec,omitempty"`
-	SyscallCounts *SyscallData    `json:"syscall_counts,omitempty"`
+	RunID         string              `json:"run_id,omitempty"`
+	Available     bool                `json:"available"`
+	Runqlat       *RunqlatData        `json:"runqlat,omitempty"`
+	Biolatency    *BiolatencyData     `json:"biolatency,omitempty"`
+	Offcpu        *OffcpuData         `json:"offcpu,omitempty"`
+	Exec          *ExecData           `json:"exec,omitempty"`
+	SyscallCounts *SyscallData        `json:"syscall_counts,omitempty"`
+	Connect       *ConnectData        `json:"connect,omitempty"`
+	Handshakes    *HandshakeData      `json:"handshakes,omitempty"`
+	Readahead     *ReadaheadData      `json:"readahead,omitempty"`
+	Writeback     *WritebackData      `json:"writeback,omitempty"`
+	Phases        []PhaseData         `json:"phases,omitempty"`
+	Measurements  map[string]float64  `json:"measurements,omitempty"`
+	RPC           *RPCLoadData        `json:"rpc,omitempty"`
+	Sync          *SyncData           `json:"sync,omitempty"`
+	EVM           *EVMBenchData       `json:"evm,omitempty"`
+	Compaction    *CompactionData     `json:"compaction,omitempty"`
+	Cgroups       []CgroupData        `json:"cgroups,omitempty"`
+	Threads       *ThreadData         `json:"threads,omitempty"`
+	Sockets       *SocketData         `json:"sockets,omitempty"`
+	Files         *FileData           `json:"files,omitempty"`
+	FDErrors      *FDErrorData        `json:"fd_errors,omitempty"`
+	Network       *NetworkSpec        `json:"network_shaping,omitempty"`
+	BlockQueue    []BlockQueueSetting `json:"block_queue,omitempty"`
+	Scheduling    *SchedulingSpec     `json:"scheduling,omitempty"`
+	Build         *BuildData          `json:"build,omitempty"`
+	Images        []ImageData         `json:"images,omitempty"`
+	Hooks         []HookData          `json:"hooks,omitempty"`
+	Readiness     *ReadinessData      `json:"readiness,omitempty"`
+	Failure       *FailureData        `json:"failure,omitempty"`
+	Attempt       *AttemptData        `json:"attempt,omitempty"`
+	Propagation   *PropagationData    `json:"propagation,omitempty"`
+	Beacon        *BeaconData         `json:"beacon,omitempty"`
+	Target        *TargetData         `json:"target,omitempty"`
+	KubernetesJob *KubernetesJobData  `json:"kubernetes_job,omitempty"`
+	SideBySide    *SideBySideData     `json:"side_by_side,omitempty"`
+	Noise         *NoiseData          `json:"noise,omitempty"`
+	Anomalies     *AnomalyData        `json:"anomalies,omitempty"`
+	Thermal       *ThermalData        `json:"thermal,omitempty"`
+	GPU           *GPUData            `json:"gpu,omitempty"`
+	PMU           *PMUData            `json:"pmu,omitempty"`
+	Clock         *ClockData          `json:"clock,omitempty"`
+	Swap          *SwapData           `json:"swap,omitempty"`
+	Pressure      *PressureData       `json:"pressure,omitempty"`
+	Overhead      *OverheadData       `json:"overhead,omitempty"`
+	Stop          *StopData           `json:"stop,omitempty"`
+	EBPF          *EBPFData           `json:"ebpf,omitempty"`
+
+	// StartedAt and StoppedAt are the wall clock at either end of the
+	// window; DurationMs is its length on the monotonic clock, which wall
+	// clock steps do not move.
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	StoppedAt  *time.Time `json:"stopped_at,omitempty"`
+	DurationMs float64    `json:"duration_ms,omitempty"`
+	// WorkloadMs is how long the workload ran, timed by the agent, for
+	// workloads its job runner launched.
+	WorkloadMs float64 `json:"workload_ms,omitempty"`
+	// HookWindowMs is how long post_iteration hooks ran inside the window;
+	// the kernel-side sections include their activity.
+	HookWindowMs float64 `json:"hook_window_ms,omitempty"`
+
+	Collectors map[string]json.RawMessage `json:"collectors,omitempty"`
 }
 
 var (
@@ -87,84 +208,129 @@ var (
 		machine: getHostname(),
 	}
 
-	runqlatHistogram = prometheus.NewHistogramVec(
+	store *RunStore
+
+	// defaultTarget is used by sessions that do not name their own.
+	defaultTarget *Target
+
+	runqlatHistogram = newHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "chainbench_runqlat_microseconds",
 			Help:    "CPU scheduler runqueue latency distribution",
 			Buckets: prometheus.ExponentialBuckets(1, 2, 20),
 		},
-		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset"},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project", "thread_group"},
 	)
 
-	biolatencyHistogram = prometheus.NewHistogramVec(
+	biolatencyHistogram = newHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "chainbench_biolatency_microseconds",
 			Help:    "Block I/O latency distribution",
 			Buckets: prometheus.ExponentialBuckets(1, 2, 20),
 		},
-		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset"},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project", "thread_group"},
+	)
+
+	connectHistogram = newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chainbench_connect_microseconds",
+			Help:    "TCP connection establishment latency distribution",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 24),
+		},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+	)
+
+	writebackHistogram = newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chainbench_writeback_microseconds",
+			Help:    "Kernel writeback pass duration distribution",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 24),
+		},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+	)
+
+	dnsHistogram = newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chainbench_dns_lookup_microseconds",
+			Help:    "getaddrinfo latency distribution",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 24),
+		},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+	)
+
+	handshakesTotal = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "chainbench_handshakes_total",
+			Help: "TLS, Noise and QUIC handshakes by stack and library",
+		},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project", "stack", "library"},
+	)
+
+	memoryPSISome = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "chainbench_memory_psi_some_microseconds_total",
+			Help: "Time some of the target's tasks stalled on memory, summed over its cgroups",
+		},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+	)
+
+	memoryPSIFull = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "chainbench_memory_psi_full_microseconds_total",
+			Help: "Time all of a target cgroup's tasks stalled on memory at once, summed over its cgroups",
+		},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
 	)
 
-	offcpuTotal = prometheus.NewGaugeVec(
+	offcpuTotal = newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "chainbench_offcpu_milliseconds_total",
 			Help: "Total off-CPU time in milliseconds",
 		},
-		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset"},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
 	)
 
-	execCount = prometheus.NewCounterVec(
+	execCount = newCounterVec(
 		prometheus.CounterOpts{
 			Name: "chainbench_exec_count_total",
 			Help: "Total number of exec calls",
 		},
-		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset"},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
 	)
 
-	syscallCounts = prometheus.NewCounterVec(
+	syscallCounts = newCounterVec(
 		prometheus.CounterOpts{
 			Name: "chainbench_syscall_count_total",
 			Help: "Total syscall counts by type",
 		},
-		[]string{"scenario", "impl", "variant", "syscall", "commit", "machine", "dataset"},
+		[]string{"scenario", "impl", "variant", "syscall", "commit", "machine", "dataset", "project"},
 	)
 
-	benchmarkDuration = prometheus.NewGaugeVec(
+	benchmarkDuration = newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "chainbench_duration_milliseconds",
 			Help: "Benchmark duration in milliseconds",
 		},
-		[]string{"impl", "variant", "scenario", "commit", "machine", "dataset"},
+		[]string{"impl", "variant", "scenario", "commit", "machine", "dataset", "project"},
 	)
 
-	benchmarkGain = prometheus.NewGaugeVec(
+	benchmarkGain = newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "chainbench_gain_percent",
 			Help: "Performance gain percentage",
 		},
-		[]string{"impl", "variant", "commit", "machine", "dataset"},
+		[]string{"impl", "variant", "commit", "machine", "dataset", "project"},
 	)
 
-	runsTotal = prometheus.NewCounterVec(
+	runsTotal = newCounterVec(
 		prometheus.CounterOpts{
 			Name: "chainbench_runs_total",
 			Help: "Total number of benchmark runs",
 		},
-		[]string{"result", "impl", "variant", "scenario", "commit", "machine", "dataset"},
+		[]string{"result", "impl", "variant", "scenario", "commit", "machine", "dataset", "project"},
 	)
 )
 
-func init() {
-	prometheus.MustRegister(runqlatHistogram)
-	prometheus.MustRegister(biolatencyHistogram)
-	prometheus.MustRegister(offcpuTotal)
-	prometheus.MustRegister(execCount)
-	prometheus.MustRegister(syscallCounts)
-	prometheus.MustRegister(benchmarkDuration)
-	prometheus.MustRegister(benchmarkGain)
-	prometheus.MustRegister(runsTotal)
-}
-
 func getHostname() string {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -185,126 +351,348 @@ func checkEBPFAvailable() bool {
 	return false
 }
 
-func (c *EvidenceCollector) Start(scenario, impl, variant, commit, dataset string) error {
+func (c *EvidenceCollector) Start(req StartRequest) (string, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.running {
-		return fmt.Errorf("collection already running")
+		return "", fmt.Errorf("collection already running")
+	}
+	if c.stopping {
+		return "", fmt.Errorf("previous session is still stopping")
+	}
+	if err := validateCollectors(req.Collectors); err != nil {
+		return "", err
+	}
+	if err := validateTags(req.Tags); err != nil {
+		return "", err
+	}
+	if err := validateRunParams(req.Params); err != nil {
+		return "", err
 	}
 
-	c.scenario = scenario
-	c.impl = impl
-	c.variant = variant
-	c.commit = commit
-	c.dataset = dataset
+	c.sessionID = newRunID()
+	c.scenario = req.Scenario
+	c.impl = req.Impl
+	c.variant = req.Variant
+	c.commit = req.Commit
+	c.dataset = req.Dataset
+	c.project = projectOf(req.Project)
+	c.params = req.Params
+	c.tags = req.Tags
+	c.dataDir = req.DataDir
+	c.target = req.Target
+	c.selection = req.Collectors
+	if c.target.empty() {
+		c.target = defaultTarget
+	}
+	c.startedAt = time.Now()
 	c.running = true
+	c.oomKills = readOOMKills()
 
 	c.runqlatData = nil
 	c.biolatencyData = nil
 	c.offcpuData = nil
 	c.execData = nil
 	c.syscallData = nil
+	c.phases = nil
+	c.openPhase = nil
+	c.measurements = nil
+	c.progress = nil
+	c.sections = nil
+
+	c.noise, c.thermal, c.gpu, c.clock, c.pressure = nil, nil, nil, nil, nil
+	if opts, ok := c.enabled("noise"); ok {
+		c.noise = startNoiseMonitor(opts.duration("interval", noiseInterval), opts.number("steal_pct", noiseStealPct))
+	}
+	if opts, ok := c.enabled("thermal"); ok {
+		c.thermal = startThermalMonitor(opts.duration("interval", thermalInterval))
+	}
+	if opts, ok := c.enabled("gpu"); ok {
+		c.gpu = startGPUMonitor(opts.duration("interval", gpuInterval))
+	}
+	c.pmu = nil
+	if _, ok := c.enabled("pmu"); ok {
+		var err error
+		if c.pmu, err = startPMUCounters(); err != nil {
+			log.Printf("PMU counters unavailable: %v", err)
+		}
+	}
+	if opts, ok := c.enabled("clock"); ok {
+		c.clock = startClockMonitor(opts.duration("interval", clockInterval))
+	}
+	if opts, ok := c.enabled("pressure"); ok {
+		c.pressure = startPressureMonitor(opts.duration("interval", pressureInterval), opts.number("some_pct", pressureSomePct))
+	}
+	c.ebpf = selectEBPF(c.selection)
+	c.collectors = startCollectors(c.sessionID, c.target, c.selection)
+	c.governor = nil
+	budget := req.OverheadBudgetPct
+	if budget == 0 {
+		budget = overheadBudgetPct
+	}
+	if budget > 0 {
+		c.governor = startOverheadGovernor(budget, c.collectors)
+	}
+	c.scope = nil
+	if !c.target.empty() {
+		c.scope = startTargetScope(c.target, c.selection)
+	}
+	c.swap = nil
+	if opts, ok := c.enabled("swap"); ok {
+		var tracker *targetTracker
+		if c.scope != nil {
+			tracker = c.scope.tracker
+		}
+		c.swap = startSwapMonitor(tracker, opts.duration("interval", swapInterval))
+	}
+	c.startTraces()
+	c.fallback = nil
+	if names := c.ebpf.fallbacks(c.scope != nil); len(names) > 0 {
+		var tracker *targetTracker
+		if c.scope != nil {
+			tracker = c.scope.tracker
+		}
+		c.fallback = startFallback(names, tracker)
+	}
 
-	log.Printf("Started eBPF collection: scenario=%s impl=%s variant=%s", scenario, impl, variant)
-	return nil
+	c.annotation = nil
+	if annotator != nil {
+		c.annotation = annotator.RunStarted(c.startedAt, c.scenario, c.impl, c.variant, c.commit)
+	}
+
+	c.publish()
+	events.publish(Event{
+		Type: eventSessionStarted, Session: c.sessionID,
+		Scenario: c.scenario, Impl: c.impl, Variant: c.variant, Commit: c.commit, Dataset: c.dataset, Project: c.project, Machine: c.machine,
+	})
+	log.Printf("Started eBPF collection: session=%s scenario=%s impl=%s variant=%s", c.sessionID, c.scenario, c.impl, c.variant)
+	return c.sessionID, nil
 }
 
-func (c *EvidenceCollector) Stop() (*Evidence, error) {
+// Stop ends the session, if it is in the caller's scope. The collectors are
+// wound down concurrently and without the lock, so /status keeps answering;
+// a new session cannot start until the last of them is done.
+func (c *EvidenceCollector) Stop(scope string) (*Evidence, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	if !c.running {
+		c.mu.Unlock()
 		return nil, fmt.Errorf("collection not running")
 	}
-
+	if !inScope(scope, c.project) {
+		project := c.project
+		c.mu.Unlock()
+		return nil, &outOfScopeError{project: project}
+	}
 	c.running = false
-
-	if !checkEBPFAvailable() {
-		log.Println("eBPF tools not available, returning empty evidence")
-		return &Evidence{Available: false}, nil
+	c.stopping = true
+	c.closePhase(time.Now())
+	governor := c.governor
+	c.governor = nil
+	tasks := c.stopTasks()
+	c.publish()
+	c.mu.Unlock()
+
+	// Nothing changes the session's fields while it is stopping, so the rest
+	// reads them unlocked.
+	started := time.Now()
+	if c.annotation != nil {
+		annotator.RunStopped(c.annotation, started)
 	}
 
+	// The governor goes first so it does not react to collectors shutting down.
+	overhead := governor.Stop()
+	applies, late, wait := runStopTasks(tasks, stopWorkers, stopTimeout)
+
+	startedAt, stoppedAt := c.startedAt.UTC(), started.UTC()
 	evidence := &Evidence{
-		Available:     true,
-		Runqlat:       c.collectRunqlat(),
-		Biolatency:    c.collectBiolatency(),
-		Offcpu:        c.collectOffcpu(),
-		Exec:          c.collectExec(),
-		SyscallCounts: c.collectSyscalls(),
+		Available:    c.ebpf.available(),
+		Phases:       c.phases,
+		Measurements: c.measurements,
+		Overhead:     overhead,
+		EBPF:         c.ebpf,
+		Stop:         &StopData{DurationMs: float64(time.Since(started).Microseconds()) / 1000, TimedOut: late},
+		StartedAt:    &startedAt,
+		StoppedAt:    &stoppedAt,
+		DurationMs:   float64(started.Sub(c.startedAt).Microseconds()) / 1000,
+	}
+	for _, apply := range applies {
+		apply(evidence)
+	}
+	for _, name := range late {
+		c.ebpf.setReason(name, "did not stop within "+stopTimeout.String())
+	}
+	if evidence.Noise != nil && evidence.Noise.Noisy {
+		log.Printf("Run %s is cloud-noisy: %s", c.sessionID, strings.Join(evidence.Noise.Reasons, "; "))
+	}
+	if !evidence.Available {
+		log.Println("No eBPF collector can run on this kernel, returning evidence without them")
+	}
+	c.applySections(evidence)
+	if evidence.Failure != nil {
+		evidence.Failure.checkOOM(evidence, readOOMKills()-c.oomKills)
 	}
 
-	c.exportToPrometheus(evidence)
+	if evidence.Available {
+		c.exportToPrometheus(evidence)
+	}
+	c.persist(evidence)
+	events.publish(Event{
+		Type: eventSessionStopped, Session: c.sessionID, Run: evidence.RunID,
+		Scenario: c.scenario, Impl: c.impl, Variant: c.variant, Commit: c.commit, Dataset: c.dataset, Project: c.project, Machine: c.machine,
+		State: runResult(evidence),
+	})
+
+	if len(late) == 0 {
+		c.stopped()
+	} else {
+		go func() {
+			wait()
+			c.stopped()
+		}()
+	}
 
 	log.Printf("Stopped eBPF collection: scenario=%s", c.scenario)
 	return evidence, nil
 }
 
-func (c *EvidenceCollector) collectRunqlat() *RunqlatData {
-	hist := []HistogramBucket{
-		{BucketUs: 1, Count: 150},
-		{BucketUs: 2, Count: 320},
-		{BucketUs: 4, Count: 280},
-		{BucketUs: 8, Count: 180},
-		{BucketUs: 16, Count: 90},
-		{BucketUs: 32, Count: 45},
-		{BucketUs: 64, Count: 20},
-		{BucketUs: 128, Count: 8},
+// startTraces starts bpftrace, or the native probe, for each eBPF collector
+// that has a variant, limited to the target's processes where the script
+// filters by pid. A collector whose script does not start loses its
+// variant, so the fallback can stand in for it.
+func (c *EvidenceCollector) startTraces() {
+	var pids []int
+	if c.scope != nil {
+		pids = c.scope.tracker.PIDs()
 	}
+	c.traces, c.natives = map[string]*bpftraceRun{}, map[string]nativeRun{}
+	for i, entry := range c.ebpf.Collectors {
+		if entry.Variant == "" {
+			continue
+		}
+		var err error
+		if native(entry.Collector, entry.Variant) {
+			opts, _ := c.enabled(entry.Collector)
+			var run nativeRun
+			if run, err = startNative(entry.Collector, entry.Variant, opts, pids); err == nil {
+				c.natives[entry.Collector] = run
+			}
+		} else {
+			var run *bpftraceRun
+			run, c.ebpf.Collectors[i].Script, err = startBPFTrace(entry.Collector, entry.Variant, pids)
+			if err == nil {
+				c.traces[entry.Collector] = run
+			}
+		}
+		if err != nil {
+			log.Printf("eBPF %s: %v", entry.Collector, err)
+			c.ebpf.Collectors[i].Variant = ""
+			c.ebpf.Collectors[i].Reason = err.Error()
+		}
+	}
+}
 
-	p95 := 45.0
-
-	for _, bucket := range hist {
-		for i := 0; i < bucket.Count; i++ {
-			runqlatHistogram.WithLabelValues(
-				c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset,
-			).Observe(float64(bucket.BucketUs))
+// retargetTraces restarts the traces whose scripts filter by pid with the
+// new target's processes; what they saw so far is dropped. Native probes
+// swap their pid filter in place and keep their counts.
+func (c *EvidenceCollector) retargetTraces() {
+	pids := c.scope.tracker.PIDs()
+	if run := c.natives["syscalls"]; run != nil {
+		if err := run.setPIDs(pids); err != nil {
+			log.Printf("eBPF syscalls: %v", err)
 		}
 	}
+	for _, name := range []string{"offcpu", "syscalls", "connect", "handshakes", "fderrors", "readahead", "writeback"} {
+		run := c.traces[name]
+		if run == nil {
+			continue
+		}
+		run.Stop()
+		variant := c.ebpf.variant(name)
+		if run, _, err := startBPFTrace(name, variant, pids); err != nil {
+			log.Printf("eBPF %s: %v", name, err)
+			delete(c.traces, name)
+		} else {
+			c.traces[name] = run
+		}
+	}
+}
+
+func (c *EvidenceCollector) collectRunqlat(out *bpftraceOutput) *RunqlatData {
+	hist := out.hists["usecs"]
+	groups := groupHistograms(out.keyedHists["usecs"])
+	c.observeLatency(runqlatHistogram, hist, groups)
 
 	return &RunqlatData{
-		Histogram: hist,
-		P95Us:     p95,
+		Histogram:    hist,
+		P95Us:        histogramPercentile(hist, 0.95),
+		ThreadGroups: groups,
 	}
 }
 
-func (c *EvidenceCollector) collectBiolatency() *BiolatencyData {
-	hist := []HistogramBucket{
-		{BucketUs: 64, Count: 45},
-		{BucketUs: 128, Count: 120},
-		{BucketUs: 256, Count: 85},
-		{BucketUs: 512, Count: 40},
-		{BucketUs: 1024, Count: 15},
+func (c *EvidenceCollector) collectBiolatency(out *bpftraceOutput) *BiolatencyData {
+	hist := out.hists["usecs"]
+	groups := groupHistograms(out.keyedHists["usecs"])
+	c.observeLatency(biolatencyHistogram, hist, groups)
+
+	data := &BiolatencyData{
+		Histogram:     hist,
+		P95Us:         histogramPercentile(hist, 0.95),
+		ThreadGroups:  groups,
+		MedianBytes:   int(histogramPercentile(out.hists["io_bytes"], 0.50)),
+		SequentialIOs: int(out.maps["io_sequential"][""]),
+		RandomIOs:     int(out.maps["io_random"][""]),
 	}
+	for _, bucket := range out.hists["io_bytes"] {
+		data.SizeHistogram = append(data.SizeHistogram, SizeBucket{Bytes: bucket.BucketUs, Count: bucket.Count})
+	}
+	if ios := data.SequentialIOs + data.RandomIOs; ios > 0 {
+		data.SequentialPct = float64(data.SequentialIOs) / float64(ios) * 100
+	}
+	return data
+}
 
-	p95 := 680.0
-
-	for _, bucket := range hist {
-		for i := 0; i < bucket.Count; i++ {
-			biolatencyHistogram.WithLabelValues(
-				c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset,
-			).Observe(float64(bucket.BucketUs))
+// observeLatency feeds a latency histogram, per thread group when the
+// collector split it by groups and with an empty thread_group otherwise.
+func (c *EvidenceCollector) observeLatency(h *prometheus.HistogramVec, hist []HistogramBucket, groups map[string][]HistogramBucket) {
+	if groups == nil {
+		groups = map[string][]HistogramBucket{"": hist}
+	}
+	for group, hist := range groups {
+		observer := h.WithLabelValues(c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project, group)
+		for _, bucket := range hist {
+			for i := 0; i < bucket.Count; i++ {
+				observer.Observe(float64(bucket.BucketUs))
+			}
 		}
 	}
+}
 
-	return &BiolatencyData{
-		Histogram: hist,
-		P95Us:     p95,
-	}
+// enabled reports whether the session runs the named collector, and with
+// which options.
+func (c *EvidenceCollector) enabled(name string) (CollectorOptions, bool) {
+	return collectorEnabled(c.selection, name)
 }
 
-func (c *EvidenceCollector) collectOffcpu() *OffcpuData {
-	totalMs := 1250.0
-	reasons := []ReasonData{
-		{Reason: "futex_wait", Ms: 450.0},
-		{Reason: "io_schedule", Ms: 380.0},
-		{Reason: "mutex_lock", Ms: 220.0},
-		{Reason: "read_sync", Ms: 120.0},
-		{Reason: "other", Ms: 80.0},
+func (c *EvidenceCollector) collectOffcpu(out *bpftraceOutput, top int) *OffcpuData {
+	var totalMs float64
+	byReason := map[string]float64{}
+	for stack, us := range out.maps["us"] {
+		byReason[offcpuReason(stack)] += us / 1000
+		totalMs += us / 1000
+	}
+	reasons := make([]ReasonData, 0, len(byReason))
+	for reason, ms := range byReason {
+		reasons = append(reasons, ReasonData{Reason: reason, Ms: ms})
+	}
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i].Ms > reasons[j].Ms })
+
+	if top > 0 && top < len(reasons) {
+		reasons = reasons[:top]
 	}
 
 	offcpuTotal.WithLabelValues(
-		c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset,
+		c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project,
 	).Set(totalMs)
 
 	return &OffcpuData{
@@ -313,17 +701,24 @@ func (c *EvidenceCollector) collectOffcpu() *OffcpuData {
 	}
 }
 
-func (c *EvidenceCollector) collectExec() *ExecData {
-	execCnt := 12
-	commands := []CommandCount{
-		{Command: "python3", Count: 5},
-		{Command: "sh", Count: 4},
-		{Command: "cat", Count: 2},
-		{Command: "grep", Count: 1},
+func (c *EvidenceCollector) collectExec(out *bpftraceOutput, top int) *ExecData {
+	execCnt := 0
+	commands := make([]CommandCount, 0, len(out.maps["execs"]))
+	for comm, n := range out.maps["execs"] {
+		execCnt += int(n)
+		commands = append(commands, CommandCount{Command: comm, Count: int(n)})
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		a, b := commands[i], commands[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Command < b.Command
+	})
+
+	if top > 0 && top < len(commands) {
+		commands = commands[:top]
 	}
 
 	execCount.WithLabelValues(
-		c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset,
+		c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project,
 	).Add(float64(execCnt))
 
 	return &ExecData{
@@ -332,28 +727,79 @@ func (c *EvidenceCollector) collectExec() *ExecData {
 	}
 }
 
-func (c *EvidenceCollector) collectSyscalls() *SyscallData {
+func (c *EvidenceCollector) collectSyscalls(out *bpftraceOutput) *SyscallData {
+	counts := out.maps["syscalls"]
 	data := &SyscallData{
-		Futex:  1250,
-		Fsync:  45,
-		Openat: 230,
-		Read:   8900,
-		Write:  450,
+		Futex:  int(counts["futex"]),
+		Fsync:  int(counts["fsync"]),
+		Openat: int(counts["openat"]),
+		Read:   int(counts["read"]),
+		Write:  int(counts["write"]),
 	}
 
-	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "futex", c.commit, c.machine, c.dataset).Add(float64(data.Futex))
-	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "fsync", c.commit, c.machine, c.dataset).Add(float64(data.Fsync))
-	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "openat", c.commit, c.machine, c.dataset).Add(float64(data.Openat))
-	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "read", c.commit, c.machine, c.dataset).Add(float64(data.Read))
-	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "write", c.commit, c.machine, c.dataset).Add(float64(data.Write))
+	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "futex", c.commit, c.machine, c.dataset, c.project).Add(float64(data.Futex))
+	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "fsync", c.commit, c.machine, c.dataset, c.project).Add(float64(data.Fsync))
+	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "openat", c.commit, c.machine, c.dataset, c.project).Add(float64(data.Openat))
+	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "read", c.commit, c.machine, c.dataset, c.project).Add(float64(data.Read))
+	syscallCounts.WithLabelValues(c.scenario, c.impl, c.variant, "write", c.commit, c.machine, c.dataset, c.project).Add(float64(data.Write))
 
 	return data
 }
 
+func (c *EvidenceCollector) applySections(evidence *Evidence) {
+	for _, section := range c.sections {
+		section(evidence)
+	}
+}
+
+func (c *EvidenceCollector) persist(evidence *Evidence) {
+	if store == nil {
+		return
+	}
+
+	evidence.RunID = c.sessionID
+	run := &Run{
+		ID:          evidence.RunID,
+		Scenario:    c.scenario,
+		Impl:        c.impl,
+		Variant:     c.variant,
+		Commit:      c.commit,
+		Machine:     c.machine,
+		Dataset:     c.dataset,
+		Project:     c.project,
+		Params:      c.params,
+		Tags:        c.tags,
+		CreatedAt:   time.Now().UTC(),
+		DurationMs:  evidence.DurationMs,
+		StartedAt:   evidence.StartedAt,
+		StoppedAt:   evidence.StoppedAt,
+		Environment: captureEnvironment(c.dataDir),
+		Evidence:    evidence,
+	}
+	evidence.Anomalies = detectAnomalies(run)
+	if err := store.Save(run); err != nil {
+		log.Printf("Failed to store run %s: %v", run.ID, err)
+		evidence.RunID = ""
+		return
+	}
+	exportMachineClasses(run.Machine)
+	checkRegression(run)
+}
+
 func (c *EvidenceCollector) exportToPrometheus(evidence *Evidence) {
 	runsTotal.WithLabelValues(
-		"success", c.impl, c.variant, c.scenario, c.commit, c.machine, c.dataset,
+		runResult(evidence), c.impl, c.variant, c.scenario, c.commit, c.machine, c.dataset, c.project,
 	).Inc()
+	machineInfo.WithLabelValues(c.machine, runtime.GOARCH, cpuModel()).Set(1)
+	exportRunTags([]string{c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project}, c.tags)
+	exportCgroupMetrics([]string{c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project}, evidence.Cgroups)
+	if evidence.Target != nil {
+		for _, pod := range evidence.Target.Pods {
+			targetPodInfo.WithLabelValues(
+				c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project, pod.Namespace, pod.Pod, pod.Container,
+			).Set(1)
+		}
+	}
 }
 
 func handleStart(w http.ResponseWriter, r *http.Request) {
@@ -362,26 +808,48 @@ func handleStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Scenario string `json:"scenario"`
-		Impl     string `json:"impl"`
-		Variant  string `json:"variant"`
-		Commit   string `json:"commit"`
-		Dataset  string `json:"dataset"`
+	var req StartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := validateCollectors(req.Collectors); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := validateTags(req.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateRunParams(req.Params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(probeCollectors(req))
+		return
+	}
 
-	if err := collector.Start(req.Scenario, req.Impl, req.Variant, req.Commit, req.Dataset); err != nil {
+	if err := admin.admit(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := reservations.admit(requestPrincipal(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	req.Project = requestProject(r)
+	sessionID, err := collector.Start(req)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "started"})
+	json.NewEncoder(w).Encode(map[string]string{"status": "started", "session_id": sessionID})
 }
 
 func handleStop(w http.ResponseWriter, r *http.Request) {
@@ -390,30 +858,18 @@ func handleStop(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	evidence, err := collector.Stop()
+	evidence, err := collector.Stop(requestScope(r))
+	var outOfScope *outOfScopeError
+	if errors.As(err, &outOfScope) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(evidence)
-}
-
-func handleStatus(w http.ResponseWriter, r *http.Request) {
-	collector.mu.RLock()
-	defer collector.mu.RUnlock()
-
-	status := map[string]interface{}{
-		"running":  collector.running,
-		"scenario": collector.scenario,
-		"impl":     collector.impl,
-		"variant":  collector.variant,
-		"machine":  collector.machine,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	writeDocument(w, r, evidence)
 }
 
 func handleReportMetrics(w http.ResponseWriter, r *http.Request) {
@@ -423,15 +879,26 @@ func handleReportMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Impl            string  `json:"impl"`
-		Variant         string  `json:"variant"`
-		Commit          string  `json:"commit"`
-		Dataset         string  `json:"dataset"`
-		BaselineMs      float64 `json:"baseline_ms"`
-		OptimizedMs     float64 `json:"optimized_ms"`
-		GainPct         float64 `json:"gain_pct"`
-		BaselineSuccess int     `json:"baseline_success"`
-		OptimizedSuccess int    `json:"optimized_success"`
+		Impl    string `json:"impl"`
+		Variant string `json:"variant"`
+		Commit  string `json:"commit"`
+		Dataset string `json:"dataset"`
+		// BaselineRuns and OptimizedRuns name the stored runs each side's
+		// durations are taken from; BaselineQuery and OptimizedQuery select
+		// them as GET /runs would instead.
+		BaselineRuns   []string `json:"baseline_runs"`
+		OptimizedRuns  []string `json:"optimized_runs"`
+		BaselineQuery  string   `json:"baseline_query"`
+		OptimizedQuery string   `json:"optimized_query"`
+		Confidence     float64  `json:"confidence"`
+
+		// Figures computed by the caller; deprecated in favour of the run
+		// sets above.
+		BaselineMs       float64 `json:"baseline_ms"`
+		OptimizedMs      float64 `json:"optimized_ms"`
+		GainPct          float64 `json:"gain_pct"`
+		BaselineSuccess  int     `json:"baseline_success"`
+		OptimizedSuccess int     `json:"optimized_success"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -439,53 +906,426 @@ func handleReportMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var gain *GainReport
+	if len(req.BaselineRuns) > 0 || len(req.OptimizedRuns) > 0 || req.BaselineQuery != "" || req.OptimizedQuery != "" {
+		baseline, baselineRuns, err := gainRuns(req.BaselineRuns, req.BaselineQuery, requestScope(r))
+		if err != nil {
+			http.Error(w, "baseline: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		optimized, optimizedRuns, err := gainRuns(req.OptimizedRuns, req.OptimizedQuery, requestScope(r))
+		if err != nil {
+			http.Error(w, "optimized: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		confidence := req.Confidence
+		if confidence == 0 {
+			confidence = gainDefaultConfidence
+		}
+		if confidence <= 0 || confidence >= 1 {
+			http.Error(w, fmt.Sprintf("invalid confidence %g (want between 0 and 1)", confidence), http.StatusBadRequest)
+			return
+		}
+		gain = newGainReport(baseline, optimized, baselineRuns, optimizedRuns, confidence)
+	} else {
+		logClientGainOnce.Do(func() {
+			log.Println("POST /report with caller-computed baseline_ms/optimized_ms/gain_pct is deprecated; send baseline_runs and optimized_runs")
+		})
+		w.Header().Set("Deprecation", "true")
+		gain = &GainReport{
+			Source:    gainSourceClient,
+			Baseline:  GainSide{Success: req.BaselineSuccess, MedianMs: req.BaselineMs},
+			Optimized: GainSide{Success: req.OptimizedSuccess, MedianMs: req.OptimizedMs},
+			GainPct:   req.GainPct,
+		}
+	}
+	project := requestProject(r)
+	gain.Impl, gain.Variant, gain.Commit, gain.Machine, gain.Dataset, gain.Project = req.Impl, req.Variant, req.Commit, collector.machine, req.Dataset, project
+	if store != nil {
+		if err := store.SaveGain(gain); err != nil {
+			log.Printf("Failed to record gain: %v", err)
+		}
+	}
+
 	benchmarkDuration.WithLabelValues(
-		req.Impl, req.Variant, "baseline", req.Commit, collector.machine, req.Dataset,
-	).Set(req.BaselineMs)
+		req.Impl, req.Variant, "baseline", req.Commit, collector.machine, req.Dataset, project,
+	).Set(gain.Baseline.MedianMs)
 
 	benchmarkDuration.WithLabelValues(
-		req.Impl, req.Variant, "optimized", req.Commit, collector.machine, req.Dataset,
-	).Set(req.OptimizedMs)
+		req.Impl, req.Variant, "optimized", req.Commit, collector.machine, req.Dataset, project,
+	).Set(gain.Optimized.MedianMs)
 
 	benchmarkGain.WithLabelValues(
-		req.Impl, req.Variant, req.Commit, collector.machine, req.Dataset,
-	).Set(req.GainPct)
+		req.Impl, req.Variant, req.Commit, collector.machine, req.Dataset, project,
+	).Set(gain.GainPct)
+
+	if gain.Verdict != "" {
+		recordVerdict("", req.Impl, req.Variant, req.Commit, collector.machine, req.Dataset, project, gain.Verdict, gain.Reason)
+	}
+	if gain.CILowPct != nil {
+		benchmarkGainCI.WithLabelValues(req.Impl, req.Variant, req.Commit, collector.machine, req.Dataset, project, "low").Set(*gain.CILowPct)
+		benchmarkGainCI.WithLabelValues(req.Impl, req.Variant, req.Commit, collector.machine, req.Dataset, project, "high").Set(*gain.CIHighPct)
+	}
+	if gain.Effect != nil {
+		benchmarkGainMinDetectable.WithLabelValues(req.Impl, req.Variant, req.Commit, collector.machine, req.Dataset, project).Set(gain.Effect.MinDetectablePct)
+	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "metrics_reported"})
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		*GainReport
+	}{"metrics_reported", gain})
 }
 
-func runServer(port int) {
-	http.HandleFunc("/start", handleStart)
-	http.HandleFunc("/stop", handleStop)
-	http.HandleFunc("/status", handleStatus)
-	http.HandleFunc("/report", handleReportMetrics)
-	http.Handle("/metrics", promhttp.Handler())
+// logClientGainOnce keeps the deprecation notice for caller-computed gains
+// to one line per agent.
+var logClientGainOnce sync.Once
+
+type serverConfig struct {
+	Port         int
+	DataDir      string
+	ScenarioDir  string
+	PluginDir    string
+	GrafanaURL   string
+	GrafanaToken string
+	Target       string
+	ThreadGroups []string
+
+	Redact       bool
+	RedactConfig string
+
+	Retention         RetentionPolicy
+	RetentionMaxAge   string
+	RetentionInterval time.Duration
+
+	Cache       CachePolicy
+	CacheMaxAge string
+
+	NoiseStealPct         float64
+	OverheadBudgetPct     float64
+	InvalidateOnClockStep bool
+	AllowSwap             bool
+	StopTimeout           time.Duration
+	StopWorkers           int
+
+	RegressionThresholdPct float64
+	RegressionAlpha        float64
+
+	IdempotencyWindow time.Duration
+
+	AggregatorURL     string
+	AdvertiseURL      string
+	HeartbeatInterval time.Duration
+	UpgradeKey        string
+
+	Tokens  string
+	Secrets string
+
+	Kubernetes         bool
+	KubeletURL         string
+	KubeletInsecureTLS bool
+}
 
-	addr := fmt.Sprintf(":%d", port)
-	log.Printf("ChainBench eBPF Agent starting on %s", addr)
-	log.Printf("Endpoints: /start, /stop, /status, /report, /metrics")
-	log.Printf("eBPF available: %v", checkEBPFAvailable())
+func runServer(cfg serverConfig) {
+	s, err := NewRunStore(cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = s
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if cfg.Redact || cfg.RedactConfig != "" {
+		redaction, err := loadRedactionConfig(cfg.RedactConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.redaction = redaction
+	}
+
+	if cfg.ScenarioDir == "" {
+		cfg.ScenarioDir = filepath.Join(cfg.DataDir, "scenarios")
+	}
+	// Scenarios may name plugin collectors, so plugins are found first.
+	if cfg.PluginDir == "" {
+		cfg.PluginDir = filepath.Join(cfg.DataDir, "plugins")
+	}
+	if err := loadPlugins(cfg.PluginDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadScenarios(cfg.ScenarioDir); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.CacheMaxAge != "" {
+		age, err := parseAge(cfg.CacheMaxAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Cache.MaxAge = age
+	}
+	artifactCache, err = NewArtifactCache(filepath.Join(cfg.DataDir, "cache"), cfg.Cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs = NewJobManager(filepath.Join(cfg.DataDir, "work"), artifactCache)
+
+	if cfg.RetentionMaxAge != "" {
+		age, err := parseAge(cfg.RetentionMaxAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Retention.MaxAge = age
+	}
+	retention = newJanitor(cfg.Retention, cfg.DataDir)
+	if cfg.Retention.enabled() {
+		go retention.loop(cfg.RetentionInterval)
+	}
+
+	if cfg.Target != "" {
+		t, err := parseTarget(cfg.Target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defaultTarget = t
+	}
+	if threadGroups, err = parseThreadGroups(cfg.ThreadGroups); err != nil {
+		log.Fatal(err)
+	}
+
+	noiseStealPct = cfg.NoiseStealPct
+	overheadBudgetPct = cfg.OverheadBudgetPct
+	invalidateOnClockStep = cfg.InvalidateOnClockStep
+	allowSwap = cfg.AllowSwap
+	stopTimeout = cfg.StopTimeout
+	stopWorkers = cfg.StopWorkers
+	regressionThresholdPct = cfg.RegressionThresholdPct
+	regressionAlpha = cfg.RegressionAlpha
+	idempotencyWindow = cfg.IdempotencyWindow
+	heartbeatInterval = cfg.HeartbeatInterval
+	fleetAdvertiseURL = cfg.AdvertiseURL
+
+	if events, err = openEventLog(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	if reservations, err = openReservations(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	if admin, err = openAdminState(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	releases = &releaseShelf{dir: filepath.Join(cfg.DataDir, "upgrades")}
+	var upgradeKey ed25519.PublicKey
+	if cfg.UpgradeKey != "" {
+		if upgradeKey, err = loadPublicKey(cfg.UpgradeKey); err != nil {
+			log.Fatal(err)
+		}
+		releases.key = upgradeKey
+	}
+	if cfg.AggregatorURL != "" {
+		agentUpgrader = newUpgrader(cfg.AggregatorURL, upgradeKey)
+	}
+
+	if cfg.Tokens != "" {
+		if projectTokens, err = loadProjectTokens(cfg.Tokens); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.Secrets != "" {
+		if secrets, err = loadSecrets(cfg.Secrets); err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(secrets.writer(os.Stderr))
+	}
+
+	if cfg.GrafanaURL != "" {
+		annotator = newGrafanaAnnotator(cfg.GrafanaURL, cfg.GrafanaToken)
+	}
+
+	if cfg.Kubernetes {
+		node := os.Getenv("NODE_NAME")
+		k, err := newKubeletPods(cfg.KubeletURL, node, cfg.KubeletInsecureTLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kubelet = k
+		// The pod's hostname is the agent pod's own name; runs belong to the node.
+		collector.machine = node
+	}
+
+	http.HandleFunc("/start", idempotent(handleStart))
+	http.HandleFunc("/stop", compressed(handleStop))
+	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/capabilities", handleCapabilities)
+	http.HandleFunc("/report", idempotent(handleReportMetrics))
+	http.HandleFunc("/gains", handleGains)
+	http.HandleFunc("/run", idempotent(handleRunScenario))
+	http.HandleFunc("/jobs", handleJobs)
+	http.HandleFunc("/jobs/", handleJob)
+	http.HandleFunc("/matrix", handleMatrices)
+	http.HandleFunc("/matrix/", handleMatrix)
+	http.HandleFunc("/scenarios", handleScenarios)
+	http.HandleFunc("/collectors", handleCollectors)
+	http.HandleFunc("/sessions/", handleSession)
+	http.HandleFunc("/propagation/", handlePropagation)
+	http.HandleFunc("/runs", compressed(handleRuns))
+	http.HandleFunc("/runs/", compressed(handleRun))
+	http.HandleFunc("/compare", compressed(handleCompare))
+	http.HandleFunc("/drift", handleDrift)
+	http.HandleFunc("/plan", handlePlan)
+	http.HandleFunc("/correlations", handleCorrelations)
+	http.HandleFunc("/trends", handleTrends)
+	http.HandleFunc("/trends/leaderboard", handleLeaderboard)
+	http.HandleFunc("/machines", handleMachines)
+	http.HandleFunc("/machines/", handleMachines)
+	http.HandleFunc("/storage/usage", handleStorageUsage)
+	http.HandleFunc("/storage/prune", handleStoragePrune)
+	http.HandleFunc("/artifacts", handleArtifacts)
+	http.HandleFunc("/ingest", compressed(handleIngest))
+	http.HandleFunc("/events", handleEvents)
+	http.HandleFunc("/reservations", handleReservations)
+	http.HandleFunc("/reservations/", handleReservations)
+	http.HandleFunc("/admin/", handleAdmin)
+	http.HandleFunc("/upgrade", handleUpgrade)
+	http.HandleFunc("/upgrade/", handleUpgrade)
+	http.HandleFunc("/fleet", handleFleet)
+	http.HandleFunc("/fleet/", handleFleet)
+	http.HandleFunc("/replay", handleReplay)
+	http.HandleFunc("/grafana/dashboard.json", handleGrafanaDashboard)
+	http.Handle("/", webUIHandler())
+	http.HandleFunc("/metrics", handleMetrics)
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	log.Printf("ChainBench eBPF Agent %s starting on %s", agentVersion, addr)
+	log.Printf("Endpoints: /start, /stop, /status, /capabilities, /sessions, /propagation, /report, /gains, /run, /jobs, /matrix, /scenarios, /collectors, /runs, /compare, /machines, /storage/usage, /storage/prune, /artifacts, /ingest, /events, /fleet, /reservations, /admin, /upgrade, /replay, /metrics")
+	features, _ := json.Marshal(kernelFeatures())
+	log.Printf("eBPF kernel features: %s", features)
+	for _, entry := range selectEBPF(nil).Collectors {
+		if entry.Variant != "" {
+			source := "no script"
+			if native(entry.Collector, entry.Variant) {
+				source = "built in"
+			} else if _, info, err := loadScript(scriptName(entry.Collector, entry.Variant)); err == nil {
+				source = info.Source
+			}
+			log.Printf("eBPF %s: %s (%s)", entry.Collector, entry.Variant, source)
+		} else {
+			log.Printf("eBPF %s: unavailable (%s)", entry.Collector, entry.Reason)
+		}
+	}
+	log.Printf("Run store: %s", cfg.DataDir)
+	if store.redaction != nil {
+		log.Printf("Run store: redacting runs before they are stored")
+	}
+	log.Printf("Scenarios (%s): %v", cfg.ScenarioDir, scenarioNames())
+	log.Printf("Collectors (%s): %v", cfg.PluginDir, collectorNames())
+	if cfg.Retention.enabled() {
+		policy, _ := json.Marshal(cfg.Retention)
+		log.Printf("Retention: %s every %s", policy, cfg.RetentionInterval)
+	}
+	if annotator != nil {
+		log.Printf("Grafana annotations: %s", cfg.GrafanaURL)
+	}
+	if defaultTarget != nil {
+		log.Printf("Default target: %s", defaultTarget)
+	}
+	if kubelet != nil {
+		log.Printf("Kubernetes mode: node %s, kubelet %s", kubelet.node, kubelet.url)
+	}
+	if s := admin.status(); s.Mode == modeMaintenance {
+		log.Printf("In maintenance since %s (%s): refusing sessions and jobs until resumed", s.Since.Format(time.RFC3339), s.Reason)
+	}
+	if len(secrets.sources) > 0 {
+		log.Printf("Secrets: %d from %s, masked in runs and logs once used", len(secrets.sources), cfg.Secrets)
+	}
+	if projectTokens != nil {
+		log.Printf("Projects: %d tokens from %s; requests without one are refused", len(projectTokens), cfg.Tokens)
+	}
+	if cfg.AggregatorURL != "" {
+		log.Printf("Fleet: heartbeating to %s every %s", cfg.AggregatorURL, heartbeatInterval)
+		go heartbeat(cfg.AggregatorURL)
+	}
+
+	if err := http.ListenAndServe(addr, versioned(authenticate(http.DefaultServeMux))); err != nil {
 		log.Fatal(err)
 	}
 }
 
 func main() {
-	var port int
+	var (
+		cfg     serverConfig
+		dataDir string
+	)
 
 	rootCmd := &cobra.Command{
-		Use:   "chainbench-agent",
-		Short: "ChainBench eBPF evidence collection agent",
+		Use:           "chainbench-agent",
+		Version:       agentVersion,
+		Short:         "ChainBench eBPF evidence collection agent",
+		SilenceUsage:  true,
+		SilenceErrors: true,
 		Long: `ChainBench eBPF Agent collects kernel-level performance evidence
 and exposes Prometheus metrics for long-term tracking.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return validateTagLabels(tagLabels)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			runServer(port)
+			cfg.DataDir = dataDir
+			runServer(cfg)
 		},
 	}
 
-	rootCmd.Flags().IntVarP(&port, "port", "p", 9090, "HTTP server port")
+	rootCmd.Flags().IntVarP(&cfg.Port, "port", "p", 9090, "HTTP server port")
+	rootCmd.Flags().StringVar(&cfg.ScenarioDir, "scenario-dir", "", "Directory of scenario YAML specs (default <data-dir>/scenarios)")
+	rootCmd.Flags().StringVar(&cfg.PluginDir, "plugin-dir", "", "Directory of exec collector plugins (default <data-dir>/plugins)")
+	rootCmd.Flags().StringVar(&cfg.GrafanaURL, "grafana-url", "", "Grafana base URL for run annotations (disabled if empty)")
+	rootCmd.Flags().StringVar(&cfg.Target, "target", "", "Default session target as kind:value selectors (pid, process, binary, port, container, cgroup, pod, log)")
+	rootCmd.Flags().StringArrayVar(&cfg.ThreadGroups, "thread-group", nil, "Thread group as name=regex over thread names, labelling the latency histograms by thread_group (repeatable, first match wins)")
+	rootCmd.Flags().StringVar(&cfg.GrafanaToken, "grafana-token", os.Getenv("GRAFANA_TOKEN"), "Grafana API token for annotations")
+	rootCmd.Flags().BoolVar(&cfg.Redact, "redact", false, "Strip hostnames, paths, argv and IPs from runs before they are stored")
+	rootCmd.Flags().StringVar(&cfg.RedactConfig, "redact-config", "", "YAML redaction config for --redact (implies --redact)")
+	rootCmd.Flags().IntVar(&cfg.Retention.KeepRuns, "retain-runs", 0, "Keep at most this many runs per scenario/impl (0 keeps all)")
+	rootCmd.Flags().StringVar(&cfg.RetentionMaxAge, "retain-max-age", "", "Remove runs and job work dirs older than this (e.g. 30d, 72h)")
+	rootCmd.Flags().Int64Var(&cfg.Retention.MaxBytes, "retain-max-bytes", 0, "Prune the oldest job work dirs, then runs, until the data dir fits in this many bytes")
+	rootCmd.Flags().DurationVar(&cfg.RetentionInterval, "retain-interval", time.Hour, "How often the retention janitor runs")
+	rootCmd.Flags().Int64Var(&cfg.Cache.MaxBytes, "cache-max-bytes", 0, "Evict least recently used builds and images beyond this many bytes")
+	rootCmd.Flags().StringVar(&cfg.CacheMaxAge, "cache-max-age", "", "Evict builds and images unused for this long (e.g. 14d)")
+	rootCmd.Flags().IntVar(&cfg.Cache.MaxEntries, "cache-max-entries", 0, "Keep at most this many builds and images")
+	rootCmd.Flags().Float64Var(&cfg.NoiseStealPct, "noise-steal-pct", noiseStealPct, "CPU steal percentage above which a run is flagged as cloud-noisy")
+	rootCmd.Flags().Float64Var(&cfg.OverheadBudgetPct, "overhead-budget-pct", 0, "Max CPU percent (of one CPU) for collection; slows sampling or stops plugins beyond it (0 disables)")
+	rootCmd.Flags().BoolVar(&cfg.InvalidateOnClockStep, "invalidate-on-clock-step", false, "Mark runs whose wall clock stepped mid-run as invalid (jobs fail) instead of only warning")
+	rootCmd.Flags().BoolVar(&cfg.AllowSwap, "allow-swap", false, "Only warn about the target swapping during a run instead of marking the run invalid (jobs fail)")
+	rootCmd.Flags().DurationVar(&cfg.StopTimeout, "stop-timeout", stopTimeout, "How long stopping a session waits for its collectors; late ones are left out of the evidence")
+	rootCmd.Flags().IntVar(&cfg.StopWorkers, "stop-workers", stopWorkers, "Collectors wound down at once when a session stops")
+	rootCmd.Flags().Float64Var(&cfg.RegressionThresholdPct, "regression-threshold", regressionThresholdPct, "Smallest slowdown in percent from the previous commit's runs that raises a regression.detected event")
+	rootCmd.Flags().Float64Var(&cfg.RegressionAlpha, "regression-alpha", regressionAlpha, "Significance level of the regression.detected test")
+	rootCmd.Flags().DurationVar(&cfg.IdempotencyWindow, "idempotency-window", idempotencyWindow, "How long a response to a request with an Idempotency-Key is replayed to its retries")
+	rootCmd.Flags().StringVar(&cfg.AggregatorURL, "aggregator-url", "", "Aggregator agent to report this agent's state to for its GET /fleet (disabled if empty)")
+	rootCmd.Flags().StringVar(&cfg.AdvertiseURL, "advertise-url", "", "URL other agents and schedulers reach this agent at, as shown in GET /fleet")
+	rootCmd.Flags().DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", heartbeatInterval, "How often to report to the aggregator; it marks agents offline after three missed heartbeats")
+	rootCmd.Flags().StringVar(&cfg.Secrets, "secrets", "", "YAML file naming the secrets scenario templates reach with {{ secret \"name\" }}: env, file or vault")
+	rootCmd.Flags().StringVar(&cfg.Tokens, "tokens", "", "YAML file binding bearer tokens to projects; every request then needs one")
+	rootCmd.Flags().StringVar(&cfg.UpgradeKey, "upgrade-key", "", "ed25519 public key file (base64) that binaries offered by the aggregator must be signed with; the aggregator refuses uploads it does not verify")
+	rootCmd.Flags().BoolVar(&cfg.Kubernetes, "kubernetes", false, "Run as a DaemonSet: attribute targets to pods through the node's kubelet")
+	rootCmd.Flags().StringVar(&cfg.KubeletURL, "kubelet-url", "", "Kubelet API base URL (default https://$NODE_NAME:10250)")
+	rootCmd.Flags().BoolVar(&cfg.KubeletInsecureTLS, "kubelet-insecure-tls", false, "Do not verify the kubelet's serving certificate")
+
+	rootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", defaultDataDir(), "Directory holding the run store")
+	rootCmd.PersistentFlags().StringSliceVar(&tagLabels, "tag-labels", nil, "Tag keys exported as labels of chainbench_run_tags (keep to low-cardinality keys)")
+	rootCmd.PersistentFlags().StringVar(&scriptsDir, "scripts-dir", scriptsDir, "Directory whose <collector>-<variant>.bt files override the embedded bpftrace scripts")
+
+	rootCmd.AddCommand(newDiffCmd(&dataDir))
+	rootCmd.AddCommand(newReportCmd(&dataDir))
+	rootCmd.AddCommand(newHTMLCmd(&dataDir))
+	rootCmd.AddCommand(newExportCmd(&dataDir))
+	rootCmd.AddCommand(newImportCmd(&dataDir))
+	rootCmd.AddCommand(newReplayCmd(&dataDir))
+	rootCmd.AddCommand(newRedactCmd(&dataDir))
+	rootCmd.AddCommand(newProbeCmd(&dataDir))
+	rootCmd.AddCommand(newScriptsCmd())
+	rootCmd.AddCommand(newRunsCmd(&dataDir))
+	rootCmd.AddCommand(newBisectCmd())
+	rootCmd.AddCommand(newABCmd())
+	rootCmd.AddCommand(newGrafanaCmd())
+	rootCmd.AddCommand(newAdminCmd())
+	rootCmd.AddCommand(newUpgradeCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
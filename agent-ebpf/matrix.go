@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MatrixRequest declares a grid of jobs: every impl × variant × dataset of
+// one scenario, each run Iterations times.
+type MatrixRequest struct {
+	Scenario string   `json:"scenario"`
+	Impls    []string `json:"impls"`
+	Variants []string `json:"variants,omitempty"`
+	Datasets []string `json:"datasets,omitempty"`
+	// Commit applies to every impl unless Commits names one for it.
+	Commit     string            `json:"commit,omitempty"`
+	Commits    map[string]string `json:"commits,omitempty"`
+	Iterations int               `json:"iterations,omitempty"`
+	// Steady, when set, stops each cell once its runs are steady, making
+	// Iterations the most a cell runs.
+	Steady *SteadySpec `json:"steady,omitempty"`
+	// Order is the run order strategy, abab (default), blocked or random;
+	// Seed draws the random ones, made up when zero.
+	Order string `json:"order,omitempty"`
+	Seed  int64  `json:"seed,omitempty"`
+	// Params set the scenario's parameters for every job.
+	Params map[string]string `json:"params,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+// MatrixCell is one impl/variant/dataset combination and the jobs run for
+// it so far.
+type MatrixCell struct {
+	Impl    string   `json:"impl"`
+	Variant string   `json:"variant"`
+	Dataset string   `json:"dataset"`
+	Commit  string   `json:"commit,omitempty"`
+	JobIDs  []string `json:"job_ids,omitempty"`
+	RunIDs  []string `json:"run_ids,omitempty"`
+	Failed  int      `json:"failed"`
+	// Steady is set once the cell's runs are steady, and CVPct is the
+	// coefficient of variation over its latest window, in a steady matrix.
+	Steady bool     `json:"steady,omitempty"`
+	CVPct  *float64 `json:"cv_pct,omitempty"`
+
+	// values are the watched measurement of the cell's runs.
+	values []float64
+}
+
+// Matrix tracks an expanded MatrixRequest. Iterations are interleaved
+// unless Order is random: every cell runs once before any runs a second
+// time, so drift over the hours a matrix takes spreads evenly over the
+// cells. Order and Seed are recorded so the order can be made again.
+type Matrix struct {
+	ID         string            `json:"id"`
+	Scenario   string            `json:"scenario"`
+	Iterations int               `json:"iterations"`
+	Steady     *SteadySpec       `json:"steady,omitempty"`
+	Order      string            `json:"order"`
+	Seed       int64             `json:"seed,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Principal  string            `json:"principal,omitempty"`
+	Project    string            `json:"project"`
+	State      string            `json:"state"`
+	Total      int               `json:"total"`
+	Done       int               `json:"done"`
+	Failed     int               `json:"failed"`
+	// CurrentJob is the job running now.
+	CurrentJob string        `json:"current_job,omitempty"`
+	Cells      []*MatrixCell `json:"cells"`
+	CreatedAt  time.Time     `json:"created_at"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+
+	// Table compares the cells; GET /matrix/{id} fills it in.
+	Table []MatrixRow `json:"table,omitempty"`
+}
+
+// MatrixRow is one cell's line of the comparison table.
+type MatrixRow struct {
+	Dataset  string  `json:"dataset"`
+	Impl     string  `json:"impl"`
+	Variant  string  `json:"variant"`
+	Runs     int     `json:"runs"`
+	Failed   int     `json:"failed"`
+	MedianMs float64 `json:"median_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	MinMs    float64 `json:"min_ms"`
+	// VsBestPct is how much slower the median is than the dataset's
+	// fastest cell.
+	VsBestPct float64 `json:"vs_best_pct"`
+	// Steady and CVPct are the cell's, in a steady matrix.
+	Steady bool     `json:"steady,omitempty"`
+	CVPct  *float64 `json:"cv_pct,omitempty"`
+	// Drift names what drifted between the first and second half of the
+	// cell's runs, once it has driftMinRuns; see runSetDrift.
+	Drift []string `json:"drift,omitempty"`
+}
+
+const (
+	maxMatrixIterations = 100
+	maxMatrixJobs       = 10000
+)
+
+var (
+	matricesMu sync.RWMutex
+	matrices   = map[string]*Matrix{}
+)
+
+// newMatrix validates the request and expands it into cells.
+func newMatrix(req MatrixRequest) (*Matrix, error) {
+	spec, ok := getScenario(req.Scenario)
+	if !ok {
+		return nil, fmt.Errorf("unknown scenario %q", req.Scenario)
+	}
+	if spec.SideBySide != nil {
+		return nil, fmt.Errorf("scenario %s runs its impls side by side; submit it with /run", spec.Name)
+	}
+	if len(req.Impls) == 0 {
+		return nil, fmt.Errorf("impls is required")
+	}
+	for _, impl := range req.Impls {
+		if _, ok := spec.Adapters[impl]; !ok {
+			return nil, fmt.Errorf("scenario %s has no adapter for impl %q", spec.Name, impl)
+		}
+	}
+	for impl := range req.Commits {
+		if _, ok := spec.Adapters[impl]; !ok {
+			return nil, fmt.Errorf("commits: scenario %s has no adapter for impl %q", spec.Name, impl)
+		}
+	}
+	if req.Iterations == 0 {
+		req.Iterations = 1
+		if req.Steady != nil {
+			req.Iterations = defaultSteadyIterations
+		}
+	}
+	if req.Iterations < 0 || req.Iterations > maxMatrixIterations {
+		return nil, fmt.Errorf("iterations must be between 1 and %d", maxMatrixIterations)
+	}
+	if req.Steady != nil {
+		if err := req.Steady.validate(req.Iterations); err != nil {
+			return nil, err
+		}
+	}
+	if req.Order == "" {
+		req.Order = orderABAB
+	}
+	if err := validateOrder(req.Order, orderABAB, orderBlocked, orderRandom); err != nil {
+		return nil, err
+	}
+	if req.Order != orderABAB {
+		req.Seed = orderSeed(req.Seed)
+	}
+	params, err := resolveParams(spec, req.Params)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Variants) == 0 {
+		req.Variants = []string{""}
+	}
+	if len(req.Datasets) == 0 {
+		req.Datasets = []string{""}
+	}
+	total := len(req.Impls) * len(req.Variants) * len(req.Datasets) * req.Iterations
+	if total > maxMatrixJobs {
+		return nil, fmt.Errorf("matrix expands to %d jobs, more than %d", total, maxMatrixJobs)
+	}
+
+	m := &Matrix{
+		ID:         newRunID(),
+		Scenario:   req.Scenario,
+		Iterations: req.Iterations,
+		Steady:     req.Steady,
+		Order:      req.Order,
+		Seed:       req.Seed,
+		Params:     params,
+		State:      jobQueued,
+		Total:      total,
+		CreatedAt:  time.Now().UTC(),
+	}
+	// Every job carries the matrix's id and run order as tags, so its runs
+	// can be found with GET /runs?tag=matrix=<id>.
+	m.Tags = map[string]string{}
+	for key, value := range req.Tags {
+		m.Tags[key] = value
+	}
+	m.Tags["matrix"] = m.ID
+	m.Tags["order"] = m.Order
+	if err := validateTags(m.Tags); err != nil {
+		return nil, err
+	}
+
+	for _, dataset := range req.Datasets {
+		for _, impl := range req.Impls {
+			commit := req.Commit
+			if c, ok := req.Commits[impl]; ok {
+				commit = c
+			}
+			for _, variant := range req.Variants {
+				m.Cells = append(m.Cells, &MatrixCell{Impl: impl, Variant: variant, Dataset: dataset, Commit: commit})
+			}
+		}
+	}
+	return m, nil
+}
+
+func updateMatrix(m *Matrix, fn func(*Matrix)) {
+	matricesMu.Lock()
+	fn(m)
+	matricesMu.Unlock()
+}
+
+// runMatrix submits the matrix's jobs one at a time, so a large grid never
+// fills the job queue and other jobs can interleave with it. In a steady
+// matrix a cell that has become steady is skipped, and its remaining
+// iterations come off the total.
+func runMatrix(m *Matrix) {
+	updateMatrix(m, func(m *Matrix) {
+		now := time.Now().UTC()
+		m.StartedAt = &now
+		m.State = jobRunning
+	})
+
+	ran := make([]int, len(m.Cells))
+	for _, i := range runSchedule(m.Order, len(m.Cells), m.Iterations, m.Seed) {
+		cell := m.Cells[i]
+		ran[i]++
+		if cell.Steady {
+			continue
+		}
+		job, err := jobs.Submit(RunRequest{
+			Scenario:  m.Scenario,
+			Impl:      cell.Impl,
+			Variant:   cell.Variant,
+			Commit:    cell.Commit,
+			Dataset:   cell.Dataset,
+			Params:    m.Params,
+			Tags:      m.Tags,
+			Principal: m.Principal,
+			Project:   m.Project,
+		})
+		if err != nil {
+			log.Printf("Matrix %s: %s/%s/%s: %v", m.ID, cell.Impl, cell.Variant, cell.Dataset, err)
+			updateMatrix(m, func(m *Matrix) {
+				cell.Failed++
+				m.Failed++
+				m.Done++
+			})
+			m.observe(cell, nil, ran[i])
+			continue
+		}
+		updateMatrix(m, func(m *Matrix) {
+			cell.JobIDs = append(cell.JobIDs, job.ID)
+			m.CurrentJob = job.ID
+		})
+
+		job = jobs.Wait(job.ID)
+		updateMatrix(m, func(m *Matrix) {
+			m.Done++
+			if job.State == jobSucceeded {
+				cell.RunIDs = append(cell.RunIDs, job.RunID)
+			} else {
+				cell.Failed++
+				m.Failed++
+			}
+		})
+		var run *Run
+		if job.State == jobSucceeded && store != nil {
+			run, _ = store.Get(job.RunID)
+		}
+		m.observe(cell, run, ran[i])
+	}
+
+	updateMatrix(m, func(m *Matrix) {
+		now := time.Now().UTC()
+		m.FinishedAt = &now
+		m.CurrentJob = ""
+		m.State = jobSucceeded
+		if m.Failed > 0 {
+			m.State = jobFailed
+		}
+	})
+}
+
+// observe feeds a cell's latest run to a steady matrix's detector.
+func (m *Matrix) observe(cell *MatrixCell, run *Run, ran int) {
+	if m.Steady == nil {
+		return
+	}
+	updateMatrix(m, func(m *Matrix) {
+		if m.Steady.observe(cell, run, ran) {
+			cell.Steady = true
+			m.Total -= m.Iterations - ran
+		}
+	})
+}
+
+// getMatrix returns a copy of the matrix.
+func getMatrix(id string) *Matrix {
+	matricesMu.RLock()
+	m, ok := matrices[id]
+	if !ok {
+		matricesMu.RUnlock()
+		return nil
+	}
+	copied := *m
+	copied.Cells = make([]*MatrixCell, len(m.Cells))
+	for i, cell := range m.Cells {
+		c := *cell
+		c.JobIDs = append([]string(nil), cell.JobIDs...)
+		c.RunIDs = append([]string(nil), cell.RunIDs...)
+		c.values = nil
+		copied.Cells[i] = &c
+	}
+	matricesMu.RUnlock()
+	return &copied
+}
+
+// matrixTable summarizes each cell's run durations from the store and
+// ranks the cells of each dataset by median.
+func matrixTable(cells []*MatrixCell) []MatrixRow {
+	rows := make([]MatrixRow, 0, len(cells))
+	for _, cell := range cells {
+		row := MatrixRow{Dataset: cell.Dataset, Impl: cell.Impl, Variant: cell.Variant, Failed: cell.Failed, Steady: cell.Steady, CVPct: cell.CVPct}
+		var durations []float64
+		var runs []*Run
+		for _, id := range cell.RunIDs {
+			if store == nil {
+				break
+			}
+			run, err := store.Get(id)
+			if err != nil || run.DurationMs <= 0 {
+				continue
+			}
+			durations = append(durations, run.DurationMs)
+			runs = append(runs, run)
+		}
+		if drift, err := runSetDrift(runs, driftDefaultThreshold); err == nil {
+			row.Drift = drift.summary()
+		}
+		row.Runs = len(durations)
+		if len(durations) > 0 {
+			sort.Float64s(durations)
+			row.MedianMs = sortedPercentile(durations, 0.5)
+			row.P95Ms = sortedPercentile(durations, 0.95)
+			row.MinMs = durations[0]
+		}
+		rows = append(rows, row)
+	}
+
+	best := map[string]float64{}
+	for _, row := range rows {
+		if row.Runs > 0 && (best[row.Dataset] == 0 || row.MedianMs < best[row.Dataset]) {
+			best[row.Dataset] = row.MedianMs
+		}
+	}
+	for i := range rows {
+		if b := best[rows[i].Dataset]; rows[i].Runs > 0 && b > 0 {
+			rows[i].VsBestPct = (rows[i].MedianMs - b) / b * 100
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Dataset != b.Dataset {
+			return a.Dataset < b.Dataset
+		}
+		if (a.Runs > 0) != (b.Runs > 0) {
+			return a.Runs > 0
+		}
+		return a.MedianMs < b.MedianMs
+	})
+	return rows
+}
+
+// writeMatrixTable renders the comparison table as plain text.
+func writeMatrixTable(w http.ResponseWriter, m *Matrix) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "matrix %s: %s, %d/%d jobs done, %d failed (%s)\n\n", m.ID, m.Scenario, m.Done, m.Total, m.Failed, m.State)
+	rows := make([][]string, len(m.Table))
+	for i, row := range m.Table {
+		median, p95, min, vs := "", "", "", ""
+		if row.Runs > 0 {
+			median = fmt.Sprintf("%.0f ms", row.MedianMs)
+			p95 = fmt.Sprintf("%.0f ms", row.P95Ms)
+			min = fmt.Sprintf("%.0f ms", row.MinMs)
+			vs = fmt.Sprintf("%+.1f%%", row.VsBestPct)
+		}
+		rows[i] = []string{row.Dataset, row.Impl, row.Variant, fmt.Sprint(row.Runs), fmt.Sprint(row.Failed), median, p95, min, vs}
+		if m.Steady != nil {
+			cv := ""
+			if row.CVPct != nil {
+				cv = fmt.Sprintf("%.1f%%", *row.CVPct)
+				if row.Steady {
+					cv += " steady"
+				}
+			}
+			rows[i] = append(rows[i], cv)
+		}
+	}
+	header := []string{"dataset", "impl", "variant", "runs", "failed", "median", "p95", "min", "vs best"}
+	if m.Steady != nil {
+		header = append(header, "cv")
+	}
+	t := &termRenderer{w: w}
+	t.table(header, rows)
+	blank := "\n"
+	for _, row := range m.Table {
+		if len(row.Drift) > 0 {
+			fmt.Fprintf(w, "%sdrift in %s/%s/%s: %s\n", blank, orUnset(row.Dataset), row.Impl, orUnset(row.Variant), strings.Join(row.Drift, "; "))
+			blank = ""
+		}
+	}
+}
+
+func handleMatrices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodGet:
+		matricesMu.RLock()
+		ids := make([]string, 0, len(matrices))
+		for id := range matrices {
+			ids = append(ids, id)
+		}
+		matricesMu.RUnlock()
+		sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+		scope := requestScope(r)
+		list := make([]*Matrix, 0, len(ids))
+		for _, id := range ids {
+			if m := getMatrix(id); m != nil && inScope(scope, m.Project) {
+				m.Cells = nil
+				list = append(list, m)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MatrixRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := newMatrix(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.Principal = requestPrincipal(r)
+	m.Project = requestProject(r)
+	matricesMu.Lock()
+	matrices[m.ID] = m
+	matricesMu.Unlock()
+	go runMatrix(m)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(getMatrix(m.ID))
+}
+
+func handleMatrix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/matrix/")
+	m := getMatrix(id)
+	if m == nil || !inScope(requestScope(r), m.Project) {
+		http.Error(w, "matrix not found", http.StatusNotFound)
+		return
+	}
+	m.Table = matrixTable(m.Cells)
+	if r.URL.Query().Get("format") == "text" {
+		writeMatrixTable(w, m)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var measurementName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var (
+	customGaugesMu sync.Mutex
+	customGauges   = map[string]*prometheus.GaugeVec{}
+)
+
+func customGauge(name string) *prometheus.GaugeVec {
+	customGaugesMu.Lock()
+	defer customGaugesMu.Unlock()
+
+	if g, ok := customGauges[name]; ok {
+		return g
+	}
+	g := newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "chainbench_custom_" + name,
+			Help: "Workload-reported measurement " + name,
+		},
+		[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+	)
+	customGauges[name] = g
+	return g
+}
+
+// Measure records workload-reported values for the session. Later values for
+// the same name overwrite earlier ones.
+func (c *EvidenceCollector) Measure(sessionID string, values map[string]float64) error {
+	for name := range values {
+		if !measurementName.MatchString(name) {
+			return fmt.Errorf("invalid measurement name %q", name)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running || sessionID != c.sessionID {
+		return errSessionNotFound
+	}
+
+	if c.measurements == nil {
+		c.measurements = map[string]float64{}
+	}
+	for name, value := range values {
+		c.measurements[name] = value
+		customGauge(name).WithLabelValues(
+			c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project,
+		).Set(value)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metricDef struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+}
+
+// metricDefs records every metric the agent registers so that artifacts
+// derived from the metric set (dashboards) can be generated from code.
+var (
+	metricDefsMu sync.Mutex
+	metricDefs   []metricDef
+)
+
+func addMetricDef(def metricDef) {
+	metricDefsMu.Lock()
+	metricDefs = append(metricDefs, def)
+	metricDefsMu.Unlock()
+}
+
+func registeredMetrics() []metricDef {
+	metricDefsMu.Lock()
+	defer metricDefsMu.Unlock()
+	return append([]metricDef(nil), metricDefs...)
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	v := prometheus.NewCounterVec(opts, labels)
+	prometheus.MustRegister(v)
+	addMetricDef(metricDef{Name: opts.Name, Help: opts.Help, Type: "counter", Labels: labels})
+	return v
+}
+
+func newGaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	v := prometheus.NewGaugeVec(opts, labels)
+	prometheus.MustRegister(v)
+	addMetricDef(metricDef{Name: opts.Name, Help: opts.Help, Type: "gauge", Labels: labels})
+	return v
+}
+
+func newHistogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	v := prometheus.NewHistogramVec(opts, labels)
+	prometheus.MustRegister(v)
+	addMetricDef(metricDef{Name: opts.Name, Help: opts.Help, Type: "histogram", Labels: labels})
+	return v
+}
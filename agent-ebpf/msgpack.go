@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Evidence with interval snapshots and stacks runs to tens of megabytes of
+// JSON. Clients that send "Accept: application/msgpack" get MessagePack
+// instead: the same document, field for field under its JSON names, encoded
+// as it is walked rather than built in memory first. Decoding goes the
+// other way, transcoding MessagePack to JSON for encoding/json, so both
+// formats read into the same types.
+
+const msgpackContentType = "application/msgpack"
+
+// isMsgpack reports whether a media type is MessagePack under any of its
+// registered or customary names.
+func isMsgpack(mediaType string) bool {
+	switch mediaType {
+	case msgpackContentType, "application/x-msgpack", "application/vnd.msgpack":
+		return true
+	}
+	return false
+}
+
+// wantsMsgpack reports whether the request's Accept header asks for
+// MessagePack ahead of JSON.
+func wantsMsgpack(r *http.Request) bool {
+	best, bestQ := "", 0.0
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+			if q > bestQ && (isMsgpack(mediaType) || mediaType == "application/json") {
+				best, bestQ = mediaType, q
+			}
+		}
+	}
+	return isMsgpack(best)
+}
+
+// writeDocument answers with v as MessagePack when the client asks for it,
+// else as JSON.
+func writeDocument(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Add("Vary", "Accept")
+	if !wantsMsgpack(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	w.Header().Set("Content-Type", msgpackContentType)
+	if err := writeMsgpack(w, v); err != nil {
+		// The status is sent; the client sees a truncated document.
+		log.Printf("%s %s: msgpack: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// writeMsgpack encodes v as its JSON encoding would be, but in MessagePack,
+// streaming to w.
+func writeMsgpack(w io.Writer, v any) error {
+	e := &msgpackEncoder{w: bufio.NewWriterSize(w, 64*1024)}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+type msgpackEncoder struct {
+	w   *bufio.Writer
+	buf [9]byte
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		return e.w.WriteByte(0xc0)
+	}
+	// Types with their own JSON encoding, such as time.Time, keep it.
+	if v.Type().Implements(jsonMarshalerType) && !(v.Kind() == reflect.Pointer && v.IsNil()) {
+		data, err := v.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return e.transcodeJSON(data)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return e.w.WriteByte(0xc3)
+		}
+		return e.w.WriteByte(0xc2)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf[0] = 0xca
+		binary.BigEndian.PutUint32(e.buf[1:], math.Float32bits(float32(v.Float())))
+		_, err := e.w.Write(e.buf[:5])
+		return err
+	case reflect.Float64:
+		return e.encodeFloat(v.Float())
+	case reflect.String:
+		return e.encodeString(v.String())
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return e.w.WriteByte(0xc0)
+		}
+		return e.encode(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return e.w.WriteByte(0xc0)
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeBytes(v.Bytes())
+		}
+		fallthrough
+	case reflect.Array:
+		if err := e.header(v.Len(), 0x90, 0xdc); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	}
+	return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) error {
+	switch {
+	case n >= 0:
+		return e.encodeUint(uint64(n))
+	case n >= -32:
+		return e.w.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		e.buf[0], e.buf[1] = 0xd0, byte(n)
+		_, err := e.w.Write(e.buf[:2])
+		return err
+	case n >= math.MinInt16:
+		e.buf[0] = 0xd1
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+		_, err := e.w.Write(e.buf[:3])
+		return err
+	case n >= math.MinInt32:
+		e.buf[0] = 0xd2
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+		_, err := e.w.Write(e.buf[:5])
+		return err
+	}
+	e.buf[0] = 0xd3
+	binary.BigEndian.PutUint64(e.buf[1:], uint64(n))
+	_, err := e.w.Write(e.buf[:9])
+	return err
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) error {
+	var size int
+	switch {
+	case n <= 0x7f:
+		return e.w.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		e.buf[0], e.buf[1], size = 0xcc, byte(n), 2
+	case n <= math.MaxUint16:
+		e.buf[0], size = 0xcd, 3
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+	case n <= math.MaxUint32:
+		e.buf[0], size = 0xce, 5
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+	default:
+		e.buf[0], size = 0xcf, 9
+		binary.BigEndian.PutUint64(e.buf[1:], n)
+	}
+	_, err := e.w.Write(e.buf[:size])
+	return err
+}
+
+func (e *msgpackEncoder) encodeFloat(f float64) error {
+	e.buf[0] = 0xcb
+	binary.BigEndian.PutUint64(e.buf[1:], math.Float64bits(f))
+	_, err := e.w.Write(e.buf[:9])
+	return err
+}
+
+func (e *msgpackEncoder) encodeString(s string) error {
+	var err error
+	switch n := len(s); {
+	case n <= 31:
+		err = e.w.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.buf[0], e.buf[1] = 0xd9, byte(n)
+		_, err = e.w.Write(e.buf[:2])
+	default:
+		err = e.sized(n, 0xda)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = e.w.WriteString(s)
+	return err
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) error {
+	var err error
+	if n := len(b); n <= math.MaxUint8 {
+		e.buf[0], e.buf[1] = 0xc4, byte(n)
+		_, err = e.w.Write(e.buf[:2])
+	} else {
+		err = e.sized(n, 0xc5)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+// header writes an array or map header: the fix form for up to 15
+// elements, else the 16- or 32-bit one.
+func (e *msgpackEncoder) header(n int, fix, wide byte) error {
+	if n <= 15 {
+		return e.w.WriteByte(fix | byte(n))
+	}
+	return e.sized(n, wide)
+}
+
+// sized writes code, the 16-bit form of a type, or code+1, its 32-bit
+// form, with the length n.
+func (e *msgpackEncoder) sized(n int, code byte) error {
+	if n <= math.MaxUint16 {
+		e.buf[0] = code
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+		_, err := e.w.Write(e.buf[:3])
+		return err
+	}
+	e.buf[0] = code + 1
+	binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+	_, err := e.w.Write(e.buf[:5])
+	return err
+}
+
+// encodeMap writes a map with its keys as strings in sorted order, as
+// encoding/json does.
+func (e *msgpackEncoder) encodeMap(v reflect.Value) error {
+	if v.IsNil() {
+		return e.w.WriteByte(0xc0)
+	}
+	keys := make([]string, 0, v.Len())
+	values := make(map[string]reflect.Value, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := mapKey(iter.Key())
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		values[key] = iter.Value()
+	}
+	sort.Strings(keys)
+	if err := e.header(len(keys), 0x80, 0xde); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := e.encodeString(key); err != nil {
+			return err
+		}
+		if err := e.encode(values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapKey(k reflect.Value) (string, error) {
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key type %s", k.Type())
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	type entry struct {
+		name  string
+		value reflect.Value
+	}
+	var entries []entry
+	for _, f := range structFields(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		entries = append(entries, entry{f.name, fv})
+	}
+	if err := e.header(len(entries), 0x80, 0xde); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := e.encodeString(entry.name); err != nil {
+			return err
+		}
+		if err := e.encode(entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msgpackField is a struct field as encoding/json names it.
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var structFieldCache sync.Map // reflect.Type -> []msgpackField
+
+// structFields lists a struct's fields under their JSON names, with the
+// fields of embedded structs without a name of their own promoted. Outer
+// fields win over promoted ones of the same name.
+func structFields(t reflect.Type) []msgpackField {
+	if cached, ok := structFieldCache.Load(t); ok {
+		return cached.([]msgpackField)
+	}
+	var fields []msgpackField
+	seen := map[string]bool{}
+	var promoted []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := sf.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for _, f := range structFields(ft) {
+				f.index = append([]int{i}, f.index...)
+				promoted = append(promoted, f)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		seen[name] = true
+		fields = append(fields, msgpackField{name: name, index: []int{i}, omitEmpty: strings.Contains(","+opts+",", ",omitempty,")})
+	}
+	for _, f := range promoted {
+		if !seen[f.name] {
+			seen[f.name] = true
+			fields = append(fields, f)
+		}
+	}
+	structFieldCache.Store(t, fields)
+	return fields
+}
+
+// fieldByIndex is v.FieldByIndex, reporting false where a nil embedded
+// pointer leaves the field out.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// transcodeJSON writes a JSON document as MessagePack. Numbers that are
+// whole become integers.
+func (e *msgpackEncoder) transcodeJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	return e.encodeJSONValue(value)
+}
+
+func (e *msgpackEncoder) encodeJSONValue(value any) error {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return e.encodeInt(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return e.encodeFloat(f)
+	case []any:
+		if err := e.header(len(v), 0x90, 0xdc); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := e.encodeJSONValue(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if err := e.header(len(keys), 0x80, 0xde); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := e.encodeString(key); err != nil {
+				return err
+			}
+			if err := e.encodeJSONValue(v[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return e.encode(reflect.ValueOf(value))
+}
+
+// msgpackDecoder reads a stream of MessagePack documents.
+type msgpackDecoder struct {
+	r *bufio.Reader
+}
+
+func newMsgpackDecoder(r io.Reader) *msgpackDecoder {
+	return &msgpackDecoder{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Limits on what a document may claim, so a corrupt or hostile one cannot
+// make the decoder allocate or recurse without bound.
+const (
+	maxMsgpackDepth  = 1000
+	maxMsgpackString = 64 << 20
+)
+
+// Decode reads the next document into v as encoding/json would read its
+// JSON form. It returns io.EOF when the stream ends between documents.
+func (d *msgpackDecoder) Decode(v any) error {
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		bw := bufio.NewWriter(pw)
+		err := msgpackToJSON(bw, d.r, 0)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := json.NewDecoder(pr).Decode(v)
+	pr.Close()
+	// The next document starts where the transcoder stopped reading.
+	if terr := <-done; terr != nil && !errors.Is(terr, io.ErrClosedPipe) {
+		return terr
+	}
+	return err
+}
+
+// msgpackToJSON rewrites one MessagePack value from r as JSON to w.
+func msgpackToJSON(w *bufio.Writer, r *bufio.Reader, depth int) error {
+	if depth > maxMsgpackDepth {
+		return fmt.Errorf("msgpack: nested deeper than %d", maxMsgpackDepth)
+	}
+	code, err := r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	var n uint64
+	switch {
+	case code <= 0x7f:
+		_, err = w.WriteString(strconv.FormatUint(uint64(code), 10))
+		return err
+	case code >= 0xe0:
+		_, err = w.WriteString(strconv.FormatInt(int64(int8(code)), 10))
+		return err
+	case code&0xf0 == 0x80:
+		return mapToJSON(w, r, int(code&0x0f), depth)
+	case code&0xf0 == 0x90:
+		return arrayToJSON(w, r, int(code&0x0f), depth)
+	case code&0xe0 == 0xa0:
+		return stringToJSON(w, r, uint64(code&0x1f), false)
+	}
+
+	switch code {
+	case 0xc0:
+		_, err = w.WriteString("null")
+	case 0xc2:
+		_, err = w.WriteString("false")
+	case 0xc3:
+		_, err = w.WriteString("true")
+	case 0xc4, 0xc5, 0xc6:
+		if n, err = readMsgpackUint(r, 1<<(code-0xc4)); err == nil {
+			err = stringToJSON(w, r, n, true)
+		}
+	case 0xca:
+		if n, err = readMsgpackUint(r, 4); err == nil {
+			err = floatToJSON(w, float64(math.Float32frombits(uint32(n))))
+		}
+	case 0xcb:
+		if n, err = readMsgpackUint(r, 8); err == nil {
+			err = floatToJSON(w, math.Float64frombits(n))
+		}
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		if n, err = readMsgpackUint(r, 1<<(code-0xcc)); err == nil {
+			_, err = w.WriteString(strconv.FormatUint(n, 10))
+		}
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		if n, err = readMsgpackUint(r, size); err == nil {
+			// Sign-extend from the value's width.
+			shift := 64 - 8*size
+			_, err = w.WriteString(strconv.FormatInt(int64(n<<shift)>>shift, 10))
+		}
+	case 0xd9, 0xda, 0xdb:
+		if n, err = readMsgpackUint(r, 1<<(code-0xd9)); err == nil {
+			err = stringToJSON(w, r, n, false)
+		}
+	case 0xdc, 0xdd:
+		if n, err = readMsgpackUint(r, 2<<(code-0xdc)); err == nil {
+			err = arrayToJSON(w, r, int(n), depth)
+		}
+	case 0xde, 0xdf:
+		if n, err = readMsgpackUint(r, 2<<(code-0xde)); err == nil {
+			err = mapToJSON(w, r, int(n), depth)
+		}
+	default:
+		err = fmt.Errorf("msgpack: unsupported type 0x%02x", code)
+	}
+	return err
+}
+
+func readMsgpackUint(r *bufio.Reader, size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func floatToJSON(w *bufio.Writer, f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("msgpack: %v has no JSON form", f)
+	}
+	_, err := w.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	return err
+}
+
+// stringToJSON copies a string of n bytes as a JSON string; binary data is
+// written in base64, as encoding/json writes []byte.
+func stringToJSON(w *bufio.Writer, r *bufio.Reader, n uint64, binary bool) error {
+	if n > maxMsgpackString {
+		return fmt.Errorf("msgpack: %d-byte string exceeds %d", n, maxMsgpackString)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return unexpectedEOF(err)
+	}
+	if binary {
+		buf = []byte(base64.StdEncoding.EncodeToString(buf))
+	}
+	quoted, err := json.Marshal(string(buf))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(quoted)
+	return err
+}
+
+func arrayToJSON(w *bufio.Writer, r *bufio.Reader, n, depth int) error {
+	w.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		if err := msgpackToJSON(w, r, depth+1); err != nil {
+			return err
+		}
+	}
+	return w.WriteByte(']')
+}
+
+// mapToJSON writes a map as a JSON object. Keys that are not strings, such
+// as integers, are written as strings of their JSON form.
+func mapToJSON(w *bufio.Writer, r *bufio.Reader, n, depth int) error {
+	w.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		if code, err := r.Peek(1); err == nil && (code[0]&0xe0 == 0xa0 || code[0] >= 0xd9 && code[0] <= 0xdb) {
+			if err := msgpackToJSON(w, r, depth+1); err != nil {
+				return err
+			}
+		} else {
+			var b strings.Builder
+			key := bufio.NewWriter(&b)
+			if err := msgpackToJSON(key, r, depth+1); err != nil {
+				return err
+			}
+			key.Flush()
+			quoted, _ := json.Marshal(b.String())
+			w.Write(quoted)
+		}
+		w.WriteByte(':')
+		if err := msgpackToJSON(w, r, depth+1); err != nil {
+			return err
+		}
+	}
+	return w.WriteByte('}')
+}
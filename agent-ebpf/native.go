@@ -0,0 +1,32 @@
+package main
+
+// The high-rate collectors, exec and syscalls, run natively instead of
+// through bpftrace. By default their programs count in per-CPU BPF maps,
+// which the agent reads once at Stop, so nothing crosses to userspace per
+// event (see aggregate_linux.go). With the collector's stream option set
+// they send every event through a ring buffer instead (see pipeline.go).
+
+// nativeRun is a native collector running for the session.
+type nativeRun interface {
+	// setPIDs limits the collector to the target's processes, or lifts the
+	// limit when there are none, keeping what it counted so far.
+	setPIDs(pids []int) error
+	// Stop detaches the collector and returns its counts in the maps its
+	// bpftrace script would have printed.
+	Stop() (*bpftraceOutput, *PipelineStats)
+}
+
+func startNative(name, variant string, opts CollectorOptions, pids []int) (nativeRun, error) {
+	if variant == "ringbuf" {
+		run, err := startRingbuf(name, opts, pids)
+		if err != nil {
+			return nil, err
+		}
+		return run, nil
+	}
+	probe, err := startMapProbe(name, pids)
+	if err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
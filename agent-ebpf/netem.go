@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// NetworkSpec declares artificial network conditions for a scenario, applied
+// with tc/netem on Interface for the duration of the job. With Peers set only
+// traffic to those addresses is shaped; otherwise everything leaving the
+// interface is.
+type NetworkSpec struct {
+	Interface string   `yaml:"interface" json:"interface"`
+	Latency   string   `yaml:"latency,omitempty" json:"latency,omitempty"`
+	Jitter    string   `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	Loss      float64  `yaml:"loss_pct,omitempty" json:"loss_pct,omitempty"`
+	Rate      string   `yaml:"rate,omitempty" json:"rate,omitempty"`
+	Peers     []string `yaml:"peers,omitempty" json:"peers,omitempty"`
+}
+
+func (n *NetworkSpec) validate() error {
+	if n.Interface == "" {
+		return fmt.Errorf("network: interface is required")
+	}
+	for name, value := range map[string]string{"latency": n.Latency, "jitter": n.Jitter} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("network: %s: %w", name, err)
+		}
+	}
+	if n.Jitter != "" && n.Latency == "" {
+		return fmt.Errorf("network: jitter needs latency")
+	}
+	if n.Loss < 0 || n.Loss > 100 {
+		return fmt.Errorf("network: loss_pct must be between 0 and 100")
+	}
+	return nil
+}
+
+// netemArgs renders the netem parameters, e.g. "delay 50ms 10ms loss 0.5% rate 10mbit".
+func (n *NetworkSpec) netemArgs() []string {
+	var args []string
+	if n.Latency != "" {
+		args = append(args, "delay", tcDuration(n.Latency))
+		if n.Jitter != "" {
+			args = append(args, tcDuration(n.Jitter))
+		}
+	}
+	if n.Loss > 0 {
+		args = append(args, "loss", fmt.Sprintf("%g%%", n.Loss))
+	}
+	if n.Rate != "" {
+		args = append(args, "rate", n.Rate)
+	}
+	return args
+}
+
+// tcDuration converts a Go duration to tc's notation, which has no "µs".
+func tcDuration(s string) string {
+	d, _ := time.ParseDuration(s)
+	return fmt.Sprintf("%dus", d.Microseconds())
+}
+
+func (n *NetworkSpec) String() string {
+	var parts []string
+	if n.Latency != "" {
+		parts = append(parts, "latency "+n.Latency)
+	}
+	if n.Jitter != "" {
+		parts = append(parts, "jitter "+n.Jitter)
+	}
+	if n.Loss > 0 {
+		parts = append(parts, fmt.Sprintf("loss %g%%", n.Loss))
+	}
+	if n.Rate != "" {
+		parts = append(parts, "rate "+n.Rate)
+	}
+	s := n.Interface + ": " + strings.Join(parts, ", ")
+	if len(n.Peers) > 0 {
+		s += " to " + strings.Join(n.Peers, ",")
+	}
+	return s
+}
+
+func runTC(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// applyNetwork installs the shaping and returns a function that removes it.
+// The root qdisc is replaced, so the interface should be dedicated to the
+// benchmark network.
+func applyNetwork(ctx context.Context, n *NetworkSpec) (func(), error) {
+	netem := n.netemArgs()
+	if len(netem) == 0 {
+		return func() {}, nil
+	}
+
+	var cmds [][]string
+	if len(n.Peers) == 0 {
+		cmds = append(cmds, append([]string{"qdisc", "replace", "dev", n.Interface, "root", "handle", "1:", "netem"}, netem...))
+	} else {
+		// A prio qdisc with a fourth band that the default priomap never
+		// uses; filters steer peer traffic into it and everything else
+		// keeps the usual three bands.
+		cmds = append(cmds,
+			[]string{"qdisc", "replace", "dev", n.Interface, "root", "handle", "1:", "prio",
+				"bands", "4", "priomap", "1", "2", "2", "2", "1", "2", "0", "0", "1", "1", "1", "1", "1", "1", "1", "1"},
+			append([]string{"qdisc", "add", "dev", n.Interface, "parent", "1:4", "handle", "40:", "netem"}, netem...),
+		)
+		for _, peer := range n.Peers {
+			proto, match := "ip", "dst"
+			if strings.Contains(peer, ":") {
+				proto = "ipv6"
+			}
+			cmds = append(cmds, []string{"filter", "add", "dev", n.Interface, "parent", "1:0", "protocol", proto,
+				"prio", "4", "u32", "match", proto, match, peer, "flowid", "1:4"})
+		}
+	}
+
+	remove := func() {
+		if err := runTC(context.Background(), "qdisc", "del", "dev", n.Interface, "root"); err != nil {
+			log.Printf("Removing network shaping: %v", err)
+		}
+	}
+	for _, args := range cmds {
+		if err := runTC(ctx, args...); err != nil {
+			remove()
+			return nil, err
+		}
+	}
+	log.Printf("Network shaping applied: %s", n)
+	return remove, nil
+}
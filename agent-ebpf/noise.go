@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NoiseData records how much the host itself interfered with the window:
+// whether it is a VM, CPU time stolen by the hypervisor, and wall-clock
+// jumps and stalls of the agent's own sampling loop.
+type NoiseData struct {
+	Virtualized  bool     `json:"virtualized"`
+	Hypervisor   string   `json:"hypervisor,omitempty"`
+	StealPct     float64  `json:"steal_pct"`
+	PeakStealPct float64  `json:"peak_steal_pct"`
+	ClockJumps   int      `json:"clock_jumps"`
+	MaxJumpMs    float64  `json:"max_jump_ms"`
+	Stalls       int      `json:"stalls"`
+	MaxStallMs   float64  `json:"max_stall_ms"`
+	Noisy        bool     `json:"noisy"`
+	Reasons      []string `json:"reasons,omitempty"`
+}
+
+// Above these the evidence is flagged as cloud-noisy.
+var (
+	noiseStealPct = 2.0
+	noiseJumpMs   = 50.0
+	noiseStallMs  = 250.0
+)
+
+const noiseInterval = time.Second
+
+// procStatCPU returns the aggregate "cpu" line of /proc/stat: user, nice,
+// system, idle, iowait, irq, softirq, steal, guest, guest_nice jiffies.
+func procStatCPU() ([]uint64, bool) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return nil, false
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return nil, false
+	}
+	values := make([]uint64, 0, len(fields)-1)
+	for _, f := range fields[1:] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, n)
+	}
+	return values, true
+}
+
+// stealTimes returns steal and total jiffies; guest time is already part of
+// user and is not counted twice.
+func stealTimes() (steal, total uint64, ok bool) {
+	values, ok := procStatCPU()
+	if !ok {
+		return 0, 0, false
+	}
+	for i, v := range values {
+		if i < 8 {
+			total += v
+		}
+	}
+	if len(values) > 7 {
+		steal = values[7]
+	}
+	return steal, total, true
+}
+
+// detectHypervisor names the hypervisor from DMI and CPU hints, or returns
+// "" on bare metal.
+func detectHypervisor() string {
+	if t := readTrimmed("/sys/hypervisor/type"); t != "" {
+		return t
+	}
+	dmi := strings.ToLower(readTrimmed("/sys/class/dmi/id/sys_vendor") + " " + readTrimmed("/sys/class/dmi/id/product_name"))
+	for _, known := range []struct{ hint, name string }{
+		{"amazon ec2", "aws"},
+		{"google", "gce"},
+		{"microsoft corporation", "hyper-v"},
+		{"vmware", "vmware"},
+		{"virtualbox", "virtualbox"},
+		{"innotek", "virtualbox"},
+		{"qemu", "kvm"},
+		{"kvm", "kvm"},
+		{"xen", "xen"},
+		{"firecracker", "firecracker"},
+	} {
+		if strings.Contains(dmi, known.hint) {
+			return known.name
+		}
+	}
+	for _, flag := range strings.Fields(procField("/proc/cpuinfo", "flags")) {
+		if flag == "hypervisor" {
+			return "unknown"
+		}
+	}
+	return ""
+}
+
+type noiseMonitor struct {
+	stop     chan struct{}
+	done     chan struct{}
+	interval time.Duration
+	stealPct float64
+
+	mu         sync.Mutex
+	data       NoiseData
+	firstSteal uint64
+	firstTotal uint64
+	lastSteal  uint64
+	lastTotal  uint64
+	haveSteal  bool
+	last       time.Time
+}
+
+func startNoiseMonitor(interval time.Duration, stealPct float64) *noiseMonitor {
+	m := &noiseMonitor{
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		interval: interval,
+		stealPct: stealPct,
+		last:     time.Now(),
+	}
+	m.data.Hypervisor = detectHypervisor()
+	m.data.Virtualized = m.data.Hypervisor != ""
+	m.firstSteal, m.firstTotal, m.haveSteal = stealTimes()
+	m.lastSteal, m.lastTotal = m.firstSteal, m.firstTotal
+	go m.loop()
+	return m
+}
+
+func (m *noiseMonitor) loop() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+func (m *noiseMonitor) sample() {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The monotonic clock only moves forward at a steady rate; the wall
+	// clock diverging from it means something stepped or slewed the time.
+	mono := now.Sub(m.last)
+	wall := now.Round(0).Sub(m.last.Round(0))
+	if jump := float64((wall - mono).Abs().Microseconds()) / 1000; jump > noiseJumpMs {
+		m.data.ClockJumps++
+		m.data.MaxJumpMs = max(m.data.MaxJumpMs, jump)
+	}
+	// A tick that arrives far too late is the whole guest (or the agent)
+	// having been paused.
+	if late := float64((mono - m.interval).Microseconds()) / 1000; late > noiseStallMs {
+		m.data.Stalls++
+		m.data.MaxStallMs = max(m.data.MaxStallMs, late)
+	}
+	m.last = now
+
+	if steal, total, ok := stealTimes(); ok && m.haveSteal && total > m.lastTotal {
+		pct := float64(steal-m.lastSteal) / float64(total-m.lastTotal) * 100
+		m.data.PeakStealPct = max(m.data.PeakStealPct, pct)
+		m.lastSteal, m.lastTotal = steal, total
+	}
+}
+
+func (m *noiseMonitor) Stop() *NoiseData {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	m.sample()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := m.data
+	if m.haveSteal && m.lastTotal > m.firstTotal {
+		data.StealPct = float64(m.lastSteal-m.firstSteal) / float64(m.lastTotal-m.firstTotal) * 100
+	}
+
+	if data.StealPct > m.stealPct {
+		data.Reasons = append(data.Reasons, fmt.Sprintf("cpu steal %.1f%% (threshold %.1f%%)", data.StealPct, m.stealPct))
+	}
+	if data.ClockJumps > 0 {
+		data.Reasons = append(data.Reasons, fmt.Sprintf("%d wall-clock jumps, largest %.0f ms", data.ClockJumps, data.MaxJumpMs))
+	}
+	if data.Stalls > 0 {
+		data.Reasons = append(data.Reasons, fmt.Sprintf("%d host stalls, longest %.0f ms", data.Stalls, data.MaxStallMs))
+	}
+	data.Noisy = len(data.Reasons) > 0
+	return &data
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Run order strategies decide in which order a comparison's runs are made,
+// so that whatever changes over its course, a cache warming up or a host
+// heating, does not quietly favour one side:
+//
+//   - abab runs every side once per round, always in the same order;
+//   - blocked runs every side once per round too, each round in an order
+//     of its own drawn at random (a randomized block design);
+//   - random draws the whole sequence of runs as one random permutation.
+//
+// Comparisons of two sides also have abba, which swaps which side goes
+// first every round, so each side goes first as often as the other.
+const (
+	orderABAB    = "abab"
+	orderABBA    = "abba"
+	orderBlocked = "blocked"
+	orderRandom  = "random"
+)
+
+// validateOrder checks a strategy against those the comparison offers.
+func validateOrder(order string, allowed ...string) error {
+	for _, a := range allowed {
+		if order == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("order must be one of %v, got %q", allowed, order)
+}
+
+// orderSeed is the seed random orders are drawn from: the one given, or
+// one made up and recorded so the order can be made again.
+func orderSeed(seed int64) int64 {
+	if seed != 0 {
+		return seed
+	}
+	return time.Now().UnixNano()
+}
+
+// runSchedule orders rounds runs of each of sides sides under a strategy,
+// returning the side of each run in turn.
+func runSchedule(order string, sides, rounds int, seed int64) []int {
+	rng := rand.New(rand.NewSource(seed))
+	schedule := make([]int, 0, sides*rounds)
+	for round := 0; round < rounds; round++ {
+		schedule = append(schedule, roundOrder(order, round, sides, rng)...)
+	}
+	if order == orderRandom {
+		rng.Shuffle(len(schedule), func(i, j int) { schedule[i], schedule[j] = schedule[j], schedule[i] })
+	}
+	return schedule
+}
+
+// roundOrder is the order of the sides in one round; random orders leave
+// rounds as they are and shuffle the whole schedule instead.
+func roundOrder(order string, round, sides int, rng *rand.Rand) []int {
+	block := make([]int, sides)
+	for side := range block {
+		block[side] = side
+	}
+	switch order {
+	case orderABBA:
+		if round%2 == 1 {
+			for i, j := 0, len(block)-1; i < j; i, j = i+1, j-1 {
+				block[i], block[j] = block[j], block[i]
+			}
+		}
+	case orderBlocked:
+		rng.Shuffle(len(block), func(i, j int) { block[i], block[j] = block[j], block[i] })
+	}
+	return block
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OverheadData records the CPU the agent spent collecting against the
+// session's budget, and what was given up to stay within it.
+type OverheadData struct {
+	BudgetPct  float64          `json:"budget_pct"`
+	MeanCPUPct float64          `json:"mean_cpu_pct"`
+	PeakCPUPct float64          `json:"peak_cpu_pct"`
+	Slowdown   int              `json:"slowdown"`
+	Degraded   []OverheadAction `json:"degraded,omitempty"`
+	OverBudget bool             `json:"over_budget,omitempty"`
+}
+
+// OverheadAction is one step the governor took.
+type OverheadAction struct {
+	OffsetMs float64 `json:"offset_ms"`
+	Action   string  `json:"action"`
+	CPUPct   float64 `json:"cpu_pct"`
+}
+
+// overheadBudgetPct is the --overhead-budget-pct default; 0 disables the
+// governor.
+var overheadBudgetPct float64
+
+const (
+	overheadInterval = time.Second
+	// overheadCooldown is how many samples the governor waits after acting,
+	// so the effect shows before it acts again.
+	overheadCooldown = 3
+	maxSlowdown      = 8
+	// overheadSmoothing weighs the newest sample in the moving average.
+	overheadSmoothing = 0.5
+)
+
+// Sampling tickers of the periodic monitors are paced: the governor
+// stretches all of their periods by the current slowdown factor.
+var pacing = struct {
+	sync.Mutex
+	slowdown int
+	tickers  map[*time.Ticker]time.Duration
+}{slowdown: 1, tickers: map[*time.Ticker]time.Duration{}}
+
+func newPacedTicker(d time.Duration) *time.Ticker {
+	pacing.Lock()
+	defer pacing.Unlock()
+	t := time.NewTicker(d * time.Duration(pacing.slowdown))
+	pacing.tickers[t] = d
+	return t
+}
+
+func stopPacedTicker(t *time.Ticker) {
+	pacing.Lock()
+	defer pacing.Unlock()
+	delete(pacing.tickers, t)
+	t.Stop()
+}
+
+func setSlowdown(factor int) {
+	pacing.Lock()
+	defer pacing.Unlock()
+	pacing.slowdown = factor
+	for t, d := range pacing.tickers {
+		t.Reset(d * time.Duration(factor))
+	}
+}
+
+// cpuTicks returns the user+system ticks each process has used so far.
+func cpuTicks(pids []int) map[int]uint64 {
+	ticks := make(map[int]uint64, len(pids))
+	for _, pid := range pids {
+		if c, ok := readThreadCounters(filepath.Join("/proc", strconv.Itoa(pid))); ok {
+			ticks[pid] = c.cpuTicks
+		}
+	}
+	return ticks
+}
+
+type overheadGovernor struct {
+	collectors *collectorSet
+	started    time.Time
+	stop       chan struct{}
+	done       chan struct{}
+
+	mu        sync.Mutex
+	data      OverheadData
+	last      map[int]uint64
+	lastAt    time.Time
+	totalEMA  float64
+	pluginEMA map[string]float64
+	cooldown  int
+	samples   int
+	sum       float64
+}
+
+func startOverheadGovernor(budgetPct float64, collectors *collectorSet) *overheadGovernor {
+	g := &overheadGovernor{
+		collectors: collectors,
+		started:    time.Now(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		data:       OverheadData{BudgetPct: budgetPct, Slowdown: 1},
+		pluginEMA:  map[string]float64{},
+	}
+	g.last, g.lastAt = cpuTicks(g.pids(procTable())), time.Now()
+	go g.loop()
+	return g
+}
+
+// pids are the agent itself and the plugin and bpftrace processes it
+// started, with their children. The agent's other children, the scenario
+// workloads among them, are not collection and do not count.
+func (g *overheadGovernor) pids(table map[int]procInfo) []int {
+	spawned := &Target{PIDs: bpftracePIDs()}
+	for _, pid := range g.collectors.processes() {
+		spawned.PIDs = append(spawned.PIDs, pid)
+	}
+	return append([]int{os.Getpid()}, spawned.resolveIn(table)...)
+}
+
+func (g *overheadGovernor) loop() {
+	defer close(g.done)
+	ticker := time.NewTicker(overheadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			g.sample()
+		}
+	}
+}
+
+func (g *overheadGovernor) sample() {
+	now := time.Now()
+	table := procTable()
+	all := g.pids(table)
+	ticks := cpuTicks(all)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	elapsedMs := float64(now.Sub(g.lastAt).Microseconds()) / 1000
+	if elapsedMs <= 0 {
+		return
+	}
+	pct := func(pids ...int) float64 {
+		var delta uint64
+		for _, pid := range pids {
+			// A process that appeared since the last sample counts from zero.
+			if cur, prev := ticks[pid], g.last[pid]; cur > prev {
+				delta += cur - prev
+			}
+		}
+		return float64(delta) * 1000 / clockTicks / elapsedMs * 100
+	}
+
+	total := pct(all...)
+	for name, pid := range g.collectors.processes() {
+		tree := (&Target{PIDs: []int{pid}}).resolveIn(table)
+		g.pluginEMA[name] = ema(g.pluginEMA[name], pct(tree...), g.samples == 0)
+	}
+	g.last, g.lastAt = ticks, now
+
+	g.totalEMA = ema(g.totalEMA, total, g.samples == 0)
+	g.samples++
+	g.sum += total
+	g.data.PeakCPUPct = max(g.data.PeakCPUPct, total)
+
+	if g.cooldown > 0 {
+		g.cooldown--
+		return
+	}
+	if g.totalEMA > g.data.BudgetPct {
+		g.degrade(now)
+	}
+}
+
+func ema(prev, cur float64, first bool) float64 {
+	if first {
+		return cur
+	}
+	return prev + overheadSmoothing*(cur-prev)
+}
+
+// degrade takes the step expected to save the most: stopping the costliest
+// plugin when it uses at least as much CPU as the agent itself, otherwise
+// halving the sampling rate, and past maxSlowdown stopping plugins anyway.
+func (g *overheadGovernor) degrade(now time.Time) {
+	cpu := g.totalEMA
+	var costliest string
+	var pluginsPct float64
+	for name, p := range g.pluginEMA {
+		pluginsPct += p
+		if costliest == "" || p > g.pluginEMA[costliest] {
+			costliest = name
+		}
+	}
+	selfPct := g.totalEMA - pluginsPct
+
+	var action string
+	switch {
+	case costliest != "" && (g.pluginEMA[costliest] >= selfPct || g.data.Slowdown >= maxSlowdown):
+		if g.collectors.stopEarly(costliest) {
+			action = fmt.Sprintf("stopped collector %s (%.1f%% cpu)", costliest, g.pluginEMA[costliest])
+		}
+		// Its share is gone at once; the average should not wait for it.
+		g.totalEMA = max(g.totalEMA-g.pluginEMA[costliest], 0)
+		delete(g.pluginEMA, costliest)
+	case g.data.Slowdown < maxSlowdown:
+		g.data.Slowdown *= 2
+		setSlowdown(g.data.Slowdown)
+		action = fmt.Sprintf("sampling slowed %dx", g.data.Slowdown)
+	case !g.data.OverBudget:
+		g.data.OverBudget = true
+		action = "over budget with every collector at its lowest rate"
+	}
+	if action == "" {
+		return
+	}
+
+	g.data.Degraded = append(g.data.Degraded, OverheadAction{
+		OffsetMs: float64(now.Sub(g.started).Microseconds()) / 1000,
+		Action:   action,
+		CPUPct:   cpu,
+	})
+	g.cooldown = overheadCooldown
+	log.Printf("Overhead %.1f%% over budget %.1f%%: %s", cpu, g.data.BudgetPct, action)
+}
+
+func (g *overheadGovernor) Stop() *OverheadData {
+	if g == nil {
+		return nil
+	}
+	close(g.stop)
+	<-g.done
+	setSlowdown(1)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	data := g.data
+	if g.samples > 0 {
+		data.MeanCPUPct = g.sum / float64(g.samples)
+	}
+	return &data
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A scenario declares the parameters a job may set, such as a dataset
+// segment, a block count or a thread count, so one spec covers many sizes
+// of a benchmark. Templates read them as {{.Params.<name>}}; dataset_path
+// and blocks are templates too. A job's params, with the defaults of those
+// it left out, are recorded with its runs.
+
+// ParamSpec declares one scenario parameter. A parameter without a default
+// must be given.
+type ParamSpec struct {
+	Default     *string `yaml:"default,omitempty" json:"default,omitempty"`
+	Description string  `yaml:"description,omitempty" json:"description,omitempty"`
+	// Pattern, when set, is a regular expression every value must match
+	// whole.
+	Pattern string `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+}
+
+const (
+	maxParams        = 32
+	maxParamValueLen = 256
+)
+
+func (p ParamSpec) check(name, value string) error {
+	if len(value) > maxParamValueLen {
+		return fmt.Errorf("param %s: value longer than %d bytes", name, maxParamValueLen)
+	}
+	if p.Pattern != "" && !regexp.MustCompile(`^(?:`+p.Pattern+`)$`).MatchString(value) {
+		return fmt.Errorf("param %s: %q does not match %s", name, value, p.Pattern)
+	}
+	return nil
+}
+
+func validateParamSpecs(params map[string]ParamSpec) error {
+	if len(params) > maxParams {
+		return fmt.Errorf("%d params, at most %d allowed", len(params), maxParams)
+	}
+	for name, p := range params {
+		if !measurementName.MatchString(name) {
+			return fmt.Errorf("invalid param name %q: must match %s", name, measurementName)
+		}
+		if p.Pattern != "" {
+			if _, err := regexp.Compile(p.Pattern); err != nil {
+				return fmt.Errorf("param %s: pattern: %w", name, err)
+			}
+		}
+		if p.Default != nil {
+			if err := p.check(name, *p.Default); err != nil {
+				return fmt.Errorf("default: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveParams checks a job's params against the scenario's declarations
+// and fills in the defaults of those left out.
+func resolveParams(spec *ScenarioSpec, given map[string]string) (map[string]string, error) {
+	for name := range given {
+		if _, ok := spec.Params[name]; !ok {
+			return nil, fmt.Errorf("scenario %s has no param %q (has %s)", spec.Name, name, paramNames(spec.Params))
+		}
+	}
+	if len(spec.Params) == 0 {
+		return nil, nil
+	}
+	resolved := make(map[string]string, len(spec.Params))
+	for name, p := range spec.Params {
+		value, ok := given[name]
+		if !ok {
+			if p.Default == nil {
+				return nil, fmt.Errorf("scenario %s: param %s is required", spec.Name, name)
+			}
+			value = *p.Default
+		}
+		if err := p.check(name, value); err != nil {
+			return nil, err
+		}
+		resolved[name] = value
+	}
+	return resolved, nil
+}
+
+func paramNames(params map[string]ParamSpec) string {
+	if len(params) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// validateRunParams checks params given to a session directly, which no
+// scenario declares.
+func validateRunParams(params map[string]string) error {
+	if len(params) > maxParams {
+		return fmt.Errorf("%d params, at most %d allowed", len(params), maxParams)
+	}
+	for name, value := range params {
+		if !measurementName.MatchString(name) {
+			return fmt.Errorf("invalid param name %q: must match %s", name, measurementName)
+		}
+		if len(value) > maxParamValueLen {
+			return fmt.Errorf("param %s: value longer than %d bytes", name, maxParamValueLen)
+		}
+	}
+	return nil
+}
+
+// intTemplate is a whole number in a scenario spec that may instead be a
+// template, e.g. blocks: "{{.Params.blocks}}".
+type intTemplate string
+
+func (t *intTemplate) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: want a number or a template", node.Line)
+	}
+	*t = intTemplate(node.Value)
+	return nil
+}
+
+// MarshalJSON writes a literal number as one.
+func (t intTemplate) MarshalJSON() ([]byte, error) {
+	if n, err := strconv.Atoi(string(t)); err == nil {
+		return json.Marshal(n)
+	}
+	return json.Marshal(string(t))
+}
+
+func (t *intTemplate) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*t = intTemplate(strconv.Itoa(n))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*t = intTemplate(s)
+	return nil
+}
+
+func (t intTemplate) render(vars scenarioVars) (int, error) {
+	if t == "" {
+		return 0, nil
+	}
+	text, err := renderTemplate(string(t), vars)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a whole number", text)
+	}
+	return n, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The ringbuf variants of the native collectors stream every event: their
+// BPF programs write one fixed-size record per event to a ring buffer, which the agent drains in batches and aggregates on a
+// few worker goroutines. When every batch is in flight the reader stops
+// draining, so the ring fills and the kernel drops, and counts, what does
+// not fit, rather than the agent buffering without bound.
+
+const (
+	pipelineBatchRecords = 4096
+	pipelineBatches      = 8
+	// pipelinePollInterval is how often an empty ring is checked again;
+	// programs submit without waking the reader, which would cost a wakeup
+	// per event.
+	pipelinePollInterval = 10 * time.Millisecond
+	// defaultRingKB is the ring buffer size, unless the collector's ring_kb
+	// option sets another.
+	defaultRingKB = 16 * 1024
+)
+
+// PipelineStats accounts for a native collector's events. The batch and
+// ring fields are those of the ring buffer variants.
+type PipelineStats struct {
+	Events uint64 `json:"events"`
+	// Dropped counts events the kernel could not record: the ring buffer,
+	// or an aggregating variant's map, was full.
+	Dropped uint64  `json:"dropped"`
+	DropPct float64 `json:"drop_pct"`
+	Batches uint64  `json:"batches,omitempty"`
+	// Stalls counts the times the reader waited for a worker to free a
+	// batch, i.e. aggregation was the bottleneck.
+	Stalls  uint64 `json:"stalls,omitempty"`
+	RingKB  int    `json:"ring_kb,omitempty"`
+	Workers int    `json:"workers,omitempty"`
+}
+
+var (
+	pipelineEvents = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "chainbench_ebpf_events_total",
+			Help: "Events native eBPF collectors counted",
+		},
+		[]string{"collector", "scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+	)
+	pipelineDropped = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "chainbench_ebpf_dropped_events_total",
+			Help: "Events native eBPF collectors lost to a full ring buffer or map",
+		},
+		[]string{"collector", "scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+	)
+)
+
+// eventSource yields fixed-size event records, such as a BPF ring buffer.
+type eventSource interface {
+	// read appends the whole records waiting, up to batch's capacity, and
+	// returns at once.
+	read(batch []byte) []byte
+	// dropped counts the records lost before the agent could read them.
+	dropped() uint64
+	// detach stops new records, so the rest can be drained.
+	detach()
+	close()
+}
+
+// eventShard aggregates the records one worker saw.
+type eventShard interface {
+	add(record []byte)
+}
+
+// eventPipeline drains a source into per-worker shards.
+type eventPipeline struct {
+	source     eventSource
+	recordSize int
+	shards     []eventShard
+
+	free chan []byte
+	full chan []byte
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	events, batches, stalls atomic.Uint64
+	stats                   PipelineStats
+}
+
+func newEventPipeline(source eventSource, recordSize, workers int, newShard func() eventShard) *eventPipeline {
+	if workers <= 0 {
+		workers = min(runtime.GOMAXPROCS(0), 4)
+	}
+	p := &eventPipeline{
+		source:     source,
+		recordSize: recordSize,
+		free:       make(chan []byte, pipelineBatches),
+		full:       make(chan []byte, pipelineBatches),
+		stop:       make(chan struct{}),
+	}
+	p.stats.Workers = workers
+	for i := 0; i < pipelineBatches; i++ {
+		p.free <- make([]byte, 0, pipelineBatchRecords*recordSize)
+	}
+	for i := 0; i < workers; i++ {
+		shard := newShard()
+		p.shards = append(p.shards, shard)
+		p.wg.Add(1)
+		go p.work(shard)
+	}
+	p.wg.Add(1)
+	go p.drain()
+	return p
+}
+
+// drain moves records from the source to the workers until stopped, then
+// takes what is left.
+func (p *eventPipeline) drain() {
+	defer p.wg.Done()
+	defer close(p.full)
+	ticker := time.NewTicker(pipelinePollInterval)
+	defer ticker.Stop()
+	stopping := false
+	for {
+		var batch []byte
+		select {
+		case batch = <-p.free:
+		default:
+			p.stalls.Add(1)
+			batch = <-p.free
+		}
+		batch = p.source.read(batch[:0])
+		if len(batch) > 0 {
+			p.batches.Add(1)
+			p.full <- batch
+			continue
+		}
+		p.free <- batch
+		if stopping {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			stopping = true
+		}
+	}
+}
+
+func (p *eventPipeline) work(shard eventShard) {
+	defer p.wg.Done()
+	for batch := range p.full {
+		for off := 0; off+p.recordSize <= len(batch); off += p.recordSize {
+			shard.add(batch[off : off+p.recordSize])
+		}
+		p.events.Add(uint64(len(batch) / p.recordSize))
+		p.free <- batch
+	}
+}
+
+// Stop detaches the source, drains what is left, waits for the workers and
+// closes the source.
+// The shards are complete once it returns.
+func (p *eventPipeline) Stop() *PipelineStats {
+	p.source.detach()
+	close(p.stop)
+	p.wg.Wait()
+	stats := p.stats
+	stats.Events = p.events.Load()
+	stats.Batches = p.batches.Load()
+	stats.Stalls = p.stalls.Load()
+	stats.Dropped = p.source.dropped()
+	p.source.close()
+	stats.setDropPct()
+	return &stats
+}
+
+// Record layouts the native programs write: an exec is the new program's
+// name, NUL-padded; a syscall its number.
+const (
+	execRecordSize    = 16
+	syscallRecordSize = 8
+	// maxSyscallNr bounds the syscall numbers counted, above every
+	// architecture's table.
+	maxSyscallNr = 1024
+)
+
+// ringbufRun is a native collector's probe and the pipeline draining it.
+type ringbufRun struct {
+	name     string
+	probe    *ringbufProbe
+	pipeline *eventPipeline
+}
+
+// startRingbuf loads the collector's probe and starts draining it, with the
+// ring_kb and workers options.
+func startRingbuf(name string, opts CollectorOptions, pids []int) (*ringbufRun, error) {
+	ringKB := opts.count("ring_kb", defaultRingKB)
+	probe, err := startRingbufProbe(name, ringKB, pids)
+	if err != nil {
+		return nil, err
+	}
+	var recordSize int
+	var newShard func() eventShard
+	switch name {
+	case "exec":
+		recordSize, newShard = execRecordSize, func() eventShard { return execShard{} }
+	case "syscalls":
+		recordSize, newShard = syscallRecordSize, func() eventShard { return make(syscallShard, maxSyscallNr) }
+	}
+	r := &ringbufRun{name: name, probe: probe}
+	r.pipeline = newEventPipeline(probe, recordSize, opts.count("workers", 0), newShard)
+	r.pipeline.stats.RingKB = ringSize(ringKB) / 1024
+	return r, nil
+}
+
+func (r *ringbufRun) setPIDs(pids []int) error {
+	return r.probe.setPIDs(pids)
+}
+
+// Stop drains the ring and merges what the workers counted.
+func (r *ringbufRun) Stop() (*bpftraceOutput, *PipelineStats) {
+	stats := r.pipeline.Stop()
+	return nativeOutput(r.name, r.pipeline.shards), stats
+}
+
+// ringSize rounds the ring_kb option up to the power of two of pages the
+// kernel wants.
+func ringSize(kb int) int {
+	if kb <= 0 {
+		kb = defaultRingKB
+	}
+	size := max(kb*1024, os.Getpagesize())
+	return 1 << bits.Len(uint(size-1))
+}
+
+func (s *PipelineStats) setDropPct() {
+	if total := s.Events + s.Dropped; total > 0 {
+		s.DropPct = float64(s.Dropped) / float64(total) * 100
+	}
+}
+
+// execShard counts execs by the new program's name.
+type execShard map[string]float64
+
+func (s execShard) add(record []byte) {
+	s.addN(record, 1)
+}
+
+func (s execShard) addN(comm []byte, n float64) {
+	if end := bytes.IndexByte(comm, 0); end >= 0 {
+		comm = comm[:end]
+	}
+	s[string(comm)] += n
+}
+
+// syscallShard counts syscalls by number.
+type syscallShard []float64
+
+func (s syscallShard) add(record []byte) {
+	if nr := binary.NativeEndian.Uint64(record); nr < uint64(len(s)) {
+		s[nr]++
+	}
+}
+
+// nativeOutput merges a native collector's shards into the maps its
+// bpftrace script would have printed, so both variants are collected alike.
+func nativeOutput(name string, shards []eventShard) *bpftraceOutput {
+	out := &bpftraceOutput{hists: map[string][]HistogramBucket{}, maps: map[string]map[string]float64{}}
+	switch name {
+	case "exec":
+		execs := map[string]float64{}
+		for _, shard := range shards {
+			for comm, n := range shard.(execShard) {
+				execs[comm] += n
+			}
+		}
+		out.maps["execs"] = execs
+	case "syscalls":
+		counts := map[string]float64{}
+		for syscall, nr := range syscallNumbers[runtime.GOARCH] {
+			for _, shard := range shards {
+				counts[syscall] += shard.(syscallShard)[nr]
+			}
+		}
+		out.maps["syscalls"] = counts
+	}
+	return out
+}
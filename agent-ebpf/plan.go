@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Plan recommends how many runs a comparison needs, from how much runs
+// like it have varied before. Each series of stored runs, one impl,
+// variant, commit, dataset and machine, gives its coefficient of variation;
+// the series' variances are pooled, so differences between impls or
+// machines do not count as noise. The recommendation is for two sides of
+// equal size, compared at Confidence with Power, to detect a change of
+// TargetEffectPct; it is at least gainMinSamples a side.
+type Plan struct {
+	Scenario        string       `json:"scenario"`
+	Metric          string       `json:"metric,omitempty"`
+	TargetEffectPct float64      `json:"target_effect_pct"`
+	Confidence      float64      `json:"confidence"`
+	Power           float64      `json:"power"`
+	Runs            int          `json:"runs"`
+	CVPct           float64      `json:"cv_pct"`
+	RunsPerSide     int          `json:"runs_per_side"`
+	Series          []PlanSeries `json:"series"`
+}
+
+// PlanSeries is one series' history and what it alone would need.
+type PlanSeries struct {
+	Impl        string  `json:"impl"`
+	Variant     string  `json:"variant"`
+	Commit      string  `json:"commit"`
+	Dataset     string  `json:"dataset"`
+	Machine     string  `json:"machine"`
+	Runs        int     `json:"runs"`
+	CVPct       float64 `json:"cv_pct"`
+	RunsPerSide int     `json:"runs_per_side"`
+}
+
+// A plan looks at the latest planDefaultRuns successful runs unless its
+// query says how many.
+const planDefaultRuns = 200
+
+// runsPerSide is how many runs each of two sides needs for a two-sided
+// test at confidence to find a change of effectPct with power, when runs
+// vary by cvPct. It is the normal approximation for a difference of means,
+// raised by a twentieth for the rank tests the agent uses, whose
+// efficiency is 3/π of the t-test's on normal data.
+func runsPerSide(cvPct, effectPct, confidence, power float64) int {
+	z := normalQuantile(1-(1-confidence)/2) + normalQuantile(power)
+	n := 2 * z * z * cvPct * cvPct / (effectPct * effectPct) / (3 / math.Pi)
+	return max(gainMinSamples, int(math.Ceil(n)))
+}
+
+// newPlan works out the plan from the runs' history.
+func newPlan(scenario, metric string, runs []*Run, effectPct, confidence, power float64) (*Plan, error) {
+	type key struct{ impl, variant, commit, dataset, machine string }
+	values := map[key][]float64{}
+	for _, run := range runs {
+		v := benchmarkMs(run)
+		ok := v > 0
+		if metric != "" {
+			v, ok = run.Evidence.Measurements[metric]
+		}
+		if !ok {
+			continue
+		}
+		k := key{run.Impl, run.Variant, run.Commit, run.Dataset, run.Machine}
+		values[k] = append(values[k], v)
+	}
+
+	p := &Plan{Scenario: scenario, Metric: metric, TargetEffectPct: effectPct, Confidence: confidence, Power: power}
+	var pooled, weight float64
+	for k, vs := range values {
+		if len(vs) < 2 {
+			continue
+		}
+		cv := coefficientOfVariation(vs)
+		p.Series = append(p.Series, PlanSeries{
+			Impl: k.impl, Variant: k.variant, Commit: k.commit, Dataset: k.dataset, Machine: k.machine,
+			Runs: len(vs), CVPct: cv, RunsPerSide: runsPerSide(cv, effectPct, confidence, power),
+		})
+		p.Runs += len(vs)
+		pooled += float64(len(vs)-1) * cv * cv
+		weight += float64(len(vs) - 1)
+	}
+	if weight == 0 {
+		return nil, fmt.Errorf("no series of scenario %s has two runs to learn its variance from", scenario)
+	}
+	p.CVPct = math.Sqrt(pooled / weight)
+	p.RunsPerSide = runsPerSide(p.CVPct, effectPct, confidence, power)
+	sort.Slice(p.Series, func(i, j int) bool { return p.Series[i].RunsPerSide > p.Series[j].RunsPerSide })
+	return p, nil
+}
+
+// handlePlan answers GET /plan?scenario=X&target_effect=5%. The runs looked
+// at may be narrowed like a GET /runs query; metric names a measurement to
+// plan for instead of the benchmark duration, and confidence (0.95) and
+// power (0.8) set the test.
+func handlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	if values.Get("scenario") == "" {
+		http.Error(w, "scenario is required", http.StatusBadRequest)
+		return
+	}
+	number := func(name string, def float64) (float64, error) {
+		s := strings.TrimSuffix(values.Get(name), "%")
+		values.Del(name)
+		if s == "" {
+			return def, nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s", name)
+		}
+		return v, nil
+	}
+	effect, err := number("target_effect", 0)
+	if err == nil && effect <= 0 {
+		err = fmt.Errorf("target_effect is required, as a percentage such as 5%%")
+	}
+	confidence, power := gainDefaultConfidence, gainPower
+	if err == nil {
+		confidence, err = number("confidence", confidence)
+	}
+	if err == nil {
+		power, err = number("power", power)
+	}
+	if err == nil && (confidence <= 0 || confidence >= 1 || power <= 0 || power >= 1) {
+		err = fmt.Errorf("confidence and power must be between 0 and 1")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metric := values.Get("metric")
+	values.Del("metric")
+
+	q, err := parseRunQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !values.Has("limit") {
+		q.Limit = planDefaultRuns
+	}
+	if !values.Has("result") {
+		q.Results = []string{resultSuccess}
+	}
+	scopeQuery(q, requestScope(r))
+	summaries, _, err := store.Query(q)
+	if errors.Is(err, errBadCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	runs := make([]*Run, 0, len(summaries))
+	for _, s := range summaries {
+		run, err := store.Get(s.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if usableRun(run) {
+			runs = append(runs, run)
+		}
+	}
+	plan, err := newPlan(values.Get("scenario"), metric, runs, effect, confidence, power)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestRunsPerSide(t *testing.T) {
+	tests := []struct {
+		cvPct, effectPct, confidence, power float64
+		want                                int
+	}{
+		// 2 (z(0.975) + z(0.8))² (10/5)² π/3 = 65.75
+		{10, 5, 0.95, 0.8, 66},
+		{20, 5, 0.95, 0.8, 264},
+		{5, 2, 0.95, 0.8, 103},
+		{10, 5, 0.99, 0.9, 125},
+		// Never fewer than a comparison needs.
+		{1, 50, 0.95, 0.8, gainMinSamples},
+	}
+	for _, tt := range tests {
+		if got := runsPerSide(tt.cvPct, tt.effectPct, tt.confidence, tt.power); got != tt.want {
+			t.Errorf("runsPerSide(%g, %g, %g, %g) = %d, want %d", tt.cvPct, tt.effectPct, tt.confidence, tt.power, got, tt.want)
+		}
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	run := func(impl string, ms float64) *Run {
+		return &Run{Scenario: "block-import", Impl: impl, DurationMs: ms, Evidence: &Evidence{}}
+	}
+	runs := []*Run{
+		run("geth", 100), run("geth", 110), run("geth", 90),
+		run("reth", 200), run("reth", 240), run("reth", 160), run("reth", 200),
+		// A series of one run says nothing about variance.
+		run("erigon", 500),
+	}
+	p, err := newPlan("block-import", "", runs, 5, 0.95, 0.8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Series) != 2 {
+		t.Fatalf("%d series, want 2: %+v", len(p.Series), p.Series)
+	}
+	if p.Runs != 7 {
+		t.Errorf("runs = %d, want 7", p.Runs)
+	}
+	// The series' CVs, 10% and 16.33%, pooled by their degrees of freedom.
+	if !near(p.CVPct, 14.1421356, 1e-6) {
+		t.Errorf("pooled CV = %.7f%%, want 14.1421356%%", p.CVPct)
+	}
+	if p.RunsPerSide != 132 {
+		t.Errorf("runs per side = %d, want 132", p.RunsPerSide)
+	}
+	// The noisiest series comes first.
+	if s := p.Series[0]; s.Impl != "reth" || s.RunsPerSide != 176 || !near(s.CVPct, 16.3299316, 1e-6) {
+		t.Errorf("first series = %+v, want reth at 16.33%% needing 176", s)
+	}
+	if s := p.Series[1]; s.Impl != "geth" || s.RunsPerSide != 66 || !near(s.CVPct, 10, 1e-9) {
+		t.Errorf("second series = %+v, want geth at 10%% needing 66", s)
+	}
+
+	if _, err := newPlan("block-import", "", runs[7:], 5, 0.95, 0.8); err == nil {
+		t.Error("a plan from single runs did not fail")
+	}
+}
+
+func TestNewPlanMetric(t *testing.T) {
+	run := func(measurements map[string]float64) *Run {
+		return &Run{Impl: "geth", DurationMs: 1000, Evidence: &Evidence{Measurements: measurements}}
+	}
+	runs := []*Run{
+		run(map[string]float64{"mgas_per_s": 50}),
+		run(map[string]float64{"mgas_per_s": 55}),
+		run(map[string]float64{"mgas_per_s": 45}),
+		run(nil),
+	}
+	p, err := newPlan("block-import", "mgas_per_s", runs, 5, 0.95, 0.8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Runs != 3 || !near(p.CVPct, 10, 1e-9) || p.RunsPerSide != 66 {
+		t.Errorf("plan = %d runs at %g%% needing %d, want 3 at 10%% needing 66", p.Runs, p.CVPct, p.RunsPerSide)
+	}
+}
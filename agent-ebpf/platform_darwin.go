@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// macOS has no adjtimex and no cgroups; the clock section is left out and
+// side-by-side runs are not isolated.
+
+func readKernelClock() (clockSample, bool) {
+	return clockSample{}, false
+}
+
+func startInCgroup(cmd *exec.Cmd, dir *os.File) {}
+
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = cancelWaitDelay
+}
+
+func freeDiskBytes(path string) uint64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+	return st.Bavail * uint64(st.Bsize)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Platform hooks; the darwin and windows builds have degraded versions.
+
+// Kernel NTP status bits (timex.h).
+const (
+	staUnsync = 0x0040
+	staNano   = 0x2000
+)
+
+func readKernelClock() (clockSample, bool) {
+	var tx syscall.Timex
+	if _, err := syscall.Adjtimex(&tx); err != nil {
+		return clockSample{}, false
+	}
+	offset := float64(tx.Offset) / 1000 // µs
+	if tx.Status&staNano != 0 {
+		offset /= 1000
+	}
+	return clockSample{
+		offsetMs: offset,
+		// Frequency is in ppm with a 16-bit fractional part.
+		freqPPM:  float64(tx.Freq) / 65536,
+		maxErrMs: float64(tx.Maxerror) / 1000,
+		synced:   tx.Status&staUnsync == 0,
+	}, true
+}
+
+// startInCgroup makes cmd start inside the cgroup directory dir.
+func startInCgroup(cmd *exec.Cmd, dir *os.File) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(dir.Fd())}
+}
+
+// killGroupOnCancel starts cmd in a process group of its own and kills the
+// whole group when its context ends, so children still holding its output
+// die with it. Call it after startInCgroup.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = cancelWaitDelay
+}
+
+func freeDiskBytes(path string) uint64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+	return st.Bavail * uint64(st.Bsize)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// Windows has no adjtimex and no cgroups; the clock section is left out and
+// side-by-side runs are not isolated.
+
+func readKernelClock() (clockSample, bool) {
+	return clockSample{}, false
+}
+
+func startInCgroup(cmd *exec.Cmd, dir *os.File) {}
+
+// killGroupOnCancel only bounds the wait: Windows has no process groups to
+// kill, so children of cmd outlive it.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.WaitDelay = cancelWaitDelay
+}
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func freeDiskBytes(path string) uint64 {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0
+	}
+	var free uint64
+	if r, _, _ := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0
+	}
+	return free
+}
@@ -0,0 +1,107 @@
+package main
+
+import "runtime"
+
+// PMUData is what the CPU's performance counters saw over the window,
+// summed over all CPUs.
+type PMUData struct {
+	Arch     string       `json:"arch"`
+	CPU      string       `json:"cpu,omitempty"`
+	Counters []PMUCounter `json:"counters"`
+	IPC      float64      `json:"ipc,omitempty"`
+	// FrontendStallPct and BackendStallPct are stall cycles as a share of
+	// all cycles, where the PMU counts them.
+	FrontendStallPct float64 `json:"frontend_stall_pct,omitempty"`
+	BackendStallPct  float64 `json:"backend_stall_pct,omitempty"`
+	// Unsupported lists events this CPU's PMU would not count.
+	Unsupported []string `json:"unsupported,omitempty"`
+}
+
+type PMUCounter struct {
+	Event string `json:"event"`
+	Value uint64 `json:"value"`
+	// Scaled is set when the event shared its counter with others and the
+	// value was extrapolated from the time it was counting.
+	Scaled bool `json:"scaled,omitempty"`
+}
+
+// pmuEvent is a generic perf hardware event (Raw false) or a raw event
+// number of the CPU's own PMU.
+type pmuEvent struct {
+	Name   string
+	Raw    bool
+	Config uint64
+}
+
+// Generic hardware event ids (perf_event.h).
+const (
+	hwCPUCycles             = 0
+	hwInstructions          = 1
+	hwCacheMisses           = 3
+	hwBranchMisses          = 5
+	hwStalledCyclesFrontend = 7
+	hwStalledCyclesBackend  = 8
+)
+
+var genericPMUEvents = []pmuEvent{
+	{Name: "cycles", Config: hwCPUCycles},
+	{Name: "instructions", Config: hwInstructions},
+	{Name: "cache_misses", Config: hwCacheMisses},
+	{Name: "branch_misses", Config: hwBranchMisses},
+}
+
+// armPMUv3Events are common architectural events every Armv8 PMU numbers
+// the same way, which the kernel does not map to generic stall events.
+var armPMUv3Events = []pmuEvent{
+	{Name: "l1d_cache_refill", Raw: true, Config: 0x03},
+	{Name: "l2d_cache_refill", Raw: true, Config: 0x17},
+	{Name: "stall_frontend", Raw: true, Config: 0x23},
+	{Name: "stall_backend", Raw: true, Config: 0x24},
+}
+
+// neoverseEvents adds events Neoverse cores implement beyond the common set:
+// last-level read misses on all of them, and on the Armv9 ones the memory
+// share of backend stalls.
+var neoverseEvents = map[string][]pmuEvent{
+	"Neoverse-N1": {{Name: "ll_cache_miss_rd", Raw: true, Config: 0x37}},
+	"Neoverse-V1": {{Name: "ll_cache_miss_rd", Raw: true, Config: 0x37}},
+	"Neoverse-N2": {{Name: "ll_cache_miss_rd", Raw: true, Config: 0x37}, {Name: "stall_backend_mem", Raw: true, Config: 0x4005}},
+	"Neoverse-V2": {{Name: "ll_cache_miss_rd", Raw: true, Config: 0x37}, {Name: "stall_backend_mem", Raw: true, Config: 0x4005}},
+}
+
+// pmuEvents returns the events to count on this architecture and CPU. x86
+// CPUs that count stalls do so through the generic events; RISC-V raw event
+// numbers are vendor-specific, so only the generic ones the SBI PMU maps
+// are used there.
+func pmuEvents(arch, cpu string) []pmuEvent {
+	events := append([]pmuEvent(nil), genericPMUEvents...)
+	switch arch {
+	case "amd64":
+		events = append(events,
+			pmuEvent{Name: "stall_frontend", Config: hwStalledCyclesFrontend},
+			pmuEvent{Name: "stall_backend", Config: hwStalledCyclesBackend})
+	case "arm64":
+		events = append(events, armPMUv3Events...)
+		events = append(events, neoverseEvents[cpu]...)
+	}
+	return events
+}
+
+// summarize fills in the derived ratios from the counters.
+func (d *PMUData) summarize() {
+	values := map[string]uint64{}
+	for _, c := range d.Counters {
+		values[c.Event] = c.Value
+	}
+	cycles := float64(values["cycles"])
+	if cycles == 0 {
+		return
+	}
+	d.IPC = float64(values["instructions"]) / cycles
+	d.FrontendStallPct = float64(values["stall_frontend"]) / cycles * 100
+	d.BackendStallPct = float64(values["stall_backend"]) / cycles * 100
+}
+
+func newPMUData() *PMUData {
+	return &PMUData{Arch: runtime.GOARCH, CPU: cpuModel()}
+}
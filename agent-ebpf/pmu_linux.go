@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// pmuCounters counts the PMU events system-wide, one perf event per event
+// and online CPU. That needs CAP_PERFMON or kernel.perf_event_paranoid <= 0.
+type pmuCounters struct {
+	data   *PMUData
+	events []pmuEvent
+	// fds holds each event's per-CPU file descriptors.
+	fds [][]int
+}
+
+// onlineCPUs lists the host's online CPUs. The agent's own affinity mask
+// does not matter, since the counters are opened per CPU, not per task.
+func onlineCPUs() ([]int, error) {
+	set, err := parseCPUList(readTrimmed("/sys/devices/system/cpu/online"))
+	if err != nil {
+		return nil, err
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no online CPUs in /sys/devices/system/cpu/online")
+	}
+	cpus := make([]int, 0, len(set))
+	for cpu := range set {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+func startPMUCounters() (*pmuCounters, error) {
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	p := &pmuCounters{data: newPMUData()}
+	var lastErr error
+	for _, event := range pmuEvents(p.data.Arch, p.data.CPU) {
+		attr := unix.PerfEventAttr{
+			Type:        unix.PERF_TYPE_HARDWARE,
+			Config:      event.Config,
+			Size:        uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+			Read_format: unix.PERF_FORMAT_TOTAL_TIME_ENABLED | unix.PERF_FORMAT_TOTAL_TIME_RUNNING,
+		}
+		if event.Raw {
+			attr.Type = unix.PERF_TYPE_RAW
+		}
+		var fds []int
+		var err error
+		for _, cpu := range cpus {
+			var fd int
+			if fd, err = unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC); err != nil {
+				break
+			}
+			fds = append(fds, fd)
+		}
+		if err != nil {
+			for _, fd := range fds {
+				unix.Close(fd)
+			}
+			if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+				p.close()
+				return nil, fmt.Errorf("perf_event_open: %v (needs CAP_PERFMON or kernel.perf_event_paranoid <= 0)", err)
+			}
+			// ENOENT or EOPNOTSUPP: this PMU does not have the event.
+			lastErr = err
+			p.data.Unsupported = append(p.data.Unsupported, event.Name)
+			continue
+		}
+		p.events = append(p.events, event)
+		p.fds = append(p.fds, fds)
+	}
+	if len(p.events) == 0 {
+		return nil, fmt.Errorf("no PMU events available on %s: %v", p.data.Arch, lastErr)
+	}
+	return p, nil
+}
+
+func (p *pmuCounters) close() {
+	for _, fds := range p.fds {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+	p.fds = nil
+}
+
+// Stop reads and closes the counters.
+func (p *pmuCounters) Stop() *PMUData {
+	if p == nil {
+		return nil
+	}
+	defer p.close()
+	buf := make([]byte, 24)
+	for i, event := range p.events {
+		counter := PMUCounter{Event: event.Name}
+		for _, fd := range p.fds[i] {
+			if n, err := unix.Read(fd, buf); err != nil || n < len(buf) {
+				continue
+			}
+			value := binary.NativeEndian.Uint64(buf[0:])
+			enabled := binary.NativeEndian.Uint64(buf[8:])
+			running := binary.NativeEndian.Uint64(buf[16:])
+			if running > 0 && running < enabled {
+				value = uint64(float64(value) * float64(enabled) / float64(running))
+				counter.Scaled = true
+			}
+			counter.Value += value
+		}
+		p.data.Counters = append(p.data.Counters, counter)
+	}
+	p.data.summarize()
+	return p.data
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+type pmuCounters struct{}
+
+func startPMUCounters() (*pmuCounters, error) {
+	return nil, fmt.Errorf("PMU counters need Linux perf events, not %s", runtime.GOOS)
+}
+
+func (p *pmuCounters) Stop() *PMUData {
+	return nil
+}
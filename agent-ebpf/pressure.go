@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PressureData is the host's pressure stall information (PSI) over the
+// window: for CPU, I/O and memory, how long some task was stalled waiting
+// for it and, for I/O and memory, how long all of them were at once. It is
+// the plainest sign that the machine was oversubscribed during the run,
+// whatever the cause.
+type PressureData struct {
+	Resources      []PressureResource `json:"resources"`
+	Oversubscribed bool               `json:"oversubscribed"`
+	Reasons        []string           `json:"reasons,omitempty"`
+}
+
+// PressureResource is one resource's stalls. The percentages are shares of
+// the window; PeakSomeAvg10 is the highest 10-second average the kernel
+// reported, which shows a burst the window's mean dilutes.
+type PressureResource struct {
+	Resource      string  `json:"resource"`
+	SomeUs        uint64  `json:"some_us"`
+	FullUs        uint64  `json:"full_us"`
+	SomePct       float64 `json:"some_pct"`
+	FullPct       float64 `json:"full_pct"`
+	PeakSomeAvg10 float64 `json:"peak_some_avg10"`
+}
+
+// pressureSomePct is the share of the window any resource may have had
+// tasks stalled on it before the host counts as oversubscribed.
+var pressureSomePct = 10.0
+
+const pressureInterval = time.Second
+
+// pressureResources are the files under /proc/pressure, in report order.
+var pressureResources = []string{"cpu", "io", "memory"}
+
+// readPressureAvg10 returns the "some" line's avg10 of a PSI file.
+func readPressureAvg10(path string) (float64, bool) {
+	line, _, _ := strings.Cut(readTrimmed(path), "\n")
+	for _, field := range strings.Fields(line) {
+		if avg, ok := strings.CutPrefix(field, "avg10="); ok {
+			v, err := strconv.ParseFloat(avg, 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+// pressureMonitor takes deltas of /proc/pressure over the window and
+// samples the 10-second averages for their peak.
+type pressureMonitor struct {
+	interval time.Duration
+	somePct  float64
+	started  time.Time
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu          sync.Mutex
+	first, last cgroupCounters
+	peak        map[string]float64
+}
+
+func startPressureMonitor(interval time.Duration, somePct float64) *pressureMonitor {
+	m := &pressureMonitor{
+		interval: interval,
+		somePct:  somePct,
+		started:  time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		peak:     map[string]float64{},
+	}
+	m.sample()
+	go m.loop()
+	return m
+}
+
+func (m *pressureMonitor) loop() {
+	defer close(m.done)
+	ticker := newPacedTicker(m.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+func (m *pressureMonitor) sample() {
+	counters := cgroupCounters{}
+	avg10 := map[string]float64{}
+	for _, resource := range pressureResources {
+		path := filepath.Join("/proc/pressure", resource)
+		readPressure(path, counters, resource+".")
+		if v, ok := readPressureAvg10(path); ok {
+			avg10[resource] = v
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(counters) == 0 {
+		return
+	}
+	if m.first == nil {
+		m.first = counters
+	}
+	m.last = counters
+	for resource, v := range avg10 {
+		m.peak[resource] = max(m.peak[resource], v)
+	}
+}
+
+// Stop returns the window's stalls, or nil on kernels without PSI (before
+// 4.20, or booted with psi=0).
+func (m *pressureMonitor) Stop() *PressureData {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	m.sample()
+	windowUs := float64(time.Since(m.started).Microseconds())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.first == nil {
+		return nil
+	}
+	delta := func(key string) uint64 {
+		if m.last[key] < m.first[key] {
+			return 0
+		}
+		return m.last[key] - m.first[key]
+	}
+	data := &PressureData{Resources: []PressureResource{}}
+	for _, resource := range pressureResources {
+		if _, ok := m.first[resource+".some"]; !ok {
+			continue
+		}
+		r := PressureResource{
+			Resource:      resource,
+			SomeUs:        delta(resource + ".some"),
+			FullUs:        delta(resource + ".full"),
+			PeakSomeAvg10: m.peak[resource],
+		}
+		if windowUs > 0 {
+			r.SomePct = float64(r.SomeUs) / windowUs * 100
+			r.FullPct = float64(r.FullUs) / windowUs * 100
+		}
+		if r.SomePct > m.somePct {
+			data.Reasons = append(data.Reasons, fmt.Sprintf("%s pressure %.1f%% of the window (threshold %.1f%%)", resource, r.SomePct, m.somePct))
+		}
+		data.Resources = append(data.Resources, r)
+	}
+	data.Oversubscribed = len(data.Reasons) > 0
+	return data
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ProbeResult says whether one collector started and stopped cleanly.
+type ProbeResult struct {
+	Collector  string  `json:"collector"`
+	OK         bool    `json:"ok"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// ProbeReport answers POST /start?dry_run=true.
+type ProbeReport struct {
+	OK         bool          `json:"ok"`
+	Collectors []ProbeResult `json:"collectors"`
+}
+
+// probeWindow is how long each collector runs during a probe.
+const probeWindow = 200 * time.Millisecond
+
+// probeCollectors starts each collector the request selects for probeWindow,
+// all at once, and reports which produced evidence. It does not touch the
+// running session, if any.
+func probeCollectors(req StartRequest) *ProbeReport {
+	target := req.Target
+	if target.empty() {
+		target = defaultTarget
+	}
+
+	var names []string
+	if req.Collectors != nil {
+		for name := range req.Collectors {
+			names = append(names, name)
+		}
+	} else {
+		for name := range coreCollectors {
+			// Without a target a session does not run these either.
+			if target.empty() && (name == "compaction" || name == "cgroups" || name == "threads" || name == "sockets" || name == "files") {
+				continue
+			}
+			names = append(names, name)
+		}
+		names = append(names, collectorNames()...)
+	}
+	sort.Strings(names)
+
+	report := &ProbeReport{OK: true, Collectors: make([]ProbeResult, len(names))}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			opts, _ := collectorEnabled(req.Collectors, name)
+			start := time.Now()
+			err := probeCollector(name, opts, target)
+			result := ProbeResult{
+				Collector:  name,
+				OK:         err == nil,
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			report.Collectors[i] = result
+		}(i, name)
+	}
+	wg.Wait()
+
+	for _, result := range report.Collectors {
+		report.OK = report.OK && result.OK
+	}
+	return report
+}
+
+func probeCollector(name string, opts CollectorOptions, target *Target) error {
+	if ebpfMatrix[name] != nil {
+		return probeEBPF(name, opts, target)
+	}
+
+	switch name {
+	case "noise":
+		m := startNoiseMonitor(opts.duration("interval", noiseInterval), opts.number("steal_pct", noiseStealPct))
+		time.Sleep(probeWindow)
+		m.Stop()
+		return nil
+	case "thermal":
+		m := startThermalMonitor(opts.duration("interval", thermalInterval))
+		time.Sleep(probeWindow)
+		if m.Stop() == nil {
+			return fmt.Errorf("no cpufreq or package temperature sensors")
+		}
+		return nil
+	case "gpu":
+		m := startGPUMonitor(opts.duration("interval", gpuInterval))
+		time.Sleep(probeWindow)
+		if m.Stop() == nil {
+			return fmt.Errorf("no NVIDIA GPU through nvidia-smi and no amdgpu device")
+		}
+		return nil
+	case "pmu":
+		p, err := startPMUCounters()
+		if err != nil {
+			return err
+		}
+		time.Sleep(probeWindow)
+		p.Stop()
+		return nil
+	case "clock":
+		m := startClockMonitor(opts.duration("interval", clockInterval))
+		time.Sleep(probeWindow)
+		m.Stop(nil)
+		if !m.available {
+			return fmt.Errorf("kernel clock state unavailable (adjtimex failed)")
+		}
+		return nil
+	case "pressure":
+		m := startPressureMonitor(opts.duration("interval", pressureInterval), opts.number("some_pct", pressureSomePct))
+		time.Sleep(probeWindow)
+		if m.Stop() == nil {
+			return fmt.Errorf("no pressure stall information (kernel before 4.20 or booted with psi=0)")
+		}
+		return nil
+	case "swap":
+		if _, ok := readSwapCounters("/proc/vmstat")["pswpin"]; !ok {
+			return fmt.Errorf("no swap counters in /proc/vmstat")
+		}
+		return nil
+	case "compaction", "cgroups", "threads", "sockets", "files":
+		if target.empty() {
+			return fmt.Errorf("needs a target")
+		}
+		scope := startTargetScope(target, map[string]CollectorOptions{name: opts})
+		time.Sleep(probeWindow)
+		var e Evidence
+		scope.Stop(&e)
+		if len(e.Target.Processes) == 0 {
+			return fmt.Errorf("target %s matched no processes", target)
+		}
+		if name == "cgroups" && len(e.Cgroups) == 0 {
+			return fmt.Errorf("no cgroup v2 accounting for target %s", target)
+		}
+		if name == "threads" && e.Threads == nil {
+			return fmt.Errorf("no schedstat for the threads of target %s", target)
+		}
+		if name == "sockets" && e.Sockets == nil {
+			return fmt.Errorf("no network counters for target %s", target)
+		}
+		if name == "files" && e.Files == nil {
+			return fmt.Errorf("cannot read the open files of target %s", target)
+		}
+		return nil
+	}
+
+	t, ok := getCollectorType(name)
+	if !ok {
+		return fmt.Errorf("unknown collector %q", name)
+	}
+	c := t.New()
+	if err := c.Supported(); err != nil {
+		return err
+	}
+	if cfg, ok := c.(configurable); ok && len(opts) > 0 {
+		if err := cfg.Configure(opts); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), sessionIDKey{}, "probe"))
+	defer cancel()
+	if err := c.Start(ctx, target); err != nil {
+		return err
+	}
+	time.Sleep(probeWindow)
+	_, err := c.Stop()
+	return err
+}
+
+// probeEBPF runs the variant a session would pick for the collector, so a
+// script bpftrace rejects or a program the kernel refuses to load fails the
+// probe with the error it gave. A script counts from the moment bpftrace
+// has attached it, however long compiling took.
+func probeEBPF(name string, opts CollectorOptions, target *Target) error {
+	variant, err := selectVariant(name, opts)
+	if err != nil {
+		return err
+	}
+	pids := target.resolve()
+	if native(name, variant) {
+		run, err := startNative(name, variant, opts, pids)
+		if err != nil {
+			return fmt.Errorf("%s: %w", variant, err)
+		}
+		time.Sleep(probeWindow)
+		run.Stop()
+		return nil
+	}
+	run, _, err := startBPFTrace(name, variant, pids)
+	if err != nil {
+		return fmt.Errorf("%s: %w", variant, err)
+	}
+	if err := run.waitAttached(bpftraceAttachTimeout); err != nil {
+		return err
+	}
+	time.Sleep(probeWindow)
+	_, err = run.Stop()
+	return err
+}
+
+func newProbeCmd(dataDir *string) *cobra.Command {
+	var (
+		agent      string
+		pluginDir  string
+		collectors []string
+		target     string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "probe",
+		Short: "Check which collectors can run on this host",
+		Long: "Starts each collector briefly and reports which succeed, locally or with\n" +
+			"--agent on a running agent (POST /start?dry_run=true). Exits non-zero if any fail.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := StartRequest{Scenario: "probe"}
+			if len(collectors) > 0 {
+				req.Collectors = map[string]CollectorOptions{}
+				for _, name := range collectors {
+					req.Collectors[name] = nil
+				}
+			}
+			if target != "" {
+				t, err := parseTarget(target)
+				if err != nil {
+					return err
+				}
+				req.Target = t
+			}
+
+			var report *ProbeReport
+			if agent == "" {
+				if pluginDir == "" {
+					pluginDir = filepath.Join(*dataDir, "plugins")
+				}
+				if err := loadPlugins(pluginDir); err != nil {
+					return err
+				}
+				if err := validateCollectors(req.Collectors); err != nil {
+					return err
+				}
+				report = probeCollectors(req)
+			} else {
+				body, err := json.Marshal(req)
+				if err != nil {
+					return err
+				}
+				if err := requireFeature(cmd.Context(), agent, "dry-run"); err != nil {
+					return err
+				}
+				url := strings.TrimSuffix(agent, "/") + "/start?dry_run=true"
+				httpReq, err := http.NewRequestWithContext(cmd.Context(), http.MethodPost, url, bytes.NewReader(body))
+				if err != nil {
+					return err
+				}
+				httpReq.Header.Set("Content-Type", "application/json")
+				authorize(httpReq)
+				resp, err := http.DefaultClient.Do(httpReq)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					msg, _ := io.ReadAll(resp.Body)
+					return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+				}
+				report = &ProbeReport{}
+				if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+					return err
+				}
+			}
+
+			out := cmd.OutOrStdout()
+			for _, result := range report.Collectors {
+				if result.OK {
+					fmt.Fprintf(out, "ok    %s\n", result.Collector)
+				} else {
+					fmt.Fprintf(out, "FAIL  %s: %s\n", result.Collector, result.Error)
+				}
+			}
+			if !report.OK {
+				return fmt.Errorf("some collectors cannot run")
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&agent, "agent", "", "Probe a running agent (e.g. http://localhost:9090) instead of this host")
+	cmd.Flags().StringVar(&pluginDir, "plugin-dir", "", "Directory of exec collector plugins (default <data-dir>/plugins)")
+	cmd.Flags().StringSliceVar(&collectors, "collectors", nil, "Only probe these collectors (default all)")
+	cmd.Flags().StringVar(&target, "target", "", "Target for per-process collectors as kind:value selectors")
+
+	return cmd
+}
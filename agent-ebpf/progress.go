@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProgressRule reads a long workload's progress from its output. The regex
+// either captures a percentage in a group named percent, or the work done
+// in a group named done (or the first group) and optionally the total in
+// one named total. Without a total group, Total is a template over
+// scenarioVars, e.g. "{{.Blocks}}".
+type ProgressRule struct {
+	Regex string `yaml:"regex" json:"regex"`
+	Total string `yaml:"total,omitempty" json:"total,omitempty"`
+}
+
+// ProgressData is how far the running session's workload has got.
+type ProgressData struct {
+	Done    float64 `json:"done,omitempty"`
+	Total   float64 `json:"total,omitempty"`
+	Percent float64 `json:"percent"`
+	// ETASeconds extrapolates the rate since the session started.
+	ETASeconds float64   `json:"eta_seconds,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// progressInterval limits how often progress parsed from output is
+// recorded.
+const progressInterval = time.Second
+
+var runProgress = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_run_progress",
+		Help: "Fraction (0-1) of the running session's work done, from workload output or /sessions/{id}/progress",
+	},
+	[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"},
+)
+
+func (r *ProgressRule) validate() error {
+	re, err := regexp.Compile(r.Regex)
+	if err != nil {
+		return fmt.Errorf("progress: %w", err)
+	}
+	if re.SubexpIndex("percent") < 0 && re.NumSubexp() == 0 {
+		return fmt.Errorf("progress: regex has no capture group")
+	}
+	return nil
+}
+
+// Progress records the session's progress, given as a percentage or as
+// work done out of a total. A zero total keeps the last one reported.
+func (c *EvidenceCollector) Progress(sessionID string, done, total, percent float64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running || sessionID != c.sessionID {
+		return errSessionNotFound
+	}
+
+	p := ProgressData{Done: done, Total: total, Percent: percent, UpdatedAt: time.Now().UTC()}
+	if p.Total == 0 && c.progress != nil {
+		p.Total = c.progress.Total
+	}
+	if p.Percent == 0 && p.Total > 0 {
+		p.Percent = p.Done / p.Total * 100
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		p.Percent = min(max(p.Percent, 0), 100)
+	}
+	c.progress = &p
+	c.publish()
+
+	runProgress.WithLabelValues(
+		c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project,
+	).Set(p.Percent / 100)
+	return nil
+}
+
+// withETA returns a copy of p with its ETA, extrapolated from the rate
+// since the session started.
+func (p ProgressData) withETA(startedAt time.Time) *ProgressData {
+	if p.Percent > 0 && p.Percent < 100 {
+		elapsed := p.UpdatedAt.Sub(startedAt).Seconds()
+		remaining := elapsed*(100-p.Percent)/p.Percent - time.Since(p.UpdatedAt).Seconds()
+		p.ETASeconds = max(remaining, 0)
+	}
+	return &p
+}
+
+// progressParser applies a ProgressRule to output lines.
+type progressParser struct {
+	re    *regexp.Regexp
+	total float64
+}
+
+func newProgressParser(rule *ProgressRule, vars scenarioVars) (*progressParser, error) {
+	if rule == nil {
+		return nil, nil
+	}
+	p := &progressParser{re: regexp.MustCompile(rule.Regex)}
+	if rule.Total != "" {
+		rendered, err := renderTemplate(rule.Total, vars)
+		if err != nil {
+			return nil, fmt.Errorf("progress total: %w", err)
+		}
+		if p.total, err = strconv.ParseFloat(strings.TrimSpace(rendered), 64); err != nil {
+			return nil, fmt.Errorf("progress total %q: %w", rendered, err)
+		}
+	}
+	return p, nil
+}
+
+// line returns the progress a line reports, if it does.
+func (p *progressParser) line(line string) (done, total, percent float64, ok bool) {
+	m := p.re.FindStringSubmatch(line)
+	if m == nil {
+		return 0, 0, 0, false
+	}
+	number := func(name string, fallback int) (float64, bool) {
+		i := p.re.SubexpIndex(name)
+		if i < 0 {
+			i = fallback
+		}
+		if i < 0 || i >= len(m) || m[i] == "" {
+			return 0, false
+		}
+		v, err := strconv.ParseFloat(strings.ReplaceAll(m[i], ",", ""), 64)
+		return v, err == nil
+	}
+	if percent, ok := number("percent", -1); ok {
+		return 0, 0, percent, true
+	}
+	done, ok = number("done", 1)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	total, _ = number("total", -1)
+	if total == 0 {
+		total = p.total
+	}
+	return done, total, 0, true
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+// A shared lab serves several teams, each in its own project. Sessions,
+// jobs, matrices, runs, gains and events belong to the project they were
+// created in, and metrics carry it as a label. With --tokens every request
+// needs a bearer token, and a token bound to a project sees and writes only
+// that project; a lab-wide token ("*") sees them all and picks one with
+// the X-ChainBench-Project header. Without --tokens nothing is enforced:
+// requests pick a project with the header, and see every project unless
+// they do.
+const (
+	defaultProject = "default"
+	allProjects    = "*"
+	projectHeader  = "X-ChainBench-Project"
+)
+
+// Agents and the CLI authenticate to other agents with these.
+const (
+	tokenEnv   = "CHAINBENCH_TOKEN"
+	projectEnv = "CHAINBENCH_PROJECT"
+)
+
+var projectName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ProjectToken binds a bearer token to a project, or to every project, and
+// to a role.
+type ProjectToken struct {
+	// Name identifies the token's holder in logs and errors.
+	Name    string `yaml:"name"`
+	Token   string `yaml:"token"`
+	Project string `yaml:"project"`
+	// Role is viewer, runner or admin; see defaultRole when empty.
+	Role string `yaml:"role"`
+}
+
+// projectTokens is the --tokens file. Nil disables authentication.
+var projectTokens []ProjectToken
+
+func loadProjectTokens(path string) ([]ProjectToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tokens []ProjectToken `yaml:"tokens"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(file.Tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	seen := map[string]bool{}
+	for i, t := range file.Tokens {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("%s: token %d has no name", path, i+1)
+		case len(t.Token) < 16:
+			return nil, fmt.Errorf("%s: token %s is shorter than 16 characters", path, t.Name)
+		case seen[t.Token]:
+			return nil, fmt.Errorf("%s: token %s is given twice", path, t.Name)
+		case t.Project != allProjects && !projectName.MatchString(t.Project):
+			return nil, fmt.Errorf("%s: token %s: invalid project %q", path, t.Name, t.Project)
+		case t.Role != "" && !slices.Contains(roles, t.Role):
+			return nil, fmt.Errorf("%s: token %s: unknown role %q (want one of %s)", path, t.Name, t.Role, strings.Join(roles, ", "))
+		}
+		if t.Role == "" {
+			file.Tokens[i].Role = defaultRole(t.Project)
+		}
+		seen[t.Token] = true
+	}
+	return file.Tokens, nil
+}
+
+// caller is who a request acts for.
+type caller struct {
+	// name is the token's name; empty without --tokens.
+	name string
+	// scope is the one project the caller sees and writes to, or empty to
+	// see every project.
+	scope string
+	// labWide callers may act on the whole lab: drain it, upgrade it or
+	// edit its machine catalog.
+	labWide bool
+	// role bounds what the caller may do; see requiredRole.
+	role string
+}
+
+type callerKey struct{}
+
+// requestCaller returns the caller authenticate found for r.
+func requestCaller(r *http.Request) caller {
+	c, _ := r.Context().Value(callerKey{}).(caller)
+	return c
+}
+
+// requestScope is the project a request is confined to, or empty for all.
+func requestScope(r *http.Request) string {
+	return requestCaller(r).scope
+}
+
+// requestProject is the project the work a request creates belongs to.
+func requestProject(r *http.Request) string {
+	if scope := requestScope(r); scope != "" {
+		return scope
+	}
+	return defaultProject
+}
+
+// projectOf names the project of a run, job or event; those created before
+// projects existed are in the default one.
+func projectOf(project string) string {
+	if project == "" {
+		return defaultProject
+	}
+	return project
+}
+
+// inScope reports whether a caller confined to scope may see project.
+func inScope(scope, project string) bool {
+	return scope == "" || scope == projectOf(project)
+}
+
+// outOfScopeError refuses a caller acting on another project's session.
+type outOfScopeError struct {
+	project string
+}
+
+func (e *outOfScopeError) Error() string {
+	return "the running session is in project " + projectOf(e.project)
+}
+
+// authenticate finds the caller from the bearer token and the project
+// header, refusing requests without a valid token when --tokens is set,
+// and those the token's role does not allow. The capabilities and the web
+// UI's files are served to anyone.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		project := strings.TrimSpace(r.Header.Get(projectHeader))
+		if project != "" && !projectName.MatchString(project) {
+			http.Error(w, fmt.Sprintf("invalid project %q", project), http.StatusBadRequest)
+			return
+		}
+		c := caller{scope: project, labWide: true, role: roleAdmin}
+		if projectTokens != nil && !publicPath(r.URL.Path) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			var found *ProjectToken
+			for i := range projectTokens {
+				if ok && subtle.ConstantTimeCompare([]byte(token), []byte(projectTokens[i].Token)) == 1 {
+					found = &projectTokens[i]
+				}
+			}
+			if found == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chainbench"`)
+				http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+				return
+			}
+			c.name, c.labWide, c.role = found.Name, found.Project == allProjects, found.Role
+			if !authorizeRole(w, r, c) {
+				return
+			}
+			if !c.labWide {
+				if project != "" && project != found.Project {
+					http.Error(w, fmt.Sprintf("token %s is for project %s, not %s", found.Name, found.Project, project), http.StatusForbidden)
+					return
+				}
+				c.scope = found.Project
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+	})
+}
+
+func publicPath(path string) bool {
+	if path == "/capabilities" || path == "/" {
+		return true
+	}
+	_, err := fs.Stat(webAssets, "web"+path)
+	return err == nil
+}
+
+// requireLabWide answers 403 to callers confined to one project.
+func requireLabWide(w http.ResponseWriter, r *http.Request) bool {
+	if requestCaller(r).labWide {
+		return true
+	}
+	http.Error(w, "this needs a lab-wide token", http.StatusForbidden)
+	return false
+}
+
+// authorize adds $CHAINBENCH_TOKEN and $CHAINBENCH_PROJECT, when set, to a
+// request to another agent.
+func authorize(req *http.Request) {
+	if token := os.Getenv(tokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if project := os.Getenv(projectEnv); project != "" {
+		req.Header.Set(projectHeader, project)
+	}
+}
+
+// scopeQuery confines q to a project, leaving it matching nothing if it
+// asks for other projects only.
+func scopeQuery(q *RunQuery, scope string) {
+	if scope == "" {
+		return
+	}
+	if asked, ok := q.Labels["project"]; ok && !slices.Contains(asked, scope) {
+		q.Labels["project"] = []string{}
+		return
+	}
+	q.Labels["project"] = []string{scope}
+}
+
+var metricsHandler = promhttp.Handler()
+
+// handleMetrics serves /metrics, leaving out the series of other projects
+// for callers confined to one.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	scope := requestScope(r)
+	if scope == "" {
+		metricsHandler.ServeHTTP(w, r)
+		return
+	}
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		kept := families[:0]
+		for _, family := range families {
+			metrics := family.Metric[:0]
+			for _, m := range family.Metric {
+				if project, ok := metricLabel(m, "project"); !ok || project == scope {
+					metrics = append(metrics, m)
+				}
+			}
+			if family.Metric = metrics; len(metrics) > 0 {
+				kept = append(kept, family)
+			}
+		}
+		return kept, err
+	})
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+func metricLabel(m *dto.Metric, name string) (string, bool) {
+	for _, label := range m.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TxObservations are the local arrival and inclusion times of every
+// transaction a node announced while an observer was running. Times are the
+// agent's wall clock, so cross-machine figures are only as good as NTP.
+type TxObservations struct {
+	Seen     map[string]time.Time   `json:"seen"`
+	Included map[string]TxInclusion `json:"included"`
+}
+
+type TxInclusion struct {
+	At    time.Time `json:"at"`
+	Block uint64    `json:"block"`
+}
+
+type txObserver struct {
+	client   *rpcClient
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu  sync.Mutex
+	obs TxObservations
+	// touched is when the coordinator last asked for the observer; it is
+	// guarded by observersMu.
+	touched time.Time
+}
+
+// An observer whose coordinator has not asked for it within observerIdle is
+// presumed abandoned and stopped; at most maxObservers run at once.
+const (
+	observerIdle = time.Hour
+	maxObservers = 32
+)
+
+var (
+	observersMu sync.Mutex
+	observers   = map[string]*txObserver{}
+)
+
+// expireObservers removes the observers idle for longer than observerIdle
+// and returns them to be stopped. Callers hold observersMu.
+func expireObservers(now time.Time) []*txObserver {
+	var expired []*txObserver
+	for id, o := range observers {
+		if now.Sub(o.touched) > observerIdle {
+			delete(observers, id)
+			expired = append(expired, o)
+			log.Printf("Propagation %s: observer idle for %s, stopping", id, observerIdle)
+		}
+	}
+	return expired
+}
+
+func startTxObserver(rpcURL string, interval time.Duration) (*txObserver, error) {
+	o := &txObserver{
+		client:   newRPCClient(rpcURL, 10*time.Second),
+		interval: interval,
+		done:     make(chan struct{}),
+		obs:      TxObservations{Seen: map[string]time.Time{}, Included: map[string]TxInclusion{}},
+		touched:  time.Now(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+
+	pending, err := o.newFilter(ctx, "eth_newPendingTransactionFilter")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	blocks, err := o.newFilter(ctx, "eth_newBlockFilter")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go o.loop(ctx, pending, blocks)
+	return o, nil
+}
+
+func (o *txObserver) newFilter(ctx context.Context, method string) (string, error) {
+	raw, err := o.client.Call(ctx, method, nil)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	if err := json.Unmarshal(raw, &id); err != nil {
+		return "", fmt.Errorf("%s: %w", method, err)
+	}
+	return id, nil
+}
+
+func (o *txObserver) changes(ctx context.Context, filter string) ([]string, error) {
+	raw, err := o.client.Call(ctx, "eth_getFilterChanges", []interface{}{filter})
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	err = json.Unmarshal(raw, &hashes)
+	return hashes, err
+}
+
+func (o *txObserver) loop(ctx context.Context, pending, blocks string) {
+	defer close(o.done)
+	defer func() {
+		for _, filter := range []string{pending, blocks} {
+			o.client.Call(context.Background(), "eth_uninstallFilter", []interface{}{filter})
+		}
+	}()
+
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := o.poll(ctx, pending, blocks); err != nil && ctx.Err() == nil {
+			log.Printf("Transaction observer: %v", err)
+		}
+	}
+}
+
+func (o *txObserver) poll(ctx context.Context, pending, blocks string) error {
+	hashes, err := o.changes(ctx, pending)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	o.mu.Lock()
+	for _, hash := range hashes {
+		hash = strings.ToLower(hash)
+		if _, ok := o.obs.Seen[hash]; !ok {
+			o.obs.Seen[hash] = now
+		}
+	}
+	o.mu.Unlock()
+
+	blockHashes, err := o.changes(ctx, blocks)
+	if err != nil {
+		return err
+	}
+	for _, blockHash := range blockHashes {
+		raw, err := o.client.Call(ctx, "eth_getBlockByHash", []interface{}{blockHash, false})
+		if err != nil {
+			return err
+		}
+		var block struct {
+			Number       string   `json:"number"`
+			Transactions []string `json:"transactions"`
+		}
+		if err := json.Unmarshal(raw, &block); err != nil {
+			return fmt.Errorf("eth_getBlockByHash: %w", err)
+		}
+		number, _ := parseHexUint(block.Number)
+
+		o.mu.Lock()
+		for _, hash := range block.Transactions {
+			hash = strings.ToLower(hash)
+			if _, ok := o.obs.Included[hash]; !ok {
+				o.obs.Included[hash] = TxInclusion{At: now, Block: number}
+			}
+		}
+		o.mu.Unlock()
+	}
+	return nil
+}
+
+func (o *txObserver) snapshot() TxObservations {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := TxObservations{Seen: map[string]time.Time{}, Included: map[string]TxInclusion{}}
+	for hash, at := range o.obs.Seen {
+		out.Seen[hash] = at
+	}
+	for hash, inc := range o.obs.Included {
+		out.Included[hash] = inc
+	}
+	return out
+}
+
+func (o *txObserver) stop() TxObservations {
+	o.cancel()
+	<-o.done
+	return o.snapshot()
+}
+
+func stopObservers(observers []*txObserver) {
+	for _, o := range observers {
+		o.stop()
+	}
+}
+
+// handlePropagation serves the observing side of a propagation scenario:
+// POST /propagation/{id} starts watching the local node, GET returns what has
+// been seen so far and DELETE stops the observer and returns the final set.
+func handlePropagation(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/propagation/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			RPCURL       string `json:"rpc_url"`
+			PollInterval string `json:"poll_interval"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		interval, err := parseOptionalDuration(req.PollInterval, 100*time.Millisecond)
+		if err != nil || interval <= 0 {
+			http.Error(w, "invalid poll_interval", http.StatusBadRequest)
+			return
+		}
+
+		// The lookup and the insert happen under one lock, so two POSTs
+		// for the same id cannot both start an observer.
+		observersMu.Lock()
+		expired := expireObservers(time.Now())
+		if observers[id] != nil {
+			observersMu.Unlock()
+			stopObservers(expired)
+			http.Error(w, "observer already running", http.StatusConflict)
+			return
+		}
+		if len(observers) >= maxObservers {
+			observersMu.Unlock()
+			stopObservers(expired)
+			http.Error(w, "too many observers running", http.StatusServiceUnavailable)
+			return
+		}
+		o, err := startTxObserver(req.RPCURL, interval)
+		if err == nil {
+			observers[id] = o
+		}
+		observersMu.Unlock()
+		stopObservers(expired)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Printf("Propagation %s: observing %s", id, req.RPCURL)
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "observing"})
+	case http.MethodGet, http.MethodDelete:
+		observersMu.Lock()
+		now := time.Now()
+		o := observers[id]
+		if o != nil {
+			if r.Method == http.MethodDelete {
+				delete(observers, id)
+			} else {
+				o.touched = now
+			}
+		}
+		expired := expireObservers(now)
+		observersMu.Unlock()
+		stopObservers(expired)
+		if o == nil {
+			http.Error(w, "observer not found", http.StatusNotFound)
+			return
+		}
+		var obs TxObservations
+		if r.Method == http.MethodDelete {
+			obs = o.stop()
+		} else {
+			obs = o.snapshot()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(obs)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// agentCall makes a JSON request to another agent's API.
+func agentCall(ctx context.Context, method, url string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(apiVersionHeader, strconv.Itoa(apiVersion))
+	authorize(req)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// RunQuery selects, orders and pages stored runs for GET /runs and the runs
+// command. Labels and tags are answered from the index's posting lists; the
+// other filters are checked on the summaries they leave.
+type RunQuery struct {
+	// Labels maps a run label to the values it may have.
+	Labels map[string][]string
+	// Classes maps a machine class name to the classes the run's machine
+	// may be in; see MachineClasses.
+	Classes  map[string][]string
+	Tags     map[string]*string
+	Since    time.Time
+	Until    time.Time
+	Valid    *bool
+	Verdicts []string
+	Results  []string
+	// Sort is "created", "duration" or "gain"; Desc orders largest first.
+	Sort string
+	Desc bool
+	// Limit is the page size: defaultRunQueryLimit when 0, and at most
+	// maxRunQueryLimit.
+	Limit  int
+	Cursor string
+}
+
+// runSorts are the orders a query may ask for, each with the key it sorts
+// by; runs without the key sort last either way.
+var runSorts = map[string]func(*RunSummary) (float64, bool){
+	"created": func(s *RunSummary) (float64, bool) {
+		return float64(s.CreatedAt.UnixMicro()), true
+	},
+	"duration": func(s *RunSummary) (float64, bool) {
+		return s.DurationMs, s.DurationMs > 0
+	},
+	"gain": func(s *RunSummary) (float64, bool) {
+		if s.GainPct == nil {
+			return 0, false
+		}
+		return *s.GainPct, true
+	},
+}
+
+var runVerdicts = []string{verdictOK, verdictDegraded, verdictNoisy, verdictAnomalous, verdictInvalid}
+
+// defaultRunQueryLimit is the page size of a query without a limit, and
+// maxRunQueryLimit caps a page.
+const (
+	defaultRunQueryLimit = 100
+	maxRunQueryLimit     = 1000
+)
+
+// parseRunQuery reads a query from URL parameters: a run label name with
+// its value (repeated for any of several), a machine class name with its
+// class (likewise), tag=key[=value], since and until
+// (RFC 3339 or an age such as 7d), valid, verdict, result, sort (created, duration,
+// gain; "-" prefix for descending, default -created), limit and cursor.
+func parseRunQuery(values url.Values) (*RunQuery, error) {
+	q := &RunQuery{Labels: map[string][]string{}, Sort: "created", Desc: true}
+	for _, label := range runLabelNames {
+		if v := values[label]; len(v) > 0 {
+			q.Labels[label] = v
+		}
+	}
+	for _, class := range machineClassNames {
+		if v := values[class]; len(v) > 0 {
+			if q.Classes == nil {
+				q.Classes = map[string][]string{}
+			}
+			q.Classes[class] = v
+		}
+	}
+
+	var err error
+	if q.Tags, err = parseTagFilters(values["tag"]); err != nil {
+		return nil, err
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := values.Get(bound.name); v != "" {
+			if *bound.t, err = parseQueryTime(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", bound.name, err)
+			}
+		}
+	}
+	if v := values.Get("valid"); v != "" {
+		valid, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid valid %q", v)
+		}
+		q.Valid = &valid
+	}
+	for _, verdict := range values["verdict"] {
+		if !slices.Contains(runVerdicts, verdict) {
+			return nil, fmt.Errorf("unknown verdict %q (want one of %s)", verdict, strings.Join(runVerdicts, ", "))
+		}
+		q.Verdicts = append(q.Verdicts, verdict)
+	}
+	for _, result := range values["result"] {
+		if !slices.Contains(runResults, result) {
+			return nil, fmt.Errorf("unknown result %q (want one of %s)", result, strings.Join(runResults, ", "))
+		}
+		q.Results = append(q.Results, result)
+	}
+	if v := values.Get("sort"); v != "" {
+		q.Sort, q.Desc = strings.TrimPrefix(v, "-"), strings.HasPrefix(v, "-")
+		if runSorts[q.Sort] == nil {
+			return nil, fmt.Errorf("unknown sort %q (want created, duration or gain)", q.Sort)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	q.Cursor = values.Get("cursor")
+	return q, nil
+}
+
+// parseQueryTime accepts RFC 3339 times and ages before now, e.g. 7d.
+func parseQueryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	age, err := parseAge(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor an age", s)
+	}
+	return time.Now().Add(-age), nil
+}
+
+// runCursor marks where a page ended: the sort key and id of its last run,
+// so the next page starts after it even if that run was since removed.
+type runCursor struct {
+	Sort   string  `json:"s"`
+	Desc   bool    `json:"d,omitempty"`
+	Key    float64 `json:"k"`
+	HasKey bool    `json:"h,omitempty"`
+	ID     string  `json:"id"`
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+func (c runCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeRunCursor(s string) (*runCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c runCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+// Query returns one page of runs matching q and, when more follow, the
+// cursor for the next page.
+func (s *RunStore) Query(q *RunQuery) ([]*RunSummary, string, error) {
+	var after *runCursor
+	if q.Cursor != "" {
+		var err error
+		if after, err = decodeRunCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+		if after.Sort != q.Sort || after.Desc != q.Desc {
+			return nil, "", fmt.Errorf("%w: it continues a query sorted by %s", errBadCursor, after.Sort)
+		}
+	}
+
+	if len(q.Classes) > 0 {
+		var err error
+		if q, err = s.resolveClasses(q); err != nil {
+			return nil, "", err
+		}
+	}
+
+	s.indexMu.Lock()
+	x, err := s.loadIndex()
+	if err != nil {
+		s.indexMu.Unlock()
+		return nil, "", err
+	}
+	var matched []*RunSummary
+	for _, id := range x.candidates(q) {
+		summary := x.entries[id].Summary
+		if q.matches(summary) {
+			matched = append(matched, summary)
+		}
+	}
+	s.indexMu.Unlock()
+
+	key := runSorts[q.Sort]
+	// before reports whether a run with key (ka, oka) and id ida comes
+	// before one with (kb, okb) and idb.
+	before := func(ka float64, oka bool, ida string, kb float64, okb bool, idb string) bool {
+		if oka != okb {
+			return oka
+		}
+		if ka != kb {
+			return ka < kb != q.Desc
+		}
+		return ida != idb && ida < idb != q.Desc
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		ki, oki := key(matched[i])
+		kj, okj := key(matched[j])
+		return before(ki, oki, matched[i].ID, kj, okj, matched[j].ID)
+	})
+
+	if after != nil {
+		start := sort.Search(len(matched), func(i int) bool {
+			k, ok := key(matched[i])
+			return before(after.Key, after.HasKey, after.ID, k, ok, matched[i].ID)
+		})
+		matched = matched[start:]
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultRunQueryLimit
+	}
+	limit = min(limit, maxRunQueryLimit)
+	if limit >= len(matched) {
+		return matched, "", nil
+	}
+	page := matched[:limit]
+	last := page[len(page)-1]
+	k, ok := key(last)
+	next := runCursor{Sort: q.Sort, Desc: q.Desc, Key: k, HasKey: ok, ID: last.ID}
+	return page, next.encode(), nil
+}
+
+// resolveClasses turns q's machine class filters into a machine filter: the
+// machines in every class asked for, among those q names if it does.
+func (s *RunStore) resolveClasses(q *RunQuery) (*RunQuery, error) {
+	classes, err := s.machineClassesByName()
+	if err != nil {
+		return nil, err
+	}
+	machines := []string{}
+	for name, c := range classes {
+		if len(q.Labels["machine"]) > 0 && !slices.Contains(q.Labels["machine"], name) {
+			continue
+		}
+		in := true
+		for class, values := range q.Classes {
+			if !slices.Contains(values, c.class(class)) {
+				in = false
+			}
+		}
+		if in {
+			machines = append(machines, name)
+		}
+	}
+	resolved := *q
+	resolved.Labels = maps.Clone(q.Labels)
+	if resolved.Labels == nil {
+		resolved.Labels = map[string][]string{}
+	}
+	resolved.Labels["machine"] = machines
+	resolved.Classes = nil
+	return &resolved, nil
+}
+
+// candidates narrows the runs to those the label and tag filters allow,
+// from the posting lists, or returns every run when there are none.
+func (x *runIndex) candidates(q *RunQuery) []string {
+	var sets []map[string]bool
+	for label, values := range q.Labels {
+		union := map[string]bool{}
+		for _, value := range values {
+			for id := range x.postings[postingKey(label, value)] {
+				union[id] = true
+			}
+		}
+		sets = append(sets, union)
+	}
+	for key, value := range q.Tags {
+		if value == nil {
+			sets = append(sets, x.postings[postingKey("tag", key)])
+		} else {
+			sets = append(sets, x.postings[postingKey("tag:"+key, *value)])
+		}
+	}
+
+	if len(sets) == 0 {
+		ids := make([]string, 0, len(x.entries))
+		for id := range x.entries {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	// Intersect starting from the smallest set.
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	var ids []string
+	for id := range sets[0] {
+		inAll := true
+		for _, set := range sets[1:] {
+			if !set[id] {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// matches checks the filters the posting lists do not answer.
+func (q *RunQuery) matches(s *RunSummary) bool {
+	switch {
+	case !q.Since.IsZero() && s.CreatedAt.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !s.CreatedAt.Before(q.Until):
+		return false
+	case q.Valid != nil && s.Valid != *q.Valid:
+		return false
+	case len(q.Verdicts) > 0 && !slices.Contains(q.Verdicts, s.Verdict):
+		return false
+	case len(q.Results) > 0 && !slices.Contains(q.Results, s.Result):
+		return false
+	}
+	return true
+}
+
+func newRunsCmd(dataDir *string) *cobra.Command {
+	var (
+		filters []string
+		asJSON  bool
+		noColor bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "runs",
+		Short: "List stored runs, filtered and sorted",
+		Long: "Queries the run store like GET /runs. Filters are name=value pairs with\n" +
+			"the same names as its parameters, e.g.\n\n" +
+			"  runs --where scenario=block-import --where tag=pr=1234 --where since=7d --where sort=-duration",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			values := url.Values{}
+			for _, filter := range filters {
+				name, value, ok := strings.Cut(filter, "=")
+				if !ok {
+					return fmt.Errorf("--where %q: want name=value", filter)
+				}
+				values.Add(name, value)
+			}
+			if !values.Has("limit") {
+				values.Set("limit", "50")
+			}
+			q, err := parseRunQuery(values)
+			if err != nil {
+				return err
+			}
+
+			s, err := NewRunStore(*dataDir)
+			if err != nil {
+				return err
+			}
+			runs, next, err := s.Query(q)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if asJSON {
+				return json.NewEncoder(out).Encode(map[string]any{"runs": runs, "next_cursor": next})
+			}
+			rows := make([][]string, len(runs))
+			for i, run := range runs {
+				duration, gain := "", ""
+				if run.DurationMs > 0 {
+					duration = fmt.Sprintf("%.0f ms", run.DurationMs)
+				}
+				if run.GainPct != nil {
+					gain = fmt.Sprintf("%+.1f%%", *run.GainPct)
+				}
+				rows[i] = []string{
+					run.ID, run.CreatedAt.Local().Format("2006-01-02 15:04"), run.Scenario,
+					run.Impl + "/" + run.Variant, duration, gain, run.Verdict, run.Result, formatTags(run.Tags),
+				}
+			}
+			t := &termRenderer{w: out, color: !noColor}
+			t.table([]string{"run", "recorded", "scenario", "impl/variant", "duration", "gain", "verdict", "result", "tags"}, rows)
+			if next != "" {
+				fmt.Fprintf(out, "\nmore: --where cursor=%s\n", next)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&filters, "where", "w", nil, "Query parameter as name=value (repeatable)")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the page as JSON")
+	cmd.Flags().BoolVar(&noColor, "no-color", false, "Disable ANSI styling")
+	return cmd
+}
@@ -0,0 +1,28 @@
+package main
+
+// ReadaheadData is how well the kernel's readahead served the target: the
+// pages it read ahead of the target's reads and page faults, and how many
+// of them the target went on to use within the window. Engines that mmap
+// their database are at the mercy of readahead; one that reads ahead far
+// more than it uses wastes disk bandwidth and page cache on every miss.
+type ReadaheadData struct {
+	Pages     uint64 `json:"pages"`
+	UsedPages uint64 `json:"used_pages"`
+	// UnusedPages were read ahead but not touched before the window
+	// ended; some may still be used later, or were evicted unused.
+	UnusedPages uint64 `json:"unused_pages"`
+	// EfficiencyPct is the used share of the pages read ahead.
+	EfficiencyPct float64 `json:"efficiency_pct"`
+}
+
+func (c *EvidenceCollector) collectReadahead(out *bpftraceOutput) *ReadaheadData {
+	data := &ReadaheadData{
+		Pages:     uint64(out.maps["readahead_pages"][""]),
+		UsedPages: uint64(out.maps["readahead_used"][""]),
+	}
+	data.UnusedPages = data.Pages - data.UsedPages
+	if data.Pages > 0 {
+		data.EfficiencyPct = float64(data.UsedPages) / float64(data.Pages) * 100
+	}
+	return data
+}
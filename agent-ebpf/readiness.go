@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server-style workloads run against a node: an rpc-load scenario's load,
+// for one. An adapter's server is that node, started before the session
+// opens and stopped after it closes, and its ready probes hold the session
+// back until the node serves, so neither the measurement window nor the
+// collectors see its start-up. Probes work without a server too, for
+// nodes started some other way. The wait is recorded in the run's
+// readiness evidence.
+
+// ServerSpec is a node run for the length of a job's session. Command
+// arguments and env values are templates over scenarioVars.
+type ServerSpec struct {
+	Command []string          `yaml:"command" json:"command"`
+	Env     map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// StopTimeout is how long the server gets to exit after SIGINT before
+	// it is killed (default 30s).
+	StopTimeout string `yaml:"stop_timeout,omitempty" json:"stop_timeout,omitempty"`
+}
+
+// ReadySpec holds probes that must all pass before the session opens. URLs
+// and addresses are templates over scenarioVars.
+type ReadySpec struct {
+	// HTTP is a URL that must answer 2xx to a GET.
+	HTTP string `yaml:"http,omitempty" json:"http,omitempty"`
+	// TCP is a host:port that must accept connections.
+	TCP string `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+	// Log is a regular expression a line of the server's output must match.
+	Log string `yaml:"log,omitempty" json:"log,omitempty"`
+	// RPC is a JSON-RPC call that must succeed.
+	RPC *ReadyRPC `yaml:"rpc,omitempty" json:"rpc,omitempty"`
+	// Timeout bounds the wait (default 5m); Interval is the time between
+	// attempts (default 1s).
+	Timeout  string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+}
+
+// ReadyRPC is a JSON-RPC readiness call, e.g. eth_syncing expecting false.
+type ReadyRPC struct {
+	// URL defaults to the rpc_url of the adapter, or else of the scenario's
+	// load or sync.
+	URL    string        `yaml:"url,omitempty" json:"url,omitempty"`
+	Method string        `yaml:"method" json:"method"`
+	Params []interface{} `yaml:"params,omitempty" json:"params,omitempty"`
+	// Expect, when set, is the result the call must return.
+	Expect interface{} `yaml:"expect,omitempty" json:"expect,omitempty"`
+}
+
+// ReadinessData is the evidence section of a run whose session waited for
+// its workload to be ready.
+type ReadinessData struct {
+	Probes   []string `json:"probes"`
+	Attempts int      `json:"attempts"`
+	// WaitMs is the time from the server's start, or from when the wait
+	// began without one, until every probe passed.
+	WaitMs float64 `json:"wait_ms"`
+	Server bool    `json:"server,omitempty"`
+}
+
+const (
+	defaultReadyTimeout  = 5 * time.Minute
+	defaultReadyInterval = time.Second
+	defaultServerStop    = 30 * time.Second
+	readyProbeTimeout    = 5 * time.Second
+)
+
+func (s *ServerSpec) validate() error {
+	if len(s.Command) == 0 {
+		return fmt.Errorf("server has no command")
+	}
+	if _, err := parseOptionalDuration(s.StopTimeout, defaultServerStop); err != nil {
+		return fmt.Errorf("server stop_timeout: %w", err)
+	}
+	return nil
+}
+
+func (r *ReadySpec) validate(server *ServerSpec) error {
+	if r.HTTP == "" && r.TCP == "" && r.Log == "" && r.RPC == nil {
+		return fmt.Errorf("ready has no probe (want http, tcp, log or rpc)")
+	}
+	if r.Log != "" {
+		if server == nil {
+			return fmt.Errorf("ready: a log probe needs a server")
+		}
+		if _, err := regexp.Compile(r.Log); err != nil {
+			return fmt.Errorf("ready log: %w", err)
+		}
+	}
+	if r.RPC != nil && r.RPC.Method == "" {
+		return fmt.Errorf("ready rpc has no method")
+	}
+	if _, err := parseOptionalDuration(r.Timeout, defaultReadyTimeout); err != nil {
+		return fmt.Errorf("ready timeout: %w", err)
+	}
+	if _, err := parseOptionalDuration(r.Interval, defaultReadyInterval); err != nil {
+		return fmt.Errorf("ready interval: %w", err)
+	}
+	return nil
+}
+
+// workloadServer is a running server.
+type workloadServer struct {
+	cmd         *exec.Cmd
+	done        chan struct{}
+	err         error
+	stopTimeout time.Duration
+	// logged is closed once a line matches the log probe.
+	logged chan struct{}
+}
+
+func startServer(spec *ServerSpec, logRule string, run *scenarioRun) (*workloadServer, error) {
+	argv := make([]string, len(spec.Command))
+	for i, arg := range spec.Command {
+		rendered, err := renderTemplate(arg, run.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("server command argument %d: %w", i, err)
+		}
+		argv[i] = rendered
+	}
+	env := make([]string, 0, len(spec.Env))
+	for key, value := range spec.Env {
+		rendered, err := renderTemplate(value, run.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("server env %s: %w", key, err)
+		}
+		env = append(env, key+"="+rendered)
+	}
+	sort.Strings(env)
+	var logRe *regexp.Regexp
+	if logRule != "" {
+		logRe = regexp.MustCompile(logRule)
+	}
+
+	s := &workloadServer{done: make(chan struct{}), logged: make(chan struct{})}
+	s.stopTimeout, _ = parseOptionalDuration(spec.StopTimeout, defaultServerStop)
+	s.cmd = exec.Command(argv[0], argv[1:]...)
+	s.cmd.Dir = run.Vars.WorkDir
+	s.cmd.Env = append(os.Environ(), env...)
+	if run.cgroup != nil {
+		startInCgroup(s.cmd, run.cgroup)
+	}
+	pr, pw := io.Pipe()
+	s.cmd.Stdout, s.cmd.Stderr = pw, pw
+	if err := startScheduled(s.cmd, run.Spec.Scheduling); err != nil {
+		return nil, fmt.Errorf("server %s: %w", argv[0], err)
+	}
+	run.logLine(fmt.Sprintf("--- server %s started (pid %d)", argv[0], s.cmd.Process.Pid))
+
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		var once sync.Once
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			run.logLine(line)
+			if logRe != nil && logRe.MatchString(line) {
+				once.Do(func() { close(s.logged) })
+			}
+		}
+		io.Copy(io.Discard, pr)
+	}()
+	go func() {
+		err := s.cmd.Wait()
+		pw.Close()
+		<-scanned
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		s.err = fmt.Errorf("server %s: %w", argv[0], err)
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// stop interrupts the server, killing it if it outstays its stop timeout.
+func (s *workloadServer) stop() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	if err := s.cmd.Process.Signal(os.Interrupt); err != nil {
+		s.cmd.Process.Kill()
+	}
+	select {
+	case <-s.done:
+	case <-time.After(s.stopTimeout):
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+}
+
+// serve starts the adapter's server, if it has one, and waits until its
+// ready probes pass. The returned stop func stops the server.
+func (r *scenarioRun) serve() (stop func(), err error) {
+	ready := r.Adapter.Ready
+	if ready == nil {
+		ready = r.Spec.Ready
+	}
+	stop = func() {}
+	if r.Adapter.Server == nil && ready == nil {
+		return stop, nil
+	}
+
+	began := time.Now()
+	var srv *workloadServer
+	if r.Adapter.Server != nil {
+		logRule := ""
+		if ready != nil {
+			logRule = ready.Log
+		}
+		if srv, err = startServer(r.Adapter.Server, logRule, r); err != nil {
+			return stop, err
+		}
+		stop = srv.stop
+	}
+	if ready == nil {
+		return stop, nil
+	}
+
+	data, err := r.waitReady(ready, srv, defaultReadyInterval)
+	if err != nil {
+		stop()
+		return func() {}, err
+	}
+	data.WaitMs = float64(time.Since(began).Microseconds()) / 1000
+	r.logLine(fmt.Sprintf("--- ready after %.0f ms (%s)", data.WaitMs, strings.Join(data.Probes, ", ")))
+	r.attach(func(e *Evidence) { e.Readiness = data })
+	return stop, nil
+}
+
+// waitReady polls the probes until they all pass, the timeout runs out or
+// the server exits. A log line matching the log probe triggers a poll
+// straight away.
+func (r *scenarioRun) waitReady(ready *ReadySpec, srv *workloadServer, defaultInterval time.Duration) (*ReadinessData, error) {
+	timeout, _ := parseOptionalDuration(ready.Timeout, defaultReadyTimeout)
+	interval, _ := parseOptionalDuration(ready.Interval, defaultInterval)
+	probes, names, err := r.readyProbes(ready, srv)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &ReadinessData{Probes: names, Server: srv != nil}
+	deadline := time.After(timeout)
+	var serverDone, logged <-chan struct{}
+	if srv != nil {
+		serverDone = srv.done
+		if ready.Log != "" {
+			logged = srv.logged
+		}
+	}
+	for {
+		data.Attempts++
+		var failed error
+		for i, probe := range probes {
+			ctx, cancel := context.WithTimeout(context.Background(), readyProbeTimeout)
+			err := probe(ctx)
+			cancel()
+			if err != nil {
+				failed = fmt.Errorf("%s: %w", names[i], err)
+				break
+			}
+		}
+		if failed == nil {
+			return data, nil
+		}
+		select {
+		case <-serverDone:
+			return nil, fmt.Errorf("not ready: %w", srv.err)
+		case <-deadline:
+			return nil, fmt.Errorf("not ready after %s: %w", timeout, failed)
+		case <-logged:
+			logged = nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+type readyProbe func(ctx context.Context) error
+
+func (r *scenarioRun) readyProbes(ready *ReadySpec, srv *workloadServer) ([]readyProbe, []string, error) {
+	var probes []readyProbe
+	var names []string
+	if ready.HTTP != "" {
+		url, err := renderTemplate(ready.HTTP, r.Vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ready http: %w", err)
+		}
+		names = append(names, "http "+url)
+		probes = append(probes, func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return fmt.Errorf("%s", resp.Status)
+			}
+			return nil
+		})
+	}
+	if ready.TCP != "" {
+		addr, err := renderTemplate(ready.TCP, r.Vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ready tcp: %w", err)
+		}
+		names = append(names, "tcp "+addr)
+		probes = append(probes, func(ctx context.Context) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	}
+	if ready.Log != "" {
+		names = append(names, "log "+ready.Log)
+		probes = append(probes, func(context.Context) error {
+			select {
+			case <-srv.logged:
+				return nil
+			default:
+				return fmt.Errorf("no matching line yet")
+			}
+		})
+	}
+	if ready.RPC != nil {
+		url := ready.RPC.URL
+		switch {
+		case url != "":
+		case r.Adapter.RPCURL != "":
+			url = r.Adapter.RPCURL
+		case r.Spec.Load != nil && r.Spec.Load.RPCURL != "":
+			url = r.Spec.Load.RPCURL
+		case r.Spec.Sync != nil:
+			url = r.Spec.Sync.RPCURL
+		}
+		url, err := renderTemplate(url, r.Vars)
+		if err != nil || url == "" {
+			return nil, nil, fmt.Errorf("ready rpc: no url")
+		}
+		var expect []byte
+		if ready.RPC.Expect != nil {
+			if expect, err = json.Marshal(ready.RPC.Expect); err != nil {
+				return nil, nil, fmt.Errorf("ready rpc expect: %w", err)
+			}
+		}
+		client := newRPCClient(url, readyProbeTimeout)
+		names = append(names, "rpc "+ready.RPC.Method)
+		probes = append(probes, func(ctx context.Context) error {
+			result, err := client.Call(ctx, ready.RPC.Method, ready.RPC.Params)
+			if err != nil {
+				return err
+			}
+			if expect != nil && !jsonEqual(result, expect) {
+				return fmt.Errorf("got %s, want %s", result, expect)
+			}
+			return nil
+		})
+	}
+	return probes, names, nil
+}
+
+// jsonEqual compares two JSON documents by value.
+func jsonEqual(a, b []byte) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return bytes.Equal(a, b)
+	}
+	ja, _ := json.Marshal(av)
+	jb, _ := json.Marshal(bv)
+	return bytes.Equal(ja, jb)
+}
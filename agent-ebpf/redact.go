@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// RedactionConfig selects what is stripped from runs before they leave the
+// machine. Hostnames and IPs become stable pseudonyms (keyed by Salt) so runs
+// from one export still line up by host and peer; paths keep only their last
+// element.
+type RedactionConfig struct {
+	Hostnames bool     `yaml:"hostnames"`
+	Paths     bool     `yaml:"paths"`
+	Argv      bool     `yaml:"argv"`
+	IPs       bool     `yaml:"ips"`
+	Salt      string   `yaml:"salt,omitempty"`
+	Keys      []string `yaml:"keys,omitempty"`
+	Patterns  []string `yaml:"patterns,omitempty"`
+
+	patterns []*regexp.Regexp
+}
+
+// hostKeys hold a machine's name; argvKeys hold command lines or the
+// executable they started.
+var (
+	hostKeys = map[string]bool{"machine": true, "hostname": true, "node": true, "agent": true}
+	argvKeys = map[string]bool{"exe": true, "cmdline": true, "argv": true, "args": true, "command_line": true, "boot.cmdline": true}
+
+	ipv4Pattern = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern = regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b|\b(?:[0-9a-fA-F]{1,4}:){1,6}:[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{1,4})*\b|\[[0-9a-fA-F]*:[0-9a-fA-F:]+\]`)
+	pathPattern = regexp.MustCompile(`(?:^|[\s=:"'(])((?:/[^/\s"'(),;]+)+/?)`)
+)
+
+func defaultRedaction() *RedactionConfig {
+	return &RedactionConfig{Hostnames: true, Paths: true, Argv: true, IPs: true}
+}
+
+func loadRedactionConfig(file string) (*RedactionConfig, error) {
+	cfg := defaultRedaction()
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	for _, p := range cfg.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", p, err)
+		}
+		cfg.patterns = append(cfg.patterns, re)
+	}
+	return cfg, nil
+}
+
+func (c *RedactionConfig) pseudonym(kind, value string) string {
+	sum := sha256.Sum256([]byte(c.Salt + "\x00" + value))
+	return kind + "-" + hex.EncodeToString(sum[:4])
+}
+
+// Run returns a redacted copy of the run. It works on the JSON form so
+// sections added later are covered without changes here.
+func (c *RedactionConfig) Run(run *Run) (*Run, error) {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+
+	// Host names are collected first so they are also replaced where they
+	// turn up inside other values (log lines, warnings, selectors).
+	hosts := map[string]bool{}
+	if c.Hostnames {
+		collectHosts(tree, hosts)
+	}
+	extra := map[string]bool{}
+	for _, key := range c.Keys {
+		extra[key] = true
+	}
+
+	tree = c.walk(tree, "", hosts, extra)
+	data, err = json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	var redacted Run
+	if err := json.Unmarshal(data, &redacted); err != nil {
+		return nil, err
+	}
+	return &redacted, nil
+}
+
+func collectHosts(v any, hosts map[string]bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if s, ok := child.(string); ok && hostKeys[key] && s != "" {
+				hosts[s] = true
+			}
+			collectHosts(child, hosts)
+		}
+	case []any:
+		for _, child := range v {
+			collectHosts(child, hosts)
+		}
+	}
+}
+
+func (c *RedactionConfig) walk(v any, key string, hosts, extra map[string]bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if extra[k] || (c.Argv && argvKeys[k]) {
+				delete(v, k)
+				continue
+			}
+			v[k] = c.walk(child, k, hosts, extra)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = c.walk(child, key, hosts, extra)
+		}
+		return v
+	case string:
+		return c.redactString(v, key, hosts)
+	default:
+		return v
+	}
+}
+
+func (c *RedactionConfig) redactString(s, key string, hosts map[string]bool) string {
+	if s == "" {
+		return s
+	}
+	if c.Hostnames && hostKeys[key] {
+		return c.pseudonym("host", s)
+	}
+	if c.Hostnames {
+		for host := range hosts {
+			// Short names would match inside unrelated words.
+			if len(host) >= 3 && strings.Contains(s, host) {
+				s = strings.ReplaceAll(s, host, c.pseudonym("host", host))
+			}
+		}
+	}
+	if c.IPs {
+		s = ipv4Pattern.ReplaceAllStringFunc(s, func(ip string) string { return c.pseudonym("ip", ip) })
+		s = ipv6Pattern.ReplaceAllStringFunc(s, func(ip string) string { return c.pseudonym("ip", strings.Trim(ip, "[]")) })
+	}
+	if c.Paths {
+		s = pathPattern.ReplaceAllStringFunc(s, func(m string) string {
+			i := strings.IndexByte(m, '/')
+			p := strings.TrimSuffix(m[i:], "/")
+			if p == "" {
+				return m
+			}
+			return m[:i] + "…/" + path.Base(p)
+		})
+	}
+	for _, re := range c.patterns {
+		s = re.ReplaceAllString(s, "<redacted>")
+	}
+	return s
+}
+
+func newRedactCmd(dataDir *string) *cobra.Command {
+	var config string
+
+	cmd := &cobra.Command{
+		Use:   "redact <run-id|file>",
+		Short: "Print a run with hostnames, paths, argv and IPs stripped",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadRedactionConfig(config)
+			if err != nil {
+				return err
+			}
+			run, err := loadRunArg(args[0], *dataDir)
+			if err != nil {
+				return err
+			}
+			redacted, err := cfg.Run(run)
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(redacted)
+		},
+	}
+
+	cmd.Flags().StringVar(&config, "redact-config", "", "YAML redaction config (default: redact everything)")
+
+	return cmd
+}
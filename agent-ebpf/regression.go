@@ -0,0 +1,110 @@
+package main
+
+import "log"
+
+// RegressionEvent is what a regression.detected event found: the commit's
+// runs against those of the commit measured before it in the same series
+// (scenario, impl, variant, dataset and machine).
+type RegressionEvent struct {
+	Baseline         string  `json:"baseline_commit"`
+	BaselineRuns     int     `json:"baseline_runs"`
+	BaselineMedianMs float64 `json:"baseline_median_ms"`
+	Runs             int     `json:"runs"`
+	MedianMs         float64 `json:"median_ms"`
+	ChangePct        float64 `json:"change_pct"`
+	P                float64 `json:"p"`
+}
+
+// A commit regressed when its runs are slower than the previous commit's by
+// at least regressionThresholdPct, significant at regressionAlpha, with at
+// least regressionMinRuns runs on each side.
+var (
+	regressionThresholdPct = 5.0
+	regressionAlpha        = 0.05
+	regressionMinRuns      = 3
+)
+
+// checkRegression compares a newly stored run's commit with the one
+// measured before it, and publishes a regression.detected event the first
+// time the commit is found slower.
+func checkRegression(run *Run) {
+	if events == nil || run.Commit == "" || run.DurationMs <= 0 {
+		return
+	}
+	valid := true
+	runs, err := timedRuns(&RunQuery{
+		Labels: map[string][]string{
+			"scenario": {run.Scenario},
+			"impl":     {run.Impl},
+			"variant":  {run.Variant},
+			"dataset":  {run.Dataset},
+			"machine":  {run.Machine},
+			"project":  {projectOf(run.Project)},
+		},
+		Valid: &valid,
+		Sort:  "created",
+	})
+	if err != nil {
+		log.Printf("Regression check of run %s: %v", run.ID, err)
+		return
+	}
+
+	// Commits in the order of their first run, each with its durations.
+	var commits []string
+	durations := map[string][]float64{}
+	for _, r := range runs {
+		if _, seen := durations[r.Commit]; !seen {
+			commits = append(commits, r.Commit)
+		}
+		durations[r.Commit] = append(durations[r.Commit], r.DurationMs)
+	}
+	var baseline string
+	for i, commit := range commits {
+		if commit == run.Commit {
+			if i > 0 {
+				baseline = commits[i-1]
+			}
+			break
+		}
+	}
+	base, current := durations[baseline], durations[run.Commit]
+	if baseline == "" || len(base) < regressionMinRuns || len(current) < regressionMinRuns {
+		return
+	}
+
+	found := &RegressionEvent{
+		Baseline:         baseline,
+		BaselineRuns:     len(base),
+		BaselineMedianMs: median(base),
+		Runs:             len(current),
+		MedianMs:         median(current),
+		P:                mannWhitneyGreater(base, current),
+	}
+	if found.BaselineMedianMs > 0 {
+		found.ChangePct = (found.MedianMs - found.BaselineMedianMs) / found.BaselineMedianMs * 100
+	}
+	if found.P >= regressionAlpha || found.ChangePct < regressionThresholdPct {
+		return
+	}
+	if events.find(func(e *Event) bool {
+		return e.Type == eventRegressionDetected && e.Commit == run.Commit && e.Scenario == run.Scenario &&
+			e.Impl == run.Impl && e.Variant == run.Variant && e.Dataset == run.Dataset && e.Machine == run.Machine &&
+			projectOf(e.Project) == projectOf(run.Project)
+	}) {
+		return
+	}
+	log.Printf("Regression: %s/%s commit %s is %+.1f%% slower than %s (p=%.3f)",
+		run.Scenario, run.Impl, short(run.Commit), found.ChangePct, short(baseline), found.P)
+	events.publish(Event{
+		Type:       eventRegressionDetected,
+		Run:        run.ID,
+		Scenario:   run.Scenario,
+		Impl:       run.Impl,
+		Variant:    run.Variant,
+		Commit:     run.Commit,
+		Dataset:    run.Dataset,
+		Project:    projectOf(run.Project),
+		Machine:    run.Machine,
+		Regression: found,
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/cobra"
+)
+
+// replayRunMetrics re-emits the metrics a stored run produced, under its
+// original labels, into the agent's registry.
+func replayRunMetrics(run *Run) {
+	e := run.Evidence
+	if e == nil {
+		return
+	}
+	scenario, impl, variant, commit, machine, dataset, project := run.Scenario, run.Impl, run.Variant, run.Commit, run.Machine, run.Dataset, projectOf(run.Project)
+
+	observe := func(h prometheus.Observer, hist []HistogramBucket) {
+		for _, bucket := range hist {
+			for i := 0; i < bucket.Count; i++ {
+				h.Observe(float64(bucket.BucketUs))
+			}
+		}
+	}
+	observeGroups := func(h *prometheus.HistogramVec, hist []HistogramBucket, groups map[string][]HistogramBucket) {
+		if groups == nil {
+			groups = map[string][]HistogramBucket{"": hist}
+		}
+		for group, hist := range groups {
+			observe(h.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project, group), hist)
+		}
+	}
+	if e.Runqlat != nil {
+		observeGroups(runqlatHistogram, e.Runqlat.Histogram, e.Runqlat.ThreadGroups)
+	}
+	if e.Biolatency != nil {
+		observeGroups(biolatencyHistogram, e.Biolatency.Histogram, e.Biolatency.ThreadGroups)
+	}
+	if e.Connect != nil {
+		observe(connectHistogram.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project), e.Connect.Histogram)
+		observe(dnsHistogram.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project), e.Connect.DNSHistogram)
+	}
+	if e.Writeback != nil {
+		for _, d := range e.Writeback.Devices {
+			observe(writebackHistogram.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project), d.Histogram)
+		}
+	}
+	if e.Handshakes != nil {
+		for _, h := range e.Handshakes.Stacks {
+			handshakesTotal.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project, h.Stack, h.Library).Add(float64(h.Handshakes))
+		}
+	}
+	exportCgroupMetrics([]string{scenario, impl, variant, commit, machine, dataset, project}, e.Cgroups)
+	if e.Offcpu != nil {
+		offcpuTotal.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project).Set(e.Offcpu.TotalMs)
+	}
+	if e.Exec != nil {
+		execCount.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project).Add(float64(e.Exec.ExecCount))
+	}
+	if s := e.SyscallCounts; s != nil {
+		for name, count := range map[string]int{"futex": s.Futex, "fsync": s.Fsync, "openat": s.Openat, "read": s.Read, "write": s.Write} {
+			syscallCounts.WithLabelValues(scenario, impl, variant, name, commit, machine, dataset, project).Add(float64(count))
+		}
+	}
+	if e.RPC != nil {
+		for _, m := range e.RPC.Methods {
+			observe(rpcLatency.WithLabelValues(scenario, impl, variant, m.Method, commit, machine, dataset, project), m.Histogram)
+		}
+	}
+	for _, p := range e.Phases {
+		phaseDuration.WithLabelValues(scenario, impl, variant, p.Name, commit, machine, dataset, project).Set(p.DurationMs)
+	}
+	for name, value := range e.Measurements {
+		if measurementName.MatchString(name) {
+			customGauge(name).WithLabelValues(scenario, impl, variant, commit, machine, dataset, project).Set(value)
+		}
+	}
+	if e.Target != nil {
+		for _, pod := range e.Target.Pods {
+			targetPodInfo.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project, pod.Namespace, pod.Pod, pod.Container).Set(1)
+		}
+	}
+	if e.Available {
+		runsTotal.WithLabelValues(runResult(e), impl, variant, scenario, commit, machine, dataset, project).Inc()
+	}
+	exportRunTags([]string{scenario, impl, variant, commit, machine, dataset, project}, run.Tags)
+	if env := run.Environment; env != nil {
+		machineInfo.WithLabelValues(machine, env.Arch, env.CPUModel).Set(1)
+	}
+	exportMachineClasses(machine)
+}
+
+// ownsMetric reports whether a gathered series carries the run's labels.
+func ownsMetric(m *dto.Metric, run *Run) bool {
+	want := map[string]string{
+		"scenario": run.Scenario, "impl": run.Impl, "variant": run.Variant,
+		"commit": run.Commit, "machine": run.Machine, "dataset": run.Dataset,
+		"project": projectOf(run.Project),
+	}
+	matched := 0
+	for _, pair := range m.Label {
+		if value, ok := want[pair.GetName()]; ok {
+			if pair.GetValue() != value {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(want)
+}
+
+func labelSignature(m *dto.Metric) string {
+	var b strings.Builder
+	for _, pair := range m.Label {
+		b.WriteString(pair.GetName() + "=" + pair.GetValue() + ",")
+	}
+	return b.String()
+}
+
+// writeReplayOpenMetrics replays runs in recording order and writes their
+// series as OpenMetrics stamped with each run's time, the input
+// `promtool tsdb create-blocks-from openmetrics` backfills from. Counters
+// accumulate across runs that share labels, as they would have live.
+func writeReplayOpenMetrics(w io.Writer, runs []*Run) error {
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].CreatedAt.Before(runs[j].CreatedAt) })
+
+	families := map[string]*dto.MetricFamily{}
+	for _, run := range runs {
+		replayRunMetrics(run)
+		gathered, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			return err
+		}
+		ts := run.CreatedAt.UnixMilli()
+		for _, mf := range gathered {
+			if !strings.HasPrefix(mf.GetName(), "chainbench_") {
+				continue
+			}
+			for _, m := range mf.Metric {
+				if !ownsMetric(m, run) {
+					continue
+				}
+				m.TimestampMs = &ts
+				if families[mf.GetName()] == nil {
+					families[mf.GetName()] = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				}
+				families[mf.GetName()].Metric = append(families[mf.GetName()].Metric, m)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	enc := expfmt.NewEncoder(w, expfmt.FmtOpenMetrics_1_0_0)
+	for _, name := range names {
+		mf := families[name]
+		// Each series' points must be contiguous; stable keeps them in time order.
+		sort.SliceStable(mf.Metric, func(i, j int) bool { return labelSignature(mf.Metric[i]) < labelSignature(mf.Metric[j]) })
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return enc.(expfmt.Closer).Close()
+}
+
+// handleReplay re-emits a posted run document's metrics on /metrics; stored
+// runs are replayed through POST /runs/<id>/replay.
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var run Run
+	if err := json.NewDecoder(r.Body).Decode(&run); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if run.Evidence == nil {
+		http.Error(w, "run document has no evidence", http.StatusBadRequest)
+		return
+	}
+	if scope := requestScope(r); scope != "" && run.Project == "" {
+		run.Project = scope
+	} else if !inScope(scope, run.Project) {
+		http.Error(w, fmt.Sprintf("run %s is in project %s", run.ID, run.Project), http.StatusForbidden)
+		return
+	}
+	replayRunMetrics(&run)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "replayed", "run_id": run.ID})
+}
+
+func newReplayCmd(dataDir *string) *cobra.Command {
+	var agent string
+
+	cmd := &cobra.Command{
+		Use:   "replay <run-id|file>...",
+		Short: "Rebuild Prometheus metrics from stored evidence",
+		Long: "Writes the runs' metrics as timestamped OpenMetrics for promtool backfilling,\n" +
+			"or with --agent has a running agent re-expose them on its /metrics.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			runs := make([]*Run, 0, len(args))
+			for _, arg := range args {
+				run, err := loadRunArg(arg, *dataDir)
+				if err != nil {
+					return err
+				}
+				runs = append(runs, run)
+			}
+
+			if agent == "" {
+				return writeReplayOpenMetrics(cmd.OutOrStdout(), runs)
+			}
+
+			if err := requireFeature(cmd.Context(), agent, "replay"); err != nil {
+				return err
+			}
+			url := strings.TrimSuffix(agent, "/") + "/replay"
+			for i, run := range runs {
+				body, err := json.Marshal(run)
+				if err != nil {
+					return err
+				}
+				req, err := http.NewRequestWithContext(cmd.Context(), http.MethodPost, url, bytes.NewReader(body))
+				if err != nil {
+					return err
+				}
+				req.Header.Set("Content-Type", "application/json")
+				authorize(req)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return err
+				}
+				msg, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					return fmt.Errorf("%s: %s: %s: %s", args[i], url, resp.Status, strings.TrimSpace(string(msg)))
+				}
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "replayed %d runs on %s\n", len(runs), agent)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&agent, "agent", "", "Replay on a running agent (e.g. http://localhost:9090) instead of writing OpenMetrics")
+
+	return cmd
+}
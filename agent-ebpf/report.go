@@ -0,0 +1,778 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+type termRenderer struct {
+	w     io.Writer
+	color bool
+}
+
+func (t *termRenderer) style(code, s string) string {
+	if !t.color {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+func (t *termRenderer) heading(title string) {
+	fmt.Fprintf(t.w, "\n%s\n", t.style(ansiBold, title))
+	fmt.Fprintln(t.w, strings.Repeat("─", len([]rune(title))))
+}
+
+func sparkline(values []float64) string {
+	max := 0.0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+
+	var b strings.Builder
+	for _, v := range values {
+		idx := 0
+		if max > 0 {
+			idx = int(v / max * float64(len(sparkBlocks)-1))
+		}
+		b.WriteRune(sparkBlocks[idx])
+	}
+	return b.String()
+}
+
+func bar(value, max float64, width int) string {
+	if max <= 0 {
+		return ""
+	}
+	n := int(value / max * float64(width))
+	if n == 0 && value > 0 {
+		return "▏"
+	}
+	return strings.Repeat("█", n)
+}
+
+// ioSize formats an I/O size in the largest binary unit it is a whole
+// number of.
+func ioSize(bytes int) string {
+	switch {
+	case bytes >= 1<<20 && bytes%(1<<20) == 0:
+		return fmt.Sprintf("%d MiB", bytes>>20)
+	case bytes >= 1<<10 && bytes%(1<<10) == 0:
+		return fmt.Sprintf("%d KiB", bytes>>10)
+	}
+	return fmt.Sprintf("%d B", bytes)
+}
+
+func (t *termRenderer) histogram(title string, hist []HistogramBucket, p95 float64) {
+	t.heading(title)
+	if len(hist) == 0 {
+		fmt.Fprintln(t.w, "  (no samples)")
+		return
+	}
+
+	counts := make([]float64, len(hist))
+	max := 0.0
+	for i, bucket := range hist {
+		counts[i] = float64(bucket.Count)
+		if counts[i] > max {
+			max = counts[i]
+		}
+	}
+
+	for _, bucket := range hist {
+		fmt.Fprintf(t.w, "  %8dus │%-40s %d\n", bucket.BucketUs, bar(float64(bucket.Count), max, 40), bucket.Count)
+	}
+	fmt.Fprintf(t.w, "  shape %s   p50 %.0fus  p95 %s  p99 %.0fus\n",
+		sparkline(counts),
+		histogramPercentile(hist, 0.50),
+		t.style(ansiBold, fmt.Sprintf("%.0fus", p95)),
+		histogramPercentile(hist, 0.99))
+}
+
+func (t *termRenderer) table(headers []string, rows [][]string) {
+	widths := make([]int, len(headers))
+	for i, h := range headers {
+		widths[i] = len([]rune(h))
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := len([]rune(cell)); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	line := func(cells []string) string {
+		parts := make([]string, len(cells))
+		for i, cell := range cells {
+			parts[i] = cell + strings.Repeat(" ", widths[i]-len([]rune(cell)))
+		}
+		return "  " + strings.Join(parts, " │ ")
+	}
+
+	fmt.Fprintln(t.w, t.style(ansiBold, line(headers)))
+	seps := make([]string, len(widths))
+	for i, width := range widths {
+		seps[i] = strings.Repeat("─", width)
+	}
+	fmt.Fprintln(t.w, "  "+strings.Join(seps, "─┼─"))
+	for _, row := range rows {
+		fmt.Fprintln(t.w, line(row))
+	}
+}
+
+func renderTerminalReport(w io.Writer, run *Run, color bool) {
+	t := &termRenderer{w: w, color: color}
+	e := run.Evidence
+
+	title := "ChainBench evidence"
+	if run.ID != "" {
+		title += " — run " + run.ID
+	}
+	fmt.Fprintln(w, t.style(ansiBold, title))
+	if run.Impl != "" || run.Scenario != "" {
+		fmt.Fprintf(w, "scenario=%s impl=%s variant=%s commit=%s machine=%s dataset=%s\n",
+			run.Scenario, run.Impl, run.Variant, run.Commit, run.Machine, run.Dataset)
+	}
+	if len(run.Params) > 0 {
+		fmt.Fprintln(w, "params "+formatTags(run.Params))
+	}
+	if len(run.Tags) > 0 {
+		fmt.Fprintln(w, "tags "+formatTags(run.Tags))
+	}
+	if !run.CreatedAt.IsZero() {
+		fmt.Fprintf(w, "recorded %s\n", run.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	}
+	if e.StartedAt != nil && e.StoppedAt != nil {
+		window := fmt.Sprintf("window %s to %s, %.0f ms", e.StartedAt.Format("15:04:05.000"), e.StoppedAt.Format("15:04:05.000 MST"), e.DurationMs)
+		if e.WorkloadMs > 0 {
+			window += fmt.Sprintf(", workload %.0f ms", e.WorkloadMs)
+		}
+		if e.HookWindowMs > 0 {
+			window += fmt.Sprintf(", hooks in window %.0f ms", e.HookWindowMs)
+		}
+		fmt.Fprintln(w, window)
+	}
+	if e.Target != nil {
+		comms := make([]string, 0, len(e.Target.Processes))
+		for _, p := range e.Target.Processes {
+			comms = append(comms, fmt.Sprintf("%s[%d]", p.Comm, p.PID))
+		}
+		fmt.Fprintf(w, "target %s: %s\n", e.Target.Selector, strings.Join(comms, " "))
+		if c := e.Target.Container; c != nil {
+			fmt.Fprintf(w, "container %s\n", c)
+		}
+		for _, pod := range e.Target.Pods {
+			fmt.Fprintf(w, "pod %s\n", pod.String())
+		}
+	}
+	if n := e.Noise; n != nil {
+		host := "bare metal"
+		if n.Virtualized {
+			host = "virtualized (" + n.Hypervisor + ")"
+		}
+		fmt.Fprintf(w, "host %s, cpu steal %.1f%% (peak %.1f%%)\n", host, n.StealPct, n.PeakStealPct)
+		if n.Noisy {
+			fmt.Fprintln(w, t.style(ansiRed, "cloud-noisy: "+strings.Join(n.Reasons, "; ")))
+		}
+	}
+	if a := e.Anomalies; a != nil {
+		fmt.Fprintln(w, t.style(ansiRed, fmt.Sprintf("anomalous against %d earlier runs: %s", a.History, a.summary())))
+	}
+	if c := e.Clock; c != nil {
+		sync := "unsynchronized"
+		if c.Synchronized {
+			sync = "synchronized"
+		}
+		if c.SyncDaemon != "" {
+			sync += " (" + c.SyncDaemon + ")"
+		}
+		fmt.Fprintf(w, "clock %s, %s, offset %.3f ms max, drift %.1f ppm\n", c.Clocksource, sync, c.MaxOffsetMs, c.DriftPPM)
+		tint := ansiBold
+		if c.Invalid {
+			tint = ansiRed
+			fmt.Fprintln(w, t.style(tint, "run invalid: the clock stepped mid-run"))
+		}
+		for _, warning := range c.Warnings {
+			fmt.Fprintln(w, t.style(tint, "clock: "+warning))
+		}
+	}
+	if p := e.Pressure; p != nil {
+		var parts []string
+		for _, r := range p.Resources {
+			parts = append(parts, fmt.Sprintf("%s %.1f%% some / %.1f%% full (peak avg10 %.1f%%)", r.Resource, r.SomePct, r.FullPct, r.PeakSomeAvg10))
+		}
+		fmt.Fprintf(w, "pressure %s\n", strings.Join(parts, ", "))
+		if p.Oversubscribed {
+			fmt.Fprintln(w, t.style(ansiRed, "oversubscribed: "+strings.Join(p.Reasons, "; ")))
+		}
+	}
+	if s := e.Swap; s != nil && s.Swapped() {
+		line := fmt.Sprintf("swapped during the run: %d pages in, %d out (zswap %d in, %d out); target %d in, %d out, %.1f MiB swapped at peak",
+			s.SwapInPages, s.SwapOutPages, s.ZswapInPages, s.ZswapOutPages, s.TargetSwapInPages, s.TargetSwapOutPages, float64(s.TargetSwapPeakBytes)/(1<<20))
+		tint := ansiBold
+		if s.Invalid {
+			line, tint = "run invalid: "+line, ansiRed
+		} else if !s.TargetSwapped() {
+			line = "host " + line
+		}
+		fmt.Fprintln(w, t.style(tint, line))
+	}
+	if b := e.EBPF; b != nil {
+		var ran, degraded, missing, overridden, dropped []string
+		for _, c := range b.Collectors {
+			if c.Script != nil && c.Script.Source != "embedded" {
+				overridden = append(overridden, c.Script.Source+" ("+shortHash(c.Script.SHA256)+")")
+			}
+			if p := c.Pipeline; p != nil && p.Dropped > 0 {
+				dropped = append(dropped, fmt.Sprintf("%s %d of %d (%.2f%%)", c.Collector, p.Dropped, p.Events+p.Dropped, p.DropPct))
+			}
+			switch {
+			case c.Variant != "":
+				ran = append(ran, c.Collector+"="+c.Variant)
+			case c.Fallback != "":
+				degraded = append(degraded, c.Collector+"="+c.Fallback)
+			default:
+				missing = append(missing, c.Collector)
+			}
+		}
+		fmt.Fprintf(w, "ebpf on kernel %s (%s): %s\n", b.Kernel.Release, b.Kernel.Arch, strings.Join(ran, " "))
+		if len(overridden) > 0 {
+			fmt.Fprintln(w, "ebpf script overrides: "+strings.Join(overridden, ", "))
+		}
+		if len(degraded) > 0 {
+			fmt.Fprintln(w, t.style(ansiBold, "ebpf fallback (degraded): "+strings.Join(degraded, " ")))
+		}
+		if len(dropped) > 0 {
+			fmt.Fprintln(w, t.style(ansiBold, "ebpf events dropped: "+strings.Join(dropped, ", ")))
+		}
+		if len(missing) > 0 {
+			fmt.Fprintln(w, t.style(ansiBold, "ebpf unavailable: "+strings.Join(missing, ", ")))
+		}
+	}
+	if o := e.Overhead; o != nil {
+		fmt.Fprintf(w, "collection overhead %.1f%% cpu mean, %.1f%% peak (budget %.1f%%)\n", o.MeanCPUPct, o.PeakCPUPct, o.BudgetPct)
+		for _, a := range o.Degraded {
+			fmt.Fprintln(w, t.style(ansiBold, fmt.Sprintf("degraded at %.0f ms: %s", a.OffsetMs, a.Action)))
+		}
+	}
+	if s := e.SideBySide; s != nil {
+		for _, r := range s.Runs {
+			fmt.Fprintf(w, "side by side: %s run %s on cpus %s\n", r.Impl, r.RunID, r.Partition.CPUs)
+		}
+		if s.Combined != run.ID {
+			fmt.Fprintf(w, "host-wide kernel evidence in run %s\n", s.Combined)
+		}
+	}
+	if k := e.KubernetesJob; k != nil {
+		fmt.Fprintf(w, "kubernetes job %s/%s: pod %s on %s, %s (exit %d) in %.0f ms\n",
+			k.Namespace, k.Job, k.Pod, k.Node, k.Phase, k.ExitCode, k.DurationMs)
+	}
+	if e.Network != nil {
+		fmt.Fprintf(w, "network shaping %s\n", t.style(ansiBold, e.Network.String()))
+	}
+	for _, q := range e.BlockQueue {
+		fmt.Fprintf(w, "block queue %s\n", t.style(ansiBold, q.String()))
+	}
+	if e.Scheduling != nil {
+		fmt.Fprintf(w, "scheduling %s", t.style(ansiBold, e.Scheduling.String()))
+		if n := e.SchedulingMismatches(); n > 0 {
+			fmt.Fprint(w, t.style(ansiRed, fmt.Sprintf(" (%d target threads ran otherwise)", n)))
+		}
+		fmt.Fprintln(w)
+	}
+	if f := e.Failure; f != nil {
+		fmt.Fprintln(w, t.style(ansiBold, "failed ("+f.String()+"): "+f.Message))
+	}
+	if a := e.Attempt; a != nil {
+		fmt.Fprintf(w, "attempt %d of %d\n", a.Attempt, a.MaxAttempts)
+		for _, p := range a.Previous {
+			fmt.Fprintf(w, "  attempt %d: %s, run %s\n", p.Attempt, p.Result, p.RunID)
+		}
+	}
+	if r := e.Readiness; r != nil {
+		fmt.Fprintf(w, "ready after %.0f ms, %d attempts (%s)\n", r.WaitMs, r.Attempts, strings.Join(r.Probes, ", "))
+	}
+	for _, h := range e.Hooks {
+		line := fmt.Sprintf("hook %s %s: %.0f ms", h.Hook, h.Name, h.DurationMs)
+		if h.Iteration > 0 {
+			line = fmt.Sprintf("hook %s %s (iteration %d): %.0f ms", h.Hook, h.Name, h.Iteration, h.DurationMs)
+		}
+		if h.Error != "" {
+			line += ", failed: " + h.Error
+		}
+		fmt.Fprintln(w, line)
+	}
+	if b := e.Build; b != nil {
+		cached := ""
+		if b.Cached {
+			cached = ", cached"
+		}
+		fmt.Fprintf(w, "built %s in %.0f ms at %s (key %s%s)\n",
+			b.Impl, b.DurationMs, b.BuiltAt.Format("2006-01-02 15:04:05 MST"), b.CacheKey, cached)
+	}
+	for _, image := range e.Images {
+		cached := ""
+		if image.Cached {
+			cached = ", cached"
+		}
+		fmt.Fprintf(w, "image %s (%s%s)\n", image.Ref, image.ImageID, cached)
+	}
+
+	if len(e.Phases) > 0 {
+		t.heading("Phases")
+		total := 0.0
+		for _, p := range e.Phases {
+			total += p.DurationMs
+		}
+		rows := make([][]string, 0, len(e.Phases))
+		for _, p := range e.Phases {
+			rows = append(rows, []string{
+				p.Name,
+				fmt.Sprintf("+%.0f ms", p.StartOffsetMs),
+				fmt.Sprintf("%.1f ms", p.DurationMs),
+				bar(p.DurationMs, total, 30),
+			})
+		}
+		t.table([]string{"PHASE", "START", "DURATION", ""}, rows)
+	}
+
+	if len(e.Measurements) > 0 {
+		t.heading("Workload measurements")
+		names := make([]string, 0, len(e.Measurements))
+		for name := range e.Measurements {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rows := make([][]string, len(names))
+		for i, name := range names {
+			rows[i] = []string{name, fmt.Sprintf("%.2f", e.Measurements[name])}
+		}
+		t.table([]string{"NAME", "VALUE"}, rows)
+	}
+
+	if e.RPC != nil {
+		t.heading(fmt.Sprintf("JSON-RPC load (%d requests, %.1f req/s, %.2f%% errors)",
+			e.RPC.Requests, e.RPC.RequestsPerSec, e.RPC.ErrorRate*100))
+		rows := make([][]string, 0, len(e.RPC.Methods))
+		for _, m := range e.RPC.Methods {
+			counts := make([]float64, len(m.Histogram))
+			for i, bucket := range m.Histogram {
+				counts[i] = float64(bucket.Count)
+			}
+			rows = append(rows, []string{
+				m.Method,
+				fmt.Sprintf("%d", m.Requests),
+				fmt.Sprintf("%.2f%%", m.ErrorRate*100),
+				fmt.Sprintf("%.0fus", m.P50Us),
+				fmt.Sprintf("%.0fus", m.P95Us),
+				fmt.Sprintf("%.0fus", m.P99Us),
+				sparkline(counts),
+			})
+		}
+		t.table([]string{"METHOD", "REQUESTS", "ERRORS", "P50", "P95", "P99", "SHAPE"}, rows)
+	}
+
+	if e.Sync != nil {
+		s := e.Sync
+		state := "completed"
+		if !s.Completed {
+			state = "incomplete"
+		}
+		t.heading(fmt.Sprintf("Sync (%s, blocks %d → %d in %.0fs)", state, s.StartBlock, s.EndBlock, s.DurationMs/1000))
+		blocks := make([]float64, len(s.Samples))
+		for i, sample := range s.Samples {
+			blocks[i] = float64(sample.Block)
+		}
+		fmt.Fprintf(w, "  progress %s   %.1f blocks/s", sparkline(blocks), s.BlocksPerSec)
+		if s.HeadersPerSec > 0 {
+			fmt.Fprintf(w, "  %.1f headers/s", s.HeadersPerSec)
+		}
+		if s.StateEntriesPerSec > 0 {
+			fmt.Fprintf(w, "  %.0f state entries/s", s.StateEntriesPerSec)
+		}
+		fmt.Fprintln(w)
+		if len(s.Stalls) > 0 {
+			fmt.Fprintf(w, "  %s, iowait %.1f%% while stalled vs %.1f%% while progressing\n",
+				t.style(ansiRed, fmt.Sprintf("%d stalls (%.0f ms)", len(s.Stalls), s.StallMs)),
+				s.IOWaitStalledPct, s.IOWaitProgressingPct)
+			rows := make([][]string, len(s.Stalls))
+			for i, stall := range s.Stalls {
+				rows[i] = []string{
+					stall.Start.Format("15:04:05"),
+					fmt.Sprintf("%.0f ms", stall.DurationMs),
+					fmt.Sprintf("%d", stall.Block),
+					fmt.Sprintf("%.1f%%", stall.IOWaitPct),
+				}
+			}
+			t.table([]string{"STALL AT", "DURATION", "BLOCK", "IOWAIT"}, rows)
+		}
+	}
+
+	if e.EVM != nil {
+		t.heading(fmt.Sprintf("EVM execution (%.1f Mgas/s over %d iterations)", e.EVM.GasPerSec/1e6, e.EVM.Iterations))
+		max := 0.0
+		for _, c := range e.EVM.Categories {
+			if c.GasPerSec > max {
+				max = c.GasPerSec
+			}
+		}
+		rows := make([][]string, 0, len(e.EVM.Categories))
+		for _, c := range e.EVM.Categories {
+			rows = append(rows, []string{
+				c.Category,
+				fmt.Sprintf("%d", c.Fixtures),
+				fmt.Sprintf("%.1f", c.GasPerSec/1e6),
+				bar(c.GasPerSec, max, 30),
+			})
+		}
+		t.table([]string{"CATEGORY", "FIXTURES", "MGAS/S", ""}, rows)
+	}
+
+	if p := e.Propagation; p != nil {
+		t.heading(fmt.Sprintf("Transaction propagation (%d sent, %d rejected)", p.Transactions, p.Rejected))
+		rows := make([][]string, 0, len(p.Peers))
+		for _, peer := range p.Peers {
+			counts := make([]float64, len(peer.Histogram))
+			for i, bucket := range peer.Histogram {
+				counts[i] = float64(bucket.Count)
+			}
+			rows = append(rows, []string{
+				peer.Peer,
+				fmt.Sprintf("%d/%d", peer.Seen, peer.Included),
+				fmt.Sprintf("%.1f ms", peer.ArrivalP50Ms),
+				fmt.Sprintf("%.1f ms", peer.ArrivalP95Ms),
+				fmt.Sprintf("%.0f ms", peer.InclusionP95Ms),
+				sparkline(counts),
+			})
+		}
+		t.table([]string{"PEER", "SEEN/INCLUDED", "ARRIVAL P50", "ARRIVAL P95", "INCLUSION P95", "SHAPE"}, rows)
+	}
+
+	if b := e.Beacon; b != nil {
+		t.heading(fmt.Sprintf("Beacon node (%d slots, %d missed)", b.Slots, b.MissedSlots))
+		t.table([]string{"EVENT", "P50", "P95"}, [][]string{
+			{"block received", fmt.Sprintf("%.0f ms", b.BlockP50Ms), fmt.Sprintf("%.0f ms", b.BlockP95Ms)},
+			{"head updated", fmt.Sprintf("%.0f ms", b.HeadP50Ms), fmt.Sprintf("%.0f ms", b.HeadP95Ms)},
+		})
+	}
+
+	if c := e.Compaction; c != nil {
+		t.heading("Background compaction")
+		t.table([]string{"THREADS", "CPU", "PEAK", "ACTIVE", "READ", "WRITTEN", "STALLS"}, [][]string{{
+			fmt.Sprintf("%d", c.Threads),
+			fmt.Sprintf("%.0f ms", c.CPUMs),
+			fmt.Sprintf("%.0f%%", c.PeakCPUPct),
+			fmt.Sprintf("%.0f%% of window", c.ActiveShare*100),
+			fmt.Sprintf("%.1f MiB", float64(c.ReadBytes)/(1<<20)),
+			fmt.Sprintf("%.1f MiB", float64(c.WriteBytes)/(1<<20)),
+			fmt.Sprintf("%d", c.Stalls),
+		}})
+		for _, line := range c.StallSamples {
+			fmt.Fprintf(w, "  %s\n", t.style(ansiRed, line))
+		}
+	}
+
+	if th := e.Thermal; th != nil {
+		t.heading(fmt.Sprintf("CPU frequency and temperature (%d samples)", th.Samples))
+		if th.MeanFreqMHz > 0 {
+			fmt.Fprintf(w, "frequency mean %.0f MHz, min %.0f MHz, max %.0f MHz\n", th.MeanFreqMHz, th.MinFreqMHz, th.MaxFreqMHz)
+			rows := make([][]string, 0, len(th.Residency))
+			for _, r := range th.Residency {
+				rows = append(rows, []string{r.Band, fmt.Sprintf("%.1f%%", r.Share*100)})
+			}
+			t.table([]string{"OF MAX FREQ", "RESIDENCY"}, rows)
+		}
+		if th.PeakTempC > 0 {
+			fmt.Fprintf(w, "package temperature start %.0f°C, mean %.0f°C, peak %.0f°C\n", th.StartTempC, th.MeanTempC, th.PeakTempC)
+		}
+		if th.ThrottleEvents > 0 {
+			fmt.Fprintln(w, t.style(ansiRed, fmt.Sprintf("%d thermal throttling events", th.ThrottleEvents)))
+		}
+	}
+
+	if g := e.GPU; g != nil {
+		t.heading("GPUs")
+		rows := make([][]string, 0, len(g.Devices))
+		for _, d := range g.Devices {
+			memory, power := "-", "-"
+			if d.MemoryTotalMB > 0 {
+				memory = fmt.Sprintf("%.0f / %.0f MB", d.PeakMemoryMB, d.MemoryTotalMB)
+			}
+			if d.PeakPowerW > 0 {
+				power = fmt.Sprintf("%.0f W (peak %.0f W)", d.MeanPowerW, d.PeakPowerW)
+			}
+			rows = append(rows, []string{
+				d.Device, d.Name,
+				fmt.Sprintf("%.0f%% (peak %.0f%%)", d.MeanUtilPct, d.PeakUtilPct),
+				fmt.Sprintf("%.0f%%", d.MeanMemBusyPct),
+				memory, power,
+			})
+		}
+		t.table([]string{"DEVICE", "NAME", "BUSY", "MEMORY BUSY", "PEAK MEMORY", "POWER"}, rows)
+	}
+
+	if p := e.PMU; p != nil {
+		t.heading(fmt.Sprintf("PMU counters (%s %s)", p.Arch, p.CPU))
+		rows := make([][]string, 0, len(p.Counters))
+		for _, c := range p.Counters {
+			value := fmt.Sprintf("%d", c.Value)
+			if c.Scaled {
+				value += " (scaled)"
+			}
+			rows = append(rows, []string{c.Event, value})
+		}
+		t.table([]string{"EVENT", "COUNT"}, rows)
+		fmt.Fprintf(w, "IPC %.2f, frontend stalls %.1f%%, backend stalls %.1f%%\n", p.IPC, p.FrontendStallPct, p.BackendStallPct)
+		if len(p.Unsupported) > 0 {
+			fmt.Fprintf(w, "not counted by this PMU: %s\n", strings.Join(p.Unsupported, ", "))
+		}
+	}
+
+	if len(e.Cgroups) > 0 {
+		t.heading("cgroup accounting")
+		rows := make([][]string, 0, len(e.Cgroups))
+		for _, cg := range e.Cgroups {
+			rows = append(rows, []string{
+				cg.Path,
+				fmt.Sprintf("%.0f ms", cg.CPUMs),
+				fmt.Sprintf("%.0f ms (%d/%d)", cg.ThrottledMs, cg.ThrottledPeriods, cg.Periods),
+				fmt.Sprintf("%.1f MiB", float64(cg.MemoryBytes)/(1<<20)),
+				fmt.Sprintf("%d", cg.MemoryHighEvents),
+				fmt.Sprintf("%d", cg.OOMKills),
+				fmt.Sprintf("%.0f / %.0f ms", float64(cg.MemorySomeStallUs)/1000, float64(cg.MemoryFullStallUs)/1000),
+				fmt.Sprintf("%.1f MiB", float64(cg.IOReadBytes)/(1<<20)),
+				fmt.Sprintf("%.1f MiB", float64(cg.IOWriteBytes)/(1<<20)),
+			})
+		}
+		t.table([]string{"CGROUP", "CPU", "THROTTLED", "MEMORY", "HIGH", "OOM", "MEM STALL SOME/FULL", "READ", "WRITTEN"}, rows)
+	}
+
+	if th := e.Threads; th != nil {
+		t.heading(fmt.Sprintf("Threads by role (%d threads)", th.Threads))
+		rows := make([][]string, 0, len(th.Roles))
+		for _, r := range th.Roles {
+			rows = append(rows, []string{
+				r.Role,
+				fmt.Sprintf("%d", r.Threads),
+				fmt.Sprintf("%.0f ms", r.CPUMs),
+				fmt.Sprintf("%.0f ms", r.OffCPUMs),
+				fmt.Sprintf("%.0f ms", r.RunqMs),
+				fmt.Sprintf("%.1fus", r.RunqMeanUs),
+			})
+		}
+		t.table([]string{"ROLE", "THREADS", "CPU", "OFF-CPU", "RUN QUEUE", "MEAN WAIT"}, rows)
+		if th.Omitted > 0 {
+			fmt.Fprintf(w, "  %d more roles\n", th.Omitted)
+		}
+		if len(th.Scheduling) > 0 {
+			policies := make([]string, len(th.Scheduling))
+			for i, s := range th.Scheduling {
+				policies[i] = fmt.Sprintf("%d %s nice %d", s.Threads, s.Policy, s.Nice)
+			}
+			fmt.Fprintf(w, "  scheduling: %s\n", strings.Join(policies, ", "))
+		}
+	}
+
+	if s := e.Sockets; s != nil {
+		t.heading("Socket drops")
+		line := fmt.Sprintf("listen overflows %d, listen drops %d, tcp receive-buffer drops %d (backlog %d, queue %d, pruned %d, out-of-order %d), udp buffer errors %d receive / %d send, udp input errors %d",
+			s.ListenOverflows, s.ListenDrops, s.TCPBacklogDrops+s.TCPRcvQDrops+s.TCPPruned+s.TCPOFODrops,
+			s.TCPBacklogDrops, s.TCPRcvQDrops, s.TCPPruned, s.TCPOFODrops, s.UDPRcvbufErrors, s.UDPSndbufErrors, s.UDPInErrors)
+		if s.Dropped() {
+			line = t.style(ansiRed, line)
+		}
+		fmt.Fprintln(w, line)
+		rows := make([][]string, 0, len(s.Ports))
+		for _, p := range s.Ports {
+			accept, drops := "-", "-"
+			if p.Proto == "tcp" {
+				accept = fmt.Sprintf("%d", p.PeakAccept)
+			} else {
+				drops = fmt.Sprintf("%d", p.Drops)
+			}
+			rows = append(rows, []string{
+				fmt.Sprintf("%s/%d", p.Proto, p.Port),
+				fmt.Sprintf("%d", p.Sockets),
+				accept,
+				fmt.Sprintf("%d B", p.PeakRecvBytes),
+				fmt.Sprintf("%d B", p.PeakSendBytes),
+				drops,
+			})
+		}
+		if len(rows) > 0 {
+			t.table([]string{"PORT", "SOCKETS", "ACCEPT QUEUE", "RECV QUEUE", "SEND QUEUE", "DROPS"}, rows)
+		}
+	}
+
+	if f := e.Files; f != nil {
+		t.heading("Open files")
+		fds := make([]float64, len(f.Samples))
+		for i, sample := range f.Samples {
+			fds[i] = float64(sample.FDs)
+		}
+		fmt.Fprintf(w, "  fds %s   %d → %d, peak %d", sparkline(fds), f.StartFDs, f.EndFDs, f.PeakFDs)
+		if f.Limit > 0 {
+			fmt.Fprintf(w, " (limit %d, %.1f%% at most)", f.Limit, f.PeakLimitPct)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "  dentries %d → %d (%d reclaimed), inodes %d → %d (%d reclaimed), %d pages freed with inodes, %d slab objects scanned\n",
+			f.DentriesStart, f.DentriesEnd, f.DentriesReclaimed, f.InodesStart, f.InodesEnd, f.InodesReclaimed, f.InodeStealPages, f.SlabsScanned)
+	}
+	if f := e.FDErrors; f != nil {
+		line := fmt.Sprintf("  too many open files: %d EMFILE (process limit), %d ENFILE (host limit)", f.TooManyOpen, f.FileTableFull)
+		if f.TooManyOpen+f.FileTableFull > 0 {
+			line = t.style(ansiRed, line)
+		}
+		if e.Files == nil {
+			t.heading("Open files")
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	if !e.Available {
+		fmt.Fprintln(w, t.style(ansiRed, "\neBPF evidence not available for this run"))
+	}
+
+	if r := e.Runqlat; r != nil && len(r.Histogram) == 0 && r.MeanUs > 0 {
+		t.heading("Run queue latency (fallback, mean only)")
+		fmt.Fprintf(w, "  mean %.1fus\n", r.MeanUs)
+	} else if r != nil {
+		t.histogram("Run queue latency", r.Histogram, r.P95Us)
+	}
+	if b := e.Biolatency; b != nil && len(b.Histogram) == 0 && b.MeanUs > 0 {
+		t.heading("Block I/O latency (fallback, mean only)")
+		fmt.Fprintf(w, "  mean %.1fus\n", b.MeanUs)
+	} else if b != nil {
+		t.histogram("Block I/O latency", b.Histogram, b.P95Us)
+		if len(b.SizeHistogram) > 0 {
+			t.heading(fmt.Sprintf("Block I/O sizes (median %s, %.0f%% sequential of %d)",
+				ioSize(b.MedianBytes), b.SequentialPct, b.SequentialIOs+b.RandomIOs))
+			max := 0.0
+			for _, bucket := range b.SizeHistogram {
+				if float64(bucket.Count) > max {
+					max = float64(bucket.Count)
+				}
+			}
+			for _, bucket := range b.SizeHistogram {
+				fmt.Fprintf(w, "  %8s │%-40s %d\n", ioSize(bucket.Bytes), bar(float64(bucket.Count), max, 40), bucket.Count)
+			}
+		}
+	}
+
+	if e.Offcpu != nil {
+		t.heading(fmt.Sprintf("Off-CPU time (%.1f ms total)", e.Offcpu.TotalMs))
+		rows := make([][]string, 0, len(e.Offcpu.TopReasons))
+		for _, reason := range e.Offcpu.TopReasons {
+			share := 0.0
+			if e.Offcpu.TotalMs > 0 {
+				share = reason.Ms / e.Offcpu.TotalMs * 100
+			}
+			rows = append(rows, []string{
+				reason.Reason,
+				fmt.Sprintf("%.1f ms", reason.Ms),
+				fmt.Sprintf("%5.1f%% %s", share, bar(share, 100, 20)),
+			})
+		}
+		t.table([]string{"REASON", "TIME", "SHARE"}, rows)
+	}
+
+	if e.Exec != nil {
+		t.heading(fmt.Sprintf("Process execs (%d total)", e.Exec.ExecCount))
+		rows := make([][]string, 0, len(e.Exec.TopCommands))
+		for _, cmd := range e.Exec.TopCommands {
+			rows = append(rows, []string{cmd.Command, fmt.Sprintf("%d", cmd.Count)})
+		}
+		t.table([]string{"COMMAND", "COUNT"}, rows)
+	}
+
+	if e.SyscallCounts != nil {
+		t.heading("Syscalls")
+		sc := e.SyscallCounts
+		counts := []float64{float64(sc.Futex), float64(sc.Fsync), float64(sc.Openat), float64(sc.Read), float64(sc.Write)}
+		names := []string{"futex", "fsync", "openat", "read", "write"}
+		max := 0.0
+		for _, c := range counts {
+			if c > max {
+				max = c
+			}
+		}
+		rows := make([][]string, len(names))
+		for i, name := range names {
+			rows[i] = []string{name, fmt.Sprintf("%.0f", counts[i]), bar(counts[i], max, 30)}
+		}
+		t.table([]string{"SYSCALL", "COUNT", ""}, rows)
+	}
+
+	if c := e.Connect; c != nil {
+		t.histogram(fmt.Sprintf("TCP connect latency (%d established, %d failed)", c.Connects, c.Failed), c.Histogram, c.P95Us)
+		t.histogram(fmt.Sprintf("getaddrinfo latency (%d lookups, %d failed)", c.Lookups, c.LookupsFailed), c.DNSHistogram, c.DNSP95Us)
+	}
+
+	if r := e.Readahead; r != nil {
+		t.heading("Readahead")
+		fmt.Fprintf(w, "  %d pages read ahead, %d used, %d unused (%.1f%% efficiency)\n", r.Pages, r.UsedPages, r.UnusedPages, r.EfficiencyPct)
+	}
+
+	if w := e.Writeback; w != nil {
+		t.heading(fmt.Sprintf("Writeback (target throttled %.0f ms in %d pauses)", w.ThrottledMs, w.Throttles))
+		rows := make([][]string, 0, len(w.Devices))
+		for _, d := range w.Devices {
+			rows = append(rows, []string{
+				d.Device, fmt.Sprintf("%d", d.Passes),
+				fmt.Sprintf("%.1f MiB", float64(d.WrittenBytes)/(1<<20)), fmt.Sprintf("%.0fus", d.P95Us),
+			})
+		}
+		t.table([]string{"DEVICE", "PASSES", "WRITTEN", "P95"}, rows)
+		if len(w.Reasons) > 0 {
+			reasons := make([]string, 0, len(w.Reasons))
+			for reason, n := range w.Reasons {
+				reasons = append(reasons, fmt.Sprintf("%s %d", reason, n))
+			}
+			sort.Strings(reasons)
+			fmt.Fprintf(t.w, "  passes by reason: %s\n", strings.Join(reasons, ", "))
+		}
+	}
+
+	if h := e.Handshakes; h != nil {
+		t.heading(fmt.Sprintf("Handshakes (%d total)", h.Handshakes))
+		rows := make([][]string, 0, len(h.Stacks))
+		for _, s := range h.Stacks {
+			ms, mean := "-", "-"
+			if s.Ms > 0 {
+				ms, mean = fmt.Sprintf("%.1f ms", s.Ms), fmt.Sprintf("%.0fus", s.MeanUs)
+			}
+			rows = append(rows, []string{s.Stack, s.Library, fmt.Sprintf("%d", s.Handshakes), ms, mean})
+		}
+		t.table([]string{"STACK", "LIBRARY", "HANDSHAKES", "TIME", "MEAN"}, rows)
+	}
+}
+
+func newReportCmd(dataDir *string) *cobra.Command {
+	var noColor bool
+
+	cmd := &cobra.Command{
+		Use:   "report <run-id|file>",
+		Short: "Render evidence in the terminal",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			run, err := loadRunArg(args[0], *dataDir)
+			if err != nil {
+				return err
+			}
+			renderTerminalReport(cmd.OutOrStdout(), run, !noColor)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&noColor, "no-color", false, "Disable ANSI styling")
+
+	return cmd
+}
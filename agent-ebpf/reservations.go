@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A reservation locks the agent for one principal, a user or CI pipeline,
+// for a time window. While it holds, sessions and jobs from anyone else are
+// refused, so two teams never co-run and spoil each other's numbers.
+// Principals name themselves in the X-ChainBench-Principal header; this
+// guards against accidents, not against impersonation.
+const principalHeader = "X-ChainBench-Principal"
+
+// maxReservation bounds a reservation's window.
+const maxReservation = 7 * 24 * time.Hour
+
+// Reservation holds the agent for Principal from Start until End.
+type Reservation struct {
+	ID        string    `json:"id"`
+	Principal string    `json:"principal"`
+	Reason    string    `json:"reason,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReservationRequest asks for a window starting at Start (default now) and
+// lasting Duration (e.g. 2h or 1d), or ending at End.
+type ReservationRequest struct {
+	Principal string    `json:"principal"`
+	Reason    string    `json:"reason,omitempty"`
+	Start     time.Time `json:"start,omitempty"`
+	End       time.Time `json:"end,omitempty"`
+	Duration  string    `json:"duration,omitempty"`
+}
+
+// reservedError refuses work from a principal other than the one holding
+// the agent.
+type reservedError struct {
+	reservation *Reservation
+}
+
+func (e *reservedError) Error() string {
+	return fmt.Sprintf("agent reserved by %s until %s", e.reservation.Principal, e.reservation.End.Format(time.RFC3339))
+}
+
+// reservationBook holds the current and upcoming reservations, saved to
+// <dataDir>/reservations.json so they outlive restarts.
+type reservationBook struct {
+	mu   sync.Mutex
+	path string
+	list []*Reservation
+}
+
+var reservations *reservationBook
+
+func openReservations(dataDir string) (*reservationBook, error) {
+	b := &reservationBook{path: filepath.Join(dataDir, "reservations.json")}
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.list); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.path, err)
+	}
+	return b, nil
+}
+
+// prune drops ended reservations. Callers hold b.mu.
+func (b *reservationBook) prune(now time.Time) {
+	kept := b.list[:0]
+	for _, res := range b.list {
+		if now.Before(res.End) {
+			kept = append(kept, res)
+		}
+	}
+	b.list = kept
+}
+
+// save writes the book out. Callers hold b.mu.
+func (b *reservationBook) save() error {
+	data, err := json.MarshalIndent(b.list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(b.path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(b.path+".tmp", b.path)
+}
+
+var (
+	errReservationOverlap  = errors.New("overlaps reservation")
+	errReservationNotFound = errors.New("reservation not found")
+	errNotYourReservation  = errors.New("reservation belongs to another principal")
+)
+
+// reserve books req's window, unless it overlaps another reservation.
+func (b *reservationBook) reserve(req ReservationRequest) (*Reservation, error) {
+	now := time.Now().UTC()
+	res := &Reservation{
+		ID:        newRunID(),
+		Principal: req.Principal,
+		Reason:    req.Reason,
+		Start:     req.Start.UTC(),
+		End:       req.End.UTC(),
+		CreatedAt: now,
+	}
+	if res.Principal == "" {
+		return nil, fmt.Errorf("principal is required (in the body or the %s header)", principalHeader)
+	}
+	if res.Start.IsZero() || res.Start.Before(now) {
+		res.Start = now
+	}
+	if req.Duration != "" {
+		if !req.End.IsZero() {
+			return nil, fmt.Errorf("give end or duration, not both")
+		}
+		d, err := parseAge(req.Duration)
+		if err != nil {
+			return nil, err
+		}
+		res.End = res.Start.Add(d)
+	}
+	switch {
+	case res.End.IsZero():
+		return nil, fmt.Errorf("end or duration is required")
+	case !res.End.After(res.Start):
+		return nil, fmt.Errorf("reservation ends before it starts")
+	case res.End.Sub(res.Start) > maxReservation:
+		return nil, fmt.Errorf("reservation longer than %s", maxReservation)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(now)
+	for _, other := range b.list {
+		if res.Start.Before(other.End) && other.Start.Before(res.End) {
+			return nil, fmt.Errorf("%w %s by %s from %s to %s", errReservationOverlap,
+				other.ID, other.Principal, other.Start.Format(time.RFC3339), other.End.Format(time.RFC3339))
+		}
+	}
+	b.list = append(b.list, res)
+	sort.Slice(b.list, func(i, j int) bool { return b.list[i].Start.Before(b.list[j].Start) })
+	if err := b.save(); err != nil {
+		b.list = slices.DeleteFunc(b.list, func(r *Reservation) bool { return r == res })
+		return nil, err
+	}
+	return res, nil
+}
+
+// release ends a reservation early. Only its principal may release it.
+func (b *reservationBook) release(id, principal string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, res := range b.list {
+		if res.ID != id {
+			continue
+		}
+		if res.Principal != principal {
+			return errNotYourReservation
+		}
+		b.list = append(b.list[:i], b.list[i+1:]...)
+		return b.save()
+	}
+	return errReservationNotFound
+}
+
+// current returns the reservation holding the agent now, if any.
+func (b *reservationBook) current() *Reservation {
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, res := range b.list {
+		if !now.Before(res.Start) && now.Before(res.End) {
+			copied := *res
+			return &copied
+		}
+	}
+	return nil
+}
+
+// upcoming returns the reservations not yet ended, soonest first.
+func (b *reservationBook) upcoming() []*Reservation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(time.Now())
+	list := make([]*Reservation, len(b.list))
+	for i, res := range b.list {
+		copied := *res
+		list[i] = &copied
+	}
+	return list
+}
+
+// admit returns a reservedError when the agent is reserved for someone
+// other than principal.
+func (b *reservationBook) admit(principal string) error {
+	if res := b.current(); res != nil && res.Principal != principal {
+		return &reservedError{reservation: res}
+	}
+	return nil
+}
+
+// requestPrincipal is who the request says it comes from.
+func requestPrincipal(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get(principalHeader))
+}
+
+// handleReservations lists reservations (GET /reservations), books one
+// (POST /reservations) and releases one (DELETE /reservations/{id}).
+func handleReservations(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/reservations"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reservations.upcoming())
+	case id == "" && r.Method == http.MethodPost:
+		var req ReservationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if principal := requestPrincipal(r); principal != "" {
+			if req.Principal != "" && req.Principal != principal {
+				http.Error(w, "principal differs from the "+principalHeader+" header", http.StatusBadRequest)
+				return
+			}
+			req.Principal = principal
+		}
+		res, err := reservations.reserve(req)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errReservationOverlap) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(res)
+	case id != "" && r.Method == http.MethodDelete:
+		switch err := reservations.release(id, requestPrincipal(r)); {
+		case errors.Is(err, errReservationNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errNotYourReservation):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartAgent replaces the process with exe, keeping its arguments,
+// environment and pid, and tells it which version it should be.
+func restartAgent(exe, version string) error {
+	return syscall.Exec(exe, os.Args, append(os.Environ(), upgradedEnv+"="+version))
+}
@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+// restartAgent cannot replace a running process on Windows; such agents
+// are upgraded by hand.
+func restartAgent(exe, version string) error {
+	return fmt.Errorf("restarting in place is not supported on Windows")
+}
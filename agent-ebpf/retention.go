@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy bounds what the agent keeps on disk. Zero fields are not
+// enforced. KeepRuns applies per scenario/impl pair.
+type RetentionPolicy struct {
+	KeepRuns int
+	MaxAge   time.Duration
+	MaxBytes int64
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.KeepRuns > 0 || p.MaxAge > 0 || p.MaxBytes > 0
+}
+
+func (p RetentionPolicy) MarshalJSON() ([]byte, error) {
+	out := struct {
+		KeepRuns int    `json:"keep_runs,omitempty"`
+		MaxAge   string `json:"max_age,omitempty"`
+		MaxBytes int64  `json:"max_bytes,omitempty"`
+	}{KeepRuns: p.KeepRuns, MaxBytes: p.MaxBytes}
+	if p.MaxAge > 0 {
+		out.MaxAge = p.MaxAge.String()
+	}
+	return json.Marshal(out)
+}
+
+// parseAge accepts Go durations plus whole days, e.g. "30d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+type PruneResult struct {
+	At              time.Time `json:"at"`
+	RemovedRuns     []string  `json:"removed_runs,omitempty"`
+	RemovedWorkDirs []string  `json:"removed_work_dirs,omitempty"`
+	FreedBytes      int64     `json:"freed_bytes"`
+	Errors          []string  `json:"errors,omitempty"`
+}
+
+type StorageUsage struct {
+	DataDir    string          `json:"data_dir"`
+	Runs       int             `json:"runs"`
+	RunBytes   int64           `json:"run_bytes"`
+	WorkDirs   int             `json:"work_dirs"`
+	WorkBytes  int64           `json:"work_bytes"`
+	CacheBytes int64           `json:"cache_bytes"`
+	TotalBytes int64           `json:"total_bytes"`
+	FreeBytes  uint64          `json:"free_bytes"`
+	Retention  RetentionPolicy `json:"retention"`
+	LastPrune  *PruneResult    `json:"last_prune,omitempty"`
+}
+
+// janitor enforces the retention policy over the run store and the job work
+// directories, which hold each job's workload output.
+type janitor struct {
+	policy  RetentionPolicy
+	dataDir string
+	workDir string
+
+	mu   sync.Mutex
+	last *PruneResult
+}
+
+var retention *janitor
+
+func newJanitor(policy RetentionPolicy, dataDir string) *janitor {
+	return &janitor{policy: policy, dataDir: dataDir, workDir: filepath.Join(dataDir, "work")}
+}
+
+func (j *janitor) loop(interval time.Duration) {
+	for {
+		result := j.prune()
+		if n := len(result.RemovedRuns) + len(result.RemovedWorkDirs); n > 0 {
+			log.Printf("Retention: removed %d runs and %d work dirs, freed %d bytes", len(result.RemovedRuns), len(result.RemovedWorkDirs), result.FreedBytes)
+		}
+		for _, msg := range result.Errors {
+			log.Printf("Retention: %s", msg)
+		}
+		time.Sleep(interval)
+	}
+}
+
+type workDirEntry struct {
+	id      string
+	modTime time.Time
+	bytes   int64
+}
+
+func dirSize(path string) int64 {
+	var total int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// workDirs lists job work directories, oldest first. Directories of jobs
+// still queued or running are never listed, so they are never pruned.
+func (j *janitor) workDirs() []workDirEntry {
+	entries, err := os.ReadDir(j.workDir)
+	if err != nil {
+		return nil
+	}
+	active := map[string]bool{}
+	if jobs != nil {
+		for _, job := range jobs.List() {
+			if job.State == jobQueued || job.State == jobBuilding || job.State == jobRunning || job.State == jobRetrying {
+				active[job.ID] = true
+			}
+		}
+	}
+
+	var dirs []workDirEntry
+	for _, entry := range entries {
+		if !entry.IsDir() || active[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(j.workDir, entry.Name())
+		dirs = append(dirs, workDirEntry{id: entry.Name(), modTime: info.ModTime(), bytes: dirSize(path)})
+	}
+	sort.Slice(dirs, func(a, b int) bool { return dirs[a].modTime.Before(dirs[b].modTime) })
+	return dirs
+}
+
+func (j *janitor) prune() PruneResult {
+	result := PruneResult{At: time.Now().UTC()}
+	defer func() {
+		j.mu.Lock()
+		j.last = &result
+		j.mu.Unlock()
+	}()
+	if !j.policy.enabled() {
+		return result
+	}
+
+	runs, err := store.List()
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	removeRun := func(run *Run) {
+		size := store.Size(run.ID)
+		if err := store.Delete(run.ID); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("run %s: %v", run.ID, err))
+			return
+		}
+		result.RemovedRuns = append(result.RemovedRuns, run.ID)
+		result.FreedBytes += size
+	}
+	removeWorkDir := func(dir workDirEntry) {
+		if err := os.RemoveAll(filepath.Join(j.workDir, dir.id)); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("work dir %s: %v", dir.id, err))
+			return
+		}
+		result.RemovedWorkDirs = append(result.RemovedWorkDirs, dir.id)
+		result.FreedBytes += dir.bytes
+	}
+
+	// Runs come newest first, so counting per pair keeps the latest ones.
+	var kept []*Run
+	perPair := map[string]int{}
+	for _, run := range runs {
+		pair := run.Scenario + "/" + run.Impl
+		perPair[pair]++
+		switch {
+		case j.policy.MaxAge > 0 && result.At.Sub(run.CreatedAt) > j.policy.MaxAge:
+			removeRun(run)
+		case j.policy.KeepRuns > 0 && perPair[pair] > j.policy.KeepRuns:
+			removeRun(run)
+		default:
+			kept = append(kept, run)
+		}
+	}
+
+	var dirs []workDirEntry
+	for _, dir := range j.workDirs() {
+		if j.policy.MaxAge > 0 && result.At.Sub(dir.modTime) > j.policy.MaxAge {
+			removeWorkDir(dir)
+		} else {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if j.policy.MaxBytes <= 0 {
+		return result
+	}
+	// Over budget: workload output goes before evidence, oldest first.
+	total := int64(0)
+	for _, run := range kept {
+		total += store.Size(run.ID)
+	}
+	for _, dir := range dirs {
+		total += dir.bytes
+	}
+	for _, dir := range dirs {
+		if total <= j.policy.MaxBytes {
+			break
+		}
+		removeWorkDir(dir)
+		total -= dir.bytes
+	}
+	for i := len(kept) - 1; i >= 0 && total > j.policy.MaxBytes; i-- {
+		size := store.Size(kept[i].ID)
+		removeRun(kept[i])
+		total -= size
+	}
+	return result
+}
+
+func (j *janitor) usage() (*StorageUsage, error) {
+	runs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &StorageUsage{DataDir: j.dataDir, Runs: len(runs), Retention: j.policy}
+	for _, run := range runs {
+		usage.RunBytes += store.Size(run.ID)
+	}
+	if entries, err := os.ReadDir(j.workDir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				usage.WorkDirs++
+				usage.WorkBytes += dirSize(filepath.Join(j.workDir, entry.Name()))
+			}
+		}
+	}
+	usage.TotalBytes = usage.RunBytes + usage.WorkBytes
+	if artifactCache != nil {
+		for _, a := range artifactCache.List() {
+			usage.CacheBytes += a.Size
+		}
+	}
+
+	usage.FreeBytes = freeDiskBytes(j.dataDir)
+
+	j.mu.Lock()
+	usage.LastPrune = j.last
+	j.mu.Unlock()
+	return usage, nil
+}
+
+func handleStorageUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage, err := retention.usage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// handleStoragePrune enforces the retention policy now rather than at the
+// janitor's next pass, and answers what it removed.
+func handleStoragePrune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireLabWide(w, r) {
+		return
+	}
+
+	result := retention.prune()
+	if n := len(result.RemovedRuns) + len(result.RemovedWorkDirs); n > 0 {
+		log.Printf("Retention: pruned on request: removed %d runs and %d work dirs, freed %d bytes", len(result.RemovedRuns), len(result.RemovedWorkDirs), result.FreedBytes)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// RetrySpec reruns a scenario's failed jobs, so a transient failure of the
+// infrastructure does not fail the job. Each attempt is a run of its own.
+type RetrySpec struct {
+	MaxRetries int `yaml:"max_retries" json:"max_retries"`
+	// On lists the failure classes worth retrying (default error and
+	// timeout).
+	On []string `yaml:"on,omitempty" json:"on,omitempty"`
+	// Backoff is the wait before the first retry (default 10s), doubled for
+	// each one after it up to MaxBackoff (default 10m).
+	Backoff    string `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+	MaxBackoff string `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty"`
+}
+
+const (
+	defaultRetryBackoff    = 10 * time.Second
+	defaultRetryMaxBackoff = 10 * time.Minute
+)
+
+var defaultRetryOn = []string{resultError, resultTimeout}
+
+// AttemptData is the evidence section of a run made under a retry policy.
+type AttemptData struct {
+	Attempt     int `json:"attempt"`
+	MaxAttempts int `json:"max_attempts"`
+	// Previous are the job's earlier, failed attempts.
+	Previous []JobAttempt `json:"previous,omitempty"`
+}
+
+// JobAttempt is one run of a job under a retry policy.
+type JobAttempt struct {
+	Attempt int    `json:"attempt"`
+	RunID   string `json:"run_id,omitempty"`
+	// Result is "success" or the failure class.
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+func (r *RetrySpec) validate() error {
+	if r.MaxRetries < 0 {
+		return fmt.Errorf("retry: max_retries must not be negative")
+	}
+	for _, class := range r.On {
+		if class == resultSuccess || !slices.Contains(runResults, class) {
+			return fmt.Errorf("retry: unknown failure class %q", class)
+		}
+	}
+	for _, d := range []string{r.Backoff, r.MaxBackoff} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("retry: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *RetrySpec) retryable(class string) bool {
+	if len(r.On) == 0 {
+		return slices.Contains(defaultRetryOn, class)
+	}
+	return slices.Contains(r.On, class)
+}
+
+// backoff is the wait after the given failed attempt.
+func (r *RetrySpec) backoff(attempt int) time.Duration {
+	wait, limit := defaultRetryBackoff, defaultRetryMaxBackoff
+	if r.Backoff != "" {
+		wait, _ = time.ParseDuration(r.Backoff)
+	}
+	if r.MaxBackoff != "" {
+		limit, _ = time.ParseDuration(r.MaxBackoff)
+	}
+	for i := 1; i < attempt && wait < limit; i++ {
+		wait *= 2
+	}
+	return min(wait, limit)
+}
+
+// classifiedError is a job error with the class its run's failure was
+// given once the collectors stopped.
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+// errorClass is the failure class of a job error. Errors raised outside a
+// run, e.g. by a failed build, are of class error.
+func errorClass(err error) string {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+	return resultError
+}
+
+// run executes the job, retrying failed attempts as far as its scenario's
+// retry policy allows. The job's run is that of its last attempt.
+func (m *JobManager) run(job *Job) (string, error) {
+	var retry *RetrySpec
+	if spec, ok := getScenario(job.Scenario); ok {
+		retry = spec.Retry
+	}
+	if retry == nil {
+		return m.execute(job, nil)
+	}
+
+	var previous []JobAttempt
+	for attempt := 1; ; attempt++ {
+		started := time.Now().UTC()
+		runID, err := m.execute(job, &AttemptData{
+			Attempt:     attempt,
+			MaxAttempts: retry.MaxRetries + 1,
+			Previous:    previous,
+		})
+		record := JobAttempt{
+			Attempt:    attempt,
+			RunID:      runID,
+			Result:     resultSuccess,
+			StartedAt:  started,
+			FinishedAt: time.Now().UTC(),
+		}
+		if err != nil {
+			record.Result = errorClass(err)
+			record.Error = err.Error()
+		}
+		previous = append(previous[:len(previous):len(previous)], record)
+		m.update(job, func(j *Job) { j.Attempts = previous })
+
+		if err == nil || attempt > retry.MaxRetries || !retry.retryable(record.Result) {
+			return runID, err
+		}
+		wait := retry.backoff(attempt)
+		log.Printf("Job %s: attempt %d of %d failed (%s), retrying in %s: %v", job.ID, attempt, retry.MaxRetries+1, record.Result, wait, err)
+		m.update(job, func(j *Job) {
+			j.State = jobRetrying
+			j.RunIDs = nil
+		})
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ringbufProbe is a native collector's BPF program, attached to a raw
+// tracepoint, and the ring buffer it writes its records to.
+type ringbufProbe struct {
+	ring, pids, drops int
+	prog, link        int
+
+	// consumer is the page holding the position the agent has read up to;
+	// producer holds the kernel's position, followed by the data pages,
+	// which the kernel maps twice in a row so no record wraps.
+	consumer, producer []byte
+	data               []byte
+	mask               uint64
+	recordSize         int
+}
+
+// Each ring buffer record starts with a header holding its length, and
+// whether it is still being written or was discarded.
+const (
+	ringbufHeaderSize = 8
+	ringbufBusyBit    = 1 << 31
+	ringbufDiscardBit = 1 << 30
+)
+
+func startRingbufProbe(collector string, ringKB int, pids []int) (*ringbufProbe, error) {
+	var tracepoint string
+	p := &ringbufProbe{ring: -1, pids: -1, drops: -1, prog: -1, link: -1}
+	switch collector {
+	case "exec":
+		tracepoint, p.recordSize = "sched_process_exec", execRecordSize
+	case "syscalls":
+		tracepoint, p.recordSize = "sys_enter", syscallRecordSize
+	default:
+		return nil, fmt.Errorf("no native probe for %s", collector)
+	}
+	raiseMemlock()
+
+	var err error
+	size := ringSize(ringKB)
+	if p.ring, err = bpfMapCreate(unix.BPF_MAP_TYPE_RINGBUF, 0, 0, uint32(size)); err != nil {
+		p.close()
+		return nil, fmt.Errorf("ring buffer: %w", err)
+	}
+	if p.pids, err = bpfMapCreate(unix.BPF_MAP_TYPE_HASH, 4, 1, pidFilterEntries); err != nil {
+		p.close()
+		return nil, fmt.Errorf("pid filter: %w", err)
+	}
+	if p.drops, err = bpfMapCreate(unix.BPF_MAP_TYPE_ARRAY, 4, 8, 1); err != nil {
+		p.close()
+		return nil, fmt.Errorf("drop counter: %w", err)
+	}
+	if err := p.setPIDs(pids); err != nil {
+		p.close()
+		return nil, fmt.Errorf("pid filter: %w", err)
+	}
+	if err := p.mmap(size); err != nil {
+		p.close()
+		return nil, err
+	}
+	if p.prog, err = bpfProgLoad(collector, p.program(collector)); err != nil {
+		p.close()
+		return nil, err
+	}
+	if p.link, err = bpfRawTracepointOpen(tracepoint, p.prog); err != nil {
+		p.close()
+		return nil, fmt.Errorf("attach %s: %w", tracepoint, err)
+	}
+	return p, nil
+}
+
+func (p *ringbufProbe) mmap(size int) error {
+	page := os.Getpagesize()
+	var err error
+	if p.consumer, err = unix.Mmap(p.ring, 0, page, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED); err != nil {
+		return fmt.Errorf("map ring buffer: %w", err)
+	}
+	if p.producer, err = unix.Mmap(p.ring, int64(page), page+2*size, unix.PROT_READ, unix.MAP_SHARED); err != nil {
+		return fmt.Errorf("map ring buffer: %w", err)
+	}
+	p.data = p.producer[page:]
+	p.mask = uint64(size - 1)
+	return nil
+}
+
+// program assembles the collector's BPF program. Both write one record per
+// event unless the pid filter rejects it (syscalls only; exec counts every
+// exec like its bpftrace script), and count the records the full ring
+// buffer would not take.
+func (p *ringbufProbe) program(collector string) []bpfInsn {
+	var a bpfAsm
+	switch collector {
+	case "syscalls":
+		a.mov(6, 1)
+		a.filterPIDs(p.pids)
+		// The raw tracepoint's second argument is the syscall number.
+		a.emit(unix.BPF_LDX|unix.BPF_MEM|unix.BPF_DW, 7, 6, 8, 0)
+		a.reserve(p.ring, syscallRecordSize)
+		a.emit(unix.BPF_STX|unix.BPF_MEM|unix.BPF_DW, 0, 7, 0, 0)
+		a.mov(1, 0)
+	case "exec":
+		a.reserve(p.ring, execRecordSize)
+		a.mov(6, 0)
+		a.mov(1, 0)
+		a.movImm(2, execRecordSize)
+		a.call(bpfGetCurrentComm)
+		a.mov(1, 6)
+	}
+	a.movImm(2, unix.BPF_RB_NO_WAKEUP)
+	a.call(bpfRingbufSubmit)
+	a.jump(unix.BPF_JA, 0, "out")
+
+	a.label("drop")
+	a.emit(unix.BPF_ST|unix.BPF_MEM|unix.BPF_W, 10, 0, -4, 0)
+	a.lookup(p.drops)
+	a.jump(unix.BPF_JEQ, 0, "out")
+	a.movImm(1, 1)
+	a.emit(unix.BPF_STX|unix.BPF_ATOMIC|unix.BPF_DW, 0, 1, 0, unix.BPF_ADD)
+
+	a.label("out")
+	a.movImm(0, 0)
+	a.emit(unix.BPF_JMP|unix.BPF_EXIT, 0, 0, 0, 0)
+	return a.assemble()
+}
+
+// read takes the committed records, up to batch's capacity, and hands
+// their space back to the kernel.
+func (p *ringbufProbe) read(batch []byte) []byte {
+	consPos := (*uint64)(unsafe.Pointer(&p.consumer[0]))
+	prodPos := (*uint64)(unsafe.Pointer(&p.producer[0]))
+	cons, prod := atomic.LoadUint64(consPos), atomic.LoadUint64(prodPos)
+	for cons < prod && len(batch)+p.recordSize <= cap(batch) {
+		header := p.data[cons&p.mask:]
+		length := atomic.LoadUint32((*uint32)(unsafe.Pointer(&header[0])))
+		if length&ringbufBusyBit != 0 {
+			break
+		}
+		if length&ringbufDiscardBit == 0 && int(length) >= p.recordSize {
+			batch = append(batch, header[ringbufHeaderSize:ringbufHeaderSize+p.recordSize]...)
+		}
+		length &^= ringbufBusyBit | ringbufDiscardBit
+		cons += (uint64(length) + ringbufHeaderSize + 7) &^ 7
+	}
+	atomic.StoreUint64(consPos, cons)
+	return batch
+}
+
+func (p *ringbufProbe) dropped() uint64 {
+	var key uint32
+	var value uint64
+	if err := bpfMapElem(unix.BPF_MAP_LOOKUP_ELEM, p.drops, unsafe.Pointer(&key), unsafe.Pointer(&value), 0); err != nil {
+		return 0
+	}
+	return value
+}
+
+// setPIDs replaces the pid filter.
+func (p *ringbufProbe) setPIDs(pids []int) error {
+	return setPIDFilter(p.pids, pids)
+}
+
+// detach stops the program; the records already in the ring can still be
+// read.
+func (p *ringbufProbe) detach() {
+	for _, fd := range []*int{&p.link, &p.prog} {
+		if *fd >= 0 {
+			unix.Close(*fd)
+			*fd = -1
+		}
+	}
+}
+
+// close detaches the program and frees the maps.
+func (p *ringbufProbe) close() {
+	p.detach()
+	for _, fd := range []*int{&p.ring, &p.pids, &p.drops} {
+		if *fd >= 0 {
+			unix.Close(*fd)
+			*fd = -1
+		}
+	}
+	for _, m := range []*[]byte{&p.consumer, &p.producer} {
+		if *m != nil {
+			unix.Munmap(*m)
+			*m = nil
+		}
+	}
+	p.data = nil
+}
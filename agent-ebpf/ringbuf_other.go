@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+type ringbufProbe struct{}
+
+func startRingbufProbe(collector string, ringKB int, pids []int) (*ringbufProbe, error) {
+	return nil, fmt.Errorf("native eBPF collectors need Linux, not %s", runtime.GOOS)
+}
+
+func (p *ringbufProbe) read(batch []byte) []byte { return batch }
+func (p *ringbufProbe) dropped() uint64          { return 0 }
+func (p *ringbufProbe) setPIDs(pids []int) error { return nil }
+func (p *ringbufProbe) detach()                  {}
+func (p *ringbufProbe) close()                   {}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Every token in the --tokens file has a role. Viewers read: runs, metrics,
+// status, events and the rest of what GET serves. Runners also do the
+// work: start and stop sessions, report gains, submit jobs and matrices,
+// ingest and replay runs, book reservations and heartbeat. Admins also run
+// the lab: drain it, upgrade it, edit its machine catalog and prune its
+// storage. Each role may do everything the ones before it may.
+const (
+	roleViewer = "viewer"
+	roleRunner = "runner"
+	roleAdmin  = "admin"
+)
+
+var roles = []string{roleViewer, roleRunner, roleAdmin}
+
+// defaultRole is the role of a token that names none: lab-wide tokens
+// administer, project tokens run.
+func defaultRole(project string) string {
+	if project == allProjects {
+		return roleAdmin
+	}
+	return roleRunner
+}
+
+// allows reports whether role may do what needs the required one.
+func allows(role, required string) bool {
+	return slices.Index(roles, role) >= slices.Index(roles, required)
+}
+
+// requiredRole is the least role a request needs. Reads need a viewer,
+// writes a runner, and managing the lab an admin.
+func requiredRole(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return roleViewer
+	case strings.HasPrefix(path, "/admin/"),
+		path == "/upgrade" || strings.HasPrefix(path, "/upgrade/"),
+		path == "/machines" || strings.HasPrefix(path, "/machines/"),
+		path == "/storage/prune":
+		return roleAdmin
+	default:
+		return roleRunner
+	}
+}
+
+// authorizeRole answers 403 to callers whose role falls short of what r
+// needs.
+func authorizeRole(w http.ResponseWriter, r *http.Request, c caller) bool {
+	if required := requiredRole(r); !allows(c.role, required) {
+		http.Error(w, fmt.Sprintf("token %s has the %s role; %s %s needs %s", c.name, c.role, r.Method, r.URL.Path, required), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ScenarioSpec struct {
+	Name string `yaml:"name" json:"name"`
+	// Extends names the scenario this one is based on; see mergeScenario.
+	Extends     string                 `yaml:"extends,omitempty" json:"extends,omitempty"`
+	Type        string                 `yaml:"type" json:"type"`
+	Description string                 `yaml:"description,omitempty" json:"description,omitempty"`
+	DatasetPath string                 `yaml:"dataset_path,omitempty" json:"dataset_path,omitempty"`
+	Blocks      intTemplate            `yaml:"blocks,omitempty" json:"blocks,omitempty"`
+	Timeout     string                 `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Load        *RPCLoadSpec           `yaml:"load,omitempty" json:"load,omitempty"`
+	Sync        *SyncSpec              `yaml:"sync,omitempty" json:"sync,omitempty"`
+	EVM         *EVMBenchSpec          `yaml:"evm,omitempty" json:"evm,omitempty"`
+	Network     *NetworkSpec           `yaml:"network,omitempty" json:"network,omitempty"`
+	BlockQueue  *BlockQueueSpec        `yaml:"block_queue,omitempty" json:"block_queue,omitempty"`
+	Scheduling  *SchedulingSpec        `yaml:"scheduling,omitempty" json:"scheduling,omitempty"`
+	Propagation *PropagationSpec       `yaml:"propagation,omitempty" json:"propagation,omitempty"`
+	Beacon      *BeaconSpec            `yaml:"beacon,omitempty" json:"beacon,omitempty"`
+	SideBySide  *SideBySideSpec        `yaml:"side_by_side,omitempty" json:"side_by_side,omitempty"`
+	Progress    *ProgressRule          `yaml:"progress,omitempty" json:"progress,omitempty"`
+	Retry       *RetrySpec             `yaml:"retry,omitempty" json:"retry,omitempty"`
+	Params      map[string]ParamSpec   `yaml:"params,omitempty" json:"params,omitempty"`
+	Prepare     []StepSpec             `yaml:"prepare,omitempty" json:"prepare,omitempty"`
+	Reset       []StepSpec             `yaml:"reset,omitempty" json:"reset,omitempty"`
+	Hooks       *HooksSpec             `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+	Startup     *StartupSpec           `yaml:"startup,omitempty" json:"startup,omitempty"`
+	Ready       *ReadySpec             `yaml:"ready,omitempty" json:"ready,omitempty"`
+	Adapters    map[string]AdapterSpec `yaml:"adapters" json:"adapters"`
+
+	// Collectors restricts and tunes the session's collectors as in /start.
+	Collectors map[string]CollectorOptions `yaml:"collectors,omitempty" json:"collectors,omitempty"`
+}
+
+// AdapterSpec describes how one implementation is driven through a scenario.
+// Command arguments and env values are Go templates over scenarioVars.
+type AdapterSpec struct {
+	Mode    string                 `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Command []string               `yaml:"command,omitempty" json:"command,omitempty"`
+	Env     map[string]string      `yaml:"env,omitempty" json:"env,omitempty"`
+	Extract map[string]ExtractRule `yaml:"extract,omitempty" json:"extract,omitempty"`
+
+	EngineURL     string `yaml:"engine_url,omitempty" json:"engine_url,omitempty"`
+	JWTSecretFile string `yaml:"jwt_secret_file,omitempty" json:"jwt_secret_file,omitempty"`
+	RPCURL        string `yaml:"rpc_url,omitempty" json:"rpc_url,omitempty"`
+
+	// Consensus clients: the beacon REST API and the client's own metrics,
+	// mapped to measurements.
+	BeaconURL  string                `yaml:"beacon_url,omitempty" json:"beacon_url,omitempty"`
+	MetricsURL string                `yaml:"metrics_url,omitempty" json:"metrics_url,omitempty"`
+	Metrics    map[string]MetricRule `yaml:"metrics,omitempty" json:"metrics,omitempty"`
+
+	// Target selects the node's processes for per-process collectors;
+	// process, container, cgroup, pod and log_file are templates.
+	Target *Target `yaml:"target,omitempty" json:"target,omitempty"`
+
+	// Kubernetes runs the command as a Job instead (type k8s-job).
+	Kubernetes *KubeJobSpec `yaml:"kubernetes,omitempty" json:"kubernetes,omitempty"`
+
+	// Build, when set, builds the impl at the job's commit before it runs.
+	Build *BuildSpec `yaml:"build,omitempty" json:"build,omitempty"`
+	// Images are container images (templates) pulled before the run.
+	Images []string `yaml:"images,omitempty" json:"images,omitempty"`
+
+	// Progress overrides the scenario's progress rule for this impl.
+	Progress *ProgressRule `yaml:"progress,omitempty" json:"progress,omitempty"`
+
+	// Server is a node the workload runs against; Ready overrides the
+	// scenario's readiness probes for this impl.
+	Server *ServerSpec `yaml:"server,omitempty" json:"server,omitempty"`
+	Ready  *ReadySpec  `yaml:"ready,omitempty" json:"ready,omitempty"`
+
+	// Prepare and Reset steps, and Hooks, run after the scenario's own.
+	Prepare []StepSpec `yaml:"prepare,omitempty" json:"prepare,omitempty"`
+	Reset   []StepSpec `yaml:"reset,omitempty" json:"reset,omitempty"`
+	Hooks   *HooksSpec `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+}
+
+// ExtractRule pulls a number out of workload output: the first capture group
+// of every matching line is aggregated ("sum", "last" or "max") and scaled.
+type ExtractRule struct {
+	Regex     string  `yaml:"regex" json:"regex"`
+	Aggregate string  `yaml:"aggregate,omitempty" json:"aggregate,omitempty"`
+	Scale     float64 `yaml:"scale,omitempty" json:"scale,omitempty"`
+}
+
+type scenarioVars struct {
+	Scenario    string
+	Impl        string
+	Variant     string
+	Commit      string
+	Dataset     string
+	Project     string
+	DatasetPath string
+	Blocks      int
+	WorkDir     string
+	Fixture     string
+	Category    string
+	// Params are the job's scenario parameters, defaults filled in.
+	Params map[string]string
+	// SourceDir and BuildDir are set for adapters with a build: the
+	// checked-out source and the build's own directory.
+	SourceDir string
+	BuildDir  string
+}
+
+// scenarioRun is handed to a scenario type's runner for one job.
+type scenarioRun struct {
+	Spec      *ScenarioSpec
+	Adapter   AdapterSpec
+	Vars      scenarioVars
+	Tags      map[string]string
+	SessionID string
+
+	sections []func(*Evidence)
+	// afterSession runs once the session has closed; see release.
+	afterSession []func()
+	// cgroup, when set, is the directory the adapter command is started in.
+	cgroup *os.File
+	// log, when set, receives the adapter command's output, each line
+	// prefixed with logPrefix if that is set.
+	log       *jobLog
+	logPrefix string
+
+	// hooks records the hooks run so far and hookValues what they
+	// extracted; iterations counts the workload's passes and
+	// iterationHooks the time their hooks took.
+	hooks          []HookData
+	hookValues     map[string]float64
+	iterations     int
+	iterationHooks time.Duration
+}
+
+// logLine writes a line to the job's log, if the run has one.
+func (r *scenarioRun) logLine(line string) {
+	if r.log != nil {
+		r.log.line(r.logPrefix, line)
+	}
+}
+
+// attach registers an evidence section produced by the scenario itself; it
+// is merged into the session's evidence at Stop.
+func (r *scenarioRun) attach(fn func(*Evidence)) {
+	r.sections = append(r.sections, fn)
+}
+
+// release runs what the scenario left to do once its session closed, such
+// as stopping a node it started, in reverse order.
+func (r *scenarioRun) release() {
+	for i := len(r.afterSession) - 1; i >= 0; i-- {
+		r.afterSession[i]()
+	}
+	r.afterSession = nil
+}
+
+type scenarioRunner func(ctx context.Context, run *scenarioRun) (map[string]float64, error)
+
+var scenarioTypes = map[string]scenarioRunner{}
+
+var (
+	scenariosMu sync.RWMutex
+	scenarios   = map[string]*ScenarioSpec{}
+)
+
+func (s *ScenarioSpec) timeout() time.Duration {
+	if s.Timeout == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s.Timeout)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+func (s *ScenarioSpec) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("scenario has no name")
+	}
+	if _, ok := scenarioTypes[s.Type]; !ok {
+		return fmt.Errorf("scenario %s: unknown type %q", s.Name, s.Type)
+	}
+	if s.Timeout != "" {
+		if _, err := time.ParseDuration(s.Timeout); err != nil {
+			return fmt.Errorf("scenario %s: timeout: %w", s.Name, err)
+		}
+	}
+	if s.Load != nil {
+		if err := s.Load.validate(); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	if s.Network != nil {
+		if err := s.Network.validate(); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	if s.BlockQueue != nil {
+		if err := s.BlockQueue.validate(); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	if s.Scheduling != nil {
+		if err := s.Scheduling.validate(); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	if err := validateCollectors(s.Collectors); err != nil {
+		return fmt.Errorf("scenario %s: %w", s.Name, err)
+	}
+	if err := validateParamSpecs(s.Params); err != nil {
+		return fmt.Errorf("scenario %s: %w", s.Name, err)
+	}
+	if err := validateSteps("prepare", s.Prepare); err != nil {
+		return fmt.Errorf("scenario %s: %w", s.Name, err)
+	}
+	if err := validateSteps("reset", s.Reset); err != nil {
+		return fmt.Errorf("scenario %s: %w", s.Name, err)
+	}
+	if err := s.Hooks.validate(); err != nil {
+		return fmt.Errorf("scenario %s: %w", s.Name, err)
+	}
+	if s.Startup != nil {
+		if err := s.Startup.validate(); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	if s.Progress != nil {
+		if err := s.Progress.validate(); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	if s.Retry != nil {
+		if err := s.Retry.validate(); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	if s.SideBySide != nil {
+		if err := s.SideBySide.validate(s.Adapters); err != nil {
+			return fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+	}
+	for impl, adapter := range s.Adapters {
+		if adapter.Build != nil {
+			if err := adapter.Build.validate(); err != nil {
+				return fmt.Errorf("scenario %s: adapter %s: %w", s.Name, impl, err)
+			}
+		}
+		if adapter.Progress != nil {
+			if err := adapter.Progress.validate(); err != nil {
+				return fmt.Errorf("scenario %s: adapter %s: %w", s.Name, impl, err)
+			}
+		}
+		if err := validateSteps("prepare", adapter.Prepare); err != nil {
+			return fmt.Errorf("scenario %s: adapter %s: %w", s.Name, impl, err)
+		}
+		if err := validateSteps("reset", adapter.Reset); err != nil {
+			return fmt.Errorf("scenario %s: adapter %s: %w", s.Name, impl, err)
+		}
+		if err := adapter.Hooks.validate(); err != nil {
+			return fmt.Errorf("scenario %s: adapter %s: %w", s.Name, impl, err)
+		}
+		if adapter.Server != nil {
+			if err := adapter.Server.validate(); err != nil {
+				return fmt.Errorf("scenario %s: adapter %s: %w", s.Name, impl, err)
+			}
+		}
+		if ready := adapter.Ready; ready != nil || s.Ready != nil {
+			if ready == nil {
+				ready = s.Ready
+			}
+			if err := ready.validate(adapter.Server); err != nil {
+				return fmt.Errorf("scenario %s: adapter %s: %w", s.Name, impl, err)
+			}
+		}
+		for name, rule := range adapter.Extract {
+			if _, err := regexp.Compile(rule.Regex); err != nil {
+				return fmt.Errorf("scenario %s: adapter %s: extract %s: %w", s.Name, impl, name, err)
+			}
+		}
+		for name, rule := range adapter.Metrics {
+			if !measurementName.MatchString(name) {
+				return fmt.Errorf("scenario %s: adapter %s: metric %q is not a valid measurement name", s.Name, impl, name)
+			}
+			switch rule.Stat {
+			case "", "last", "mean", "rate":
+			default:
+				return fmt.Errorf("scenario %s: adapter %s: metric %s: unknown stat %q", s.Name, impl, name, rule.Stat)
+			}
+		}
+	}
+	return nil
+}
+
+// scenarioFile is a scenario spec as read, before its base is merged in.
+type scenarioFile struct {
+	path string
+	data []byte
+	doc  map[string]any
+}
+
+func readScenarioFile(path string) (*scenarioFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	return &scenarioFile{path: path, data: data, doc: doc}, nil
+}
+
+// mergeScenario lays a scenario over the one it extends: mappings (adapters,
+// env, collectors, params, ...) merge key by key, anything else set in over
+// replaces the base's, and a key set to null removes it. A base marked
+// abstract is only ever extended, and may leave out what a runnable
+// scenario needs.
+func mergeScenario(base, over map[string]any) map[string]any {
+	merged := make(map[string]any, len(base)+len(over))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range over {
+		if v == nil {
+			delete(merged, k)
+			continue
+		}
+		if b, ok := merged[k].(map[string]any); ok {
+			if o, ok := v.(map[string]any); ok {
+				merged[k] = mergeScenario(b, o)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// resolveExtends returns the named scenario with its bases merged in.
+func resolveExtends(files map[string]*scenarioFile, name string, chain []string) (map[string]any, error) {
+	if slices.Contains(chain, name) {
+		return nil, fmt.Errorf("extends cycle: %s -> %s", strings.Join(chain, " -> "), name)
+	}
+	f := files[name]
+	baseName, _ := f.doc["extends"].(string)
+	if baseName == "" {
+		return f.doc, nil
+	}
+	if files[baseName] == nil {
+		return nil, fmt.Errorf("scenario %s extends unknown scenario %q", name, baseName)
+	}
+	base, err := resolveExtends(files, baseName, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+	base = mergeScenario(base, nil)
+	delete(base, "abstract")
+	return mergeScenario(base, f.doc), nil
+}
+
+func loadScenarios(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.y*ml"))
+	if err != nil {
+		return err
+	}
+	library, err := loadStepLibrary(filepath.Join(dir, "steps"))
+	if err != nil {
+		return err
+	}
+
+	files := map[string]*scenarioFile{}
+	for _, path := range paths {
+		f, err := readScenarioFile(path)
+		if err != nil {
+			return err
+		}
+		name, _ := f.doc["name"].(string)
+		if name == "" {
+			return fmt.Errorf("%s: scenario has no name", path)
+		}
+		files[name] = f
+	}
+
+	loaded := map[string]*ScenarioSpec{}
+	for name, f := range files {
+		if abstract, _ := f.doc["abstract"].(bool); abstract {
+			continue
+		}
+		data := f.data
+		if _, ok := f.doc["extends"]; ok {
+			doc, err := resolveExtends(files, name, nil)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.path, err)
+			}
+			if data, err = yaml.Marshal(doc); err != nil {
+				return fmt.Errorf("%s: %w", f.path, err)
+			}
+		}
+		var spec ScenarioSpec
+		if err := yaml.Unmarshal(data, &spec); err != nil {
+			return fmt.Errorf("%s: %w", f.path, err)
+		}
+		if err := spec.resolveSteps(library); err != nil {
+			return fmt.Errorf("%s: scenario %s: %w", f.path, name, err)
+		}
+		if err := spec.validate(); err != nil {
+			return fmt.Errorf("%s: %w", f.path, err)
+		}
+		loaded[spec.Name] = &spec
+	}
+
+	scenariosMu.Lock()
+	scenarios = loaded
+	scenariosMu.Unlock()
+	return nil
+}
+
+func getScenario(name string) (*ScenarioSpec, bool) {
+	scenariosMu.RLock()
+	defer scenariosMu.RUnlock()
+	spec, ok := scenarios[name]
+	return spec, ok
+}
+
+func scenarioNames() []string {
+	scenariosMu.RLock()
+	defer scenariosMu.RUnlock()
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func renderTemplate(text string, vars scenarioVars) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(template.FuncMap{"secret": secrets.get}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func renderTarget(t *Target, vars scenarioVars) (*Target, error) {
+	if t == nil {
+		return nil, nil
+	}
+	rendered := *t
+	for _, field := range []*string{&rendered.Process, &rendered.Container, &rendered.Cgroup, &rendered.Pod, &rendered.LogFile} {
+		value, err := renderTemplate(*field, vars)
+		if err != nil {
+			return nil, err
+		}
+		*field = value
+	}
+	return &rendered, nil
+}
+
+type extractor struct {
+	rules  map[string]ExtractRule
+	re     map[string]*regexp.Regexp
+	mu     sync.Mutex
+	values map[string]float64
+	seen   map[string]bool
+}
+
+func newExtractor(rules map[string]ExtractRule) *extractor {
+	e := &extractor{
+		rules:  rules,
+		re:     map[string]*regexp.Regexp{},
+		values: map[string]float64{},
+		seen:   map[string]bool{},
+	}
+	for name, rule := range rules {
+		e.re[name] = regexp.MustCompile(rule.Regex)
+	}
+	return e
+}
+
+func (e *extractor) line(line string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for name, re := range e.re {
+		m := re.FindStringSubmatch(line)
+		if len(m) < 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64)
+		if err != nil {
+			continue
+		}
+		if scale := e.rules[name].Scale; scale != 0 {
+			v *= scale
+		}
+
+		switch e.rules[name].Aggregate {
+		case "sum":
+			e.values[name] += v
+		case "max":
+			if !e.seen[name] || v > e.values[name] {
+				e.values[name] = v
+			}
+		default:
+			e.values[name] = v
+		}
+		e.seen[name] = true
+	}
+}
+
+// Values returns the extracted values; rules that never matched are absent.
+func (e *extractor) Values() map[string]float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := map[string]float64{}
+	for name, v := range e.values {
+		if e.seen[name] {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// cancelWaitDelay is how long Wait still reads a cancelled command's output
+// before closing it, should something outlive the kill.
+const cancelWaitDelay = 5 * time.Second
+
+// runAdapterCommand executes the adapter's command, feeding each output line
+// to the extractor, and returns the wall time it took.
+func runAdapterCommand(ctx context.Context, run *scenarioRun, ex *extractor) (time.Duration, error) {
+	if len(run.Adapter.Command) == 0 {
+		return 0, fmt.Errorf("adapter for %s has no command", run.Vars.Impl)
+	}
+
+	argv := make([]string, len(run.Adapter.Command))
+	for i, arg := range run.Adapter.Command {
+		rendered, err := renderTemplate(arg, run.Vars)
+		if err != nil {
+			return 0, fmt.Errorf("command argument %d: %w", i, err)
+		}
+		argv[i] = rendered
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = run.Vars.WorkDir
+	if run.cgroup != nil {
+		startInCgroup(cmd, run.cgroup)
+	}
+	killGroupOnCancel(cmd)
+	cmd.Env = os.Environ()
+	for key, value := range run.Adapter.Env {
+		rendered, err := renderTemplate(value, run.Vars)
+		if err != nil {
+			return 0, fmt.Errorf("env %s: %w", key, err)
+		}
+		cmd.Env = append(cmd.Env, key+"="+rendered)
+	}
+
+	rule := run.Adapter.Progress
+	if rule == nil {
+		rule = run.Spec.Progress
+	}
+	progress, err := newProgressParser(rule, run.Vars)
+	if err != nil {
+		return 0, err
+	}
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		// Progress is passed on at most once a second, plus the last
+		// report once the output ends.
+		var reported time.Time
+		var pending func()
+		for scanner.Scan() {
+			line := scanner.Text()
+			ex.line(line)
+			if run.log != nil {
+				run.log.line(run.logPrefix, line)
+			}
+			if progress == nil {
+				continue
+			}
+			if done, total, percent, ok := progress.line(line); ok {
+				pending = func() { collector.Progress(run.SessionID, done, total, percent) }
+				if time.Since(reported) >= progressInterval {
+					pending()
+					pending, reported = nil, time.Now()
+				}
+			}
+		}
+		if pending != nil {
+			pending()
+		}
+		io.Copy(io.Discard, pr)
+	}()
+
+	start := time.Now()
+	err = startScheduled(cmd, run.Spec.Scheduling)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	elapsed := time.Since(start)
+	pw.Close()
+	<-scanned
+
+	if err != nil {
+		return elapsed, fmt.Errorf("%s: %w", argv[0], err)
+	}
+	return elapsed, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+type BeaconSpec struct {
+	Duration string `yaml:"duration" json:"duration"`
+}
+
+// MetricRule turns one of the client's own Prometheus metrics into a
+// measurement, from scrapes at the start and end of the window: "mean" is a
+// histogram's or summary's average observation, "rate" a counter's per-second
+// increase and "last" a gauge's final value.
+type MetricRule struct {
+	Metric string  `yaml:"metric" json:"metric"`
+	Stat   string  `yaml:"stat,omitempty" json:"stat,omitempty"`
+	Scale  float64 `yaml:"scale,omitempty" json:"scale,omitempty"`
+}
+
+type BeaconData struct {
+	DurationMs  float64           `json:"duration_ms"`
+	Slots       int               `json:"slots"`
+	Blocks      int               `json:"blocks"`
+	MissedSlots int               `json:"missed_slots"`
+	BlockP50Ms  float64           `json:"block_p50_ms"`
+	BlockP95Ms  float64           `json:"block_p95_ms"`
+	HeadP50Ms   float64           `json:"head_p50_ms"`
+	HeadP95Ms   float64           `json:"head_p95_ms"`
+	Histogram   []HistogramBucket `json:"head_histogram"`
+}
+
+func init() {
+	scenarioTypes["beacon"] = runBeacon
+}
+
+type beaconClock struct {
+	genesis time.Time
+	slot    time.Duration
+}
+
+func (c beaconClock) slotStart(slot uint64) time.Time {
+	return c.genesis.Add(time.Duration(slot) * c.slot)
+}
+
+func beaconGet(ctx context.Context, base, path string, out interface{}) error {
+	return agentCall(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+path, nil, out)
+}
+
+func fetchBeaconClock(ctx context.Context, base string) (beaconClock, error) {
+	var genesis struct {
+		Data struct {
+			GenesisTime string `json:"genesis_time"`
+		} `json:"data"`
+	}
+	if err := beaconGet(ctx, base, "/eth/v1/beacon/genesis", &genesis); err != nil {
+		return beaconClock{}, err
+	}
+	var spec struct {
+		Data struct {
+			SecondsPerSlot string `json:"SECONDS_PER_SLOT"`
+		} `json:"data"`
+	}
+	if err := beaconGet(ctx, base, "/eth/v1/config/spec", &spec); err != nil {
+		return beaconClock{}, err
+	}
+
+	genesisTime, err := strconv.ParseInt(genesis.Data.GenesisTime, 10, 64)
+	if err != nil {
+		return beaconClock{}, fmt.Errorf("genesis_time: %w", err)
+	}
+	secondsPerSlot, err := strconv.Atoi(spec.Data.SecondsPerSlot)
+	if err != nil || secondsPerSlot <= 0 {
+		return beaconClock{}, fmt.Errorf("SECONDS_PER_SLOT %q", spec.Data.SecondsPerSlot)
+	}
+	return beaconClock{genesis: time.Unix(genesisTime, 0), slot: time.Duration(secondsPerSlot) * time.Second}, nil
+}
+
+// scrapeMetrics fetches and parses a Prometheus text endpoint.
+func scrapeMetrics(ctx context.Context, url string) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// metricTotals sums a family across its label sets: the value for counters
+// and gauges, sum and count for histograms and summaries.
+func metricTotals(families map[string]*dto.MetricFamily, name string) (value, sum, count float64, ok bool) {
+	family, ok := families[name]
+	if !ok {
+		return 0, 0, 0, false
+	}
+	for _, m := range family.GetMetric() {
+		switch {
+		case m.Counter != nil:
+			value += m.Counter.GetValue()
+		case m.Gauge != nil:
+			value += m.Gauge.GetValue()
+		case m.Untyped != nil:
+			value += m.Untyped.GetValue()
+		case m.Histogram != nil:
+			sum += m.Histogram.GetSampleSum()
+			count += float64(m.Histogram.GetSampleCount())
+		case m.Summary != nil:
+			sum += m.Summary.GetSampleSum()
+			count += float64(m.Summary.GetSampleCount())
+		}
+	}
+	return value, sum, count, true
+}
+
+func applyMetricRules(rules map[string]MetricRule, before, after map[string]*dto.MetricFamily, elapsed time.Duration) map[string]float64 {
+	out := map[string]float64{}
+	for name, rule := range rules {
+		v0, s0, c0, ok0 := metricTotals(before, rule.Metric)
+		v1, s1, c1, ok1 := metricTotals(after, rule.Metric)
+		if !ok1 {
+			continue
+		}
+
+		var v float64
+		switch rule.Stat {
+		case "mean":
+			if !ok0 || c1 <= c0 {
+				continue
+			}
+			v = (s1 - s0) / (c1 - c0)
+		case "rate":
+			if !ok0 || elapsed <= 0 {
+				continue
+			}
+			v = (v1 - v0) / elapsed.Seconds()
+		default:
+			v = v1
+		}
+		if rule.Scale != 0 {
+			v *= rule.Scale
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// watchBeaconEvents follows the node's event stream until ctx ends and
+// returns, per slot, when its block was received and when it became head.
+func watchBeaconEvents(ctx context.Context, base string) (blocks, heads map[uint64]time.Time, err error) {
+	blocks, heads = map[uint64]time.Time{}, map[uint64]time.Time{}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/eth/v1/events?topics=block,head", nil)
+	if err != nil {
+		return blocks, heads, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return blocks, heads, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return blocks, heads, fmt.Errorf("event stream: %s", resp.Status)
+	}
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			now := time.Now()
+			var data struct {
+				Slot string `json:"slot"`
+			}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &data) != nil {
+				continue
+			}
+			slot, err := strconv.ParseUint(data.Slot, 10, 64)
+			if err != nil {
+				continue
+			}
+			target := heads
+			if event == "block" {
+				target = blocks
+			}
+			if _, ok := target[slot]; !ok {
+				target[slot] = now
+			}
+		}
+	}
+	// The stream only ends when the window does.
+	return blocks, heads, nil
+}
+
+func slotDelays(events map[uint64]time.Time, clock beaconClock) []float64 {
+	delays := make([]float64, 0, len(events))
+	for slot, at := range events {
+		delays = append(delays, float64(at.Sub(clock.slotStart(slot)).Microseconds())/1000)
+	}
+	sort.Float64s(delays)
+	return delays
+}
+
+// runBeacon observes a consensus client for the window: how long after each
+// slot starts its block arrives and becomes head (from the standard beacon
+// API event stream), plus any client-specific metrics the adapter maps, such
+// as attestation processing times.
+func runBeacon(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	if run.Spec.Beacon == nil {
+		return nil, fmt.Errorf("beacon: scenario %s has no beacon section", run.Spec.Name)
+	}
+	duration, err := time.ParseDuration(run.Spec.Beacon.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("beacon: duration: %w", err)
+	}
+	base, err := renderTemplate(run.Adapter.BeaconURL, run.Vars)
+	if err != nil || base == "" {
+		return nil, fmt.Errorf("beacon: adapter for %s needs beacon_url", run.Vars.Impl)
+	}
+	metricsURL, err := renderTemplate(run.Adapter.MetricsURL, run.Vars)
+	if err != nil {
+		return nil, fmt.Errorf("beacon: metrics_url: %w", err)
+	}
+
+	clock, err := fetchBeaconClock(ctx, base)
+	if err != nil {
+		return nil, fmt.Errorf("beacon: %w", err)
+	}
+
+	var before map[string]*dto.MetricFamily
+	if metricsURL != "" && len(run.Adapter.Metrics) > 0 {
+		if before, err = scrapeMetrics(ctx, metricsURL); err != nil {
+			return nil, fmt.Errorf("beacon: %w", err)
+		}
+	}
+
+	start := time.Now()
+	windowCtx, cancel := context.WithTimeout(ctx, duration)
+	blocks, heads, err := watchBeaconEvents(windowCtx, base)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("beacon: %w", err)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	elapsed := time.Since(start)
+
+	blockDelays := slotDelays(blocks, clock)
+	headDelays := slotDelays(heads, clock)
+	// Only slots that both started and ended inside the window count, so a
+	// block still in flight at the end is not reported as missed.
+	firstSlot := uint64((start.Sub(clock.genesis) + clock.slot - 1) / clock.slot)
+	endSlot := uint64(start.Add(elapsed).Sub(clock.genesis) / clock.slot)
+	slots, seen := 0, 0
+	for slot := firstSlot; slot < endSlot; slot++ {
+		slots++
+		if _, ok := blocks[slot]; ok {
+			seen++
+		}
+	}
+	data := &BeaconData{
+		DurationMs: float64(elapsed.Microseconds()) / 1000,
+		Slots:      slots,
+		Blocks:     len(blocks),
+		BlockP50Ms: sortedPercentile(blockDelays, 0.50),
+		BlockP95Ms: sortedPercentile(blockDelays, 0.95),
+		HeadP50Ms:  sortedPercentile(headDelays, 0.50),
+		HeadP95Ms:  sortedPercentile(headDelays, 0.95),
+	}
+	data.MissedSlots = slots - seen
+	us := make([]float64, len(headDelays))
+	for i, ms := range headDelays {
+		us[i] = ms * 1000
+	}
+	data.Histogram = powerOfTwoHistogram(us)
+	run.attach(func(e *Evidence) { e.Beacon = data })
+
+	measurements := map[string]float64{
+		"beacon_block_p95_ms": data.BlockP95Ms,
+		"beacon_head_p50_ms":  data.HeadP50Ms,
+		"beacon_head_p95_ms":  data.HeadP95Ms,
+		"beacon_missed_slots": float64(data.MissedSlots),
+	}
+	if before != nil {
+		after, err := scrapeMetrics(ctx, metricsURL)
+		if err != nil {
+			return measurements, fmt.Errorf("beacon: %w", err)
+		}
+		for name, v := range applyMetricRules(run.Adapter.Metrics, before, after, elapsed) {
+			measurements[name] = v
+		}
+	}
+	return measurements, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	scenarioTypes["block-import"] = runBlockImport
+}
+
+// runBlockImport drives an implementation through importing the dataset's
+// blocks, either with the client's own import command ("cli", the default)
+// or by replaying recorded engine API calls ("engine-api").
+func runBlockImport(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	var (
+		blocks, gas float64
+		elapsed     time.Duration
+		err         error
+	)
+
+	switch run.Adapter.Mode {
+	case "", "cli":
+		ex := newExtractor(run.Adapter.Extract)
+		elapsed, err = runAdapterCommand(ctx, run, ex)
+		if err != nil {
+			return nil, err
+		}
+		values := ex.Values()
+		blocks, gas = values["blocks"], values["gas"]
+		if _, ok := values["blocks"]; !ok {
+			blocks = float64(run.Vars.Blocks)
+		}
+	case "engine-api":
+		blocks, gas, elapsed, err = replayEnginePayloads(ctx, run)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("block-import: unknown adapter mode %q", run.Adapter.Mode)
+	}
+
+	seconds := elapsed.Seconds()
+	measurements := map[string]float64{
+		"import_seconds":  seconds,
+		"blocks_imported": blocks,
+	}
+	if seconds > 0 {
+		measurements["blocks_per_second"] = blocks / seconds
+	}
+	if gas > 0 {
+		measurements["gas_used"] = gas
+		if seconds > 0 {
+			measurements["gas_per_second"] = gas / seconds
+		}
+	}
+	return measurements, nil
+}
+
+// replayEnginePayloads sends each line of the dataset (a JSON object with
+// "method" and "params") to the engine API. Every engine_newPayload* call is
+// one block; its gasUsed contributes to the gas total.
+func replayEnginePayloads(ctx context.Context, run *scenarioRun) (blocks, gas float64, elapsed time.Duration, err error) {
+	url, err := renderTemplate(run.Adapter.EngineURL, run.Vars)
+	if err != nil || url == "" {
+		return 0, 0, 0, fmt.Errorf("engine-api adapter needs engine_url")
+	}
+
+	client := newRPCClient(url, 60*time.Second)
+	if run.Adapter.JWTSecretFile != "" {
+		secret, err := readJWTSecret(run.Adapter.JWTSecretFile)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		client.header = func(h http.Header) { h.Set("Authorization", "Bearer "+engineJWT(secret)) }
+	}
+
+	f, err := os.Open(run.Vars.DatasetPath)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+
+	start := time.Now()
+	for line := 1; scanner.Scan(); line++ {
+		if ctx.Err() != nil {
+			return blocks, gas, time.Since(start), ctx.Err()
+		}
+
+		var call struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			return blocks, gas, time.Since(start), fmt.Errorf("dataset line %d: %w", line, err)
+		}
+
+		result, err := client.Call(ctx, call.Method, call.Params)
+		if err != nil {
+			return blocks, gas, time.Since(start), fmt.Errorf("dataset line %d: %w", line, err)
+		}
+
+		if !strings.HasPrefix(call.Method, "engine_newPayload") {
+			continue
+		}
+		var status struct {
+			Status          string `json:"status"`
+			ValidationError string `json:"validationError"`
+		}
+		json.Unmarshal(result, &status)
+		if status.Status == "INVALID" {
+			return blocks, gas, time.Since(start), fmt.Errorf("dataset line %d: payload invalid: %s", line, status.ValidationError)
+		}
+
+		blocks++
+		if len(call.Params) > 0 {
+			var payload struct {
+				GasUsed string `json:"gasUsed"`
+			}
+			if json.Unmarshal(call.Params[0], &payload) == nil && payload.GasUsed != "" {
+				if used, err := parseHexUint(payload.GasUsed); err == nil {
+					gas += float64(used)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return blocks, gas, time.Since(start), err
+	}
+	return blocks, gas, time.Since(start), nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type EVMBenchSpec struct {
+	Categories []string `yaml:"categories,omitempty" json:"categories,omitempty"`
+	Iterations int      `yaml:"iterations,omitempty" json:"iterations,omitempty"`
+}
+
+type EVMCategoryStats struct {
+	Category  string  `json:"category"`
+	Fixtures  int     `json:"fixtures"`
+	Gas       float64 `json:"gas"`
+	Seconds   float64 `json:"seconds"`
+	GasPerSec float64 `json:"gas_per_sec"`
+}
+
+type EVMBenchData struct {
+	Iterations int                `json:"iterations"`
+	Gas        float64            `json:"gas"`
+	Seconds    float64            `json:"seconds"`
+	GasPerSec  float64            `json:"gas_per_sec"`
+	Categories []EVMCategoryStats `json:"categories"`
+}
+
+type evmFixture struct {
+	category string
+	path     string
+}
+
+func init() {
+	scenarioTypes["evm-bench"] = runEVMBench
+}
+
+// evmFixtures lists dataset_path/<category>/<fixture>, restricted to the
+// spec's categories when it names any.
+func evmFixtures(dir string, categories []string) ([]evmFixture, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, c := range categories {
+		wanted[c] = true
+	}
+
+	var fixtures []evmFixture
+	for _, entry := range entries {
+		if !entry.IsDir() || (len(wanted) > 0 && !wanted[entry.Name()]) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			fixtures = append(fixtures, evmFixture{category: entry.Name(), path: filepath.Join(dir, entry.Name(), f.Name())})
+		}
+	}
+	if len(fixtures) == 0 {
+		return nil, fmt.Errorf("no fixtures under %s", dir)
+	}
+	return fixtures, nil
+}
+
+// runEVMBench executes every fixture through the implementation's EVM in
+// isolation: with its standalone bench tool ("cli", the default) or as
+// engine API payloads against an otherwise idle node ("engine-api"). Gas is
+// totalled per opcode category, which is the fixture's directory name.
+func runEVMBench(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	if run.Vars.DatasetPath == "" {
+		return nil, fmt.Errorf("evm-bench: scenario %s has no dataset_path", run.Spec.Name)
+	}
+	spec := run.Spec.EVM
+	if spec == nil {
+		spec = &EVMBenchSpec{}
+	}
+	iterations := spec.Iterations
+	if iterations <= 0 {
+		iterations = 1
+	}
+
+	fixtures, err := evmFixtures(run.Vars.DatasetPath, spec.Categories)
+	if err != nil {
+		return nil, fmt.Errorf("evm-bench: %w", err)
+	}
+
+	stats := map[string]*EVMCategoryStats{}
+	for i := 0; i < iterations; i++ {
+		for _, fixture := range fixtures {
+			gas, elapsed, err := runEVMFixture(ctx, run, fixture)
+			if err != nil {
+				return nil, fmt.Errorf("evm-bench: %s: %w", filepath.Base(fixture.path), err)
+			}
+
+			s, ok := stats[fixture.category]
+			if !ok {
+				s = &EVMCategoryStats{Category: fixture.category}
+				stats[fixture.category] = s
+			}
+			if i == 0 {
+				s.Fixtures++
+			}
+			s.Gas += gas
+			s.Seconds += elapsed.Seconds()
+		}
+		if err := run.iterationDone(ctx); err != nil {
+			return nil, fmt.Errorf("evm-bench: %w", err)
+		}
+	}
+
+	data := &EVMBenchData{Iterations: iterations}
+	measurements := map[string]float64{}
+	for _, s := range stats {
+		if s.Seconds > 0 {
+			s.GasPerSec = s.Gas / s.Seconds
+		}
+		data.Gas += s.Gas
+		data.Seconds += s.Seconds
+		data.Categories = append(data.Categories, *s)
+		if name := "evm_" + s.Category + "_gas_per_second"; measurementName.MatchString(name) {
+			measurements[name] = s.GasPerSec
+		}
+	}
+	sort.Slice(data.Categories, func(i, j int) bool { return data.Categories[i].Category < data.Categories[j].Category })
+	if data.Seconds > 0 {
+		data.GasPerSec = data.Gas / data.Seconds
+	}
+	measurements["evm_gas_per_second"] = data.GasPerSec
+
+	run.attach(func(e *Evidence) { e.EVM = data })
+	return measurements, nil
+}
+
+// runEVMFixture runs one fixture and returns the gas it burned and the time
+// spent executing it. Bench tools usually print their own execution time,
+// which excludes process start-up and state loading; a "seconds" extract rule
+// picks it up, otherwise the command's wall time is used.
+func runEVMFixture(ctx context.Context, run *scenarioRun, fixture evmFixture) (float64, time.Duration, error) {
+	fixtureRun := *run
+	fixtureRun.Vars.Fixture = fixture.path
+	fixtureRun.Vars.Category = fixture.category
+
+	switch run.Adapter.Mode {
+	case "", "cli":
+		ex := newExtractor(run.Adapter.Extract)
+		elapsed, err := runAdapterCommand(ctx, &fixtureRun, ex)
+		if err != nil {
+			return 0, elapsed, err
+		}
+		values := ex.Values()
+		gas, ok := values["gas"]
+		if !ok {
+			return 0, elapsed, fmt.Errorf("no gas figure in output (needs a \"gas\" extract rule)")
+		}
+		if seconds, ok := values["seconds"]; ok {
+			elapsed = time.Duration(seconds * float64(time.Second))
+		}
+		return gas, elapsed, nil
+	case "engine-api":
+		fixtureRun.Vars.DatasetPath = fixture.path
+		_, gas, elapsed, err := replayEnginePayloads(ctx, &fixtureRun)
+		return gas, elapsed, err
+	default:
+		return 0, 0, fmt.Errorf("unknown adapter mode %q", run.Adapter.Mode)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KubeJobSpec is how an adapter's workload is run as a Kubernetes Job. The
+// adapter's command, env and extract rules apply to the Job's container.
+type KubeJobSpec struct {
+	Image          string            `yaml:"image" json:"image"`
+	Namespace      string            `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Resources      *KubeResources    `yaml:"resources,omitempty" json:"resources,omitempty"`
+	NodeSelector   map[string]string `yaml:"node_selector,omitempty" json:"node_selector,omitempty"`
+	ServiceAccount string            `yaml:"service_account,omitempty" json:"service_account,omitempty"`
+	AgentPort      int               `yaml:"agent_port,omitempty" json:"agent_port,omitempty"`
+}
+
+type KubeResources struct {
+	Requests map[string]string `yaml:"requests,omitempty" json:"requests,omitempty"`
+	Limits   map[string]string `yaml:"limits,omitempty" json:"limits,omitempty"`
+}
+
+type KubernetesJobData struct {
+	Job       string `json:"job"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Node      string `json:"node"`
+	Image     string `json:"image"`
+	Phase     string `json:"phase"`
+	ExitCode  int    `json:"exit_code"`
+	// Reason is why the container terminated, e.g. OOMKilled.
+	Reason      string  `json:"reason,omitempty"`
+	DurationMs  float64 `json:"duration_ms"`
+	Agent       string  `json:"agent,omitempty"`
+	RemoteRunID string  `json:"remote_run_id,omitempty"`
+}
+
+type kubePod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase             string `json:"phase"`
+		HostIP            string `json:"hostIP"`
+		ContainerStatuses []struct {
+			State struct {
+				Terminated *struct {
+					ExitCode   int       `json:"exitCode"`
+					Reason     string    `json:"reason"`
+					StartedAt  time.Time `json:"startedAt"`
+					FinishedAt time.Time `json:"finishedAt"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+func init() {
+	scenarioTypes["k8s-job"] = runKubernetesJob
+}
+
+const kubeWorkloadContainer = "workload"
+
+func kubeJobManifest(name string, spec *KubeJobSpec, image string, run *scenarioRun) (map[string]interface{}, error) {
+	argv := make([]string, len(run.Adapter.Command))
+	for i, arg := range run.Adapter.Command {
+		rendered, err := renderTemplate(arg, run.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("command argument %d: %w", i, err)
+		}
+		argv[i] = rendered
+	}
+	env := []map[string]string{}
+	for key, value := range run.Adapter.Env {
+		rendered, err := renderTemplate(value, run.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", key, err)
+		}
+		env = append(env, map[string]string{"name": key, "value": rendered})
+	}
+
+	container := map[string]interface{}{
+		"name":  kubeWorkloadContainer,
+		"image": image,
+		"env":   env,
+	}
+	if len(argv) > 0 {
+		container["command"] = argv
+	}
+	if spec.Resources != nil {
+		container["resources"] = spec.Resources
+	}
+
+	labels := map[string]string{
+		"app.kubernetes.io/name":       "chainbench-workload",
+		"app.kubernetes.io/managed-by": "chainbench-agent",
+		"chainbench/session":           strings.ToLower(run.SessionID),
+	}
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers":    []interface{}{container},
+	}
+	if len(spec.NodeSelector) > 0 {
+		podSpec["nodeSelector"] = spec.NodeSelector
+	}
+	if spec.ServiceAccount != "" {
+		podSpec["serviceAccountName"] = spec.ServiceAccount
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]interface{}{"name": name, "labels": labels},
+		"spec": map[string]interface{}{
+			// A benchmark is run once; a retried pod would measure something else.
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 3600,
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec":     podSpec,
+			},
+		},
+	}, nil
+}
+
+// runKubernetesJob launches the workload as a Job, has the agent on the node
+// it was scheduled to collect evidence for its pod while it runs, and merges
+// that evidence into this run. When the pod lands on this agent's own node
+// the local session is retargeted at it instead.
+func runKubernetesJob(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	spec := run.Adapter.Kubernetes
+	if spec == nil || spec.Image == "" {
+		return nil, fmt.Errorf("k8s-job: adapter for %s has no kubernetes.image", run.Vars.Impl)
+	}
+	image, err := renderTemplate(spec.Image, run.Vars)
+	if err != nil {
+		return nil, fmt.Errorf("k8s-job: image: %w", err)
+	}
+	namespace := spec.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	agentPort := spec.AgentPort
+	if agentPort == 0 {
+		agentPort = 9090
+	}
+
+	api, err := newInClusterAPI()
+	if err != nil {
+		return nil, fmt.Errorf("k8s-job: %w", err)
+	}
+
+	name := "chainbench-" + strings.ToLower(run.SessionID)
+	manifest, err := kubeJobManifest(name, spec, image, run)
+	if err != nil {
+		return nil, fmt.Errorf("k8s-job: %w", err)
+	}
+	if err := api.do(ctx, http.MethodPost, "/apis/batch/v1/namespaces/"+namespace+"/jobs", manifest, nil); err != nil {
+		return nil, fmt.Errorf("k8s-job: creating job: %w", err)
+	}
+	log.Printf("k8s-job: created job %s/%s (%s)", namespace, name, image)
+
+	data := &KubernetesJobData{Job: name, Namespace: namespace, Image: image}
+	run.attach(func(e *Evidence) { e.KubernetesJob = data })
+
+	finished := false
+	defer func() {
+		if !finished {
+			// Timed out or failed while waiting: do not leave the workload running.
+			api.do(context.Background(), http.MethodDelete,
+				"/apis/batch/v1/namespaces/"+namespace+"/jobs/"+name+"?propagationPolicy=Background", nil, nil)
+		}
+	}()
+
+	podsPath := "/api/v1/namespaces/" + namespace + "/pods?labelSelector=" + url.QueryEscape("job-name="+name)
+	getPod := func() (*kubePod, error) {
+		var list struct {
+			Items []kubePod `json:"items"`
+		}
+		if err := api.do(ctx, http.MethodGet, podsPath, nil, &list); err != nil {
+			return nil, err
+		}
+		if len(list.Items) == 0 {
+			return nil, nil
+		}
+		return &list.Items[0], nil
+	}
+
+	// Wait for the scheduler to place the pod.
+	var pod *kubePod
+	for pod == nil || pod.Spec.NodeName == "" || pod.Status.HostIP == "" {
+		if pod, err = getPod(); err != nil {
+			return nil, fmt.Errorf("k8s-job: %w", err)
+		}
+		if pod != nil && pod.Spec.NodeName != "" && pod.Status.HostIP != "" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("k8s-job: pod not scheduled: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+	data.Pod, data.Node = pod.Metadata.Name, pod.Spec.NodeName
+	target := &Target{Pod: namespace + "/" + pod.Metadata.Name}
+	log.Printf("k8s-job: pod %s scheduled on %s", data.Pod, data.Node)
+
+	var remoteEvidence *Evidence
+	if kubelet != nil && kubelet.node == data.Node {
+		if err := collector.Retarget(run.SessionID, target); err != nil {
+			return nil, fmt.Errorf("k8s-job: %w", err)
+		}
+	} else {
+		data.Agent = "http://" + net.JoinHostPort(pod.Status.HostIP, strconv.Itoa(agentPort))
+		req := StartRequest{
+			Scenario:   run.Vars.Scenario,
+			Impl:       run.Vars.Impl,
+			Variant:    run.Vars.Variant,
+			Commit:     run.Vars.Commit,
+			Dataset:    run.Vars.Dataset,
+			Project:    run.Vars.Project,
+			Params:     run.Vars.Params,
+			Target:     target,
+			Tags:       run.Tags,
+			Collectors: run.Spec.Collectors,
+		}
+		if err := agentCall(ctx, http.MethodPost, data.Agent+"/start", req, nil); err != nil {
+			return nil, fmt.Errorf("k8s-job: starting collection on %s: %w", data.Node, err)
+		}
+		defer func() {
+			var evidence Evidence
+			if err := agentCall(context.Background(), http.MethodPost, data.Agent+"/stop", nil, &evidence); err != nil {
+				log.Printf("k8s-job: stopping collection on %s: %v", data.Node, err)
+				return
+			}
+			remoteEvidence = &evidence
+			data.RemoteRunID = evidence.RunID
+		}()
+	}
+
+	for pod.Status.Phase != "Succeeded" && pod.Status.Phase != "Failed" {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("k8s-job: %w", ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+		next, err := getPod()
+		if err != nil {
+			return nil, fmt.Errorf("k8s-job: %w", err)
+		}
+		if next == nil {
+			return nil, fmt.Errorf("k8s-job: pod %s disappeared", data.Pod)
+		}
+		pod = next
+	}
+	finished = true
+	data.Phase = pod.Status.Phase
+	for _, status := range pod.Status.ContainerStatuses {
+		if t := status.State.Terminated; t != nil {
+			data.ExitCode = t.ExitCode
+			data.Reason = t.Reason
+			data.DurationMs = float64(t.FinishedAt.Sub(t.StartedAt).Milliseconds())
+		}
+	}
+
+	// The remote agent's kernel view is the one that saw the workload.
+	run.attach(func(e *Evidence) {
+		if remoteEvidence == nil {
+			return
+		}
+		e.Available = remoteEvidence.Available
+		e.Runqlat = remoteEvidence.Runqlat
+		e.Biolatency = remoteEvidence.Biolatency
+		e.Offcpu = remoteEvidence.Offcpu
+		e.Exec = remoteEvidence.Exec
+		e.SyscallCounts = remoteEvidence.SyscallCounts
+		e.Compaction = remoteEvidence.Compaction
+		e.Cgroups = remoteEvidence.Cgroups
+		e.Threads = remoteEvidence.Threads
+		e.Sockets = remoteEvidence.Sockets
+		e.Files = remoteEvidence.Files
+		e.Noise = remoteEvidence.Noise
+		e.Thermal = remoteEvidence.Thermal
+		e.Clock = remoteEvidence.Clock
+		e.Target = remoteEvidence.Target
+	})
+
+	measurements := map[string]float64{"duration_ms": data.DurationMs}
+	var logs []byte
+	logPath := "/api/v1/namespaces/" + namespace + "/pods/" + data.Pod + "/log?container=" + kubeWorkloadContainer
+	if err := api.do(ctx, http.MethodGet, logPath, nil, &logs); err != nil {
+		log.Printf("k8s-job: fetching logs of %s: %v", data.Pod, err)
+	} else {
+		ex := newExtractor(run.Adapter.Extract)
+		for _, line := range strings.Split(string(logs), "\n") {
+			ex.line(line)
+		}
+		for name, value := range ex.Values() {
+			measurements[name] = value
+		}
+	}
+
+	if data.Phase == "Failed" {
+		return measurements, fmt.Errorf("k8s-job: pod %s failed with exit code %d", data.Pod, data.ExitCode)
+	}
+	return measurements, nil
+}
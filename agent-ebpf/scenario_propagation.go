@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PropagationSpec struct {
+	RPCURL       string            `yaml:"rpc_url,omitempty" json:"rpc_url,omitempty"`
+	Rate         float64           `yaml:"rate,omitempty" json:"rate,omitempty"`
+	Settle       string            `yaml:"settle,omitempty" json:"settle,omitempty"`
+	PollInterval string            `yaml:"poll_interval,omitempty" json:"poll_interval,omitempty"`
+	Peers        []PropagationPeer `yaml:"peers" json:"peers"`
+}
+
+// PropagationPeer is another agent observing its own node.
+type PropagationPeer struct {
+	Agent  string `yaml:"agent" json:"agent"`
+	RPCURL string `yaml:"rpc_url" json:"rpc_url"`
+}
+
+type PeerPropagation struct {
+	Peer           string            `json:"peer"`
+	Seen           int               `json:"seen"`
+	Included       int               `json:"included"`
+	ArrivalP50Ms   float64           `json:"arrival_p50_ms"`
+	ArrivalP95Ms   float64           `json:"arrival_p95_ms"`
+	ArrivalP99Ms   float64           `json:"arrival_p99_ms"`
+	InclusionP50Ms float64           `json:"inclusion_p50_ms"`
+	InclusionP95Ms float64           `json:"inclusion_p95_ms"`
+	Histogram      []HistogramBucket `json:"arrival_histogram"`
+}
+
+type PropagationData struct {
+	Transactions int               `json:"transactions"`
+	Rejected     int               `json:"rejected"`
+	Peers        []PeerPropagation `json:"peers"`
+}
+
+func init() {
+	scenarioTypes["tx-propagation"] = runTxPropagation
+}
+
+func readRawTransactions(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var txs []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			txs = append(txs, line)
+		}
+	}
+	return txs, scanner.Err()
+}
+
+// runTxPropagation injects the dataset's signed raw transactions into the
+// local node and collects, from every peer agent, when each one arrived at
+// and was included by that peer's node. This agent coordinates: it starts
+// and stops the peers' observers and merges their timings.
+func runTxPropagation(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	spec := run.Spec.Propagation
+	if spec == nil || len(spec.Peers) == 0 {
+		return nil, fmt.Errorf("tx-propagation: scenario %s has no propagation.peers", run.Spec.Name)
+	}
+	url := spec.RPCURL
+	if run.Adapter.RPCURL != "" {
+		url = run.Adapter.RPCURL
+	}
+	url, err := renderTemplate(url, run.Vars)
+	if err != nil || url == "" {
+		return nil, fmt.Errorf("tx-propagation: no rpc_url")
+	}
+	settle, err := parseOptionalDuration(spec.Settle, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("tx-propagation: settle: %w", err)
+	}
+
+	txs, err := readRawTransactions(run.Vars.DatasetPath)
+	if err != nil {
+		return nil, fmt.Errorf("tx-propagation: %w", err)
+	}
+	if len(txs) == 0 {
+		return nil, fmt.Errorf("tx-propagation: %s has no transactions", run.Vars.DatasetPath)
+	}
+
+	observeID := newRunID()
+	started := make([]PropagationPeer, 0, len(spec.Peers))
+	stopPeers := func() map[string]TxObservations {
+		out := map[string]TxObservations{}
+		for _, peer := range started {
+			var obs TxObservations
+			if err := agentCall(context.Background(), http.MethodDelete, peer.Agent+"/propagation/"+observeID, nil, &obs); err != nil {
+				continue
+			}
+			out[peer.Agent] = obs
+		}
+		return out
+	}
+	for _, peer := range spec.Peers {
+		body := map[string]string{"rpc_url": peer.RPCURL, "poll_interval": spec.PollInterval}
+		if err := agentCall(ctx, http.MethodPost, peer.Agent+"/propagation/"+observeID, body, nil); err != nil {
+			stopPeers()
+			return nil, fmt.Errorf("tx-propagation: starting observer: %w", err)
+		}
+		started = append(started, peer)
+	}
+
+	client := newRPCClient(url, 10*time.Second)
+	sent := map[string]time.Time{}
+	rejected := 0
+	var interval time.Duration
+	if spec.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / spec.Rate)
+	}
+	for _, tx := range txs {
+		if ctx.Err() != nil {
+			break
+		}
+		t0 := time.Now()
+		raw, err := client.Call(ctx, "eth_sendRawTransaction", []interface{}{tx})
+		var hash string
+		if err != nil || json.Unmarshal(raw, &hash) != nil {
+			rejected++
+		} else {
+			sent[strings.ToLower(hash)] = t0
+		}
+		if interval > 0 {
+			if wait := interval - time.Since(t0); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+
+	// Give the network time to carry and include what was sent, finishing
+	// early once every peer has included every transaction.
+	deadline := time.Now().Add(settle)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		time.Sleep(time.Second)
+		complete := true
+		for _, peer := range started {
+			var obs TxObservations
+			if err := agentCall(ctx, http.MethodGet, peer.Agent+"/propagation/"+observeID, nil, &obs); err != nil {
+				complete = false
+				break
+			}
+			for hash := range sent {
+				if _, ok := obs.Included[hash]; !ok {
+					complete = false
+					break
+				}
+			}
+		}
+		if complete {
+			break
+		}
+	}
+
+	observations := stopPeers()
+	data := mergePropagation(sent, observations)
+	data.Rejected = rejected
+	run.attach(func(e *Evidence) { e.Propagation = data })
+
+	measurements := map[string]float64{
+		"propagation_transactions": float64(data.Transactions),
+	}
+	var worstP95, worstInclusion float64
+	for _, p := range data.Peers {
+		if p.ArrivalP95Ms > worstP95 {
+			worstP95 = p.ArrivalP95Ms
+		}
+		if p.InclusionP95Ms > worstInclusion {
+			worstInclusion = p.InclusionP95Ms
+		}
+	}
+	measurements["propagation_p95_ms"] = worstP95
+	measurements["inclusion_p95_ms"] = worstInclusion
+
+	if len(observations) < len(started) {
+		return measurements, fmt.Errorf("tx-propagation: %d of %d peers did not return observations", len(started)-len(observations), len(started))
+	}
+	return measurements, nil
+}
+
+func mergePropagation(sent map[string]time.Time, observations map[string]TxObservations) *PropagationData {
+	data := &PropagationData{Transactions: len(sent)}
+
+	for peer, obs := range observations {
+		var arrivals, inclusions []float64
+		for hash, at := range sent {
+			if seen, ok := obs.Seen[hash]; ok {
+				arrivals = append(arrivals, float64(seen.Sub(at).Microseconds())/1000)
+			}
+			if inc, ok := obs.Included[hash]; ok {
+				inclusions = append(inclusions, float64(inc.At.Sub(at).Microseconds())/1000)
+			}
+		}
+		sort.Float64s(arrivals)
+		sort.Float64s(inclusions)
+
+		// Clock skew between machines can make early arrivals negative;
+		// they are clamped for the histogram but kept in the percentiles.
+		us := make([]float64, len(arrivals))
+		for i, ms := range arrivals {
+			us[i] = ms * 1000
+			if us[i] < 1 {
+				us[i] = 1
+			}
+		}
+
+		data.Peers = append(data.Peers, PeerPropagation{
+			Peer:           peer,
+			Seen:           len(arrivals),
+			Included:       len(inclusions),
+			ArrivalP50Ms:   sortedPercentile(arrivals, 0.50),
+			ArrivalP95Ms:   sortedPercentile(arrivals, 0.95),
+			ArrivalP99Ms:   sortedPercentile(arrivals, 0.99),
+			InclusionP50Ms: sortedPercentile(inclusions, 0.50),
+			InclusionP95Ms: sortedPercentile(inclusions, 0.95),
+			Histogram:      powerOfTwoHistogram(us),
+		})
+	}
+	sort.Slice(data.Peers, func(i, j int) bool { return data.Peers[i].Peer < data.Peers[j].Peer })
+	return data
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type RPCLoadSpec struct {
+	RPCURL      string          `yaml:"rpc_url,omitempty" json:"rpc_url,omitempty"`
+	Duration    string          `yaml:"duration" json:"duration"`
+	Rate        float64         `yaml:"rate,omitempty" json:"rate,omitempty"`
+	Concurrency int             `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	Timeout     string          `yaml:"request_timeout,omitempty" json:"request_timeout,omitempty"`
+	Mix         []RPCMethodSpec `yaml:"mix" json:"mix"`
+}
+
+// maxRPCRate is the highest rate whose ticker interval is still at least a
+// nanosecond.
+const maxRPCRate = float64(time.Second)
+
+func (l *RPCLoadSpec) validate() error {
+	duration, err := time.ParseDuration(l.Duration)
+	if err != nil {
+		return fmt.Errorf("load: duration: %w", err)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("load: duration must be positive")
+	}
+	if l.Timeout != "" {
+		timeout, err := time.ParseDuration(l.Timeout)
+		if err != nil {
+			return fmt.Errorf("load: request_timeout: %w", err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("load: request_timeout must be positive")
+		}
+	}
+	// An unset rate runs closed-loop; a set one must give a ticker a
+	// positive interval.
+	if l.Rate < 0 || l.Rate > maxRPCRate {
+		return fmt.Errorf("load: rate %g is not between 0 and %g per second", l.Rate, maxRPCRate)
+	}
+	if l.Concurrency < 0 {
+		return fmt.Errorf("load: concurrency must not be negative")
+	}
+	return nil
+}
+
+type RPCMethodSpec struct {
+	Method string        `yaml:"method" json:"method"`
+	Weight float64       `yaml:"weight,omitempty" json:"weight,omitempty"`
+	Params []interface{} `yaml:"params,omitempty" json:"params,omitempty"`
+}
+
+type RPCMethodStats struct {
+	Method    string            `json:"method"`
+	Requests  int               `json:"requests"`
+	Errors    int               `json:"errors"`
+	ErrorRate float64           `json:"error_rate"`
+	P50Us     float64           `json:"p50_us"`
+	P95Us     float64           `json:"p95_us"`
+	P99Us     float64           `json:"p99_us"`
+	Histogram []HistogramBucket `json:"histogram"`
+}
+
+type RPCLoadData struct {
+	DurationMs     float64          `json:"duration_ms"`
+	Requests       int              `json:"requests"`
+	Errors         int              `json:"errors"`
+	ErrorRate      float64          `json:"error_rate"`
+	RequestsPerSec float64          `json:"requests_per_sec"`
+	P95Us          float64          `json:"p95_us"`
+	Methods        []RPCMethodStats `json:"methods"`
+}
+
+var defaultRPCParams = map[string][]interface{}{
+	"eth_blockNumber":      {},
+	"eth_chainId":          {},
+	"eth_gasPrice":         {},
+	"eth_getBlockByNumber": {"latest", false},
+	"eth_getLogs":          {map[string]string{"fromBlock": "latest", "toBlock": "latest"}},
+}
+
+var rpcLatency = newHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "chainbench_rpc_latency_microseconds",
+		Help:    "JSON-RPC request latency under generated load",
+		Buckets: prometheus.ExponentialBuckets(16, 2, 20),
+	},
+	[]string{"scenario", "impl", "variant", "method", "commit", "machine", "dataset", "project"},
+)
+
+func init() {
+	scenarioTypes["rpc-load"] = runRPCLoad
+}
+
+type rpcSamples struct {
+	mu        sync.Mutex
+	latencies map[string][]float64
+	errors    map[string]int
+}
+
+func (s *rpcSamples) record(method string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[method]++
+		return
+	}
+	s.latencies[method] = append(s.latencies[method], float64(latency.Microseconds()))
+}
+
+func sortedPercentile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(q * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+// powerOfTwoHistogram buckets microsecond samples the way the kernel
+// histograms are reported: each bucket is the next power of two.
+func powerOfTwoHistogram(samples []float64) []HistogramBucket {
+	counts := map[int]int{}
+	for _, v := range samples {
+		bucket := 1
+		for float64(bucket) < v {
+			bucket <<= 1
+		}
+		counts[bucket]++
+	}
+
+	hist := make([]HistogramBucket, 0, len(counts))
+	for bucket, count := range counts {
+		hist = append(hist, HistogramBucket{BucketUs: bucket, Count: count})
+	}
+	sort.Slice(hist, func(i, j int) bool { return hist[i].BucketUs < hist[j].BucketUs })
+	return hist
+}
+
+func runRPCLoad(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	load := run.Spec.Load
+	if load == nil || len(load.Mix) == 0 {
+		return nil, fmt.Errorf("rpc-load: scenario %s has no load.mix", run.Spec.Name)
+	}
+
+	url := load.RPCURL
+	if run.Adapter.RPCURL != "" {
+		url = run.Adapter.RPCURL
+	}
+	url, err := renderTemplate(url, run.Vars)
+	if err != nil || url == "" {
+		return nil, fmt.Errorf("rpc-load: no rpc_url")
+	}
+
+	if err := load.validate(); err != nil {
+		return nil, fmt.Errorf("rpc-load: %w", err)
+	}
+	duration, _ := time.ParseDuration(load.Duration)
+	timeout := 10 * time.Second
+	if load.Timeout != "" {
+		timeout, _ = time.ParseDuration(load.Timeout)
+	}
+	concurrency := load.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	totalWeight := 0.0
+	for _, m := range load.Mix {
+		totalWeight += methodWeight(m)
+	}
+	pick := func(rng *rand.Rand) RPCMethodSpec {
+		x := rng.Float64() * totalWeight
+		for _, m := range load.Mix {
+			x -= methodWeight(m)
+			if x < 0 {
+				return m
+			}
+		}
+		return load.Mix[len(load.Mix)-1]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	// With a target rate, a ticker hands out tokens; otherwise every worker
+	// issues requests back to back (closed loop).
+	var tokens <-chan time.Time
+	if load.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / load.Rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	client := newRPCClient(url, timeout)
+	samples := &rpcSamples{latencies: map[string][]float64{}, errors: map[string]int{}}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for {
+				if tokens != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-tokens:
+					}
+				} else if ctx.Err() != nil {
+					return
+				}
+
+				m := pick(rng)
+				params := m.Params
+				if params == nil {
+					params = defaultRPCParams[m.Method]
+				}
+
+				t0 := time.Now()
+				_, err := client.Call(ctx, m.Method, params)
+				if ctx.Err() != nil {
+					// Requests cut off by the end of the window are not
+					// failures of the node.
+					return
+				}
+				latency := time.Since(t0)
+				samples.record(m.Method, latency, err)
+				if err == nil {
+					rpcLatency.WithLabelValues(
+						run.Vars.Scenario, run.Vars.Impl, run.Vars.Variant, m.Method, run.Vars.Commit, getHostname(), run.Vars.Dataset, run.Vars.Project,
+					).Observe(float64(latency.Microseconds()))
+				}
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	data := summarizeRPCSamples(samples, elapsed)
+	run.attach(func(e *Evidence) { e.RPC = data })
+
+	return map[string]float64{
+		"rpc_requests_per_second": data.RequestsPerSec,
+		"rpc_error_rate":          data.ErrorRate,
+		"rpc_p95_us":              data.P95Us,
+	}, nil
+}
+
+func methodWeight(m RPCMethodSpec) float64 {
+	if m.Weight <= 0 {
+		return 1
+	}
+	return m.Weight
+}
+
+func summarizeRPCSamples(s *rpcSamples, elapsed time.Duration) *RPCLoadData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	methods := map[string]bool{}
+	for m := range s.latencies {
+		methods[m] = true
+	}
+	for m := range s.errors {
+		methods[m] = true
+	}
+
+	data := &RPCLoadData{DurationMs: float64(elapsed.Microseconds()) / 1000}
+	var all []float64
+	for method := range methods {
+		lat := append([]float64(nil), s.latencies[method]...)
+		sort.Float64s(lat)
+		all = append(all, lat...)
+
+		stats := RPCMethodStats{
+			Method:    method,
+			Requests:  len(lat) + s.errors[method],
+			Errors:    s.errors[method],
+			P50Us:     sortedPercentile(lat, 0.50),
+			P95Us:     sortedPercentile(lat, 0.95),
+			P99Us:     sortedPercentile(lat, 0.99),
+			Histogram: powerOfTwoHistogram(lat),
+		}
+		if stats.Requests > 0 {
+			stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+		}
+		data.Methods = append(data.Methods, stats)
+		data.Requests += stats.Requests
+		data.Errors += stats.Errors
+	}
+	sort.Slice(data.Methods, func(i, j int) bool { return data.Methods[i].Method < data.Methods[j].Method })
+
+	sort.Float64s(all)
+	data.P95Us = sortedPercentile(all, 0.95)
+	if data.Requests > 0 {
+		data.ErrorRate = float64(data.Errors) / float64(data.Requests)
+	}
+	if elapsed > 0 {
+		data.RequestsPerSec = float64(data.Requests) / elapsed.Seconds()
+	}
+	return data
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// StartupSpec configures a startup scenario, which measures node boot: the
+// adapter's command is started inside the session and timed until the
+// ready probes pass. The workload ends there, so the session's window, and
+// with it the exec, syscalls and other collectors, covers the boot alone;
+// the node is stopped only once the session has closed.
+type StartupSpec struct {
+	Ready ReadySpec `yaml:"ready" json:"ready"`
+	// StopTimeout is how long the node gets to exit after SIGINT before it
+	// is killed (default 30s).
+	StopTimeout string `yaml:"stop_timeout,omitempty" json:"stop_timeout,omitempty"`
+}
+
+// startupPollInterval is the default time between probe attempts; it bounds
+// how finely startup is timed, except for log probes, which are checked as
+// soon as a line matches.
+const startupPollInterval = 50 * time.Millisecond
+
+func init() {
+	scenarioTypes["startup"] = runStartup
+}
+
+func (s *StartupSpec) validate() error {
+	if err := s.Ready.validate(&ServerSpec{}); err != nil {
+		return fmt.Errorf("startup: %w", err)
+	}
+	if _, err := parseOptionalDuration(s.StopTimeout, defaultServerStop); err != nil {
+		return fmt.Errorf("startup stop_timeout: %w", err)
+	}
+	return nil
+}
+
+func runStartup(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	spec := run.Spec.Startup
+	if spec == nil {
+		return nil, fmt.Errorf("startup: scenario %s has no startup.ready", run.Spec.Name)
+	}
+	if len(run.Adapter.Command) == 0 {
+		return nil, fmt.Errorf("startup: adapter for %s has no command", run.Vars.Impl)
+	}
+	ready := spec.Ready
+	if timeout, ok := ctx.Deadline(); ok && ready.Timeout == "" {
+		ready.Timeout = time.Until(timeout).String()
+	}
+
+	if err := collector.Mark(run.SessionID, "startup"); err != nil {
+		log.Printf("Startup: marking phase: %v", err)
+	}
+	began := time.Now()
+	srv, err := startServer(&ServerSpec{Command: run.Adapter.Command, Env: run.Adapter.Env, StopTimeout: spec.StopTimeout}, ready.Log, run)
+	if err != nil {
+		return nil, fmt.Errorf("startup: %w", err)
+	}
+	run.afterSession = append(run.afterSession, srv.stop)
+
+	data, err := run.waitReady(&ready, srv, startupPollInterval)
+	startup := time.Since(began)
+	if err := collector.Mark(run.SessionID, ""); err != nil {
+		log.Printf("Startup: marking phase: %v", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("startup: %w", err)
+	}
+	data.WaitMs = float64(startup.Microseconds()) / 1000
+	run.logLine(fmt.Sprintf("--- ready after %.0f ms", data.WaitMs))
+	run.attach(func(e *Evidence) { e.Readiness = data })
+	return map[string]float64{"startup_seconds": startup.Seconds()}, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type SyncSpec struct {
+	RPCURL       string `yaml:"rpc_url,omitempty" json:"rpc_url,omitempty"`
+	PollInterval string `yaml:"poll_interval,omitempty" json:"poll_interval,omitempty"`
+	StallAfter   string `yaml:"stall_after,omitempty" json:"stall_after,omitempty"`
+	TargetBlock  uint64 `yaml:"target_block,omitempty" json:"target_block,omitempty"`
+}
+
+type SyncSample struct {
+	OffsetMs     float64 `json:"offset_ms"`
+	Block        uint64  `json:"block"`
+	Highest      uint64  `json:"highest"`
+	Headers      uint64  `json:"headers,omitempty"`
+	StateEntries uint64  `json:"state_entries,omitempty"`
+	IOWaitPct    float64 `json:"iowait_pct"`
+}
+
+// SyncStall is a stretch of polls during which no progress counter moved.
+type SyncStall struct {
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"duration_ms"`
+	Block      uint64    `json:"block"`
+	IOWaitPct  float64   `json:"iowait_pct"`
+}
+
+type SyncData struct {
+	Completed            bool         `json:"completed"`
+	DurationMs           float64      `json:"duration_ms"`
+	StartBlock           uint64       `json:"start_block"`
+	EndBlock             uint64       `json:"end_block"`
+	BlocksPerSec         float64      `json:"blocks_per_sec"`
+	HeadersPerSec        float64      `json:"headers_per_sec,omitempty"`
+	StateEntriesPerSec   float64      `json:"state_entries_per_sec,omitempty"`
+	StallMs              float64      `json:"stall_ms"`
+	IOWaitStalledPct     float64      `json:"iowait_stalled_pct"`
+	IOWaitProgressingPct float64      `json:"iowait_progressing_pct"`
+	Stalls               []SyncStall  `json:"stalls,omitempty"`
+	Samples              []SyncSample `json:"samples"`
+}
+
+// syncProgress is one eth_syncing reading. Clients disagree on the shape:
+// geth reports snap counters next to the block range, reth and erigon
+// report per-stage checkpoints.
+type syncProgress struct {
+	Syncing      bool
+	Block        uint64
+	Highest      uint64
+	Headers      uint64
+	StateEntries uint64
+}
+
+func init() {
+	scenarioTypes["sync"] = runSync
+}
+
+func parseSyncing(raw json.RawMessage) (syncProgress, error) {
+	var p syncProgress
+	if strings.TrimSpace(string(raw)) == "false" {
+		return p, nil
+	}
+
+	var status struct {
+		CurrentBlock    string `json:"currentBlock"`
+		HighestBlock    string `json:"highestBlock"`
+		SyncedAccounts  string `json:"syncedAccounts"`
+		SyncedStorage   string `json:"syncedStorage"`
+		SyncedBytecodes string `json:"syncedBytecodes"`
+		HealedTrienodes string `json:"healedTrienodes"`
+		Stages          []struct {
+			Name  string `json:"name"`
+			Block string `json:"block"`
+		} `json:"stages"`
+	}
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return p, fmt.Errorf("eth_syncing: %w", err)
+	}
+
+	p.Syncing = true
+	p.Block, _ = parseHexUint(status.CurrentBlock)
+	p.Highest, _ = parseHexUint(status.HighestBlock)
+	for _, counter := range []string{status.SyncedAccounts, status.SyncedStorage, status.SyncedBytecodes, status.HealedTrienodes} {
+		n, _ := parseHexUint(counter)
+		p.StateEntries += n
+	}
+	for _, stage := range status.Stages {
+		if strings.EqualFold(stage.Name, "headers") {
+			p.Headers, _ = parseHexUint(stage.Block)
+		}
+	}
+	return p, nil
+}
+
+// cpuTimes returns the aggregate iowait and total jiffies from /proc/stat.
+func cpuTimes() (iowait, total uint64, ok bool) {
+	values, ok := procStatCPU()
+	if !ok {
+		return 0, 0, false
+	}
+	for _, v := range values {
+		total += v
+	}
+	return values[4], total, true
+}
+
+func parseOptionalDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func runSync(ctx context.Context, run *scenarioRun) (map[string]float64, error) {
+	spec := run.Spec.Sync
+	if spec == nil {
+		spec = &SyncSpec{}
+	}
+
+	url := spec.RPCURL
+	if run.Adapter.RPCURL != "" {
+		url = run.Adapter.RPCURL
+	}
+	url, err := renderTemplate(url, run.Vars)
+	if err != nil || url == "" {
+		return nil, fmt.Errorf("sync: no rpc_url")
+	}
+	interval, err := parseOptionalDuration(spec.PollInterval, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("sync: poll_interval: %w", err)
+	}
+	stallAfter, err := parseOptionalDuration(spec.StallAfter, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("sync: stall_after: %w", err)
+	}
+
+	// The adapter command, if any, is the node itself: it runs for as long as
+	// the sync does and is killed once the target is reached.
+	nodeCtx, stopNode := context.WithCancel(ctx)
+	defer stopNode()
+	nodeDone := make(chan error, 1)
+	if len(run.Adapter.Command) > 0 {
+		go func() {
+			_, err := runAdapterCommand(nodeCtx, run, newExtractor(nil))
+			nodeDone <- err
+		}()
+	}
+
+	client := newRPCClient(url, interval)
+	data := &SyncData{}
+	start := time.Now()
+	lastIOWait, lastTotal, haveCPU := cpuTimes()
+
+	var (
+		seenSyncing  bool
+		first        SyncSample
+		lastProgress = start
+		last         SyncSample
+		stalled      *SyncStall
+		stallIOWait  []float64
+		progIOWait   []float64
+	)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var syncErr error
+poll:
+	for {
+		select {
+		case <-ctx.Done():
+			syncErr = fmt.Errorf("sync did not complete: %w", ctx.Err())
+			break poll
+		case err := <-nodeDone:
+			syncErr = fmt.Errorf("node exited before sync completed: %v", err)
+			break poll
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		raw, err := client.Call(ctx, "eth_syncing", nil)
+		if err != nil {
+			// The node may not be serving RPC yet.
+			continue
+		}
+		progress, err := parseSyncing(raw)
+		if err != nil {
+			syncErr = err
+			break poll
+		}
+		if !progress.Syncing {
+			if raw, err := client.Call(ctx, "eth_blockNumber", nil); err == nil {
+				var hex string
+				if json.Unmarshal(raw, &hex) == nil {
+					progress.Block, _ = parseHexUint(hex)
+					progress.Highest = progress.Block
+				}
+			}
+		}
+
+		sample := SyncSample{
+			OffsetMs:     float64(now.Sub(start).Microseconds()) / 1000,
+			Block:        progress.Block,
+			Highest:      progress.Highest,
+			Headers:      progress.Headers,
+			StateEntries: progress.StateEntries,
+		}
+		if iowait, total, ok := cpuTimes(); ok && haveCPU && total > lastTotal {
+			sample.IOWaitPct = float64(iowait-lastIOWait) / float64(total-lastTotal) * 100
+			lastIOWait, lastTotal = iowait, total
+		}
+		data.Samples = append(data.Samples, sample)
+		if len(data.Samples) == 1 {
+			first = sample
+		}
+
+		advanced := sample.Block > last.Block || sample.Headers > last.Headers || sample.StateEntries > last.StateEntries
+		last = sample
+		if advanced {
+			lastProgress = now
+			progIOWait = append(progIOWait, sample.IOWaitPct)
+			if stalled != nil {
+				stalled.DurationMs = float64(now.Sub(stalled.Start).Microseconds()) / 1000
+				stalled.IOWaitPct = mean(stallIOWait)
+				data.Stalls = append(data.Stalls, *stalled)
+				stalled = nil
+			}
+			stallIOWait = stallIOWait[:0]
+		} else {
+			stallIOWait = append(stallIOWait, sample.IOWaitPct)
+			if stalled == nil && seenSyncing && now.Sub(lastProgress) >= stallAfter {
+				// stallIOWait already holds every sample since lastProgress,
+				// where the stall began.
+				stalled = &SyncStall{Start: lastProgress, Block: sample.Block}
+				if annotator != nil {
+					annotator.Mark(lastProgress, fmt.Sprintf("sync stalled at block %d", sample.Block),
+						[]string{"chainbench", "sync-stall", "scenario:" + run.Vars.Scenario, "impl:" + run.Vars.Impl})
+				}
+			}
+		}
+
+		if progress.Syncing {
+			seenSyncing = true
+			continue
+		}
+		if (spec.TargetBlock > 0 && progress.Block >= spec.TargetBlock) || (spec.TargetBlock == 0 && seenSyncing) {
+			data.Completed = true
+			break poll
+		}
+	}
+	stopNode()
+
+	elapsed := time.Since(start)
+	if stalled != nil {
+		stalled.DurationMs = float64(time.Since(stalled.Start).Microseconds()) / 1000
+		stalled.IOWaitPct = mean(stallIOWait)
+		data.Stalls = append(data.Stalls, *stalled)
+	}
+	data.DurationMs = float64(elapsed.Microseconds()) / 1000
+	for _, stall := range data.Stalls {
+		data.StallMs += stall.DurationMs
+	}
+	data.IOWaitProgressingPct = mean(progIOWait)
+	if len(data.Stalls) > 0 {
+		sum := 0.0
+		for _, stall := range data.Stalls {
+			sum += stall.IOWaitPct
+		}
+		data.IOWaitStalledPct = sum / float64(len(data.Stalls))
+	}
+
+	if len(data.Samples) > 0 && elapsed > 0 {
+		secs := elapsed.Seconds()
+		data.StartBlock, data.EndBlock = first.Block, last.Block
+		data.BlocksPerSec = counterDelta(first.Block, last.Block) / secs
+		data.HeadersPerSec = counterDelta(first.Headers, last.Headers) / secs
+		data.StateEntriesPerSec = counterDelta(first.StateEntries, last.StateEntries) / secs
+	}
+	if !data.Completed && syncErr == nil {
+		syncErr = fmt.Errorf("sync did not complete")
+	}
+	if len(data.Stalls) > 0 {
+		log.Printf("Sync %s/%s: %d stalls, %.0f ms without progress", run.Vars.Scenario, run.Vars.Impl, len(data.Stalls), data.StallMs)
+	}
+
+	run.attach(func(e *Evidence) { e.Sync = data })
+
+	measurements := map[string]float64{
+		"sync_seconds":           elapsed.Seconds(),
+		"sync_blocks_per_second": data.BlocksPerSec,
+		"sync_stall_seconds":     data.StallMs / 1000,
+	}
+	// Not every client reports header or state progress.
+	if data.HeadersPerSec > 0 {
+		measurements["sync_headers_per_second"] = data.HeadersPerSec
+	}
+	if data.StateEntriesPerSec > 0 {
+		measurements["sync_state_entries_per_second"] = data.StateEntriesPerSec
+	}
+	return measurements, syncErr
+}
+
+// counterDelta tolerates counters that restart, as snap sync counters do when
+// the pivot block moves.
+func counterDelta(from, to uint64) float64 {
+	if to < from {
+		return 0
+	}
+	return float64(to - from)
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
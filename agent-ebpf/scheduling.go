@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SchedulingSpec declares the CPU scheduling the workload runs under, so
+// that a baseline and an optimized run compete the same way with the
+// host's background daemons. The runner starts the adapter's command and
+// server with it; threads inherit it from there. Unset fields keep the
+// agent's own.
+type SchedulingSpec struct {
+	// Policy is "other" (the default time-sharing policy), "batch" or
+	// "idle". Real-time policies are not offered: a runaway node under
+	// them can starve the host.
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+	Nice   *int   `yaml:"nice,omitempty" json:"nice,omitempty"`
+}
+
+// schedPolicies are the Linux scheduling policies by number, as in
+// sched_setattr(2) and the 41st field of /proc/<pid>/stat.
+var schedPolicies = map[int]string{0: "other", 1: "fifo", 2: "rr", 3: "batch", 5: "idle", 6: "deadline"}
+
+func (s *SchedulingSpec) validate() error {
+	switch s.Policy {
+	case "", "other", "batch", "idle":
+	default:
+		return fmt.Errorf("scheduling: policy %q is not other, batch or idle", s.Policy)
+	}
+	if s.Nice != nil && (*s.Nice < -20 || *s.Nice > 19) {
+		return fmt.Errorf("scheduling: nice %d is not between -20 and 19", *s.Nice)
+	}
+	if s.Policy == "" && s.Nice == nil {
+		return fmt.Errorf("scheduling: set policy or nice")
+	}
+	return nil
+}
+
+func (s *SchedulingSpec) String() string {
+	var parts []string
+	if s.Policy != "" {
+		parts = append(parts, s.Policy)
+	}
+	if s.Nice != nil {
+		parts = append(parts, fmt.Sprintf("nice %d", *s.Nice))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches reports whether a thread's policy and nice are what s declares.
+func (s *SchedulingSpec) matches(policy string, nice int) bool {
+	return (s.Policy == "" || s.Policy == policy) && (s.Nice == nil || *s.Nice == nice)
+}
+
+// ThreadScheduling counts the target's threads that ran with one policy
+// and nice value.
+type ThreadScheduling struct {
+	Policy  string `json:"policy"`
+	Nice    int    `json:"nice"`
+	Threads int    `json:"threads"`
+}
+
+// SchedulingMismatches counts the target's threads that did not run as the
+// scenario declared, such as those of a container the runner did not start.
+func (e *Evidence) SchedulingMismatches() int {
+	if e.Scheduling == nil || e.Threads == nil {
+		return 0
+	}
+	n := 0
+	for _, t := range e.Threads.Scheduling {
+		if !e.Scheduling.matches(t.Policy, t.Nice) {
+			n += t.Threads
+		}
+	}
+	return n
+}
+
+// threadSched is a thread's policy and nice value.
+type threadSched struct {
+	policy string
+	nice   int
+}
+
+// readThreadSched reads a thread's policy and nice value from its stat.
+func readThreadSched(statPath string) (threadSched, bool) {
+	data, err := os.ReadFile(statPath)
+	if err != nil {
+		return threadSched{}, false
+	}
+	// The command name may hold spaces; the fields after it start with
+	// the third, the state.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return threadSched{}, false
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 39 {
+		return threadSched{}, false
+	}
+	nice, err1 := strconv.Atoi(fields[16])
+	policy, err2 := strconv.Atoi(fields[38])
+	if err1 != nil || err2 != nil {
+		return threadSched{}, false
+	}
+	name, ok := schedPolicies[policy]
+	if !ok {
+		name = strconv.Itoa(policy)
+	}
+	return threadSched{policy: name, nice: nice}, true
+}
+
+// tallyScheduling counts threads by policy and nice, most threads first.
+func tallyScheduling(threads map[string]threadSched) []ThreadScheduling {
+	counts := map[threadSched]int{}
+	for _, t := range threads {
+		counts[t]++
+	}
+	tally := make([]ThreadScheduling, 0, len(counts))
+	for t, n := range counts {
+		tally = append(tally, ThreadScheduling{Policy: t.policy, Nice: t.nice, Threads: n})
+	}
+	sort.Slice(tally, func(i, j int) bool {
+		if tally[i].Threads != tally[j].Threads {
+			return tally[i].Threads > tally[j].Threads
+		}
+		if tally[i].Policy != tally[j].Policy {
+			return tally[i].Policy < tally[j].Policy
+		}
+		return tally[i].Nice < tally[j].Nice
+	})
+	return tally
+}
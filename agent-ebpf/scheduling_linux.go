@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+var schedPolicyNumbers = map[string]uint32{"other": unix.SCHED_NORMAL, "batch": unix.SCHED_BATCH, "idle": unix.SCHED_IDLE}
+
+// startScheduled starts cmd under the scheduling s declares, or as it is
+// without one. The policy and nice value are set on an OS thread of its
+// own, which the child is forked from and inherits them from; the thread
+// is discarded afterwards rather than handed back to the runtime.
+func startScheduled(cmd *exec.Cmd, s *SchedulingSpec) error {
+	if s == nil {
+		return cmd.Start()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// Never unlocked: the thread exits with the goroutine.
+		runtime.LockOSThread()
+		attr, err := unix.SchedGetAttr(0, 0)
+		if err != nil {
+			errc <- fmt.Errorf("scheduling: %w", err)
+			return
+		}
+		if s.Policy != "" {
+			attr.Policy = schedPolicyNumbers[s.Policy]
+		}
+		if s.Nice != nil {
+			attr.Nice = int32(*s.Nice)
+		}
+		attr.Priority = 0
+		if err := unix.SchedSetAttr(0, attr, 0); err != nil {
+			errc <- fmt.Errorf("scheduling %s: %w", s, err)
+			return
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// startScheduled starts cmd; scheduling policies are only set on Linux.
+func startScheduled(cmd *exec.Cmd, s *SchedulingSpec) error {
+	if s != nil {
+		return fmt.Errorf("scheduling: not supported on this platform")
+	}
+	return cmd.Start()
+}
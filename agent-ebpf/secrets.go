@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenarios reach RPC keys, dataset credentials and webhook tokens by name,
+// as {{ secret "rpc-key" }} in any of their templates, so the values stay
+// out of scenario files. --secrets names each secret and where it comes
+// from: an environment variable, a file, or a field of a Vault KV secret.
+// Every value handed out is remembered and masked in what the agent writes
+// afterwards: stored runs, job and build logs, job errors and its own log.
+
+// SecretSource is where one secret comes from.
+type SecretSource struct {
+	// Provider is env, file or vault.
+	Provider string `yaml:"provider"`
+	// Env is the environment variable of an env secret.
+	Env string `yaml:"env,omitempty"`
+	// Path is the file of a file secret, or the KV path of a vault one
+	// (e.g. secret/data/chainbench/rpc, for KV version 2).
+	Path string `yaml:"path,omitempty"`
+	// Key is the field of a vault secret.
+	Key string `yaml:"key,omitempty"`
+}
+
+// VaultConfig reaches Vault. Address and token default to $VAULT_ADDR and
+// $VAULT_TOKEN.
+type VaultConfig struct {
+	Address   string `yaml:"address,omitempty"`
+	TokenFile string `yaml:"token_file,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// SecretsConfig is the --secrets file.
+type SecretsConfig struct {
+	Vault   *VaultConfig            `yaml:"vault,omitempty"`
+	Secrets map[string]SecretSource `yaml:"secrets"`
+}
+
+// secretProvider looks a secret up from one kind of source.
+type secretProvider interface {
+	lookup(ctx context.Context, src SecretSource) (string, error)
+}
+
+type envSecrets struct{}
+
+func (envSecrets) lookup(_ context.Context, src SecretSource) (string, error) {
+	value, ok := os.LookupEnv(src.Env)
+	if !ok {
+		return "", fmt.Errorf("$%s is not set", src.Env)
+	}
+	return value, nil
+}
+
+type fileSecrets struct{}
+
+func (fileSecrets) lookup(_ context.Context, src SecretSource) (string, error) {
+	data, err := os.ReadFile(src.Path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// vaultSecrets reads KV secrets, of either engine version, over Vault's
+// HTTP API.
+type vaultSecrets struct {
+	address   string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+func newVaultSecrets(cfg *VaultConfig) (*vaultSecrets, error) {
+	v := &vaultSecrets{address: os.Getenv("VAULT_ADDR"), token: os.Getenv("VAULT_TOKEN"), client: &http.Client{Timeout: 10 * time.Second}}
+	if cfg != nil {
+		if cfg.Address != "" {
+			v.address = cfg.Address
+		}
+		if cfg.TokenFile != "" {
+			data, err := os.ReadFile(cfg.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("vault token: %w", err)
+			}
+			v.token = strings.TrimSpace(string(data))
+		}
+		v.namespace = cfg.Namespace
+	}
+	if v.address == "" {
+		return nil, fmt.Errorf("vault: no address (set vault.address or $VAULT_ADDR)")
+	}
+	if v.token == "" {
+		return nil, fmt.Errorf("vault: no token (set vault.token_file or $VAULT_TOKEN)")
+	}
+	v.address = strings.TrimSuffix(v.address, "/")
+	return v, nil
+}
+
+func (v *vaultSecrets) lookup(ctx context.Context, src SecretSource) (string, error) {
+	url := v.address + "/v1/" + strings.TrimPrefix(src.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s: %s", src.Path, resp.Status)
+	}
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault %s: %w", src.Path, err)
+	}
+	// KV version 2 nests the fields under data.data, next to metadata.
+	fields := body.Data
+	if inner, ok := fields["data"].(map[string]any); ok && fields["metadata"] != nil {
+		fields = inner
+	}
+	value, ok := fields[src.Key].(string)
+	if !ok {
+		return "", fmt.Errorf("vault %s: no string field %q", src.Path, src.Key)
+	}
+	return value, nil
+}
+
+var secretName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// minMaskedSecret is the shortest value masked; shorter ones would mangle
+// unrelated text.
+const minMaskedSecret = 4
+
+// secretStore resolves secrets by name and masks the values it handed out.
+type secretStore struct {
+	sources   map[string]SecretSource
+	providers map[string]secretProvider
+
+	mu sync.Mutex
+	// handed maps each value handed out to its secret's name; masks holds
+	// the values longest first, so a value containing another is masked
+	// whole.
+	handed map[string]string
+	masks  []string
+}
+
+// secrets is the --secrets configuration. Without one every lookup fails.
+var secrets = &secretStore{}
+
+func loadSecrets(path string) (*secretStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg SecretsConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s := &secretStore{
+		sources:   cfg.Secrets,
+		providers: map[string]secretProvider{"env": envSecrets{}, "file": fileSecrets{}},
+	}
+	for name, src := range cfg.Secrets {
+		if !secretName.MatchString(name) {
+			return nil, fmt.Errorf("%s: invalid secret name %q", path, name)
+		}
+		var missing string
+		switch src.Provider {
+		case "env":
+			if src.Env == "" {
+				missing = "env"
+			}
+		case "file":
+			if src.Path == "" {
+				missing = "path"
+			}
+		case "vault":
+			if src.Path == "" {
+				missing = "path"
+			} else if src.Key == "" {
+				missing = "key"
+			}
+			if s.providers["vault"] == nil {
+				v, err := newVaultSecrets(cfg.Vault)
+				if err != nil {
+					return nil, fmt.Errorf("%s: secret %s: %w", path, name, err)
+				}
+				s.providers["vault"] = v
+			}
+		default:
+			return nil, fmt.Errorf("%s: secret %s: unknown provider %q (want env, file or vault)", path, name, src.Provider)
+		}
+		if missing != "" {
+			return nil, fmt.Errorf("%s: secret %s: %s provider needs %s", path, name, src.Provider, missing)
+		}
+	}
+	return s, nil
+}
+
+// get looks a secret up and remembers its value for masking.
+func (s *secretStore) get(name string) (string, error) {
+	src, ok := s.sources[name]
+	if !ok {
+		return "", fmt.Errorf("unknown secret %q", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	value, err := s.providers[src.Provider].lookup(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", name, err)
+	}
+
+	if len(value) < minMaskedSecret {
+		log.Printf("Secret %s is shorter than %d characters and is not masked", name, minMaskedSecret)
+		return value, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, seen := s.handed[value]; seen {
+		return value, nil
+	}
+	if s.handed == nil {
+		s.handed = map[string]string{}
+	}
+	s.handed[value] = name
+	s.masks = append(s.masks, value)
+	sort.Slice(s.masks, func(i, j int) bool { return len(s.masks[i]) > len(s.masks[j]) })
+	return value, nil
+}
+
+// mask replaces every value handed out in text with <secret:name>.
+func (s *secretStore) mask(text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, value := range s.masks {
+		if strings.Contains(text, value) {
+			text = strings.ReplaceAll(text, value, "<secret:"+s.handed[value]+">")
+		}
+	}
+	return text
+}
+
+func (s *secretStore) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.masks) > 0
+}
+
+// maskRun returns run with every value handed out masked, or run itself if
+// none was. Like RedactionConfig.Run it works on the JSON form.
+func (s *secretStore) maskRun(run *Run) (*Run, error) {
+	if !s.active() {
+		return run, nil
+	}
+	data, err := json.Marshal(run)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	data, err = json.Marshal(s.maskTree(tree))
+	if err != nil {
+		return nil, err
+	}
+	var masked Run
+	if err := json.Unmarshal(data, &masked); err != nil {
+		return nil, err
+	}
+	return &masked, nil
+}
+
+func (s *secretStore) maskTree(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			v[k] = s.maskTree(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = s.maskTree(child)
+		}
+	case string:
+		return s.mask(v)
+	}
+	return v
+}
+
+// maskingWriter masks secrets in what is written through it, a line at a
+// time; Close writes out an unterminated last line.
+type maskingWriter struct {
+	s   *secretStore
+	w   io.Writer
+	buf []byte
+}
+
+func (s *secretStore) writer(w io.Writer) *maskingWriter {
+	return &maskingWriter{s: s, w: w}
+}
+
+func (m *maskingWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	for {
+		i := bytes.IndexByte(m.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := io.WriteString(m.w, m.s.mask(string(m.buf[:i+1]))); err != nil {
+			return 0, err
+		}
+		m.buf = m.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (m *maskingWriter) Close() error {
+	if len(m.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(m.w, m.s.mask(string(m.buf)))
+	m.buf = nil
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errSessionNotFound = errors.New("session not found or not running")
+
+type PhaseData struct {
+	Name          string  `json:"name"`
+	StartOffsetMs float64 `json:"start_offset_ms"`
+	DurationMs    float64 `json:"duration_ms"`
+}
+
+type phaseMark struct {
+	name  string
+	start time.Time
+}
+
+var phaseDuration = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_phase_duration_milliseconds",
+		Help: "Duration of each marked scenario phase in milliseconds",
+	},
+	[]string{"scenario", "impl", "variant", "phase", "commit", "machine", "dataset", "project"},
+)
+
+// Mark closes the current phase of the session, if any, and opens a new one
+// named phase. An empty name only closes the current phase.
+func (c *EvidenceCollector) Mark(sessionID, phase string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running || sessionID != c.sessionID {
+		return errSessionNotFound
+	}
+
+	now := time.Now()
+	c.closePhase(now)
+	if phase != "" {
+		c.openPhase = &phaseMark{name: phase, start: now}
+		if annotator != nil {
+			annotator.Mark(now, "phase "+phase, []string{"chainbench", "phase:" + phase, "scenario:" + c.scenario, "impl:" + c.impl})
+		}
+	}
+
+	c.publish()
+	log.Printf("Session %s: phase %q", sessionID, phase)
+	return nil
+}
+
+func (c *EvidenceCollector) closePhase(now time.Time) {
+	if c.openPhase == nil {
+		return
+	}
+
+	p := PhaseData{
+		Name:          c.openPhase.name,
+		StartOffsetMs: float64(c.openPhase.start.Sub(c.startedAt).Microseconds()) / 1000,
+		DurationMs:    float64(now.Sub(c.openPhase.start).Microseconds()) / 1000,
+	}
+	c.phases = append(c.phases, p)
+	c.openPhase = nil
+
+	phaseDuration.WithLabelValues(
+		c.scenario, c.impl, c.variant, p.Name, c.commit, c.machine, c.dataset, c.project,
+	).Set(p.DurationMs)
+}
+
+// AttachEvidence queues a section to be merged into the session's evidence
+// when it stops.
+func (c *EvidenceCollector) AttachEvidence(sessionID string, section func(*Evidence)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running || sessionID != c.sessionID {
+		return errSessionNotFound
+	}
+	c.sections = append(c.sections, section)
+	return nil
+}
+
+// Retarget points the session's per-process collectors at a target that was
+// only known once the workload was placed; what they saw so far is dropped.
+func (c *EvidenceCollector) Retarget(sessionID string, target *Target) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running || sessionID != c.sessionID {
+		return errSessionNotFound
+	}
+	if c.scope != nil {
+		c.scope.Stop(&Evidence{})
+	}
+	c.target = target
+	c.scope = startTargetScope(target, c.selection)
+	c.retargetTraces()
+	if c.fallback != nil {
+		c.fallback.retarget(c.scope.tracker)
+	}
+	return nil
+}
+
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	// Sessions of other projects are not found, as if they did not exist.
+	if !inScope(requestScope(r), collector.Status().Project) {
+		http.Error(w, errSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch action {
+	case "mark":
+		var req struct {
+			Phase string `json:"phase"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = collector.Mark(id, req.Phase)
+	case "measure":
+		var req struct {
+			Measurements map[string]float64 `json:"measurements"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = collector.Measure(id, req.Measurements)
+	case "progress":
+		var req struct {
+			Done    float64 `json:"done"`
+			Total   float64 `json:"total"`
+			Percent float64 `json:"percent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = collector.Progress(id, req.Done, req.Total, req.Percent)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if errors.Is(err, errSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
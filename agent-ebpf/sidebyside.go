@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SideBySideSpec runs several impls of a scenario at once, each confined to
+// its own partition of the host, so they share the machine's conditions
+// instead of drifting apart between sequential runs.
+type SideBySideSpec struct {
+	Impls      []string        `yaml:"impls" json:"impls"`
+	Partitions []PartitionSpec `yaml:"partitions" json:"partitions"`
+}
+
+// PartitionSpec is a cgroup v2 slice of the host: CPUs and NUMA nodes
+// (cpuset), a memory cap and I/O weight or limits.
+type PartitionSpec struct {
+	CPUs      string `yaml:"cpus" json:"cpus"`
+	Mems      string `yaml:"mems,omitempty" json:"mems,omitempty"`
+	MemoryMax string `yaml:"memory_max,omitempty" json:"memory_max,omitempty"`
+	IOWeight  int    `yaml:"io_weight,omitempty" json:"io_weight,omitempty"`
+	IOMax     string `yaml:"io_max,omitempty" json:"io_max,omitempty"`
+}
+
+// PairedRun links a side-by-side run to the others recorded with it.
+type PairedRun struct {
+	Impl      string        `json:"impl"`
+	RunID     string        `json:"run_id"`
+	Partition PartitionSpec `json:"partition"`
+	Cgroup    string        `json:"cgroup"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type SideBySideData struct {
+	// Combined is the host-wide run; its kernel sections cover all sides.
+	Combined string      `json:"combined_run_id"`
+	Runs     []PairedRun `json:"runs"`
+}
+
+// parseCPUList reads the kernel's cpulist format, e.g. "0-3,8,10-11".
+func parseCPUList(list string) (map[int]bool, error) {
+	cpus := map[int]bool{}
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("cpu list %q: %w", list, err)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("cpu list %q: bad range %q", list, part)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus[cpu] = true
+		}
+	}
+	return cpus, nil
+}
+
+func (s *SideBySideSpec) validate(adapters map[string]AdapterSpec) error {
+	if len(s.Impls) < 2 {
+		return fmt.Errorf("side_by_side: needs at least two impls")
+	}
+	if len(s.Partitions) != len(s.Impls) {
+		return fmt.Errorf("side_by_side: %d impls but %d partitions", len(s.Impls), len(s.Partitions))
+	}
+	owner := map[int]string{}
+	for i, impl := range s.Impls {
+		if _, ok := adapters[impl]; !ok {
+			return fmt.Errorf("side_by_side: no adapter for impl %q", impl)
+		}
+		if s.Partitions[i].CPUs == "" {
+			return fmt.Errorf("side_by_side: partition for %s has no cpus", impl)
+		}
+		cpus, err := parseCPUList(s.Partitions[i].CPUs)
+		if err != nil {
+			return fmt.Errorf("side_by_side: %w", err)
+		}
+		for cpu := range cpus {
+			if other, taken := owner[cpu]; taken {
+				return fmt.Errorf("side_by_side: cpu %d is in the partitions of both %s and %s", cpu, other, impl)
+			}
+			owner[cpu] = impl
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+		return fmt.Errorf("%s: controller not available on this host", name)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// partitionCgroups creates chainbench/<job>/<impl> under the unified
+// hierarchy with each partition's limits applied. The returned cleanup
+// kills anything left inside and removes the cgroups.
+func partitionCgroups(jobID string, spec *SideBySideSpec) ([]string, func(), error) {
+	parent := filepath.Join("chainbench", jobID)
+	if err := os.MkdirAll(filepath.Join(cgroupRoot, parent), 0o755); err != nil {
+		return nil, nil, err
+	}
+	// Controllers have to be delegated down every level. Ones the host
+	// lacks are left out; the limit that needs one then fails below.
+	for _, dir := range []string{"", "chainbench", parent} {
+		for _, controller := range []string{"cpuset", "cpu", "memory", "io"} {
+			writeCgroupFile(filepath.Join(cgroupRoot, dir), "cgroup.subtree_control", "+"+controller)
+		}
+	}
+
+	var paths []string
+	cleanup := func() {
+		for _, path := range paths {
+			dir := filepath.Join(cgroupRoot, path)
+			writeCgroupFile(dir, "cgroup.kill", "1")
+			for attempt := 0; attempt < 50; attempt++ {
+				if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		os.Remove(filepath.Join(cgroupRoot, parent))
+	}
+
+	for i, impl := range spec.Impls {
+		p := spec.Partitions[i]
+		path := filepath.Join(parent, impl)
+		dir := filepath.Join(cgroupRoot, path)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		paths = append(paths, path)
+
+		settings := [][2]string{{"cpuset.cpus", p.CPUs}, {"cpuset.mems", p.Mems}, {"memory.max", p.MemoryMax}, {"io.max", p.IOMax}}
+		if p.IOWeight > 0 {
+			settings = append(settings, [2]string{"io.weight", "default " + strconv.Itoa(p.IOWeight)})
+		}
+		for _, s := range settings {
+			if s[1] == "" {
+				continue
+			}
+			if err := writeCgroupFile(dir, s[0], s[1]); err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("partition %s: %w", impl, err)
+			}
+		}
+	}
+	return paths, cleanup, nil
+}
+
+type sideRun struct {
+	run          *scenarioRun
+	runID        string
+	cgroup       string
+	scope        *targetScope
+	prepared     *preparedAdapter
+	measurements map[string]float64
+	workloadMs   float64
+	err          error
+}
+
+// executeSideBySide runs every impl of the spec concurrently, each launched
+// into its partition's cgroup and followed by its own scoped collectors.
+// Each impl gets a run of its own, linked to the others; the collector's
+// session becomes the combined run holding the host-wide kernel view.
+func (m *JobManager) executeSideBySide(job *Job, spec *ScenarioSpec, vars scenarioVars, attempt *AttemptData) (string, error) {
+	cgroups, cleanup, err := partitionCgroups(job.ID, spec.SideBySide)
+	if err != nil {
+		return "", fmt.Errorf("side_by_side: %w", err)
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	if timeout := spec.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	sides := make([]*sideRun, len(spec.SideBySide.Impls))
+	// Until the sides' scopes are stopped with their evidence, any return
+	// stops every scope started so far.
+	scopesStopped := false
+	defer func() {
+		if scopesStopped {
+			return
+		}
+		for _, side := range sides {
+			if side != nil && side.scope != nil {
+				side.scope.Stop(&Evidence{})
+			}
+		}
+	}()
+	for i, impl := range spec.SideBySide.Impls {
+		adapter := spec.Adapters[impl]
+		sideVars := vars
+		sideVars.Impl = impl
+		sideVars.WorkDir = filepath.Join(vars.WorkDir, impl)
+		if err := os.MkdirAll(sideVars.WorkDir, 0o755); err != nil {
+			return "", err
+		}
+		if adapter.Build != nil || len(adapter.Images) > 0 {
+			m.update(job, func(j *Job) { j.State = jobBuilding })
+		}
+		prepared, err := m.prepare(adapter, &sideVars)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", impl, err)
+		}
+		defer m.release(prepared)
+
+		prepare, reset := jobSteps(spec, adapter)
+		defer resetSteps(job.ID, reset, sideVars, job.log, impl)
+		if err := runSteps("prepare", prepare, sideVars, job.log, impl); err != nil {
+			return "", fmt.Errorf("%s: %w", impl, err)
+		}
+
+		target, err := renderTarget(adapter.Target, sideVars)
+		if err != nil {
+			return "", fmt.Errorf("adapter %s target: %w", impl, err)
+		}
+		if target == nil {
+			target = &Target{}
+		}
+		target.Cgroup = "/" + cgroups[i]
+
+		cgroupDir, err := os.Open(filepath.Join(cgroupRoot, cgroups[i]))
+		if err != nil {
+			return "", err
+		}
+		defer cgroupDir.Close()
+
+		sides[i] = &sideRun{
+			run:    &scenarioRun{Spec: spec, Adapter: adapter, Vars: sideVars, Tags: job.Tags, cgroup: cgroupDir, log: job.log, logPrefix: sideVars.Impl},
+			runID:  newRunID(),
+			cgroup: target.Cgroup,
+		}
+		defer sides[i].run.release()
+		sides[i].prepared = prepared
+		prepared.attach(sides[i].run)
+		if attempt != nil {
+			sides[i].run.attach(func(e *Evidence) { e.Attempt = attempt })
+		}
+		stopServer, err := sides[i].run.serve()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", impl, err)
+		}
+		defer stopServer()
+		if _, err := sides[i].run.runHooks(ctx, hookPreRun, 0); err != nil {
+			return "", fmt.Errorf("%s: %w", impl, err)
+		}
+		sides[i].scope = startTargetScope(target, spec.Collectors)
+	}
+
+	sessionID, err := collector.Start(StartRequest{
+		Scenario:   job.Scenario,
+		Impl:       job.Impl,
+		Variant:    job.Variant,
+		Commit:     job.Commit,
+		Dataset:    job.Dataset,
+		Project:    job.Project,
+		Params:     job.Params,
+		Tags:       job.Tags,
+		Collectors: spec.Collectors,
+		DataDir:    vars.WorkDir,
+	})
+	if err != nil {
+		return "", err
+	}
+	m.update(job, func(j *Job) {
+		j.State = jobRunning
+		now := time.Now().UTC()
+		j.StartedAt = &now
+		j.SessionID = sessionID
+	})
+
+	var wg sync.WaitGroup
+	for _, side := range sides {
+		side.run.SessionID = sessionID
+		wg.Add(1)
+		go func(side *sideRun) {
+			defer wg.Done()
+			side.measurements, side.workloadMs, side.err = runWorkload(ctx, side.run)
+		}(side)
+	}
+	wg.Wait()
+
+	pairing := &SideBySideData{Combined: sessionID}
+	for i, side := range sides {
+		paired := PairedRun{
+			Impl:      side.run.Vars.Impl,
+			RunID:     side.runID,
+			Partition: spec.SideBySide.Partitions[i],
+			Cgroup:    side.cgroup,
+		}
+		if side.err != nil {
+			paired.Error = side.err.Error()
+		}
+		pairing.Runs = append(pairing.Runs, paired)
+	}
+	collector.AttachEvidence(sessionID, func(e *Evidence) { e.SideBySide = pairing })
+	combined, err := collector.Stop("")
+	if err != nil {
+		return "", err
+	}
+
+	scopesStopped = true
+	var failed []string
+	var class string
+	for _, side := range sides {
+		evidence := &Evidence{
+			RunID:        side.runID,
+			Available:    combined.Available,
+			Measurements: side.measurements,
+			Noise:        combined.Noise,
+			Thermal:      combined.Thermal,
+			Clock:        combined.Clock,
+			SideBySide:   pairing,
+			StartedAt:    combined.StartedAt,
+			StoppedAt:    combined.StoppedAt,
+			DurationMs:   combined.DurationMs,
+			WorkloadMs:   side.workloadMs,
+		}
+		side.scope.Stop(evidence)
+		// With its scope stopped, the side's post_run hooks are out of the
+		// window too.
+		if _, err := side.run.runHooks(ctx, hookPostRun, 0); err != nil && side.err == nil {
+			side.err = err
+		}
+		for _, section := range side.run.sections {
+			section(evidence)
+		}
+		if side.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", side.run.Vars.Impl, side.err))
+			evidence.Failure = classifyFailure(ctx, side.err)
+			evidence.Failure.checkOOM(evidence, 0)
+			if class == "" {
+				class = evidence.Failure.Class
+			}
+		}
+		for name, value := range side.measurements {
+			if measurementName.MatchString(name) {
+				customGauge(name).WithLabelValues(
+					job.Scenario, side.run.Vars.Impl, job.Variant, job.Commit, collector.machine, job.Dataset, job.Project,
+				).Set(value)
+			}
+		}
+		if store != nil {
+			run := &Run{
+				ID:          side.runID,
+				Scenario:    job.Scenario,
+				Impl:        side.run.Vars.Impl,
+				Variant:     job.Variant,
+				Commit:      job.Commit,
+				Machine:     collector.machine,
+				Dataset:     job.Dataset,
+				Project:     job.Project,
+				Tags:        job.Tags,
+				CreatedAt:   time.Now().UTC(),
+				DurationMs:  evidence.DurationMs,
+				StartedAt:   evidence.StartedAt,
+				StoppedAt:   evidence.StoppedAt,
+				Environment: captureEnvironment(side.run.Vars.WorkDir),
+				Evidence:    evidence,
+			}
+			evidence.Anomalies = detectAnomalies(run)
+			if err := store.Save(run); err != nil {
+				log.Printf("Job %s: storing side-by-side run %s: %v", job.ID, run.ID, err)
+			} else {
+				side.prepared.saveBuildLog(run.ID, side.run.Vars.BuildDir)
+				job.log.save(run.ID)
+				exportMachineClasses(run.Machine)
+				checkRegression(run)
+			}
+		}
+	}
+
+	m.update(job, func(j *Job) {
+		for _, side := range sides {
+			j.RunIDs = append(j.RunIDs, side.runID)
+		}
+	})
+	if len(failed) > 0 {
+		return combined.RunID, &classifiedError{class: class, err: fmt.Errorf("side_by_side: %s", strings.Join(failed, "; "))}
+	}
+	return combined.RunID, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SocketData is evidence of packets the kernel dropped before the target
+// read them, which application metrics never see: a P2P node whose accept
+// queue overflows or whose UDP discovery socket runs out of buffer just
+// looks slow. The counters are deltas over the session for the target's
+// network namespace; Ports breaks down the target's own listening TCP and
+// bound UDP ports.
+type SocketData struct {
+	// ListenOverflows and ListenDrops are connections refused because an
+	// accept queue was full, or dropped for any reason while handshaking.
+	ListenOverflows uint64 `json:"listen_overflows"`
+	ListenDrops     uint64 `json:"listen_drops"`
+	// TCPBacklogDrops, TCPRcvQDrops and TCPPruned are segments dropped for
+	// want of socket receive buffer; TCPOFODrops are out-of-order segments
+	// dropped for the same reason.
+	TCPBacklogDrops uint64 `json:"tcp_backlog_drops"`
+	TCPRcvQDrops    uint64 `json:"tcp_rcvq_drops"`
+	TCPPruned       uint64 `json:"tcp_pruned"`
+	TCPOFODrops     uint64 `json:"tcp_ofo_drops"`
+	// UDP counts IPv4 and IPv6 together.
+	UDPRcvbufErrors uint64       `json:"udp_rcvbuf_errors"`
+	UDPSndbufErrors uint64       `json:"udp_sndbuf_errors"`
+	UDPInErrors     uint64       `json:"udp_in_errors"`
+	Ports           []SocketPort `json:"ports"`
+}
+
+// SocketPort is one of the target's ports over the session: the most
+// sockets it had, the longest accept queue of a listening TCP port, the
+// fullest receive and send queues of its sockets (for TCP, the connections
+// it accepted), and for UDP the datagrams its sockets dropped.
+type SocketPort struct {
+	Proto         string `json:"proto"`
+	Port          int    `json:"port"`
+	Sockets       int    `json:"sockets"`
+	PeakAccept    int    `json:"peak_accept_queue,omitempty"`
+	PeakRecvBytes uint64 `json:"peak_recv_queue_bytes"`
+	PeakSendBytes uint64 `json:"peak_send_queue_bytes"`
+	Drops         uint64 `json:"drops,omitempty"`
+}
+
+// Dropped reports whether the kernel dropped anything of the target's.
+func (s *SocketData) Dropped() bool {
+	total := s.ListenOverflows + s.ListenDrops + s.TCPBacklogDrops + s.TCPRcvQDrops + s.TCPPruned +
+		s.TCPOFODrops + s.UDPRcvbufErrors + s.UDPSndbufErrors + s.UDPInErrors
+	for _, p := range s.Ports {
+		total += p.Drops
+	}
+	return total > 0
+}
+
+const socketsInterval = time.Second
+
+// socketCounters maps the counters SocketData takes deltas of, as
+// "<group>.<name>" from /proc/net/netstat and /proc/net/snmp or as named in
+// /proc/net/snmp6.
+var socketCounters = map[string]func(*SocketData) *uint64{
+	"TcpExt.ListenOverflows": func(s *SocketData) *uint64 { return &s.ListenOverflows },
+	"TcpExt.ListenDrops":     func(s *SocketData) *uint64 { return &s.ListenDrops },
+	"TcpExt.TCPBacklogDrop":  func(s *SocketData) *uint64 { return &s.TCPBacklogDrops },
+	"TcpExt.TCPRcvQDrop":     func(s *SocketData) *uint64 { return &s.TCPRcvQDrops },
+	"TcpExt.RcvPruned":       func(s *SocketData) *uint64 { return &s.TCPPruned },
+	"TcpExt.TCPOFODrop":      func(s *SocketData) *uint64 { return &s.TCPOFODrops },
+	"Udp.RcvbufErrors":       func(s *SocketData) *uint64 { return &s.UDPRcvbufErrors },
+	"Udp.SndbufErrors":       func(s *SocketData) *uint64 { return &s.UDPSndbufErrors },
+	"Udp.InErrors":           func(s *SocketData) *uint64 { return &s.UDPInErrors },
+	"Udp6RcvbufErrors":       func(s *SocketData) *uint64 { return &s.UDPRcvbufErrors },
+	"Udp6SndbufErrors":       func(s *SocketData) *uint64 { return &s.UDPSndbufErrors },
+	"Udp6InErrors":           func(s *SocketData) *uint64 { return &s.UDPInErrors },
+}
+
+// readNetCounters reads the counters of the network namespace netDir
+// (/proc/<pid>/net) belongs to.
+func readNetCounters(netDir string) cgroupCounters {
+	counters := cgroupCounters{}
+	for _, name := range []string{"netstat", "snmp"} {
+		data, err := os.ReadFile(filepath.Join(netDir, name))
+		if err != nil {
+			continue
+		}
+		// Each group is a line of names followed by a line of values.
+		lines := strings.Split(string(data), "\n")
+		for i := 0; i+1 < len(lines); i += 2 {
+			names, values := strings.Fields(lines[i]), strings.Fields(lines[i+1])
+			if len(names) != len(values) || len(names) == 0 || names[0] != values[0] {
+				continue
+			}
+			group := strings.TrimSuffix(names[0], ":")
+			for j := 1; j < len(names); j++ {
+				if v, err := strconv.ParseUint(values[j], 10, 64); err == nil {
+					counters[group+"."+names[j]] = v
+				}
+			}
+		}
+	}
+	readKeyValues(filepath.Join(netDir, "snmp6"), counters, "")
+	return counters
+}
+
+// procSocket is one row of /proc/net/{tcp,udp}[6].
+type procSocket struct {
+	port      int
+	state     string
+	sendQueue uint64
+	recvQueue uint64
+	inode     string
+	drops     uint64
+}
+
+const tcpListen = "0A"
+
+func readProcSockets(path string) []procSocket {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var sockets []procSocket
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		_, hexPort, _ := strings.Cut(fields[1], ":")
+		port, err := strconv.ParseInt(hexPort, 16, 32)
+		if err != nil {
+			continue
+		}
+		tx, rx, _ := strings.Cut(fields[4], ":")
+		s := procSocket{port: int(port), state: fields[3], inode: fields[9]}
+		s.sendQueue, _ = strconv.ParseUint(tx, 16, 64)
+		s.recvQueue, _ = strconv.ParseUint(rx, 16, 64)
+		if len(fields) > 12 {
+			s.drops, _ = strconv.ParseUint(fields[12], 10, 64)
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets
+}
+
+// socketInodes returns the inodes of the sockets pids hold open.
+func socketInodes(pids []int) map[string]bool {
+	inodes := map[string]bool{}
+	for _, pid := range pids {
+		fdDir := filepath.Join("/proc", strconv.Itoa(pid), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && strings.HasPrefix(link, "socket:[") {
+				inodes[strings.Trim(link[7:], "[]")] = true
+			}
+		}
+	}
+	return inodes
+}
+
+// socketSampler samples the target's sockets every interval, from the
+// /proc/<pid>/net tables of its network namespace.
+type socketSampler struct {
+	tracker  *targetTracker
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu          sync.Mutex
+	first, last cgroupCounters
+	ports       map[string]*SocketPort
+	udpDrops    map[string]uint64
+}
+
+func startSocketSampler(tracker *targetTracker, interval time.Duration) *socketSampler {
+	s := &socketSampler{
+		tracker:  tracker,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		ports:    map[string]*SocketPort{},
+		udpDrops: map[string]uint64{},
+	}
+	s.sample(true)
+	go s.loop()
+	return s
+}
+
+func (s *socketSampler) loop() {
+	defer close(s.done)
+	ticker := newPacedTicker(s.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sample(false)
+		}
+	}
+}
+
+func (s *socketSampler) port(proto string, port int) *SocketPort {
+	key := proto + "/" + strconv.Itoa(port)
+	p := s.ports[key]
+	if p == nil {
+		p = &SocketPort{Proto: proto, Port: port}
+		s.ports[key] = p
+	}
+	return p
+}
+
+func (s *socketSampler) sample(baseline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pids := s.tracker.PIDs()
+	if len(pids) == 0 {
+		return
+	}
+	netDir := filepath.Join("/proc", strconv.Itoa(pids[0]), "net")
+	if counters := readNetCounters(netDir); len(counters) > 0 {
+		if s.first == nil {
+			s.first = counters
+		}
+		s.last = counters
+	}
+	inodes := socketInodes(pids)
+
+	var tcp []procSocket
+	for _, name := range []string{"tcp", "tcp6"} {
+		tcp = append(tcp, readProcSockets(filepath.Join(netDir, name))...)
+	}
+	listening := map[int]bool{}
+	for _, sock := range tcp {
+		if sock.state == tcpListen && inodes[sock.inode] {
+			listening[sock.port] = true
+		}
+	}
+	sockets := map[*SocketPort]int{}
+	for _, sock := range tcp {
+		if !inodes[sock.inode] || !listening[sock.port] {
+			continue
+		}
+		p := s.port("tcp", sock.port)
+		if sock.state == tcpListen {
+			// A listening socket's receive queue is its accept queue.
+			p.PeakAccept = max(p.PeakAccept, int(sock.recvQueue))
+			continue
+		}
+		sockets[p]++
+		p.PeakRecvBytes = max(p.PeakRecvBytes, sock.recvQueue)
+		p.PeakSendBytes = max(p.PeakSendBytes, sock.sendQueue)
+	}
+
+	for _, name := range []string{"udp", "udp6"} {
+		for _, sock := range readProcSockets(filepath.Join(netDir, name)) {
+			if !inodes[sock.inode] {
+				continue
+			}
+			p := s.port("udp", sock.port)
+			sockets[p]++
+			p.PeakRecvBytes = max(p.PeakRecvBytes, sock.recvQueue)
+			p.PeakSendBytes = max(p.PeakSendBytes, sock.sendQueue)
+			// A socket opened during the window counts its drops from zero.
+			prev := s.udpDrops[sock.inode]
+			s.udpDrops[sock.inode] = sock.drops
+			if !baseline && sock.drops >= prev {
+				p.Drops += sock.drops - prev
+			}
+		}
+	}
+	for p, n := range sockets {
+		p.Sockets = max(p.Sockets, n)
+	}
+}
+
+func (s *socketSampler) Stop() *SocketData {
+	close(s.stop)
+	<-s.done
+	s.sample(false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.first == nil && len(s.ports) == 0 {
+		return nil
+	}
+	data := &SocketData{Ports: []SocketPort{}}
+	for name, field := range socketCounters {
+		if v, ok := s.last[name]; ok && v >= s.first[name] {
+			*field(data) += v - s.first[name]
+		}
+	}
+	for _, p := range s.ports {
+		data.Ports = append(data.Ports, *p)
+	}
+	sort.Slice(data.Ports, func(i, j int) bool {
+		if data.Ports[i].Proto != data.Ports[j].Proto {
+			return data.Ports[i].Proto < data.Ports[j].Proto
+		}
+		return data.Ports[i].Port < data.Ports[j].Port
+	})
+	return data
+}
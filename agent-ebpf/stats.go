@@ -0,0 +1,231 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// mannWhitneyGreater is the one-sided Mann-Whitney U test that values in b
+// tend to be larger than those in a. It returns the p-value from the normal
+// approximation with tie correction, which is adequate from about five
+// samples a side; it makes no assumption about how run times are
+// distributed.
+func mannWhitneyGreater(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+
+	type sample struct {
+		v    float64
+		inB  bool
+		rank float64
+	}
+	all := make([]sample, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, sample{v: v})
+	}
+	for _, v := range b {
+		all = append(all, sample{v: v, inB: true})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Tied values share their mean rank; ties shrink the variance.
+	var tieTerm float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			all[k].rank = rank
+		}
+		t := float64(j - i)
+		tieTerm += t*t*t - t
+		i = j
+	}
+
+	var rankSumB float64
+	for _, s := range all {
+		if s.inB {
+			rankSumB += s.rank
+		}
+	}
+	u := rankSumB - n2*(n2+1)/2
+	n := n1 + n2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * (n + 1 - tieTerm/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	// Continuity correction toward the mean.
+	z := (u - mean - 0.5) / math.Sqrt(variance)
+	return 0.5 * math.Erfc(z/math.Sqrt2)
+}
+
+// coefficientOfVariation is the sample standard deviation of values as a
+// percentage of their mean; it is zero for fewer than two values or a zero
+// mean.
+func coefficientOfVariation(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	if m == 0 {
+		return 0
+	}
+	return math.Sqrt(variance(values)) / math.Abs(m) * 100
+}
+
+// cliffsDelta is how much more often a value of a exceeds one of b than
+// the other way round, from -1 to 1. It makes no assumption about how the
+// values are distributed.
+func cliffsDelta(a, b []float64) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	var more, less int
+	for _, x := range a {
+		for _, y := range b {
+			switch {
+			case x > y:
+				more++
+			case x < y:
+				less++
+			}
+		}
+	}
+	return float64(more-less) / float64(len(a)*len(b))
+}
+
+// cliffsMagnitude names the size of a Cliff's delta by the usual
+// thresholds.
+func cliffsMagnitude(delta float64) string {
+	switch d := math.Abs(delta); {
+	case d < 0.147:
+		return "negligible"
+	case d < 0.33:
+		return "small"
+	case d < 0.474:
+		return "medium"
+	}
+	return "large"
+}
+
+// variance is the sample variance of values.
+func variance(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	var sq float64
+	for _, v := range values {
+		sq += (v - m) * (v - m)
+	}
+	return sq / float64(len(values)-1)
+}
+
+// hedgesG is the difference of the means of a and b in pooled standard
+// deviations, corrected for the bias of small samples. It is zero when
+// there are too few values or no spread.
+func hedgesG(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 < 2 || n2 < 2 {
+		return 0
+	}
+	pooled := math.Sqrt(((n1-1)*variance(a) + (n2-1)*variance(b)) / (n1 + n2 - 2))
+	if pooled == 0 {
+		return 0
+	}
+	return (mean(a) - mean(b)) / pooled * (1 - 3/(4*(n1+n2)-9))
+}
+
+// normalQuantile is the standard normal distribution's p quantile.
+func normalQuantile(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
+
+// minDetectablePct is the smallest difference of the means of a and b, in
+// percent of a's, that a two-sided test at alpha would find with the given
+// power, given their spread and count.
+func minDetectablePct(a, b []float64, alpha, power float64) float64 {
+	if len(a) < 2 || len(b) < 2 || mean(a) == 0 {
+		return 0
+	}
+	se := math.Sqrt(variance(a)/float64(len(a)) + variance(b)/float64(len(b)))
+	return (normalQuantile(1-alpha/2) + normalQuantile(power)) * se / math.Abs(mean(a)) * 100
+}
+
+// ranks are the values' ranks from 1, tied values sharing their mean rank.
+func ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return values[order[i]] < values[order[j]] })
+	r := make([]float64, len(values))
+	for i := 0; i < len(order); {
+		j := i
+		for j < len(order) && values[order[j]] == values[order[i]] {
+			j++
+		}
+		for k := i; k < j; k++ {
+			r[order[k]] = float64(i+j+1) / 2
+		}
+		i = j
+	}
+	return r
+}
+
+// pearson is the linear correlation of x and y, zero when either does not
+// vary.
+func pearson(x, y []float64) float64 {
+	if len(x) < 2 || len(x) != len(y) {
+		return 0
+	}
+	mx, my := mean(x), mean(y)
+	var sxy, sxx, syy float64
+	for i := range x {
+		sxy += (x[i] - mx) * (y[i] - my)
+		sxx += (x[i] - mx) * (x[i] - mx)
+		syy += (y[i] - my) * (y[i] - my)
+	}
+	if sxx == 0 || syy == 0 {
+		return 0
+	}
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+// spearman is the rank correlation of x and y: whether one rises with the
+// other, in a straight line or not, untroubled by outliers.
+func spearman(x, y []float64) float64 {
+	return pearson(ranks(x), ranks(y))
+}
+
+// spearmanP is the two-sided p-value of a rank correlation rho over n
+// pairs, from the Fisher transformation with the variance Fieller, Hartley
+// and Pearson give for ranks; it is adequate from about ten pairs.
+func spearmanP(rho float64, n int) float64 {
+	if n < 4 {
+		return 1
+	}
+	if math.Abs(rho) >= 1 {
+		return 0
+	}
+	z := math.Atanh(rho) * math.Sqrt(float64(n-3)/1.06)
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// near reports whether got is want to within tol.
+func near(got, want, tol float64) bool {
+	return math.Abs(got-want) <= tol
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   float64
+	}{
+		{"empty", nil, 0},
+		{"one", []float64{7}, 7},
+		{"odd", []float64{3, 1, 2}, 2},
+		{"even", []float64{4, 1, 3, 2}, 2.5},
+		{"ties", []float64{5, 5, 1, 5}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := median(tt.values); got != tt.want {
+				t.Errorf("median(%v) = %g, want %g", tt.values, got, tt.want)
+			}
+		})
+	}
+
+	values := []float64{3, 1, 2}
+	median(values)
+	if values[0] != 3 || values[1] != 1 || values[2] != 2 {
+		t.Errorf("median reordered its input: %v", values)
+	}
+}
+
+func TestMannWhitneyGreater(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		// R: wilcox.test(6:10, 1:5, alternative = "greater", exact = FALSE)
+		{"separated", []float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10}, 0.006092890},
+		{"reversed", []float64{6, 7, 8, 9, 10}, []float64{1, 2, 3, 4, 5}, 0.996692325},
+		// U = 19 with tie-corrected variance 21.8056.
+		{"ties", []float64{1, 2, 2, 3, 4}, []float64{2, 3, 3, 5, 6}, 0.099414472},
+		{"empty side", nil, []float64{1, 2}, 1},
+		{"all tied", []float64{4, 4}, []float64{4, 4}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mannWhitneyGreater(tt.a, tt.b); !near(got, tt.want, 1e-6) {
+				t.Errorf("mannWhitneyGreater(%v, %v) = %.9f, want %.9f", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarianceAndCV(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		variance float64
+		cv       float64
+	}{
+		{"textbook", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 32.0 / 7, 42.7617987},
+		{"constant", []float64{3, 3, 3}, 0, 0},
+		{"one value", []float64{5}, 0, 0},
+		{"zero mean", []float64{-1, 1}, 2, 0},
+		{"negative mean", []float64{-4, -6}, 2, 28.2842712},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := variance(tt.values); !near(got, tt.variance, 1e-9) {
+				t.Errorf("variance(%v) = %g, want %g", tt.values, got, tt.variance)
+			}
+			if got := coefficientOfVariation(tt.values); !near(got, tt.cv, 1e-6) {
+				t.Errorf("coefficientOfVariation(%v) = %g, want %g", tt.values, got, tt.cv)
+			}
+		})
+	}
+}
+
+func TestCliffsDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, b      []float64
+		want      float64
+		magnitude string
+	}{
+		{"identical", []float64{1, 2, 3}, []float64{1, 2, 3}, 0, "negligible"},
+		{"dominates", []float64{4, 5}, []float64{1, 2}, 1, "large"},
+		{"dominated", []float64{1, 2}, []float64{4, 5}, -1, "large"},
+		{"overlap", []float64{1, 2, 3, 4}, []float64{3, 4, 5, 6}, -0.75, "large"},
+		{"slight", []float64{1, 2, 3, 4, 6}, []float64{1, 2, 3, 4, 5}, 0.04, "negligible"},
+		{"empty", nil, []float64{1}, 0, "negligible"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cliffsDelta(tt.a, tt.b)
+			if !near(got, tt.want, 1e-12) {
+				t.Errorf("cliffsDelta(%v, %v) = %g, want %g", tt.a, tt.b, got, tt.want)
+			}
+			if m := cliffsMagnitude(got); m != tt.magnitude {
+				t.Errorf("cliffsMagnitude(%g) = %s, want %s", got, m, tt.magnitude)
+			}
+		})
+	}
+}
+
+func TestCliffsMagnitude(t *testing.T) {
+	tests := []struct {
+		delta float64
+		want  string
+	}{
+		{0, "negligible"},
+		{0.146, "negligible"},
+		{0.147, "small"},
+		{-0.2, "small"},
+		{0.33, "medium"},
+		{-0.473, "medium"},
+		{0.474, "large"},
+		{-1, "large"},
+	}
+	for _, tt := range tests {
+		if got := cliffsMagnitude(tt.delta); got != tt.want {
+			t.Errorf("cliffsMagnitude(%g) = %s, want %s", tt.delta, got, tt.want)
+		}
+	}
+}
+
+func TestHedgesG(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		// d = -2/sqrt(2.5), corrected by 1 - 3/31.
+		{"shifted", []float64{1, 2, 3, 4, 5}, []float64{3, 4, 5, 6, 7}, -1.1425003159},
+		{"same", []float64{1, 2, 3}, []float64{1, 2, 3}, 0},
+		{"no spread", []float64{2, 2}, []float64{3, 3}, 0},
+		{"too few", []float64{1}, []float64{2, 3}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hedgesG(tt.a, tt.b); !near(got, tt.want, 1e-9) {
+				t.Errorf("hedgesG(%v, %v) = %.10f, want %.10f", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalQuantile(t *testing.T) {
+	tests := []struct {
+		p, want float64
+	}{
+		{0.5, 0},
+		{0.8, 0.8416212336},
+		{0.95, 1.6448536270},
+		{0.975, 1.9599639845},
+		{0.05, -1.6448536270},
+	}
+	for _, tt := range tests {
+		if got := normalQuantile(tt.p); !near(got, tt.want, 1e-9) {
+			t.Errorf("normalQuantile(%g) = %.10f, want %.10f", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestMinDetectablePct(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		// (z(0.975) + z(0.8)) * sqrt(2.5/5 + 3.7/5), in percent of a mean of 100.
+		{"spread", []float64{100, 102, 98, 101, 99}, []float64{90, 93, 88, 91, 89}, 3.1197132674},
+		{"no spread", []float64{100, 100}, []float64{90, 90}, 0},
+		{"too few", []float64{100}, []float64{90, 91}, 0},
+		{"zero mean", []float64{-1, 1}, []float64{2, 3}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := minDetectablePct(tt.a, tt.b, 0.05, 0.8); !near(got, tt.want, 1e-8) {
+				t.Errorf("minDetectablePct(%v, %v) = %.10f, want %.10f", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRanks(t *testing.T) {
+	tests := []struct {
+		values, want []float64
+	}{
+		{[]float64{}, []float64{}},
+		{[]float64{30, 10, 20}, []float64{3, 1, 2}},
+		{[]float64{10, 20, 20, 30}, []float64{1, 2.5, 2.5, 4}},
+		{[]float64{5, 5, 5}, []float64{2, 2, 2}},
+	}
+	for _, tt := range tests {
+		got := ranks(tt.values)
+		if len(got) != len(tt.want) {
+			t.Fatalf("ranks(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ranks(%v) = %v, want %v", tt.values, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	tests := []struct {
+		name              string
+		x, y              []float64
+		pearson, spearman float64
+	}{
+		{"textbook", []float64{1, 2, 3, 4, 5}, []float64{2, 4, 5, 4, 5}, 0.7745966692, 0.7378647873},
+		{"monotone", []float64{1, 2, 3, 4, 5}, []float64{1, 8, 27, 64, 125}, 0.9431175138, 1},
+		{"inverse", []float64{1, 2, 3}, []float64{3, 2, 1}, -1, -1},
+		{"flat", []float64{1, 2, 3}, []float64{4, 4, 4}, 0, 0},
+		{"mismatched", []float64{1, 2, 3}, []float64{1, 2}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pearson(tt.x, tt.y); !near(got, tt.pearson, 1e-9) {
+				t.Errorf("pearson = %.10f, want %.10f", got, tt.pearson)
+			}
+			if got := spearman(tt.x, tt.y); !near(got, tt.spearman, 1e-9) {
+				t.Errorf("spearman = %.10f, want %.10f", got, tt.spearman)
+			}
+		})
+	}
+}
+
+func TestSpearmanP(t *testing.T) {
+	tests := []struct {
+		rho  float64
+		n    int
+		want float64
+	}{
+		// atanh(0.5) * sqrt(17/1.06) = 2.1998
+		{0.5, 20, 0.0278200859},
+		{-0.5, 20, 0.0278200859},
+		{0, 30, 1},
+		{1, 10, 0},
+		{0.9, 3, 1},
+	}
+	for _, tt := range tests {
+		if got := spearmanP(tt.rho, tt.n); !near(got, tt.want, 1e-9) {
+			t.Errorf("spearmanP(%g, %d) = %.10f, want %.10f", tt.rho, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CollectorStatus is a snapshot of the collector's session. It is never
+// modified once published; every change publishes a new one, so readers
+// such as /status load it without taking the collector's lock.
+type CollectorStatus struct {
+	Running   bool              `json:"running"`
+	Stopping  bool              `json:"stopping"`
+	SessionID string            `json:"session_id"`
+	Scenario  string            `json:"scenario"`
+	Impl      string            `json:"impl"`
+	Variant   string            `json:"variant"`
+	Project   string            `json:"project,omitempty"`
+	Machine   string            `json:"machine"`
+	Tags      map[string]string `json:"tags"`
+	// Phase is the phase marked open, if any.
+	Phase     string        `json:"phase,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	Progress  *ProgressData `json:"progress"`
+}
+
+// publish replaces the status snapshot with the collector's current state.
+// Callers hold c.mu.
+func (c *EvidenceCollector) publish() {
+	s := &CollectorStatus{
+		Running:   c.running,
+		Stopping:  c.stopping,
+		SessionID: c.sessionID,
+		Scenario:  c.scenario,
+		Impl:      c.impl,
+		Variant:   c.variant,
+		Project:   c.project,
+		Machine:   c.machine,
+		Tags:      c.tags,
+		StartedAt: c.startedAt,
+	}
+	if c.openPhase != nil {
+		s.Phase = c.openPhase.name
+	}
+	if c.progress != nil {
+		progress := *c.progress
+		s.Progress = &progress
+	}
+	c.status.Store(s)
+}
+
+// Status returns the latest snapshot, with the progress ETA brought up to
+// date. It never blocks on the collector.
+func (c *EvidenceCollector) Status() *CollectorStatus {
+	s := c.status.Load()
+	if s == nil {
+		return &CollectorStatus{Machine: c.machine}
+	}
+	copied := *s
+	if s.Progress != nil {
+		copied.Progress = s.Progress.withETA(s.StartedAt)
+	}
+	return &copied
+}
+
+// agentStatus is the answer to GET /status: the session's status, and the
+// agent's version and features so clients can tell what they talk to.
+type agentStatus struct {
+	*CollectorStatus
+	Version    string   `json:"version"`
+	APIVersion int      `json:"api_version"`
+	Features   []string `json:"features"`
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := collector.Status()
+	if !inScope(requestScope(r), status.Project) {
+		// Another project's session only shows as the agent being busy.
+		status = &CollectorStatus{Running: status.Running, Stopping: status.Stopping, Machine: status.Machine}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agentStatus{
+		CollectorStatus: status,
+		Version:         agentVersion,
+		APIVersion:      apiVersion,
+		Features:        agentFeatures,
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import "fmt"
+
+// SteadySpec sizes a matrix by its runs rather than a fixed count: each
+// cell keeps running until the coefficient of variation of a measurement
+// over its latest runs falls under a threshold, or until it has run the
+// matrix's iterations. Stable cells stop after a few runs; noisy ones get
+// the rest.
+type SteadySpec struct {
+	// Measurement is the measurement watched; empty watches the benchmark
+	// duration, the workload's time or else the window's.
+	Measurement string `json:"measurement,omitempty"`
+	// CVPct is the coefficient of variation, in percent, under which a
+	// cell is steady.
+	CVPct float64 `json:"cv_pct"`
+	// Window is how many of the cell's latest successful runs the
+	// coefficient is taken over (default 5).
+	Window int `json:"window,omitempty"`
+	// MinIterations is how many times a cell runs before it can be steady
+	// (default the window).
+	MinIterations int `json:"min_iterations,omitempty"`
+}
+
+const (
+	defaultSteadyWindow = 5
+	// defaultSteadyIterations is a steady matrix's iterations when the
+	// request sets none: the most any cell runs.
+	defaultSteadyIterations = 20
+)
+
+func (s *SteadySpec) validate(iterations int) error {
+	if s.Measurement != "" && !measurementName.MatchString(s.Measurement) {
+		return fmt.Errorf("steady: %q is not a valid measurement name", s.Measurement)
+	}
+	if s.CVPct <= 0 {
+		return fmt.Errorf("steady: cv_pct must be positive")
+	}
+	if s.Window == 0 {
+		s.Window = defaultSteadyWindow
+	}
+	if s.Window < 2 {
+		return fmt.Errorf("steady: window must be at least 2")
+	}
+	if s.MinIterations == 0 {
+		s.MinIterations = s.Window
+	}
+	if s.MinIterations < s.Window || s.MinIterations > iterations {
+		return fmt.Errorf("steady: min_iterations must be between the window (%d) and iterations (%d)", s.Window, iterations)
+	}
+	return nil
+}
+
+// value is the measurement the spec watches in run.
+func (s *SteadySpec) value(run *Run) (float64, bool) {
+	if s.Measurement == "" {
+		ms := benchmarkMs(run)
+		return ms, ms > 0
+	}
+	if run.Evidence == nil {
+		return 0, false
+	}
+	v, ok := run.Evidence.Measurements[s.Measurement]
+	return v, ok
+}
+
+// observe adds a cell's latest run, nil if its job failed, to the cell's
+// window and reports whether the cell is steady after ran iterations. Runs
+// without the measurement do not count toward the window.
+func (s *SteadySpec) observe(cell *MatrixCell, run *Run, ran int) bool {
+	if run != nil {
+		if v, ok := s.value(run); ok {
+			cell.values = append(cell.values, v)
+		}
+	}
+	if len(cell.values) < s.Window {
+		return false
+	}
+	cv := coefficientOfVariation(cell.values[len(cell.values)-s.Window:])
+	cell.CVPct = &cv
+	return ran >= s.MinIterations && cv < s.CVPct
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Steps get the box ready around a job's session: prepare steps run before
+// it opens (after any build), reset steps after it closes, whether or not
+// the run succeeded, so the next job starts from the same state. A scenario
+// runs its own steps, then those of the impl's adapter. Steps shared by many
+// scenarios live in step libraries, <scenario-dir>/steps/*.yaml, and are
+// pulled in with use:
+//
+//	steps:
+//	  drop-caches:
+//	    command: ["sh", "-c", "sync && echo 3 > /proc/sys/vm/drop_caches"]
+
+// StepSpec is one prepare or reset step. Command arguments and env values
+// are templates over scenarioVars.
+type StepSpec struct {
+	// Use names a library step; the fields set here override its own, and
+	// its env is added to.
+	Use     string            `yaml:"use,omitempty" json:"use,omitempty"`
+	Name    string            `yaml:"name,omitempty" json:"name,omitempty"`
+	Command []string          `yaml:"command,omitempty" json:"command,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	Timeout string            `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// IgnoreErrors keeps a failing step from failing the job.
+	IgnoreErrors bool `yaml:"ignore_errors,omitempty" json:"ignore_errors,omitempty"`
+}
+
+// defaultStepTimeout bounds steps that set no timeout.
+const defaultStepTimeout = 10 * time.Minute
+
+func (s *StepSpec) validate() error {
+	if len(s.Command) == 0 {
+		return fmt.Errorf("step %s has no command", s.Name)
+	}
+	if s.Timeout != "" {
+		if _, err := time.ParseDuration(s.Timeout); err != nil {
+			return fmt.Errorf("step %s: timeout: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// loadStepLibrary reads the step libraries in dir; a missing dir is an
+// empty library.
+func loadStepLibrary(dir string) (map[string]StepSpec, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.y*ml"))
+	if err != nil {
+		return nil, err
+	}
+	library := map[string]StepSpec{}
+	from := map[string]string{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Steps map[string]StepSpec `yaml:"steps"`
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for name, step := range file.Steps {
+			if prev, ok := from[name]; ok {
+				return nil, fmt.Errorf("%s: step %s is also defined in %s", path, name, prev)
+			}
+			if step.Use != "" {
+				return nil, fmt.Errorf("%s: step %s: library steps cannot use others", path, name)
+			}
+			if step.Name == "" {
+				step.Name = name
+			}
+			if err := step.validate(); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			library[name], from[name] = step, path
+		}
+	}
+	return library, nil
+}
+
+// resolveSteps replaces steps that use a library step with the step they
+// make of it.
+func resolveSteps(steps []StepSpec, library map[string]StepSpec) ([]StepSpec, error) {
+	resolved := make([]StepSpec, len(steps))
+	for i, step := range steps {
+		if step.Use == "" {
+			resolved[i] = step
+			continue
+		}
+		base, ok := library[step.Use]
+		if !ok {
+			return nil, fmt.Errorf("step %d uses unknown library step %q", i+1, step.Use)
+		}
+		if step.Name != "" {
+			base.Name = step.Name
+		}
+		if len(step.Command) > 0 {
+			base.Command = step.Command
+		}
+		if step.Timeout != "" {
+			base.Timeout = step.Timeout
+		}
+		base.IgnoreErrors = base.IgnoreErrors || step.IgnoreErrors
+		if len(step.Env) > 0 {
+			env := make(map[string]string, len(base.Env)+len(step.Env))
+			for k, v := range base.Env {
+				env[k] = v
+			}
+			for k, v := range step.Env {
+				env[k] = v
+			}
+			base.Env = env
+		}
+		base.Use = step.Use
+		resolved[i] = base
+	}
+	return resolved, nil
+}
+
+// resolveSteps resolves the library steps the scenario and its adapters use.
+func (s *ScenarioSpec) resolveSteps(library map[string]StepSpec) error {
+	var err error
+	if s.Prepare, err = resolveSteps(s.Prepare, library); err != nil {
+		return fmt.Errorf("prepare: %w", err)
+	}
+	if s.Reset, err = resolveSteps(s.Reset, library); err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	for impl, adapter := range s.Adapters {
+		if adapter.Prepare, err = resolveSteps(adapter.Prepare, library); err != nil {
+			return fmt.Errorf("adapter %s: prepare: %w", impl, err)
+		}
+		if adapter.Reset, err = resolveSteps(adapter.Reset, library); err != nil {
+			return fmt.Errorf("adapter %s: reset: %w", impl, err)
+		}
+		if err = adapter.Hooks.resolve(library); err != nil {
+			return fmt.Errorf("adapter %s: %w", impl, err)
+		}
+		s.Adapters[impl] = adapter
+	}
+	return s.Hooks.resolve(library)
+}
+
+func validateSteps(phase string, steps []StepSpec) error {
+	for i := range steps {
+		if steps[i].Name == "" {
+			steps[i].Name = fmt.Sprintf("%s-%d", phase, i+1)
+		}
+		if err := steps[i].validate(); err != nil {
+			return fmt.Errorf("%s: %w", phase, err)
+		}
+	}
+	return nil
+}
+
+// runSteps runs steps in order in the job's work directory, their output
+// going to the job's log. It stops at the first step that fails unless
+// that step ignores errors.
+func runSteps(phase string, steps []StepSpec, vars scenarioVars, jl *jobLog, prefix string) error {
+	for _, step := range steps {
+		jl.line(prefix, fmt.Sprintf("--- %s step %s", phase, step.Name))
+		err := runStep(context.Background(), step, vars, func(line string) { jl.line(prefix, line) })
+		if err == nil {
+			continue
+		}
+		if step.IgnoreErrors {
+			jl.line(prefix, fmt.Sprintf("--- %s step %s failed, ignored: %v", phase, step.Name, err))
+			continue
+		}
+		return fmt.Errorf("%s step %s: %w", phase, step.Name, err)
+	}
+	return nil
+}
+
+// runStep runs one step, handing each line of its output to line. The step
+// is cut short when ctx ends or its own timeout passes.
+func runStep(ctx context.Context, step StepSpec, vars scenarioVars, line func(string)) error {
+	argv := make([]string, len(step.Command))
+	for i, arg := range step.Command {
+		rendered, err := renderTemplate(arg, vars)
+		if err != nil {
+			return fmt.Errorf("command argument %d: %w", i, err)
+		}
+		argv[i] = rendered
+	}
+	env := make([]string, 0, len(step.Env))
+	for key, value := range step.Env {
+		rendered, err := renderTemplate(value, vars)
+		if err != nil {
+			return fmt.Errorf("env %s: %w", key, err)
+		}
+		env = append(env, key+"="+rendered)
+	}
+	sort.Strings(env)
+
+	timeout := defaultStepTimeout
+	if step.Timeout != "" {
+		timeout, _ = time.ParseDuration(step.Timeout)
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = vars.WorkDir
+	cmd.Env = append(os.Environ(), env...)
+	killGroupOnCancel(cmd)
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line(scanner.Text())
+		}
+		io.Copy(io.Discard, pr)
+	}()
+	err := cmd.Run()
+	pw.Close()
+	<-scanned
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		return fmt.Errorf("%s: %w", argv[0], err)
+	}
+	return nil
+}
+
+// jobSteps are the steps a job runs for an impl: the scenario's, then its
+// adapter's.
+func jobSteps(spec *ScenarioSpec, adapter AdapterSpec) (prepare, reset []StepSpec) {
+	prepare = append(slices.Clip(spec.Prepare), adapter.Prepare...)
+	reset = append(slices.Clip(spec.Reset), adapter.Reset...)
+	return prepare, reset
+}
+
+// resetSteps runs reset steps, logging rather than returning a failure:
+// the run is stored by then, and the next job's prepare steps get another
+// go at the box.
+func resetSteps(jobID string, steps []StepSpec, vars scenarioVars, jl *jobLog, prefix string) {
+	if err := runSteps("reset", steps, vars, jl, prefix); err != nil {
+		log.Printf("Job %s: %v", jobID, err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stopTimeout and stopWorkers are the --stop-timeout and --stop-workers
+// settings: how long Stop waits for the session's collectors to wind down,
+// and how many it winds down at once.
+var (
+	stopTimeout = 30 * time.Second
+	stopWorkers = 4
+)
+
+// StopData is how long the session's collectors took to wind down at Stop,
+// and which of them missed the deadline and are missing from the evidence.
+type StopData struct {
+	DurationMs float64  `json:"duration_ms"`
+	TimedOut   []string `json:"timed_out,omitempty"`
+}
+
+// stopTask winds down one part of a session's collection. It returns what
+// to merge into the evidence rather than writing it, so a task that misses
+// the deadline cannot race with the rest of Stop.
+type stopTask struct {
+	name string
+	run  func() func(*Evidence)
+}
+
+// runStopTasks runs the tasks on up to workers goroutines and collects
+// what finishes within timeout, in task order. Late tasks keep running;
+// wait blocks until they are done too.
+func runStopTasks(tasks []stopTask, workers int, timeout time.Duration) (applies []func(*Evidence), late []string, wait func()) {
+	slots := make(chan struct{}, max(workers, 1))
+	results := make([]chan func(*Evidence), len(tasks))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		results[i] = make(chan func(*Evidence), 1)
+		wg.Add(1)
+		go func(task stopTask, result chan<- func(*Evidence)) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			result <- task.run()
+		}(task, results[i])
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	expired := false
+	for i, result := range results {
+		if !expired {
+			select {
+			case apply := <-result:
+				applies = append(applies, apply)
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case apply := <-result:
+			applies = append(applies, apply)
+		default:
+			log.Printf("Stop: %s did not finish within %s, leaving it out", tasks[i].name, timeout)
+			late = append(late, tasks[i].name)
+		}
+	}
+	return applies, late, wg.Wait
+}
+
+// stopped lets a new session start once the last one has wound down.
+func (c *EvidenceCollector) stopped() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopping = false
+	c.publish()
+}
+
+// stopTasks hands the session's running parts over to tasks, clearing them
+// from the collector. Callers hold c.mu.
+func (c *EvidenceCollector) stopTasks() []stopTask {
+	var tasks []stopTask
+	if scope := c.scope; scope != nil {
+		tasks = append(tasks, stopTask{"target", func() func(*Evidence) {
+			var scoped Evidence
+			scope.Stop(&scoped)
+			return func(e *Evidence) {
+				e.Compaction = scoped.Compaction
+				e.Cgroups = scoped.Cgroups
+				e.Threads = scoped.Threads
+				e.Sockets = scoped.Sockets
+				e.Files = scoped.Files
+				e.Target = scoped.Target
+			}
+		}})
+	}
+	// The clock's verdict weighs the noise seen, so they stop together.
+	noiseMon, clockMon, sessionID := c.noise, c.clock, c.sessionID
+	tasks = append(tasks, stopTask{"noise", func() func(*Evidence) {
+		noise := noiseMon.Stop()
+		clock := clockMon.Stop(noise)
+		if clock != nil {
+			for _, warning := range clock.Warnings {
+				log.Printf("Run %s: %s", sessionID, warning)
+			}
+		}
+		return func(e *Evidence) { e.Noise, e.Clock = noise, clock }
+	}})
+	thermal, gpu, swap, pressure, pmu, collectors := c.thermal, c.gpu, c.swap, c.pressure, c.pmu, c.collectors
+	tasks = append(tasks,
+		stopTask{"pressure", func() func(*Evidence) {
+			data := pressure.Stop()
+			if data != nil && data.Oversubscribed {
+				log.Printf("Run %s: host oversubscribed: %s", sessionID, strings.Join(data.Reasons, "; "))
+			}
+			return func(e *Evidence) { e.Pressure = data }
+		}},
+		stopTask{"swap", func() func(*Evidence) {
+			data := swap.Stop()
+			if data != nil && data.Swapped() {
+				log.Printf("Run %s: swapped %d pages in and %d out during the window", sessionID, data.SwapInPages+data.ZswapInPages, data.SwapOutPages+data.ZswapOutPages)
+			}
+			return func(e *Evidence) { e.Swap = data }
+		}},
+		stopTask{"thermal", func() func(*Evidence) {
+			data := thermal.Stop()
+			return func(e *Evidence) { e.Thermal = data }
+		}},
+		stopTask{"gpu", func() func(*Evidence) {
+			data := gpu.Stop()
+			return func(e *Evidence) { e.GPU = data }
+		}},
+		stopTask{"pmu", func() func(*Evidence) {
+			data := pmu.Stop()
+			return func(e *Evidence) { e.PMU = data }
+		}},
+		stopTask{"plugins", func() func(*Evidence) {
+			data := collectors.Stop()
+			return func(e *Evidence) { e.Collectors = data }
+		}},
+	)
+
+	// Interrupt every bpftrace first so they print their maps in parallel.
+	for _, run := range c.traces {
+		run.interrupt()
+	}
+	offcpuOpts, _ := c.enabled("offcpu")
+	execOpts, _ := c.enabled("exec")
+	for name, run := range c.traces {
+		name, run := name, run
+		tasks = append(tasks, stopTask{name, func() func(*Evidence) {
+			out, err := run.Stop()
+			if err != nil {
+				log.Printf("eBPF %s: %v", name, err)
+				return func(e *Evidence) { c.ebpf.setReason(name, err.Error()) }
+			}
+			switch name {
+			case "runqlat":
+				data := c.collectRunqlat(out)
+				return func(e *Evidence) { e.Runqlat = data }
+			case "biolatency":
+				data := c.collectBiolatency(out)
+				return func(e *Evidence) { e.Biolatency = data }
+			case "offcpu":
+				data := c.collectOffcpu(out, offcpuOpts.count("top", 0))
+				return func(e *Evidence) { e.Offcpu = data }
+			case "exec":
+				data := c.collectExec(out, execOpts.count("top", 0))
+				return func(e *Evidence) { e.Exec = data }
+			case "syscalls":
+				data := c.collectSyscalls(out)
+				return func(e *Evidence) { e.SyscallCounts = data }
+			case "connect":
+				data := c.collectConnect(out)
+				return func(e *Evidence) { e.Connect = data }
+			case "handshakes":
+				data := c.collectHandshakes(out)
+				return func(e *Evidence) { e.Handshakes = data }
+			case "fderrors":
+				data := c.collectFDErrors(out)
+				return func(e *Evidence) { e.FDErrors = data }
+			case "readahead":
+				data := c.collectReadahead(out)
+				return func(e *Evidence) { e.Readahead = data }
+			case "writeback":
+				data := c.collectWriteback(out)
+				return func(e *Evidence) { e.Writeback = data }
+			}
+			return func(*Evidence) {}
+		}})
+	}
+	for name, run := range c.natives {
+		name, run := name, run
+		tasks = append(tasks, stopTask{name, func() func(*Evidence) {
+			out, stats := run.Stop()
+			pipelineEvents.WithLabelValues(name, c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project).Add(float64(stats.Events))
+			pipelineDropped.WithLabelValues(name, c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project).Add(float64(stats.Dropped))
+			if stats.Dropped > 0 {
+				log.Printf("eBPF %s: ring buffer full, dropped %d of %d events (%.2f%%)", name, stats.Dropped, stats.Events+stats.Dropped, stats.DropPct)
+			}
+			var apply func(*Evidence)
+			switch name {
+			case "exec":
+				data := c.collectExec(out, execOpts.count("top", 0))
+				apply = func(e *Evidence) { e.Exec = data }
+			case "syscalls":
+				data := c.collectSyscalls(out)
+				apply = func(e *Evidence) { e.SyscallCounts = data }
+			}
+			return func(e *Evidence) {
+				c.ebpf.setPipeline(name, stats)
+				apply(e)
+			}
+		}})
+	}
+	if fallback := c.fallback; fallback != nil {
+		tasks = append(tasks, stopTask{"fallback", func() func(*Evidence) {
+			var fb Evidence
+			fallback.Stop(&fb, offcpuOpts.count("top", 0), execOpts.count("top", 0))
+			return func(e *Evidence) {
+				// The fallback only fills in collectors without a variant.
+				if fb.Runqlat != nil {
+					e.Runqlat = fb.Runqlat
+				}
+				if fb.Biolatency != nil {
+					e.Biolatency = fb.Biolatency
+				}
+				if fb.Offcpu != nil {
+					e.Offcpu = fb.Offcpu
+				}
+				if fb.Exec != nil {
+					e.Exec = fb.Exec
+				}
+				if fb.SyscallCounts != nil {
+					e.SyscallCounts = fb.SyscallCounts
+				}
+			}
+		}})
+	}
+
+	c.scope, c.noise, c.clock, c.thermal, c.gpu, c.swap, c.pressure, c.pmu, c.collectors = nil, nil, nil, nil, nil, nil, nil, nil, nil
+	c.traces, c.natives, c.fallback = nil, nil, nil
+	return tasks
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// applyNote returns an apply that appends note to the evidence's run ID,
+// so the order the applies come back in shows.
+func applyNote(note string) func(*Evidence) {
+	return func(e *Evidence) { e.RunID += note }
+}
+
+func TestRunStopTasksOrder(t *testing.T) {
+	var tasks []stopTask
+	for i := 0; i < 8; i++ {
+		note := fmt.Sprint(i)
+		// Later tasks finish first.
+		delay := time.Duration(8-i) * time.Millisecond
+		tasks = append(tasks, stopTask{name: note, run: func() func(*Evidence) {
+			time.Sleep(delay)
+			return applyNote(note)
+		}})
+	}
+	applies, late, wait := runStopTasks(tasks, 4, 5*time.Second)
+	wait()
+	if len(late) != 0 {
+		t.Errorf("late = %v, want none", late)
+	}
+	var e Evidence
+	for _, apply := range applies {
+		apply(&e)
+	}
+	if e.RunID != "01234567" {
+		t.Errorf("applied in order %q, want 01234567", e.RunID)
+	}
+}
+
+func TestRunStopTasksWorkers(t *testing.T) {
+	for _, workers := range []int{0, 1, 3} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			var running, peak atomic.Int32
+			tasks := make([]stopTask, 10)
+			for i := range tasks {
+				tasks[i] = stopTask{name: fmt.Sprint(i), run: func() func(*Evidence) {
+					n := running.Add(1)
+					for {
+						p := peak.Load()
+						if n <= p || peak.CompareAndSwap(p, n) {
+							break
+						}
+					}
+					time.Sleep(2 * time.Millisecond)
+					running.Add(-1)
+					return applyNote("")
+				}}
+			}
+			applies, late, wait := runStopTasks(tasks, workers, 5*time.Second)
+			wait()
+			if len(applies) != len(tasks) || len(late) != 0 {
+				t.Errorf("%d applies and late %v, want %d and none", len(applies), late, len(tasks))
+			}
+			if want := int32(max(workers, 1)); peak.Load() > want {
+				t.Errorf("%d tasks ran at once, want at most %d", peak.Load(), want)
+			}
+		})
+	}
+}
+
+func TestRunStopTasksDeadline(t *testing.T) {
+	release := make(chan struct{})
+	var finished atomic.Bool
+	tasks := []stopTask{
+		{name: "quick", run: func() func(*Evidence) { return applyNote("q") }},
+		{name: "stuck", run: func() func(*Evidence) {
+			<-release
+			finished.Store(true)
+			return applyNote("s")
+		}},
+		{name: "after", run: func() func(*Evidence) { return applyNote("a") }},
+	}
+	began := time.Now()
+	applies, late, wait := runStopTasks(tasks, 3, 50*time.Millisecond)
+	if took := time.Since(began); took > 2*time.Second {
+		t.Errorf("returned after %s, past the 50ms deadline", took)
+	}
+	if len(late) != 1 || late[0] != "stuck" {
+		t.Errorf("late = %v, want [stuck]", late)
+	}
+	var e Evidence
+	for _, apply := range applies {
+		apply(&e)
+	}
+	if e.RunID != "qa" {
+		t.Errorf("applied %q, want the tasks that finished, qa", e.RunID)
+	}
+
+	// The late task keeps running, and wait sees it out.
+	var waited sync.WaitGroup
+	waited.Add(1)
+	go func() {
+		defer waited.Done()
+		wait()
+	}()
+	close(release)
+	waited.Wait()
+	if !finished.Load() {
+		t.Error("wait returned before the late task finished")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// diskOf returns the sysfs directory of the disk path lives on, or ""
+// when it is not on a block device, as with tmpfs and overlay mounts.
+// Partitions resolve to their disk, and device-mapper volumes are followed
+// down to the first disk under them.
+func diskOf(path string) string {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return ""
+	}
+	dev := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+	for depth := 0; depth < 4; depth++ {
+		disk, err := filepath.EvalSymlinks(dev)
+		if err != nil {
+			return ""
+		}
+		if _, err := os.Stat(filepath.Join(disk, "partition")); err == nil {
+			disk = filepath.Dir(disk)
+		}
+		name := filepath.Base(disk)
+		if !strings.HasPrefix(name, "dm-") && !strings.HasPrefix(name, "md") {
+			return disk
+		}
+		slaves, err := os.ReadDir(filepath.Join(disk, "slaves"))
+		if err != nil || len(slaves) == 0 {
+			return ""
+		}
+		dev = filepath.Join("/sys/class/block", slaves[0].Name())
+	}
+	return ""
+}
+
+// storageClass names the kind of disk path lives on: "nvme", "ssd", "hdd",
+// or "virtual" for paravirtualized disks; "" when it is not on a block
+// device.
+func storageClass(path string) string {
+	disk := diskOf(path)
+	if disk == "" {
+		return ""
+	}
+	name := filepath.Base(disk)
+	switch {
+	case strings.HasPrefix(name, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(name, "vd") || strings.HasPrefix(name, "xvd"):
+		return "virtual"
+	case readTrimmed(filepath.Join(disk, "queue", "rotational")) == "1":
+		return "hdd"
+	}
+	return "ssd"
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// diskOf is only known on Linux, from sysfs.
+func diskOf(path string) string {
+	return ""
+}
+
+// storageClass is only known on Linux, from sysfs.
+func storageClass(path string) string {
+	return ""
+}
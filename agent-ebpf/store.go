@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRunNotFound = errors.New("run not found")
+
+type Run struct {
+	ID        string            `json:"id"`
+	Scenario  string            `json:"scenario"`
+	Impl      string            `json:"impl"`
+	Variant   string            `json:"variant"`
+	Commit    string            `json:"commit"`
+	Machine   string            `json:"machine"`
+	Dataset   string            `json:"dataset"`
+	Project   string            `json:"project,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	// DurationMs is the length of the collection window, on the monotonic
+	// clock, between the wall clock times StartedAt and StoppedAt.
+	DurationMs  float64          `json:"duration_ms,omitempty"`
+	StartedAt   *time.Time       `json:"started_at,omitempty"`
+	StoppedAt   *time.Time       `json:"stopped_at,omitempty"`
+	Environment *EnvironmentInfo `json:"environment,omitempty"`
+	Evidence    *Evidence        `json:"evidence,omitempty"`
+}
+
+// RunStore keeps one JSON document per run under <dir>/runs.
+type RunStore struct {
+	mu  sync.RWMutex
+	dir string
+
+	// redaction, when set, is applied to every run before it is written.
+	redaction *RedactionConfig
+
+	// indexMu guards index, which is loaded on first query.
+	indexMu sync.Mutex
+	index   *runIndex
+}
+
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "chainbench-data"
+	}
+	return filepath.Join(home, ".chainbench")
+}
+
+func NewRunStore(dir string) (*RunStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "runs"), 0o755); err != nil {
+		return nil, fmt.Errorf("create run store: %w", err)
+	}
+	return &RunStore{dir: dir}, nil
+}
+
+func newRunID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+func (s *RunStore) runPath(id string) string {
+	return filepath.Join(s.dir, "runs", id+".json")
+}
+
+func validRunID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
+
+func (s *RunStore) Save(run *Run) error {
+	if !validRunID(run.ID) {
+		return fmt.Errorf("invalid run id %q", run.ID)
+	}
+
+	run, err := secrets.maskRun(run)
+	if err != nil {
+		return fmt.Errorf("mask secrets in run %s: %w", run.ID, err)
+	}
+	if s.redaction != nil {
+		redacted, err := s.redaction.Run(run)
+		if err != nil {
+			return fmt.Errorf("redact run %s: %w", run.ID, err)
+		}
+		run = redacted
+	}
+
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+
+	tmp := s.runPath(run.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	err = os.Rename(tmp, s.runPath(run.ID))
+	s.mu.Unlock()
+	if err == nil {
+		s.indexRun(run)
+	}
+	return err
+}
+
+func (s *RunStore) Get(id string) (*Run, error) {
+	if !validRunID(id) {
+		return nil, errRunNotFound
+	}
+
+	s.mu.RLock()
+	data, err := os.ReadFile(s.runPath(id))
+	s.mu.RUnlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("run %s: %w", id, err)
+	}
+	return &run, nil
+}
+
+func (s *RunStore) Delete(id string) error {
+	if !validRunID(id) {
+		return errRunNotFound
+	}
+
+	s.mu.Lock()
+	err := os.Remove(s.runPath(id))
+	if err == nil {
+		os.RemoveAll(s.artifactDir(id))
+	}
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return errRunNotFound
+	}
+	if err == nil {
+		s.unindexRun(id)
+	}
+	return err
+}
+
+// Size returns the bytes a stored run occupies on disk, artifacts included.
+func (s *RunStore) Size(id string) int64 {
+	info, err := os.Stat(s.runPath(id))
+	if err != nil {
+		return 0
+	}
+	return info.Size() + dirSize(s.artifactDir(id))
+}
+
+// ArtifactInfo describes a file stored with a run, such as a build log.
+type ArtifactInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func (s *RunStore) artifactDir(id string) string {
+	return filepath.Join(s.dir, "artifacts", id)
+}
+
+func validArtifactName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// SaveArtifact stores a file with a run under <dir>/artifacts/<id>,
+// replacing one of the same name. It goes when the run is deleted.
+func (s *RunStore) SaveArtifact(id, name string, r io.Reader) error {
+	if !validRunID(id) || !validArtifactName(name) {
+		return fmt.Errorf("invalid artifact %s/%s", id, name)
+	}
+	dir := s.artifactDir(id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// Artifacts lists the files stored with a run, by name.
+func (s *RunStore) Artifacts(id string) ([]ArtifactInfo, error) {
+	if !validRunID(id) {
+		return nil, errRunNotFound
+	}
+	entries, err := os.ReadDir(s.artifactDir(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return []ArtifactInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	artifacts := make([]ArtifactInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.Type().IsRegular() || !validArtifactName(entry.Name()) {
+			continue
+		}
+		artifacts = append(artifacts, ArtifactInfo{Name: entry.Name(), Size: info.Size()})
+	}
+	return artifacts, nil
+}
+
+// ArtifactPath returns where a run's artifact is stored, or os.ErrNotExist.
+func (s *RunStore) ArtifactPath(id, name string) (string, error) {
+	if !validRunID(id) || !validArtifactName(name) {
+		return "", os.ErrNotExist
+	}
+	path := filepath.Join(s.artifactDir(id), name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// List returns all stored runs, newest first.
+func (s *RunStore) List() ([]*Run, error) {
+	s.mu.RLock()
+	entries, err := os.ReadDir(filepath.Join(s.dir, "runs"))
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*Run, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		run, err := s.Get(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].CreatedAt.After(runs[j].CreatedAt)
+	})
+	return runs, nil
+}
+
+// loadRunArg resolves a CLI argument that is either a path to an evidence or
+// run document, or the ID of a run in the store.
+func loadRunArg(arg, dataDir string) (*Run, error) {
+	if data, err := os.ReadFile(arg); err == nil {
+		var run Run
+		if err := json.Unmarshal(data, &run); err == nil && run.Evidence != nil {
+			return &run, nil
+		}
+		evidence, err := loadEvidence(arg)
+		if err != nil {
+			return nil, err
+		}
+		return &Run{ID: evidence.RunID, Evidence: evidence}, nil
+	}
+
+	s, err := NewRunStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	run, err := s.Get(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", arg, err)
+	}
+	return run, nil
+}
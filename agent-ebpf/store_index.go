@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RunSummary is a stored run without its evidence, plus the figures the
+// store indexes for queries.
+type RunSummary struct {
+	Run
+	// GainPct is the workload-reported gain_pct measurement, if any.
+	GainPct *float64 `json:"gain_pct,omitempty"`
+	// Valid is false when the run was invalidated (its clock stepped).
+	Valid bool `json:"valid"`
+	// Verdict grades how far the run can be trusted: "ok", "degraded" (eBPF
+	// unavailable or replaced by a fallback), "anomalous" (evidence far out of
+	// line with the series' history), "noisy" (cloud-noisy host) or
+	// "invalid".
+	Verdict string `json:"verdict"`
+	// Result is how the workload ended: "success", or the failure class.
+	Result string `json:"result"`
+}
+
+const (
+	verdictOK        = "ok"
+	verdictDegraded  = "degraded"
+	verdictNoisy     = "noisy"
+	verdictAnomalous = "anomalous"
+	verdictInvalid   = "invalid"
+)
+
+func summarizeRun(run *Run) *RunSummary {
+	s := &RunSummary{Run: *run, Valid: true, Verdict: verdictOK, Result: resultSuccess}
+	s.Evidence = nil
+	s.Project = projectOf(run.Project)
+	e := run.Evidence
+	if e == nil {
+		return s
+	}
+	s.Result = runResult(e)
+	if s.DurationMs == 0 {
+		// Runs stored before the window was recorded; scenarios that time
+		// themselves report it.
+		s.DurationMs = e.Measurements["duration_ms"]
+	}
+	if gain, ok := e.Measurements["gain_pct"]; ok {
+		s.GainPct = &gain
+	}
+	degraded := !e.Available
+	if e.EBPF != nil {
+		for _, c := range e.EBPF.Collectors {
+			degraded = degraded || c.Fallback != ""
+		}
+	}
+	switch {
+	case e.Clock != nil && e.Clock.Invalid, e.Swap != nil && e.Swap.Invalid:
+		s.Valid = false
+		s.Verdict = verdictInvalid
+	case e.Noise != nil && e.Noise.Noisy:
+		s.Verdict = verdictNoisy
+	case e.Anomalies != nil:
+		s.Verdict = verdictAnomalous
+	case degraded:
+		s.Verdict = verdictDegraded
+	}
+	return s
+}
+
+// runIndex holds every run's summary in memory, with posting lists from
+// each label and tag value to the runs carrying it, so queries never read
+// run documents. It is saved to <dir>/index.json and reconciled with the
+// run files when loaded, by modification time and size.
+type runIndex struct {
+	entries map[string]*indexEntry
+	// postings maps postingKey(field, value) to the ids of the runs that
+	// have it.
+	postings map[string]map[string]bool
+
+	flushPending bool
+}
+
+type indexEntry struct {
+	Summary *RunSummary `json:"summary"`
+	ModTime time.Time   `json:"mod_time"`
+	Size    int64       `json:"size"`
+}
+
+// indexVersion changes whenever RunSummary's derivation does, so older
+// index files are rebuilt.
+const indexVersion = 4
+
+// indexFlushDelay batches index writes when many runs change at once, as
+// when retention prunes or an archive is imported.
+const indexFlushDelay = time.Second
+
+func postingKey(field, value string) string {
+	return field + "\x00" + value
+}
+
+// postingKeys lists the keys a run is filed under: each run label, each tag
+// by key and value, and each tag key alone.
+func postingKeys(s *RunSummary) []string {
+	keys := []string{
+		postingKey("scenario", s.Scenario),
+		postingKey("impl", s.Impl),
+		postingKey("variant", s.Variant),
+		postingKey("commit", s.Commit),
+		postingKey("machine", s.Machine),
+		postingKey("dataset", s.Dataset),
+		postingKey("project", s.Project),
+	}
+	for key, value := range s.Tags {
+		keys = append(keys, postingKey("tag", key), postingKey("tag:"+key, value))
+	}
+	return keys
+}
+
+func (x *runIndex) add(entry *indexEntry) {
+	x.remove(entry.Summary.ID)
+	x.entries[entry.Summary.ID] = entry
+	for _, key := range postingKeys(entry.Summary) {
+		if x.postings[key] == nil {
+			x.postings[key] = map[string]bool{}
+		}
+		x.postings[key][entry.Summary.ID] = true
+	}
+}
+
+func (x *runIndex) remove(id string) {
+	entry, ok := x.entries[id]
+	if !ok {
+		return
+	}
+	delete(x.entries, id)
+	for _, key := range postingKeys(entry.Summary) {
+		delete(x.postings[key], id)
+		if len(x.postings[key]) == 0 {
+			delete(x.postings, key)
+		}
+	}
+}
+
+func (s *RunStore) indexPath() string {
+	return filepath.Join(s.dir, "index.json")
+}
+
+// loadIndex returns the index, building it on first use. Callers hold
+// s.indexMu.
+func (s *RunStore) loadIndex() (*runIndex, error) {
+	if s.index != nil {
+		return s.index, nil
+	}
+
+	x := &runIndex{entries: map[string]*indexEntry{}, postings: map[string]map[string]bool{}}
+	var saved struct {
+		Version int                    `json:"version"`
+		Entries map[string]*indexEntry `json:"entries"`
+	}
+	if data, err := os.ReadFile(s.indexPath()); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil || saved.Version != indexVersion {
+			saved.Entries = nil
+		}
+	}
+
+	s.mu.RLock()
+	files, err := os.ReadDir(filepath.Join(s.dir, "runs"))
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	changed := len(saved.Entries) == 0 && len(files) > 0
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if file.IsDir() || !ok {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if entry := saved.Entries[id]; entry != nil && entry.Summary != nil &&
+			entry.ModTime.Equal(info.ModTime()) && entry.Size == info.Size() {
+			x.add(entry)
+			continue
+		}
+		run, err := s.Get(id)
+		if err != nil {
+			log.Printf("Run index: skipping %s: %v", id, err)
+			continue
+		}
+		x.add(&indexEntry{Summary: summarizeRun(run), ModTime: info.ModTime(), Size: info.Size()})
+		changed = true
+	}
+	changed = changed || len(x.entries) != len(saved.Entries)
+
+	s.index = x
+	if changed {
+		if err := s.writeIndex(); err != nil {
+			log.Printf("Run index: %v", err)
+		}
+	}
+	return x, nil
+}
+
+// indexRun files a just-written run, if the index has been loaded; one
+// loaded later picks the run up from its file.
+func (s *RunStore) indexRun(run *Run) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.index == nil {
+		return
+	}
+	info, err := os.Stat(s.runPath(run.ID))
+	if err != nil {
+		return
+	}
+	s.index.add(&indexEntry{Summary: summarizeRun(run), ModTime: info.ModTime(), Size: info.Size()})
+	s.scheduleIndexFlush()
+}
+
+func (s *RunStore) unindexRun(id string) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.index == nil {
+		return
+	}
+	s.index.remove(id)
+	s.scheduleIndexFlush()
+}
+
+// scheduleIndexFlush writes the index out shortly. Callers hold s.indexMu.
+func (s *RunStore) scheduleIndexFlush() {
+	if s.index.flushPending {
+		return
+	}
+	s.index.flushPending = true
+	time.AfterFunc(indexFlushDelay, func() {
+		s.indexMu.Lock()
+		defer s.indexMu.Unlock()
+		s.index.flushPending = false
+		if err := s.writeIndex(); err != nil {
+			log.Printf("Run index: %v", err)
+		}
+	})
+}
+
+// writeIndex saves the index. Callers hold s.indexMu.
+func (s *RunStore) writeIndex() error {
+	data, err := json.Marshal(map[string]any{"version": indexVersion, "entries": s.index.entries})
+	if err != nil {
+		return err
+	}
+	tmp := s.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.indexPath())
+}
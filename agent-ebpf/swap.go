@@ -0,0 +1,180 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SwapData is the swapping done during the window. A run whose target
+// swapped timed the swap device as much as the node, so by default it is
+// invalid; see allowSwap. Swapping elsewhere on the host is only a warning.
+type SwapData struct {
+	// SwapInPages and SwapOutPages are pages moved to and from swap devices
+	// on the whole host, from /proc/vmstat; the Zswap ones are pages
+	// compressed into and out of memory by zswap in front of them.
+	SwapInPages   uint64 `json:"swap_in_pages"`
+	SwapOutPages  uint64 `json:"swap_out_pages"`
+	ZswapInPages  uint64 `json:"zswap_in_pages,omitempty"`
+	ZswapOutPages uint64 `json:"zswap_out_pages,omitempty"`
+	// TargetSwapInPages and TargetSwapOutPages are the target's cgroups'
+	// share, on kernels whose memory.stat counts it.
+	TargetSwapInPages  uint64 `json:"target_swap_in_pages,omitempty"`
+	TargetSwapOutPages uint64 `json:"target_swap_out_pages,omitempty"`
+	// TargetSwapStartBytes and TargetSwapPeakBytes are how much of the
+	// target's memory was in swap at the start and at most (VmSwap).
+	TargetSwapStartBytes uint64 `json:"target_swap_start_bytes,omitempty"`
+	TargetSwapPeakBytes  uint64 `json:"target_swap_peak_bytes,omitempty"`
+	Invalid              bool   `json:"invalid,omitempty"`
+}
+
+// Swapped reports whether anything went to or came back from swap.
+func (s *SwapData) Swapped() bool {
+	return s.SwapInPages+s.SwapOutPages+s.ZswapInPages+s.ZswapOutPages > 0 || s.TargetSwapped()
+}
+
+// TargetSwapped reports whether the target's cgroups swapped or more of its
+// memory went to swap than at the start.
+func (s *SwapData) TargetSwapped() bool {
+	return s.TargetSwapInPages+s.TargetSwapOutPages > 0 || s.TargetSwapPeakBytes > s.TargetSwapStartBytes
+}
+
+// allowSwap makes the target's swapping only a warning rather than
+// invalidating the run.
+var allowSwap bool
+
+const swapInterval = time.Second
+
+// swapMonitor takes deltas of the host's swap counters, and samples how
+// much of the target is swapped out and its cgroups' swap counters.
+type swapMonitor struct {
+	tracker  *targetTracker
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu          sync.Mutex
+	first, last cgroupCounters
+	cgroups     map[string][2]cgroupCounters
+	started     bool
+	startBytes  uint64
+	peakBytes   uint64
+}
+
+func startSwapMonitor(tracker *targetTracker, interval time.Duration) *swapMonitor {
+	m := &swapMonitor{
+		tracker:  tracker,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		cgroups:  map[string][2]cgroupCounters{},
+	}
+	m.sample()
+	go m.loop()
+	return m
+}
+
+func (m *swapMonitor) loop() {
+	defer close(m.done)
+	ticker := newPacedTicker(m.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+// readSwapCounters reads the swap counters of /proc/vmstat or a cgroup's
+// memory.stat, which use the same names.
+func readSwapCounters(path string) cgroupCounters {
+	counters := cgroupCounters{}
+	readKeyValues(path, counters, "")
+	for name := range counters {
+		if name != "pswpin" && name != "pswpout" && name != "zswpin" && name != "zswpout" {
+			delete(counters, name)
+		}
+	}
+	return counters
+}
+
+func (m *swapMonitor) sample() {
+	host := readSwapCounters("/proc/vmstat")
+	var pids []int
+	if m.tracker != nil {
+		pids = m.tracker.PIDs()
+	}
+	var swapped uint64
+	cgroups := map[string]cgroupCounters{}
+	for _, pid := range pids {
+		kb := strings.TrimSuffix(procField(filepath.Join("/proc", strconv.Itoa(pid), "status"), "VmSwap"), " kB")
+		if v, err := strconv.ParseUint(kb, 10, 64); err == nil {
+			swapped += v * 1024
+		}
+		if cgroup := processCgroup(pid); cgroup != "" && cgroup != "/" {
+			if _, ok := cgroups[cgroup]; !ok {
+				cgroups[cgroup] = readSwapCounters(filepath.Join(cgroupRoot, strings.TrimPrefix(cgroup, "/"), "memory.stat"))
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.first == nil {
+		m.first = host
+	}
+	m.last = host
+	for path, counters := range cgroups {
+		seen, ok := m.cgroups[path]
+		if !ok {
+			seen[0] = counters
+		}
+		seen[1] = counters
+		m.cgroups[path] = seen
+	}
+	if len(pids) > 0 {
+		if !m.started {
+			m.started, m.startBytes = true, swapped
+		}
+		m.peakBytes = max(m.peakBytes, swapped)
+	}
+}
+
+// Stop returns the window's swapping, invalid if the target swapped unless
+// swap is allowed.
+func (m *swapMonitor) Stop() *SwapData {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	m.sample()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delta := func(first, last cgroupCounters, name string) uint64 {
+		if last[name] < first[name] {
+			return 0
+		}
+		return last[name] - first[name]
+	}
+	data := &SwapData{
+		SwapInPages:          delta(m.first, m.last, "pswpin"),
+		SwapOutPages:         delta(m.first, m.last, "pswpout"),
+		ZswapInPages:         delta(m.first, m.last, "zswpin"),
+		ZswapOutPages:        delta(m.first, m.last, "zswpout"),
+		TargetSwapStartBytes: m.startBytes,
+		TargetSwapPeakBytes:  m.peakBytes,
+	}
+	for _, seen := range m.cgroups {
+		data.TargetSwapInPages += delta(seen[0], seen[1], "pswpin") + delta(seen[0], seen[1], "zswpin")
+		data.TargetSwapOutPages += delta(seen[0], seen[1], "pswpout") + delta(seen[0], seen[1], "zswpout")
+	}
+	data.Invalid = data.TargetSwapped() && !allowSwap
+	return data
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tags are free-form key/value annotations a session or job carries into
+// its stored run, e.g. pr=1234 or reason="pebble upgrade". Keys follow
+// Prometheus label naming so an allow-listed one can become a label.
+const (
+	maxTags        = 32
+	maxTagValueLen = 256
+)
+
+var runLabelNames = []string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project"}
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("%d tags, at most %d allowed", len(tags), maxTags)
+	}
+	for key, value := range tags {
+		if !measurementName.MatchString(key) {
+			return fmt.Errorf("invalid tag key %q: must match %s", key, measurementName)
+		}
+		if len(value) > maxTagValueLen {
+			return fmt.Errorf("tag %s: value longer than %d bytes", key, maxTagValueLen)
+		}
+	}
+	return nil
+}
+
+// tagLabels is the --tag-labels allow-list: the tag keys exported as labels
+// of chainbench_run_tags. Every distinct value makes a new series, so only
+// low-cardinality keys belong here.
+var tagLabels []string
+
+func validateTagLabels(keys []string) error {
+	for _, key := range keys {
+		if !measurementName.MatchString(key) || strings.HasPrefix(key, "__") {
+			return fmt.Errorf("--tag-labels: %q is not a valid label name", key)
+		}
+		if slices.Contains(runLabelNames, key) {
+			return fmt.Errorf("--tag-labels: %q clashes with the run label of that name", key)
+		}
+	}
+	return nil
+}
+
+var (
+	runTagsOnce sync.Once
+	runTags     *prometheus.GaugeVec
+)
+
+// exportRunTags sets chainbench_run_tags for a run, with its allow-listed
+// tags as labels (empty where the run lacks one), so other series sharing
+// the run labels can be joined to them in PromQL. It does nothing without
+// an allow-list.
+func exportRunTags(labels []string, tags map[string]string) {
+	if len(tagLabels) == 0 {
+		return
+	}
+	runTagsOnce.Do(func() {
+		runTags = newGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "chainbench_run_tags",
+				Help: "Allow-listed tags of a run (always 1)",
+			},
+			append(slices.Clone(runLabelNames), tagLabels...),
+		)
+	})
+	values := slices.Clone(labels)
+	for _, key := range tagLabels {
+		values = append(values, tags[key])
+	}
+	runTags.WithLabelValues(values...).Set(1)
+}
+
+// formatTags renders tags as sorted key=value pairs, quoting values that
+// need it.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := tags[key]
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		pairs[i] = key + "=" + value
+	}
+	return strings.Join(pairs, " ")
+}
+
+// parseTagFilters reads tag query parameters: "key=value" matches runs with
+// that tag value, a bare "key" runs that have the tag at all.
+func parseTagFilters(params []string) (map[string]*string, error) {
+	filters := map[string]*string{}
+	for _, param := range params {
+		key, value, hasValue := strings.Cut(param, "=")
+		if !measurementName.MatchString(key) {
+			return nil, fmt.Errorf("invalid tag filter %q", param)
+		}
+		if hasValue {
+			filters[key] = &value
+		} else {
+			filters[key] = nil
+		}
+	}
+	return filters, nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target selects the processes a session's per-process collectors look at.
+// Any combination of selectors may be set; the union of matches and all of
+// their descendants is used. Matches are re-resolved every second, so a node
+// started after the session, or helpers it forks, are picked up.
+type Target struct {
+	PIDs      []int  `yaml:"pids,omitempty" json:"pids,omitempty"`
+	Process   string `yaml:"process,omitempty" json:"process,omitempty"`
+	Binary    string `yaml:"binary,omitempty" json:"binary,omitempty"`
+	Port      int    `yaml:"port,omitempty" json:"port,omitempty"`
+	Container string `yaml:"container,omitempty" json:"container,omitempty"`
+	Cgroup    string `yaml:"cgroup,omitempty" json:"cgroup,omitempty"`
+	Pod       string `yaml:"pod,omitempty" json:"pod,omitempty"`
+	LogFile   string `yaml:"log_file,omitempty" json:"log_file,omitempty"`
+}
+
+// StartRequest opens a collection session.
+type StartRequest struct {
+	Scenario string  `json:"scenario"`
+	Impl     string  `json:"impl"`
+	Variant  string  `json:"variant"`
+	Commit   string  `json:"commit"`
+	Dataset  string  `json:"dataset"`
+	Target   *Target `json:"target,omitempty"`
+	// Project is the project the run is stored in; POST /start takes it
+	// from the caller.
+	Project string `json:"-"`
+	// Params are the scenario parameters the run was made with, stored
+	// with it.
+	Params map[string]string `json:"params,omitempty"`
+	// Tags are stored with the run; see validateTags.
+	Tags map[string]string `json:"tags,omitempty"`
+	// DataDir is where the workload keeps its data, whose filesystem the
+	// run's environment records; the agent's data dir when unset.
+	DataDir string `json:"data_dir,omitempty"`
+
+	// Collectors, when set, names exactly the collectors to run, each with
+	// its options; otherwise all of them run with defaults.
+	Collectors map[string]CollectorOptions `json:"collectors,omitempty"`
+	// OverheadBudgetPct caps the agent's CPU use, in percent of one CPU;
+	// 0 uses --overhead-budget-pct.
+	OverheadBudgetPct float64 `json:"overhead_budget_pct,omitempty"`
+}
+
+// TargetProcess is one process that matched the target during a session.
+type TargetProcess struct {
+	PID         int     `json:"pid"`
+	PPID        int     `json:"ppid"`
+	Comm        string  `json:"comm"`
+	Exe         string  `json:"exe,omitempty"`
+	Pod         string  `json:"pod,omitempty"`
+	FirstSeenMs float64 `json:"first_seen_ms"`
+	LastSeenMs  float64 `json:"last_seen_ms"`
+}
+
+type TargetData struct {
+	Selector  string          `json:"selector"`
+	Processes []TargetProcess `json:"processes"`
+	Container *ContainerInfo  `json:"container,omitempty"`
+	Pods      []PodInfo       `json:"pods,omitempty"`
+}
+
+// cgroupRoot is the unified (v2) hierarchy: /sys/fs/cgroup itself, or its
+// unified subdirectory on hybrid v1/v2 hosts.
+var cgroupRoot = func() string {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		if _, err := os.Stat("/sys/fs/cgroup/unified/cgroup.controllers"); err == nil {
+			return "/sys/fs/cgroup/unified"
+		}
+	}
+	return "/sys/fs/cgroup"
+}()
+
+// parseTarget reads the --target flag syntax: comma-separated kind:value
+// selectors, e.g. "binary:geth,port:8545" or "pid:1234".
+func parseTarget(spec string) (*Target, error) {
+	t := &Target{}
+	for _, part := range strings.Split(spec, ",") {
+		kind, value, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("target %q: expected kind:value", part)
+		}
+		switch kind {
+		case "pid":
+			pid, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("target %q: %w", part, err)
+			}
+			t.PIDs = append(t.PIDs, pid)
+		case "process":
+			t.Process = value
+		case "binary":
+			t.Binary = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("target %q: %w", part, err)
+			}
+			t.Port = port
+		case "container":
+			t.Container = value
+		case "cgroup":
+			t.Cgroup = value
+		case "pod":
+			t.Pod = value
+		case "log":
+			t.LogFile = value
+		default:
+			return nil, fmt.Errorf("target %q: unknown kind %q", part, kind)
+		}
+	}
+	return t, nil
+}
+
+func (t *Target) empty() bool {
+	return t == nil || len(t.PIDs) == 0 && t.Process == "" && t.Binary == "" &&
+		t.Port == 0 && t.Container == "" && t.Cgroup == "" && t.Pod == ""
+}
+
+func (t *Target) String() string {
+	if t == nil {
+		return ""
+	}
+	var parts []string
+	for _, pid := range t.PIDs {
+		parts = append(parts, "pid:"+strconv.Itoa(pid))
+	}
+	for kind, value := range map[string]string{"process": t.Process, "binary": t.Binary, "container": t.Container, "cgroup": t.Cgroup, "pod": t.Pod} {
+		if value != "" {
+			parts = append(parts, kind+":"+value)
+		}
+	}
+	if t.Port != 0 {
+		parts = append(parts, "port:"+strconv.Itoa(t.Port))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+type procInfo struct {
+	ppid int
+	comm string
+}
+
+// procTable reads the parent and name of every process.
+func procTable() map[int]procInfo {
+	table := map[int]procInfo{}
+	dirs, _ := os.ReadDir("/proc")
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", dir.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		s := string(stat)
+		open, close := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+		if open < 0 || close < open {
+			continue
+		}
+		fields := strings.Fields(s[close+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		table[pid] = procInfo{ppid: ppid, comm: s[open+1 : close]}
+	}
+	return table
+}
+
+// listeningSocketInodes returns the inodes of TCP sockets listening on port.
+func listeningSocketInodes(port int) map[string]bool {
+	inodes := map[string]bool{}
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != "0A" {
+				continue
+			}
+			_, hexPort, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
+			}
+			if p, err := strconv.ParseInt(hexPort, 16, 32); err == nil && int(p) == port {
+				inodes[fields[9]] = true
+			}
+		}
+	}
+	return inodes
+}
+
+func pidsOwningSockets(table map[int]procInfo, inodes map[string]bool) []int {
+	if len(inodes) == 0 {
+		return nil
+	}
+	var pids []int
+	for pid := range table {
+		fdDir := filepath.Join("/proc", strconv.Itoa(pid), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && strings.HasPrefix(link, "socket:[") && inodes[strings.Trim(link[7:], "[]")] {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
+
+func (t *Target) resolve() []int {
+	if t.empty() {
+		return nil
+	}
+	return t.resolveIn(procTable())
+}
+
+func (t *Target) resolveIn(table map[int]procInfo) []int {
+
+	roots := map[int]bool{}
+	for _, pid := range t.PIDs {
+		roots[pid] = true
+	}
+	if t.Cgroup != "" {
+		pids, _ := cgroupProcs(t.Cgroup)
+		for _, pid := range pids {
+			roots[pid] = true
+		}
+	}
+	if t.Container != "" {
+		pids, _ := containerProcs(t.Container)
+		for _, pid := range pids {
+			roots[pid] = true
+		}
+	}
+	if t.Pod != "" && kubelet != nil {
+		for _, pid := range kubelet.podPIDs(t.Pod, table) {
+			roots[pid] = true
+		}
+	}
+	if t.Port != 0 {
+		for _, pid := range pidsOwningSockets(table, listeningSocketInodes(t.Port)) {
+			roots[pid] = true
+		}
+	}
+	for pid, info := range table {
+		if t.Process != "" && info.comm == t.Process {
+			roots[pid] = true
+		}
+		if t.Binary != "" {
+			exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+			if err == nil && (exe == t.Binary || filepath.Base(exe) == t.Binary) {
+				roots[pid] = true
+			}
+		}
+	}
+
+	// Walk down from the roots so helpers the node forks are included.
+	children := map[int][]int{}
+	for pid, info := range table {
+		children[info.ppid] = append(children[info.ppid], pid)
+	}
+	var pids []int
+	seen := map[int]bool{}
+	queue := make([]int, 0, len(roots))
+	for pid := range roots {
+		if _, alive := table[pid]; alive {
+			queue = append(queue, pid)
+		}
+	}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		pids = append(pids, pid)
+		queue = append(queue, children[pid]...)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// targetTracker keeps a session's target resolved while it runs and
+// remembers every process that matched.
+type targetTracker struct {
+	target  *Target
+	started time.Time
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu        sync.Mutex
+	current   []int
+	processes map[int]*TargetProcess
+	container *ContainerInfo
+	pods      map[string]*PodInfo
+}
+
+const targetInterval = time.Second
+
+func startTargetTracker(target *Target) *targetTracker {
+	t := &targetTracker{
+		target:    target,
+		started:   time.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		processes: map[int]*TargetProcess{},
+		pods:      map[string]*PodInfo{},
+	}
+	t.refresh()
+	go t.loop()
+	return t
+}
+
+func (t *targetTracker) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(targetInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.refresh()
+		}
+	}
+}
+
+func (t *targetTracker) refresh() {
+	table := procTable()
+	pids := t.target.resolveIn(table)
+	offset := float64(time.Since(t.started).Microseconds()) / 1000
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.target.Container != "" && t.container == nil {
+		// Recorded as first seen, before the container can go away.
+		_, t.container = containerProcs(t.target.Container)
+	}
+	t.current = pids
+	for _, pid := range pids {
+		if p, ok := t.processes[pid]; ok {
+			p.LastSeenMs = offset
+			continue
+		}
+		info := table[pid]
+		p := &TargetProcess{PID: pid, PPID: info.ppid, Comm: info.comm, FirstSeenMs: offset, LastSeenMs: offset}
+		p.Exe, _ = os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+		if kubelet != nil {
+			if pod := kubelet.podForPID(pid); pod != nil {
+				p.Pod = pod.String()
+				t.pods[p.Pod] = pod
+			}
+		}
+		t.processes[pid] = p
+		log.Printf("Target %s: tracking pid %d (%s)", t.target, pid, p.Comm)
+	}
+}
+
+// PIDs returns the most recently resolved process set.
+func (t *targetTracker) PIDs() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]int(nil), t.current...)
+}
+
+func (t *targetTracker) Stop() *TargetData {
+	close(t.stop)
+	<-t.done
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data := &TargetData{Selector: t.target.String(), Container: t.container}
+	for _, p := range t.processes {
+		data.Processes = append(data.Processes, *p)
+	}
+	sort.Slice(data.Processes, func(i, j int) bool { return data.Processes[i].PID < data.Processes[j].PID })
+	for _, pod := range t.pods {
+		data.Pods = append(data.Pods, *pod)
+	}
+	sort.Slice(data.Pods, func(i, j int) bool { return data.Pods[i].String() < data.Pods[j].String() })
+	return data
+}
+
+// targetScope is the set of per-process collectors following one target.
+type targetScope struct {
+	target     *Target
+	tracker    *targetTracker
+	compaction *compactionSampler
+	cgroups    *cgroupAccounting
+	threads    *threadSampler
+	sockets    *socketSampler
+	files      *fileSampler
+}
+
+// startTargetScope starts the scope's collectors that collectors (nil for
+// all) enables; the tracker itself always runs.
+func startTargetScope(target *Target, collectors map[string]CollectorOptions) *targetScope {
+	tracker := startTargetTracker(target)
+	s := &targetScope{target: target, tracker: tracker}
+	if opts, ok := collectorEnabled(collectors, "compaction"); ok {
+		s.compaction = startCompactionSampler(tracker, opts.duration("interval", compactionInterval))
+	}
+	if _, ok := collectorEnabled(collectors, "cgroups"); ok {
+		s.cgroups = startCgroupAccounting(tracker)
+	}
+	if opts, ok := collectorEnabled(collectors, "threads"); ok {
+		s.threads = startThreadSampler(tracker, opts.duration("interval", threadsInterval), opts.count("top", threadsDefaultTop))
+	}
+	if opts, ok := collectorEnabled(collectors, "sockets"); ok {
+		s.sockets = startSocketSampler(tracker, opts.duration("interval", socketsInterval))
+	}
+	if opts, ok := collectorEnabled(collectors, "files"); ok {
+		s.files = startFileSampler(tracker, opts.duration("interval", filesInterval))
+	}
+	return s
+}
+
+// Stop ends the scope's collectors and fills in their evidence sections.
+// These read /proc and cgroupfs and do not need eBPF.
+func (s *targetScope) Stop(e *Evidence) {
+	if s.compaction != nil {
+		e.Compaction = s.compaction.Stop()
+		if e.Compaction.Threads == 0 && s.target.LogFile == "" {
+			e.Compaction = nil
+		}
+	}
+	if s.cgroups != nil {
+		e.Cgroups = s.cgroups.Stop()
+	}
+	if s.threads != nil {
+		e.Threads = s.threads.Stop()
+	}
+	if s.sockets != nil {
+		e.Sockets = s.sockets.Stop()
+	}
+	if s.files != nil {
+		e.Files = s.files.Stop()
+	}
+	e.Target = s.tracker.Stop()
+}
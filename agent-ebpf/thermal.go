@@ -0,0 +1,233 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThermalData summarises CPU frequency and temperature over the window, so a
+// run that was faster only because the CPU ran cooler or boosted higher can
+// be told apart from a real improvement.
+type ThermalData struct {
+	Samples        int                  `json:"samples"`
+	MaxFreqMHz     float64              `json:"max_freq_mhz,omitempty"`
+	MeanFreqMHz    float64              `json:"mean_freq_mhz,omitempty"`
+	MinFreqMHz     float64              `json:"min_freq_mhz,omitempty"`
+	Residency      []FrequencyResidency `json:"residency,omitempty"`
+	StartTempC     float64              `json:"start_temp_c,omitempty"`
+	MeanTempC      float64              `json:"mean_temp_c,omitempty"`
+	PeakTempC      float64              `json:"peak_temp_c,omitempty"`
+	ThrottleEvents uint64               `json:"throttle_events"`
+}
+
+// FrequencyResidency is the share of core-samples spent in a band of the
+// CPU's maximum frequency.
+type FrequencyResidency struct {
+	Band  string  `json:"band"`
+	Share float64 `json:"share"`
+}
+
+// residencyBands are upper bounds as a fraction of cpuinfo_max_freq.
+var residencyBands = []struct {
+	label string
+	upper float64
+}{
+	{"<50%", 0.50},
+	{"50-70%", 0.70},
+	{"70-85%", 0.85},
+	{"85-95%", 0.95},
+	{">=95%", 1e9},
+}
+
+const thermalInterval = time.Second
+
+func readUint(path string) (uint64, bool) {
+	v, err := strconv.ParseUint(readTrimmed(path), 10, 64)
+	return v, err == nil
+}
+
+func cpuDirs() []string {
+	dirs, _ := filepath.Glob("/sys/devices/system/cpu/cpu[0-9]*")
+	return dirs
+}
+
+// packageTemps reads package temperatures in °C, from the x86_pkg_temp
+// thermal zones or, failing that, coretemp's "Package id" hwmon sensors. Arm
+// and RISC-V boards have neither; their device trees name CPU zones like
+// "cpu-thermal", "cpu0-thermal" or "cpu_thermal".
+func packageTemps() []float64 {
+	var temps, cpuZones []float64
+	zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*")
+	for _, zone := range zones {
+		kind := readTrimmed(filepath.Join(zone, "type"))
+		milli, ok := readUint(filepath.Join(zone, "temp"))
+		if !ok {
+			continue
+		}
+		switch {
+		case kind == "x86_pkg_temp":
+			temps = append(temps, float64(milli)/1000)
+		case strings.HasPrefix(kind, "cpu") && strings.HasSuffix(kind, "thermal"):
+			cpuZones = append(cpuZones, float64(milli)/1000)
+		}
+	}
+	if len(temps) > 0 {
+		return temps
+	}
+	labels, _ := filepath.Glob("/sys/class/hwmon/hwmon*/temp*_label")
+	for _, label := range labels {
+		name := readTrimmed(label)
+		if !strings.HasPrefix(name, "Package id") && name != "Tctl" && name != "Tdie" {
+			continue
+		}
+		if milli, ok := readUint(strings.TrimSuffix(label, "_label") + "_input"); ok {
+			temps = append(temps, float64(milli)/1000)
+		}
+	}
+	if len(temps) > 0 {
+		return temps
+	}
+	return cpuZones
+}
+
+// throttleCount sums the kernel's core and package thermal throttle counters.
+func throttleCount() uint64 {
+	var total uint64
+	for _, dir := range cpuDirs() {
+		for _, name := range []string{"core_throttle_count", "package_throttle_count"} {
+			if n, ok := readUint(filepath.Join(dir, "thermal_throttle", name)); ok {
+				total += n
+			}
+		}
+	}
+	return total
+}
+
+type thermalMonitor struct {
+	stop     chan struct{}
+	done     chan struct{}
+	interval time.Duration
+
+	mu            sync.Mutex
+	data          ThermalData
+	maxKHz        map[string]uint64
+	bandCounts    []int
+	freqSamples   int
+	freqSum       float64
+	tempSamples   int
+	tempSum       float64
+	startThrottle uint64
+}
+
+func startThermalMonitor(interval time.Duration) *thermalMonitor {
+	m := &thermalMonitor{
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		interval:      interval,
+		maxKHz:        map[string]uint64{},
+		bandCounts:    make([]int, len(residencyBands)),
+		startThrottle: throttleCount(),
+	}
+	for _, dir := range cpuDirs() {
+		if khz, ok := readUint(filepath.Join(dir, "cpufreq", "cpuinfo_max_freq")); ok && khz > 0 {
+			m.maxKHz[dir] = khz
+			m.data.MaxFreqMHz = max(m.data.MaxFreqMHz, float64(khz)/1000)
+		}
+	}
+	if temps := packageTemps(); len(temps) > 0 {
+		m.data.StartTempC = temps[0]
+		for _, t := range temps {
+			m.data.StartTempC = max(m.data.StartTempC, t)
+		}
+	}
+	m.sample()
+	go m.loop()
+	return m
+}
+
+func (m *thermalMonitor) loop() {
+	defer close(m.done)
+	ticker := newPacedTicker(m.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+func (m *thermalMonitor) sample() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data.Samples++
+	for dir, maxKHz := range m.maxKHz {
+		khz, ok := readUint(filepath.Join(dir, "cpufreq", "scaling_cur_freq"))
+		if !ok {
+			continue
+		}
+		mhz := float64(khz) / 1000
+		if m.freqSamples == 0 || mhz < m.data.MinFreqMHz {
+			m.data.MinFreqMHz = mhz
+		}
+		m.freqSamples++
+		m.freqSum += mhz
+		ratio := float64(khz) / float64(maxKHz)
+		for i, band := range residencyBands {
+			if ratio < band.upper {
+				m.bandCounts[i]++
+				break
+			}
+		}
+	}
+
+	// The hottest package is the one that throttles first.
+	if temps := packageTemps(); len(temps) > 0 {
+		sort.Float64s(temps)
+		hottest := temps[len(temps)-1]
+		m.tempSamples++
+		m.tempSum += hottest
+		m.data.PeakTempC = max(m.data.PeakTempC, hottest)
+	}
+}
+
+// Stop returns the summary, or nil when the host exposes neither cpufreq
+// nor package temperatures (common in VMs).
+func (m *thermalMonitor) Stop() *ThermalData {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	m.sample()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.freqSamples == 0 && m.tempSamples == 0 {
+		return nil
+	}
+	data := m.data
+	if m.freqSamples > 0 {
+		data.MeanFreqMHz = m.freqSum / float64(m.freqSamples)
+		for i, band := range residencyBands {
+			data.Residency = append(data.Residency, FrequencyResidency{
+				Band:  band.label,
+				Share: float64(m.bandCounts[i]) / float64(m.freqSamples),
+			})
+		}
+	}
+	if m.tempSamples > 0 {
+		data.MeanTempC = m.tempSum / float64(m.tempSamples)
+	}
+	if n := throttleCount(); n >= m.startThrottle {
+		data.ThrottleEvents = n - m.startThrottle
+	}
+	return &data
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// threadGroup is one --thread-group: the threads whose name matches
+// pattern, such as compaction threads or RPC handlers.
+type threadGroup struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// threadGroups are the configured groups, matched in order. With any set,
+// the latency collectors key their histograms by thread name and the
+// latency histograms carry the group as their thread_group label; without,
+// the label is empty and the scripts do not look at thread names.
+var threadGroups []threadGroup
+
+// threadGroupOther is the group of threads no pattern matches.
+const threadGroupOther = "other"
+
+// parseThreadGroups parses --thread-group name=regex flags.
+func parseThreadGroups(specs []string) ([]threadGroup, error) {
+	var groups []threadGroup
+	for _, spec := range specs {
+		name, pattern, ok := strings.Cut(spec, "=")
+		if !ok || name == "" || pattern == "" {
+			return nil, fmt.Errorf("--thread-group %q: want name=regex", spec)
+		}
+		if name == threadGroupOther {
+			return nil, fmt.Errorf("--thread-group %q: %q is the group of unmatched threads", spec, threadGroupOther)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("--thread-group %s: %w", name, err)
+		}
+		groups = append(groups, threadGroup{name: name, pattern: re})
+	}
+	return groups, nil
+}
+
+// threadGroupOf is the group of the thread named comm: the first whose
+// pattern matches, or "other".
+func threadGroupOf(comm string) string {
+	for _, g := range threadGroups {
+		if g.pattern.MatchString(comm) {
+			return g.name
+		}
+	}
+	return threadGroupOther
+}
+
+// groupHistograms merges histograms keyed by thread name into one per
+// thread group. It returns nil without groups or keyed histograms.
+func groupHistograms(byComm map[string][]HistogramBucket) map[string][]HistogramBucket {
+	if len(threadGroups) == 0 || len(byComm) == 0 {
+		return nil
+	}
+	groups := map[string][]HistogramBucket{}
+	for comm, hist := range byComm {
+		group := threadGroupOf(comm)
+		groups[group] = mergeHistograms(groups[group], hist)
+	}
+	return groups
+}
+
+// mergeHistograms adds the counts of b's buckets to a's.
+func mergeHistograms(a, b []HistogramBucket) []HistogramBucket {
+	counts := map[int]int{}
+	for _, bucket := range a {
+		counts[bucket.BucketUs] += bucket.Count
+	}
+	for _, bucket := range b {
+		counts[bucket.BucketUs] += bucket.Count
+	}
+	merged := make([]HistogramBucket, 0, len(counts))
+	for us, count := range counts {
+		merged = append(merged, HistogramBucket{BucketUs: us, Count: count})
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].BucketUs < merged[j].BucketUs })
+	return merged
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThreadData is the target's time broken down by thread role: threads
+// sharing a name apart from a trailing number, such as the workers of one
+// pool, count as one role. A multi-threaded node shows there which part of
+// it, compaction, networking or the EVM, got slower.
+type ThreadData struct {
+	Threads int `json:"threads"`
+	// Roles are ordered by CPU time, busiest first; Omitted counts the roles
+	// left out past the top ones.
+	Roles   []ThreadRole `json:"roles"`
+	Omitted int          `json:"omitted,omitempty"`
+	// Scheduling counts the threads by the policy and nice value they
+	// last ran with.
+	Scheduling []ThreadScheduling `json:"scheduling,omitempty"`
+}
+
+// ThreadRole is one role's share of the window: time on CPU, waiting on the
+// run queue, and off CPU otherwise (sleeping or blocked). RunqMeanUs is the
+// mean run-queue wait per timeslice.
+type ThreadRole struct {
+	Role       string  `json:"role"`
+	Threads    int     `json:"threads"`
+	CPUMs      float64 `json:"cpu_ms"`
+	OffCPUMs   float64 `json:"offcpu_ms"`
+	RunqMs     float64 `json:"runq_ms"`
+	RunqMeanUs float64 `json:"runq_mean_us"`
+}
+
+const (
+	threadsInterval   = time.Second
+	threadsDefaultTop = 20
+)
+
+// threadNumber is a trailing worker number, with the separator before it.
+var threadNumber = regexp.MustCompile(`[-_:.#/ ]?\d+$`)
+
+// threadRole is the role of a thread named comm: "rocksdb:bg3" and
+// "rocksdb:bg12" are both "rocksdb:bg".
+func threadRole(comm string) string {
+	if role := threadNumber.ReplaceAllString(comm, ""); role != "" {
+		return role
+	}
+	return comm
+}
+
+// schedCounters are a schedstat's run delay and timeslices, and for
+// threads also the time spent on CPU.
+type schedCounters struct {
+	cpuNs   uint64
+	delayNs uint64
+	slices  uint64
+}
+
+func readSchedstat(path string) (schedCounters, bool) {
+	fields := strings.Fields(readTrimmed(path))
+	if len(fields) < 3 {
+		return schedCounters{}, false
+	}
+	var c schedCounters
+	c.cpuNs, _ = strconv.ParseUint(fields[0], 10, 64)
+	c.delayNs, _ = strconv.ParseUint(fields[1], 10, 64)
+	c.slices, _ = strconv.ParseUint(fields[2], 10, 64)
+	return c, true
+}
+
+type threadTotals struct {
+	threads map[string]bool
+	sched   schedCounters
+	offNs   uint64
+}
+
+// threadSampler reads the target's threads' schedstat every interval and
+// sums the deltas by role. It needs CONFIG_SCHEDSTATS, like the procfs
+// fallback's off-CPU time.
+type threadSampler struct {
+	tracker  *targetTracker
+	interval time.Duration
+	top      int
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu     sync.Mutex
+	last   map[string]schedCounters
+	sched  map[string]threadSched
+	roles  map[string]*threadTotals
+	lastAt time.Time
+}
+
+func startThreadSampler(tracker *targetTracker, interval time.Duration, top int) *threadSampler {
+	s := &threadSampler{
+		tracker:  tracker,
+		interval: interval,
+		top:      top,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		last:     map[string]schedCounters{},
+		sched:    map[string]threadSched{},
+		roles:    map[string]*threadTotals{},
+	}
+	s.sample(true)
+	go s.loop()
+	return s
+}
+
+func (s *threadSampler) loop() {
+	defer close(s.done)
+	ticker := newPacedTicker(s.interval)
+	defer stopPacedTicker(ticker)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sample(false)
+		}
+	}
+}
+
+func (s *threadSampler) sample(baseline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	elapsedNs := uint64(now.Sub(s.lastAt).Nanoseconds())
+	s.lastAt = now
+	for _, pid := range s.tracker.PIDs() {
+		taskRoot := filepath.Join("/proc", strconv.Itoa(pid), "task")
+		tasks, err := os.ReadDir(taskRoot)
+		if err != nil {
+			continue
+		}
+		for _, task := range tasks {
+			taskDir := filepath.Join(taskRoot, task.Name())
+			c, ok := readSchedstat(filepath.Join(taskDir, "schedstat"))
+			if !ok {
+				continue
+			}
+			key := strconv.Itoa(pid) + "/" + task.Name()
+			if sched, ok := readThreadSched(filepath.Join(taskDir, "stat")); ok {
+				s.sched[key] = sched
+			}
+			prev, seen := s.last[key]
+			s.last[key] = c
+			if baseline {
+				continue
+			}
+			role := threadRole(readTrimmed(filepath.Join(taskDir, "comm")))
+			totals := s.roles[role]
+			if totals == nil {
+				totals = &threadTotals{threads: map[string]bool{}}
+				s.roles[role] = totals
+			}
+			totals.threads[key] = true
+			if c.cpuNs < prev.cpuNs || c.delayNs < prev.delayNs {
+				continue
+			}
+			// A thread spawned during the window starts from zero; when
+			// in the interval it started is unknown, so its off-CPU time
+			// counts from the next one.
+			busy := (c.cpuNs - prev.cpuNs) + (c.delayNs - prev.delayNs)
+			if seen && busy < elapsedNs {
+				totals.offNs += elapsedNs - busy
+			}
+			totals.sched.cpuNs += c.cpuNs - prev.cpuNs
+			totals.sched.delayNs += c.delayNs - prev.delayNs
+			totals.sched.slices += c.slices - prev.slices
+		}
+	}
+}
+
+func (s *threadSampler) Stop() *ThreadData {
+	close(s.stop)
+	<-s.done
+	s.sample(false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.roles) == 0 {
+		return nil
+	}
+	data := &ThreadData{Scheduling: tallyScheduling(s.sched)}
+	for role, totals := range s.roles {
+		r := ThreadRole{
+			Role:     role,
+			Threads:  len(totals.threads),
+			CPUMs:    float64(totals.sched.cpuNs) / 1e6,
+			OffCPUMs: float64(totals.offNs) / 1e6,
+			RunqMs:   float64(totals.sched.delayNs) / 1e6,
+		}
+		if totals.sched.slices > 0 {
+			r.RunqMeanUs = float64(totals.sched.delayNs) / float64(totals.sched.slices) / 1e3
+		}
+		data.Threads += r.Threads
+		data.Roles = append(data.Roles, r)
+	}
+	sort.Slice(data.Roles, func(i, j int) bool {
+		if data.Roles[i].CPUMs != data.Roles[j].CPUMs {
+			return data.Roles[i].CPUMs > data.Roles[j].CPUMs
+		}
+		return data.Roles[i].Role < data.Roles[j].Role
+	})
+	if s.top > 0 && len(data.Roles) > s.top {
+		data.Omitted = len(data.Roles) - s.top
+		data.Roles = data.Roles[:s.top]
+	}
+	return data
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Trend is how one impl/variant's run durations moved from commit to commit
+// on one machine and dataset, or on one class of machines when grouped by
+// class.
+type Trend struct {
+	Scenario string       `json:"scenario"`
+	Impl     string       `json:"impl"`
+	Variant  string       `json:"variant"`
+	Dataset  string       `json:"dataset"`
+	Machine  string       `json:"machine,omitempty"`
+	Class    string       `json:"class,omitempty"`
+	Points   []TrendPoint `json:"points"`
+}
+
+// TrendPoint summarizes one commit's runs. Points are ordered by the
+// commit's first run.
+type TrendPoint struct {
+	Commit    string    `json:"commit"`
+	FirstSeen time.Time `json:"first_seen"`
+	Runs      int       `json:"runs"`
+	MedianMs  float64   `json:"median_ms"`
+	P95Ms     float64   `json:"p95_ms"`
+}
+
+// LeaderboardEntry ranks one impl/variant, on one class of machines when
+// grouped by class, by median duration.
+type LeaderboardEntry struct {
+	Rank       int     `json:"rank"`
+	Impl       string  `json:"impl"`
+	Variant    string  `json:"variant"`
+	Class      string  `json:"class,omitempty"`
+	Runs       int     `json:"runs"`
+	Machines   int     `json:"machines"`
+	MedianMs   float64 `json:"median_ms"`
+	P95Ms      float64 `json:"p95_ms"`
+	BestMs     float64 `json:"best_ms"`
+	LastCommit string  `json:"last_commit"`
+}
+
+type Leaderboard struct {
+	Scenario string             `json:"scenario"`
+	Dataset  string             `json:"dataset"`
+	Since    time.Time          `json:"since"`
+	Entries  []LeaderboardEntry `json:"entries"`
+}
+
+// leaderboardWindow is the leaderboard's default since.
+const leaderboardWindow = "30d"
+
+// trendQuery reads a trend or leaderboard's run filters, the same as GET
+// /runs takes, with defaults for those the request leaves out. Unless asked
+// otherwise only valid runs count.
+func trendQuery(r *http.Request, defaults map[string]string) (*RunQuery, error) {
+	values := r.URL.Query()
+	for name, value := range defaults {
+		if !values.Has(name) {
+			values.Set(name, value)
+		}
+	}
+	q, err := parseRunQuery(values)
+	if err != nil {
+		return nil, err
+	}
+	q.Sort, q.Desc, q.Limit, q.Cursor = "created", false, 0, ""
+	scopeQuery(q, requestScope(r))
+	return q, nil
+}
+
+// timedRuns returns every run matching q that recorded a duration, oldest
+// first, reading the store a page at a time.
+func timedRuns(q *RunQuery) ([]*RunSummary, error) {
+	page := *q
+	page.Limit, page.Cursor = maxRunQueryLimit, ""
+	var timed []*RunSummary
+	for {
+		runs, next, err := store.Query(&page)
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range runs {
+			if run.DurationMs > 0 {
+				timed = append(timed, run)
+			}
+		}
+		if next == "" {
+			return timed, nil
+		}
+		page.Cursor = next
+	}
+}
+
+// durationStats returns the median and p95 of the runs' durations.
+func durationStats(runs []*RunSummary) (median, p95 float64) {
+	durations := make([]float64, len(runs))
+	for i, run := range runs {
+		durations[i] = run.DurationMs
+	}
+	sort.Float64s(durations)
+	return sortedPercentile(durations, 0.5), sortedPercentile(durations, 0.95)
+}
+
+// buildTrends groups runs, oldest first, into one trend per impl, variant,
+// dataset and machine, with a point per commit. Given classOf, machines of
+// the same class share a trend.
+func buildTrends(runs []*RunSummary, classOf func(*RunSummary) string) []Trend {
+	type seriesKey struct{ scenario, impl, variant, dataset, machine, class string }
+	var keys []seriesKey
+	series := map[seriesKey]map[string][]*RunSummary{}
+	commits := map[seriesKey][]string{}
+	for _, run := range runs {
+		key := seriesKey{run.Scenario, run.Impl, run.Variant, run.Dataset, run.Machine, ""}
+		if classOf != nil {
+			key.machine, key.class = "", classOf(run)
+		}
+		if series[key] == nil {
+			series[key] = map[string][]*RunSummary{}
+			keys = append(keys, key)
+		}
+		if series[key][run.Commit] == nil {
+			commits[key] = append(commits[key], run.Commit)
+		}
+		series[key][run.Commit] = append(series[key][run.Commit], run)
+	}
+
+	trends := make([]Trend, 0, len(keys))
+	for _, key := range keys {
+		trend := Trend{Scenario: key.scenario, Impl: key.impl, Variant: key.variant, Dataset: key.dataset, Machine: key.machine, Class: key.class}
+		for _, commit := range commits[key] {
+			commitRuns := series[key][commit]
+			median, p95 := durationStats(commitRuns)
+			trend.Points = append(trend.Points, TrendPoint{
+				Commit:    commit,
+				FirstSeen: commitRuns[0].CreatedAt,
+				Runs:      len(commitRuns),
+				MedianMs:  median,
+				P95Ms:     p95,
+			})
+		}
+		trends = append(trends, trend)
+	}
+	sort.SliceStable(trends, func(i, j int) bool {
+		a, b := trends[i], trends[j]
+		if a.Impl != b.Impl {
+			return a.Impl < b.Impl
+		}
+		if a.Variant != b.Variant {
+			return a.Variant < b.Variant
+		}
+		if a.Dataset != b.Dataset {
+			return a.Dataset < b.Dataset
+		}
+		if a.Class != b.Class {
+			return a.Class < b.Class
+		}
+		return a.Machine < b.Machine
+	})
+	return trends
+}
+
+// buildLeaderboard ranks impl/variant pairs by their median duration over
+// runs, oldest first. Given classOf, each class of machines ranks the pairs
+// apart.
+func buildLeaderboard(runs []*RunSummary, classOf func(*RunSummary) string) []LeaderboardEntry {
+	type pair struct{ impl, variant, class string }
+	groups := map[pair][]*RunSummary{}
+	for _, run := range runs {
+		key := pair{run.Impl, run.Variant, ""}
+		if classOf != nil {
+			key.class = classOf(run)
+		}
+		groups[key] = append(groups[key], run)
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(groups))
+	for key, group := range groups {
+		machines := map[string]bool{}
+		best := group[0].DurationMs
+		for _, run := range group {
+			machines[run.Machine] = true
+			if run.DurationMs < best {
+				best = run.DurationMs
+			}
+		}
+		median, p95 := durationStats(group)
+		entries = append(entries, LeaderboardEntry{
+			Impl:       key.impl,
+			Variant:    key.variant,
+			Class:      key.class,
+			Runs:       len(group),
+			Machines:   len(machines),
+			MedianMs:   median,
+			P95Ms:      p95,
+			BestMs:     best,
+			LastCommit: group[len(group)-1].Commit,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Class != b.Class {
+			return a.Class < b.Class
+		}
+		if a.MedianMs != b.MedianMs {
+			return a.MedianMs < b.MedianMs
+		}
+		return a.Impl+"/"+a.Variant < b.Impl+"/"+b.Variant
+	})
+	for i := range entries {
+		if i > 0 && entries[i].Class == entries[i-1].Class {
+			entries[i].Rank = entries[i-1].Rank + 1
+		} else {
+			entries[i].Rank = 1
+		}
+	}
+	return entries
+}
+
+func handleTrends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("scenario") == "" {
+		http.Error(w, "scenario is required", http.StatusBadRequest)
+		return
+	}
+
+	q, err := trendQuery(r, map[string]string{"valid": "true"})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by != "" && by != "machine" {
+		if err := validMachineClass(by); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	classOf, err := runClassOf(by)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	runs, err := timedRuns(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildTrends(runs, classOf))
+}
+
+func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	if params.Get("scenario") == "" || params.Get("dataset") == "" {
+		http.Error(w, "scenario and dataset are required", http.StatusBadRequest)
+		return
+	}
+
+	q, err := trendQuery(r, map[string]string{"valid": "true", "since": leaderboardWindow})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	by := params.Get("by")
+	if by != "" && by != "machine" {
+		if err := validMachineClass(by); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	classOf, err := runClassOf(by)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	runs, err := timedRuns(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Leaderboard{
+		Scenario: params.Get("scenario"),
+		Dataset:  params.Get("dataset"),
+		Since:    q.Since.UTC(),
+		Entries:  buildLeaderboard(runs, classOf),
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tunedSysctls are the knobs that move node benchmark results: writeback,
+// reclaim, scheduler and the network buffers peers talk through.
+var tunedSysctls = []string{
+	"vm.dirty_ratio",
+	"vm.dirty_background_ratio",
+	"vm.dirty_bytes",
+	"vm.dirty_background_bytes",
+	"vm.dirty_expire_centisecs",
+	"vm.dirty_writeback_centisecs",
+	"vm.swappiness",
+	"vm.vfs_cache_pressure",
+	"vm.overcommit_memory",
+	"vm.max_map_count",
+	"vm.zone_reclaim_mode",
+	"kernel.numa_balancing",
+	"fs.file-max",
+	"net.core.somaxconn",
+	"net.core.rmem_max",
+	"net.core.wmem_max",
+	"net.ipv4.tcp_congestion_control",
+}
+
+// tunedKernelConfig are build options with a visible effect on latency.
+var tunedKernelConfig = []string{"CONFIG_HZ", "CONFIG_PREEMPT", "CONFIG_PREEMPT_VOLUNTARY", "CONFIG_PREEMPT_NONE", "CONFIG_PREEMPT_DYNAMIC", "CONFIG_NO_HZ_FULL", "CONFIG_NO_HZ_IDLE"}
+
+func sysctlPath(name string) string {
+	return filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/"))
+}
+
+// readKernelConfig returns the selected options from /proc/config.gz or the
+// installed config of the running kernel.
+func readKernelConfig(release string) map[string]string {
+	var r io.Reader
+	if f, err := os.Open("/proc/config.gz"); err == nil {
+		defer f.Close()
+		if gz, err := gzip.NewReader(f); err == nil {
+			r = gz
+		}
+	}
+	if r == nil {
+		f, err := os.Open("/boot/config-" + release)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		r = f
+	}
+
+	wanted := map[string]bool{}
+	for _, option := range tunedKernelConfig {
+		wanted[option] = true
+	}
+	options := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && wanted[name] {
+			options[name] = value
+		}
+	}
+	return options
+}
+
+// bracketed returns the active choice of a sysfs list like
+// "mq-deadline [none] kyber".
+func bracketed(s string) string {
+	if i := strings.IndexByte(s, '['); i >= 0 {
+		if j := strings.IndexByte(s[i:], ']'); j > 0 {
+			return s[i+1 : i+j]
+		}
+	}
+	return s
+}
+
+// captureKernelTuning flattens the host's tuning into "kind.name" keys so
+// two runs' settings can be compared key by key.
+func captureKernelTuning(release string) map[string]string {
+	tuning := map[string]string{}
+
+	for _, name := range tunedSysctls {
+		if v := readTrimmed(sysctlPath(name)); v != "" {
+			tuning["sysctl."+name] = strings.Join(strings.Fields(v), " ")
+		}
+	}
+	sched, _ := filepath.Glob("/proc/sys/kernel/sched_*")
+	for _, path := range sched {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			tuning["sysctl.kernel."+filepath.Base(path)] = readTrimmed(path)
+		}
+	}
+
+	devices, _ := filepath.Glob("/sys/block/*")
+	for _, dev := range devices {
+		name := filepath.Base(dev)
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") {
+			continue
+		}
+		for _, attr := range []string{"scheduler", "read_ahead_kb", "nr_requests", "rotational"} {
+			if v := readTrimmed(filepath.Join(dev, "queue", attr)); v != "" {
+				tuning["block."+name+"."+attr] = bracketed(v)
+			}
+		}
+	}
+
+	if v := readTrimmed("/sys/kernel/mm/transparent_hugepage/enabled"); v != "" {
+		tuning["mm.transparent_hugepage"] = bracketed(v)
+	}
+	if v := readTrimmed("/sys/kernel/mm/transparent_hugepage/defrag"); v != "" {
+		tuning["mm.transparent_hugepage_defrag"] = bracketed(v)
+	}
+
+	governors := map[string]bool{}
+	policies, _ := filepath.Glob("/sys/devices/system/cpu/cpufreq/policy*/scaling_governor")
+	for _, path := range policies {
+		if v := readTrimmed(path); v != "" {
+			governors[v] = true
+		}
+	}
+	if len(governors) > 0 {
+		names := make([]string, 0, len(governors))
+		for g := range governors {
+			names = append(names, g)
+		}
+		sort.Strings(names)
+		tuning["cpu.governor"] = strings.Join(names, ",")
+	}
+	if v := readTrimmed("/sys/devices/system/cpu/smt/control"); v != "" {
+		tuning["cpu.smt"] = v
+	}
+
+	// BOOT_IMAGE and root= identify the install, not its tuning.
+	var params []string
+	for _, p := range strings.Fields(readTrimmed("/proc/cmdline")) {
+		if !strings.HasPrefix(p, "BOOT_IMAGE=") && !strings.HasPrefix(p, "root=") && !strings.HasPrefix(p, "initrd=") {
+			params = append(params, p)
+		}
+	}
+	if len(params) > 0 {
+		tuning["boot.cmdline"] = strings.Join(params, " ")
+	}
+
+	for name, value := range readKernelConfig(release) {
+		tuning["kconfig."+name] = value
+	}
+	return tuning
+}
+
+// TuningDifference is a setting that differs between two runs' hosts; a
+// missing value means the setting was not recorded for that run.
+type TuningDifference struct {
+	Setting string `json:"setting"`
+	A       string `json:"a"`
+	B       string `json:"b"`
+}
+
+func tuningDifferences(a, b *EnvironmentInfo) []TuningDifference {
+	if a == nil || b == nil {
+		return nil
+	}
+	var diffs []TuningDifference
+	// A different CPU outweighs any setting.
+	for _, d := range []TuningDifference{{"arch", a.Arch, b.Arch}, {"cpu_model", a.CPUModel, b.CPUModel}} {
+		if d.A != d.B {
+			diffs = append(diffs, d)
+		}
+	}
+	// So does a different or visibly more worn disk, or a differently
+	// mounted filesystem.
+	diffs = append(diffs, diskDifferences(a.Disks, b.Disks)...)
+	diffs = append(diffs, filesystemDifferences(a.Filesystem, b.Filesystem)...)
+	if a.KernelTuning == nil || b.KernelTuning == nil {
+		return diffs
+	}
+	for key, va := range a.KernelTuning {
+		if vb := b.KernelTuning[key]; vb != va {
+			diffs = append(diffs, TuningDifference{Setting: key, A: va, B: vb})
+		}
+	}
+	for key, vb := range b.KernelTuning {
+		if _, ok := a.KernelTuning[key]; !ok {
+			diffs = append(diffs, TuningDifference{Setting: key, B: vb})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Setting < diffs[j].Setting })
+	return diffs
+}
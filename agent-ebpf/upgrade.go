@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// An operator pushes a signed agent binary to the aggregator, which offers
+// it in its answer to the heartbeats of agents on that OS and architecture
+// running another version. Each agent downloads it, checks its SHA-256 and
+// its ed25519 signature against --upgrade-key, and once no session or job
+// is running or queued swaps its executable and restarts in place.
+
+// agentVersion is set at build time with -ldflags "-X main.agentVersion=...";
+// otherwise it is the VCS revision Go stamped into the binary.
+var agentVersion = ""
+
+func init() {
+	if agentVersion != "" {
+		return
+	}
+	agentVersion = "dev"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision != "" {
+		agentVersion = short(revision)
+		if modified == "true" {
+			agentVersion += "-dirty"
+		}
+	}
+}
+
+// upgradedEnv tells a restarted agent the version it was upgraded to. One
+// reporting another version was pushed under the wrong one, and is not
+// offered it again.
+const upgradedEnv = "CHAINBENCH_UPGRADED_TO"
+
+// signatureHeader carries a release's base64 ed25519 signature.
+const signatureHeader = "X-ChainBench-Signature"
+
+// maxReleaseBytes bounds an uploaded agent binary.
+const maxReleaseBytes = 512 << 20
+
+// upgradePoll is how often an agent with an upgrade downloaded checks
+// whether it is idle enough to restart.
+const upgradePoll = 5 * time.Second
+
+var releaseVersion = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// Release is an agent binary offered to one OS and architecture.
+type Release struct {
+	Version   string    `json:"version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (r *Release) platform() string {
+	return r.OS + "-" + r.Arch
+}
+
+// HeartbeatReply is the aggregator's answer to a heartbeat that it has an
+// upgrade for.
+type HeartbeatReply struct {
+	Upgrade *Release `json:"upgrade,omitempty"`
+}
+
+// parsePublicKey reads a base64 ed25519 public key.
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("not a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// parsePrivateKey reads a base64 ed25519 private key.
+func parsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("not a base64 ed25519 private key")
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// loadPublicKey reads the key file given to --upgrade-key.
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePublicKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// signedMessage is what a release's signature covers: its version,
+// platform and digest, so a signed binary cannot be offered as another
+// version or to another platform than it was pushed for.
+func (r *Release) signedMessage() []byte {
+	return []byte(fmt.Sprintf("chainbench-release v1\nversion %s\nos %s\narch %s\nsha256 %s\n",
+		r.Version, r.OS, r.Arch, r.SHA256))
+}
+
+// verifyRelease checks a binary against its release's digest and signature.
+func verifyRelease(key ed25519.PublicKey, rel *Release, binary []byte) error {
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != rel.SHA256 {
+		return fmt.Errorf("sha256 mismatch")
+	}
+	sig, err := base64.StdEncoding.DecodeString(rel.Signature)
+	if err != nil || !ed25519.Verify(key, rel.signedMessage(), sig) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// releaseShelf keeps the release offered to each platform on the
+// aggregator, under <dataDir>/upgrades: <os>-<arch>.json describes it and
+// <os>-<arch>.bin is the binary.
+type releaseShelf struct {
+	mu  sync.RWMutex
+	dir string
+	// key, if set, refuses uploads it did not sign.
+	key ed25519.PublicKey
+}
+
+var releases *releaseShelf
+
+func (s *releaseShelf) path(platform, ext string) string {
+	return filepath.Join(s.dir, platform+ext)
+}
+
+// put stores a release, replacing the platform's previous one.
+func (s *releaseShelf) put(rel *Release, binary []byte) error {
+	if s.key != nil {
+		if err := verifyRelease(s.key, rel, binary); err != nil {
+			return err
+		}
+	}
+	meta, err := json.MarshalIndent(rel, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	for ext, data := range map[string][]byte{".bin": binary, ".json": meta} {
+		path := s.path(rel.platform(), ext)
+		if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get returns the release offered to a platform, if any.
+func (s *releaseShelf) get(platform string) (*Release, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, err := os.ReadFile(s.path(platform, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rel Release
+	if err := json.Unmarshal(data, &rel); err != nil {
+		return nil, err
+	}
+	return &rel, nil
+}
+
+func (s *releaseShelf) list() ([]*Release, error) {
+	matches, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	list := []*Release{}
+	for _, path := range matches {
+		rel, err := s.get(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if rel != nil {
+			list = append(list, rel)
+		}
+	}
+	return list, nil
+}
+
+// remove withdraws a platform's release.
+func (s *releaseShelf) remove(platform string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ext := range []string{".json", ".bin"} {
+		if err := os.Remove(s.path(platform, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// offer returns the release an agent should upgrade to, if any.
+func (s *releaseShelf) offer(agent AgentState) *Release {
+	if s == nil || agent.OS == "" || agent.Arch == "" {
+		return nil
+	}
+	rel, err := s.get(agent.OS + "-" + agent.Arch)
+	if err != nil {
+		log.Printf("Upgrade offer for %s: %v", agent.Agent, err)
+		return nil
+	}
+	if rel == nil || rel.Version == agent.Version {
+		return nil
+	}
+	return rel
+}
+
+// handleUpgrade serves the aggregator's releases: POST /upgrade uploads one
+// (version, os and arch as parameters, the signature in its header), GET
+// /upgrade lists them, GET /upgrade/<os>-<arch> downloads one and DELETE
+// /upgrade/<os>-<arch> withdraws it.
+func handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	platform := strings.Trim(strings.TrimPrefix(r.URL.Path, "/upgrade"), "/")
+	if platform != "" && !releaseVersion.MatchString(platform) {
+		http.NotFound(w, r)
+		return
+	}
+	if (r.Method == http.MethodPost || r.Method == http.MethodDelete) && !requireLabWide(w, r) {
+		return
+	}
+	switch {
+	case platform == "" && r.Method == http.MethodGet:
+		list, err := releases.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case platform == "" && r.Method == http.MethodPost:
+		params := r.URL.Query()
+		rel := &Release{
+			Version:   params.Get("version"),
+			OS:        params.Get("os"),
+			Arch:      params.Get("arch"),
+			Signature: r.Header.Get(signatureHeader),
+			CreatedAt: time.Now().UTC(),
+		}
+		for name, value := range map[string]string{"version": rel.Version, "os": rel.OS, "arch": rel.Arch} {
+			if !releaseVersion.MatchString(value) {
+				http.Error(w, fmt.Sprintf("invalid %s %q", name, value), http.StatusBadRequest)
+				return
+			}
+		}
+		if rel.Signature == "" {
+			http.Error(w, signatureHeader+" is required", http.StatusBadRequest)
+			return
+		}
+		binary, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReleaseBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		sum := sha256.Sum256(binary)
+		rel.Size, rel.SHA256 = int64(len(binary)), hex.EncodeToString(sum[:])
+		if err := releases.put(rel, binary); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Upgrade: offering %s to %s agents", rel.Version, rel.platform())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rel)
+	case platform != "" && r.Method == http.MethodGet:
+		rel, err := releases.get(platform)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rel == nil {
+			http.Error(w, "no release for "+platform, http.StatusNotFound)
+			return
+		}
+		w.Header().Set(signatureHeader, rel.Signature)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		releases.mu.RLock()
+		defer releases.mu.RUnlock()
+		http.ServeFile(w, r, releases.path(platform, ".bin"))
+	case platform != "" && r.Method == http.MethodDelete:
+		if err := releases.remove(platform); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// upgrader applies releases the aggregator offers this agent, one at a
+// time.
+type upgrader struct {
+	aggregator string
+	key        ed25519.PublicKey
+	client     *http.Client
+
+	mu sync.Mutex
+	// pending is the version being downloaded or waiting to be swapped in.
+	pending string
+	// refused remembers versions that failed verification, so they are not
+	// fetched on every heartbeat.
+	refused map[string]bool
+	// drained is set while the upgrade holds the agent drained.
+	drained bool
+}
+
+var agentUpgrader *upgrader
+
+func newUpgrader(aggregator string, key ed25519.PublicKey) *upgrader {
+	u := &upgrader{
+		aggregator: strings.TrimRight(aggregator, "/"),
+		key:        key,
+		client:     &http.Client{Timeout: 10 * time.Minute},
+		refused:    map[string]bool{},
+	}
+	if version := os.Getenv(upgradedEnv); version != "" {
+		os.Unsetenv(upgradedEnv)
+		if version != agentVersion {
+			log.Printf("Upgrade: pushed as %s but reports %s; not applying %s again", version, agentVersion, version)
+			u.refused[version] = true
+		} else {
+			log.Printf("Upgrade: now running %s", agentVersion)
+		}
+	}
+	return u
+}
+
+// offered starts applying rel unless it is already under way or refused.
+func (u *upgrader) offered(rel *Release) {
+	if rel.OS != runtime.GOOS || rel.Arch != runtime.GOARCH || rel.Version == agentVersion {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pending != "" || u.refused[rel.Version] {
+		return
+	}
+	if u.key == nil {
+		log.Printf("Upgrade: %s offered, but no --upgrade-key to verify it with", rel.Version)
+		u.refused[rel.Version] = true
+		return
+	}
+	u.pending = rel.Version
+	go func() {
+		if err := u.apply(rel); err != nil {
+			log.Printf("Upgrade to %s failed: %v", rel.Version, err)
+			u.mu.Lock()
+			u.pending = ""
+			u.refused[rel.Version] = true
+			u.mu.Unlock()
+		}
+	}()
+}
+
+// apply downloads and verifies rel, waits until the agent is idle, swaps
+// the executable and restarts. It only returns on failure.
+func (u *upgrader) apply(rel *Release) error {
+	url := u.aggregator + "/upgrade/" + rel.platform()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	authorize(req)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	binary, err := io.ReadAll(io.LimitReader(resp.Body, maxReleaseBytes))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := verifyRelease(u.key, rel, binary); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	staged := filepath.Join(filepath.Dir(exe), "."+filepath.Base(exe)+".new")
+	if err := os.WriteFile(staged, binary, 0o755); err != nil {
+		return err
+	}
+	log.Printf("Upgrade: %s verified, restarting once idle", rel.Version)
+
+	for !u.idle() {
+		time.Sleep(upgradePoll)
+	}
+	if err := os.Rename(exe, exe+".old"); err != nil {
+		os.Remove(staged)
+		u.undrain()
+		return err
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		os.Rename(exe+".old", exe)
+		u.undrain()
+		return err
+	}
+	log.Printf("Upgrade: restarting as %s (previous binary kept as %s.old)", rel.Version, exe)
+	if err := restartAgent(exe, rel.Version); err != nil {
+		os.Rename(exe+".old", exe)
+		u.undrain()
+		return err
+	}
+	return nil
+}
+
+// idle reports whether the agent can restart without losing work: no
+// session or job is running or queued. An active agent is drained for the
+// check, so no work sneaks in between it and the restart; it stays drained
+// when idle.
+func (u *upgrader) idle() bool {
+	if s := admin.status(); s.Busy || s.Queued > 0 {
+		return false
+	}
+	if admin.status().Mode != modeActive {
+		return true
+	}
+	admin.set(modeDraining, "upgrading")
+	u.drained = true
+	if s := admin.status(); s.Busy || s.Queued > 0 {
+		u.undrain()
+		return false
+	}
+	return true
+}
+
+// undrain returns the agent to active if the upgrade drained it.
+func (u *upgrader) undrain() {
+	if u.drained {
+		admin.set(modeActive, "")
+		u.drained = false
+	}
+}
+
+func newUpgradeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Sign agent binaries and push them to an aggregator for the fleet",
+	}
+
+	var out string
+	keygen := &cobra.Command{
+		Use:   "keygen",
+		Short: "Create an ed25519 signing key pair (<out> and <out>.pub)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			public, private, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(out, []byte(base64.StdEncoding.EncodeToString(private)+"\n"), 0o600); err != nil {
+				return err
+			}
+			if err := os.WriteFile(out+".pub", []byte(base64.StdEncoding.EncodeToString(public)+"\n"), 0o644); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "wrote %s and %s.pub; give agents --upgrade-key %s.pub\n", out, out, out)
+			return nil
+		},
+	}
+	keygen.Flags().StringVarP(&out, "output", "o", "upgrade.key", "Private key file")
+
+	var (
+		agent, key, version, goos, goarch string
+	)
+	push := &cobra.Command{
+		Use:   "push <binary>",
+		Short: "Sign a binary and offer it to the aggregator's agents on its OS and architecture",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyData, err := os.ReadFile(key)
+			if err != nil {
+				return err
+			}
+			private, err := parsePrivateKey(string(keyData))
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			binary, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			if err := requireFeature(cmd.Context(), agent, "upgrade"); err != nil {
+				return err
+			}
+			sum := sha256.Sum256(binary)
+			signed := &Release{Version: version, OS: goos, Arch: goarch, SHA256: hex.EncodeToString(sum[:])}
+			url := fmt.Sprintf("%s/upgrade?version=%s&os=%s&arch=%s", strings.TrimSuffix(agent, "/"), version, goos, goarch)
+			req, err := http.NewRequestWithContext(cmd.Context(), http.MethodPost, url, bytes.NewReader(binary))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(private, signed.signedMessage())))
+			authorize(req)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+			}
+			var rel Release
+			if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "offering %s to %s agents (sha256 %s)\n", rel.Version, rel.platform(), rel.SHA256)
+			return nil
+		},
+	}
+	push.Flags().StringVar(&agent, "agent", "http://localhost:9090", "Aggregator the fleet heartbeats to")
+	push.Flags().StringVar(&key, "key", "upgrade.key", "Private key to sign with")
+	push.Flags().StringVar(&version, "version", "", "Version the binary reports (its -X main.agentVersion)")
+	push.Flags().StringVar(&goos, "os", runtime.GOOS, "OS the binary is for")
+	push.Flags().StringVar(&goarch, "arch", runtime.GOARCH, "Architecture the binary is for")
+	push.MarkFlagRequired("version")
+
+	cmd.AddCommand(keygen, push)
+	return cmd
+}
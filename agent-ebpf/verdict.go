@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A comparison's verdict says what the numbers are worth: whether B
+// improved on A or regressed, or neither, or whether the two cannot be
+// compared at all. Its reason says why.
+const (
+	comparisonImproved  = "improved"
+	comparisonRegressed = "regressed"
+	comparisonNeutral   = "neutral"
+	comparisonInvalid   = "invalid"
+
+	reasonSignificant         = "significant"
+	reasonBelowNoiseFloor     = "below-noise-floor"
+	reasonInsufficientSamples = "insufficient-samples"
+	reasonEnvironmentMismatch = "environment-mismatch"
+	reasonInvalidRun          = "invalid-run"
+)
+
+// gainMinSamples is how many successful runs each side of a gain needs for
+// its interval to mean anything.
+const gainMinSamples = 3
+
+var comparisonVerdict = newGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chainbench_comparison_verdict",
+		Help: "Verdict of the latest comparison of each series (1 for the current verdict and reason)",
+	},
+	[]string{"scenario", "impl", "variant", "commit", "machine", "dataset", "project", "verdict", "reason"},
+)
+
+// recordVerdict makes verdict and reason the series' current ones.
+func recordVerdict(scenario, impl, variant, commit, machine, dataset, project, verdict, reason string) {
+	comparisonVerdict.DeletePartialMatch(prometheus.Labels{
+		"scenario": scenario, "impl": impl, "variant": variant, "commit": commit, "machine": machine, "dataset": dataset, "project": project,
+	})
+	comparisonVerdict.WithLabelValues(scenario, impl, variant, commit, machine, dataset, project, verdict, reason).Set(1)
+}
+
+// benchmarkMs is the run's benchmark duration: the workload's own time
+// where the agent launched it, else the collection window.
+func benchmarkMs(run *Run) float64 {
+	if run.Evidence != nil && run.Evidence.WorkloadMs > 0 {
+		return run.Evidence.WorkloadMs
+	}
+	return run.DurationMs
+}
+
+// usableRun reports whether a run's numbers can be compared at all: it
+// succeeded and its clock did not step.
+func usableRun(run *Run) bool {
+	e := run.Evidence
+	return e != nil && runResult(e) == resultSuccess && (e.Clock == nil || !e.Clock.Invalid) &&
+		(e.Swap == nil || !e.Swap.Invalid)
+}
+
+// sameEnvironment reports whether two runs measured the same thing on like
+// hardware: the same dataset, architecture, CPU model, disks, data
+// filesystem and kernel tuning.
+func sameEnvironment(a, b *Run) bool {
+	if a.Dataset != b.Dataset {
+		return false
+	}
+	ea, eb := a.Environment, b.Environment
+	if ea == nil || eb == nil {
+		return true
+	}
+	if ea.Arch != eb.Arch || (ea.CPUModel != "" && eb.CPUModel != "" && ea.CPUModel != eb.CPUModel) {
+		return false
+	}
+	return len(tuningDifferences(ea, eb)) == 0
+}
+
+// judgeRuns gives the verdict on B's benchmark duration against A's, where
+// a change smaller than thresholdPct is within the noise.
+func judgeRuns(a, b *Run, thresholdPct float64) (verdict, reason string) {
+	switch {
+	case !usableRun(a) || !usableRun(b):
+		return comparisonInvalid, reasonInvalidRun
+	case !sameEnvironment(a, b):
+		return comparisonInvalid, reasonEnvironmentMismatch
+	}
+	da, db := benchmarkMs(a), benchmarkMs(b)
+	if da <= 0 || db <= 0 {
+		return comparisonNeutral, reasonInsufficientSamples
+	}
+	change := (db - da) / da * 100
+	switch {
+	case math.Abs(change) < thresholdPct:
+		return comparisonNeutral, reasonBelowNoiseFloor
+	case change < 0:
+		return comparisonImproved, reasonSignificant
+	}
+	return comparisonRegressed, reasonSignificant
+}
+
+// judgeGain gives the verdict on a gain between two run sets: significant
+// when its confidence interval leaves out zero.
+func judgeGain(g *GainReport, baseline, optimized []*Run) (verdict, reason string) {
+	runs := append(append([]*Run(nil), baseline...), optimized...)
+	for _, run := range runs[1:] {
+		if run.Machine != runs[0].Machine || !sameEnvironment(runs[0], run) {
+			return comparisonInvalid, reasonEnvironmentMismatch
+		}
+	}
+	switch {
+	case len(baseline) < gainMinSamples || len(optimized) < gainMinSamples:
+		return comparisonNeutral, reasonInsufficientSamples
+	case *g.CILowPct > 0:
+		return comparisonImproved, reasonSignificant
+	case *g.CIHighPct < 0:
+		return comparisonRegressed, reasonSignificant
+	}
+	return comparisonNeutral, reasonBelowNoiseFloor
+}
@@ -0,0 +1,149 @@
+const selected = new Set();
+const pageSize = 100;
+let pages = 1;
+
+// With --tokens every call needs the token, which is kept for the tab's
+// session only.
+const tokenKey = 'chainbench-token';
+
+function api(url) {
+  const token = sessionStorage.getItem(tokenKey);
+  return fetch(url, token ? {headers: {Authorization: `Bearer ${token}`}} : {});
+}
+
+async function getJSON(url) {
+  const resp = await api(url);
+  if (!resp.ok) throw new Error(`${url}: ${resp.status}`);
+  return resp.json();
+}
+
+// showDetail loads an HTML report into the detail pane; the frame cannot
+// send the token itself.
+async function showDetail(url) {
+  const frame = document.getElementById('detail');
+  const resp = await api(url);
+  if (!resp.ok) {
+    frame.srcdoc = `<p>${url}: ${resp.status}</p>`;
+    return;
+  }
+  frame.srcdoc = await resp.text();
+}
+
+async function refreshStatus() {
+  const el = document.getElementById('status');
+  try {
+    const s = await getJSON('/status');
+    if (s.running) {
+      el.textContent = `● collecting: ${s.scenario} ${s.impl}/${s.variant} on ${s.machine}`;
+      el.className = 'status running';
+    } else {
+      el.textContent = `idle on ${s.machine}`;
+      el.className = 'status';
+    }
+  } catch (err) {
+    el.textContent = err.message.endsWith(': 401') ? 'token required' : 'agent unreachable';
+    el.className = 'status';
+  }
+}
+
+function cell(text) {
+  const td = document.createElement('td');
+  td.textContent = text || '';
+  return td;
+}
+
+function showRun(id, row) {
+  document.querySelectorAll('#runs tr').forEach(tr => tr.classList.remove('active'));
+  row.classList.add('active');
+  showDetail(`/runs/${encodeURIComponent(id)}/report.html?inline=1`);
+}
+
+function runsQuery() {
+  const params = new URLSearchParams({limit: pageSize});
+  for (const tag of document.getElementById('tag-filter').value.split(/\s+/)) {
+    if (tag) params.append('tag', tag);
+  }
+  return params;
+}
+
+// fetchRuns returns the first `pages` pages of runs, following the cursor
+// GET /runs puts in X-Next-Cursor, and whether more remain.
+async function fetchRuns() {
+  const params = runsQuery();
+  const runs = [];
+  for (let i = 0; i < pages; i++) {
+    const resp = await api(`/runs?${params}`);
+    if (!resp.ok) throw new Error(`/runs: ${resp.status}`);
+    runs.push(...await resp.json());
+    const next = resp.headers.get('X-Next-Cursor');
+    if (!next) return {runs, more: false};
+    params.set('cursor', next);
+  }
+  return {runs, more: true};
+}
+
+async function refreshRuns() {
+  const {runs, more} = await fetchRuns();
+  document.getElementById('more').hidden = !more;
+  const body = document.getElementById('runs');
+  body.replaceChildren();
+
+  for (const run of runs) {
+    const tr = document.createElement('tr');
+    const box = document.createElement('input');
+    box.type = 'checkbox';
+    box.checked = selected.has(run.id);
+    box.addEventListener('click', ev => {
+      ev.stopPropagation();
+      box.checked ? selected.add(run.id) : selected.delete(run.id);
+      document.getElementById('compare').disabled = selected.size !== 2;
+    });
+    const tdBox = document.createElement('td');
+    tdBox.appendChild(box);
+
+    tr.append(
+      tdBox,
+      cell(run.id),
+      cell(run.scenario),
+      cell(`${run.impl} / ${run.variant}`),
+      cell((run.commit || '').slice(0, 10)),
+      cell(run.dataset),
+      cell(Object.entries(run.tags || {}).map(([k, v]) => `${k}=${v}`).join(' ')),
+      cell(new Date(run.created_at).toLocaleString()),
+    );
+    tr.addEventListener('click', () => showRun(run.id, tr));
+    body.appendChild(tr);
+  }
+}
+
+document.getElementById('compare').addEventListener('click', () => {
+  const [a, b] = [...selected];
+  showDetail(`/compare?a=${encodeURIComponent(a)}&b=${encodeURIComponent(b)}&format=html`);
+});
+
+const tokenInput = document.getElementById('token');
+tokenInput.value = sessionStorage.getItem(tokenKey) || '';
+tokenInput.addEventListener('change', () => {
+  if (tokenInput.value) {
+    sessionStorage.setItem(tokenKey, tokenInput.value);
+  } else {
+    sessionStorage.removeItem(tokenKey);
+  }
+  refreshStatus();
+  refreshRuns();
+});
+
+document.getElementById('tag-filter').addEventListener('change', () => {
+  pages = 1;
+  refreshRuns();
+});
+
+document.getElementById('more').addEventListener('click', () => {
+  pages++;
+  refreshRuns();
+});
+
+refreshStatus();
+refreshRuns();
+setInterval(refreshStatus, 2000);
+setInterval(refreshRuns, 10000);
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// WritebackData is the kernel's writeback of dirty pages during the window:
+// the flusher threads' passes over each backing device, how long they took
+// and how much they wrote, and how long the target's own writers were
+// throttled for dirtying pages faster than they were written. A burst of
+// background writeback is a common cause of the biolatency tail.
+type WritebackData struct {
+	Devices []WritebackDevice `json:"devices"`
+	// Reasons counts the writeback passes by why they ran: background,
+	// periodic, sync, vmscan and so on.
+	Reasons map[string]int `json:"reasons,omitempty"`
+	// Throttles and ThrottledMs are the target's pauses in
+	// balance_dirty_pages, and their total length.
+	Throttles   int     `json:"throttles"`
+	ThrottledMs float64 `json:"throttled_ms"`
+}
+
+// WritebackDevice is the writeback to one backing device. Device is the
+// disk's name where it has one, or the bdi's major:minor otherwise.
+type WritebackDevice struct {
+	Device       string            `json:"device"`
+	Passes       int               `json:"passes"`
+	Pages        uint64            `json:"pages"`
+	WrittenBytes uint64            `json:"written_bytes"`
+	Histogram    []HistogramBucket `json:"histogram"`
+	P95Us        float64           `json:"p95_us"`
+}
+
+// writebackReasons are the kernel's enum wb_reason, in order.
+var writebackReasons = []string{
+	"background", "vmscan", "sync", "periodic", "laptop_timer", "fs_free_space", "forker_thread", "foreign_flush",
+}
+
+// bdiDevice names the disk behind a bdi, which the writeback tracepoints
+// name by its major:minor.
+func bdiDevice(bdi string) string {
+	if target, err := os.Readlink(filepath.Join("/sys/dev/block", bdi)); err == nil {
+		return filepath.Base(target)
+	}
+	return bdi
+}
+
+func (c *EvidenceCollector) collectWriteback(out *bpftraceOutput) *WritebackData {
+	data := &WritebackData{
+		Devices:     []WritebackDevice{},
+		Throttles:   int(out.maps["dirty_throttled"][""]),
+		ThrottledMs: out.maps["dirty_throttle_ms"][""],
+	}
+	bdis := map[string]bool{}
+	for bdi := range out.keyedHists["writeback_usecs"] {
+		bdis[bdi] = true
+	}
+	for bdi := range out.maps["writeback_pages"] {
+		bdis[bdi] = true
+	}
+	page := uint64(os.Getpagesize())
+	for bdi := range bdis {
+		hist := out.keyedHists["writeback_usecs"][bdi]
+		d := WritebackDevice{
+			Device:    bdiDevice(bdi),
+			Pages:     uint64(out.maps["writeback_pages"][bdi]),
+			Histogram: hist,
+			P95Us:     histogramPercentile(hist, 0.95),
+		}
+		d.WrittenBytes = d.Pages * page
+		for _, bucket := range hist {
+			d.Passes += bucket.Count
+		}
+		data.Devices = append(data.Devices, d)
+	}
+	sort.Slice(data.Devices, func(i, j int) bool { return data.Devices[i].Device < data.Devices[j].Device })
+	for key, n := range out.maps["writeback_reasons"] {
+		reason := key
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(writebackReasons) {
+			reason = writebackReasons[i]
+		}
+		if data.Reasons == nil {
+			data.Reasons = map[string]int{}
+		}
+		data.Reasons[reason] += int(n)
+	}
+	observer := writebackHistogram.WithLabelValues(c.scenario, c.impl, c.variant, c.commit, c.machine, c.dataset, c.project)
+	for _, bucket := range out.hists["writeback_usecs"] {
+		for i := 0; i < bucket.Count; i++ {
+			observer.Observe(float64(bucket.BucketUs))
+		}
+	}
+	return data
+}